@@ -0,0 +1,5 @@
+// Package godbpb is the gRPC API of `godb serve -grpc`, generated from
+// godb.proto. clients in other languages are generated from the same file.
+package godbpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative godb.proto
@@ -0,0 +1,97 @@
+//go:build badger
+
+package main
+
+import (
+	"errors"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"godb/internal/bench"
+)
+
+func init() {
+	engines["badger"] = openBadger
+}
+
+// writes are synced like the other engines, SyncWrites. a read-modify-write
+// that conflicts with another one is retried.
+type badgerEngine struct {
+	db *badger.DB
+}
+
+func openBadger(dir string) (engine, error) {
+	db, err := badger.Open(badger.DefaultOptions(dir).WithSyncWrites(true).WithLogger(nil))
+	if err != nil {
+		return nil, err
+	}
+	return badgerEngine{db}, nil
+}
+
+func (e badgerEngine) Load(keys, vals [][]byte) error {
+	wb := e.db.NewWriteBatch()
+	defer wb.Cancel()
+	for i := range keys {
+		if err := wb.Set(keys[i], vals[i]); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+func (e badgerEngine) Read(key []byte) error {
+	return e.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return bench.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		// the value can be in the value log, read it like the others do
+		return item.Value(func([]byte) error { return nil })
+	})
+}
+
+func (e badgerEngine) Update(key, val []byte) error {
+	return e.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, val)
+	})
+}
+
+func (e badgerEngine) Scan(start []byte, n int) error {
+	return e.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchSize = n
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		i := 0
+		for it.Seek(start); it.Valid() && i < n; it.Next() {
+			if err := it.Item().Value(func([]byte) error { return nil }); err != nil {
+				return err
+			}
+			i++
+		}
+		return nil
+	})
+}
+
+func (e badgerEngine) ReadModifyWrite(key, val []byte) error {
+	for {
+		err := e.db.Update(func(txn *badger.Txn) error {
+			if _, err := txn.Get(key); errors.Is(err, badger.ErrKeyNotFound) {
+				return bench.ErrNotFound
+			} else if err != nil {
+				return err
+			}
+			return txn.Set(key, val)
+		})
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+}
+
+func (e badgerEngine) Close() error {
+	return e.db.Close()
+}
@@ -0,0 +1,90 @@
+//go:build bbolt
+
+package main
+
+import (
+	"path/filepath"
+
+	bolt "go.etcd.io/bbolt"
+
+	"godb/internal/bench"
+)
+
+func init() {
+	engines["bbolt"] = openBolt
+}
+
+var boltBucket = []byte("bench")
+
+// the keys are in one bucket, every update transaction is fsynced
+type boltEngine struct {
+	db *bolt.DB
+}
+
+func openBolt(dir string) (engine, error) {
+	db, err := bolt.Open(filepath.Join(dir, "bolt.db"), 0o600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return boltEngine{db}, nil
+}
+
+func (e boltEngine) Load(keys, vals [][]byte) error {
+	return e.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		for i := range keys {
+			if err := b.Put(keys[i], vals[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e boltEngine) Read(key []byte) error {
+	return e.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltBucket).Get(key) == nil {
+			return bench.ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (e boltEngine) Update(key, val []byte) error {
+	return e.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(key, val)
+	})
+}
+
+func (e boltEngine) Scan(start []byte, n int) error {
+	return e.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		i := 0
+		for k, _ := c.Seek(start); k != nil && i < n; k, _ = c.Next() {
+			i++
+		}
+		return nil
+	})
+}
+
+func (e boltEngine) ReadModifyWrite(key, val []byte) error {
+	return e.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		if b.Get(key) == nil {
+			return bench.ErrNotFound
+		}
+		return b.Put(key, val)
+	})
+}
+
+func (e boltEngine) Close() error {
+	return e.db.Close()
+}
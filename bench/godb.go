@@ -0,0 +1,30 @@
+package main
+
+import (
+	"path/filepath"
+
+	"godb/internal/bench"
+	"godb/internal/storage/index/btree"
+)
+
+func init() {
+	engines["godb"] = openGodb
+}
+
+type godbEngine struct {
+	bench.DB
+	kv *btree.KV
+}
+
+// every Set and commit waits for its fsync, like the other engines
+func openGodb(dir string) (engine, error) {
+	kv := &btree.KV{Path: filepath.Join(dir, "godb.db")}
+	if err := kv.Open(); err != nil {
+		return nil, err
+	}
+	return godbEngine{DB: bench.KV(kv), kv: kv}, nil
+}
+
+func (e godbEngine) Close() error {
+	return e.kv.Close()
+}
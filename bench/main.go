@@ -0,0 +1,212 @@
+// Command bench runs the workloads of godb/internal/bench against godb and
+// other embedded engines and prints a report to compare them. it's a module
+// of its own so godb doesn't depend on the other engines, and they are
+// built in with build tags:
+//
+//	go run -tags bbolt,badger . -workloads a,c,e -records 1000000
+//
+// every engine gets a new directory, the same keys, values and seed, and
+// syncs its writes to disk like godb does.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"godb/internal/bench"
+)
+
+type engine interface {
+	bench.DB
+	Close() error
+}
+
+// the engines built in, see the build tags of their files
+var engines = map[string]func(dir string) (engine, error){}
+
+// the result of a workload on an engine
+type Report struct {
+	Engine     string
+	Workload   string
+	Load       time.Duration // of the records
+	Records    int
+	Ops        int
+	Elapsed    time.Duration
+	Throughput float64 // operations per second
+	Stats      map[string]bench.OpStats
+}
+
+const usage = `usage: bench [-engines godb,bbolt,badger] [-workloads a,b,c,d,e,f] [-records n]
+             [-ops n | -duration d] [-value bytes] [-scan-length n]
+             [-concurrency n] [-seed n] [-dir dir] [-json]
+
+runs the YCSB like workloads of godb bench on every engine and prints the
+throughput and the latency percentiles side by side. engines other than
+godb are built in with the build tags bbolt and badger.
+`
+
+func main() {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	names := fs.String("engines", "", "engines to compare, all the ones built in if empty")
+	workloads := fs.String("workloads", "a,b,c,d,e,f", "YCSB core workloads")
+	records := fs.Int("records", 100000, "keys loaded")
+	ops := fs.Int("ops", 100000, "operations run")
+	duration := fs.Duration("duration", 0, "run time instead of -ops")
+	valueSize := fs.Int("value", 100, "bytes of the values")
+	scanLength := fs.Int("scan-length", 100, "keys read by a scan")
+	concurrency := fs.Int("concurrency", 8, "workers")
+	seed := fs.Int64("seed", 1, "seed of the random numbers")
+	dir := fs.String("dir", "", "directory of the database files, a temporary one if empty")
+	asJSON := fs.Bool("json", false, "print the reports as JSON")
+	fs.Parse(os.Args[1:])
+
+	w := bench.Workload{
+		Records: *records, Ops: *ops, ValueSize: *valueSize, ScanLength: *scanLength,
+		Concurrency: *concurrency, Seed: *seed,
+	}
+	if *duration > 0 {
+		w.Ops, w.Duration = 0, *duration
+	}
+	reports, err := compare(*dir, engineNames(*names), strings.Split(*workloads, ","), w)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bench:", err)
+		os.Exit(1)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(reports)
+		return
+	}
+	printReports(os.Stdout, reports)
+}
+
+// the engines of the flag, godb first
+func engineNames(flag string) []string {
+	if flag != "" {
+		return strings.Split(flag, ",")
+	}
+	var names []string
+	for name := range engines {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	if i := slices.Index(names, "godb"); i > 0 {
+		names = slices.Insert(slices.Delete(names, i, i+1), 0, "godb")
+	}
+	return names
+}
+
+// runs every workload on every engine, the sizes of `w` and the mix and
+// distribution of the workload
+func compare(dir string, names, workloads []string, w bench.Workload) ([]Report, error) {
+	for _, name := range names {
+		if engines[name] == nil {
+			return nil, fmt.Errorf("engine %s is not built in", name)
+		}
+	}
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "godb-compare")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	}
+	var reports []Report
+	for _, wname := range workloads {
+		core, ok := bench.Workloads[wname]
+		if !ok {
+			return nil, fmt.Errorf("bad workload %s", wname)
+		}
+		w.Mix, w.Dist = core.Mix, core.Dist
+		for _, name := range names {
+			r, err := runEngine(filepath.Join(dir, wname+"-"+name), name, w)
+			if err != nil {
+				return nil, fmt.Errorf("%s on %s: %w", wname, name, err)
+			}
+			r.Workload = wname
+			reports = append(reports, *r)
+		}
+	}
+	return reports, nil
+}
+
+// loads and runs the workload on a new database of the engine in `dir`,
+// removed at the end
+func runEngine(dir, name string, w bench.Workload) (*Report, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	db, err := engines[name](dir)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	load, err := bench.Load(db, w)
+	if err != nil {
+		return nil, err
+	}
+	res, err := bench.Run(db, w)
+	if err != nil {
+		return nil, err
+	}
+	r := &Report{
+		Engine: name, Load: load, Records: w.Records,
+		Ops: res.Ops, Elapsed: res.Elapsed, Throughput: res.Throughput(),
+		Stats: map[string]bench.OpStats{},
+	}
+	for op, s := range res.Stats {
+		if s.Count > 0 {
+			r.Stats[bench.OpNames[op]] = s
+		}
+	}
+	return r, nil
+}
+
+// the throughput of every engine relative to the first one of the
+// workload, then the latencies of every operation
+func printReports(out io.Writer, reports []Report) {
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "workload\tengine\tload keys/s\tops/s\trelative")
+	first := map[string]float64{}
+	for _, r := range reports {
+		if _, ok := first[r.Workload]; !ok {
+			first[r.Workload] = r.Throughput
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.0f\t%.0f\t%.2fx\n", r.Workload, r.Engine,
+			float64(r.Records)/r.Load.Seconds(), r.Throughput, r.Throughput/first[r.Workload])
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "workload\top\tengine\tcount\terrors\tmean\tp50\tp95\tp99\tmax")
+	for _, r := range reports {
+		for _, op := range bench.OpNames {
+			s, ok := r.Stats[op]
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%v\t%v\t%v\t%v\t%v\n", r.Workload, op, r.Engine, s.Count, s.Errors,
+				round(s.Mean), round(s.P50), round(s.P95), round(s.P99), round(s.Max))
+		}
+	}
+	tw.Flush()
+}
+
+// 3 significant digits
+func round(d time.Duration) time.Duration {
+	unit := time.Duration(1)
+	for d/unit >= 1000 {
+		unit *= 10
+	}
+	return d.Round(unit)
+}
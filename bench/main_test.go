@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"godb/internal/bench"
+)
+
+func TestCompare(t *testing.T) {
+	names := engineNames("")
+	if names[0] != "godb" {
+		t.Fatalf("engines %v", names)
+	}
+	w := bench.Workload{Records: 2000, Ops: 300, ValueSize: 100, ScanLength: 10, Concurrency: 4, Seed: 1}
+	reports, err := compare(t.TempDir(), names, []string{"a", "e", "f"}, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 3*len(names) {
+		t.Fatalf("%d reports", len(reports))
+	}
+	for _, r := range reports {
+		if r.Ops != 300 || r.Throughput <= 0 || r.Load <= 0 {
+			t.Fatalf("%+v", r)
+		}
+		for op, s := range r.Stats {
+			if s.Errors != 0 {
+				t.Fatalf("%s on %s: %d %s errors", r.Workload, r.Engine, s.Errors, op)
+			}
+		}
+	}
+	var out bytes.Buffer
+	printReports(&out, reports)
+	if !strings.Contains(out.String(), "1.00x") {
+		t.Fatalf("report:\n%s", out.String())
+	}
+
+	if _, err := compare(t.TempDir(), []string{"nosuch"}, []string{"a"}, w); err == nil {
+		t.Fatal("an engine that isn't built in")
+	}
+}
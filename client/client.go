@@ -0,0 +1,465 @@
+// Package client talks to a godb server, see `godb serve`.
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"godb/internal/table"
+	"godb/internal/wire"
+)
+
+// the error reported by the server, the request was not applied
+var ErrServer = errors.New("server error")
+
+// a request on a connection that streams a watch or the changefeed
+var ErrWatching = errors.New("the connection is streaming")
+
+// Client is a connection to the server. a connection is a session: Begin
+// opens a transaction that the following requests run in until Commit or
+// Rollback, other requests are applied one by one. requests are
+// serialized, a Client can be shared by goroutines outside of transactions.
+type Client struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	watching bool
+}
+
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn), nil
+}
+
+// connects to a server with TLS, see `godb serve -tls-cert`. the config
+// holds the trusted CAs and the client certificate if the server asks for one.
+func DialTLS(addr string, cfg *tls.Config) (*Client, error) {
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn), nil
+}
+
+func newClient(conn net.Conn) *Client {
+	return &Client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+}
+
+// closes the connection, the open transaction is rolled back
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// sends the request and returns the status and the data of the response
+func (c *Client) call(req []byte) (byte, *wire.Reader, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.watching {
+		return 0, nil, ErrWatching
+	}
+	if err := wire.WriteFrame(c.w, req); err != nil {
+		return 0, nil, err
+	}
+	resp, err := wire.ReadFrame(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	r := wire.NewReader(resp)
+	status := r.Byte()
+	if status == wire.STATUS_ERR {
+		return status, nil, fmt.Errorf("%w: %s", ErrServer, r.Rest())
+	}
+	return status, r, nil
+}
+
+func (c *Client) Get(key []byte) ([]byte, bool, error) {
+	status, r, err := c.call(wire.AppendBytes([]byte{wire.OP_GET}, key))
+	if err != nil || status == wire.STATUS_NOT_FOUND {
+		return nil, false, err
+	}
+	return r.Rest(), true, nil
+}
+
+func (c *Client) Set(key, val []byte) error {
+	req := wire.AppendBytes([]byte{wire.OP_SET}, key)
+	_, r, err := c.call(wire.AppendBytes(req, val))
+	if err != nil {
+		return err
+	}
+	return r.Done()
+}
+
+// deletes the key, false if it did not exist
+func (c *Client) Del(key []byte) (bool, error) {
+	_, r, err := c.call(wire.AppendBytes([]byte{wire.OP_DEL}, key))
+	if err != nil {
+		return false, err
+	}
+	deleted := r.Byte() == 1
+	return deleted, r.Done()
+}
+
+// calls `fn` for keys in [start, end) in order until it returns false,
+// nil `end` means up to the last key. pairs are fetched in batches,
+// outside of a transaction every batch reads the latest version.
+func (c *Client) Scan(start, end []byte, fn func(key, val []byte) bool) error {
+	for {
+		req := wire.AppendBytes([]byte{wire.OP_SCAN}, start)
+		req = wire.AppendBytes(req, end)
+		_, r, err := c.call(wire.AppendUint32(req, 0))
+		if err != nil {
+			return err
+		}
+		more := r.Byte() == 1
+		n := r.Uint32()
+		var last []byte
+		for i := uint32(0); i < n; i++ {
+			key, val := r.Bytes(), r.Bytes()
+			if err := r.Err(); err != nil {
+				return err
+			}
+			if !fn(key, val) {
+				return nil
+			}
+			last = key
+		}
+		if err := r.Done(); err != nil {
+			return err
+		}
+		if !more || last == nil {
+			return nil
+		}
+		// the smallest key after the last one
+		start = append(last[:len(last):len(last)], 0)
+	}
+}
+
+// opens a transaction of the session, a write transaction waits for
+// the current writer
+func (c *Client) Begin(writable bool) error {
+	req := []byte{wire.OP_BEGIN, 0}
+	if writable {
+		req[1] = 1
+	}
+	_, r, err := c.call(req)
+	if err != nil {
+		return err
+	}
+	return r.Done()
+}
+
+// commits the write transaction, ends a read transaction
+func (c *Client) Commit() error {
+	_, r, err := c.call([]byte{wire.OP_COMMIT})
+	if err != nil {
+		return err
+	}
+	return r.Done()
+}
+
+func (c *Client) Rollback() error {
+	_, r, err := c.call([]byte{wire.OP_ROLLBACK})
+	if err != nil {
+		return err
+	}
+	return r.Done()
+}
+
+// authenticates the session as the user, needed first by servers with
+// authentication
+func (c *Client) Auth(user, password string) error {
+	req := wire.AppendBytes([]byte{wire.OP_AUTH}, []byte(user))
+	_, r, err := c.call(wire.AppendBytes(req, []byte(password)))
+	if err != nil {
+		return err
+	}
+	return r.Done()
+}
+
+// switches the session to the namespace, "/" is the main keyspace and
+// other names are buckets. buckets are created by the first write.
+func (c *Client) Use(namespace string) error {
+	_, r, err := c.call(wire.AppendBytes([]byte{wire.OP_USE}, []byte(namespace)))
+	if err != nil {
+		return err
+	}
+	return r.Done()
+}
+
+// deletes the namespace and its keys, false if it did not exist
+func (c *Client) Drop(namespace string) (bool, error) {
+	_, r, err := c.call(wire.AppendBytes([]byte{wire.OP_DROP}, []byte(namespace)))
+	if err != nil {
+		return false, err
+	}
+	dropped := r.Byte() == 1
+	return dropped, r.Done()
+}
+
+// creates or replaces a user with rules like "tenant1=write" or "*=read",
+// needs the *=admin rule
+func (c *Client) SetUser(name, password string, rules ...string) error {
+	req := wire.AppendBytes([]byte{wire.OP_USER_SET}, []byte(name))
+	req = wire.AppendBytes(req, []byte(password))
+	req = wire.AppendUint32(req, uint32(len(rules)))
+	for _, rule := range rules {
+		req = wire.AppendBytes(req, []byte(rule))
+	}
+	_, r, err := c.call(req)
+	if err != nil {
+		return err
+	}
+	return r.Done()
+}
+
+// false if there is no such user, needs the *=admin rule
+func (c *Client) DeleteUser(name string) (bool, error) {
+	_, r, err := c.call(wire.AppendBytes([]byte{wire.OP_USER_DEL}, []byte(name)))
+	if err != nil {
+		return false, err
+	}
+	deleted := r.Byte() == 1
+	return deleted, r.Done()
+}
+
+// sets an option of the session, like "isolation" to "read_committed"
+func (c *Client) SetOption(name, value string) error {
+	req := wire.AppendBytes([]byte{wire.OP_SET_OPTION}, []byte(name))
+	_, r, err := c.call(wire.AppendBytes(req, []byte(value)))
+	if err != nil {
+		return err
+	}
+	return r.Done()
+}
+
+// the result of a SQL statement
+type Result struct {
+	Affected int // rows changed by INSERT, UPDATE and DELETE
+	Columns  []string
+	Rows     [][]table.Value
+}
+
+// runs a SQL statement in the main keyspace, the arguments are the
+// values of its ? parameters
+func (c *Client) Query(query string, args ...table.Value) (*Result, error) {
+	req := wire.AppendBytes([]byte{wire.OP_QUERY}, []byte(query))
+	return c.result(wire.AppendBytes(req, table.EncodeRow(nil, args)))
+}
+
+// Stmt is a statement prepared by the session, it is valid until Close
+// or the end of the connection
+type Stmt struct {
+	c         *Client
+	id        uint32
+	NumParams int
+}
+
+func (c *Client) Prepare(query string) (*Stmt, error) {
+	_, r, err := c.call(wire.AppendBytes([]byte{wire.OP_PREPARE}, []byte(query)))
+	if err != nil {
+		return nil, err
+	}
+	stmt := &Stmt{c: c, id: r.Uint32(), NumParams: int(r.Uint32())}
+	return stmt, r.Done()
+}
+
+func (s *Stmt) Exec(args ...table.Value) (*Result, error) {
+	req := wire.AppendUint32([]byte{wire.OP_EXECUTE}, s.id)
+	return s.c.result(wire.AppendBytes(req, table.EncodeRow(nil, args)))
+}
+
+func (s *Stmt) Close() error {
+	_, r, err := s.c.call(wire.AppendUint32([]byte{wire.OP_CLOSE_STMT}, s.id))
+	if err != nil {
+		return err
+	}
+	r.Byte()
+	return r.Done()
+}
+
+func (c *Client) result(req []byte) (*Result, error) {
+	_, r, err := c.call(req)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Affected: int(r.Uint32())}
+	for n := r.Uint32(); n > 0 && r.Err() == nil; n-- {
+		res.Columns = append(res.Columns, string(r.Bytes()))
+	}
+	for n := r.Uint32(); n > 0 && r.Err() == nil; n-- {
+		row, err := table.DecodeRow(r.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		res.Rows = append(res.Rows, row)
+	}
+	return res, r.Done()
+}
+
+// a committed change of a key, Old is nil if the key did not exist, New
+// is nil if it was deleted
+type Change struct {
+	Seq           uint64 // the commit sequence of the transaction
+	Key, Old, New []byte
+}
+
+// Watcher receives the changes of a range, see Client.Watch
+type Watcher struct {
+	// closed when the watch ends, see Err
+	C <-chan Change
+
+	stream
+}
+
+// streams the changes of keys in [start, end) of the namespace committed
+// from now on, nil `end` means up to the last key. the connection serves
+// only the watch afterwards, Close of the watcher closes it.
+func (c *Client) Watch(start, end []byte) (*Watcher, error) {
+	req := wire.AppendBytes([]byte{wire.OP_WATCH}, start)
+	if err := c.startStream(wire.AppendBytes(req, end)); err != nil {
+		return nil, err
+	}
+	ch := make(chan Change, 64)
+	w := &Watcher{C: ch, stream: stream{c: c, done: make(chan struct{})}}
+	go func() {
+		defer close(ch)
+		w.read(func(r *wire.Reader) bool {
+			c := Change{Seq: r.Uint64()}
+			flags := r.Byte()
+			key, old, val := r.Bytes(), r.Bytes(), r.Bytes()
+			if r.Done() != nil {
+				return false
+			}
+			c.Key = key
+			if flags&wire.CHANGE_OLD != 0 {
+				c.Old = append([]byte{}, old...)
+			}
+			if flags&wire.CHANGE_NEW != 0 {
+				c.New = append([]byte{}, val...)
+			}
+			select {
+			case ch <- c:
+				return true
+			case <-w.done:
+				return false
+			}
+		})
+	}()
+	return w, nil
+}
+
+// an entry of the changefeed, Value is nil if the key was deleted
+type Entry struct {
+	Seq       uint64 // the commit sequence of the transaction
+	Namespace string // "/" is the main keyspace
+	Key       []byte
+	Value     []byte
+}
+
+// Feed receives the changefeed, see Client.Changes
+type Feed struct {
+	// closed when the feed ends, see Err
+	C <-chan Entry
+
+	stream
+}
+
+// streams the changefeed of the server from the commit sequence `from`
+// on, 0 is the oldest entry kept, then the entries of later commits. the
+// entries are of the namespaces the user can read. the connection serves
+// only the feed afterwards, Close of the feed closes it.
+func (c *Client) Changes(from uint64) (*Feed, error) {
+	if err := c.startStream(wire.AppendUint64([]byte{wire.OP_CHANGES}, from)); err != nil {
+		return nil, err
+	}
+	ch := make(chan Entry, 64)
+	f := &Feed{C: ch, stream: stream{c: c, done: make(chan struct{})}}
+	go func() {
+		defer close(ch)
+		f.read(func(r *wire.Reader) bool {
+			e := Entry{Seq: r.Uint64()}
+			op := r.Byte()
+			ns, key, val := r.Bytes(), r.Bytes(), r.Bytes()
+			if r.Done() != nil {
+				return false
+			}
+			e.Namespace, e.Key = string(ns), key
+			if op == wire.ENTRY_SET {
+				e.Value = val
+			}
+			select {
+			case ch <- e:
+				return true
+			case <-f.done:
+				return false
+			}
+		})
+	}()
+	return f, nil
+}
+
+// a connection that receives frames of a stream after the request
+type stream struct {
+	c    *Client
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+// sends the request of a stream, the connection serves nothing else afterwards
+func (c *Client) startStream(req []byte) error {
+	_, r, err := c.call(req)
+	if err != nil {
+		return err
+	}
+	if err := r.Done(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.watching = true
+	c.mu.Unlock()
+	return nil
+}
+
+// reads frames until `handle` returns false, the error or Close
+func (s *stream) read(handle func(r *wire.Reader) bool) {
+	for {
+		resp, err := wire.ReadFrame(s.c.r)
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				s.err = err
+			}
+			return
+		}
+		r := wire.NewReader(resp)
+		if r.Byte() == wire.STATUS_ERR {
+			s.err = fmt.Errorf("%w: %s", ErrServer, r.Rest())
+			return
+		}
+		if !handle(r) {
+			s.err = r.Err()
+			return
+		}
+	}
+}
+
+// the reason C was closed, valid once it is closed. nil after Close.
+func (s *stream) Err() error {
+	return s.err
+}
+
+func (s *stream) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return s.c.Close()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"godb/internal/storage/index/btree"
+)
+
+const backupUsage = `usage: godb backup [-db file] [-since seq] <backup file>
+
+writes a backup of the pages changed after the commit sequence -since, all
+of them by default, and prints the sequence of the backup for the next one
+`
+
+func backup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, backupUsage) }
+	path := fs.String("db", "godb.db", "database file")
+	since := fs.Uint64("since", 0, "commit sequence of the previous backup")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db := &btree.KV{Path: *path}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	out, err := os.Create(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	seq, err := db.BackupSince(out, *since)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(seq)
+	return nil
+}
+
+const restoreUsage = `usage: godb restore [-db file] [-force] [-verify] <backup file>...
+
+applies a full backup and the incremental backups after it in order. the
+backups are restored to a new file that replaces the database file once
+they all applied, an existing file is replaced only with -force. a first
+backup that is incremental applies on top of the existing file.
+
+-verify only checks the checksums and the meta pages of the backups
+`
+
+func restore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, restoreUsage) }
+	path := fs.String("db", "godb.db", "database file")
+	force := fs.Bool("force", false, "replace an existing database file")
+	verify := fs.Bool("verify", false, "check the backups without restoring them")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if *verify {
+		for _, name := range fs.Args() {
+			var info btree.BackupInfo
+			err := readBackup(name, func(r io.Reader) (err error) {
+				info, err = btree.VerifyBackup(r)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			fmt.Printf("%s: ok, %d pages from %d to %d\n", name, info.Pages, info.Since, info.Seq)
+		}
+		return nil
+	}
+
+	_, err := os.Stat(*path)
+	exists := err == nil
+	if exists && !*force {
+		return fmt.Errorf("%s exists, -force replaces it", *path)
+	}
+	var first btree.BackupInfo
+	err = readBackup(fs.Arg(0), func(r io.Reader) (err error) {
+		first, err = btree.ReadBackupInfo(r)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", fs.Arg(0), err)
+	}
+	tmp := *path + ".restore"
+	if first.Since > 0 {
+		if !exists {
+			return fmt.Errorf("%s is incremental, it needs %s", fs.Arg(0), *path)
+		}
+		if err := copyFile(tmp, *path); err != nil {
+			return err
+		}
+	}
+	defer os.Remove(tmp)
+	for _, name := range fs.Args() {
+		var info btree.BackupInfo
+		err := readBackup(name, func(r io.Reader) (err error) {
+			info, err = btree.ApplyBackup(tmp, r)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Printf("%s: %d pages, at %d\n", name, info.Pages, info.Seq)
+	}
+	// the restored file must open
+	db := &btree.KV{Path: tmp}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	db.Close()
+	return os.Rename(tmp, *path)
+}
+
+// calls `fn` with the backup file, reports the progress of large ones
+func readBackup(name string, fn func(r io.Reader) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	p := &progress{r: f, name: name, total: info.Size(), last: time.Now()}
+	return fn(p)
+}
+
+// reports the bytes read to stderr every second
+type progress struct {
+	r     io.Reader
+	name  string
+	n     int64
+	total int64
+	last  time.Time
+}
+
+func (p *progress) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= time.Second && p.total > 0 {
+		p.last = now
+		fmt.Fprintf(os.Stderr, "%s: %d%% of %d MiB\n", p.name, p.n*100/p.total, p.total>>20)
+	}
+	return n, err
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	return errors.Join(err, out.Close())
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"godb/internal/bench"
+	"godb/internal/storage/index/btree"
+)
+
+const benchUsage = `usage: godb bench [-db file] [-workload a|b|c|d|e|f] [-records n] [-ops n | -duration d]
+                  [-read p] [-update p] [-insert p] [-scan p] [-rmw p]
+                  [-dist uniform|zipfian|latest] [-value bytes] [-scan-length n]
+                  [-concurrency n] [-seed n] [-no-load]
+
+loads -records keys, then runs a workload like the YCSB core workloads and
+prints the throughput and the latency percentiles of every operation. the
+proportions of the operations replace the mix of -workload if one is set:
+
+  a  50% read, 50% update, zipfian
+  b  95% read, 5% update, zipfian
+  c  100% read, zipfian
+  d  95% read, 5% insert, latest
+  e  95% scan, 5% insert, zipfian
+  f  50% read, 50% read-modify-write, zipfian
+
+without -db it runs on a new file that is removed at the end. -no-load runs
+on the keys loaded by an earlier run with the same -records.
+`
+
+func benchCommand(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, benchUsage) }
+	path := fs.String("db", "", "database file, a new one if empty")
+	workload := fs.String("workload", "a", "YCSB core workload")
+	records := fs.Int("records", 100000, "keys loaded")
+	ops := fs.Int("ops", 100000, "operations run")
+	duration := fs.Duration("duration", 0, "run time instead of -ops")
+	var mix [bench.OP_COUNT]*float64
+	for op, name := range bench.OpNames {
+		mix[op] = fs.Float64(name, 0, "proportion of "+name+" operations")
+	}
+	dist := fs.String("dist", "", "key distribution, the one of -workload if empty")
+	valueSize := fs.Int("value", 100, "bytes of the values")
+	scanLength := fs.Int("scan-length", 100, "keys read by a scan")
+	concurrency := fs.Int("concurrency", 8, "workers")
+	seed := fs.Int64("seed", 1, "seed of the random numbers")
+	noLoad := fs.Bool("no-load", false, "use the keys of an earlier run")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	w, ok := bench.Workloads[*workload]
+	if !ok {
+		return fmt.Errorf("bad workload %s", *workload)
+	}
+	w.Records, w.ValueSize, w.ScanLength = *records, *valueSize, *scanLength
+	w.Concurrency, w.Seed = *concurrency, *seed
+	w.Ops = *ops
+	if *duration > 0 {
+		w.Ops, w.Duration = 0, *duration
+	}
+	custom := false
+	fs.Visit(func(f *flag.Flag) {
+		custom = custom || slices.Contains(bench.OpNames[:], f.Name)
+	})
+	if custom {
+		for op := range mix {
+			w.Mix[op] = *mix[op]
+		}
+	}
+	if *dist != "" {
+		if w.Dist = slices.Index(bench.DistNames, *dist); w.Dist < 0 {
+			return fmt.Errorf("bad distribution %s", *dist)
+		}
+	}
+
+	if *path == "" {
+		dir, err := os.MkdirTemp("", "godb-bench")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		*path = filepath.Join(dir, "bench.db")
+	}
+	db := &btree.KV{Path: *path}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if !*noLoad {
+		elapsed, err := bench.Load(bench.KV(db), w)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("load\t%d keys in %v, %.0f keys/s\n", w.Records, elapsed.Round(time.Millisecond), float64(w.Records)/elapsed.Seconds())
+	}
+	res, err := bench.Run(bench.KV(db), w)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("run\t%d ops in %v, %.0f ops/s\n\n", res.Ops, res.Elapsed.Round(time.Millisecond), res.Throughput())
+	fmt.Println(strings.Join([]string{"op", "count", "errors", "mean", "p50", "p95", "p99", "max"}, "\t"))
+	for op, s := range res.Stats {
+		if s.Count == 0 {
+			continue
+		}
+		fmt.Printf("%s\t%d\t%d\t%v\t%v\t%v\t%v\t%v\n", bench.OpNames[op], s.Count, s.Errors,
+			round(s.Mean), round(s.P50), round(s.P95), round(s.P99), round(s.Max))
+	}
+	return nil
+}
+
+// 3 significant digits
+func round(d time.Duration) time.Duration {
+	unit := time.Duration(1)
+	for d/unit >= 1000 {
+		unit *= 10
+	}
+	return d.Round(unit)
+}
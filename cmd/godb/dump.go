@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf8"
+
+	"godb/internal/dump"
+	"godb/internal/storage/index/btree"
+	"godb/internal/table"
+)
+
+const dumpUsage = `usage: godb dump [-db file] [-table name] [-format json|csv] [-bytes escape|base64|hex]
+                 [-comma c] [-null s] [-no-header] [-o file]
+
+writes every key/value pair of the main keyspace and of the buckets, or the
+rows of a table, as JSON lines or CSV. keys, values and BYTES columns are
+written as selected by -bytes. it reads the file like a read only ` + "`serve`" + `,
+so it works while the database is served.
+`
+
+// the flags of the format of dump and import
+func formatFlags(fs *flag.FlagSet) func() (dump.Options, error) {
+	format := fs.String("format", "json", "json for JSON lines or csv")
+	encoding := fs.String("bytes", "escape", "escape, base64 or hex")
+	comma := fs.String("comma", ",", "CSV separator")
+	null := fs.String("null", "", "CSV field of NULL")
+	noHeader := fs.Bool("no-header", false, "CSV without the header line")
+	return func() (dump.Options, error) {
+		opts := dump.Options{Null: *null, NoHeader: *noHeader}
+		switch *format {
+		case "json":
+			opts.Format = dump.FORMAT_JSON
+		case "csv":
+			opts.Format = dump.FORMAT_CSV
+		default:
+			return opts, fmt.Errorf("bad format %s", *format)
+		}
+		switch *encoding {
+		case "escape":
+			opts.Bytes = dump.BYTES_ESCAPE
+		case "base64":
+			opts.Bytes = dump.BYTES_BASE64
+		case "hex":
+			opts.Bytes = dump.BYTES_HEX
+		default:
+			return opts, fmt.Errorf("bad bytes encoding %s", *encoding)
+		}
+		r, size := utf8.DecodeRuneInString(*comma)
+		if size == 0 || size != len(*comma) {
+			return opts, fmt.Errorf("bad separator %q", *comma)
+		}
+		opts.Comma = r
+		return opts, nil
+	}
+}
+
+func dumpCommand(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, dumpUsage) }
+	path := fs.String("db", "godb.db", "database file")
+	tableName := fs.String("table", "", "table to dump, the key/value pairs if empty")
+	format := formatFlags(fs)
+	out := fs.String("o", "", "output file, stdout if empty")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	opts, err := format()
+	if err != nil {
+		return err
+	}
+
+	db := &btree.KV{Path: *path, ReadOnly: true}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if *out != "" {
+		var err error
+		if f, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	var n int
+	if *tableName == "" {
+		n, err = dump.KV(w, tx, opts)
+	} else {
+		n, err = dump.Table(w, table.NewTx(tx), *tableName, opts)
+	}
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "%d records\n", n)
+	return f.Sync()
+}
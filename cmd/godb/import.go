@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"godb/internal/dump"
+	"godb/internal/storage/index/btree"
+)
+
+const importUsage = `usage: godb import [-db file] [-table name | -bucket path] [-format json|csv] [-bytes escape|base64|hex]
+                   [-comma c] [-null s] [-no-header] [-batch n] [-replace] [-dry-run] [file]
+       godb import [-db file] [-bucket path] [-batch n] [-dry-run] -bolt file
+
+loads records in the format written by ` + "`godb dump`" + ` from the file or stdin,
+key/value pairs into the buckets under -bucket, or rows into a table. the
+records are written in transactions of -batch records, a bad record stops
+the import and the batches before it stay. -dry-run writes every batch and
+rolls it back. the database must not be served.
+
+-bolt copies the buckets, nested buckets, keys and bucket sequences of a
+bbolt or boltdb file, its buckets go under -bucket.
+`
+
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, importUsage) }
+	path := fs.String("db", "godb.db", "database file")
+	tableName := fs.String("table", "", "table to load rows into, key/value pairs if empty")
+	bucket := fs.String("bucket", "", "bucket path like a/b the pairs go under, the main keyspace if empty")
+	format := formatFlags(fs)
+	batch := fs.Int("batch", dump.IMPORT_BATCH, "records per transaction")
+	replace := fs.Bool("replace", false, "replace table rows with the same primary key")
+	dryRun := fs.Bool("dry-run", false, "check the records without keeping them")
+	bolt := fs.String("bolt", "", "bolt file to copy the buckets of")
+	fs.Parse(args)
+	if fs.NArg() > 1 || *tableName != "" && *bucket != "" || *bolt != "" && (*tableName != "" || fs.NArg() > 0) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	fopts, err := format()
+	if err != nil {
+		return err
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.NArg() == 1 && *bolt == "" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	db := &btree.KV{Path: *path}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	start := time.Now()
+	last := start
+	opts := dump.ImportOptions{
+		Options: fopts,
+		Batch:   *batch,
+		DryRun:  *dryRun,
+		Replace: *replace,
+		Progress: func(n int) {
+			if now := time.Now(); now.Sub(last) >= time.Second {
+				last = now
+				fmt.Fprintf(os.Stderr, "%d records, %.0f/s\n", n, float64(n)/now.Sub(start).Seconds())
+			}
+		},
+	}
+	var names [][]byte
+	if *bucket != "" {
+		for _, name := range strings.Split(*bucket, "/") {
+			names = append(names, []byte(name))
+		}
+	}
+	var n int
+	switch {
+	case *bolt != "":
+		n, err = dump.ImportBolt(*bolt, db, names, opts)
+	case *tableName != "":
+		n, err = dump.ImportTable(in, db, *tableName, opts)
+	default:
+		n, err = dump.ImportKV(in, db, names, opts)
+	}
+	if err != nil {
+		return fmt.Errorf("%w, %d records imported before it", err, n)
+	}
+	if *dryRun {
+		fmt.Printf("%d records ok\n", n)
+	} else {
+		fmt.Printf("%d records imported in %v\n", n, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
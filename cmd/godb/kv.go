@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"godb/internal/storage/index/btree"
+)
+
+// the commands on the keys of a database file, the keys and values are the
+// bytes of the arguments. get, scan and stats read the file like a read
+// only `serve`, so they work while it's served, the others need a database
+// that is not being served. -bucket is a path of nested buckets separated
+// by "/", the main keyspace if empty.
+
+func openBucket(tx *btree.Tx, path string, create bool) (*btree.Bucket, error) {
+	var b *btree.Bucket
+	for _, name := range strings.Split(path, "/") {
+		var next *btree.Bucket
+		var err error
+		switch {
+		case b == nil && create:
+			next, err = tx.CreateBucketIfNotExists([]byte(name))
+		case b == nil:
+			next = tx.Bucket([]byte(name))
+		case create:
+			next, err = b.CreateBucketIfNotExists([]byte(name))
+		default:
+			next = b.Bucket([]byte(name))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			return nil, fmt.Errorf("no bucket %s", path)
+		}
+		b = next
+	}
+	return b, nil
+}
+
+// the flags of every key command
+func keyFlags(name string, usage string) (*flag.FlagSet, *string, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	path := fs.String("db", "godb.db", "database file")
+	bucket := fs.String("bucket", "", "bucket path like a/b, the main keyspace if empty")
+	return fs, path, bucket
+}
+
+// printable bytes are kept, others are escaped like \x00
+func escape(data []byte) string {
+	var sb strings.Builder
+	for _, c := range data {
+		if c < 0x20 || c >= 0x7f || c == '\\' {
+			fmt.Fprintf(&sb, "\\x%02x", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+const getUsage = `usage: godb get [-db file] [-bucket path] <key>
+
+writes the value of the key to stdout as is
+`
+
+func get(args []string) error {
+	fs, path, bucket := keyFlags("get", getUsage)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db := &btree.KV{Path: *path, ReadOnly: true}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	var val []byte
+	var ok bool
+	if *bucket == "" {
+		val, ok = tx.Get([]byte(fs.Arg(0)))
+	} else {
+		b, err := openBucket(tx, *bucket, false)
+		if err != nil {
+			return err
+		}
+		val, ok = b.Get([]byte(fs.Arg(0)))
+	}
+	if !ok {
+		return fmt.Errorf("no key %s", escape([]byte(fs.Arg(0))))
+	}
+	_, err := os.Stdout.Write(val)
+	return err
+}
+
+const setUsage = `usage: godb set [-db file] [-bucket path] <key> [value]
+
+sets the key, the value is read from stdin if it's not an argument. the
+buckets of the path are created if they don't exist
+`
+
+func set(args []string) error {
+	fs, path, bucket := keyFlags("set", setUsage)
+	fs.Parse(args)
+	if fs.NArg() != 1 && fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var val []byte
+	if fs.NArg() == 2 {
+		val = []byte(fs.Arg(1))
+	} else {
+		var err error
+		if val, err = io.ReadAll(os.Stdin); err != nil {
+			return err
+		}
+	}
+
+	db := &btree.KV{Path: *path}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	tx := db.Begin()
+	if *bucket == "" {
+		if err := tx.Set([]byte(fs.Arg(0)), val); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+	b, err := openBucket(tx, *bucket, true)
+	if err == nil {
+		err = b.Set([]byte(fs.Arg(0)), val)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+const delUsage = `usage: godb del [-db file] [-bucket path] <key>...
+
+deletes the keys, it fails if none of them exists
+`
+
+func del(args []string) error {
+	fs, path, bucket := keyFlags("del", delUsage)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db := &btree.KV{Path: *path}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	tx := db.Begin()
+	delFn := tx.Del
+	if *bucket != "" {
+		b, err := openBucket(tx, *bucket, false)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		delFn = b.Del
+	}
+	n := 0
+	for _, key := range fs.Args() {
+		deleted, err := delFn([]byte(key))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if deleted {
+			n++
+		}
+	}
+	if n == 0 {
+		tx.Rollback()
+		return errors.New("no such keys")
+	}
+	return tx.Commit()
+}
+
+const scanUsage = `usage: godb scan [-db file] [-bucket path] [-start key] [-end key] [-limit n]
+
+prints the keys in [start, end) and their values separated by a tab, bytes
+that aren't printable are escaped like \x00
+`
+
+func scan(args []string) error {
+	fs, path, bucket := keyFlags("scan", scanUsage)
+	start := fs.String("start", "", "first key")
+	end := fs.String("end", "", "key after the last one, the end of the keyspace if empty")
+	limit := fs.Int("limit", 0, "number of keys, no limit if 0")
+	keysOnly := fs.Bool("keys", false, "print only the keys")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db := &btree.KV{Path: *path, ReadOnly: true}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	var endKey []byte
+	if *end != "" {
+		endKey = []byte(*end)
+	}
+	n := 0
+	fn := func(key, val []byte) bool {
+		if *keysOnly {
+			fmt.Println(escape(key))
+		} else {
+			fmt.Printf("%s\t%s\n", escape(key), escape(val))
+		}
+		n++
+		return *limit == 0 || n < *limit
+	}
+	if *bucket == "" {
+		tx.Scan([]byte(*start), endKey, fn)
+		return nil
+	}
+	b, err := openBucket(tx, *bucket, false)
+	if err != nil {
+		return err
+	}
+	b.Scan([]byte(*start), endKey, fn)
+	return nil
+}
+
+const statsUsage = `usage: godb stats [-db file] [-json]
+
+prints the pages of the file and the usage of the main keyspace and of
+every bucket, as a JSON object with -json
+`
+
+func stats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, statsUsage) }
+	path := fs.String("db", "godb.db", "database file")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db := &btree.KV{Path: *path, ReadOnly: true}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	if *asJSON {
+		return statsJSON(tx)
+	}
+	file := tx.FileStats()
+	fmt.Printf("seq\t%d\n", tx.Seq())
+	if applied := tx.Applied(); applied != 0 {
+		fmt.Printf("applied\t%d\n", applied)
+	}
+	fmt.Printf("pages\t%d (%d in trees, %d free)\n", file.Pages, file.TreePages, file.FreePages)
+	fmt.Printf("size\t%d bytes\n\n", file.Pages*btree.BT_PAGE_SIZE)
+
+	fmt.Println("bucket\tkeys\tdepth\tleaves\tbranches\tkey bytes\tvalue bytes\tfill")
+	row := func(name string, s btree.BucketStats) {
+		fmt.Printf("%s\t%d\t%d\t%d\t%d\t%d\t%d\t%.2f\n",
+			name, s.Keys, s.Depth, s.LeafPages, s.BranchPages, s.KeyBytes, s.ValBytes, s.FillFactor)
+	}
+	row("/", tx.Stats())
+	var walk func(prefix string, name []byte, b *btree.Bucket) error
+	walk = func(prefix string, name []byte, b *btree.Bucket) error {
+		path := prefix + escape(name)
+		row(path, b.Stats())
+		return b.ForEachBucket(func(name []byte, b *btree.Bucket) error {
+			return walk(path+"/", name, b)
+		})
+	}
+	return tx.ForEachBucket(func(name []byte, b *btree.Bucket) error {
+		return walk("", name, b)
+	})
+}
+
+// the stats of `godb stats -json`, the buckets by path
+func statsJSON(tx *btree.Tx) error {
+	out := struct {
+		Seq     uint64                       `json:"seq"`
+		File    btree.FileStats              `json:"file"`
+		Buckets map[string]btree.BucketStats `json:"buckets"`
+	}{Seq: tx.Seq(), File: tx.FileStats(), Buckets: map[string]btree.BucketStats{"/": tx.Stats()}}
+	var walk func(prefix string, name []byte, b *btree.Bucket) error
+	walk = func(prefix string, name []byte, b *btree.Bucket) error {
+		path := prefix + escape(name)
+		out.Buckets[path] = b.Stats()
+		return b.ForEachBucket(func(name []byte, b *btree.Bucket) error {
+			return walk(path+"/", name, b)
+		})
+	}
+	err := tx.ForEachBucket(func(name []byte, b *btree.Bucket) error {
+		return walk("", name, b)
+	})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+const compactUsage = `usage: godb compact [-db file] [-o file]
+
+copies the database without its free pages to a new file that replaces the
+database file, or to the -o file. backups taken before don't apply to the
+compacted file, take a full backup after it
+`
+
+func compact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, compactUsage) }
+	path := fs.String("db", "godb.db", "database file")
+	out := fs.String("o", "", "compacted file, replaces the database file if empty")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db := &btree.KV{Path: *path}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	target := *out
+	if target == "" {
+		target = *path + ".compact"
+	}
+	tx := db.BeginRead()
+	before := tx.FileStats().Pages
+	tx.Rollback()
+	err := db.Compact(target)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		if err := os.Rename(target, *path); err != nil {
+			return err
+		}
+	}
+	info, err := os.Stat(*path)
+	if *out != "" {
+		info, err = os.Stat(*out)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d -> %d bytes\n", before*btree.BT_PAGE_SIZE, info.Size())
+	return nil
+}
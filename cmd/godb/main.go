@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"godb/internal/metrics"
+	"godb/internal/server"
+	"godb/internal/storage/index/btree"
+)
+
+const usage = `usage: godb <command> [flags]
+
+commands:
+  serve    serve a database over TCP
+  user     manage the users of a database that is not being served
+  backup   back up a database that is not being served
+  restore  apply backups to a database file
+  get      print the value of a key
+  set      set a key
+  del      delete keys
+  scan     print a range of keys
+  stats    print the usage of a database file
+  compact  rewrite a database file without its free pages
+  shell    run SQL statements interactively
+  dump     export key/value pairs or the rows of a table as JSON or CSV
+  import   load key/value pairs or table rows from JSON or CSV
+  verify   check the integrity of a database file
+  repair   rebuild a damaged database file from its valid leaves
+  page     decode and print a page of a database file
+  bench    measure the throughput and the latency of a workload
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "serve":
+		err = serve(os.Args[2:])
+	case "user":
+		err = user(os.Args[2:])
+	case "backup":
+		err = backup(os.Args[2:])
+	case "restore":
+		err = restore(os.Args[2:])
+	case "get":
+		err = get(os.Args[2:])
+	case "set":
+		err = set(os.Args[2:])
+	case "del":
+		err = del(os.Args[2:])
+	case "scan":
+		err = scan(os.Args[2:])
+	case "stats":
+		err = stats(os.Args[2:])
+	case "compact":
+		err = compact(os.Args[2:])
+	case "shell":
+		err = shell(os.Args[2:])
+	case "dump":
+		err = dumpCommand(os.Args[2:])
+	case "import":
+		err = importCommand(os.Args[2:])
+	case "verify":
+		err = verify(os.Args[2:])
+	case "repair":
+		err = repair(os.Args[2:])
+	case "page":
+		err = page(os.Args[2:])
+	case "bench":
+		err = benchCommand(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// a protocol front-end of `serve`
+type frontend interface {
+	Serve(ln net.Listener) error
+	Close() error
+}
+
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:7070", "address to listen on")
+	path := fs.String("db", "godb.db", "database file")
+	respAddr := fs.String("resp", "", "address of the Redis protocol front-end, off if empty")
+	grpcAddr := fs.String("grpc", "", "address of the gRPC front-end, off if empty")
+	mcAddr := fs.String("memcache", "", "address of the memcached protocol front-end, off if empty")
+	certFile := fs.String("tls-cert", "", "PEM certificate, serves TLS on every address if set")
+	keyFile := fs.String("tls-key", "", "PEM key of the certificate")
+	clientCA := fs.String("tls-client-ca", "", "PEM CAs of the required client certificates")
+	alpn := fs.String("tls-alpn", "", "comma-separated ALPN protocols")
+	auth := fs.Bool("auth", false, "clients must authenticate as a user, see `godb user`")
+	idle := fs.Duration("idle-timeout", 0, "close connections idle for longer, no limit if 0")
+	txIdle := fs.Duration("tx-idle-timeout", 0, "the idle limit while a transaction is open, -idle-timeout if 0")
+	follow := fs.String("follow", "", "address of a leader, serves a read-only replica of it if set")
+	followUser := fs.String("follow-user", "", "superuser of the leader, the password is read from $GODB_FOLLOW_PASSWORD")
+	followCA := fs.String("follow-ca", "", "PEM CAs of the leader, connects with TLS if set")
+	changefeed := fs.Bool("changefeed", false, "log the changes of write transactions for consumers of the changefeed")
+	readOnly := fs.Bool("read-only", false, "serve the database file of another process read only")
+	metricsAddr := fs.String("metrics", "", "HTTP address of /metrics for Prometheus and /debug/vars for expvar, off if empty")
+	logLevel := fs.String("log-level", "info", "the lowest level of the events of the engine: debug, info, warn or error")
+	slowCommit := fs.Duration("slow-commit", 0, "log batches of commits slower than this, off if 0")
+	healthAddr := fs.String("health", "", "HTTP address of /healthz and /readyz for orchestrators, off if empty")
+	maxLag := fs.Duration("ready-max-lag", 0, "a replica is not ready when disconnected from the leader for longer, no limit if 0")
+	minFree := fs.Uint64("ready-min-free", 0, "not ready with fewer bytes free on the disk of the database, no limit if 0")
+	poolPages := fs.Int("pool-pages", 0, "read pages into a buffer pool of this many pages instead of mapping the file, off if 0")
+	bloomBits := fs.Int("bloom-bits", 0, "Bloom filters of this many bits per key for the leaves, lookups of missing keys skip most leaves, off if 0")
+	doubleWrite := fs.Bool("double-write", false, "write the pages updated in place to <path>.dw first, against torn pages")
+	checkCommits := fs.Bool("check-commits", false, "check the pages of every commit and panic on a problem, for debugging")
+	noSync := fs.Bool("no-sync", false, "commits skip their fsyncs, a crash can lose commits or break the file")
+	mmapLimit := fs.Int64("mmap-limit", 0, "bytes of the database file, commits that would grow it past fail, no limit if 0")
+	auditPath := fs.String("audit", "", "audit log of the committed write transactions, off if empty")
+	auditSize := fs.Int64("audit-max-size", 100<<20, "bytes of the audit log before it is rotated, no rotation if 0")
+	auditFiles := fs.Int("audit-max-files", 0, "rotated audit logs kept, all if 0")
+	debugAddr := fs.String("debug", "", "HTTP address of /debug/pprof/ and /debug/buffers, an admin port, off if empty")
+	fs.Parse(args)
+
+	var tlsConfig *tls.Config
+	if *certFile != "" || *keyFile != "" || *clientCA != "" {
+		var protos []string
+		if *alpn != "" {
+			protos = strings.Split(*alpn, ",")
+		}
+		var err error
+		if tlsConfig, err = server.LoadTLSConfig(*certFile, *keyFile, *clientCA, protos); err != nil {
+			return err
+		}
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("-log-level: %w", err)
+	}
+	opts := []btree.Option{
+		btree.WithLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})), *slowCommit),
+		btree.WithPoolPages(*poolPages),
+		btree.WithBloomBits(*bloomBits),
+		btree.WithMmapLimit(*mmapLimit),
+	}
+	if *follow != "" {
+		opts = append(opts, btree.WithReplica())
+	}
+	if *changefeed {
+		opts = append(opts, btree.WithChangefeed())
+	}
+	if *readOnly {
+		opts = append(opts, btree.WithReadOnly(0))
+	}
+	if *doubleWrite {
+		opts = append(opts, btree.WithDoubleWrite())
+	}
+	if *checkCommits {
+		opts = append(opts, btree.WithCheckCommits())
+	}
+	if *noSync {
+		opts = append(opts, btree.WithNoSync())
+	}
+	if *auditPath != "" {
+		opts = append(opts, btree.WithAudit(&btree.AuditLog{Path: *auditPath, MaxSize: *auditSize, MaxFiles: *auditFiles}))
+	}
+	prom := &metrics.Prometheus{}
+	if *metricsAddr != "" {
+		opts = append(opts, btree.WithMetrics(metrics.Multi{prom, metrics.NewExpvar("godb")}))
+	}
+	db, err := btree.Open(*path, opts...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var f *server.Follower
+	if *follow != "" {
+		f = &server.Follower{DB: db, Addr: *follow, User: *followUser, Password: os.Getenv("GODB_FOLLOW_PASSWORD")}
+		if *followCA != "" {
+			var err error
+			if f.TLS, err = server.LoadLeaderTLSConfig(*followCA, *certFile, *keyFile); err != nil {
+				return err
+			}
+		}
+	}
+	// the HTTP endpoints by address, -metrics, -health and -debug may share one
+	muxes := map[string]*http.ServeMux{}
+	handle := func(addr, pattern string, h http.Handler) {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		muxes[addr].Handle(pattern, h)
+	}
+	if *metricsAddr != "" {
+		handle(*metricsAddr, "/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// the buffer pool is sampled at each scrape
+			tx := db.BeginRead()
+			tx.Resident()
+			tx.Rollback()
+			prom.ServeHTTP(w, r)
+		}))
+		handle(*metricsAddr, "/debug/vars", expvar.Handler())
+	}
+	if *healthAddr != "" {
+		health := &server.Health{DB: db, Follower: f, MaxLag: *maxLag, MinFree: *minFree}
+		handle(*healthAddr, "/healthz", health)
+		handle(*healthAddr, "/readyz", health)
+	}
+	if *debugAddr != "" {
+		debug := &server.Debug{DB: db}
+		handle(*debugAddr, "/debug/pprof/", debug)
+		handle(*debugAddr, "/debug/buffers", debug)
+	}
+	for haddr, mux := range muxes {
+		hln, err := net.Listen("tcp", haddr)
+		if err != nil {
+			return err
+		}
+		defer hln.Close()
+		go func() {
+			log.Printf("serving HTTP on %s", hln.Addr())
+			http.Serve(hln, mux)
+		}()
+	}
+	if f != nil {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				err := f.Follow()
+				if errors.Is(err, server.ErrServerClosed) {
+					return
+				}
+				log.Printf("following %s: %v", *follow, err)
+				time.Sleep(time.Second)
+			}
+		}()
+		// runs before db.Close
+		defer func() {
+			f.Close()
+			<-done
+		}()
+	}
+	var accounts *server.Accounts
+	if *auth {
+		accounts = &server.Accounts{DB: db}
+	}
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	srv := &server.Server{DB: db, TLS: tlsConfig, Auth: accounts, IdleTimeout: *idle, TxIdleTimeout: *txIdle}
+	var extra []frontend
+	for _, fe := range []struct {
+		name, addr string
+		srv        frontend
+	}{
+		{"RESP", *respAddr, &server.RESPServer{DB: db, TLS: tlsConfig, Auth: accounts}},
+		{"gRPC", *grpcAddr, &server.GRPCServer{DB: db, TLS: tlsConfig, Auth: accounts}},
+		{"memcached", *mcAddr, &server.MemcacheServer{DB: db, TLS: tlsConfig, Auth: accounts}},
+	} {
+		if fe.addr == "" {
+			continue
+		}
+		feln, err := net.Listen("tcp", fe.addr)
+		if err != nil {
+			ln.Close()
+			for _, other := range extra {
+				other.Close()
+			}
+			return err
+		}
+		extra = append(extra, fe.srv)
+		go func() {
+			log.Printf("serving %s on %s", fe.name, feln.Addr())
+			if err := fe.srv.Serve(feln); !errors.Is(err, server.ErrServerClosed) {
+				log.Print(err)
+				srv.Close()
+			}
+		}()
+	}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		srv.Close()
+	}()
+	log.Printf("serving %s on %s", *path, ln.Addr())
+	err = srv.Serve(ln)
+	// waits for the sessions before the database is closed
+	srv.Close()
+	for _, fe := range extra {
+		fe.Close()
+	}
+	if errors.Is(err, server.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+const userUsage = `usage: godb user [-db godb.db] <command>
+
+commands:
+  list                 list the users and their rules
+  set <name> <rule>... create or replace a user, the password is read from stdin
+  del <name>           delete a user
+
+rules are pattern=perm, the pattern is a glob of namespaces ("/" is the main
+keyspace, others are buckets) and perm is read, write or admin
+`
+
+func user(args []string) error {
+	fs := flag.NewFlagSet("user", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, userUsage) }
+	path := fs.String("db", "godb.db", "database file")
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db := &btree.KV{Path: *path}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	accounts := &server.Accounts{DB: db}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		users, err := accounts.List()
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			var rules []string
+			for _, r := range u.Rules {
+				rules = append(rules, r.String())
+			}
+			fmt.Printf("%s\t%s\n", u.Name, strings.Join(rules, " "))
+		}
+		return nil
+	case args[0] == "set" && len(args) >= 2:
+		var rules []server.Rule
+		for _, arg := range args[2:] {
+			rule, err := server.ParseRule(arg)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+		}
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && (err != io.EOF || password == "") {
+			return errors.New("no password on stdin")
+		}
+		return accounts.Set(args[1], strings.TrimRight(password, "\r\n"), rules)
+	case args[0] == "del" && len(args) == 2:
+		deleted, err := accounts.Delete(args[1])
+		if err == nil && !deleted {
+			err = fmt.Errorf("no user %s", args[1])
+		}
+		return err
+	default:
+		fs.Usage()
+		os.Exit(2)
+		return nil
+	}
+}
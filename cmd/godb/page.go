@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"godb/internal/storage/index/btree"
+)
+
+const pageUsage = `usage: godb page <database file> <page number>
+
+prints a page of a database file: the fields of the meta page (page 0),
+the items of a free list node or the type, the commit and the keys of a
+tree node, then all its bytes in hex. a node that is damaged is decoded as
+far as its header and its offsets can be read. it reads the file without
+opening the database.
+`
+
+func page(args []string) error {
+	fs := flag.NewFlagSet("page", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, pageUsage) }
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	ptr, err := strconv.ParseUint(fs.Arg(1), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad page number %q", fs.Arg(1))
+	}
+	out, err := btree.InspectPage(fs.Arg(0), ptr)
+	if err != nil {
+		return err
+	}
+	fmt.Print(out)
+	return nil
+}
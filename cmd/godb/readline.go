@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+)
+
+// a line editor for the shell: the arrows move in the line and in the
+// history, Ctrl-A/Ctrl-E go to the start and the end, Ctrl-U/Ctrl-K cut
+// before and after the cursor, Ctrl-W cuts a word, Ctrl-C drops the input
+// and Ctrl-D on an empty line ends it. input that isn't a terminal is
+// read line by line without prompts.
+
+var errInterrupt = errors.New("interrupt")
+
+const HISTORY_MAX = 1000
+
+type lineReader struct {
+	in      *bufio.Reader
+	out     *os.File
+	fd      int
+	term    bool
+	history []string
+	file    string // history file, no history is saved if empty
+}
+
+func newLineReader(historyFile string) *lineReader {
+	lr := &lineReader{in: bufio.NewReader(os.Stdin), out: os.Stdout, fd: int(os.Stdin.Fd())}
+	_, err := unix.IoctlGetTermios(lr.fd, unix.TCGETS)
+	lr.term = err == nil
+	if lr.term && historyFile != "" {
+		lr.file = historyFile
+		if data, err := os.ReadFile(historyFile); err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if line != "" {
+					lr.history = append(lr.history, line)
+				}
+			}
+		}
+	}
+	return lr
+}
+
+// adds an entry to the history and its file
+func (lr *lineReader) remember(entry string) {
+	entry = strings.TrimSpace(strings.ReplaceAll(entry, "\n", " "))
+	if !lr.term || entry == "" || len(lr.history) > 0 && lr.history[len(lr.history)-1] == entry {
+		return
+	}
+	lr.history = append(lr.history, entry)
+	if len(lr.history) > HISTORY_MAX {
+		lr.history = lr.history[len(lr.history)-HISTORY_MAX:]
+	}
+	if lr.file == "" {
+		return
+	}
+	data := strings.Join(lr.history, "\n") + "\n"
+	os.WriteFile(lr.file, []byte(data), 0o600)
+}
+
+// reads a line without the newline, io.EOF at the end of the input and
+// errInterrupt on Ctrl-C
+func (lr *lineReader) readLine(prompt string) (string, error) {
+	if !lr.term {
+		line, err := lr.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	old, err := unix.IoctlGetTermios(lr.fd, unix.TCGETS)
+	if err != nil {
+		return "", err
+	}
+	raw := *old
+	raw.Iflag &^= unix.ICRNL | unix.IXON
+	raw.Lflag &^= unix.ICANON | unix.ECHO | unix.ISIG | unix.IEXTEN
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(lr.fd, unix.TCSETS, &raw); err != nil {
+		return "", err
+	}
+	defer unix.IoctlSetTermios(lr.fd, unix.TCSETS, old)
+	return lr.edit(prompt)
+}
+
+func (lr *lineReader) edit(prompt string) (string, error) {
+	var line []rune
+	pos := 0
+	hist := len(lr.history) // the history entry shown, the new line if at the end
+	var typed []rune        // the new line while the history is shown
+	redraw := func() {
+		// the cursor goes back from the end of the line
+		fmt.Fprintf(lr.out, "\r%s%s\x1b[K", prompt, string(line))
+		if back := len(line) - pos; back > 0 {
+			fmt.Fprintf(lr.out, "\x1b[%dD", back)
+		}
+	}
+	show := func(i int) {
+		if hist == len(lr.history) {
+			typed = line
+		}
+		hist = i
+		if i == len(lr.history) {
+			line = typed
+		} else {
+			line = []rune(lr.history[i])
+		}
+		pos = len(line)
+	}
+	redraw()
+	for {
+		r, _, err := lr.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(lr.out, "\r\n")
+			return string(line), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(lr.out, "^C\r\n")
+			return "", errInterrupt
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				fmt.Fprint(lr.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(line)
+		case 2: // Ctrl-B
+			pos = max(pos-1, 0)
+		case 6: // Ctrl-F
+			pos = min(pos+1, len(line))
+		case 11: // Ctrl-K
+			line = line[:pos]
+		case 21: // Ctrl-U
+			line = append([]rune{}, line[pos:]...)
+			pos = 0
+		case 23: // Ctrl-W
+			start := pos
+			for start > 0 && line[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && line[start-1] != ' ' {
+				start--
+			}
+			line = append(line[:start], line[pos:]...)
+			pos = start
+		case 127, 8: // backspace
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+			}
+		case 16: // Ctrl-P
+			if hist > 0 {
+				show(hist - 1)
+			}
+		case 14: // Ctrl-N
+			if hist < len(lr.history) {
+				show(hist + 1)
+			}
+		case 27: // escape sequences of the arrows and keys like Home
+			seq := lr.escape()
+			switch seq {
+			case "[A", "OA":
+				if hist > 0 {
+					show(hist - 1)
+				}
+			case "[B", "OB":
+				if hist < len(lr.history) {
+					show(hist + 1)
+				}
+			case "[C", "OC":
+				pos = min(pos+1, len(line))
+			case "[D", "OD":
+				pos = max(pos-1, 0)
+			case "[H", "OH", "[1~", "[7~":
+				pos = 0
+			case "[F", "OF", "[4~", "[8~":
+				pos = len(line)
+			case "[3~":
+				if pos < len(line) {
+					line = append(line[:pos], line[pos+1:]...)
+				}
+			}
+		default:
+			if r < 0x20 || r == utf8.RuneError {
+				continue
+			}
+			line = append(line[:pos], append([]rune{r}, line[pos:]...)...)
+			pos++
+		}
+		redraw()
+	}
+}
+
+// reads the rest of an escape sequence like "[A" or "[3~"
+func (lr *lineReader) escape() string {
+	c, err := lr.in.ReadByte()
+	if err != nil || c != '[' && c != 'O' {
+		return ""
+	}
+	seq := []byte{c}
+	for {
+		c, err := lr.in.ReadByte()
+		if err != nil {
+			return ""
+		}
+		seq = append(seq, c)
+		if c >= 0x40 && c <= 0x7e {
+			return string(seq)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"godb/internal/storage/index/btree"
+)
+
+const repairUsage = `usage: godb repair [-o file] <database file>
+
+the last resort for a file whose meta page or branch nodes are damaged. it
+scans every page for leaves that look valid and writes their key/value pairs
+to a new database, <database file>.repaired or -o. the damaged file is left
+as is. leaves of no known tree are in the bucket lost+found, with old values
+and deleted keys if the free list is damaged too. run ` + "`godb verify`" + ` first,
+the file must not be written while it is repaired.
+`
+
+func repair(args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, repairUsage) }
+	out := fs.String("o", "", "repaired file, <database file>.repaired if empty")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := fs.Arg(0)
+	if *out == "" {
+		*out = path + ".repaired"
+	}
+
+	report, err := btree.Repair(path, *out)
+	if err != nil {
+		return err
+	}
+	if !report.MetaOK {
+		fmt.Println("the meta page is damaged, the main keyspace is in " + btree.LOST_FOUND)
+	}
+	fmt.Printf("%d pages: %d leaves, %d free, %d skipped\n", report.Pages, report.Leaves, report.Free, report.Skipped)
+	fmt.Printf("%d keys in %d buckets written to %s", report.Keys, report.Buckets, *out)
+	if report.LostFound > 0 {
+		fmt.Printf(", %d in %s", report.LostFound, btree.LOST_FOUND)
+	}
+	fmt.Println()
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"godb/internal/sql"
+	"godb/internal/table"
+)
+
+const shellUsage = `usage: godb shell <database file>
+
+reads SQL statements ending with ";" and prints their results as tables,
+every statement runs in its own transaction. the file must not be served.
+
+meta-commands:
+  \dt        list the tables
+  \d <table> describe a table
+  \?         this help
+  \q         quit
+`
+
+func shell(args []string) error {
+	fs := flag.NewFlagSet("shell", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, shellUsage) }
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db := &table.DB{Path: fs.Arg(0)}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	var history string
+	if home, err := os.UserHomeDir(); err == nil {
+		history = filepath.Join(home, ".godb_history")
+	}
+	lr := newLineReader(history)
+	if lr.term {
+		fmt.Printf("godb shell on %s, \\? for help\n", fs.Arg(0))
+	}
+
+	failed := false
+	var input strings.Builder
+	for {
+		prompt := "godb> "
+		if input.Len() > 0 {
+			prompt = "   -> "
+		}
+		line, err := lr.readLine(prompt)
+		if errors.Is(err, errInterrupt) {
+			input.Reset()
+			continue
+		}
+		if err == io.EOF {
+			if strings.TrimSpace(input.String()) != "" {
+				err = errors.New("the last statement has no ;")
+				fmt.Fprintln(os.Stderr, err)
+				failed = true
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if input.Len() == 0 && strings.HasPrefix(strings.TrimSpace(line), `\`) {
+			lr.remember(line)
+			cmd := strings.Fields(strings.TrimSpace(line))
+			if cmd[0] == `\q` {
+				break
+			}
+			if err := metaCommand(db, cmd); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				failed = true
+			}
+			continue
+		}
+		input.WriteString(line)
+		input.WriteByte('\n')
+		if !sql.Complete(input.String()) {
+			continue
+		}
+		src := input.String()
+		input.Reset()
+		lr.remember(src)
+		if err := runStatements(db, src); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+	}
+	if failed && !lr.term {
+		return errors.New("some statements failed")
+	}
+	return nil
+}
+
+func metaCommand(db *table.DB, cmd []string) error {
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	switch {
+	case cmd[0] == `\dt` && len(cmd) == 1, cmd[0] == `\d` && len(cmd) == 1:
+		names, err := tx.Tables()
+		if err != nil {
+			return err
+		}
+		var rows [][]string
+		for _, name := range names {
+			rows = append(rows, []string{name})
+		}
+		printTable([]string{"table"}, rows, nil)
+		return nil
+	case cmd[0] == `\d` && len(cmd) == 2:
+		tdef, err := tx.TableDef(cmd[1])
+		if err != nil {
+			return err
+		}
+		var rows [][]string
+		for i, col := range tdef.Cols {
+			key := ""
+			if i < tdef.PKeys {
+				key = "primary key"
+			}
+			rows = append(rows, []string{col, sql.TypeName(tdef.Types[i]), key})
+		}
+		fmt.Printf("table %s\n", tdef.Name)
+		printTable([]string{"column", "type", "key"}, rows, nil)
+		for _, index := range tdef.Indexes {
+			fmt.Printf("index (%s)\n", strings.Join(index, ", "))
+		}
+		for _, col := range tdef.Bitmaps {
+			fmt.Printf("bitmap index (%s)\n", col)
+		}
+		for _, col := range tdef.FullText {
+			fmt.Printf("full-text index (%s)\n", col)
+		}
+		return nil
+	case cmd[0] == `\?`:
+		fmt.Print(shellUsage[strings.Index(shellUsage, "meta-commands"):])
+		return nil
+	}
+	return fmt.Errorf("bad meta-command %s, \\? for help", strings.Join(cmd, " "))
+}
+
+// runs the statements in order, it stops at the first error
+func runStatements(db *table.DB, src string) error {
+	stmts, err := sql.ParseAll(src)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range stmts {
+		if err := runStatement(db, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runStatement(db *table.DB, stmt sql.Stmt) error {
+	if _, ok := stmt.(*sql.Select); ok {
+		tx := db.BeginRead()
+		defer tx.Rollback()
+		res, err := sql.Execute(tx, stmt)
+		if err != nil {
+			return err
+		}
+		return printRows(res.Rows)
+	}
+
+	tx := db.Begin()
+	res, err := sql.Execute(tx, stmt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	switch stmt.(type) {
+	case *sql.CreateTable:
+		fmt.Println("CREATE TABLE")
+	case *sql.Insert:
+		fmt.Println("INSERT", res.Affected)
+	case *sql.Update:
+		fmt.Println("UPDATE", res.Affected)
+	case *sql.Delete:
+		fmt.Println("DELETE", res.Affected)
+	}
+	return nil
+}
+
+func printRows(rows sql.Rows) error {
+	defer rows.Close()
+	cols := rows.Columns()
+	right := make([]bool, len(cols))
+	var out [][]string
+	for rows.Next() {
+		row := make([]string, len(cols))
+		for i, v := range rows.Row() {
+			row[i] = strings.NewReplacer("\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(v.String())
+			// numbers are aligned to the right
+			right[i] = right[i] || v.Type == table.TYPE_INT64 || v.Type == table.TYPE_FLOAT64
+		}
+		out = append(out, row)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	printTable(cols, out, right)
+	return nil
+}
+
+// prints the rows in aligned columns under a header
+//
+//	 id | name
+//	----+-------
+//	  1 | alice
+//	(1 row)
+func printTable(cols []string, rows [][]string, right []bool) {
+	widths := make([]int, len(cols))
+	for i, col := range cols {
+		widths[i] = utf8.RuneCountInString(col)
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+	var sb strings.Builder
+	line := func(cells []string, alignRight []bool) {
+		var l strings.Builder
+		for i, cell := range cells {
+			if i > 0 {
+				l.WriteString("|")
+			}
+			pad := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell))
+			if alignRight != nil && alignRight[i] {
+				l.WriteString(" " + pad + cell + " ")
+			} else {
+				l.WriteString(" " + cell + pad + " ")
+			}
+		}
+		sb.WriteString(strings.TrimRight(l.String(), " ") + "\n")
+	}
+	line(cols, nil)
+	for i, w := range widths {
+		if i > 0 {
+			sb.WriteString("+")
+		}
+		sb.WriteString(strings.Repeat("-", w+2))
+	}
+	sb.WriteString("\n")
+	for _, row := range rows {
+		line(row, right)
+	}
+	if len(rows) == 1 {
+		sb.WriteString("(1 row)\n")
+	} else {
+		fmt.Fprintf(&sb, "(%d rows)\n", len(rows))
+	}
+	fmt.Print(sb.String())
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"godb/internal/storage/index/btree"
+)
+
+const verifyUsage = `usage: godb verify <database file>
+
+checks the meta page, the free list and every page of the trees: the node
+layouts, the order of the keys, the separators of the branch nodes, that no
+page is both free and in a tree and that no page is lost. pages have no
+checksums, a page is checked by its header and its layout. it prints the
+problems with their pages and fails if there are any. the file must not be
+written while it is checked.
+`
+
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, verifyUsage) }
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	report, err := btree.Check(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	for _, e := range report.Errors {
+		fmt.Println(e)
+	}
+	if report.More {
+		fmt.Printf("more than %d problems\n", btree.CHECK_MAX_ERRORS)
+	}
+	if report.Pages > 0 {
+		fmt.Printf("seq %d, %d pages: %d in trees of %d buckets, %d free, %d of the free list\n",
+			report.Seq, report.Pages, report.TreePages, report.Buckets, report.FreePages, report.ListPages)
+	}
+	if !report.OK() {
+		return fmt.Errorf("%s is corrupted", fs.Arg(0))
+	}
+	return nil
+}
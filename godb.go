@@ -0,0 +1,591 @@
+// Package godb is the embedded key-value store, the supported API of the
+// engine in internal/storage/index/btree. the internal packages change
+// with the engine, the types and the functions of this package only
+// change with the major version.
+//
+//	db, err := godb.Open("app.db", godb.WithBloomBits(10))
+//	if err != nil {
+//		return err
+//	}
+//	defer db.Close()
+//	err = db.Update(func(tx *godb.Tx) error {
+//		b, err := tx.CreateBucketIfNotExists([]byte("users"))
+//		if err != nil {
+//			return err
+//		}
+//		return b.Set([]byte("alice"), []byte("admin"))
+//	})
+package godb
+
+import (
+	"time"
+
+	"godb/internal/storage/index/btree"
+)
+
+// the errors of the engine, compared with errors.Is
+var (
+	ErrTxClosed       = btree.ErrTxClosed
+	ErrTxReadOnly     = btree.ErrTxReadOnly
+	ErrInvalidKey     = btree.ErrInvalidKey // the empty key
+	ErrKeyNotFound    = btree.ErrKeyNotFound
+	ErrKeyTooLarge    = btree.ErrKeyTooLarge
+	ErrValueTooLarge  = btree.ErrValueTooLarge
+	ErrDatabaseFull   = btree.ErrDatabaseFull
+	ErrBucketExists   = btree.ErrBucketExists
+	ErrBucketNotFound = btree.ErrBucketNotFound
+	ErrBucketName     = btree.ErrBucketName
+	ErrConfig         = btree.ErrConfig
+	ErrDiffMismatch   = btree.ErrDiffMismatch
+	ErrMergeOrder     = btree.ErrMergeOrder
+)
+
+type Option = btree.Option
+
+// a set or a delete of Merge, the key is deleted if Del is set
+type MergePair = btree.MergePair
+
+// Set and Del return once the update is applied in memory, the updates
+// are flushed every `interval`
+func WithAsync(interval time.Duration) Option {
+	return btree.WithAsync(interval)
+}
+
+// the file is written by another process, it's read again every `refresh`
+func WithReadOnly(refresh time.Duration) Option {
+	return btree.WithReadOnly(refresh)
+}
+
+// commits skip their fsyncs: a crash can lose the last commits or break
+// the file
+func WithNoSync() Option {
+	return btree.WithNoSync()
+}
+
+// the file can't grow past `size` bytes, a commit past it fails with
+// ErrDatabaseFull
+func WithMmapLimit(size int64) Option {
+	return btree.WithMmapLimit(size)
+}
+
+// pages are read into a buffer pool of about `pages` pages instead of
+// mapping the file
+func WithPoolPages(pages int) Option {
+	return btree.WithPoolPages(pages)
+}
+
+// Bloom filters of the leaves with `bits` per key
+func WithBloomBits(bits int) Option {
+	return btree.WithBloomBits(bits)
+}
+
+// the largest keys and values of a new file
+func WithMaxSizes(key, val int) Option {
+	return btree.WithMaxSizes(key, val)
+}
+
+// DB is a database file. its methods can be called by goroutines at once:
+// there is a single write transaction at a time and any number of read
+// transactions, each one reads the version it began with.
+type DB struct {
+	kv *btree.KV
+}
+
+// opens the database at `path`, creating it if there is none
+func Open(path string, opts ...Option) (*DB, error) {
+	kv, err := btree.Open(path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{kv: kv}, nil
+}
+
+// flushes the queued updates and closes the file. transactions must be
+// finished before.
+func (db *DB) Close() error {
+	return db.kv.Close()
+}
+
+// the value of `key`, a copy
+func (db *DB) Get(key []byte) ([]byte, bool) {
+	return db.kv.Get(key)
+}
+
+func (db *DB) Set(key []byte, val []byte) error {
+	return db.kv.Set(key, val)
+}
+
+func (db *DB) Del(key []byte) (bool, error) {
+	return db.kv.Del(key)
+}
+
+// waits until the updates so far are durable
+func (db *DB) Sync() error {
+	return db.kv.Sync()
+}
+
+// begins the write transaction, waits for the current one to finish
+func (db *DB) Begin() *Tx {
+	return &Tx{tx: db.kv.Begin()}
+}
+
+// begins a read transaction of the last durable version
+func (db *DB) BeginRead() *Tx {
+	return &Tx{tx: db.kv.BeginRead()}
+}
+
+// runs `fn` in a write transaction, committed if it returns nil and rolled
+// back otherwise
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	tx := db.Begin()
+	defer tx.rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// runs `fn` in a read transaction
+func (db *DB) View(fn func(tx *Tx) error) error {
+	tx := db.BeginRead()
+	defer tx.rollback()
+	return fn(tx)
+}
+
+// Tx is a transaction. the values it returns are valid until it ends,
+// see GetCopy. a transaction is used by one goroutine.
+type Tx struct {
+	tx *btree.Tx
+}
+
+func (tx *Tx) Writable() bool {
+	return tx.tx.Writable()
+}
+
+// waits until the updates are durable, unless the database is async
+func (tx *Tx) Commit() error {
+	return tx.tx.Commit()
+}
+
+// ends the transaction, the updates are discarded
+func (tx *Tx) Rollback() error {
+	return tx.tx.Rollback()
+}
+
+// Rollback unless the transaction is committed, for Update and View
+func (tx *Tx) rollback() {
+	tx.tx.Rollback()
+}
+
+func (tx *Tx) Get(key []byte) ([]byte, bool) {
+	return tx.tx.Get(key)
+}
+
+// like Get, the value can be kept after the transaction
+func (tx *Tx) GetCopy(key []byte) ([]byte, bool) {
+	return tx.tx.GetCopy(key)
+}
+
+func (tx *Tx) Set(key []byte, val []byte) error {
+	return tx.tx.Set(key, val)
+}
+
+func (tx *Tx) Del(key []byte) (bool, error) {
+	return tx.tx.Del(key)
+}
+
+// applies the sets and the deletes of `pairs`, in increasing key order, in
+// one traversal of the tree: each node a pair falls in is rebuilt once
+func (tx *Tx) Merge(pairs []MergePair) error {
+	return tx.tx.Merge(pairs)
+}
+
+// calls `fn` for every key in order, stops at the first error and returns it
+func (tx *Tx) ForEach(fn func(key, val []byte) error) error {
+	return tx.tx.ForEach(fn)
+}
+
+// calls `fn` for keys in [start, end) in order until it returns false, nil
+// `end` is up to the last key
+func (tx *Tx) Scan(start, end []byte, fn func(key, val []byte) bool) {
+	tx.tx.Scan(start, end, fn)
+}
+
+// the number of keys in [start, end), without iterating them
+func (tx *Tx) Count(start, end []byte) int {
+	return tx.tx.Count(start, end)
+}
+
+// an iterator at the first key greater than or equal to `key`
+func (tx *Tx) Seek(key []byte) *Iterator {
+	return &Iterator{iter: tx.tx.Seek(key)}
+}
+
+// an iterator at the last key less than or equal to `key`
+func (tx *Tx) SeekLE(key []byte) *Iterator {
+	return &Iterator{iter: tx.tx.SeekLE(key)}
+}
+
+// the number of keys less than `key`, its position in the order
+func (tx *Tx) Rank(key []byte) int {
+	return tx.tx.Rank(key)
+}
+
+// an iterator at the key of rank `i`, the first one is 0, not valid past
+// the last key
+func (tx *Tx) SelectNth(i int) *Iterator {
+	return &Iterator{iter: tx.tx.SelectNth(i)}
+}
+
+// calls `fn` for the keys that differ between the version of `old`, a
+// transaction begun before, and the one of the transaction until it
+// returns false. `oldVal` is nil for an added key, `newVal` for a removed
+// one. the subtrees the versions share are skipped.
+func (tx *Tx) Diff(old *Tx, fn func(key, oldVal, newVal []byte) bool) error {
+	return tx.tx.Diff(old.tx, fn)
+}
+
+// a cursor on the keys in [start, end) in order, nil `end` means up to
+// the last key. for Intersect, Union and Difference.
+func (tx *Tx) Range(start, end []byte) *Range {
+	return &Range{r: tx.tx.Range(start, end)}
+}
+
+// the top-level bucket `name`, nil if there is none
+func (tx *Tx) Bucket(name []byte) *Bucket {
+	return wrapBucket(tx.tx.Bucket(name))
+}
+
+func (tx *Tx) CreateBucket(name []byte) (*Bucket, error) {
+	return wrapBucketErr(tx.tx.CreateBucket(name))
+}
+
+func (tx *Tx) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
+	return wrapBucketErr(tx.tx.CreateBucketIfNotExists(name))
+}
+
+// deletes the top-level bucket `name`, its keys and its nested buckets
+func (tx *Tx) DeleteBucket(name []byte) error {
+	return tx.tx.DeleteBucket(name)
+}
+
+// copies the top-level bucket `src` with its nested buckets to the new
+// bucket `dst`, page by page
+func (tx *Tx) CloneBucket(src, dst []byte) error {
+	return tx.tx.CloneBucket(src, dst)
+}
+
+// the names of the top-level buckets in order
+func (tx *Tx) Buckets() [][]byte {
+	return tx.tx.Buckets()
+}
+
+// Bucket is a keyspace of its own, it can have nested buckets. it belongs
+// to the transaction that opened it.
+type Bucket struct {
+	b *btree.Bucket
+}
+
+func wrapBucket(b *btree.Bucket) *Bucket {
+	if b == nil {
+		return nil
+	}
+	return &Bucket{b: b}
+}
+
+func wrapBucketErr(b *btree.Bucket, err error) (*Bucket, error) {
+	if err != nil {
+		return nil, err
+	}
+	return wrapBucket(b), nil
+}
+
+func (b *Bucket) Get(key []byte) ([]byte, bool) {
+	return b.b.Get(key)
+}
+
+// like Get, the value can be kept after the transaction
+func (b *Bucket) GetCopy(key []byte) ([]byte, bool) {
+	return b.b.GetCopy(key)
+}
+
+func (b *Bucket) Set(key []byte, val []byte) error {
+	return b.b.Set(key, val)
+}
+
+func (b *Bucket) Del(key []byte) (bool, error) {
+	return b.b.Del(key)
+}
+
+// like Tx.Merge
+func (b *Bucket) Merge(pairs []MergePair) error {
+	return b.b.Merge(pairs)
+}
+
+// like Tx.ForEach
+func (b *Bucket) ForEach(fn func(key, val []byte) error) error {
+	return b.b.ForEach(fn)
+}
+
+// like Tx.Scan
+func (b *Bucket) Scan(start, end []byte, fn func(key, val []byte) bool) {
+	b.b.Scan(start, end, fn)
+}
+
+// like Tx.Count, the expired keys are counted until they are swept
+func (b *Bucket) Count(start, end []byte) int {
+	return b.b.Count(start, end)
+}
+
+// like Tx.Rank, the expired keys are counted until they are swept
+func (b *Bucket) Rank(key []byte) int {
+	return b.b.Rank(key)
+}
+
+// the key of rank `i`, false past the last key
+func (b *Bucket) SelectNth(i int) ([]byte, bool) {
+	return b.b.SelectNth(i)
+}
+
+// like Tx.Diff for the bucket in two transactions, `old` is nil if the
+// bucket is new
+func (b *Bucket) Diff(old *Bucket, fn func(key, oldVal, newVal []byte) bool) error {
+	if old == nil {
+		return b.b.Diff(nil, fn)
+	}
+	return b.b.Diff(old.b, fn)
+}
+
+// like Tx.Range, the expired keys are skipped
+func (b *Bucket) Range(start, end []byte) *Range {
+	return &Range{r: b.b.Range(start, end)}
+}
+
+// a number for a new key, one more than the last one
+func (b *Bucket) NextSequence() (uint64, error) {
+	return b.b.NextSequence()
+}
+
+// the nested bucket `name`, nil if there is none
+func (b *Bucket) Bucket(name []byte) *Bucket {
+	return wrapBucket(b.b.Bucket(name))
+}
+
+func (b *Bucket) CreateBucket(name []byte) (*Bucket, error) {
+	return wrapBucketErr(b.b.CreateBucket(name))
+}
+
+func (b *Bucket) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
+	return wrapBucketErr(b.b.CreateBucketIfNotExists(name))
+}
+
+func (b *Bucket) DeleteBucket(name []byte) error {
+	return b.b.DeleteBucket(name)
+}
+
+// the names of the nested buckets in order
+func (b *Bucket) Buckets() [][]byte {
+	return b.b.Buckets()
+}
+
+// Iterator walks the keys of a transaction in order, see Tx.Seek
+type Iterator struct {
+	iter *btree.BIter
+}
+
+// false past the first or the last key
+func (it *Iterator) Valid() bool {
+	return it.iter.Valid()
+}
+
+// the current key, with Valid
+func (it *Iterator) Key() []byte {
+	key, _ := it.iter.Deref()
+	return key
+}
+
+// the value of the current key, with Valid
+func (it *Iterator) Value() []byte {
+	_, val := it.iter.Deref()
+	return val
+}
+
+func (it *Iterator) Next() {
+	it.iter.Next()
+}
+
+func (it *Iterator) Prev() {
+	it.iter.Prev()
+}
+
+// Range walks the keys of a range of a transaction or a bucket in order,
+// see Tx.Range. like Iterator, it's valid until the keys are updated.
+type Range struct {
+	r *btree.RangeIter
+}
+
+// false past the end of the range
+func (r *Range) Valid() bool {
+	return r.r.Valid()
+}
+
+// the current key, with Valid
+func (r *Range) Key() []byte {
+	return r.r.Key()
+}
+
+// the value of the current key, with Valid
+func (r *Range) Value() []byte {
+	return r.r.Value()
+}
+
+func (r *Range) Next() {
+	r.r.Next()
+}
+
+// moves forward to the first key greater than or equal to `key`
+func (r *Range) Seek(key []byte) {
+	r.r.Seek(key)
+}
+
+// calls `fn` for the keys in both ranges in order until it returns false.
+// a range seeks past the keys the other one skips: the AND of two indexes.
+func Intersect(a, b *Range, fn func(key, aVal, bVal []byte) bool) {
+	btree.Intersect(a.r, b.r, fn)
+}
+
+// calls `fn` for the keys in either range in order until it returns
+// false, `aVal` is nil for a key only in `b` and `bVal` for one only in
+// `a`: the OR of two indexes
+func Union(a, b *Range, fn func(key, aVal, bVal []byte) bool) {
+	btree.Union(a.r, b.r, fn)
+}
+
+// calls `fn` for the keys of `a` that aren't in `b` in order until it
+// returns false
+func Difference(a, b *Range, fn func(key, val []byte) bool) {
+	btree.Difference(a.r, b.r, fn)
+}
+
+// Map is an ordered map of byte keys on the B-tree of the engine with its
+// pages in memory, no file. the pairs have the default limits of a DB. the
+// keys and the values passed to the callers must not be modified. not safe
+// for concurrent use, its snapshots are.
+type Map struct {
+	m *btree.Map
+}
+
+func NewMap() *Map {
+	return &Map{m: btree.NewMap()}
+}
+
+// the number of keys
+func (m *Map) Len() int {
+	return m.m.Len()
+}
+
+func (m *Map) Get(key []byte) ([]byte, bool) {
+	return m.m.Get(key)
+}
+
+// ErrInvalidKey for the empty key, ErrKeyTooLarge or ErrValueTooLarge
+func (m *Map) Set(key []byte, val []byte) error {
+	return m.m.Set(key, val)
+}
+
+// false if there is no `key`
+func (m *Map) Delete(key []byte) bool {
+	return m.m.Delete(key)
+}
+
+// like Tx.Merge
+func (m *Map) Merge(pairs []MergePair) error {
+	return m.m.Merge(pairs)
+}
+
+// calls `fn` for the keys from `start` on in order until it returns false
+func (m *Map) Ascend(start []byte, fn func(key, val []byte) bool) {
+	m.m.Ascend(start, fn)
+}
+
+// calls `fn` for the keys from `start` down in reverse order until it
+// returns false, nil `start` is from the last key
+func (m *Map) Descend(start []byte, fn func(key, val []byte) bool) {
+	m.m.Descend(start, fn)
+}
+
+// the number of keys in [start, end), nil `end` is up to the last key
+func (m *Map) Count(start, end []byte) int {
+	return m.m.Count(start, end)
+}
+
+// the number of keys less than `key`
+func (m *Map) Rank(key []byte) int {
+	return m.m.Rank(key)
+}
+
+// the pair of rank `i`, the first one is 0, false past the last key
+func (m *Map) SelectNth(i int) ([]byte, []byte, bool) {
+	return m.m.SelectNth(i)
+}
+
+// like Tx.Diff between the snapshot `old` of the map and the map
+func (m *Map) Diff(old *MapSnapshot, fn func(key, oldVal, newVal []byte) bool) error {
+	return m.m.Diff(old.s, fn)
+}
+
+// a snapshot of the map in O(1), it must be released
+func (m *Map) Snapshot() *MapSnapshot {
+	return &MapSnapshot{s: m.m.Snapshot()}
+}
+
+// MapSnapshot is a Map as it was when Snapshot was called, it shares the
+// pages with the map. its reads are safe for concurrent use, with the
+// updates of the map too.
+type MapSnapshot struct {
+	s *btree.MapSnapshot
+}
+
+// the number of keys
+func (s *MapSnapshot) Len() int {
+	return s.s.Len()
+}
+
+func (s *MapSnapshot) Get(key []byte) ([]byte, bool) {
+	return s.s.Get(key)
+}
+
+// like Map.Ascend
+func (s *MapSnapshot) Ascend(start []byte, fn func(key, val []byte) bool) {
+	s.s.Ascend(start, fn)
+}
+
+// like Map.Descend
+func (s *MapSnapshot) Descend(start []byte, fn func(key, val []byte) bool) {
+	s.s.Descend(start, fn)
+}
+
+// the number of keys in [start, end), nil `end` is up to the last key
+func (s *MapSnapshot) Count(start, end []byte) int {
+	return s.s.Count(start, end)
+}
+
+// the number of keys less than `key`
+func (s *MapSnapshot) Rank(key []byte) int {
+	return s.s.Rank(key)
+}
+
+// the pair of rank `i`, the first one is 0, false past the last key
+func (s *MapSnapshot) SelectNth(i int) ([]byte, []byte, bool) {
+	return s.s.SelectNth(i)
+}
+
+// like Map.Diff between two snapshots of a map
+func (s *MapSnapshot) Diff(old *MapSnapshot, fn func(key, oldVal, newVal []byte) bool) error {
+	return s.s.Diff(old.s, fn)
+}
+
+// the pages only the snapshot reads are deleted, it can't be read after
+func (s *MapSnapshot) Release() {
+	s.s.Release()
+}
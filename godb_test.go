@@ -0,0 +1,119 @@
+package godb
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, WithBloomBits(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("users"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Set([]byte(fmt.Sprintf("u%03d", i)), []byte("x")); err != nil {
+				return err
+			}
+		}
+		return tx.Set([]byte("a"), []byte("1"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an error rolls back
+	boom := errors.New("boom")
+	if err := db.Update(func(tx *Tx) error {
+		tx.Set([]byte("b"), []byte("2"))
+		return boom
+	}); err != boom {
+		t.Fatalf("Update() = %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if val, ok := db.Get([]byte("a")); !ok || string(val) != "1" {
+		t.Fatalf("Get() = %q, %v", val, ok)
+	}
+	if _, ok := db.Get([]byte("b")); ok {
+		t.Fatal("the rolled back update is kept")
+	}
+	err = db.View(func(tx *Tx) error {
+		if tx.Bucket([]byte("none")) != nil {
+			t.Fatal("a missing bucket isn't nil")
+		}
+		n := 0
+		tx.Bucket([]byte("users")).Scan(nil, nil, func(key, val []byte) bool {
+			n++
+			return true
+		})
+		if n != 100 {
+			t.Fatalf("%d keys scanned", n)
+		}
+		it := tx.Seek([]byte("0"))
+		if !it.Valid() || string(it.Key()) != "a" || string(it.Value()) != "1" {
+			t.Fatal("the iterator isn't at a")
+		}
+		if it.Next(); it.Valid() {
+			t.Fatalf("key %q after the last one", it.Key())
+		}
+		users := tx.Bucket([]byte("users"))
+		var keys []string
+		Intersect(users.Range([]byte("u010"), nil), users.Range(nil, []byte("u013")), func(key, aVal, bVal []byte) bool {
+			keys = append(keys, string(key))
+			return true
+		})
+		if fmt.Sprint(keys) != "[u010 u011 u012]" {
+			t.Fatalf("Intersect() = %v", keys)
+		}
+		return tx.Set([]byte("c"), nil)
+	})
+	if !errors.Is(err, ErrTxReadOnly) {
+		t.Fatalf("Set() in View = %v", err)
+	}
+}
+
+func TestMap(t *testing.T) {
+	m := NewMap()
+	for _, key := range []string{"b", "c", "a"} {
+		if err := m.Set([]byte(key), []byte(key+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Delete([]byte("c"))
+	var keys []string
+	m.Descend(nil, func(key, val []byte) bool {
+		keys = append(keys, string(key)+"="+string(val))
+		return true
+	})
+	if fmt.Sprint(keys) != "[b=bb a=aa]" || m.Len() != 2 {
+		t.Fatalf("Descend() = %v, Len() = %d", keys, m.Len())
+	}
+	if key, val, ok := m.SelectNth(m.Rank([]byte("b"))); !ok || string(key) != "b" || string(val) != "bb" {
+		t.Fatalf("SelectNth(Rank(b)) = %q, %q, %v", key, val, ok)
+	}
+	if err := m.Merge([]MergePair{{Key: []byte("a"), Val: []byte("x")}, {Key: []byte("b"), Del: true}}); err != nil || m.Len() != 1 {
+		t.Fatalf("Merge() = %v, Len() = %d", err, m.Len())
+	}
+	m.Set([]byte("b"), []byte("bb"))
+	m.Set([]byte("a"), []byte("aa"))
+	snap := m.Snapshot()
+	defer snap.Release()
+	m.Delete([]byte("a"))
+	if _, ok := snap.Get([]byte("a")); !ok || snap.Len() != 2 || m.Len() != 1 {
+		t.Fatalf("the snapshot has %d keys, the map %d", snap.Len(), m.Len())
+	}
+}
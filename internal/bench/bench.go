@@ -0,0 +1,415 @@
+// Package bench runs workloads like the YCSB core workloads against a
+// database and measures the throughput and the latency of the operations,
+// to find performance regressions of the engine end to end.
+//
+// a run loads Workload.Records keys, then Workload.Concurrency workers run
+// operations picked by the proportions of the workload on keys picked by
+// its distribution until Workload.Ops operations or Workload.Duration.
+// keys are "user" and a hash of their number like in YCSB, so the keys of
+// consecutive numbers are spread over the tree.
+//
+// workloads run against a DB, KV adapts the engine. the module in /bench
+// runs the same workloads against other engines to compare them.
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"godb/internal/storage/index/btree"
+)
+
+const (
+	OP_READ   = 0
+	OP_UPDATE = 1
+	OP_INSERT = 2
+	OP_SCAN   = 3
+	OP_RMW    = 4 // a read and a write of the key in a transaction
+	OP_COUNT  = 5
+)
+
+var OpNames = [OP_COUNT]string{"read", "update", "insert", "scan", "rmw"}
+
+const (
+	DIST_UNIFORM = 0
+	// a few keys are most of the operations, see ZIPFIAN_THETA
+	DIST_ZIPFIAN = 1
+	// like DIST_ZIPFIAN, the most recently inserted keys are the hot ones
+	DIST_LATEST = 2
+)
+
+var DistNames = []string{"uniform", "zipfian", "latest"}
+
+const (
+	ZIPFIAN_THETA = 0.99
+	LOAD_BATCH    = 1000 // keys per transaction of the load
+)
+
+var (
+	ErrWorkload = errors.New("bench: bad workload")
+	ErrNotFound = errors.New("bench: key not found")
+)
+
+// DB is the database a workload runs against. the methods are called by
+// concurrent workers, writes are durable when they return.
+type DB interface {
+	// writes the pairs in one transaction
+	Load(keys, vals [][]byte) error
+	// ErrNotFound if there is no such key
+	Read(key []byte) error
+	Update(key, val []byte) error
+	// reads up to `n` keys >= `start` in order
+	Scan(start []byte, n int) error
+	// reads the key and writes `val` in one transaction, ErrNotFound if
+	// there is no such key
+	ReadModifyWrite(key, val []byte) error
+}
+
+// the DB of the engine
+func KV(db *btree.KV) DB {
+	return kvDB{db}
+}
+
+type kvDB struct {
+	db *btree.KV
+}
+
+func (k kvDB) Load(keys, vals [][]byte) error {
+	tx := k.db.Begin()
+	for i := range keys {
+		if err := tx.Set(keys[i], vals[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (k kvDB) Read(key []byte) error {
+	if _, ok := k.db.Get(key); !ok {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (k kvDB) Update(key, val []byte) error {
+	return k.db.Set(key, val)
+}
+
+func (k kvDB) Scan(start []byte, n int) error {
+	tx := k.db.BeginRead()
+	defer tx.Rollback()
+	i := 0
+	tx.Scan(start, nil, func(key, val []byte) bool {
+		i++
+		return i < n
+	})
+	return nil
+}
+
+func (k kvDB) ReadModifyWrite(key, val []byte) error {
+	tx := k.db.Begin()
+	if _, ok := tx.Get(key); !ok {
+		tx.Rollback()
+		return ErrNotFound
+	}
+	if err := tx.Set(key, val); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type Workload struct {
+	Records     int           // keys loaded before the run
+	Ops         int           // operations of the run, 0 to run for Duration
+	Duration    time.Duration // used if Ops is 0
+	Mix         [OP_COUNT]float64
+	Dist        int
+	ValueSize   int // bytes of the values written
+	ScanLength  int // keys read by a scan
+	Concurrency int // workers running operations
+	Seed        int64
+}
+
+// the YCSB core workloads, without the sizes
+var Workloads = map[string]Workload{
+	// update heavy
+	"a": {Mix: mix(OP_READ, 0.5, OP_UPDATE, 0.5), Dist: DIST_ZIPFIAN},
+	// read mostly
+	"b": {Mix: mix(OP_READ, 0.95, OP_UPDATE, 0.05), Dist: DIST_ZIPFIAN},
+	// read only
+	"c": {Mix: mix(OP_READ, 1), Dist: DIST_ZIPFIAN},
+	// read latest
+	"d": {Mix: mix(OP_READ, 0.95, OP_INSERT, 0.05), Dist: DIST_LATEST},
+	// short ranges
+	"e": {Mix: mix(OP_SCAN, 0.95, OP_INSERT, 0.05), Dist: DIST_ZIPFIAN},
+	// read-modify-write
+	"f": {Mix: mix(OP_READ, 0.5, OP_RMW, 0.5), Dist: DIST_ZIPFIAN},
+}
+
+func mix(pairs ...float64) [OP_COUNT]float64 {
+	var m [OP_COUNT]float64
+	for i := 0; i < len(pairs); i += 2 {
+		m[int(pairs[i])] = pairs[i+1]
+	}
+	return m
+}
+
+func (w *Workload) check() error {
+	total := 0.0
+	for _, p := range w.Mix {
+		if p < 0 {
+			return fmt.Errorf("%w: a negative proportion", ErrWorkload)
+		}
+		total += p
+	}
+	switch {
+	case total == 0:
+		return fmt.Errorf("%w: no operations", ErrWorkload)
+	case w.Records <= 0:
+		return fmt.Errorf("%w: no records", ErrWorkload)
+	case w.Ops <= 0 && w.Duration <= 0:
+		return fmt.Errorf("%w: no operation count nor duration", ErrWorkload)
+	case w.Dist < DIST_UNIFORM || w.Dist > DIST_LATEST:
+		return fmt.Errorf("%w: distribution %d", ErrWorkload, w.Dist)
+	case w.ValueSize < 0 || w.ValueSize > btree.BT_MAX_VAL_SIZE:
+		return fmt.Errorf("%w: values of %d bytes", ErrWorkload, w.ValueSize)
+	case w.Mix[OP_SCAN] > 0 && w.ScanLength <= 0:
+		return fmt.Errorf("%w: scans of %d keys", ErrWorkload, w.ScanLength)
+	case w.Concurrency <= 0:
+		return fmt.Errorf("%w: %d workers", ErrWorkload, w.Concurrency)
+	}
+	return nil
+}
+
+// the latencies of an operation
+type OpStats struct {
+	Count  int
+	Errors int
+	Mean   time.Duration
+	P50    time.Duration
+	P95    time.Duration
+	P99    time.Duration
+	Max    time.Duration
+}
+
+type Result struct {
+	Ops     int // operations run, failed ones included
+	Elapsed time.Duration
+	Stats   [OP_COUNT]OpStats
+}
+
+// operations per second
+func (r *Result) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Ops) / r.Elapsed.Seconds()
+}
+
+// the key of a number, "user" and its FNV-1a hash
+func Key(n uint64) []byte {
+	h := uint64(14695981039346656037)
+	for i := 0; i < 8; i++ {
+		h ^= n >> (8 * i) & 0xff
+		h *= 1099511628211
+	}
+	return fmt.Appendf(nil, "user%020d", h)
+}
+
+func value(r *rand.Rand, size int) []byte {
+	val := make([]byte, size)
+	for i := range val {
+		val[i] = byte('a' + r.Intn(26))
+	}
+	return val
+}
+
+// writes the keys 0 to Records-1 in transactions of LOAD_BATCH keys
+func Load(db DB, w Workload) (time.Duration, error) {
+	if err := w.check(); err != nil {
+		return 0, err
+	}
+	r := rand.New(rand.NewSource(w.Seed))
+	start := time.Now()
+	for n := 0; n < w.Records; {
+		var keys, vals [][]byte
+		for end := min(n+LOAD_BATCH, w.Records); n < end; n++ {
+			keys = append(keys, Key(uint64(n)))
+			vals = append(vals, value(r, w.ValueSize))
+		}
+		if err := db.Load(keys, vals); err != nil {
+			return 0, err
+		}
+	}
+	return time.Since(start), nil
+}
+
+// runs the operations of the workload on the keys written by Load
+func Run(db DB, w Workload) (*Result, error) {
+	if err := w.check(); err != nil {
+		return nil, err
+	}
+	var total float64
+	for _, p := range w.Mix {
+		total += p
+	}
+	var (
+		keys     atomic.Uint64 // the number of the next inserted key
+		acked    atomic.Uint64 // the keys before are written
+		started  atomic.Int64  // operations started, with Ops
+		deadline time.Time
+		wg       sync.WaitGroup
+	)
+	keys.Store(uint64(w.Records))
+	acked.Store(uint64(w.Records))
+	zipf := newZipfian(uint64(w.Records), ZIPFIAN_THETA)
+	latencies := make([][OP_COUNT][]time.Duration, w.Concurrency)
+	errs := make([][OP_COUNT]int, w.Concurrency)
+
+	start := time.Now()
+	if w.Ops <= 0 {
+		deadline = start.Add(w.Duration)
+	}
+	for worker := 0; worker < w.Concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(w.Seed + int64(worker) + 1))
+			// a key written by Load or by an insert
+			pick := func() uint64 {
+				n := acked.Load()
+				switch w.Dist {
+				case DIST_ZIPFIAN:
+					return zipf.next(r) % n
+				case DIST_LATEST:
+					return n - 1 - zipf.next(r)%n
+				}
+				return uint64(r.Int63n(int64(n)))
+			}
+			for {
+				if w.Ops > 0 && started.Add(1) > int64(w.Ops) {
+					return
+				}
+				if w.Ops <= 0 && time.Now().After(deadline) {
+					return
+				}
+				op, x := 0, r.Float64()*total
+				for op < OP_COUNT-1 && x >= w.Mix[op] {
+					x -= w.Mix[op]
+					op++
+				}
+				for w.Mix[op] == 0 {
+					op-- // rounding past the last operation of the mix
+				}
+				t := time.Now()
+				err := runOp(db, r, &w, op, pick, &keys, &acked)
+				latencies[worker][op] = append(latencies[worker][op], time.Since(t))
+				if err != nil {
+					errs[worker][op]++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	res := &Result{Elapsed: time.Since(start)}
+	for op := 0; op < OP_COUNT; op++ {
+		var all []time.Duration
+		stats := &res.Stats[op]
+		for worker := range latencies {
+			all = append(all, latencies[worker][op]...)
+			stats.Errors += errs[worker][op]
+		}
+		res.Ops += len(all)
+		*stats = summarize(all, stats.Errors)
+	}
+	return res, nil
+}
+
+func runOp(db DB, r *rand.Rand, w *Workload, op int, pick func() uint64, keys, acked *atomic.Uint64) error {
+	switch op {
+	case OP_READ:
+		return db.Read(Key(pick()))
+	case OP_UPDATE:
+		return db.Update(Key(pick()), value(r, w.ValueSize))
+	case OP_INSERT:
+		n := keys.Add(1) - 1
+		err := db.Update(Key(n), value(r, w.ValueSize))
+		// the others pick the key once the keys before it are written too
+		for !acked.CompareAndSwap(n, n+1) {
+			runtime.Gosched()
+		}
+		return err
+	case OP_SCAN:
+		return db.Scan(Key(pick()), w.ScanLength)
+	case OP_RMW:
+		return db.ReadModifyWrite(Key(pick()), value(r, w.ValueSize))
+	}
+	return nil
+}
+
+func summarize(all []time.Duration, errs int) OpStats {
+	stats := OpStats{Count: len(all), Errors: errs}
+	if len(all) == 0 {
+		return stats
+	}
+	slices.Sort(all)
+	var sum time.Duration
+	for _, d := range all {
+		sum += d
+	}
+	at := func(p float64) time.Duration {
+		return all[min(int(math.Ceil(p*float64(len(all))))-1, len(all)-1)]
+	}
+	stats.Mean = sum / time.Duration(len(all))
+	stats.P50, stats.P95, stats.P99 = at(0.50), at(0.95), at(0.99)
+	stats.Max = all[len(all)-1]
+	return stats
+}
+
+// the zipfian generator of YCSB, from "Quickly Generating Billion-Record
+// Synthetic Databases" by Gray et al. 0 is the most frequent item.
+type zipfian struct {
+	items float64
+	theta float64
+	zetan float64
+	alpha float64
+	eta   float64
+}
+
+func zeta(n uint64, theta float64) float64 {
+	sum := 0.0
+	for i := uint64(1); i <= n; i++ {
+		sum += 1 / math.Pow(float64(i), theta)
+	}
+	return sum
+}
+
+func newZipfian(items uint64, theta float64) *zipfian {
+	z := &zipfian{items: float64(items), theta: theta, zetan: zeta(items, theta)}
+	zeta2 := zeta(2, theta)
+	z.alpha = 1 / (1 - theta)
+	z.eta = (1 - math.Pow(2/z.items, 1-theta)) / (1 - zeta2/z.zetan)
+	return z
+}
+
+func (z *zipfian) next(r *rand.Rand) uint64 {
+	u := r.Float64()
+	uz := u * z.zetan
+	if uz < 1 {
+		return 0
+	}
+	if uz < 1+math.Pow(0.5, z.theta) {
+		return 1
+	}
+	return uint64(z.items * math.Pow(z.eta*u-z.eta+1, z.alpha))
+}
@@ -0,0 +1,90 @@
+package bench
+
+import (
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"godb/internal/storage/index/btree"
+)
+
+func TestZipfian(t *testing.T) {
+	z := newZipfian(1000, ZIPFIAN_THETA)
+	r := rand.New(rand.NewSource(1))
+	counts := make([]int, 1000)
+	for i := 0; i < 100000; i++ {
+		n := z.next(r)
+		if n >= 1000 {
+			t.Fatalf("next() = %d of 1000 items", n)
+		}
+		counts[n]++
+	}
+	// the first item is the most frequent, the first 10% are most of them
+	hot := 0
+	for i, c := range counts {
+		if c > counts[0] {
+			t.Fatalf("item %d: %d times, item 0: %d", i, c, counts[0])
+		}
+		if i < 100 {
+			hot += c
+		}
+	}
+	if hot < 60000 {
+		t.Fatalf("the first 100 items: %d times of 100000", hot)
+	}
+}
+
+func TestRun(t *testing.T) {
+	db := &btree.KV{Path: filepath.Join(t.TempDir(), "bench.db")}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	w := Workloads["a"]
+	w.Records, w.ValueSize, w.Ops, w.Concurrency = 2500, 100, 1, 1
+	if _, err := Load(KV(db), w); err != nil {
+		t.Fatal(err)
+	}
+	tx := db.BeginRead()
+	if n := tx.Count(nil, nil); n != 2500 {
+		t.Fatalf("%d keys loaded", n)
+	}
+	tx.Rollback()
+
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		w := Workloads[name]
+		w.Records, w.ValueSize, w.ScanLength = 2500, 100, 10
+		w.Ops, w.Concurrency = 400, 4
+		res, err := Run(KV(db), w)
+		if err != nil {
+			t.Fatalf("workload %s: %v", name, err)
+		}
+		if res.Ops != 400 || res.Throughput() <= 0 {
+			t.Fatalf("workload %s: %d operations, %f/s", name, res.Ops, res.Throughput())
+		}
+		for op, stats := range res.Stats {
+			if stats.Errors != 0 {
+				t.Fatalf("workload %s: %d %s errors", name, stats.Errors, OpNames[op])
+			}
+			if stats.Count > 0 && w.Mix[op] == 0 || stats.Count == 0 && w.Mix[op] > 0.1 {
+				t.Fatalf("workload %s: %d %s operations", name, stats.Count, OpNames[op])
+			}
+			if stats.Count > 0 && !(stats.P50 <= stats.P95 && stats.P95 <= stats.P99 && stats.P99 <= stats.Max) {
+				t.Fatalf("workload %s: %s latencies %+v", name, OpNames[op], stats)
+			}
+		}
+	}
+
+	w = Workloads["c"]
+	w.Records, w.Duration, w.Concurrency = 2500, 50*time.Millisecond, 2
+	if res, err := Run(KV(db), w); err != nil || res.Elapsed < 50*time.Millisecond {
+		t.Fatalf("Run() for %v: %v, %v", w.Duration, res, err)
+	}
+	w.Concurrency = 0
+	if _, err := Run(KV(db), w); !errors.Is(err, ErrWorkload) {
+		t.Fatalf("Run() without workers: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+// Package dsa has in-memory data structures shared by the storage engines.
+package dsa
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// SkipList is a concurrent ordered map of byte keys. inserts are lock-free:
+// a node is linked into the bottom level by a compare-and-swap and then
+// into the levels above it one by one, a failed swap searches that level
+// again. readers don't lock and see a key once it's in the bottom level.
+//
+// keys are never removed, a memtable deletes by inserting a tombstone
+// value. keys and values are not copied and must not be modified.
+type SkipList struct {
+	head   *slNode
+	height atomic.Int32 // levels in use
+	count  atomic.Int64
+	size   atomic.Int64 // bytes of the keys and values
+}
+
+const (
+	SKIPLIST_MAX_HEIGHT = 20
+	SKIPLIST_BRANCHING  = 4 // 1 in 4 nodes of a level is in the next one
+)
+
+type slNode struct {
+	key  []byte
+	val  atomic.Pointer[[]byte]
+	next []atomic.Pointer[slNode]
+}
+
+func NewSkipList() *SkipList {
+	l := &SkipList{head: &slNode{next: make([]atomic.Pointer[slNode], SKIPLIST_MAX_HEIGHT)}}
+	l.height.Store(1)
+	return l
+}
+
+func randomHeight() int {
+	h := 1
+	for h < SKIPLIST_MAX_HEIGHT && rand.IntN(SKIPLIST_BRANCHING) == 0 {
+		h++
+	}
+	return h
+}
+
+func (l *SkipList) Len() int { return int(l.count.Load()) }
+
+// bytes of the keys and values, replaced values are not counted
+func (l *SkipList) Size() int64 { return l.size.Load() }
+
+// the last node of `level` before `key` starting at `before`, and the next one
+func (l *SkipList) findLevel(key []byte, before *slNode, level int) (*slNode, *slNode) {
+	for {
+		next := before.next[level].Load()
+		if next == nil || bytes.Compare(next.key, key) >= 0 {
+			return before, next
+		}
+		before = next
+	}
+}
+
+// the first node with a key >= `key`, filling the nodes before it by level
+func (l *SkipList) find(key []byte, preds []*slNode) *slNode {
+	pred, succ := l.head, (*slNode)(nil)
+	for level := int(l.height.Load()) - 1; level >= 0; level-- {
+		pred, succ = l.findLevel(key, pred, level)
+		if preds != nil {
+			preds[level] = pred
+		}
+	}
+	return succ
+}
+
+func (l *SkipList) Get(key []byte) ([]byte, bool) {
+	n := l.find(key, nil)
+	if n == nil || !bytes.Equal(n.key, key) {
+		return nil, false
+	}
+	return *n.val.Load(), true
+}
+
+// inserts or replaces the value of `key`
+func (l *SkipList) Set(key, val []byte) {
+	h := randomHeight()
+	for {
+		cur := l.height.Load()
+		if int(cur) >= h || l.height.CompareAndSwap(cur, int32(h)) {
+			break
+		}
+	}
+
+	var preds [SKIPLIST_MAX_HEIGHT]*slNode
+	for i := range preds {
+		preds[i] = l.head // levels above the height seen by find
+	}
+	node := &slNode{key: key, next: make([]atomic.Pointer[slNode], h)}
+	node.val.Store(&val)
+	for {
+		succ := l.find(key, preds[:])
+		if succ != nil && bytes.Equal(succ.key, key) {
+			old := succ.val.Swap(&val)
+			l.size.Add(int64(len(val) - len(*old)))
+			return
+		}
+		node.next[0].Store(succ)
+		if preds[0].next[0].CompareAndSwap(succ, node) {
+			break
+		}
+	}
+	l.count.Add(1)
+	l.size.Add(int64(len(key) + len(val)))
+
+	for level := 1; level < h; level++ {
+		for {
+			pred, succ := l.findLevel(key, preds[level], level)
+			node.next[level].Store(succ)
+			if pred.next[level].CompareAndSwap(succ, node) {
+				break
+			}
+			preds[level] = pred
+		}
+	}
+}
+
+// SkipIter iterates the keys in order. keys inserted during the iteration
+// are seen if they are after the current one.
+type SkipIter struct {
+	list *SkipList
+	node *slNode
+}
+
+// an iterator at the first key >= `key`, nil is the first key
+func (l *SkipList) Seek(key []byte) *SkipIter {
+	return &SkipIter{list: l, node: l.find(key, nil)}
+}
+
+func (it *SkipIter) Valid() bool { return it.node != nil }
+
+func (it *SkipIter) Next() { it.node = it.node.next[0].Load() }
+
+func (it *SkipIter) Deref() ([]byte, []byte) {
+	return it.node.key, *it.node.val.Load()
+}
+
+// calls `fn` on the keys `start <= key < end` in order until it returns
+// false, nil bounds are unbounded
+func (l *SkipList) Scan(start, end []byte, fn func(key, val []byte) bool) {
+	for it := l.Seek(start); it.Valid(); it.Next() {
+		key, val := it.Deref()
+		if end != nil && bytes.Compare(key, end) >= 0 || !fn(key, val) {
+			return
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package dsa
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestSkipList(t *testing.T) {
+	l := NewSkipList()
+	for _, k := range []string{"b", "d", "a", "c", "", "bb"} {
+		l.Set([]byte(k), []byte("v"+k))
+	}
+	l.Set([]byte("c"), []byte("new"))
+	if l.Len() != 6 || l.Size() != 19 {
+		t.Fatalf("Len() = %d, Size() = %d", l.Len(), l.Size())
+	}
+	if v, ok := l.Get([]byte("c")); !ok || string(v) != "new" {
+		t.Fatalf("Get(c) = %q, %v", v, ok)
+	}
+	if _, ok := l.Get([]byte("ba")); ok {
+		t.Fatal("Get() of a missing key")
+	}
+
+	var got []string
+	l.Scan([]byte("b"), []byte("d"), func(key, val []byte) bool {
+		got = append(got, string(key))
+		return true
+	})
+	if fmt.Sprint(got) != "[b bb c]" {
+		t.Fatalf("Scan(b, d) = %v", got)
+	}
+	got = got[:0]
+	for it := l.Seek(nil); it.Valid(); it.Next() {
+		key, _ := it.Deref()
+		got = append(got, string(key))
+	}
+	if fmt.Sprint(got) != "[ a b bb c d]" {
+		t.Fatalf("Seek(nil) = %v", got)
+	}
+	if l.Seek([]byte("e")).Valid() {
+		t.Fatal("Seek() past the last key")
+	}
+}
+
+func TestSkipListConcurrent(t *testing.T) {
+	const writers, keys = 8, 2000
+	l := NewSkipList()
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// the writers insert the same keys in different orders
+			for i := 0; i < keys; i++ {
+				k := (i*7919 + w*keys/writers) % keys
+				l.Set([]byte(fmt.Sprintf("key%05d", k)), []byte(fmt.Sprint(w)))
+			}
+		}()
+	}
+	// readers iterate while the keys are inserted
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				var prev []byte
+				for it := l.Seek(nil); it.Valid(); it.Next() {
+					key, _ := it.Deref()
+					if prev != nil && string(prev) >= string(key) {
+						t.Errorf("%q after %q", key, prev)
+						return
+					}
+					prev = key
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if l.Len() != keys {
+		t.Fatalf("Len() = %d, want %d", l.Len(), keys)
+	}
+	var got []string
+	l.Scan(nil, nil, func(key, val []byte) bool {
+		got = append(got, string(key))
+		return true
+	})
+	if len(got) != keys || !slices.IsSorted(got) {
+		t.Fatalf("Scan() = %d keys, sorted %v", len(got), slices.IsSorted(got))
+	}
+	for i := 0; i < keys; i++ {
+		if _, ok := l.Get([]byte(fmt.Sprintf("key%05d", i))); !ok {
+			t.Fatalf("Get(key%05d) missing", i)
+		}
+	}
+}
+
+func BenchmarkSkipListSet(b *testing.B) {
+	l := NewSkipList()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			l.Set([]byte(fmt.Sprintf("key%016d", i*7919)), []byte("value"))
+			i++
+		}
+	})
+}
@@ -0,0 +1,301 @@
+package dump
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+
+	"godb/internal/storage/index/btree"
+)
+
+// ImportBolt reads a bbolt (or boltdb) file without the library and copies
+// its buckets, nested buckets, keys and bucket sequences to the database.
+// the keys of bolt are all in buckets, a bucket of the root of the file is
+// a bucket under the path given to ImportBolt.
+//
+// bolt file, the fields are little endian
+//
+//	page  | id 8B | flags 2B | count 2B | overflow 4B | data |
+//	meta  | magic 4B | version 4B | pageSize 4B | flags 4B | root 8B | sequence 8B
+//	      | freelist 8B | pgid 8B | txid 8B | checksum 8B |
+//	branch element | pos 4B | ksize 4B | pgid 8B |
+//	leaf element   | flags 4B | pos 4B | ksize 4B | vsize 4B |
+//
+// the key of an element is at its address plus pos, the value follows. the
+// value of a bucket is its root and sequence, then its page if the root is
+// 0 (an inline bucket). a page is 1+overflow pages long.
+
+const (
+	BOLT_MAGIC   = 0xED0CDAED
+	BOLT_VERSION = 2
+
+	boltPageHeader  = 16
+	boltElement     = 16
+	boltBranchPage  = 0x01
+	boltLeafPage    = 0x02
+	boltMetaPage    = 0x04
+	boltBucketLeaf  = 0x01
+	boltBucketValue = 16
+)
+
+var ErrBolt = errors.New("not a bolt file")
+
+type boltFile struct {
+	f        *os.File
+	pageSize int
+	pages    uint64 // of the file
+	root     uint64 // the root bucket
+}
+
+func openBolt(path string) (*boltFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	bf := &boltFile{f: f}
+	if err := bf.readMeta(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return bf, nil
+}
+
+// uses the valid meta page of the last transaction, the meta pages are the
+// first two. the second is after the page size of the first, or of a
+// common size if the first is damaged.
+func (bf *boltFile) readMeta() error {
+	var best []byte
+	offsets := []int64{0}
+	meta0, err := bf.meta(0)
+	if err == nil {
+		offsets = append(offsets, int64(binary.LittleEndian.Uint32(meta0[24:28])))
+	} else {
+		for size := int64(4096); size <= 65536; size *= 2 {
+			offsets = append(offsets, size)
+		}
+	}
+	for _, off := range offsets {
+		meta, err := bf.meta(off)
+		if err != nil {
+			continue
+		}
+		txid := binary.LittleEndian.Uint64(meta[64:72])
+		if best == nil || txid > binary.LittleEndian.Uint64(best[64:72]) {
+			best = meta
+		}
+	}
+	if best == nil {
+		return fmt.Errorf("%w: no valid meta page", ErrBolt)
+	}
+	bf.pageSize = int(binary.LittleEndian.Uint32(best[24:28]))
+	fi, err := bf.f.Stat()
+	if err != nil {
+		return err
+	}
+	bf.pages = uint64(fi.Size()) / uint64(bf.pageSize)
+	bf.root = binary.LittleEndian.Uint64(best[32:40])
+	return nil
+}
+
+// the meta page at `off` if it is valid
+func (bf *boltFile) meta(off int64) ([]byte, error) {
+	meta := make([]byte, boltPageHeader+64)
+	if _, err := bf.f.ReadAt(meta, off); err != nil {
+		return nil, err
+	}
+	h := fnv.New64a()
+	h.Write(meta[16:72])
+	switch {
+	case binary.LittleEndian.Uint16(meta[8:10])&boltMetaPage == 0,
+		binary.LittleEndian.Uint32(meta[16:20]) != BOLT_MAGIC,
+		binary.LittleEndian.Uint32(meta[20:24]) != BOLT_VERSION,
+		binary.LittleEndian.Uint64(meta[72:80]) != h.Sum64():
+		return nil, ErrBolt
+	}
+	size := binary.LittleEndian.Uint32(meta[24:28])
+	if size < 1024 || size&(size-1) != 0 {
+		return nil, ErrBolt
+	}
+	return meta, nil
+}
+
+// the page and its overflow pages
+func (bf *boltFile) page(id uint64) ([]byte, error) {
+	if id < 2 || id >= bf.pages {
+		return nil, fmt.Errorf("%w: page %d out of the %d pages", ErrBolt, id, bf.pages)
+	}
+	page := make([]byte, bf.pageSize)
+	if _, err := bf.f.ReadAt(page, int64(id)*int64(bf.pageSize)); err != nil {
+		return nil, fmt.Errorf("page %d: %w", id, err)
+	}
+	if overflow := binary.LittleEndian.Uint32(page[12:16]); overflow > 0 {
+		if id+1+uint64(overflow) > bf.pages {
+			return nil, fmt.Errorf("%w: page %d: %d overflow pages out of the file", ErrBolt, id, overflow)
+		}
+		page = make([]byte, (int(overflow)+1)*bf.pageSize)
+		if _, err := bf.f.ReadAt(page, int64(id)*int64(bf.pageSize)); err != nil {
+			return nil, fmt.Errorf("page %d: %w", id, err)
+		}
+	}
+	return page, nil
+}
+
+// calls fn with the elements of the bucket in key order, the value of a
+// nested bucket is its bucket value. `inline` is the page of an inline
+// bucket.
+func (bf *boltFile) forEach(root uint64, inline []byte, fn func(key, val []byte, bucket bool) error) error {
+	page := inline
+	if page == nil {
+		var err error
+		if page, err = bf.page(root); err != nil {
+			return err
+		}
+	}
+	if len(page) < boltPageHeader {
+		return fmt.Errorf("%w: short page", ErrBolt)
+	}
+	flags := binary.LittleEndian.Uint16(page[8:10])
+	count := int(binary.LittleEndian.Uint16(page[10:12]))
+	if boltPageHeader+count*boltElement > len(page) {
+		return fmt.Errorf("%w: page %d: %d elements", ErrBolt, root, count)
+	}
+	// a slice of the page, or an error
+	slice := func(elem, pos, size int) ([]byte, error) {
+		start := elem + pos
+		if pos < 0 || size < 0 || start+size > len(page) {
+			return nil, fmt.Errorf("%w: page %d: an element out of the page", ErrBolt, root)
+		}
+		return page[start : start+size], nil
+	}
+	for i := 0; i < count; i++ {
+		elem := boltPageHeader + i*boltElement
+		e := page[elem : elem+boltElement]
+		switch {
+		case flags&boltBranchPage != 0:
+			if err := bf.forEach(binary.LittleEndian.Uint64(e[8:16]), nil, fn); err != nil {
+				return err
+			}
+		case flags&boltLeafPage != 0:
+			pos := int(binary.LittleEndian.Uint32(e[4:8]))
+			ksize := int(binary.LittleEndian.Uint32(e[8:12]))
+			vsize := int(binary.LittleEndian.Uint32(e[12:16]))
+			key, err := slice(elem, pos, ksize)
+			if err != nil {
+				return err
+			}
+			val, err := slice(elem, pos+ksize, vsize)
+			if err != nil {
+				return err
+			}
+			bucket := binary.LittleEndian.Uint32(e[0:4])&boltBucketLeaf != 0
+			if err := fn(key, val, bucket); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: page %d: flags %#x", ErrBolt, root, flags)
+		}
+	}
+	return nil
+}
+
+// copies the buckets and keys of the bolt file at `path` to the buckets
+// under `bucket`, in transactions of ImportOptions.Batch keys. returns the
+// number of keys.
+func ImportBolt(path string, db *btree.KV, bucket [][]byte, opts ImportOptions) (int, error) {
+	bf, err := openBolt(path)
+	if err != nil {
+		return 0, err
+	}
+	defer bf.f.Close()
+	batch := opts.Batch
+	if batch <= 0 {
+		batch = IMPORT_BATCH
+	}
+
+	n, size := 0, 0
+	tx := db.Begin()
+	// the bucket of the path in the transaction, created if it doesn't exist
+	open := func(path [][]byte) (*btree.Bucket, error) {
+		b, err := tx.CreateBucketIfNotExists(path[0])
+		for _, name := range path[1:] {
+			if err != nil {
+				break
+			}
+			b, err = b.CreateBucketIfNotExists(name)
+		}
+		return b, err
+	}
+	var walk func(path [][]byte, root uint64, inline []byte) error
+	walk = func(path [][]byte, root uint64, inline []byte) error {
+		return bf.forEach(root, inline, func(key, val []byte, isBucket bool) error {
+			if !isBucket {
+				if size == batch {
+					if err := finish(tx, &opts); err != nil {
+						return err
+					}
+					tx, size = db.Begin(), 0
+					if opts.Progress != nil {
+						opts.Progress(n)
+					}
+				}
+				if len(key) > db.MaxKeySize || len(val) > db.MaxValueSize {
+					return fmt.Errorf("%w: key %q: a key of %d bytes and a value of %d, the limits are %d and %d",
+						ErrRecord, key, len(key), len(val), db.MaxKeySize, db.MaxValueSize)
+				}
+				var err error
+				if len(path) == 0 {
+					err = tx.Set(key, val)
+				} else if b, berr := open(path); berr != nil {
+					err = berr
+				} else {
+					err = b.Set(key, val)
+				}
+				if err != nil {
+					return fmt.Errorf("key %q: %w", key, err)
+				}
+				n, size = n+1, size+1
+				return nil
+			}
+			if len(val) < boltBucketValue {
+				return fmt.Errorf("%w: bucket %q: a value of %d bytes", ErrBolt, key, len(val))
+			}
+			child := append(path[:len(path):len(path)], key)
+			b, err := open(child)
+			if err == nil {
+				err = b.SetSequence(binary.LittleEndian.Uint64(val[8:16]))
+			}
+			if err != nil {
+				return fmt.Errorf("bucket %q: %w", key, err)
+			}
+			root := binary.LittleEndian.Uint64(val[0:8])
+			if root == 0 {
+				return walk(child, 0, val[boltBucketValue:])
+			}
+			return walk(child, root, nil)
+		})
+	}
+	if bf.root != 0 {
+		err = walk(bucket, bf.root, nil)
+	}
+	if err != nil {
+		tx.Rollback()
+		return n - size, err
+	}
+	if err := finish(tx, &opts); err != nil {
+		return n - size, err
+	}
+	if opts.Progress != nil && size > 0 {
+		opts.Progress(n)
+	}
+	return n, nil
+}
+
+// commits the transaction of a batch, or rolls it back with DryRun
+func finish(tx *btree.Tx, opts *ImportOptions) error {
+	if opts.DryRun {
+		return tx.Rollback()
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,201 @@
+package dump
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"godb/internal/storage/index/btree"
+)
+
+const testBoltPageSize = 4096
+
+type boltElem struct {
+	bucket bool
+	key    string
+	val    []byte
+}
+
+// a leaf page with its overflow pages, of the exact size if id is 0 like
+// the page of an inline bucket
+func testBoltLeaf(id uint64, elems []boltElem) []byte {
+	size := boltPageHeader + len(elems)*boltElement
+	for _, e := range elems {
+		size += len(e.key) + len(e.val)
+	}
+	if id != 0 {
+		size = (size + testBoltPageSize - 1) / testBoltPageSize * testBoltPageSize
+	}
+	page := make([]byte, size)
+	binary.LittleEndian.PutUint64(page[0:], id)
+	binary.LittleEndian.PutUint16(page[8:], boltLeafPage)
+	binary.LittleEndian.PutUint16(page[10:], uint16(len(elems)))
+	binary.LittleEndian.PutUint32(page[12:], uint32(size/testBoltPageSize-1))
+	data := boltPageHeader + len(elems)*boltElement
+	for i, e := range elems {
+		elem := boltPageHeader + i*boltElement
+		if e.bucket {
+			binary.LittleEndian.PutUint32(page[elem:], boltBucketLeaf)
+		}
+		binary.LittleEndian.PutUint32(page[elem+4:], uint32(data-elem))
+		binary.LittleEndian.PutUint32(page[elem+8:], uint32(len(e.key)))
+		binary.LittleEndian.PutUint32(page[elem+12:], uint32(len(e.val)))
+		data += copy(page[data:], e.key)
+		data += copy(page[data:], e.val)
+	}
+	return page
+}
+
+func testBoltBranch(id uint64, keys []string, kids []uint64) []byte {
+	page := make([]byte, testBoltPageSize)
+	binary.LittleEndian.PutUint64(page[0:], id)
+	binary.LittleEndian.PutUint16(page[8:], boltBranchPage)
+	binary.LittleEndian.PutUint16(page[10:], uint16(len(keys)))
+	data := boltPageHeader + len(keys)*boltElement
+	for i, key := range keys {
+		elem := boltPageHeader + i*boltElement
+		binary.LittleEndian.PutUint32(page[elem:], uint32(data-elem))
+		binary.LittleEndian.PutUint32(page[elem+4:], uint32(len(key)))
+		binary.LittleEndian.PutUint64(page[elem+8:], kids[i])
+		data += copy(page[data:], key)
+	}
+	return page
+}
+
+func boltBucket(root, seq uint64, inline []byte) []byte {
+	val := make([]byte, boltBucketValue, boltBucketValue+len(inline))
+	binary.LittleEndian.PutUint64(val[0:], root)
+	binary.LittleEndian.PutUint64(val[8:], seq)
+	return append(val, inline...)
+}
+
+func testBoltMeta(id, root, txid uint64) []byte {
+	page := make([]byte, testBoltPageSize)
+	binary.LittleEndian.PutUint64(page[0:], id)
+	binary.LittleEndian.PutUint16(page[8:], boltMetaPage)
+	binary.LittleEndian.PutUint32(page[16:], BOLT_MAGIC)
+	binary.LittleEndian.PutUint32(page[20:], BOLT_VERSION)
+	binary.LittleEndian.PutUint32(page[24:], testBoltPageSize)
+	binary.LittleEndian.PutUint64(page[32:], root)
+	binary.LittleEndian.PutUint64(page[48:], 2)
+	binary.LittleEndian.PutUint64(page[56:], 10)
+	binary.LittleEndian.PutUint64(page[64:], txid)
+	h := fnv.New64a()
+	h.Write(page[16:72])
+	binary.LittleEndian.PutUint64(page[72:], h.Sum64())
+	return page
+}
+
+// a bolt file with the buckets app (a leaf with a nested inline bucket),
+// inline and big (a branch and leaves with overflow pages)
+func writeBolt(t *testing.T, path string) map[string]string {
+	want := map[string]string{
+		"app/a": "1", "app/b": "2", "app/nested/x": "y",
+		"inline/k": "v",
+	}
+	var left, right []boltElem
+	for i := 0; i < 100; i++ {
+		key, val := fmt.Sprintf("k%03d", i), strings.Repeat(fmt.Sprint(i%10), 100)
+		want["big/"+key] = val
+		if i < 50 {
+			left = append(left, boltElem{key: key, val: []byte(val)})
+		} else {
+			right = append(right, boltElem{key: key, val: []byte(val)})
+		}
+	}
+	nested := testBoltLeaf(0, []boltElem{{key: "x", val: []byte("y")}})
+	inline := testBoltLeaf(0, []boltElem{{key: "k", val: []byte("v")}})
+	pages := [][]byte{
+		testBoltMeta(0, 0, 1), // an older transaction
+		testBoltMeta(1, 3, 2),
+		make([]byte, testBoltPageSize), // the free list
+		testBoltLeaf(3, []boltElem{
+			{bucket: true, key: "app", val: boltBucket(4, 7, nil)},
+			{bucket: true, key: "big", val: boltBucket(5, 0, nil)},
+			{bucket: true, key: "inline", val: boltBucket(0, 0, inline)},
+		}),
+		testBoltLeaf(4, []boltElem{
+			{key: "a", val: []byte("1")},
+			{key: "b", val: []byte("2")},
+			{bucket: true, key: "nested", val: boltBucket(0, 0, nested)},
+		}),
+		testBoltBranch(5, []string{"k000", "k050"}, []uint64{6, 8}),
+		testBoltLeaf(6, left), // and its overflow page 7
+		testBoltLeaf(8, right),
+	}
+	if binary.LittleEndian.Uint32(pages[6][12:16]) != 1 {
+		t.Fatal("no overflow page")
+	}
+	var data []byte
+	for _, page := range pages {
+		data = append(data, page...)
+	}
+	os.WriteFile(path, data, 0o644)
+	return want
+}
+
+func TestImportBolt(t *testing.T) {
+	dir := t.TempDir()
+	want := writeBolt(t, filepath.Join(dir, "app.bolt"))
+	db := &btree.KV{Path: filepath.Join(dir, "test.db")}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if n, err := ImportBolt(filepath.Join(dir, "app.bolt"), db, nil, ImportOptions{Batch: 7, DryRun: true}); err != nil || n != len(want) {
+		t.Fatalf("ImportBolt(DryRun) = %d, %v", n, err)
+	}
+	rtx := db.BeginRead()
+	if buckets := rtx.Buckets(); len(buckets) != 0 {
+		t.Fatalf("buckets after a dry run: %q", buckets)
+	}
+	rtx.Rollback()
+	batches := 0
+	opts := ImportOptions{Batch: 7, Progress: func(int) { batches++ }}
+	n, err := ImportBolt(filepath.Join(dir, "app.bolt"), db, [][]byte{[]byte("old")}, opts)
+	if err != nil || n != len(want) || batches != (n+6)/7 {
+		t.Fatalf("ImportBolt() = %d, %v, %d batches", n, err, batches)
+	}
+
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	got := map[string]string{}
+	var walk func(prefix string, b *btree.Bucket)
+	walk = func(prefix string, b *btree.Bucket) {
+		b.Scan(nil, nil, func(key, val []byte) bool {
+			got[prefix+string(key)] = string(val)
+			return true
+		})
+		b.ForEachBucket(func(name []byte, b *btree.Bucket) error {
+			walk(prefix+string(name)+"/", b)
+			return nil
+		})
+	}
+	old := tx.Bucket([]byte("old"))
+	if old == nil {
+		t.Fatal("no bucket old")
+	}
+	walk("", old)
+	if len(got) != len(want) {
+		t.Fatalf("%d keys, want %d", len(got), len(want))
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+	if seq := old.Bucket([]byte("app")).Sequence(); seq != 7 {
+		t.Fatalf("Sequence() of app = %d, want 7", seq)
+	}
+
+	os.WriteFile(filepath.Join(dir, "bad.bolt"), make([]byte, 2*testBoltPageSize), 0o644)
+	if _, err := ImportBolt(filepath.Join(dir, "bad.bolt"), db, nil, ImportOptions{}); !errors.Is(err, ErrBolt) {
+		t.Fatalf("ImportBolt() of zeros: %v", err)
+	}
+}
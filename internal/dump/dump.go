@@ -0,0 +1,269 @@
+// Package dump exports the key/value pairs of a database or the rows of a
+// table as JSON lines or CSV, for analysis with other tools and for moving
+// the data out of godb. ImportKV and ImportTable load them back.
+//
+// key/value pairs, one record per pair, in the main keyspace then in every
+// bucket depth first:
+//
+//	{"bucket":["users"],"key":"1","value":"alice"}
+//	bucket,key,value        (CSV, the bucket path joined by "/", a "/" of
+//	                         an escaped name is \x2f)
+//
+// table rows, one record per row in primary key order:
+//
+//	{"id":1,"name":"alice","score":null}
+//	id,name,score           (CSV, NULL is Options.Null)
+//
+// keys, values and BYTES columns are bytes, they are written as selected by
+// Options.Bytes. a STRING is written as is, TIME as RFC 3339 and a float
+// that isn't a number as the string "NaN", "+Inf" or "-Inf" in JSON.
+package dump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"godb/internal/storage/index/btree"
+	"godb/internal/table"
+)
+
+const (
+	FORMAT_JSON = 0 // JSON lines
+	FORMAT_CSV  = 1
+)
+
+const (
+	// printable ASCII as is, other bytes and the backslash as \xNN
+	BYTES_ESCAPE = 0
+	// base64 with the URL alphabet, without "/" and with padding
+	BYTES_BASE64 = 1
+	BYTES_HEX    = 2
+)
+
+var ErrOptions = errors.New("dump: bad options")
+
+type Options struct {
+	Format int
+	Bytes  int
+	// the CSV separator, ',' if 0
+	Comma rune
+	// CSV of a table: the field of NULL, empty by default
+	Null string
+	// CSV: no header line
+	NoHeader bool
+}
+
+func (opts *Options) check() error {
+	if opts.Format != FORMAT_JSON && opts.Format != FORMAT_CSV {
+		return fmt.Errorf("%w: format %d", ErrOptions, opts.Format)
+	}
+	if opts.Bytes < BYTES_ESCAPE || opts.Bytes > BYTES_HEX {
+		return fmt.Errorf("%w: bytes encoding %d", ErrOptions, opts.Bytes)
+	}
+	return nil
+}
+
+func (opts *Options) encode(data []byte) string {
+	switch opts.Bytes {
+	case BYTES_BASE64:
+		return base64.URLEncoding.EncodeToString(data)
+	case BYTES_HEX:
+		return hex.EncodeToString(data)
+	}
+	var sb strings.Builder
+	for _, c := range data {
+		if c < 0x20 || c >= 0x7f || c == '\\' {
+			fmt.Fprintf(&sb, "\\x%02x", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// writes the records in the format, a record is the names and the values
+// of its fields
+type writer struct {
+	opts *Options
+	bw   *bufio.Writer
+	cw   *csv.Writer
+	n    int
+}
+
+func newWriter(w io.Writer, opts *Options, header []string) (*writer, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	wr := &writer{opts: opts, bw: bufio.NewWriter(w)}
+	if opts.Format == FORMAT_CSV {
+		wr.cw = csv.NewWriter(wr.bw)
+		if opts.Comma != 0 {
+			wr.cw.Comma = opts.Comma
+		}
+		if !opts.NoHeader {
+			if err := wr.cw.Write(header); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return wr, nil
+}
+
+// a JSON string without the escapes of HTML characters
+func jsonString(s string) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
+
+// `values` has the JSON values of the fields, `fields` the CSV ones
+func (wr *writer) write(names []string, values [][]byte, fields []string) error {
+	wr.n++
+	if wr.cw != nil {
+		return wr.cw.Write(fields)
+	}
+	wr.bw.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			wr.bw.WriteByte(',')
+		}
+		wr.bw.Write(jsonString(name))
+		wr.bw.WriteByte(':')
+		wr.bw.Write(values[i])
+	}
+	wr.bw.WriteString("}\n")
+	return nil
+}
+
+func (wr *writer) flush() error {
+	if wr.cw != nil {
+		wr.cw.Flush()
+		if err := wr.cw.Error(); err != nil {
+			return err
+		}
+	}
+	return wr.bw.Flush()
+}
+
+// writes the key/value pairs of the main keyspace and of every bucket,
+// returns the number of records
+func KV(w io.Writer, tx *btree.Tx, opts Options) (int, error) {
+	wr, err := newWriter(w, &opts, []string{"bucket", "key", "value"})
+	if err != nil {
+		return 0, err
+	}
+	names := []string{"bucket", "key", "value"}
+	var path [][]byte
+	pair := func(key, val []byte) bool {
+		k, v := opts.encode(key), opts.encode(val)
+		if wr.cw != nil {
+			var parts []string
+			for _, name := range path {
+				// a slash of an escaped name isn't a separator
+				parts = append(parts, strings.ReplaceAll(opts.encode(name), "/", `\x2f`))
+			}
+			err = wr.write(nil, nil, []string{strings.Join(parts, "/"), k, v})
+		} else {
+			bucket := []byte{'['}
+			for i, name := range path {
+				if i > 0 {
+					bucket = append(bucket, ',')
+				}
+				bucket = append(bucket, jsonString(opts.encode(name))...)
+			}
+			bucket = append(bucket, ']')
+			err = wr.write(names, [][]byte{bucket, jsonString(k), jsonString(v)}, nil)
+		}
+		return err == nil
+	}
+	tx.Scan(nil, nil, pair)
+	var walk func(name []byte, b *btree.Bucket) error
+	walk = func(name []byte, b *btree.Bucket) error {
+		path = append(path, name)
+		defer func() { path = path[:len(path)-1] }()
+		b.Scan(nil, nil, pair)
+		if err != nil {
+			return err
+		}
+		return b.ForEachBucket(walk)
+	}
+	if err == nil {
+		err = tx.ForEachBucket(walk)
+	}
+	if err == nil {
+		err = wr.flush()
+	}
+	return wr.n, err
+}
+
+// writes the rows of the table in primary key order, returns the number
+// of rows
+func Table(w io.Writer, tx *table.Tx, name string, opts Options) (int, error) {
+	tdef, err := tx.TableDef(name)
+	if err != nil {
+		return 0, err
+	}
+	wr, err := newWriter(w, &opts, tdef.Cols)
+	if err != nil {
+		return 0, err
+	}
+	values := make([][]byte, len(tdef.Cols))
+	fields := make([]string, len(tdef.Cols))
+	scanErr := tx.Scan(name, table.Record{}, func(rec table.Record) bool {
+		for i, col := range tdef.Cols {
+			v := rec.Get(col)
+			if v == nil {
+				null := table.Null()
+				v = &null
+			}
+			values[i], fields[i] = opts.value(*v)
+		}
+		err = wr.write(tdef.Cols, values, fields)
+		return err == nil
+	})
+	if err == nil {
+		err = scanErr
+	}
+	if err == nil {
+		err = wr.flush()
+	}
+	return wr.n, err
+}
+
+// the JSON and the CSV forms of a value
+func (opts *Options) value(v table.Value) ([]byte, string) {
+	switch v.Type {
+	case table.TYPE_NULL:
+		return []byte("null"), opts.Null
+	case table.TYPE_INT64:
+		s := strconv.FormatInt(v.I64, 10)
+		return []byte(s), s
+	case table.TYPE_FLOAT64:
+		s := strconv.FormatFloat(v.F64, 'g', -1, 64)
+		if math.IsNaN(v.F64) || math.IsInf(v.F64, 0) {
+			return jsonString(s), s
+		}
+		return []byte(s), s
+	case table.TYPE_BOOL:
+		s := strconv.FormatBool(v.Bool())
+		return []byte(s), s
+	case table.TYPE_BYTES:
+		s := opts.encode(v.Str)
+		return jsonString(s), s
+	}
+	// strings and times
+	s := v.String()
+	return jsonString(s), s
+}
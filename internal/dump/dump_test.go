@@ -0,0 +1,123 @@
+package dump
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"godb/internal/storage/index/btree"
+	"godb/internal/table"
+)
+
+func TestKV(t *testing.T) {
+	db := &btree.KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx := db.Begin()
+	tx.Set([]byte("a"), []byte("1"))
+	tx.Set([]byte("b\x00"), []byte(`"<\>"`))
+	users, _ := tx.CreateBucket([]byte("users"))
+	users.Set([]byte("1"), []byte("alice"))
+	nested, _ := users.CreateBucket([]byte("a/b"))
+	nested.Set([]byte("k"), []byte{0xff})
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	rtx := db.BeginRead()
+	defer rtx.Rollback()
+	cases := []struct {
+		opts Options
+		want string
+	}{
+		{Options{}, `{"bucket":[],"key":"a","value":"1"}
+{"bucket":[],"key":"b\\x00","value":"\"<\\x5c>\""}
+{"bucket":["users"],"key":"1","value":"alice"}
+{"bucket":["users","a/b"],"key":"k","value":"\\xff"}
+`},
+		{Options{Format: FORMAT_CSV}, `bucket,key,value
+,a,1
+,b\x00,"""<\x5c>"""
+users,1,alice
+users/a\x2fb,k,\xff
+`},
+		{Options{Format: FORMAT_CSV, Bytes: BYTES_HEX, Comma: ';', NoHeader: true}, `;61;31
+;6200;223c5c3e22
+7573657273;31;616c696365
+7573657273/612f62;6b;ff
+`},
+		{Options{Bytes: BYTES_BASE64}, `{"bucket":[],"key":"YQ==","value":"MQ=="}
+{"bucket":[],"key":"YgA=","value":"IjxcPiI="}
+{"bucket":["dXNlcnM="],"key":"MQ==","value":"YWxpY2U="}
+{"bucket":["dXNlcnM=","YS9i"],"key":"aw==","value":"_w=="}
+`},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		n, err := KV(&buf, rtx, c.opts)
+		if err != nil || n != 4 || buf.String() != c.want {
+			t.Errorf("KV(%+v) = %d, %v\n%s", c.opts, n, err, buf.String())
+		}
+	}
+	if _, err := KV(&bytes.Buffer{}, rtx, Options{Format: 5}); !errors.Is(err, ErrOptions) {
+		t.Fatalf("KV() with a bad format = %v", err)
+	}
+}
+
+func TestTable(t *testing.T) {
+	db := &table.DB{Path: filepath.Join(t.TempDir(), "test.db")}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tdef := &table.TableDef{
+		Name:  "t",
+		Types: []uint32{table.TYPE_INT64, table.TYPE_STRING, table.TYPE_BYTES, table.TYPE_FLOAT64, table.TYPE_BOOL, table.TYPE_TIME},
+		Cols:  []string{"id", "name", "data", "score", "ok", "at"},
+	}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	rows := []table.Record{
+		*(&table.Record{}).AddInt64("id", 1).Add("name", table.String(`a,"b"`)).AddStr("data", []byte{0, 'x'}).
+			Add("score", table.Float64(1.5)).Add("ok", table.Bool(true)).Add("at", table.Time(at)),
+		*(&table.Record{}).AddInt64("id", 2).Add("name", table.Null()).Add("data", table.Null()).
+			Add("score", table.Float64(math.NaN())).Add("ok", table.Bool(false)).Add("at", table.Null()),
+	}
+	for _, rec := range rows {
+		if _, err := db.Insert("t", rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	cases := []struct {
+		opts Options
+		want string
+	}{
+		{Options{}, `{"id":1,"name":"a,\"b\"","data":"\\x00x","score":1.5,"ok":true,"at":"2024-01-02T03:04:05Z"}
+{"id":2,"name":null,"data":null,"score":"NaN","ok":false,"at":null}
+`},
+		{Options{Format: FORMAT_CSV, Null: `\N`, Bytes: BYTES_BASE64}, `id,name,data,score,ok,at
+1,"a,""b""",AHg=,1.5,true,2024-01-02T03:04:05Z
+2,\N,\N,NaN,false,\N
+`},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		n, err := Table(&buf, tx, "t", c.opts)
+		if err != nil || n != 2 || buf.String() != c.want {
+			t.Errorf("Table(%+v) = %d, %v\n%s", c.opts, n, err, buf.String())
+		}
+	}
+	if _, err := Table(&bytes.Buffer{}, tx, "nope", Options{}); !errors.Is(err, table.ErrTableNotFound) {
+		t.Fatalf("Table() of a missing table = %v", err)
+	}
+}
@@ -0,0 +1,359 @@
+package dump
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"godb/internal/sql"
+	"godb/internal/storage/index/btree"
+	"godb/internal/table"
+)
+
+// Import reads records in the formats written by KV and Table and writes
+// them in batches of ImportOptions.Batch records, one write transaction
+// each, instead of a transaction per key. a failed record stops the
+// import, the batches before it are committed.
+
+const IMPORT_BATCH = 10000
+
+var ErrRecord = errors.New("bad record")
+
+type ImportOptions struct {
+	Options
+	// records per transaction, IMPORT_BATCH if 0
+	Batch int
+	// the batches are written and rolled back: the records are checked
+	// against the database, but not against the records of other batches
+	DryRun bool
+	// table rows replace the rows with the same primary key instead of
+	// failing
+	Replace bool
+	// called after every batch with the number of records so far
+	Progress func(n int)
+}
+
+func (opts *Options) decode(s string) ([]byte, error) {
+	switch opts.Bytes {
+	case BYTES_BASE64:
+		return base64.URLEncoding.DecodeString(s)
+	case BYTES_HEX:
+		return hex.DecodeString(s)
+	}
+	// \xNN is a byte, anything else is as is
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if b, err := hex.DecodeString(s[i+2 : i+4]); err == nil {
+				out = append(out, b[0])
+				i += 3
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return out, nil
+}
+
+// reads the records of JSON lines or CSV
+type reader struct {
+	opts   *Options
+	jd     *json.Decoder
+	cr     *csv.Reader
+	header []string // the CSV header line, nil with NoHeader
+}
+
+func newReader(r io.Reader, opts *Options) (*reader, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	rd := &reader{opts: opts}
+	if opts.Format == FORMAT_JSON {
+		rd.jd = json.NewDecoder(bufio.NewReader(r))
+		rd.jd.UseNumber()
+		return rd, nil
+	}
+	rd.cr = csv.NewReader(bufio.NewReader(r))
+	if opts.Comma != 0 {
+		rd.cr.Comma = opts.Comma
+	}
+	if !opts.NoHeader {
+		header, err := rd.cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("header: %w", err)
+		}
+		rd.header = header
+	}
+	rd.cr.ReuseRecord = true
+	return rd, nil
+}
+
+// the next JSON object or CSV line, io.EOF at the end
+func (rd *reader) next() (map[string]any, []string, error) {
+	if rd.jd != nil {
+		var obj map[string]any
+		err := rd.jd.Decode(&obj)
+		if err == nil && obj == nil {
+			err = fmt.Errorf("%w: not an object", ErrRecord)
+		}
+		return obj, nil, err
+	}
+	fields, err := rd.cr.Read()
+	return nil, fields, err
+}
+
+// writes the records to the database in batches, `write` adds a record to
+// the transaction
+func load(db *btree.KV, rd *reader, opts *ImportOptions, write func(tx *btree.Tx, obj map[string]any, fields []string) error) (int, error) {
+	batch := opts.Batch
+	if batch <= 0 {
+		batch = IMPORT_BATCH
+	}
+	n := 0
+	for {
+		tx := db.Begin()
+		size := 0
+		var err error
+		for ; size < batch; size++ {
+			var obj map[string]any
+			var fields []string
+			if obj, fields, err = rd.next(); err != nil {
+				break
+			}
+			if err = write(tx, obj, fields); err != nil {
+				break
+			}
+		}
+		if err != nil && err != io.EOF {
+			tx.Rollback()
+			return n, fmt.Errorf("record %d: %w", n+size+1, err)
+		}
+		if opts.DryRun {
+			tx.Rollback()
+		} else if cerr := tx.Commit(); cerr != nil {
+			return n, cerr
+		}
+		n += size
+		if opts.Progress != nil && size > 0 {
+			opts.Progress(n)
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+	}
+}
+
+// loads key/value pairs written by KV into the database, the bucket path
+// of a record is under `bucket`, the main keyspace if empty. buckets are
+// created if they don't exist. returns the number of records.
+func ImportKV(r io.Reader, db *btree.KV, bucket [][]byte, opts ImportOptions) (int, error) {
+	rd, err := newReader(r, &opts.Options)
+	if err != nil {
+		return 0, err
+	}
+	if rd.header != nil && strings.Join(rd.header, ",") != "bucket,key,value" {
+		return 0, fmt.Errorf("%w: the header must be bucket,key,value", ErrRecord)
+	}
+	return load(db, rd, &opts, func(tx *btree.Tx, obj map[string]any, fields []string) error {
+		var path []string
+		var key, val string
+		if obj != nil {
+			k, ok1 := obj["key"].(string)
+			v, ok2 := obj["value"].(string)
+			if !ok1 || !ok2 {
+				return fmt.Errorf("%w: key and value must be strings", ErrRecord)
+			}
+			key, val = k, v
+			if b, ok := obj["bucket"]; ok && b != nil {
+				names, ok := b.([]any)
+				if !ok {
+					return fmt.Errorf("%w: bucket must be an array of names", ErrRecord)
+				}
+				for _, name := range names {
+					s, ok := name.(string)
+					if !ok {
+						return fmt.Errorf("%w: bucket must be an array of names", ErrRecord)
+					}
+					path = append(path, s)
+				}
+			}
+		} else {
+			if len(fields) != 3 {
+				return fmt.Errorf("%w: %d fields, want 3", ErrRecord, len(fields))
+			}
+			if fields[0] != "" {
+				path = strings.Split(fields[0], "/")
+			}
+			key, val = fields[1], fields[2]
+		}
+
+		k, err := opts.decode(key)
+		if err != nil {
+			return fmt.Errorf("%w: key: %v", ErrRecord, err)
+		}
+		v, err := opts.decode(val)
+		if err != nil {
+			return fmt.Errorf("%w: value: %v", ErrRecord, err)
+		}
+		names := append([][]byte{}, bucket...)
+		for _, name := range path {
+			b, err := opts.decode(name)
+			if err != nil {
+				return fmt.Errorf("%w: bucket: %v", ErrRecord, err)
+			}
+			names = append(names, b)
+		}
+		if len(names) == 0 {
+			return tx.Set(k, v)
+		}
+		b, err := tx.CreateBucketIfNotExists(names[0])
+		for _, name := range names[1:] {
+			if err != nil {
+				break
+			}
+			b, err = b.CreateBucketIfNotExists(name)
+		}
+		if err != nil {
+			return err
+		}
+		return b.Set(k, v)
+	})
+}
+
+// loads rows written by Table into the table. JSON objects may leave out
+// columns, CSV has the columns of the header line, or of the table with
+// NoHeader. columns left out are NULL. returns the number of rows.
+func ImportTable(r io.Reader, db *btree.KV, name string, opts ImportOptions) (int, error) {
+	rd, err := newReader(r, &opts.Options)
+	if err != nil {
+		return 0, err
+	}
+	rtx := db.BeginRead()
+	tdef, err := table.NewTx(rtx).TableDef(name)
+	rtx.Rollback()
+	if err != nil {
+		return 0, err
+	}
+	cols := map[string]int{}
+	for i, col := range tdef.Cols {
+		cols[col] = i
+	}
+	header := rd.header
+	if opts.Format == FORMAT_CSV && header == nil {
+		header = tdef.Cols
+	}
+	for _, col := range header {
+		if _, ok := cols[col]; !ok {
+			return 0, fmt.Errorf("%w: no column %s", ErrRecord, col)
+		}
+	}
+
+	mode := (*table.Tx).Insert
+	if opts.Replace {
+		mode = (*table.Tx).Upsert
+	}
+	// the table transaction of the batch keeps the definition
+	var kvtx *btree.Tx
+	var ttx *table.Tx
+	return load(db, rd, &opts, func(tx *btree.Tx, obj map[string]any, fields []string) error {
+		if tx != kvtx {
+			kvtx, ttx = tx, table.NewTx(tx)
+		}
+		vals := make([]table.Value, len(tdef.Cols))
+		for i := range vals {
+			vals[i] = table.Null()
+		}
+		if obj != nil {
+			for col, x := range obj {
+				i, ok := cols[col]
+				if !ok {
+					return fmt.Errorf("%w: no column %s", ErrRecord, col)
+				}
+				v, err := opts.jsonValue(x, tdef.Types[i])
+				if err != nil {
+					return fmt.Errorf("%w: column %s: %v", ErrRecord, col, err)
+				}
+				vals[i] = v
+			}
+		} else {
+			if len(fields) != len(header) {
+				return fmt.Errorf("%w: %d fields, want %d", ErrRecord, len(fields), len(header))
+			}
+			for j, col := range header {
+				i := cols[col]
+				v, err := opts.fieldValue(fields[j], tdef.Types[i])
+				if err != nil {
+					return fmt.Errorf("%w: column %s: %v", ErrRecord, col, err)
+				}
+				vals[i] = v
+			}
+		}
+		rec := table.Record{Cols: tdef.Cols, Vals: vals}
+		ok, err := mode(ttx, name, rec)
+		if err == nil && !ok {
+			err = fmt.Errorf("%w: the primary key exists", ErrRecord)
+		}
+		return err
+	})
+}
+
+// a value of a JSON field written by Table
+func (opts *Options) jsonValue(x any, typ uint32) (table.Value, error) {
+	switch x := x.(type) {
+	case nil:
+		return table.Null(), nil
+	case json.Number:
+		switch typ {
+		case table.TYPE_INT64:
+			i, err := x.Int64()
+			return table.Int64(i), err
+		case table.TYPE_FLOAT64:
+			f, err := x.Float64()
+			return table.Float64(f), err
+		}
+	case bool:
+		if typ == table.TYPE_BOOL {
+			return table.Bool(x), nil
+		}
+	case string:
+		if typ == table.TYPE_INT64 || typ == table.TYPE_BOOL {
+			break
+		}
+		return opts.fieldValue(x, typ)
+	}
+	return table.Value{}, fmt.Errorf("%v is not a value of type %s", x, sql.TypeName(typ))
+}
+
+// a value of a CSV field, or of a JSON string
+func (opts *Options) fieldValue(s string, typ uint32) (table.Value, error) {
+	if opts.Format == FORMAT_CSV && s == opts.Null {
+		return table.Null(), nil
+	}
+	switch typ {
+	case table.TYPE_INT64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		return table.Int64(i), err
+	case table.TYPE_FLOAT64:
+		// NaN and +Inf too
+		f, err := strconv.ParseFloat(s, 64)
+		return table.Float64(f), err
+	case table.TYPE_BOOL:
+		b, err := strconv.ParseBool(s)
+		return table.Bool(b), err
+	case table.TYPE_TIME:
+		t, err := time.Parse(time.RFC3339Nano, s)
+		return table.Time(t), err
+	case table.TYPE_BYTES:
+		b, err := opts.decode(s)
+		return table.Bytes(b), err
+	}
+	return table.String(s), nil
+}
@@ -0,0 +1,146 @@
+package dump
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"godb/internal/storage/index/btree"
+	"godb/internal/table"
+)
+
+func openKV(t *testing.T, path string) *btree.KV {
+	t.Helper()
+	db := &btree.KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestImportKV(t *testing.T) {
+	dir := t.TempDir()
+	src := openKV(t, filepath.Join(dir, "src.db"))
+	defer src.Close()
+	tx := src.Begin()
+	for i := 0; i < 250; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%03d", i)), []byte{byte(i), '\\', 'x'})
+	}
+	b, _ := tx.CreateBucket([]byte("a/b"))
+	nested, _ := b.CreateBucket([]byte{0, 1})
+	nested.Set([]byte("n"), []byte("v"))
+	tx.Commit()
+	rtx := src.BeginRead()
+	defer rtx.Rollback()
+
+	for i, opts := range []Options{{}, {Format: FORMAT_CSV}, {Format: FORMAT_CSV, Bytes: BYTES_BASE64, Comma: '\t', NoHeader: true}, {Bytes: BYTES_HEX}} {
+		var buf bytes.Buffer
+		if _, err := KV(&buf, rtx, opts); err != nil {
+			t.Fatal(err)
+		}
+		dst := openKV(t, filepath.Join(dir, fmt.Sprintf("dst%d.db", i)))
+		var progress []int
+		n, err := ImportKV(&buf, dst, [][]byte{[]byte("under")}, ImportOptions{
+			Options:  opts,
+			Batch:    100,
+			Progress: func(n int) { progress = append(progress, n) },
+		})
+		if err != nil || n != 251 || fmt.Sprint(progress) != "[100 200 251]" {
+			t.Fatalf("ImportKV(%+v) = %d, %v, progress %v", opts, n, err, progress)
+		}
+		dtx := dst.BeginRead()
+		under := dtx.Bucket([]byte("under"))
+		if val, _ := under.Get([]byte("k007")); !bytes.Equal(val, []byte{7, '\\', 'x'}) {
+			t.Fatalf("k007 = %q after importing %+v", val, opts)
+		}
+		if val, _ := under.Bucket([]byte("a/b")).Bucket([]byte{0, 1}).Get([]byte("n")); string(val) != "v" {
+			t.Fatalf("nested n = %q after importing %+v", val, opts)
+		}
+		dtx.Rollback()
+		dst.Close()
+	}
+
+	// a bad record stops the import, the batches before it stay
+	db := openKV(t, filepath.Join(dir, "bad.db"))
+	defer db.Close()
+	in := `{"key":"a","value":"1"}
+{"key":"b","value":"2"}
+{"key":"c","value":3}
+`
+	n, err := ImportKV(strings.NewReader(in), db, nil, ImportOptions{Batch: 2})
+	if !errors.Is(err, ErrRecord) || !strings.Contains(err.Error(), "record 3") || n != 2 {
+		t.Fatalf("ImportKV() of a bad record = %d, %v", n, err)
+	}
+	if _, ok := db.Get([]byte("b")); !ok {
+		t.Fatal("the batch before the bad record isn't committed")
+	}
+	n, err = ImportKV(strings.NewReader(`{"key":"d","value":"4"}`), db, nil, ImportOptions{DryRun: true})
+	if _, ok := db.Get([]byte("d")); err != nil || n != 1 || ok {
+		t.Fatalf("dry run = %d, %v, d written %v", n, err, ok)
+	}
+}
+
+func TestImportTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	tdb := &table.DB{Path: path}
+	if err := tdb.Open(); err != nil {
+		t.Fatal(err)
+	}
+	tdef := &table.TableDef{
+		Name:  "t",
+		Types: []uint32{table.TYPE_INT64, table.TYPE_STRING, table.TYPE_BYTES, table.TYPE_FLOAT64, table.TYPE_BOOL, table.TYPE_TIME},
+		Cols:  []string{"id", "name", "data", "score", "ok", "at"},
+	}
+	if err := tdb.TableNew(tdef); err != nil {
+		t.Fatal(err)
+	}
+	tdb.Close()
+	db := openKV(t, path)
+	defer db.Close()
+
+	in := `{"id":1,"name":"a,\"b\"","data":"\\x00x","score":1.5,"ok":true,"at":"2024-01-02T03:04:05Z"}
+{"id":2,"score":"NaN","ok":false}
+`
+	if n, err := ImportTable(strings.NewReader(in), db, "t", ImportOptions{}); err != nil || n != 2 {
+		t.Fatalf("ImportTable() = %d, %v", n, err)
+	}
+	dump := func(opts Options) string {
+		tx := db.BeginRead()
+		defer tx.Rollback()
+		var buf bytes.Buffer
+		if _, err := Table(&buf, table.NewTx(tx), "t", opts); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	if got := dump(Options{}); got != in[:strings.Index(in, "\n")+1]+`{"id":2,"name":null,"data":null,"score":"NaN","ok":false,"at":null}`+"\n" {
+		t.Fatalf("rows after importing JSON:\n%s", got)
+	}
+
+	// the primary key exists
+	if _, err := ImportTable(strings.NewReader(`{"id":1}`), db, "t", ImportOptions{}); !errors.Is(err, ErrRecord) {
+		t.Fatalf("ImportTable() of an existing key = %v", err)
+	}
+	csv := "ok,id,name\ntrue,2,\\N\nfalse,3,c\n"
+	opts := ImportOptions{Options: Options{Format: FORMAT_CSV, Null: `\N`}, Replace: true}
+	if n, err := ImportTable(strings.NewReader(csv), db, "t", opts); err != nil || n != 2 {
+		t.Fatalf("ImportTable() of CSV = %d, %v", n, err)
+	}
+	want := `id,name,data,score,ok,at
+1,"a,""b""",\x00x,1.5,true,2024-01-02T03:04:05Z
+2,\N,\N,\N,true,\N
+3,c,\N,\N,false,\N
+`
+	if got := dump(Options{Format: FORMAT_CSV, Null: `\N`}); got != want {
+		t.Fatalf("rows after importing CSV:\n%s", got)
+	}
+	if _, err := ImportTable(strings.NewReader("id,nope\n"), db, "t", opts); !errors.Is(err, ErrRecord) {
+		t.Fatalf("ImportTable() with a bad header = %v", err)
+	}
+	if _, err := ImportTable(strings.NewReader(`{"id":"x"}`), db, "t", ImportOptions{}); !errors.Is(err, ErrRecord) {
+		t.Fatalf("ImportTable() of a bad value = %v", err)
+	}
+}
@@ -0,0 +1,396 @@
+// Package godbtest checks an engine against a model: random sequences of
+// operations run on both, every result of the engine is compared with the
+// one of the model, and a failing sequence is shrunk to a short one that
+// still fails before it's reported.
+//
+// an Engine is a map of byte keys in order, Map is the model of one. the
+// engine can be a new implementation, a KV with options, a layer above
+// one... KV adapts the engine of this module. with Reopener the sequences
+// close and open the engine between operations, with Verifier the
+// structure of the engine is checked after every sequence.
+package godbtest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const (
+	OP_GET    = 0
+	OP_SET    = 1
+	OP_DEL    = 2
+	OP_SCAN   = 3
+	OP_REOPEN = 4 // with Reopener
+	OP_COUNT  = 5
+)
+
+var OpNames = [OP_COUNT]string{"Get", "Set", "Del", "Scan", "Reopen"}
+
+var ErrConfig = errors.New("godbtest: bad config")
+
+// Engine is what the sequences run against, the model is one too. the
+// methods are called by one goroutine.
+type Engine interface {
+	Get(key []byte) ([]byte, bool, error)
+	Set(key, val []byte) error
+	Del(key []byte) (bool, error)
+	// calls `fn` for the keys in [start, end) in order until it returns
+	// false, end is nil for no bound
+	Scan(start, end []byte, fn func(key, val []byte) bool) error
+	Close() error
+}
+
+// an Engine that can be closed and opened again, OP_REOPEN checks that the
+// writes before it are kept
+type Reopener interface {
+	Reopen() error
+}
+
+// an Engine with a check of its structure, run after every sequence
+type Verifier interface {
+	Verify() error
+}
+
+type Op struct {
+	Kind  int
+	Key   []byte
+	End   []byte // of OP_SCAN, nil for no bound
+	Val   []byte // of OP_SET
+	Limit int    // keys read by OP_SCAN
+}
+
+func (op Op) String() string {
+	switch op.Kind {
+	case OP_SET:
+		return fmt.Sprintf("Set(%q, %d bytes)", op.Key, len(op.Val))
+	case OP_SCAN:
+		return fmt.Sprintf("Scan(%q, %q, %d)", op.Key, op.End, op.Limit)
+	case OP_REOPEN:
+		return "Reopen()"
+	default:
+		return fmt.Sprintf("%s(%q)", OpNames[op.Kind], op.Key)
+	}
+}
+
+type Config struct {
+	// a new empty engine for every run of a sequence, shrinking runs many
+	New func() (Engine, error)
+	// a new empty model, NewMap if nil
+	Model func() Engine
+
+	Seqs     int // sequences
+	Ops      int // operations of a sequence
+	Keys     int // distinct keys, fewer keys are more updates of the same ones
+	MaxValue int // bytes of the values written
+	Mix      [OP_COUNT]float64
+	Seed     int64
+}
+
+// the proportions of the operations if Config.Mix is zero
+var DefaultMix = [OP_COUNT]float64{OP_GET: 0.3, OP_SET: 0.35, OP_DEL: 0.2, OP_SCAN: 0.1, OP_REOPEN: 0.05}
+
+func (c *Config) check() error {
+	if c.Mix == [OP_COUNT]float64{} {
+		c.Mix = DefaultMix
+	}
+	if c.Model == nil {
+		c.Model = func() Engine { return NewMap() }
+	}
+	total := 0.0
+	for _, p := range c.Mix {
+		if p < 0 {
+			return fmt.Errorf("%w: a negative proportion", ErrConfig)
+		}
+		total += p
+	}
+	switch {
+	case c.New == nil:
+		return fmt.Errorf("%w: no engine", ErrConfig)
+	case total == 0:
+		return fmt.Errorf("%w: no operations", ErrConfig)
+	case c.Seqs <= 0 || c.Ops <= 0:
+		return fmt.Errorf("%w: %d sequences of %d operations", ErrConfig, c.Seqs, c.Ops)
+	case c.Keys <= 0:
+		return fmt.Errorf("%w: %d keys", ErrConfig, c.Keys)
+	case c.MaxValue < 0:
+		return fmt.Errorf("%w: values of %d bytes", ErrConfig, c.MaxValue)
+	}
+	return nil
+}
+
+// Failure is a sequence of operations with a different result on the
+// engine and the model, or an error of the engine
+type Failure struct {
+	Ops  []Op // the shrunk sequence
+	Step int  // the failing operation, len(Ops) for Verify or Close
+	Msg  string
+	Seed int64 // of the original sequence
+	Len  int   // of the original sequence
+}
+
+func (f *Failure) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "godbtest: step %d of %d (shrunk from %d, seed %d): %s", f.Step, len(f.Ops), f.Len, f.Seed, f.Msg)
+	for i, op := range f.Ops {
+		mark := " "
+		if i == f.Step {
+			mark = ">"
+		}
+		fmt.Fprintf(&sb, "\n%s %3d %s", mark, i, op)
+	}
+	return sb.String()
+}
+
+// generates a sequence of `c.Ops` operations
+func Generate(c Config, r *rand.Rand) []Op {
+	if c.Mix == [OP_COUNT]float64{} {
+		c.Mix = DefaultMix
+	}
+	total := 0.0
+	for _, p := range c.Mix {
+		total += p
+	}
+	key := func() []byte {
+		return []byte(fmt.Sprintf("k%04d", r.Intn(c.Keys)))
+	}
+	ops := make([]Op, 0, c.Ops)
+	for len(ops) < c.Ops {
+		op := Op{Kind: OP_COUNT - 1}
+		x := r.Float64() * total
+		for kind, p := range c.Mix {
+			if x < p {
+				op.Kind = kind
+				break
+			}
+			x -= p
+		}
+		switch op.Kind {
+		case OP_GET, OP_DEL:
+			op.Key = key()
+		case OP_SET:
+			op.Key = key()
+			op.Val = make([]byte, r.Intn(c.MaxValue+1))
+			r.Read(op.Val)
+		case OP_SCAN:
+			op.Key = key()
+			if r.Intn(2) == 0 {
+				op.End = key()
+			}
+			op.Limit = 1 + r.Intn(c.Keys)
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// runs `c.Seqs` sequences, returns a *Failure with the shrunk sequence of
+// the first one that fails
+func Run(c Config) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	for i := 0; i < c.Seqs; i++ {
+		seed := c.Seed + int64(i)
+		ops := Generate(c, rand.New(rand.NewSource(seed)))
+		if f := Replay(c, ops); f != nil {
+			n := len(ops)
+			f = Shrink(c, ops, f)
+			f.Seed, f.Len = seed, n
+			return f
+		}
+	}
+	return nil
+}
+
+// Run for tests, fails `t` with the shrunk sequence
+func Check(t testing.TB, c Config) {
+	t.Helper()
+	if err := Run(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runs `ops` on a new engine and a new model, nil if the results are the
+// same
+func Replay(c Config, ops []Op) *Failure {
+	if c.Model == nil {
+		c.Model = func() Engine { return NewMap() }
+	}
+	fail := func(step int, format string, args ...any) *Failure {
+		return &Failure{Ops: ops, Step: step, Msg: fmt.Sprintf(format, args...)}
+	}
+	db, err := c.New()
+	if err != nil {
+		return fail(0, "New: %v", err)
+	}
+	model := c.Model()
+	defer model.Close()
+	for i, op := range ops {
+		if msg := apply(db, model, op); msg != "" {
+			db.Close()
+			return fail(i, "%s: %s", op, msg)
+		}
+	}
+	if v, ok := db.(Verifier); ok {
+		if err := v.Verify(); err != nil {
+			db.Close()
+			return fail(len(ops), "Verify: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		return fail(len(ops), "Close: %v", err)
+	}
+	return nil
+}
+
+// runs `op` on both, the difference of the results if any
+func apply(db, model Engine, op Op) string {
+	switch op.Kind {
+	case OP_GET:
+		val, ok, err := db.Get(op.Key)
+		want, has, _ := model.Get(op.Key)
+		if err != nil || ok != has || !bytes.Equal(val, want) {
+			return fmt.Sprintf("got %s, want %s", result(val, ok, err), result(want, has, nil))
+		}
+	case OP_SET:
+		model.Set(op.Key, op.Val)
+		if err := db.Set(op.Key, op.Val); err != nil {
+			return err.Error()
+		}
+	case OP_DEL:
+		deleted, err := db.Del(op.Key)
+		want, _ := model.Del(op.Key)
+		if err != nil || deleted != want {
+			return fmt.Sprintf("got %v, %v, want %v", deleted, err, want)
+		}
+	case OP_SCAN:
+		got, err := scan(db, op)
+		want, _ := scan(model, op)
+		if err != nil {
+			return err.Error()
+		}
+		for i := 0; i < max(len(got), len(want)); i++ {
+			if i == len(got) || i == len(want) || !bytes.Equal(got[i][0], want[i][0]) || !bytes.Equal(got[i][1], want[i][1]) {
+				return fmt.Sprintf("%d keys, want %d, the first difference at %d: got %s, want %s",
+					len(got), len(want), i, pair(got, i), pair(want, i))
+			}
+		}
+	case OP_REOPEN:
+		if r, ok := db.(Reopener); ok {
+			if err := r.Reopen(); err != nil {
+				return err.Error()
+			}
+		}
+	}
+	return ""
+}
+
+func result(val []byte, ok bool, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	if !ok {
+		return "not found"
+	}
+	return fmt.Sprintf("%d bytes %x", len(val), val[:min(len(val), 8)])
+}
+
+func pair(pairs [][2][]byte, i int) string {
+	if i >= len(pairs) {
+		return "the end"
+	}
+	return fmt.Sprintf("%q = %s", pairs[i][0], result(pairs[i][1], true, nil))
+}
+
+// the pairs read by the scan `op`, copied
+func scan(db Engine, op Op) ([][2][]byte, error) {
+	var pairs [][2][]byte
+	err := db.Scan(op.Key, op.End, func(key, val []byte) bool {
+		pairs = append(pairs, [2][]byte{bytes.Clone(key), bytes.Clone(val)})
+		return len(pairs) < op.Limit
+	})
+	return pairs, err
+}
+
+// removes operations from the sequence of `f` while it still fails: runs
+// of half the sequence, then of a quarter... then single operations. then
+// the values are cut to a byte.
+func Shrink(c Config, ops []Op, f *Failure) *Failure {
+	try := func(cand []Op) bool {
+		if g := Replay(c, cand); g != nil {
+			ops, f = cand, g
+			return true
+		}
+		return false
+	}
+	// the operations after the failing one don't matter
+	if f.Step < len(ops) {
+		try(slices.Clone(ops[:f.Step+1]))
+	}
+	for chunk := len(ops) / 2; chunk >= 1; chunk /= 2 {
+		for i := 0; i+chunk <= len(ops); {
+			if !try(slices.Concat(ops[:i], ops[i+chunk:])) {
+				i += chunk
+			}
+		}
+	}
+	for i := range ops {
+		if len(ops[i].Val) > 1 {
+			cand := slices.Clone(ops)
+			cand[i].Val = cand[i].Val[:1]
+			try(cand)
+		}
+	}
+	return f
+}
+
+// Map is the model of an engine, a map with sorted keys for Scan
+type Map struct {
+	m map[string][]byte
+}
+
+func NewMap() *Map {
+	return &Map{m: map[string][]byte{}}
+}
+
+func (m *Map) Get(key []byte) ([]byte, bool, error) {
+	val, ok := m.m[string(key)]
+	return val, ok, nil
+}
+
+func (m *Map) Set(key, val []byte) error {
+	m.m[string(key)] = bytes.Clone(val)
+	return nil
+}
+
+func (m *Map) Del(key []byte) (bool, error) {
+	_, ok := m.m[string(key)]
+	delete(m.m, string(key))
+	return ok, nil
+}
+
+func (m *Map) Scan(start, end []byte, fn func(key, val []byte) bool) error {
+	keys := make([]string, 0, len(m.m))
+	for key := range m.m {
+		if key >= string(start) && (end == nil || key < string(end)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn([]byte(key), m.m[key]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *Map) Close() error {
+	return nil
+}
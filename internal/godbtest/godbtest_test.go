@@ -0,0 +1,81 @@
+package godbtest
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"godb/internal/storage/index/btree"
+)
+
+func TestKV(t *testing.T) {
+	dir := t.TempDir()
+	n := 0
+	Check(t, Config{
+		New: func() (Engine, error) {
+			n++
+			path := filepath.Join(dir, fmt.Sprint(n, ".db"))
+			return KV(func() *btree.KV {
+				return &btree.KV{Path: path, CheckCommits: true, PoisonViews: true}
+			})
+		},
+		Seqs:     5,
+		Ops:      300,
+		Keys:     60,
+		MaxValue: 300,
+	})
+}
+
+// forgets the deletes once it has 3 keys
+type buggyMap struct {
+	*Map
+}
+
+func (m buggyMap) Del(key []byte) (bool, error) {
+	_, ok := m.m[string(key)]
+	if len(m.m) < 3 {
+		delete(m.m, string(key))
+	}
+	return ok, nil
+}
+
+func TestShrink(t *testing.T) {
+	c := Config{
+		New:      func() (Engine, error) { return buggyMap{NewMap()}, nil },
+		Seqs:     10,
+		Ops:      200,
+		Keys:     10,
+		MaxValue: 20,
+	}
+	var f *Failure
+	if err := Run(c); !errors.As(err, &f) {
+		t.Fatalf("Run() = %v", err)
+	}
+	// 3 sets, a delete and a read of the key
+	if len(f.Ops) != 5 || f.Step != 4 || f.Len != 200 || !strings.Contains(f.Error(), "> ") {
+		t.Fatal(f)
+	}
+	for _, op := range f.Ops {
+		if len(op.Val) > 1 {
+			t.Fatalf("a value of %d bytes in the shrunk sequence:\n%v", len(op.Val), f)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	newMap := func() (Engine, error) { return NewMap(), nil }
+	for _, c := range []Config{
+		{Seqs: 1, Ops: 1, Keys: 1},
+		{New: newMap, Ops: 1, Keys: 1},
+		{New: newMap, Seqs: 1, Ops: 1},
+		{New: newMap, Seqs: 1, Ops: 1, Keys: 1, Mix: [OP_COUNT]float64{OP_GET: -1}},
+	} {
+		if err := Run(c); !errors.Is(err, ErrConfig) {
+			t.Fatalf("Run(%+v) = %v", c, err)
+		}
+	}
+	// the model against itself
+	Check(t, Config{New: newMap, Seqs: 3, Ops: 100, Keys: 10})
+}
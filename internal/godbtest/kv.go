@@ -0,0 +1,76 @@
+package godbtest
+
+import (
+	"context"
+	"fmt"
+
+	"godb/internal/storage/index/btree"
+)
+
+// the Engine of the KV returned by `config`, not open yet. Reopen closes it
+// and opens a new one of `config`, Verify scrubs it.
+func KV(config func() *btree.KV) (Engine, error) {
+	k := &kvEngine{config: config, db: config()}
+	if err := k.db.Open(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+type kvEngine struct {
+	config func() *btree.KV
+	db     *btree.KV
+}
+
+func (k *kvEngine) Get(key []byte) ([]byte, bool, error) {
+	tx := k.db.BeginRead()
+	defer tx.Rollback()
+	// the view of Get ends with the transaction
+	val, ok := tx.GetCopy(key)
+	return val, ok, tx.Err()
+}
+
+func (k *kvEngine) Set(key, val []byte) error {
+	return k.db.Set(key, val)
+}
+
+func (k *kvEngine) Del(key []byte) (bool, error) {
+	return k.db.Del(key)
+}
+
+func (k *kvEngine) Scan(start, end []byte, fn func(key, val []byte) bool) error {
+	tx := k.db.BeginRead()
+	defer tx.Rollback()
+	tx.Scan(start, end, fn)
+	return tx.Err()
+}
+
+func (k *kvEngine) Close() error {
+	if k.db == nil {
+		return nil // Reopen failed
+	}
+	return k.db.Close()
+}
+
+func (k *kvEngine) Reopen() error {
+	if err := k.db.Close(); err != nil {
+		return err
+	}
+	k.db = k.config()
+	if err := k.db.Open(); err != nil {
+		k.db = nil
+		return err
+	}
+	return nil
+}
+
+func (k *kvEngine) Verify() error {
+	report, err := k.db.Scrub(context.Background())
+	if err != nil {
+		return err
+	}
+	if !report.OK() {
+		return fmt.Errorf("%d problems, the first one: %v", len(report.Errors), report.Errors[0])
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// Package metrics adapts btree.Metrics to expvar and to the text format of
+// Prometheus, without the Prometheus client library. counters and gauges
+// keep the names of the engine, durations are histograms in seconds.
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"godb/internal/storage/index/btree"
+)
+
+// the upper bounds of the histogram buckets in seconds, like the default
+// buckets of the Prometheus client with finer ones under 5ms for fsyncs
+var BUCKETS = []float64{
+	.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+}
+
+// Expvar publishes the metrics in an expvar.Map, served as JSON at
+// /debug/vars with the other variables of the process. a duration is
+// name_count and name_seconds, its total.
+type Expvar struct {
+	vars *expvar.Map
+}
+
+// the metrics in the expvar variable `name`, the map is reused if the
+// variable exists already
+func NewExpvar(name string) *Expvar {
+	if m, ok := expvar.Get(name).(*expvar.Map); ok {
+		return &Expvar{vars: m}
+	}
+	return &Expvar{vars: expvar.NewMap(name)}
+}
+
+func (e *Expvar) Add(name string, delta uint64) {
+	e.vars.Add(name, int64(delta))
+}
+
+func (e *Expvar) Set(name string, value float64) {
+	f := new(expvar.Float)
+	f.Set(value)
+	e.vars.Set(name, f)
+}
+
+func (e *Expvar) Observe(name string, d time.Duration) {
+	e.vars.Add(name+"_count", 1)
+	e.vars.AddFloat(name+"_seconds", d.Seconds())
+}
+
+// Prometheus keeps the metrics for a scrape, it serves them in the text
+// exposition format. counters are named namespace_name_total.
+type Prometheus struct {
+	Namespace string // the prefix of the names, "godb" if empty
+
+	mu       sync.Mutex
+	counters map[string]uint64
+	gauges   map[string]float64
+	hists    map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket of BUCKETS, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (p *Prometheus) Add(name string, delta uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.counters == nil {
+		p.counters = map[string]uint64{}
+	}
+	p.counters[name] += delta
+}
+
+func (p *Prometheus) Set(name string, value float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.gauges == nil {
+		p.gauges = map[string]float64{}
+	}
+	p.gauges[name] = value
+}
+
+func (p *Prometheus) Observe(name string, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hists == nil {
+		p.hists = map[string]*histogram{}
+	}
+	h := p.hists[name]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(BUCKETS))}
+		p.hists[name] = h
+	}
+	s := d.Seconds()
+	if i, _ := slices.BinarySearch(BUCKETS, s); i < len(BUCKETS) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += s
+}
+
+// writes the metrics in the text exposition format, sorted by name
+func (p *Prometheus) WriteTo(w io.Writer) (int64, error) {
+	ns := p.Namespace
+	if ns == "" {
+		ns = "godb"
+	}
+	var buf []byte
+	p.mu.Lock()
+	for _, name := range sortedKeys(p.counters) {
+		full := ns + "_" + name + "_total"
+		buf = fmt.Appendf(buf, "# TYPE %s counter\n%s %d\n", full, full, p.counters[name])
+	}
+	for _, name := range sortedKeys(p.gauges) {
+		full := ns + "_" + name
+		buf = fmt.Appendf(buf, "# TYPE %s gauge\n%s %s\n", full, full, formatFloat(p.gauges[name]))
+	}
+	for _, name := range sortedKeys(p.hists) {
+		h, full := p.hists[name], ns+"_"+name+"_seconds"
+		buf = fmt.Appendf(buf, "# TYPE %s histogram\n", full)
+		cumulative := uint64(0)
+		for i, le := range BUCKETS {
+			cumulative += h.counts[i]
+			buf = fmt.Appendf(buf, "%s_bucket{le=\"%s\"} %d\n", full, formatFloat(le), cumulative)
+		}
+		buf = fmt.Appendf(buf, "%s_bucket{le=\"+Inf\"} %d\n", full, h.count)
+		buf = fmt.Appendf(buf, "%s_sum %s\n%s_count %d\n", full, formatFloat(h.sum), full, h.count)
+	}
+	p.mu.Unlock()
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// serves the scrapes of Prometheus
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.WriteTo(w)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Multi sends the metrics to each of its adapters
+type Multi []btree.Metrics
+
+func (m Multi) Add(name string, delta uint64) {
+	for _, metrics := range m {
+		metrics.Add(name, delta)
+	}
+}
+
+func (m Multi) Set(name string, value float64) {
+	for _, metrics := range m {
+		metrics.Set(name, value)
+	}
+}
+
+func (m Multi) Observe(name string, d time.Duration) {
+	for _, metrics := range m {
+		metrics.Observe(name, d)
+	}
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"expvar"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"godb/internal/storage/index/btree"
+)
+
+func TestPrometheus(t *testing.T) {
+	p := &Prometheus{}
+	p.Add(btree.METRIC_COMMITS, 2)
+	p.Add(btree.METRIC_COMMITS, 3)
+	p.Set(btree.METRIC_FREE_PAGES, 7)
+	p.Observe(btree.METRIC_BATCH, 3*time.Millisecond)
+	p.Observe(btree.METRIC_BATCH, 20*time.Second)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	got := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE godb_commits_total counter\ngodb_commits_total 5\n",
+		"# TYPE godb_free_pages gauge\ngodb_free_pages 7\n",
+		"# TYPE godb_batch_seconds histogram\n",
+		`godb_batch_seconds_bucket{le="0.0025"} 0` + "\n",
+		`godb_batch_seconds_bucket{le="0.005"} 1` + "\n",
+		`godb_batch_seconds_bucket{le="10"} 1` + "\n",
+		`godb_batch_seconds_bucket{le="+Inf"} 2` + "\n",
+		"godb_batch_seconds_sum 20.003\ngodb_batch_seconds_count 2\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("no %q in\n%s", want, got)
+		}
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type %q", ct)
+	}
+}
+
+func TestExpvar(t *testing.T) {
+	e := NewExpvar("godb_test")
+	db := &btree.KV{Path: filepath.Join(t.TempDir(), "test.db"), Metrics: Multi{e, &Prometheus{}}}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("k"), []byte("v"))
+	db.Close()
+
+	vars := expvar.Get("godb_test").(*expvar.Map)
+	if v := vars.Get(btree.METRIC_COMMITS); v == nil || v.String() != "1" {
+		t.Fatalf("commits = %v", v)
+	}
+	if v := vars.Get(btree.METRIC_BATCH + "_count"); v == nil || v.String() != "1" {
+		t.Fatalf("batch_count = %v", v)
+	}
+	if NewExpvar("godb_test").vars != vars {
+		t.Fatal("NewExpvar() of an existing name")
+	}
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"godb/internal/storage/index/btree"
+)
+
+// Namespaces are the keyspaces clients use: "/" is the main keyspace,
+// other names are top-level buckets, including the column families of
+// the RESP and memcached front-ends. names starting with _ are reserved.
+//
+// Users have a password and rules granting a permission on the
+// namespaces matching a glob pattern, the highest matching permission
+// applies. read allows reads, write also allows writes, admin also allows
+// dropping the namespace. admin on "*" allows managing the users.
+//
+// users are stored in the _users bucket
+// | iterations | salt | hash | rules ...
+// |     4B     | 16B  | 32B  |
+//
+// rule
+// | perm | len | pattern |
+// |  1B  | 2B  |   ...   |
+//
+// the hash is PBKDF2-SHA256 of the password.
+
+type Perm uint8
+
+const (
+	PermNone Perm = iota
+	PermRead
+	PermWrite
+	PermAdmin
+)
+
+const ROOT_NAMESPACE = "/"
+
+// iterations of new password hashes
+var PasswordIterations = 600_000
+
+var (
+	ErrAuth       = errors.New("invalid username or password")
+	ErrPermission = errors.New("permission denied")
+	ErrNamespace  = errors.New("bad namespace")
+	ErrUser       = errors.New("bad user")
+)
+
+var usersBucket = []byte("_users")
+
+func (p Perm) String() string {
+	return [...]string{"none", "read", "write", "admin"}[p]
+}
+
+type Rule struct {
+	Pattern string
+	Perm    Perm
+}
+
+// parses pattern=perm
+func ParseRule(s string) (Rule, error) {
+	i := strings.LastIndexByte(s, '=')
+	if i <= 0 {
+		return Rule{}, fmt.Errorf("%w: rule %q is not pattern=perm", ErrUser, s)
+	}
+	for p := PermRead; p <= PermAdmin; p++ {
+		if s[i+1:] == p.String() {
+			return Rule{Pattern: s[:i], Perm: p}, nil
+		}
+	}
+	return Rule{}, fmt.Errorf("%w: unknown permission %q", ErrUser, s[i+1:])
+}
+
+func (r Rule) String() string {
+	return r.Pattern + "=" + r.Perm.String()
+}
+
+type User struct {
+	Name  string
+	Rules []Rule
+
+	iterations uint32
+	salt       []byte
+	hash       []byte
+}
+
+// the permission of the user on the namespace
+func (u *User) Perm(ns string) Perm {
+	perm := PermNone
+	for _, r := range u.Rules {
+		if r.Perm > perm && globMatch([]byte(r.Pattern), []byte(ns)) {
+			perm = r.Perm
+		}
+	}
+	return perm
+}
+
+func (u *User) superuser() bool {
+	return slices.Contains(u.Rules, Rule{"*", PermAdmin})
+}
+
+func (u *User) encode() []byte {
+	out := binary.LittleEndian.AppendUint32(nil, u.iterations)
+	out = append(out, u.salt...)
+	out = append(out, u.hash...)
+	for _, r := range u.Rules {
+		out = append(out, byte(r.Perm))
+		out = binary.LittleEndian.AppendUint16(out, uint16(len(r.Pattern)))
+		out = append(out, r.Pattern...)
+	}
+	return out
+}
+
+func decodeUser(name string, data []byte) (*User, error) {
+	if len(data) < 52 {
+		return nil, fmt.Errorf("%w: bad record of %s", ErrUser, name)
+	}
+	u := &User{Name: name, iterations: binary.LittleEndian.Uint32(data), salt: data[4:20], hash: data[20:52]}
+	for rest := data[52:]; len(rest) > 0; {
+		if len(rest) < 3 || len(rest) < 3+int(binary.LittleEndian.Uint16(rest[1:])) {
+			return nil, fmt.Errorf("%w: bad record of %s", ErrUser, name)
+		}
+		size := 3 + int(binary.LittleEndian.Uint16(rest[1:]))
+		u.Rules = append(u.Rules, Rule{Pattern: string(rest[3:size]), Perm: Perm(rest[0])})
+		rest = rest[size:]
+	}
+	return u, nil
+}
+
+func hashPassword(password string, salt []byte, iterations uint32) []byte {
+	hash, err := pbkdf2.Key(sha256.New, password, salt, int(iterations), 32)
+	if err != nil {
+		panic(err) // only for invalid parameters
+	}
+	return hash
+}
+
+// checks a namespace name of a client
+func checkNamespace(ns string) error {
+	if ns == "" || strings.HasPrefix(ns, "_") || len(ns) > btree.BT_MAX_KEY_SIZE/2 {
+		return fmt.Errorf("%w %q", ErrNamespace, ns)
+	}
+	return nil
+}
+
+// Accounts are the users of a database, the servers authenticate clients
+// with them. users are loaded on first use, changes made with Set and
+// Delete apply to the open sessions, changes made to the file by other
+// means need a restart.
+type Accounts struct {
+	DB *btree.KV
+
+	mu       sync.Mutex
+	users    map[string]*User
+	verified map[[32]byte]bool // passwords already checked, see Authenticate
+}
+
+func (a *Accounts) load() error {
+	if a.users != nil {
+		return nil
+	}
+	users := map[string]*User{}
+	tx := a.DB.BeginRead()
+	defer tx.Rollback()
+	if b := tx.Bucket(usersBucket); b != nil {
+		var err error
+		b.Scan(nil, nil, func(key, val []byte) bool {
+			var u *User
+			if u, err = decodeUser(string(key), append([]byte{}, val...)); err == nil {
+				users[u.Name] = u
+			}
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	a.users = users
+	a.verified = map[[32]byte]bool{}
+	return nil
+}
+
+// the user of the name and password. checked passwords are remembered by
+// their SHA-256 until the user changes, the key derivation is slow on
+// purpose and clients like gRPC send the password on every call.
+func (a *Accounts) Authenticate(name, password string) (*User, error) {
+	a.mu.Lock()
+	if err := a.load(); err != nil {
+		a.mu.Unlock()
+		return nil, err
+	}
+	u, ok := a.users[name]
+	token := sha256.Sum256([]byte(name + "\x00" + password))
+	verified := a.verified[token]
+	a.mu.Unlock()
+	if !ok {
+		return nil, ErrAuth
+	}
+	if verified {
+		return u, nil
+	}
+	if subtle.ConstantTimeCompare(hashPassword(password, u.salt, u.iterations), u.hash) != 1 {
+		return nil, ErrAuth
+	}
+	a.mu.Lock()
+	if a.users[name] == u {
+		a.verified[token] = true
+	}
+	a.mu.Unlock()
+	return u, nil
+}
+
+// the current rules of the user, nil if it was deleted
+func (a *Accounts) Lookup(name string) *User {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.load(); err != nil {
+		return nil
+	}
+	return a.users[name]
+}
+
+// creates or replaces the user
+func (a *Accounts) Set(name, password string, rules []Rule) error {
+	if name == "" || len(name) > btree.BT_MAX_KEY_SIZE/2 {
+		return fmt.Errorf("%w: name of %d bytes", ErrUser, len(name))
+	}
+	for _, r := range rules {
+		if r.Perm < PermRead || r.Perm > PermAdmin || r.Pattern == "" || len(r.Pattern) > 255 {
+			return fmt.Errorf("%w: rule %v", ErrUser, r)
+		}
+	}
+	u := &User{Name: name, Rules: rules, iterations: uint32(PasswordIterations), salt: make([]byte, 16)}
+	rand.Read(u.salt)
+	u.hash = hashPassword(password, u.salt, u.iterations)
+	if len(u.encode()) > btree.BT_MAX_VAL_SIZE {
+		return fmt.Errorf("%w: too many rules", ErrUser)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.load(); err != nil {
+		return err
+	}
+	tx := a.DB.Begin()
+	b, err := tx.CreateBucketIfNotExists(usersBucket)
+	if err == nil {
+		err = b.Set([]byte(name), u.encode())
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	a.users[name] = u
+	clear(a.verified)
+	return nil
+}
+
+// false if there is no such user
+func (a *Accounts) Delete(name string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.load(); err != nil {
+		return false, err
+	}
+	if _, ok := a.users[name]; !ok {
+		return false, nil
+	}
+	tx := a.DB.Begin()
+	if _, err := tx.Bucket(usersBucket).Del([]byte(name)); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	delete(a.users, name)
+	clear(a.verified)
+	return true, nil
+}
+
+// the users by name
+func (a *Accounts) List() ([]*User, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	var users []*User
+	for _, u := range a.users {
+		users = append(users, u)
+	}
+	slices.SortFunc(users, func(x, y *User) int { return strings.Compare(x.Name, y.Name) })
+	return users, nil
+}
+
+// checks that the user may use the namespace, nil accounts allow anything
+func (a *Accounts) check(name, ns string, perm Perm) error {
+	if a == nil {
+		return nil
+	}
+	u := a.Lookup(name)
+	if u == nil || u.Perm(ns) < perm {
+		return fmt.Errorf("%w: %s on %s", ErrPermission, perm, ns)
+	}
+	return nil
+}
+
+// checks that the user may manage users
+func (a *Accounts) checkAdmin(name string) error {
+	if a == nil {
+		return errors.New("authentication is not enabled")
+	}
+	if u := a.Lookup(name); u == nil || !u.superuser() {
+		return fmt.Errorf("%w: managing users needs *=admin", ErrPermission)
+	}
+	return nil
+}
+
+// a keyspace of a transaction, the main one or a bucket
+type keyspace interface {
+	Get(key []byte) ([]byte, bool)
+	Set(key []byte, val []byte) error
+	Del(key []byte) (bool, error)
+	Scan(start, end []byte, fn func(key, val []byte) bool)
+}
+
+// a bucket that does not exist
+type emptyKeyspace struct{}
+
+func (emptyKeyspace) Get(key []byte) ([]byte, bool)                         { return nil, false }
+func (emptyKeyspace) Set(key []byte, val []byte) error                      { return btree.ErrBucketNotFound }
+func (emptyKeyspace) Del(key []byte) (bool, error)                          { return false, nil }
+func (emptyKeyspace) Scan(start, end []byte, fn func(key, val []byte) bool) {}
+
+// the namespace in the transaction, a missing bucket is created if
+// `create` is true and is empty otherwise
+func namespace(tx *btree.Tx, ns string, create bool) (keyspace, error) {
+	if ns == ROOT_NAMESPACE {
+		return tx, nil
+	}
+	if b := tx.Bucket([]byte(ns)); b != nil {
+		return b, nil
+	}
+	if !create {
+		return emptyKeyspace{}, nil
+	}
+	b, err := tx.CreateBucket([]byte(ns))
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"godb/api/godbpb"
+	"godb/client"
+	"godb/internal/storage/index/btree"
+)
+
+func init() {
+	PasswordIterations = 1000 // fast tests
+}
+
+type testServer interface {
+	Serve(ln net.Listener) error
+	Close() error
+}
+
+// a database with users and a function starting servers on it
+func authSetup(t *testing.T) (*Accounts, func(srv testServer) string) {
+	t.Helper()
+	db := &btree.KV{Path: filepath.Join(t.TempDir(), "test.db"), PoisonViews: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() }) // after the servers
+	acc := &Accounts{DB: db}
+	for _, u := range []struct {
+		name  string
+		rules []string
+	}{
+		{"root", []string{"*=admin"}},
+		{"alice", []string{"tenant_a*=admin", "/=read", "redis=write", "memcached=read"}},
+		{"bob", []string{"tenant_b=write"}},
+	} {
+		var rules []Rule
+		for _, s := range u.rules {
+			r, err := ParseRule(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rules = append(rules, r)
+		}
+		if err := acc.Set(u.name, u.name+"-pw", rules); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := func(srv testServer) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- srv.Serve(ln) }()
+		t.Cleanup(func() {
+			srv.Close()
+			if err := <-done; !errors.Is(err, ErrServerClosed) {
+				t.Errorf("Serve() = %v", err)
+			}
+		})
+		return ln.Addr().String()
+	}
+	return acc, start
+}
+
+func TestAccounts(t *testing.T) {
+	acc, _ := authSetup(t)
+	if _, err := acc.Authenticate("alice", "wrong"); !errors.Is(err, ErrAuth) {
+		t.Fatalf("Authenticate(wrong password) = %v", err)
+	}
+	if _, err := acc.Authenticate("nobody", "x"); !errors.Is(err, ErrAuth) {
+		t.Fatalf("Authenticate(unknown user) = %v", err)
+	}
+	u, err := acc.Authenticate("alice", "alice-pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ns, want := range map[string]Perm{"tenant_a": PermAdmin, "tenant_a2": PermAdmin, "/": PermRead, "tenant_b": PermNone} {
+		if got := u.Perm(ns); got != want {
+			t.Errorf("alice on %s = %v; want %v", ns, got, want)
+		}
+	}
+
+	// reloaded from the database
+	acc2 := &Accounts{DB: acc.DB}
+	if _, err := acc2.Authenticate("bob", "bob-pw"); err != nil {
+		t.Fatal(err)
+	}
+	users, err := acc2.List()
+	if err != nil || len(users) != 3 || users[0].Name != "alice" || users[0].Rules[1] != (Rule{"/", PermRead}) {
+		t.Fatalf("List() = %v, %v", users, err)
+	}
+	if ok, err := acc2.Delete("bob"); !ok || err != nil {
+		t.Fatalf("Delete(bob) = %v, %v", ok, err)
+	}
+	if _, err := acc2.Authenticate("bob", "bob-pw"); !errors.Is(err, ErrAuth) {
+		t.Fatalf("Authenticate(deleted user) = %v", err)
+	}
+	for _, s := range []string{"x", "=read", "a=root"} {
+		if _, err := ParseRule(s); !errors.Is(err, ErrUser) {
+			t.Errorf("ParseRule(%q) = %v", s, err)
+		}
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	acc, start := authSetup(t)
+	addr := start(&Server{DB: acc.DB, Auth: acc})
+	root, alice, bob := dial(t, addr), dial(t, addr), dial(t, addr)
+
+	if err := alice.Set([]byte("k"), []byte("v")); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("Set() before Auth = %v", err)
+	}
+	if err := alice.Auth("alice", "bob-pw"); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("Auth(wrong password) = %v", err)
+	}
+	for c, name := range map[*client.Client]string{root: "root", alice: "alice", bob: "bob"} {
+		if err := c.Auth(name, name+"-pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the main keyspace is read-only for alice, closed to bob
+	if err := root.Set([]byte("k"), []byte("main")); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, err := alice.Get([]byte("k")); err != nil || string(val) != "main" {
+		t.Fatalf("alice Get(k) = %q, %v", val, err)
+	}
+	if err := alice.Set([]byte("k"), []byte("x")); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("alice Set() on / = %v", err)
+	}
+	if _, _, err := bob.Get([]byte("k")); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("bob Get() on / = %v", err)
+	}
+
+	// namespaces are separate buckets
+	if err := alice.Use("tenant_a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Use("tenant_a"); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("bob Use(tenant_a) = %v", err)
+	}
+	if err := bob.Use("tenant_b"); err != nil {
+		t.Fatal(err)
+	}
+	alice.Set([]byte("k"), []byte("a"))
+	bob.Set([]byte("k"), []byte("b"))
+	if val, _, _ := alice.Get([]byte("k")); string(val) != "a" {
+		t.Fatalf("alice Get(k) in tenant_a = %q", val)
+	}
+	if val, _, _ := bob.Get([]byte("k")); string(val) != "b" {
+		t.Fatalf("bob Get(k) in tenant_b = %q", val)
+	}
+	if err := alice.Use("_users"); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("Use(_users) = %v", err)
+	}
+
+	// dropping needs admin, managing users needs *=admin
+	if _, err := bob.Drop("tenant_b"); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("bob Drop(tenant_b) = %v", err)
+	}
+	if ok, err := alice.Drop("tenant_a"); !ok || err != nil {
+		t.Fatalf("alice Drop(tenant_a) = %v, %v", ok, err)
+	}
+	if _, ok, _ := alice.Get([]byte("k")); ok {
+		t.Fatal("the key survived the drop")
+	}
+	if err := alice.SetUser("eve", "pw", "*=admin"); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("alice SetUser() = %v", err)
+	}
+	if err := root.SetUser("bob", "new-pw", "tenant_b=read"); err != nil {
+		t.Fatal(err)
+	}
+	// the new rules apply to the open session
+	if err := bob.Set([]byte("k"), []byte("x")); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("bob Set() after losing write = %v", err)
+	}
+	if ok, err := root.DeleteUser("bob"); !ok || err != nil {
+		t.Fatalf("DeleteUser(bob) = %v, %v", ok, err)
+	}
+	if _, _, err := bob.Get([]byte("k")); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("Get() of a deleted user = %v", err)
+	}
+	root.Begin(true)
+	if err := root.SetUser("eve", "pw"); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("SetUser() in a transaction = %v", err)
+	}
+	root.Rollback()
+}
+
+func TestRESPAuth(t *testing.T) {
+	acc, start := authSetup(t)
+	conn, err := net.Dial("tcp", start(&RESPServer{DB: acc.DB, Auth: acc}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &respClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	for _, step := range [][]string{
+		{"GET k", "-NOAUTH Authentication required."},
+		{"AUTH alice nope", "-WRONGPASS invalid username-password pair or user is disabled."},
+		{"AUTH bob bob-pw", "+OK"},
+		{"GET k", "-NOPERM permission denied: read on redis"},
+		{"AUTH alice alice-pw", "+OK"},
+		{"SET k v", "+OK"},
+		{"GET k", "v"},
+	} {
+		if got := c.do(strings.Fields(step[0])...); got != step[1] {
+			t.Fatalf("%s = %q; want %q", step[0], got, step[1])
+		}
+	}
+}
+
+func TestMemcacheAuth(t *testing.T) {
+	acc, start := authSetup(t)
+	conn, err := net.Dial("tcp", start(&MemcacheServer{DB: acc.DB, Auth: acc}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &mcClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	for _, step := range []struct {
+		req, want string
+	}{
+		{"get k\r\n", "CLIENT_ERROR unauthenticated"},
+		{"set x 0 0 8\r\nbob nope\r\n", "CLIENT_ERROR authentication failure"},
+		{"set x 0 0 14\r\nalice alice-pw\r\n", "STORED"},
+		{"get k\r\n", "END"},
+		{"set k 0 0 1\r\nv\r\n", "CLIENT_ERROR permission denied: write on memcached"},
+	} {
+		if got := c.do(step.req, 1); got != step.want {
+			t.Fatalf("%q = %q; want %q", step.req, got, step.want)
+		}
+	}
+}
+
+func TestGRPCAuth(t *testing.T) {
+	acc, start := authSetup(t)
+	conn, err := grpc.NewClient(start(&GRPCServer{DB: acc.DB, Auth: acc}), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	kv := godbpb.NewKVClient(conn)
+	as := func(user, ns string) context.Context {
+		auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+user+"-pw"))
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", auth, "godb-namespace", ns)
+	}
+	put := &godbpb.PutRequest{Key: []byte("k"), Value: []byte("v")}
+
+	if _, err := kv.Put(context.Background(), put); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Put() without credentials = %v", err)
+	}
+	if _, err := kv.Put(as("bob", "tenant_a"), put); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("bob Put() on tenant_a = %v", err)
+	}
+	if _, err := kv.Put(as("bob", "tenant_b"), put); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := kv.Get(as("alice", "tenant_a"), &godbpb.GetRequest{Key: []byte("k")}); err != nil || got.Found {
+		t.Fatalf("alice Get(k) on tenant_a = %v, %v", got, err)
+	}
+	if got, err := kv.Get(as("root", "tenant_b"), &godbpb.GetRequest{Key: []byte("k")}); err != nil || string(got.Value) != "v" {
+		t.Fatalf("root Get(k) on tenant_b = %v, %v", got, err)
+	}
+	if _, err := kv.Get(as("root", "_users"), &godbpb.GetRequest{Key: []byte("k")}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Get() on _users = %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"godb/internal/storage/index/btree"
+	"godb/internal/wire"
+)
+
+// The changefeed of `godb serve -changefeed` over the protocols, see
+// btree.Follow. a consumer receives the entries of the namespaces it can
+// read, the permissions are checked per entry. internal buckets like the
+// users are never sent. a connection of the wire protocol that tails the
+// changefeed only receives entries afterwards, the client ends it by
+// closing the connection.
+
+// the namespace of the entry, false for internal buckets
+func entryNamespace(e *btree.Entry) (string, bool) {
+	if e.Bucket == nil {
+		return ROOT_NAMESPACE, true
+	}
+	ns := string(e.Bucket)
+	return ns, checkNamespace(ns) == nil
+}
+
+// whether the user can read the namespace of the entry
+func readable(auth *Accounts, user string, e *btree.Entry) (string, bool) {
+	ns, ok := entryNamespace(e)
+	return ns, ok && auth.check(user, ns, PermRead) == nil
+}
+
+func (sess *session) startFeed(from uint64) error {
+	if sess.tx != nil {
+		return errors.New("can't tail the changefeed in a transaction")
+	}
+	sess.feed = sess.db.Follow(from)
+	return nil
+}
+
+// sends the entries until the client goes away or the feed ends
+func (sess *session) tail(conn net.Conn, w *bufio.Writer) {
+	feed := sess.feed
+	defer feed.Close()
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		// the client sends nothing more, the read ends when it goes away
+		io.Copy(io.Discard, conn)
+		feed.Close()
+	}()
+	for e := range feed.C {
+		ns, ok := readable(sess.auth, sess.user, &e)
+		if !ok {
+			continue
+		}
+		if err := wire.WriteFrame(w, entryReply(ns, &e)); err != nil {
+			return
+		}
+	}
+	if err := feed.Err(); err != nil {
+		wire.WriteFrame(w, errorReply(err))
+	}
+}
+
+func entryReply(ns string, e *btree.Entry) []byte {
+	out := wire.AppendUint64([]byte{wire.STATUS_OK}, e.Seq)
+	op := byte(wire.ENTRY_SET)
+	if e.Op == btree.OP_DEL {
+		op = wire.ENTRY_DEL
+	}
+	out = append(out, op)
+	out = wire.AppendBytes(out, []byte(ns))
+	out = wire.AppendBytes(out, e.Key)
+	return wire.AppendBytes(out, e.Value)
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"godb/api/godbpb"
+	"godb/client"
+)
+
+func nextFeedEntry(t *testing.T, f *client.Feed) string {
+	t.Helper()
+	select {
+	case e, ok := <-f.C:
+		if !ok {
+			t.Fatalf("feed ended: %v", f.Err())
+		}
+		return fmt.Sprintf("%d %s %s %q", e.Seq, e.Namespace, e.Key, e.Value)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no entry")
+	}
+	return ""
+}
+
+func TestChangefeed(t *testing.T) {
+	acc, start := authSetup(t) // the users are sequences 1 to 3
+	acc.DB.Changefeed = true   // read by Begin, there is no transaction yet
+	addr := start(&Server{DB: acc.DB, Auth: acc})
+	root, bob := dial(t, addr), dial(t, addr)
+	root.Auth("root", "root-pw")
+	bob.Auth("bob", "bob-pw")
+
+	root.Set([]byte("k"), []byte("main"))
+	root.Use("tenant_b")
+	root.Set([]byte("k"), []byte("b"))
+	root.SetUser("carol", "carol-pw") // internal, never sent
+
+	rootFeed, err := dial(t, addr).Changes(0)
+	if err == nil {
+		t.Fatal("Changes() before Auth succeeded")
+	}
+	rc := dial(t, addr)
+	rc.Auth("root", "root-pw")
+	if rootFeed, err = rc.Changes(0); err != nil {
+		t.Fatal(err)
+	}
+	defer rootFeed.Close()
+	bobFeed, err := bob.Changes(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bobFeed.Close()
+	for _, want := range []string{`4 / k "main"`, `5 tenant_b k "b"`} {
+		if got := nextFeedEntry(t, rootFeed); got != want {
+			t.Fatalf("root entry = %s; want %s", got, want)
+		}
+	}
+	if got := nextFeedEntry(t, bobFeed); got != `5 tenant_b k "b"` {
+		t.Fatalf("bob entry = %s", got)
+	}
+
+	// later commits are tailed, bob only gets his namespace
+	root.Use("/")
+	root.Del([]byte("k"))
+	root.Use("tenant_b")
+	root.Set([]byte("empty"), []byte{})
+	for _, want := range []string{`7 / k ""`, `8 tenant_b empty ""`} {
+		if got := nextFeedEntry(t, rootFeed); got != want {
+			t.Fatalf("root entry = %s; want %s", got, want)
+		}
+	}
+	if got := nextFeedEntry(t, bobFeed); got != `8 tenant_b empty ""` {
+		t.Fatalf("bob entry = %s", got)
+	}
+	if _, _, err := bob.Get([]byte("k")); err != client.ErrWatching {
+		t.Fatalf("a request on a feed connection = %v", err)
+	}
+
+	// gRPC
+	conn, err := grpc.NewClient(start(&GRPCServer{DB: acc.DB, Auth: acc}), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	kv := godbpb.NewKVClient(conn)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:bob-pw"))
+	stream, err := kv.Changes(metadata.AppendToOutgoingContext(ctx, "authorization", auth), &godbpb.ChangesRequest{From: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`5 tenant_b k "b"`, `8 tenant_b empty ""`} {
+		e, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprintf("%d %s %s %q", e.Seq, e.Namespace, e.Key, e.Value); got != want || e.Value == nil {
+			t.Fatalf("gRPC entry = %s; want %s", got, want)
+		}
+	}
+	stream, _ = kv.Changes(ctx, &godbpb.ChangesRequest{})
+	if _, err := stream.Recv(); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Changes() without credentials = %v", err)
+	}
+}
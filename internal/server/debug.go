@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+
+	"godb/internal/storage/index/btree"
+)
+
+// Debug serves the diagnostics of a running server over HTTP, for an admin
+// address: the profiles of net/http/pprof under /debug/pprof/, a dump of
+// the goroutines is /debug/pprof/goroutine?debug=2, /debug/buffers, the
+// page buffers of the database and the heap of the process, and
+// /debug/stats, the stats of the database as JSON.
+type Debug struct {
+	DB *btree.KV
+}
+
+func (d *Debug) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch p := r.URL.Path; {
+	case p == "/debug/buffers":
+		d.buffers(w)
+	case p == "/debug/stats":
+		d.stats(w)
+	case p == "/debug/pprof/cmdline":
+		pprof.Cmdline(w, r)
+	case p == "/debug/pprof/profile":
+		pprof.Profile(w, r)
+	case p == "/debug/pprof/symbol":
+		pprof.Symbol(w, r)
+	case p == "/debug/pprof/trace":
+		pprof.Trace(w, r)
+	case strings.HasPrefix(p, "/debug/pprof/"):
+		// the index and the named profiles: heap, goroutine, allocs...
+		pprof.Index(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (d *Debug) buffers(w http.ResponseWriter) {
+	s := d.DB.Buffers()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "mapped\t%d bytes in %d mmaps, %d bytes retired\n", s.Mapped, s.MapChunks, s.Retired)
+	if d.DB.PoolPages > 0 {
+		fmt.Fprintf(w, "pool\t%d of %d pages, %d bytes\n", s.Pool, d.DB.PoolPages, s.Pool*btree.BT_PAGE_SIZE)
+	}
+	if d.DB.BloomBits > 0 {
+		fmt.Fprintf(w, "filters\t%d leaves, %d bits per key\n", s.Filters, d.DB.BloomBits)
+	}
+	fmt.Fprintf(w, "pending\t%d pages, %d bytes\n", s.Pending, s.Pending*btree.BT_PAGE_SIZE)
+	fmt.Fprintf(w, "flushing\t%d pages, %d bytes\n", s.Flushing, s.Flushing*btree.BT_PAGE_SIZE)
+	fmt.Fprintf(w, "readers\t%d on %d versions\n", s.Readers, s.Versions)
+	fmt.Fprintf(w, "replicas\t%d, %d batches queued\n", s.Replicas, s.Queued)
+	fmt.Fprintf(w, "heap\t%d bytes in use, %d from the OS, %d GCs\n", mem.HeapInuse, mem.HeapSys, mem.NumGC)
+	fmt.Fprintf(w, "goroutines\t%d\n", runtime.NumGoroutine())
+}
+
+// the stats of the version read and the free list, it traverses every tree
+func (d *Debug) stats(w http.ResponseWriter) {
+	tx := d.DB.BeginRead()
+	defer tx.Rollback()
+	stats := struct {
+		Seq      uint64              `json:"seq"`
+		File     btree.FileStats     `json:"file"`
+		Keyspace btree.BucketStats   `json:"keyspace"`
+		FreeList btree.FreeListStats `json:"free_list"`
+		Buffers  btree.BufferStats   `json:"buffers"`
+	}{
+		Seq:      tx.Seq(),
+		File:     tx.FileStats(),
+		Keyspace: tx.Stats(),
+		FreeList: d.DB.FreeListStats(),
+		Buffers:  d.DB.Buffers(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(stats)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"godb/internal/storage/index/btree"
+)
+
+func TestDebug(t *testing.T) {
+	db := &btree.KV{Path: filepath.Join(t.TempDir(), "test.db"), PoisonViews: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	d := &Debug{DB: db}
+
+	for _, tc := range []struct {
+		path string
+		code int
+		want string
+	}{
+		{"/debug/buffers", http.StatusOK, "readers\t1 on 1 versions\n"},
+		{"/debug/stats", http.StatusOK, `"free_list": {`},
+		{"/debug/pprof/", http.StatusOK, "goroutine"},
+		{"/debug/pprof/goroutine?debug=2", http.StatusOK, "TestDebug"},
+		{"/debug/pprof/heap?debug=1", http.StatusOK, "heap profile"},
+		{"/debug/pprof/cmdline", http.StatusOK, ""},
+		{"/other", http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Code != tc.code || !strings.Contains(w.Body.String(), tc.want) {
+			t.Fatalf("%s = %d %q, want %d with %q", tc.path, w.Code, w.Body.String(), tc.code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"godb/api/godbpb"
+	"godb/internal/storage/index/btree"
+)
+
+// GRPCServer serves the KV service of the godbpb package. every call is
+// a transaction, a scan streams from the snapshot of one read
+// transaction, so a slow reader holds on to the pages of its version.
+//
+// calls use the namespace of the godb-namespace metadata, "/" if absent.
+// with authentication, calls carry the user in the authorization
+// metadata as "Basic " + base64(user:password).
+type GRPCServer struct {
+	DB  *btree.KV
+	TLS *tls.Config // plain HTTP/2 if nil
+	// callers must authenticate as one of the users, anyone is allowed if nil
+	Auth *Accounts
+
+	mu     sync.Mutex
+	srv    *grpc.Server
+	closed bool
+}
+
+// accepts connections until Close
+func (s *GRPCServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	var opts []grpc.ServerOption
+	if s.TLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.TLS)))
+	}
+	s.srv = grpc.NewServer(opts...)
+	godbpb.RegisterKVServer(s.srv, &kvService{db: s.DB, auth: s.Auth})
+	srv := s.srv
+	s.mu.Unlock()
+
+	err := srv.Serve(ln)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// closes the connections and waits for the calls to return
+func (s *GRPCServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	srv := s.srv
+	s.mu.Unlock()
+	if srv != nil {
+		srv.Stop()
+	}
+	return nil
+}
+
+type kvService struct {
+	godbpb.UnimplementedKVServer
+	db   *btree.KV
+	auth *Accounts
+}
+
+// the namespace of the call if the caller has the permission on it, and
+// the client for the audit log
+func (k *kvService) authorize(ctx context.Context, perm Perm) (ns, client string, err error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ns = ROOT_NAMESPACE
+	if v := md.Get("godb-namespace"); len(v) > 0 {
+		ns = v[0]
+	}
+	if err := checkNamespace(ns); err != nil {
+		return "", "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	user, err := k.authenticate(md)
+	if err != nil {
+		return "", "", err
+	}
+	if err := k.auth.check(user, ns, perm); err != nil {
+		return "", "", status.Error(codes.PermissionDenied, err.Error())
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		client = p.Addr.String()
+	}
+	return ns, clientName(user, client), nil
+}
+
+// the user of the call, empty without authentication
+func (k *kvService) authenticate(md metadata.MD) (string, error) {
+	if k.auth == nil {
+		return "", nil
+	}
+	var user, password string
+	ok := false
+	if v := md.Get("authorization"); len(v) > 0 {
+		if enc, found := strings.CutPrefix(v[0], "Basic "); found {
+			if raw, err := base64.StdEncoding.DecodeString(enc); err == nil {
+				user, password, ok = strings.Cut(string(raw), ":")
+			}
+		}
+	}
+	if !ok {
+		return "", status.Error(codes.Unauthenticated, "authentication required")
+	}
+	if _, err := k.auth.Authenticate(user, password); err != nil {
+		return "", status.Error(codes.Unauthenticated, err.Error())
+	}
+	return user, nil
+}
+
+// the status of a storage error
+func grpcError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func checkPut(key, val []byte) error {
+	if err := checkKey(key); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if len(val) > btree.BT_MAX_VAL_SIZE {
+		return status.Errorf(codes.InvalidArgument, "bad value size %d", len(val))
+	}
+	return nil
+}
+
+func (k *kvService) Get(ctx context.Context, req *godbpb.GetRequest) (*godbpb.GetResponse, error) {
+	ns, _, err := k.authorize(ctx, PermRead)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := k.db.BeginReadCtx(ctx)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	defer tx.Rollback()
+	resp := &godbpb.GetResponse{}
+	ks, err := namespace(tx, ns, false)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	// the response is marshalled after the transaction ends
+	resp.Value, resp.Found = ks.Get(req.Key)
+	resp.Value = bytes.Clone(resp.Value)
+	if err := tx.Err(); err != nil {
+		return nil, grpcError(err)
+	}
+	return resp, nil
+}
+
+// runs `fn` in a write transaction of the client on the namespace, a
+// missing bucket is created if `create` is true. the transaction ends
+// with the call.
+func (k *kvService) update(ctx context.Context, ns, client string, create bool, fn func(ks keyspace) error) error {
+	tx, err := k.db.BeginCtx(ctx)
+	if err != nil {
+		return grpcError(err)
+	}
+	tx.SetClient(client)
+	ks, err := namespace(tx, ns, create)
+	if err == nil {
+		err = fn(ks)
+	}
+	if err != nil {
+		tx.Rollback()
+		return grpcError(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return grpcError(err)
+	}
+	return nil
+}
+
+func (k *kvService) Put(ctx context.Context, req *godbpb.PutRequest) (*godbpb.PutResponse, error) {
+	if err := checkPut(req.Key, req.Value); err != nil {
+		return nil, err
+	}
+	ns, client, err := k.authorize(ctx, PermWrite)
+	if err != nil {
+		return nil, err
+	}
+	err = k.update(ctx, ns, client, true, func(ks keyspace) error {
+		return ks.Set(req.Key, req.Value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &godbpb.PutResponse{}, nil
+}
+
+func (k *kvService) Delete(ctx context.Context, req *godbpb.DeleteRequest) (*godbpb.DeleteResponse, error) {
+	if err := checkKey(req.Key); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	ns, client, err := k.authorize(ctx, PermWrite)
+	if err != nil {
+		return nil, err
+	}
+	resp := &godbpb.DeleteResponse{}
+	err = k.update(ctx, ns, client, false, func(ks keyspace) error {
+		var err error
+		resp.Deleted, err = ks.Del(req.Key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (k *kvService) Scan(req *godbpb.ScanRequest, stream grpc.ServerStreamingServer[godbpb.KeyValue]) error {
+	ns, _, err := k.authorize(stream.Context(), PermRead)
+	if err != nil {
+		return err
+	}
+	end := req.End
+	if len(end) == 0 {
+		end = nil
+	}
+	tx, err := k.db.BeginReadCtx(stream.Context())
+	if err != nil {
+		return grpcError(err)
+	}
+	defer tx.Rollback()
+	ks, err := namespace(tx, ns, false)
+	if err != nil {
+		return grpcError(err)
+	}
+	n := uint32(0)
+	ks.Scan(req.Start, end, func(key, val []byte) bool {
+		if req.Limit > 0 && n == req.Limit {
+			return false
+		}
+		// the stream fails when the client goes away
+		err = stream.Send(&godbpb.KeyValue{Key: key, Value: val})
+		n++
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := tx.Err(); err != nil {
+		return grpcError(err)
+	}
+	return nil
+}
+
+func (k *kvService) Txn(ctx context.Context, req *godbpb.TxnRequest) (*godbpb.TxnResponse, error) {
+	perm := PermRead
+	for _, ops := range [][]*godbpb.Op{req.Success, req.Failure} {
+		for _, op := range ops {
+			if err := checkOp(op); err != nil {
+				return nil, err
+			}
+			if op.GetGet() == nil {
+				perm = PermWrite
+			}
+		}
+	}
+	ns, client, err := k.authorize(ctx, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &godbpb.TxnResponse{Succeeded: true}
+	err = k.update(ctx, ns, client, perm == PermWrite, func(ks keyspace) error {
+		for _, cmp := range req.Compare {
+			val, ok := ks.Get(cmp.Key)
+			if ok != (cmp.Value != nil) || ok && !bytes.Equal(val, cmp.Value) {
+				resp.Succeeded = false
+				break
+			}
+		}
+		ops := req.Success
+		if !resp.Succeeded {
+			ops = req.Failure
+		}
+		for _, op := range ops {
+			out, err := applyOp(ks, op)
+			if err != nil {
+				return err
+			}
+			resp.Responses = append(resp.Responses, out)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func checkOp(op *godbpb.Op) error {
+	switch op := op.Op.(type) {
+	case *godbpb.Op_Get:
+		return nil
+	case *godbpb.Op_Put:
+		return checkPut(op.Put.Key, op.Put.Value)
+	case *godbpb.Op_Delete:
+		if err := checkKey(op.Delete.Key); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil
+	default:
+		return status.Error(codes.InvalidArgument, "empty op")
+	}
+}
+
+func applyOp(ks keyspace, op *godbpb.Op) (*godbpb.OpResponse, error) {
+	switch op := op.Op.(type) {
+	case *godbpb.Op_Get:
+		val, ok := ks.Get(op.Get.Key)
+		val = bytes.Clone(val) // see Get
+		return &godbpb.OpResponse{Op: &godbpb.OpResponse_Get{Get: &godbpb.GetResponse{Found: ok, Value: val}}}, nil
+	case *godbpb.Op_Put:
+		if err := ks.Set(op.Put.Key, op.Put.Value); err != nil {
+			return nil, err
+		}
+		return &godbpb.OpResponse{Op: &godbpb.OpResponse_Put{Put: &godbpb.PutResponse{}}}, nil
+	case *godbpb.Op_Delete:
+		deleted, err := ks.Del(op.Delete.Key)
+		if err != nil {
+			return nil, err
+		}
+		return &godbpb.OpResponse{Op: &godbpb.OpResponse_Delete{Delete: &godbpb.DeleteResponse{Deleted: deleted}}}, nil
+	}
+	return nil, fmt.Errorf("unknown op %T", op.Op)
+}
+
+func (k *kvService) Watch(req *godbpb.WatchRequest, stream grpc.ServerStreamingServer[godbpb.Change]) error {
+	ns, _, err := k.authorize(stream.Context(), PermRead)
+	if err != nil {
+		return err
+	}
+	w := watch(k.db, ns, req.Start, req.End)
+	defer w.Close()
+	// the headers tell the client that the watch started
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	for {
+		select {
+		case c, ok := <-w.C:
+			if !ok {
+				return status.Error(codes.Aborted, w.Err().Error())
+			}
+			if err := stream.Send(&godbpb.Change{Seq: c.Seq, Key: c.Key, Old: c.Old, New: c.New}); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
+
+func (k *kvService) Changes(req *godbpb.ChangesRequest, stream grpc.ServerStreamingServer[godbpb.LogEntry]) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	user, err := k.authenticate(md)
+	if err != nil {
+		return err
+	}
+	feed := k.db.Follow(req.From)
+	defer feed.Close()
+	for {
+		select {
+		case e, ok := <-feed.C:
+			if !ok {
+				if errors.Is(feed.Err(), btree.ErrChangesTrimmed) {
+					return status.Error(codes.OutOfRange, feed.Err().Error())
+				}
+				return status.Error(codes.Aborted, feed.Err().Error())
+			}
+			ns, ok := readable(k.auth, user, &e)
+			if !ok {
+				continue
+			}
+			entry := &godbpb.LogEntry{Seq: e.Seq, Namespace: ns, Key: e.Key, Value: e.Value}
+			if err := stream.Send(entry); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
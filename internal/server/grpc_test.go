@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"godb/api/godbpb"
+	"godb/internal/storage/index/btree"
+)
+
+// a gRPC server and its client, the values kept after a transaction are
+// poisoned
+func startGRPC(t *testing.T) godbpb.KVClient {
+	t.Helper()
+	db := &btree.KV{Path: filepath.Join(t.TempDir(), "test.db"), PoisonViews: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &GRPCServer{DB: db}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+	conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		srv.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve() = %v", err)
+		}
+		db.Close()
+	})
+	return godbpb.NewKVClient(conn)
+}
+
+func scanAll(t *testing.T, c godbpb.KVClient, req *godbpb.ScanRequest) []string {
+	t.Helper()
+	stream, err := c.Scan(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for {
+		kv, err := stream.Recv()
+		if err == io.EOF {
+			return keys
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, string(kv.Key))
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	c := startGRPC(t)
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		_, err := c.Put(ctx, &godbpb.PutRequest{Key: []byte(fmt.Sprintf("k%03d", i)), Value: []byte(fmt.Sprint(i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := c.Get(ctx, &godbpb.GetRequest{Key: []byte("k042")})
+	if err != nil || !got.Found || string(got.Value) != "42" {
+		t.Fatalf("Get(k042) = %v, %v", got, err)
+	}
+	if got, err := c.Get(ctx, &godbpb.GetRequest{Key: []byte("nope")}); err != nil || got.Found {
+		t.Fatalf("Get(nope) = %v, %v", got, err)
+	}
+	if del, err := c.Delete(ctx, &godbpb.DeleteRequest{Key: []byte("k042")}); err != nil || !del.Deleted {
+		t.Fatalf("Delete(k042) = %v, %v", del, err)
+	}
+	if _, err := c.Put(ctx, &godbpb.PutRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Put(empty key) = %v; want InvalidArgument", err)
+	}
+
+	if keys := scanAll(t, c, &godbpb.ScanRequest{Start: []byte("k040"), End: []byte("k045")}); fmt.Sprint(keys) != "[k040 k041 k043 k044]" {
+		t.Fatalf("Scan(k040, k045) = %v", keys)
+	}
+	if keys := scanAll(t, c, &godbpb.ScanRequest{}); len(keys) != 99 {
+		t.Fatalf("Scan() = %d keys; want 99", len(keys))
+	}
+	if keys := scanAll(t, c, &godbpb.ScanRequest{Start: []byte("k090"), Limit: 3}); fmt.Sprint(keys) != "[k090 k091 k092]" {
+		t.Fatalf("Scan(k090, limit 3) = %v", keys)
+	}
+}
+
+func TestGRPCTxn(t *testing.T) {
+	c := startGRPC(t)
+	ctx := context.Background()
+	c.Put(ctx, &godbpb.PutRequest{Key: []byte("a"), Value: []byte("1")})
+	put := func(key, val string) *godbpb.Op {
+		return &godbpb.Op{Op: &godbpb.Op_Put{Put: &godbpb.PutRequest{Key: []byte(key), Value: []byte(val)}}}
+	}
+	get := func(key string) *godbpb.Op {
+		return &godbpb.Op{Op: &godbpb.Op_Get{Get: &godbpb.GetRequest{Key: []byte(key)}}}
+	}
+
+	// compare and swap
+	req := &godbpb.TxnRequest{
+		Compare: []*godbpb.Compare{{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("b")}},
+		Success: []*godbpb.Op{put("a", "2"), put("b", "x"), get("a")},
+		Failure: []*godbpb.Op{get("a")},
+	}
+	resp, err := c.Txn(ctx, req)
+	if err != nil || !resp.Succeeded || len(resp.Responses) != 3 {
+		t.Fatalf("Txn() = %v, %v", resp, err)
+	}
+	if val := resp.Responses[2].GetGet().Value; string(val) != "2" {
+		t.Fatalf("Get(a) in the transaction = %q; want 2", val)
+	}
+	resp, err = c.Txn(ctx, req)
+	if err != nil || resp.Succeeded || string(resp.Responses[0].GetGet().Value) != "2" {
+		t.Fatalf("second Txn() = %v, %v", resp, err)
+	}
+
+	// an invalid op fails the whole transaction
+	_, err = c.Txn(ctx, &godbpb.TxnRequest{Success: []*godbpb.Op{put("c", "1"), put("", "1")}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Txn() with an empty key = %v; want InvalidArgument", err)
+	}
+	if got, _ := c.Get(ctx, &godbpb.GetRequest{Key: []byte("c")}); got.Found {
+		t.Fatal("a failed transaction was applied")
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"godb/internal/storage/index/btree"
+)
+
+// Health serves the probes of an orchestrator like Kubernetes over HTTP.
+// /healthz is the liveness: the database is open and its last batch of
+// commits is durable, see btree.KV.Health. /readyz is the readiness: the
+// liveness, the lag of a replica and the free space of the disk. both
+// answer 200 or 503 with a line per check.
+type Health struct {
+	DB       *btree.KV
+	Follower *Follower     // of a replica, nil on a leader
+	MaxLag   time.Duration // of the replica, see Follower.Lag. no limit if 0
+	MinFree  uint64        // bytes free on the disk of the file, no limit if 0
+}
+
+type healthCheck struct {
+	name string
+	err  error
+}
+
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var checks []healthCheck
+	switch r.URL.Path {
+	case "/healthz":
+		checks = h.live()
+	case "/readyz":
+		checks = h.ready()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	status, body := http.StatusOK, ""
+	for _, c := range checks {
+		if c.err != nil {
+			status = http.StatusServiceUnavailable
+			body += fmt.Sprintf("fail %s: %v\n", c.name, c.err)
+		} else {
+			body += fmt.Sprintf("ok %s\n", c.name)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
+
+func (h *Health) live() []healthCheck {
+	return []healthCheck{{"db", h.DB.Health()}}
+}
+
+func (h *Health) ready() []healthCheck {
+	checks := h.live()
+	if h.Follower != nil {
+		checks = append(checks, healthCheck{"lag", h.checkLag()})
+	}
+	if h.MinFree > 0 {
+		checks = append(checks, healthCheck{"disk", h.checkDisk()})
+	}
+	return checks
+}
+
+func (h *Health) checkLag() error {
+	lag, ok := h.Follower.Lag()
+	switch {
+	case !ok:
+		return errors.New("not synced with the leader yet")
+	case h.MaxLag > 0 && lag > h.MaxLag:
+		return fmt.Errorf("disconnected from the leader for %v", lag.Round(time.Millisecond))
+	}
+	return nil
+}
+
+func (h *Health) checkDisk() error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(filepath.Dir(h.DB.Path), &st); err != nil {
+		return err
+	}
+	if free := st.Bavail * uint64(st.Bsize); free < h.MinFree {
+		return fmt.Errorf("%d bytes free, %d needed", free, h.MinFree)
+	}
+	return nil
+}
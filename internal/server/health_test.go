@@ -0,0 +1,77 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"godb/internal/storage/index/btree"
+)
+
+// the status and the body of a probe
+func probe(h *Health, path string) (int, string) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w.Code, w.Body.String()
+}
+
+func TestHealth(t *testing.T) {
+	leaderAddr := startServer(t)
+	var replicaDB *btree.KV
+	startServerWith(t, func(srv *Server) {
+		replicaDB = srv.DB
+		replicaDB.Replica = true
+	})
+	f := &Follower{DB: replicaDB, Addr: leaderAddr}
+	h := &Health{DB: replicaDB, Follower: f, MaxLag: time.Millisecond}
+
+	if code, body := probe(h, "/healthz"); code != http.StatusOK || body != "ok db\n" {
+		t.Fatalf("/healthz = %d %q", code, body)
+	}
+	if code, body := probe(h, "/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "fail lag: not synced") {
+		t.Fatalf("/readyz before the sync = %d %q", code, body)
+	}
+	if code, _ := probe(h, "/other"); code != http.StatusNotFound {
+		t.Fatalf("/other = %d", code)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- f.Follow() }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, body := probe(h, "/readyz")
+		if code == http.StatusOK && body == "ok db\nok lag\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("/readyz after the sync = %d %q", code, body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the lag grows once the connection ends
+	f.Close()
+	if err := <-done; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Follow() = %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if code, body := probe(h, "/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "fail lag: disconnected from the leader for") {
+		t.Fatalf("/readyz after the connection ended = %d %q", code, body)
+	}
+	if lag, ok := f.Lag(); !ok || lag < 10*time.Millisecond {
+		t.Fatalf("Lag() = %v, %v", lag, ok)
+	}
+
+	h = &Health{DB: replicaDB, MinFree: math.MaxUint64}
+	if code, body := probe(h, "/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "fail disk: ") {
+		t.Fatalf("/readyz without disk space = %d %q", code, body)
+	}
+	h.MinFree = 1
+	if code, body := probe(h, "/readyz"); code != http.StatusOK || body != "ok db\nok disk\n" {
+		t.Fatalf("/readyz = %d %q", code, body)
+	}
+}
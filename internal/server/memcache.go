@@ -0,0 +1,439 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"godb/internal/storage/index/btree"
+)
+
+// MemcacheServer speaks the memcached text protocol. items live in a TTL
+// column family, every command is its own transaction.
+//
+//	get key ...                           VALUE key flags bytes, data, END
+//	set|add|replace key flags exptime bytes [noreply], data
+//	                                      STORED or NOT_STORED
+//	delete key [noreply]                  DELETED or NOT_FOUND
+//	incr|decr key delta [noreply]         the new value or NOT_FOUND
+//	touch key exptime [noreply]           TOUCHED or NOT_FOUND
+//	version, quit
+//
+// with authentication the first command is a set of any key with the data
+// "user password", as in memcached's text protocol authentication.
+//
+// there are no cas unique values, gets and cas are unknown commands.
+//
+// exptime 0 never expires, up to 30 days is relative seconds, above is a
+// unix time, negative is expired.
+//
+// stored item
+// | flags | data |
+// |  4B   | ...  |
+type MemcacheServer struct {
+	DB     *btree.KV
+	Family string      // column family of the items, "memcached" if empty
+	TLS    *tls.Config // plain TCP if nil
+	// clients must authenticate as one of the users, anyone is allowed if
+	// nil. the namespace of the users' rules is the column family.
+	Auth *Accounts
+
+	listener
+}
+
+const (
+	MC_MAX_KEY = 250
+	// the expiration index prefixes values by 8 bytes
+	MC_MAX_DATA = btree.BT_MAX_VAL_SIZE - 8 - 4
+	// larger data blocks close the connection instead of being skipped
+	MC_MAX_SKIP = 1 << 20
+	// exptime above this is a unix time
+	MC_RELATIVE_EXPTIME = 30 * 24 * 3600
+)
+
+var (
+	errMCClient = errors.New("CLIENT_ERROR")
+	errMCServer = errors.New("SERVER_ERROR")
+)
+
+// creates the column family and accepts connections until Close
+func (s *MemcacheServer) Serve(ln net.Listener) error {
+	if s.Family == "" {
+		s.Family = "memcached"
+	}
+	if err := ttlFamily(s.DB, s.Family); err != nil {
+		return err
+	}
+	return s.serve(ln, s.TLS, s.serveConn)
+}
+
+type mcConn struct {
+	srv  *MemcacheServer
+	r    *bufio.Reader
+	w    *bufio.Writer
+	user string
+	addr string // of the client, for the audit log
+	quit bool
+}
+
+func (s *MemcacheServer) serveConn(conn net.Conn) {
+	c := &mcConn{srv: s, r: bufio.NewReader(conn), w: bufio.NewWriter(conn), addr: conn.RemoteAddr().String()}
+	for !c.quit {
+		line, err := readLine(c.r)
+		if err != nil {
+			if errors.Is(err, errRESPProtocol) {
+				c.w.WriteString("CLIENT_ERROR line too long\r\n")
+				c.w.Flush()
+			}
+			return
+		}
+		if err := c.exec(bytes.Fields(line)); err != nil {
+			if !errors.Is(err, errMCClient) && !errors.Is(err, errMCServer) {
+				c.w.Flush()
+				return // the data block can't be read
+			}
+			c.w.WriteString(err.Error() + "\r\n")
+		}
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+	c.w.Flush()
+}
+
+func mcClientError(msg string) error {
+	return fmt.Errorf("%w %s", errMCClient, msg)
+}
+
+// the time of an exptime, zero if it never expires
+func (s *MemcacheServer) expireAt(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return s.now()
+	case exptime <= MC_RELATIVE_EXPTIME:
+		return s.now().Add(time.Duration(exptime) * time.Second)
+	default:
+		return time.Unix(exptime, 0)
+	}
+}
+
+func (s *MemcacheServer) now() time.Time {
+	if s.DB.Now != nil {
+		return s.DB.Now()
+	}
+	return time.Now()
+}
+
+// the column family in a transaction, writes are committed.
+// storage errors are server errors.
+func (c *mcConn) update(fn func(cf *btree.Bucket) error) error {
+	tx := c.srv.DB.Begin()
+	tx.SetClient(clientName(c.user, c.addr))
+	err := fn(tx.ColumnFamily([]byte(c.srv.Family)))
+	if err != nil {
+		tx.Rollback()
+	} else {
+		err = tx.Commit()
+	}
+	if err != nil && !errors.Is(err, errMCClient) {
+		return fmt.Errorf("%w %s", errMCServer, err)
+	}
+	return err
+}
+
+// sets the item, an expiration in the past deletes it
+func (c *mcConn) put(cf *btree.Bucket, key, item []byte, expireAt time.Time) error {
+	if expireAt.IsZero() {
+		return cf.Set(key, item)
+	}
+	ttl := expireAt.Sub(c.srv.now())
+	if ttl <= 0 {
+		_, err := cf.Del(key)
+		return err
+	}
+	return cf.SetTTL(key, item, ttl)
+}
+
+func checkMCKey(key []byte) error {
+	if len(key) == 0 || len(key) > MC_MAX_KEY {
+		return mcClientError("bad command line format")
+	}
+	for _, ch := range key {
+		if ch <= ' ' || ch == 0x7f {
+			return mcClientError("bad command line format")
+		}
+	}
+	return nil
+}
+
+// the trailing noreply argument
+func noreply(args [][]byte, n int) bool {
+	return len(args) == n+1 && string(args[n]) == "noreply"
+}
+
+func (c *mcConn) reply(quiet bool, s string) {
+	if !quiet {
+		c.w.WriteString(s + "\r\n")
+	}
+}
+
+func (c *mcConn) exec(args [][]byte) error {
+	if len(args) == 0 {
+		c.w.WriteString("ERROR\r\n")
+		return nil
+	}
+	cmd, args := string(args[0]), args[1:]
+	if c.srv.Auth != nil && c.user == "" && cmd != "set" && cmd != "quit" {
+		return mcClientError("unauthenticated")
+	}
+	perm := PermWrite
+	if cmd == "get" {
+		perm = PermRead
+	}
+	if c.user != "" && cmd != "version" && cmd != "quit" {
+		if err := c.srv.Auth.check(c.user, c.srv.Family, perm); err != nil {
+			return mcClientError(err.Error())
+		}
+	}
+	switch cmd {
+	case "get":
+		if len(args) == 0 {
+			c.w.WriteString("ERROR\r\n")
+			return nil
+		}
+		return c.get(args)
+	case "set", "add", "replace":
+		return c.store(cmd, args)
+	case "delete":
+		if len(args) == 0 || len(args) > 1 && !noreply(args, 1) {
+			return mcClientError("bad command line format")
+		}
+		if err := checkMCKey(args[0]); err != nil {
+			return err
+		}
+		deleted := false
+		err := c.update(func(cf *btree.Bucket) error {
+			var err error
+			deleted, err = cf.Del(args[0])
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if deleted {
+			c.reply(noreply(args, 1), "DELETED")
+		} else {
+			c.reply(noreply(args, 1), "NOT_FOUND")
+		}
+		return nil
+	case "incr", "decr":
+		return c.incr(cmd == "incr", args)
+	case "touch":
+		return c.touch(args)
+	case "version":
+		c.w.WriteString("VERSION godb\r\n")
+		return nil
+	case "quit":
+		c.quit = true
+		return nil
+	default:
+		c.w.WriteString("ERROR\r\n")
+		return nil
+	}
+}
+
+func (c *mcConn) get(keys [][]byte) error {
+	for _, key := range keys {
+		if err := checkMCKey(key); err != nil {
+			return err
+		}
+	}
+	tx := c.srv.DB.BeginRead()
+	defer tx.Rollback()
+	// nil if the column family is not durable yet
+	cf := tx.ColumnFamily([]byte(c.srv.Family))
+	for _, key := range keys {
+		if cf == nil {
+			break
+		}
+		item, ok := cf.Get(key)
+		if !ok || len(item) < 4 {
+			continue
+		}
+		flags := binary.BigEndian.Uint32(item)
+		fmt.Fprintf(c.w, "VALUE %s %d %d\r\n", key, flags, len(item)-4)
+		c.w.Write(item[4:])
+		c.w.WriteString("\r\n")
+	}
+	c.w.WriteString("END\r\n")
+	return nil
+}
+
+// reads the data block of a storage command
+func (c *mcConn) data(size int) ([]byte, error) {
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(buf, []byte("\r\n")) {
+		// skips the rest of the line like memcached
+		if !bytes.HasSuffix(buf, []byte("\n")) {
+			if _, err := readLine(c.r); err != nil {
+				return nil, err
+			}
+		}
+		return nil, mcClientError("bad data chunk")
+	}
+	return buf[:size], nil
+}
+
+func (c *mcConn) store(cmd string, args [][]byte) error {
+	if len(args) != 4 && !noreply(args, 4) {
+		return mcClientError("bad command line format")
+	}
+	key := args[0]
+	flags, err1 := strconv.ParseUint(string(args[1]), 10, 32)
+	exptime, err2 := strconv.ParseInt(string(args[2]), 10, 64)
+	size, err3 := strconv.Atoi(string(args[3]))
+	if err1 != nil || err2 != nil || err3 != nil || size < 0 {
+		return mcClientError("bad command line format")
+	}
+	if size > MC_MAX_DATA {
+		if size > MC_MAX_SKIP {
+			c.w.WriteString("SERVER_ERROR object too large for cache\r\n")
+			return errors.New("data block too large")
+		}
+		if _, err := c.r.Discard(size + 2); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w object too large for cache", errMCServer)
+	}
+	data, err := c.data(size)
+	if err != nil {
+		return err
+	}
+	if c.srv.Auth != nil && c.user == "" {
+		user, password, _ := bytes.Cut(data, []byte(" "))
+		u, err := c.srv.Auth.Authenticate(string(user), string(password))
+		if err != nil {
+			return mcClientError("authentication failure")
+		}
+		c.user = u.Name
+		c.reply(false, "STORED")
+		return nil
+	}
+	if err := checkMCKey(key); err != nil {
+		return err
+	}
+
+	item := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(data)), uint32(flags))
+	item = append(item, data...)
+	stored := false
+	err = c.update(func(cf *btree.Bucket) error {
+		if cmd != "set" {
+			if _, ok := cf.Get(key); ok != (cmd == "replace") {
+				return nil
+			}
+		}
+		stored = true
+		return c.put(cf, key, item, c.srv.expireAt(exptime))
+	})
+	if err != nil {
+		return err
+	}
+	if stored {
+		c.reply(noreply(args, 4), "STORED")
+	} else {
+		c.reply(noreply(args, 4), "NOT_STORED")
+	}
+	return nil
+}
+
+// incr wraps around at 64 bits, decr stops at 0, the expiration is kept
+func (c *mcConn) incr(incr bool, args [][]byte) error {
+	if len(args) != 2 && !noreply(args, 2) {
+		return mcClientError("bad command line format")
+	}
+	key := args[0]
+	if err := checkMCKey(key); err != nil {
+		return err
+	}
+	delta, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return mcClientError("invalid numeric delta argument")
+	}
+	var result []byte
+	err = c.update(func(cf *btree.Bucket) error {
+		item, ok := cf.Get(key)
+		if !ok || len(item) < 4 {
+			return nil
+		}
+		n, err := strconv.ParseUint(string(item[4:]), 10, 64)
+		if err != nil {
+			return mcClientError("cannot increment or decrement non-numeric value")
+		}
+		switch {
+		case incr:
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		result = strconv.AppendUint(nil, n, 10)
+		expireAt, _ := cf.ExpiresAt(key)
+		return c.put(cf, key, append(item[:4:4], result...), expireAt)
+	})
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		c.reply(noreply(args, 2), "NOT_FOUND")
+	} else {
+		c.reply(noreply(args, 2), string(result))
+	}
+	return nil
+}
+
+func (c *mcConn) touch(args [][]byte) error {
+	if len(args) != 2 && !noreply(args, 2) {
+		return mcClientError("bad command line format")
+	}
+	key := args[0]
+	if err := checkMCKey(key); err != nil {
+		return err
+	}
+	exptime, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return mcClientError("invalid exptime argument")
+	}
+	touched := false
+	err = c.update(func(cf *btree.Bucket) error {
+		item, ok := cf.Get(key)
+		if !ok {
+			return nil
+		}
+		touched = true
+		return c.put(cf, key, append([]byte{}, item...), c.srv.expireAt(exptime))
+	})
+	if err != nil {
+		return err
+	}
+	if touched {
+		c.reply(noreply(args, 2), "TOUCHED")
+	} else {
+		c.reply(noreply(args, 2), "NOT_FOUND")
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"godb/internal/storage/index/btree"
+)
+
+type mcClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startMemcache(t *testing.T, now func() time.Time) *mcClient {
+	t.Helper()
+	db := &btree.KV{Path: filepath.Join(t.TempDir(), "test.db"), Now: now, PoisonViews: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &MemcacheServer{DB: db}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		srv.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve() = %v", err)
+		}
+		db.Close()
+	})
+	return &mcClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// sends the request and reads `lines` lines of the reply, joined by |
+func (c *mcClient) do(req string, lines int) string {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(req)); err != nil {
+		c.t.Fatal(err)
+	}
+	var out []string
+	for i := 0; i < lines; i++ {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("%q: %v", req, err)
+		}
+		out = append(out, strings.TrimSuffix(line, "\r\n"))
+	}
+	return strings.Join(out, "|")
+}
+
+func TestMemcache(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	c := startMemcache(t, func() time.Time { return now })
+	for _, step := range []struct {
+		req   string
+		lines int
+		want  string
+	}{
+		{"get k\r\n", 1, "END"},
+		{"set k 5 0 5\r\nhello\r\n", 1, "STORED"},
+		{"get k nope\r\n", 3, "VALUE k 5 5|hello|END"},
+		{"add k 0 0 1\r\nx\r\n", 1, "NOT_STORED"},
+		{"replace k2 0 0 1\r\nx\r\n", 1, "NOT_STORED"},
+		{"add k2 0 0 4\r\na\r\nb\r\n", 1, "STORED"},
+		{"get k2\r\n", 4, "VALUE k2 0 4|a|b|END"},
+		{"delete k2\r\n", 1, "DELETED"},
+		{"delete k2\r\n", 1, "NOT_FOUND"},
+		{"set n 0 10 2\r\n41\r\n", 1, "STORED"},
+		{"incr n 1\r\n", 1, "42"},
+		{"decr n 50\r\n", 1, "0"},
+		{"incr n 18446744073709551615\r\n", 1, "18446744073709551615"},
+		{"incr n 2\r\n", 1, "1"},
+		{"incr k 1\r\n", 1, "CLIENT_ERROR cannot increment or decrement non-numeric value"},
+		{"incr nope 1\r\n", 1, "NOT_FOUND"},
+		{"incr n x\r\n", 1, "CLIENT_ERROR invalid numeric delta argument"},
+		{"set e 0 -1 1\r\nx\r\n", 1, "STORED"},
+		{"get e\r\n", 1, "END"},
+		{"set a 0 1700000100 1\r\nx\r\n", 1, "STORED"},
+		{"set q 0 0 1 noreply\r\nx\r\nget q\r\n", 3, "VALUE q 0 1|x|END"},
+		{"set k 0 0 3\r\nabcde\r\n", 1, "CLIENT_ERROR bad data chunk"},
+		{"set k 0 0\r\n", 1, "CLIENT_ERROR bad command line format"},
+		{"bogus\r\n", 1, "ERROR"},
+		{"version\r\n", 1, "VERSION godb"},
+	} {
+		if got := c.do(step.req, step.lines); got != step.want {
+			t.Fatalf("%q = %q; want %q", step.req, got, step.want)
+		}
+	}
+
+	// n expires in 10s, incr keeps the expiration, a in 100s
+	now = now.Add(11 * time.Second)
+	if got := c.do("get n a\r\n", 3); got != "VALUE a 0 1|x|END" {
+		t.Fatalf("after 11s: %q", got)
+	}
+	if got := c.do("touch a 0\r\n", 1); got != "TOUCHED" {
+		t.Fatal(got)
+	}
+	now = now.Add(time.Hour)
+	if got := c.do("get a\r\n", 3); got != "VALUE a 0 1|x|END" {
+		t.Fatalf("after touch: %q", got)
+	}
+	if got := c.do("touch nope 10\r\n", 1); got != "NOT_FOUND" {
+		t.Fatal(got)
+	}
+
+	// too large values are skipped, or close the connection
+	big := strings.Repeat("x", MC_MAX_DATA+1)
+	req := fmt.Sprintf("set big 0 0 %d\r\n%s\r\nget big\r\n", len(big), big)
+	if got := c.do(req, 2); got != "SERVER_ERROR object too large for cache|END" {
+		t.Fatalf("large value: %q", got)
+	}
+	if got := c.do("set big 0 0 100000000\r\n", 1); got != "SERVER_ERROR object too large for cache" {
+		t.Fatalf("huge value: %q", got)
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Fatal("the connection is open after a huge value")
+	}
+}
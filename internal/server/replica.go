@@ -0,0 +1,281 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"godb/internal/storage/index/btree"
+	"godb/internal/wire"
+)
+
+// Replication over the wire protocol: a follower connects to the leader
+// and sends REPLICATE, the connection then streams a snapshot of the
+// leader and the batches made durable after it, see btree.Replication.
+// a new follower joins with an empty file, nothing is copied out of band.
+// the snapshot ends with its commit sequence, the batches follow it. a
+// follower syncs the snapshot again on every connection. replication
+// needs a superuser when authentication is enabled, the users are
+// replicated with the data.
+
+// the pages of a REPL_PAGES frame
+const REPLICA_FRAME_PAGES = 256
+
+func (sess *session) startReplication() error {
+	if sess.tx != nil {
+		return errors.New("can't replicate in a transaction")
+	}
+	if sess.auth != nil {
+		if u := sess.auth.Lookup(sess.user); u == nil || !u.superuser() {
+			return fmt.Errorf("%w: replication needs *=admin", ErrPermission)
+		}
+	}
+	sess.replication = sess.db.Replicate()
+	return nil
+}
+
+// sends the snapshot and the batches until the follower goes away or the
+// replication ends
+func (sess *session) ship(conn net.Conn, w *bufio.Writer) {
+	rep := sess.replication
+	defer rep.Close()
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		// the follower sends nothing more, the read ends when it goes away
+		io.Copy(io.Discard, conn)
+		rep.Close()
+	}()
+	frame := []byte{wire.STATUS_OK, wire.REPL_PAGES}
+	n := 0
+	flush := func() error {
+		if n == 0 {
+			return nil
+		}
+		err := wire.WriteFrame(w, frame)
+		frame, n = frame[:2], 0
+		return err
+	}
+	add := func(ptr uint64, page []byte) error {
+		frame = wire.AppendUint64(frame, ptr)
+		frame = wire.AppendBytes(frame, page)
+		if n++; n == REPLICA_FRAME_PAGES {
+			return flush()
+		}
+		return nil
+	}
+	if err := rep.Snapshot(add); err != nil {
+		return
+	}
+	snapshot := wire.AppendUint64([]byte{wire.STATUS_OK, wire.REPL_SNAPSHOT}, rep.Seq())
+	if flush() != nil || wire.WriteFrame(w, snapshot) != nil {
+		return
+	}
+	for d := range rep.C {
+		for ptr, page := range d.Pages {
+			if add(ptr, page) != nil {
+				return
+			}
+		}
+		if flush() != nil {
+			return
+		}
+		if wire.WriteFrame(w, wire.AppendBytes([]byte{wire.STATUS_OK, wire.REPL_COMMIT}, d.Meta)) != nil {
+			return
+		}
+	}
+	if err := rep.Err(); !errors.Is(err, btree.ErrReplicaClosed) {
+		wire.WriteFrame(w, errorReply(err))
+	}
+}
+
+// Follower keeps a replica up to date with a leader served by Server.
+// the replica serves reads, writes fail with btree.ErrReplica.
+type Follower struct {
+	DB   *btree.KV // opened with Replica
+	Addr string    // the address of the leader
+	TLS  *tls.Config
+	// authenticates as the user if set, a superuser of the leader
+	User, Password string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	closed bool
+	synced bool      // the snapshot of the connection is restored
+	lost   time.Time // the last synced connection ended, see Lag
+}
+
+// an upper bound of how far the replica is behind the leader. the leader
+// streams its batches as they are durable, the lag is 0 while a synced
+// connection lasts and the time since it ended otherwise. ok is false
+// until the first snapshot is restored.
+func (f *Follower) Lag() (lag time.Duration, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case f.synced:
+		return 0, true
+	case f.lost.IsZero():
+		return 0, false
+	default:
+		return time.Since(f.lost), true
+	}
+}
+
+// syncs a snapshot of the leader and applies its batches until the
+// connection fails or Close. call it again to reconnect.
+func (f *Follower) Follow() error {
+	f.mu.Lock()
+	closed := f.closed
+	f.mu.Unlock()
+	if closed {
+		return ErrServerClosed
+	}
+	var conn net.Conn
+	var err error
+	if f.TLS != nil {
+		conn, err = tls.Dial("tcp", f.Addr, f.TLS)
+	} else {
+		conn, err = net.Dial("tcp", f.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return ErrServerClosed
+	}
+	f.conn = conn
+	f.mu.Unlock()
+
+	err = f.follow(bufio.NewReader(conn), bufio.NewWriter(conn))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.conn = nil
+	if f.synced {
+		f.synced = false
+		f.lost = time.Now()
+	}
+	if f.closed {
+		return ErrServerClosed
+	}
+	return err
+}
+
+func (f *Follower) follow(r *bufio.Reader, w *bufio.Writer) error {
+	call := func(req []byte) error {
+		if err := wire.WriteFrame(w, req); err != nil {
+			return err
+		}
+		_, err := readReplyFrame(r)
+		return err
+	}
+	if f.User != "" {
+		req := wire.AppendBytes([]byte{wire.OP_AUTH}, []byte(f.User))
+		if err := call(wire.AppendBytes(req, []byte(f.Password))); err != nil {
+			return err
+		}
+	}
+	if err := call([]byte{wire.OP_REPLICATE}); err != nil {
+		return err
+	}
+
+	path := f.DB.Path + ".sync"
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path) // renamed by Restore
+	defer file.Close()
+	synced := false
+	pages := map[uint64][]byte{}
+	for {
+		fr, err := readReplyFrame(r)
+		if err != nil {
+			return err
+		}
+		switch fr.Byte() {
+		case wire.REPL_PAGES:
+			for fr.Err() == nil && fr.Len() > 0 {
+				ptr, page := fr.Uint64(), fr.Bytes()
+				if fr.Err() != nil {
+					break
+				}
+				if synced {
+					pages[ptr] = page
+				} else if _, err := file.WriteAt(page, int64(ptr*btree.BT_PAGE_SIZE)); err != nil {
+					return err
+				}
+			}
+			if err := fr.Done(); err != nil {
+				return err
+			}
+		case wire.REPL_SNAPSHOT:
+			seq := fr.Uint64()
+			if err := fr.Done(); err != nil {
+				return err
+			}
+			if err := file.Close(); err != nil {
+				return err
+			}
+			if err := f.DB.Restore(path); err != nil {
+				return err
+			}
+			tx := f.DB.BeginRead()
+			restored := tx.Seq()
+			tx.Rollback()
+			if restored != seq {
+				return fmt.Errorf("%w: a snapshot of %d restored as %d", wire.ErrProtocol, seq, restored)
+			}
+			synced = true
+			f.mu.Lock()
+			f.synced = true
+			f.mu.Unlock()
+		case wire.REPL_COMMIT:
+			meta := fr.Bytes()
+			if err := fr.Done(); err != nil {
+				return err
+			}
+			if !synced {
+				return fmt.Errorf("%w: commit before the snapshot", wire.ErrProtocol)
+			}
+			if err := f.DB.Apply(btree.Delta{Meta: meta, Pages: pages}); err != nil {
+				return err
+			}
+			pages = map[uint64][]byte{}
+		default:
+			return fmt.Errorf("%w: bad replication frame", wire.ErrProtocol)
+		}
+	}
+}
+
+// stops following, a running Follow returns ErrServerClosed
+func (f *Follower) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	if f.conn != nil {
+		return f.conn.Close()
+	}
+	return nil
+}
+
+// reads a response, ERR becomes an error
+func readReplyFrame(r *bufio.Reader) (*wire.Reader, error) {
+	resp, err := wire.ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	fr := wire.NewReader(resp)
+	if fr.Byte() == wire.STATUS_ERR {
+		return nil, fmt.Errorf("leader: %s", fr.Rest())
+	}
+	return fr, nil
+}
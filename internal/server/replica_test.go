@@ -0,0 +1,72 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"godb/client"
+	"godb/internal/storage/index/btree"
+)
+
+// waits until the key has the value on the replica
+func waitReplica(t *testing.T, c *client.Client, key, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		val, ok, err := c.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok && string(val) == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Get(%s) on the replica = %q, %v; want %s", key, val, ok, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	leaderAddr := startServer(t)
+	leader := dial(t, leaderAddr)
+	for i := 0; i < 1000; i++ {
+		leader.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprint(i)))
+	}
+	var replicaDB *btree.KV
+	addr := startServerWith(t, func(srv *Server) {
+		// read by commits, there were none yet
+		replicaDB = srv.DB
+		replicaDB.Replica = true
+	})
+	f := &Follower{DB: replicaDB, Addr: leaderAddr}
+	done := make(chan error, 1)
+	go func() { done <- f.Follow() }()
+	defer func() {
+		f.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Follow() = %v", err)
+		}
+	}()
+
+	replica := dial(t, addr)
+	waitReplica(t, replica, "k0999", "999")
+	leader.Use("ns")
+	leader.Set([]byte("a"), []byte("in a bucket"))
+	leader.Use("/")
+	leader.Begin(true)
+	leader.Del([]byte("k0000"))
+	leader.Set([]byte("k0001"), []byte("changed"))
+	leader.Commit()
+	waitReplica(t, replica, "k0001", "changed")
+	if _, ok, _ := replica.Get([]byte("k0000")); ok {
+		t.Fatal("a deleted key on the replica")
+	}
+	replica.Use("ns")
+	waitReplica(t, replica, "a", "in a bucket")
+	if err := replica.Set([]byte("a"), nil); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("Set() on the replica = %v", err)
+	}
+}
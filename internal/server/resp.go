@@ -0,0 +1,556 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"godb/internal/storage/index/btree"
+)
+
+// RESPServer speaks the Redis protocol, so Redis clients can use the store.
+// keys live in a TTL column family, every command is its own transaction.
+//
+//	GET key                          bulk or nil
+//	SET key val [EX s|PX ms] [NX|XX] OK, nil if NX/XX is not met
+//	DEL key ...                      number of deleted keys
+//	MGET key ...                     array of bulks or nils
+//	EXPIRE key seconds               1 if the key exists, seconds <= 0 deletes it
+//	SCAN cursor [MATCH p] [COUNT n]  next cursor and keys, cursor 0 starts and ends
+//	PING [msg], QUIT
+//	AUTH [user] password             OK, the user is "default" if omitted
+//
+// requests are arrays of bulk strings or inline commands, replies are
+// flushed when there are no more pipelined requests.
+type RESPServer struct {
+	DB     *btree.KV
+	Family string      // column family of the keys, "redis" if empty
+	TLS    *tls.Config // plain TCP if nil
+	// clients must AUTH as one of the users, anyone is allowed if nil.
+	// the namespace of the users' rules is the column family.
+	Auth *Accounts
+
+	listener
+}
+
+const (
+	RESP_MAX_ARGS = 1 << 16
+	RESP_MAX_BULK = 1 << 20
+	// cursors kept per connection, the oldest one is dropped
+	RESP_MAX_CURSORS = 1024
+	// the expiration index prefixes keys by 8 bytes, values by 8 bytes
+	RESP_MAX_KEY = btree.BT_MAX_KEY_SIZE - 8
+	RESP_MAX_VAL = btree.BT_MAX_VAL_SIZE - 8
+)
+
+var errRESPProtocol = errors.New("Protocol error")
+
+// creates the column family and accepts connections until Close
+func (s *RESPServer) Serve(ln net.Listener) error {
+	if s.Family == "" {
+		s.Family = "redis"
+	}
+	if err := ttlFamily(s.DB, s.Family); err != nil {
+		return err
+	}
+	return s.serve(ln, s.TLS, s.serveConn)
+}
+
+// creates the TTL column family if it does not exist
+func ttlFamily(db *btree.KV, name string) error {
+	tx := db.Begin()
+	cf := tx.ColumnFamily([]byte(name))
+	if cf == nil {
+		var err error
+		if cf, err = tx.CreateColumnFamily([]byte(name), btree.CFOptions{TTL: true}); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if !cf.Options().TTL {
+		tx.Rollback()
+		return fmt.Errorf("column family %s has no TTL", name)
+	}
+	return tx.Commit()
+}
+
+type respConn struct {
+	srv     *RESPServer
+	w       *bufio.Writer
+	cursors map[uint64][]byte // cursor -> the next key
+	next    uint64
+	user    string
+	addr    string // of the client, for the audit log
+	quit    bool
+}
+
+func (s *RESPServer) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	c := &respConn{srv: s, w: bufio.NewWriter(conn), cursors: map[uint64][]byte{}, addr: conn.RemoteAddr().String()}
+	for !c.quit {
+		args, err := readCommand(r)
+		if err != nil {
+			if errors.Is(err, errRESPProtocol) {
+				c.error(err.Error())
+				c.w.Flush()
+			}
+			return
+		}
+		if len(args) > 0 {
+			c.exec(args)
+		}
+		if r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+	c.w.Flush()
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, fmt.Errorf("%w: too big inline request", errRESPProtocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(line[:len(line)-1], []byte("\r")), nil
+}
+
+// the arguments of the next request
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		var args [][]byte
+		for _, f := range bytes.Fields(line) {
+			args = append(args, append([]byte{}, f...))
+		}
+		return args, nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > RESP_MAX_ARGS {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+	args := make([][]byte, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$'", errRESPProtocol)
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > RESP_MAX_BULK {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(arg, []byte("\r\n")) {
+			return nil, fmt.Errorf("%w: expected CRLF", errRESPProtocol)
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+// replies
+
+func (c *respConn) simple(s string) { fmt.Fprintf(c.w, "+%s\r\n", s) }
+func (c *respConn) error(s string)  { fmt.Fprintf(c.w, "-ERR %s\r\n", s) }
+func (c *respConn) int(n int)       { fmt.Fprintf(c.w, ":%d\r\n", n) }
+func (c *respConn) nil()            { c.w.WriteString("$-1\r\n") }
+func (c *respConn) array(n int)     { fmt.Fprintf(c.w, "*%d\r\n", n) }
+
+func (c *respConn) bulk(b []byte) {
+	fmt.Fprintf(c.w, "$%d\r\n", len(b))
+	c.w.Write(b)
+	c.w.WriteString("\r\n")
+}
+
+// the column family in a transaction, writes are committed
+func (c *respConn) update(fn func(cf *btree.Bucket) error) error {
+	tx := c.srv.DB.Begin()
+	tx.SetClient(clientName(c.user, c.addr))
+	if err := fn(tx.ColumnFamily([]byte(c.srv.Family))); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// nil column family if it is not durable yet
+func (c *respConn) view(fn func(cf *btree.Bucket)) {
+	tx := c.srv.DB.BeginRead()
+	defer tx.Rollback()
+	fn(tx.ColumnFamily([]byte(c.srv.Family)))
+}
+
+func checkRESPKey(key []byte) error {
+	if len(key) == 0 || len(key) > RESP_MAX_KEY {
+		return fmt.Errorf("bad key size %d", len(key))
+	}
+	return nil
+}
+
+func (c *respConn) exec(args [][]byte) {
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+	// exact number of arguments, or the negated minimum
+	arity := map[string]int{"GET": 1, "SET": -2, "DEL": -1, "MGET": -1, "EXPIRE": 2, "SCAN": -1, "PING": 0, "QUIT": 0, "AUTH": -1}
+	n, ok := arity[name]
+	if !ok {
+		if len(name) > 64 {
+			name = name[:64]
+		}
+		c.error(fmt.Sprintf("unknown command '%s'", name))
+		return
+	}
+	if n >= 0 && len(args) != n && name != "PING" || len(args) < -n || name == "PING" && len(args) > 1 || name == "AUTH" && len(args) > 2 {
+		c.error(fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+	if c.srv.Auth != nil && c.user == "" && name != "AUTH" && name != "QUIT" {
+		c.w.WriteString("-NOAUTH Authentication required.\r\n")
+		return
+	}
+	perms := map[string]Perm{"GET": PermRead, "MGET": PermRead, "SCAN": PermRead, "SET": PermWrite, "DEL": PermWrite, "EXPIRE": PermWrite}
+	if perm := perms[name]; perm != PermNone {
+		if err := c.srv.Auth.check(c.user, c.srv.Family, perm); err != nil {
+			fmt.Fprintf(c.w, "-NOPERM %s\r\n", err)
+			return
+		}
+	}
+	var err error
+	switch name {
+	case "PING":
+		if len(args) == 1 {
+			c.bulk(args[0])
+		} else {
+			c.simple("PONG")
+		}
+	case "QUIT":
+		c.simple("OK")
+		c.quit = true
+	case "AUTH":
+		// AUTH password is the user "default"
+		user, password := "default", args[0]
+		if len(args) == 2 {
+			user, password = string(args[0]), args[1]
+		}
+		if c.srv.Auth == nil {
+			c.error("authentication is not enabled")
+			break
+		}
+		u, err := c.srv.Auth.Authenticate(user, string(password))
+		if err != nil {
+			c.w.WriteString("-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+			break
+		}
+		c.user = u.Name
+		c.simple("OK")
+	case "GET":
+		c.view(func(cf *btree.Bucket) {
+			if val, ok := respGet(cf, args[0]); ok {
+				c.bulk(val)
+			} else {
+				c.nil()
+			}
+		})
+	case "MGET":
+		c.view(func(cf *btree.Bucket) {
+			c.array(len(args))
+			for _, key := range args {
+				if val, ok := respGet(cf, key); ok {
+					c.bulk(val)
+				} else {
+					c.nil()
+				}
+			}
+		})
+	case "SET":
+		err = c.set(args)
+	case "DEL":
+		deleted := 0
+		err = c.update(func(cf *btree.Bucket) error {
+			for _, key := range args {
+				ok, err := cf.Del(key)
+				if err != nil {
+					return err
+				}
+				if ok {
+					deleted++
+				}
+			}
+			return nil
+		})
+		if err == nil {
+			c.int(deleted)
+		}
+	case "EXPIRE":
+		err = c.expire(args[0], args[1])
+	case "SCAN":
+		err = c.scan(args)
+	}
+	if err != nil {
+		c.error(err.Error())
+	}
+}
+
+func respGet(cf *btree.Bucket, key []byte) ([]byte, bool) {
+	if cf == nil {
+		return nil, false
+	}
+	return cf.Get(key)
+}
+
+func (c *respConn) set(args [][]byte) error {
+	key, val := args[0], args[1]
+	if err := checkRESPKey(key); err != nil {
+		return err
+	}
+	if len(val) > RESP_MAX_VAL {
+		return fmt.Errorf("bad value size %d", len(val))
+	}
+	var ttl time.Duration
+	nx, xx := false, false
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch {
+		case opt == "NX":
+			nx = true
+		case opt == "XX":
+			xx = true
+		case (opt == "EX" || opt == "PX") && i+1 < len(args) && ttl == 0:
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || n <= 0 || n > int64(time.Duration(1<<62)/time.Second) {
+				return errors.New("invalid expire time in 'set' command")
+			}
+			ttl = time.Duration(n) * time.Millisecond
+			if opt == "EX" {
+				ttl = time.Duration(n) * time.Second
+			}
+			i++
+		default:
+			return errors.New("syntax error")
+		}
+	}
+	if nx && xx {
+		return errors.New("syntax error")
+	}
+	done := false
+	err := c.update(func(cf *btree.Bucket) error {
+		if nx || xx {
+			if _, ok := cf.Get(key); ok != xx {
+				return nil
+			}
+		}
+		done = true
+		if ttl > 0 {
+			return cf.SetTTL(key, val, ttl)
+		}
+		return cf.Set(key, val)
+	})
+	if err != nil {
+		return err
+	}
+	if done {
+		c.simple("OK")
+	} else {
+		c.nil()
+	}
+	return nil
+}
+
+func (c *respConn) expire(key, arg []byte) error {
+	secs, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil || secs > int64(time.Duration(1<<62)/time.Second) {
+		return errors.New("value is not an integer or out of range")
+	}
+	ok := false
+	err = c.update(func(cf *btree.Bucket) error {
+		var err error
+		if secs <= 0 {
+			ok, err = cf.Del(key)
+		} else {
+			ok, err = cf.Expire(key, time.Duration(secs)*time.Second)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if ok {
+		c.int(1)
+	} else {
+		c.int(0)
+	}
+	return nil
+}
+
+// visits COUNT keys from the cursor, replies with the ones matching MATCH
+func (c *respConn) scan(args [][]byte) error {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return errors.New("invalid cursor")
+	}
+	var start []byte
+	if cursor != 0 {
+		var ok bool
+		if start, ok = c.cursors[cursor]; !ok {
+			return errors.New("invalid cursor")
+		}
+		delete(c.cursors, cursor)
+	}
+	var pattern []byte
+	count := 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errors.New("syntax error")
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n < 1 {
+				return errors.New("syntax error")
+			}
+			count = min(n, MAX_SCAN)
+		default:
+			return errors.New("syntax error")
+		}
+	}
+
+	var keys [][]byte
+	var next []byte
+	c.view(func(cf *btree.Bucket) {
+		if cf == nil {
+			return
+		}
+		seen := 0
+		cf.Scan(start, nil, func(key, _ []byte) bool {
+			if seen == count {
+				next = append([]byte{}, key...)
+				return false
+			}
+			seen++
+			if pattern == nil || globMatch(pattern, key) {
+				keys = append(keys, append([]byte{}, key...))
+			}
+			return true
+		})
+	})
+	id := uint64(0)
+	if next != nil {
+		c.next++
+		id = c.next
+		c.cursors[id] = next
+		if len(c.cursors) > RESP_MAX_CURSORS {
+			delete(c.cursors, id-RESP_MAX_CURSORS)
+		}
+	}
+	c.array(2)
+	c.bulk([]byte(strconv.FormatUint(id, 10)))
+	c.array(len(keys))
+	for _, key := range keys {
+		c.bulk(key)
+	}
+	return nil
+}
+
+// Redis glob patterns: * ? [abc] [^a-z] and \ escapes
+func globMatch(pattern, s []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := 1
+			for end < len(pattern) && (pattern[end] != ']' || end == 1 || end == 2 && pattern[1] == '^') {
+				if pattern[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(pattern) {
+				return false // unterminated class
+			}
+			if !classMatch(pattern[1:end], s[0]) {
+				return false
+			}
+			pattern = pattern[end:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// `class` is the inside of [...]
+func classMatch(class []byte, c byte) bool {
+	neg := len(class) > 0 && class[0] == '^'
+	if neg {
+		class = class[1:]
+	}
+	match := false
+	for i := 0; i < len(class); i++ {
+		lo := class[i]
+		if lo == '\\' && i+1 < len(class) {
+			i++
+			lo = class[i]
+		}
+		hi := lo
+		if i+2 < len(class) && class[i+1] == '-' {
+			hi = class[i+2]
+			i += 2
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= c && c <= hi {
+			match = true
+		}
+	}
+	return match != neg
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"godb/internal/storage/index/btree"
+)
+
+// a RESP connection reading replies as strings, arrays are flattened
+type respClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startRESP(t *testing.T, now func() time.Time) *respClient {
+	t.Helper()
+	db := &btree.KV{Path: filepath.Join(t.TempDir(), "test.db"), Now: now, PoisonViews: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &RESPServer{DB: db}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		srv.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve() = %v", err)
+		}
+		db.Close()
+	})
+	return &respClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *respClient) send(args ...string) {
+	c.t.Helper()
+	req := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		req += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(req)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *respClient) reply() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatal(err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		var items []string
+		for i := 0; i < n; i++ {
+			items = append(items, c.reply())
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+	return line
+}
+
+func (c *respClient) do(args ...string) string {
+	c.t.Helper()
+	c.send(args...)
+	return c.reply()
+}
+
+func TestRESP(t *testing.T) {
+	now := time.Now()
+	c := startRESP(t, func() time.Time { return now })
+	for _, step := range [][]string{
+		{"PING", "+PONG"},
+		{"ping hi", "hi"},
+		{"GET k", "(nil)"},
+		{"SET k v", "+OK"},
+		{"GET k", "v"},
+		{"SET k v2 NX", "(nil)"},
+		{"SET k2 x XX", "(nil)"},
+		{"SET k2 x NX", "+OK"},
+		{"MGET k nope k2", "[v (nil) x]"},
+		{"DEL k k2 nope", ":2"},
+		{"EXPIRE k 10", ":0"},
+		{"SET k v EX 10", "+OK"},
+		{"SET k2 v PX 1500", "+OK"},
+		{"SET k3 v", "+OK"},
+		{"EXPIRE k3 0", ":1"},
+		{"GET k3", "(nil)"},
+		{"SET k v EX 0", "-ERR invalid expire time in 'set' command"},
+		{"SET k v EX", "-ERR syntax error"},
+		{"SET k v NX XX", "-ERR syntax error"},
+		{"GET", "-ERR wrong number of arguments for 'get' command"},
+		{"NOPE", "-ERR unknown command 'NOPE'"},
+	} {
+		got := c.do(strings.Fields(step[0])...)
+		want := step[1]
+		if got != want {
+			t.Fatalf("%s = %q; want %q", step[0], got, want)
+		}
+	}
+
+	now = now.Add(2 * time.Second)
+	if got := c.do("MGET", "k", "k2"); got != "[v (nil)]" {
+		t.Fatalf("after 2s MGET k k2 = %q", got)
+	}
+	if got := c.do("EXPIRE", "k", "60"); got != ":1" {
+		t.Fatalf("EXPIRE k 60 = %q", got)
+	}
+	now = now.Add(30 * time.Second)
+	if got := c.do("GET", "k"); got != "v" {
+		t.Fatalf("GET k after EXPIRE = %q", got)
+	}
+
+	// binary-safe values and inline commands
+	if got := c.do("SET", "bin", "a b\r\nc"); got != "+OK" {
+		t.Fatal(got)
+	}
+	if got := c.do("GET", "bin"); got != "a b\r\nc" {
+		t.Fatalf("GET bin = %q", got)
+	}
+	c.conn.Write([]byte("GET k\r\n"))
+	if got := c.reply(); got != "v" {
+		t.Fatalf("inline GET k = %q", got)
+	}
+
+	// pipelined requests
+	for i := 0; i < 100; i++ {
+		c.send("SET", fmt.Sprintf("p%03d", i), strconv.Itoa(i))
+	}
+	for i := 0; i < 100; i++ {
+		if got := c.reply(); got != "+OK" {
+			t.Fatalf("pipelined SET %d = %q", i, got)
+		}
+	}
+	if got := c.do("SET", strings.Repeat("x", RESP_MAX_KEY+1), "v"); !strings.HasPrefix(got, "-ERR") {
+		t.Fatalf("SET large key = %q", got)
+	}
+	if got := c.do("QUIT"); got != "+OK" {
+		t.Fatalf("QUIT = %q", got)
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Fatal("the connection is open after QUIT")
+	}
+}
+
+func TestRESPScan(t *testing.T) {
+	c := startRESP(t, nil)
+	want := map[string]bool{}
+	for i := 0; i < 250; i++ {
+		key := fmt.Sprintf("user:%03d", i)
+		c.do("SET", key, "x")
+		if i%10 == 3 {
+			want[key] = true
+		}
+		c.do("SET", fmt.Sprintf("item:%03d", i), "x")
+	}
+
+	got := map[string]bool{}
+	cursor, calls := "0", 0
+	for {
+		c.send("SCAN", cursor, "MATCH", "user:??3", "COUNT", "40")
+		// [cursor [keys...]]
+		line, _ := c.r.ReadString('\n')
+		if line != "*2\r\n" {
+			t.Fatalf("SCAN reply %q", line)
+		}
+		cursor = c.reply()
+		keys := strings.Trim(c.reply(), "[]")
+		for _, key := range strings.Fields(keys) {
+			if got[key] {
+				t.Fatalf("SCAN returned %s twice", key)
+			}
+			got[key] = true
+		}
+		calls++
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(got) != len(want) || calls != 13 {
+		t.Fatalf("SCAN found %d keys in %d calls; want %d in 13", len(got), calls, len(want))
+	}
+	for key := range want {
+		if !got[key] {
+			t.Fatalf("SCAN missed %s", key)
+		}
+	}
+	if got := c.do("SCAN", "12345"); got != "-ERR invalid cursor" {
+		t.Fatalf("SCAN with an unknown cursor = %q", got)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"*", "abc", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbb", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"h[ae]llo", "hello", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"[abc", "a", false},
+		{"*:*:*", "a:b:c", true},
+	} {
+		if got := globMatch([]byte(tc.pattern), []byte(tc.s)); got != tc.match {
+			t.Errorf("globMatch(%q, %q) = %v", tc.pattern, tc.s, got)
+		}
+	}
+}
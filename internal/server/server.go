@@ -0,0 +1,514 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"godb/internal/sql"
+	"godb/internal/storage/index/btree"
+	"godb/internal/wire"
+)
+
+// Server serves a KV store over TCP with the protocol of the wire package.
+// every connection is a session with at most one open transaction,
+// requests outside of a transaction are applied one by one. the
+// transaction of a closed connection is rolled back, see session.
+type Server struct {
+	DB  *btree.KV
+	TLS *tls.Config // plain TCP if nil
+	// clients must authenticate as one of the users, anyone is allowed if nil
+	Auth *Accounts
+	// connections idle for longer are closed, no limit if 0
+	IdleTimeout time.Duration
+	// the limit while a transaction is open, IdleTimeout if 0. the write
+	// transaction of an idle client blocks the other writers.
+	TxIdleTimeout time.Duration
+
+	listener
+}
+
+var ErrServerClosed = errors.New("server closed")
+
+// scans return at most this many pairs per request
+const MAX_SCAN = 1000
+
+// accepts connections until Close
+func (s *Server) Serve(ln net.Listener) error {
+	return s.serve(ln, s.TLS, s.serveConn)
+}
+
+// accepts connections and tracks them for Close, shared by the protocols
+type listener struct {
+	mu     sync.Mutex
+	ln     net.Listener
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// serves TLS connections if cfg is not nil
+func (l *listener) serve(ln net.Listener, cfg *tls.Config, handle func(conn net.Conn)) error {
+	ln, err := tlsListener(ln, cfg)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return ErrServerClosed
+	}
+	l.ln = ln
+	if l.conns == nil {
+		l.conns = map[net.Conn]struct{}{}
+	}
+	l.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return ErrServerClosed
+		}
+		if err != nil {
+			l.mu.Unlock()
+			return err
+		}
+		l.conns[conn] = struct{}{}
+		l.wg.Add(1)
+		l.mu.Unlock()
+		go func() {
+			defer l.wg.Done()
+			defer func() {
+				conn.Close()
+				l.mu.Lock()
+				delete(l.conns, conn)
+				l.mu.Unlock()
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+// stops accepting, closes the connections and waits for the sessions to end
+func (l *listener) Close() error {
+	l.mu.Lock()
+	var err error
+	if l.ln != nil && !l.closed {
+		err = l.ln.Close()
+	}
+	l.closed = true
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+	return err
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	sess := newSession(s.DB, s.Auth)
+	sess.addr = conn.RemoteAddr().String()
+	defer sess.close()
+
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		timeout := s.IdleTimeout
+		if sess.tx != nil && s.TxIdleTimeout > 0 {
+			timeout = s.TxIdleTimeout
+		}
+		if timeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		req, err := wire.ReadFrame(r)
+		if err != nil {
+			if errors.Is(err, wire.ErrProtocol) {
+				wire.WriteFrame(w, errorReply(err))
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				wire.WriteFrame(w, errorReply(ErrIdleTimeout))
+			}
+			return
+		}
+		if err := wire.WriteFrame(w, sess.handle(req)); err != nil {
+			return
+		}
+		if sess.watcher != nil {
+			sess.stream(conn, w)
+			return
+		}
+		if sess.replication != nil {
+			sess.ship(conn, w)
+			return
+		}
+		if sess.feed != nil {
+			sess.tail(conn, w)
+			return
+		}
+	}
+}
+
+func errorReply(err error) []byte {
+	return append([]byte{wire.STATUS_ERR}, err.Error()...)
+}
+
+func checkKey(key []byte) error {
+	if len(key) == 0 || len(key) > btree.BT_MAX_KEY_SIZE {
+		return fmt.Errorf("bad key size %d", len(key))
+	}
+	return nil
+}
+
+func boolReply(b bool) []byte {
+	if b {
+		return []byte{wire.STATUS_OK, 1}
+	}
+	return []byte{wire.STATUS_OK, 0}
+}
+
+// the response to the request
+func (sess *session) handle(req []byte) []byte {
+	r := wire.NewReader(req)
+	op := r.Byte()
+	if sess.auth != nil && sess.user == "" && op != wire.OP_AUTH {
+		return errorReply(errors.New("authentication required"))
+	}
+	reply, err := sess.exec(op, r)
+	if err != nil {
+		return errorReply(err)
+	}
+	return reply
+}
+
+func (sess *session) exec(op byte, r *wire.Reader) ([]byte, error) {
+	ok := []byte{wire.STATUS_OK}
+	switch op {
+	case wire.OP_GET:
+		key := r.Bytes()
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		if err := sess.auth.check(sess.user, sess.ns, PermRead); err != nil {
+			return nil, err
+		}
+		var val []byte
+		var found bool
+		err := sess.read(func(tx *btree.Tx) error {
+			ks, err := namespace(tx, sess.ns, false)
+			if err != nil {
+				return err
+			}
+			// the value is a view of the transaction, which ends with read
+			val, found = ks.Get(key)
+			val = bytes.Clone(val)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return []byte{wire.STATUS_NOT_FOUND}, nil
+		}
+		return append(ok, val...), nil
+	case wire.OP_SET:
+		key, val := r.Bytes(), r.Bytes()
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		if err := checkKey(key); err != nil {
+			return nil, err
+		}
+		if len(val) > btree.BT_MAX_VAL_SIZE {
+			return nil, fmt.Errorf("bad value size %d", len(val))
+		}
+		if err := sess.auth.check(sess.user, sess.ns, PermWrite); err != nil {
+			return nil, err
+		}
+		err := sess.write(func(tx *btree.Tx) error {
+			ks, err := namespace(tx, sess.ns, true)
+			if err != nil {
+				return err
+			}
+			return ks.Set(key, val)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return ok, nil
+	case wire.OP_DEL:
+		key := r.Bytes()
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		if err := checkKey(key); err != nil {
+			return nil, err
+		}
+		if err := sess.auth.check(sess.user, sess.ns, PermWrite); err != nil {
+			return nil, err
+		}
+		deleted := false
+		err := sess.write(func(tx *btree.Tx) error {
+			ks, err := namespace(tx, sess.ns, false)
+			if err != nil {
+				return err
+			}
+			deleted, err = ks.Del(key)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return boolReply(deleted), nil
+	case wire.OP_SCAN:
+		start, end, limit := r.Bytes(), r.Bytes(), r.Uint32()
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		if err := sess.auth.check(sess.user, sess.ns, PermRead); err != nil {
+			return nil, err
+		}
+		var reply []byte
+		err := sess.read(func(tx *btree.Tx) error {
+			ks, err := namespace(tx, sess.ns, false)
+			if err != nil {
+				return err
+			}
+			reply = scanReply(ks, start, end, int(limit))
+			return nil
+		})
+		return reply, err
+	case wire.OP_BEGIN:
+		writable := r.Byte()
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		if sess.tx != nil {
+			return nil, errors.New("transaction already open")
+		}
+		if writable != 0 {
+			sess.tx = sess.begin()
+		} else {
+			sess.tx = sess.db.BeginRead()
+		}
+		return ok, nil
+	case wire.OP_COMMIT, wire.OP_ROLLBACK:
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		if sess.tx == nil {
+			return nil, errors.New("no open transaction")
+		}
+		tx := sess.tx
+		sess.tx = nil
+		var err error
+		if op == wire.OP_COMMIT && tx.Writable() {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback() // the end of a read transaction
+		}
+		if err != nil {
+			return nil, err
+		}
+		return ok, nil
+	case wire.OP_AUTH:
+		name, password := r.Bytes(), r.Bytes()
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		if sess.auth == nil {
+			return nil, errors.New("authentication is not enabled")
+		}
+		u, err := sess.auth.Authenticate(string(name), string(password))
+		if err != nil {
+			return nil, err
+		}
+		sess.user = u.Name
+		return ok, nil
+	case wire.OP_USE:
+		ns := string(r.Bytes())
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		if err := checkNamespace(ns); err != nil {
+			return nil, err
+		}
+		if err := sess.auth.check(sess.user, ns, PermRead); err != nil {
+			return nil, err
+		}
+		sess.ns = ns
+		return ok, nil
+	case wire.OP_DROP:
+		ns := string(r.Bytes())
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		if err := checkNamespace(ns); err != nil {
+			return nil, err
+		}
+		if ns == ROOT_NAMESPACE {
+			return nil, fmt.Errorf("%w: the main keyspace can't be dropped", ErrNamespace)
+		}
+		if err := sess.auth.check(sess.user, ns, PermAdmin); err != nil {
+			return nil, err
+		}
+		dropped := false
+		err := sess.write(func(tx *btree.Tx) error {
+			if tx.Bucket([]byte(ns)) == nil {
+				return nil
+			}
+			dropped = true
+			return tx.DeleteBucket([]byte(ns))
+		})
+		if err != nil {
+			return nil, err
+		}
+		return boolReply(dropped), nil
+	case wire.OP_USER_SET:
+		name, password, n := r.Bytes(), r.Bytes(), r.Uint32()
+		var rules []Rule
+		for i := uint32(0); i < n && r.Err() == nil; i++ {
+			rule, err := ParseRule(string(r.Bytes()))
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		}
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		if err := sess.checkUsers(); err != nil {
+			return nil, err
+		}
+		if err := sess.auth.Set(string(name), string(password), rules); err != nil {
+			return nil, err
+		}
+		return ok, nil
+	case wire.OP_USER_DEL:
+		name := r.Bytes()
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		if err := sess.checkUsers(); err != nil {
+			return nil, err
+		}
+		deleted, err := sess.auth.Delete(string(name))
+		if err != nil {
+			return nil, err
+		}
+		return boolReply(deleted), nil
+	case wire.OP_QUERY:
+		src, args := r.Bytes(), r.Bytes()
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		stmt, err := sql.Parse(string(src))
+		if err != nil {
+			return nil, err
+		}
+		return sess.query(string(src), stmt, args)
+	case wire.OP_PREPARE:
+		src := r.Bytes()
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		id, nparams, err := sess.prepare(string(src))
+		if err != nil {
+			return nil, err
+		}
+		return wire.AppendUint32(wire.AppendUint32(ok, id), uint32(nparams)), nil
+	case wire.OP_EXECUTE:
+		id, args := r.Uint32(), r.Bytes()
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		p, found := sess.stmts[id]
+		if !found {
+			return nil, fmt.Errorf("no prepared statement %d", id)
+		}
+		return sess.query(p.src, p.stmt, args)
+	case wire.OP_CLOSE_STMT:
+		id := r.Uint32()
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		_, found := sess.stmts[id]
+		delete(sess.stmts, id)
+		return boolReply(found), nil
+	case wire.OP_SET_OPTION:
+		name, value := r.Bytes(), r.Bytes()
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		if err := sess.setOption(string(name), string(value)); err != nil {
+			return nil, err
+		}
+		return ok, nil
+	case wire.OP_WATCH:
+		start, end := r.Bytes(), r.Bytes()
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		if err := sess.startWatch(start, end); err != nil {
+			return nil, err
+		}
+		return ok, nil
+	case wire.OP_REPLICATE:
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		if err := sess.startReplication(); err != nil {
+			return nil, err
+		}
+		return ok, nil
+	case wire.OP_CHANGES:
+		from := r.Uint64()
+		if err := r.Done(); err != nil {
+			return nil, err
+		}
+		if err := sess.startFeed(from); err != nil {
+			return nil, err
+		}
+		return ok, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown op %d", wire.ErrProtocol, op)
+	}
+}
+
+// up to `limit` pairs in [start, end) and whether there are more,
+// the response stays well under the frame limit
+func scanReply(ks keyspace, start, end []byte, limit int) []byte {
+	if limit <= 0 || limit > MAX_SCAN {
+		limit = MAX_SCAN
+	}
+	if len(end) == 0 {
+		end = nil
+	}
+	var pairs []byte
+	n, more := 0, false
+	ks.Scan(start, end, func(key, val []byte) bool {
+		if n == limit || len(pairs) > wire.MAX_FRAME/2 {
+			more = true
+			return false
+		}
+		pairs = wire.AppendBytes(pairs, key)
+		pairs = wire.AppendBytes(pairs, val)
+		n++
+		return true
+	})
+	out := []byte{wire.STATUS_OK, 0}
+	if more {
+		out[1] = 1
+	}
+	out = wire.AppendUint32(out, uint32(n))
+	return append(out, pairs...)
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"godb/client"
+	"godb/internal/storage/index/btree"
+	"godb/internal/wire"
+)
+
+// a server on a random port and its address
+func startServer(t *testing.T) string {
+	t.Helper()
+	return startServerWith(t, func(srv *Server) {})
+}
+
+// a server configured by `configure`, its values kept after a transaction
+// are poisoned
+func startServerWith(t *testing.T, configure func(srv *Server)) string {
+	t.Helper()
+	db := &btree.KV{Path: filepath.Join(t.TempDir(), "test.db"), PoisonViews: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{DB: db}
+	configure(srv)
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+	t.Cleanup(func() {
+		srv.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve() = %v", err)
+		}
+		db.Close()
+	})
+	return ln.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *client.Client {
+	t.Helper()
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestServer(t *testing.T) {
+	c := dial(t, startServer(t))
+	for i := 0; i < 2500; i++ {
+		if err := c.Set([]byte(fmt.Sprintf("key_%04d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	val, ok, err := c.Get([]byte("key_0042"))
+	if err != nil || !ok || string(val) != "42" {
+		t.Fatalf("Get(key_0042) = %q, %v, %v", val, ok, err)
+	}
+	if _, ok, err := c.Get([]byte("nope")); ok || err != nil {
+		t.Fatalf("Get(nope) = %v, %v", ok, err)
+	}
+	if ok, err := c.Del([]byte("key_0042")); !ok || err != nil {
+		t.Fatalf("Del(key_0042) = %v, %v", ok, err)
+	}
+	if ok, err := c.Del([]byte("key_0042")); ok || err != nil {
+		t.Fatalf("Del(key_0042) again = %v, %v", ok, err)
+	}
+
+	// more than one batch
+	n, prev := 0, ""
+	err = c.Scan([]byte("key_0010"), nil, func(key, val []byte) bool {
+		if string(key) <= prev {
+			t.Fatalf("Scan: %s after %s", key, prev)
+		}
+		prev = string(key)
+		n++
+		return true
+	})
+	if err != nil || n != 2489 {
+		t.Fatalf("Scan(key_0010, nil) = %d keys, %v; want 2489", n, err)
+	}
+	n = 0
+	c.Scan([]byte("key_0100"), []byte("key_0200"), func(key, val []byte) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("Scan stopped after %d keys; want 10", n)
+	}
+
+	if err := c.Set(nil, []byte("x")); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("Set(empty key) = %v; want ErrServer", err)
+	}
+	if err := c.Set(make([]byte, btree.BT_MAX_KEY_SIZE+1), nil); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("Set(large key) = %v; want ErrServer", err)
+	}
+	if err := c.Commit(); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("Commit() without Begin = %v; want ErrServer", err)
+	}
+}
+
+func TestServerTx(t *testing.T) {
+	addr := startServer(t)
+	a, b := dial(t, addr), dial(t, addr)
+	a.Set([]byte("k"), []byte("v0"))
+
+	// a reader keeps its snapshot
+	if err := b.Begin(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Begin(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Begin(true); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("nested Begin() = %v; want ErrServer", err)
+	}
+	a.Set([]byte("k"), []byte("v1"))
+	a.Set([]byte("k2"), []byte("x"))
+	if val, _, _ := a.Get([]byte("k")); string(val) != "v1" {
+		t.Fatalf("writer Get(k) = %q; want v1", val)
+	}
+	if err := a.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := b.Get([]byte("k")); string(val) != "v0" {
+		t.Fatalf("reader Get(k) = %q; want v0", val)
+	}
+	if err := b.Set([]byte("k"), []byte("v2")); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("Set() in a read transaction = %v; want ErrServer", err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := b.Get([]byte("k")); string(val) != "v1" {
+		t.Fatalf("Get(k) after the reader = %q; want v1", val)
+	}
+
+	// rollback, and a dropped connection rolls back
+	a.Begin(true)
+	a.Set([]byte("k"), []byte("lost"))
+	if err := a.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t, addr)
+	c.Begin(true)
+	c.Set([]byte("k"), []byte("lost"))
+	c.Close()
+	if val, _, err := b.Get([]byte("k")); err != nil || string(val) != "v1" {
+		t.Fatalf("Get(k) = %q, %v; want v1", val, err)
+	}
+}
+
+func TestServerBadFrames(t *testing.T) {
+	addr := startServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for _, req := range [][]byte{
+		{99},
+		{wire.OP_GET, 0, 0, 0, 9, 'x'},
+		{wire.OP_COMMIT, 1},
+	} {
+		if err := wire.WriteFrame(w, req); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := wire.ReadFrame(r)
+		if err != nil || resp[0] != wire.STATUS_ERR {
+			t.Fatalf("request %v: %q, %v; want an error", req, resp, err)
+		}
+	}
+	// a bad frame closes the connection
+	w.Write([]byte{0, 0, 0, 0})
+	w.Flush()
+	if resp, err := wire.ReadFrame(r); err != nil || resp[0] != wire.STATUS_ERR {
+		t.Fatalf("empty frame: %q, %v", resp, err)
+	}
+	if _, err := wire.ReadFrame(r); err == nil {
+		t.Fatal("the connection is open after a bad frame")
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"godb/internal/sql"
+	"godb/internal/storage/index/btree"
+	"godb/internal/table"
+	"godb/internal/wire"
+)
+
+// A session is the state of a connection of the wire protocol: the user
+// and the namespace, the open transaction, the prepared statements and
+// the options. the transaction of a session is rolled back when the
+// session ends, a dropped or idle connection never keeps the writer.
+//
+// the isolation option applies to read transactions: with snapshot every
+// read sees the version of BEGIN, with read_committed every request sees
+// the latest commit. the write transaction is the only writer, it always
+// sees the latest version and its own updates.
+type session struct {
+	db   *btree.KV
+	auth *Accounts
+	user string
+	addr string // of the client, for the audit log
+	ns   string // the namespace of the requests
+	tx   *btree.Tx
+
+	readCommitted bool
+	stmts         map[uint32]prepared // prepared statements by id
+	nextStmt      uint32
+	watcher       *btree.Watcher     // the connection streams its changes, see stream
+	replication   *btree.Replication // the connection ships the database, see ship
+	feed          *btree.Feed        // the connection tails the changefeed, see tail
+}
+
+var ErrIdleTimeout = errors.New("idle session timeout")
+
+const (
+	ISOLATION_SNAPSHOT       = "snapshot"
+	ISOLATION_READ_COMMITTED = "read_committed"
+)
+
+// prepared statements per session
+const MAX_STATEMENTS = 1000
+
+func newSession(db *btree.KV, auth *Accounts) *session {
+	return &session{db: db, auth: auth, ns: ROOT_NAMESPACE, stmts: map[uint32]prepared{}}
+}
+
+// a prepared statement and its source for the audit log
+type prepared struct {
+	src  string
+	stmt sql.Stmt
+}
+
+// the client of a connection in the audit log, user@address or the address
+// without authentication
+func clientName(user, addr string) string {
+	if user == "" {
+		return addr
+	}
+	return user + "@" + addr
+}
+
+// begins a write transaction of the session's client
+func (sess *session) begin() *btree.Tx {
+	tx := sess.db.Begin()
+	tx.SetClient(clientName(sess.user, sess.addr))
+	return tx
+}
+
+// ends the session, rolls back the open transaction
+func (sess *session) close() {
+	if sess.tx != nil {
+		sess.tx.Rollback()
+		sess.tx = nil
+	}
+	clear(sess.stmts)
+}
+
+// runs `fn` in the open transaction or in a read transaction of its own,
+// a read transaction is not used with read_committed
+func (sess *session) read(fn func(tx *btree.Tx) error) error {
+	if sess.tx != nil && (sess.tx.Writable() || !sess.readCommitted) {
+		return fn(sess.tx)
+	}
+	tx := sess.db.BeginRead()
+	defer tx.Rollback()
+	return fn(tx)
+}
+
+// runs `fn` in the open transaction or commits a write transaction of its own
+func (sess *session) write(fn func(tx *btree.Tx) error) error {
+	if sess.tx != nil {
+		return fn(sess.tx)
+	}
+	tx := sess.begin()
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// users are changed in transactions of their own, an open write
+// transaction of the session would wait for itself
+func (sess *session) checkUsers() error {
+	if sess.tx != nil {
+		return errors.New("users can't be changed in a transaction")
+	}
+	return sess.auth.checkAdmin(sess.user)
+}
+
+func (sess *session) setOption(name, value string) error {
+	switch name {
+	case "isolation":
+		switch value {
+		case ISOLATION_SNAPSHOT:
+			sess.readCommitted = false
+		case ISOLATION_READ_COMMITTED:
+			sess.readCommitted = true
+		default:
+			return fmt.Errorf("unknown isolation %q", value)
+		}
+	default:
+		return fmt.Errorf("unknown option %q", name)
+	}
+	return nil
+}
+
+// parses the statement for execute, returns its id and number of parameters
+func (sess *session) prepare(src string) (uint32, int, error) {
+	if len(sess.stmts) >= MAX_STATEMENTS {
+		return 0, 0, fmt.Errorf("more than %d prepared statements", MAX_STATEMENTS)
+	}
+	stmt, err := sql.Parse(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	sess.nextStmt++
+	sess.stmts[sess.nextStmt] = prepared{src, stmt}
+	return sess.nextStmt, sql.NumParams(stmt), nil
+}
+
+// runs the statement with the arguments, a row in the format of
+// table.EncodeRow. SELECT reads like GET, the others write like SET and
+// are recorded in the audit log.
+func (sess *session) query(src string, stmt sql.Stmt, args []byte) ([]byte, error) {
+	vals, err := table.DecodeRow(args)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad arguments: %v", wire.ErrProtocol, err)
+	}
+	bound, err := sql.Bind(stmt, vals)
+	if err != nil {
+		return nil, err
+	}
+	if sess.ns != ROOT_NAMESPACE {
+		return nil, fmt.Errorf("%w: SQL runs in the main keyspace", ErrNamespace)
+	}
+	_, isSelect := bound.(*sql.Select)
+	perm := PermWrite
+	if isSelect {
+		perm = PermRead
+	}
+	if err := sess.auth.check(sess.user, ROOT_NAMESPACE, perm); err != nil {
+		return nil, err
+	}
+	var reply []byte
+	run := func(tx *btree.Tx) error {
+		if !isSelect {
+			tx.AddStatement(src)
+		}
+		res, err := sql.Execute(table.NewTx(tx), bound)
+		if err != nil {
+			return err
+		}
+		reply, err = resultReply(res)
+		return err
+	}
+	if isSelect {
+		err = sess.read(run)
+	} else {
+		err = sess.write(run)
+	}
+	return reply, err
+}
+
+// the result of a statement, the rows of SELECT are read before the
+// transaction ends and must fit in a frame
+func resultReply(res *sql.Result) ([]byte, error) {
+	out := wire.AppendUint32([]byte{wire.STATUS_OK}, uint32(res.Affected))
+	if res.Rows == nil {
+		out = wire.AppendUint32(out, 0)
+		return wire.AppendUint32(out, 0), nil
+	}
+	defer res.Rows.Close()
+	cols := res.Rows.Columns()
+	out = wire.AppendUint32(out, uint32(len(cols)))
+	for _, col := range cols {
+		out = wire.AppendBytes(out, []byte(col))
+	}
+	var rows []byte
+	n := 0
+	for res.Rows.Next() {
+		rows = wire.AppendBytes(rows, table.EncodeRow(nil, res.Rows.Row()))
+		n++
+		if len(rows) > wire.MAX_FRAME/2 {
+			return nil, errors.New("the result is too large, use LIMIT")
+		}
+	}
+	if err := res.Rows.Err(); err != nil {
+		return nil, err
+	}
+	out = wire.AppendUint32(out, uint32(n))
+	return append(out, rows...), nil
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"godb/client"
+	"godb/internal/storage/index/btree"
+	"godb/internal/table"
+)
+
+// the rows of the result, one row per line, values separated by spaces
+func rowsText(res *client.Result) string {
+	var lines []string
+	for _, row := range res.Rows {
+		var vals []string
+		for _, v := range row {
+			vals = append(vals, v.String())
+		}
+		lines = append(lines, strings.Join(vals, " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestSessionSQL(t *testing.T) {
+	addr := startServer(t)
+	a, b := dial(t, addr), dial(t, addr)
+	if _, err := a.Query("CREATE TABLE t (id INT, name STRING)"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := a.Query("INSERT INTO t VALUES (1, 'ann'), (?, ?)", table.Int64(2), table.String("bob"))
+	if err != nil || res.Affected != 2 {
+		t.Fatalf("INSERT = %v, %v", res, err)
+	}
+
+	stmt, err := b.Prepare("SELECT id, name FROM t WHERE id >= ? ORDER BY id DESC")
+	if err != nil || stmt.NumParams != 1 {
+		t.Fatalf("Prepare() = %v, %v", stmt, err)
+	}
+	res, err = stmt.Exec(table.Int64(1))
+	if err != nil || strings.Join(res.Columns, ",") != "id,name" || rowsText(res) != "2 bob\n1 ann" {
+		t.Fatalf("Exec(1) = %v, %v", res, err)
+	}
+	if _, err := stmt.Exec(); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("Exec() without arguments = %v", err)
+	}
+
+	// statements run in the transaction of the session
+	a.Begin(true)
+	a.Query("UPDATE t SET name = 'cat' WHERE id = 1")
+	if res, _ := b.Query("SELECT name FROM t WHERE id = 1"); rowsText(res) != "ann" {
+		t.Fatalf("uncommitted update is visible: %q", rowsText(res))
+	}
+	if err := a.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := stmt.Exec(table.Int64(1)); rowsText(res) != "2 bob\n1 cat" {
+		t.Fatalf("after commit: %q", rowsText(res))
+	}
+
+	// statements belong to the session
+	if err := stmt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stmt.Exec(table.Int64(1)); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("Exec() after Close = %v", err)
+	}
+	if _, err := a.Query("SELEC 1"); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("Query() with a syntax error = %v", err)
+	}
+	b.Use("ns")
+	if _, err := b.Query("SELECT * FROM t"); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("Query() in a bucket = %v", err)
+	}
+}
+
+func TestSessionIsolation(t *testing.T) {
+	addr := startServer(t)
+	a, b := dial(t, addr), dial(t, addr)
+	a.Set([]byte("k"), []byte("v0"))
+	if err := b.SetOption("isolation", "dirty"); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("SetOption(dirty) = %v", err)
+	}
+
+	b.Begin(false)
+	a.Set([]byte("k"), []byte("v1"))
+	if val, _, _ := b.Get([]byte("k")); string(val) != "v0" {
+		t.Fatalf("snapshot Get(k) = %q; want v0", val)
+	}
+	if err := b.SetOption("isolation", ISOLATION_READ_COMMITTED); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := b.Get([]byte("k")); string(val) != "v1" {
+		t.Fatalf("read_committed Get(k) = %q; want v1", val)
+	}
+	b.Commit()
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	addr := startServerWith(t, func(srv *Server) {
+		srv.IdleTimeout = time.Minute
+		srv.TxIdleTimeout = 50 * time.Millisecond
+	})
+	a, b := dial(t, addr), dial(t, addr)
+
+	// idle outside of a transaction
+	time.Sleep(100 * time.Millisecond)
+	if err := a.Set([]byte("k"), []byte("v0")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the idle writer is dropped and rolled back, the next writer proceeds
+	a.Begin(true)
+	a.Set([]byte("k"), []byte("lost"))
+	time.Sleep(100 * time.Millisecond)
+	if err := b.Set([]byte("k"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Commit(); err == nil || !strings.Contains(err.Error(), ErrIdleTimeout.Error()) {
+		t.Fatalf("Commit() after the timeout = %v", err)
+	}
+	if val, _, _ := b.Get([]byte("k")); string(val) != "v1" {
+		t.Fatalf("Get(k) = %q; want v1", val)
+	}
+}
+
+func TestSessionAudit(t *testing.T) {
+	var audit *btree.AuditLog
+	addr := startServerWith(t, func(srv *Server) {
+		// the audit log is opened by Open
+		srv.DB.Close()
+		audit = &btree.AuditLog{Path: srv.DB.Path + ".audit"}
+		srv.DB.Audit = audit
+		if err := srv.DB.Open(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	c := dial(t, addr)
+	c.Set([]byte("k"), []byte("v"))
+	c.Query("CREATE TABLE t (id INT, name STRING)")
+	stmt, _ := c.Prepare("INSERT INTO t VALUES (?, 'ann')")
+	c.Begin(true)
+	stmt.Exec(table.Int64(1))
+	c.Query("SELECT id FROM t")
+	c.Commit()
+
+	data, err := os.ReadFile(audit.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("audit log:\n%s", data)
+	}
+	var records []btree.AuditRecord
+	for _, line := range lines {
+		var r btree.AuditRecord
+		json.Unmarshal([]byte(line), &r)
+		if !strings.HasPrefix(r.Client, "127.0.0.1:") {
+			t.Fatalf("client of %s", line)
+		}
+		records = append(records, r)
+	}
+	if records[0].Changes[0].Key != "k" || records[0].Statements != nil {
+		t.Fatalf("SET recorded as %s", lines[0])
+	}
+	if s := records[2].Statements; len(s) != 1 || s[0] != "INSERT INTO t VALUES (?, 'ann')" {
+		t.Fatalf("the transaction recorded as %s", lines[2])
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"godb/api/godbpb"
+	"godb/client"
+	"godb/internal/storage/index/btree"
+	"godb/internal/wire"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "godb test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert, key, pool, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// a certificate for 127.0.0.1 signed by the CA, as PEM
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) clientConfig(t *testing.T, alpn ...string) *tls.Config {
+	t.Helper()
+	cert, err := tls.X509KeyPair(ca.issue(t, "client", x509.ExtKeyUsageClientAuth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{cert}, NextProtos: alpn}
+}
+
+// the server config from files, clients need a certificate of the CA
+func serverTLS(t *testing.T, ca *testCA) *tls.Config {
+	t.Helper()
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	files := map[string][]byte{"cert.pem": certPEM, "key.pem": keyPEM, "ca.pem": ca.pem}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg, err := LoadTLSConfig(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem"), []string{"godb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t)
+	cfg := serverTLS(t, ca)
+	db := &btree.KV{Path: filepath.Join(t.TempDir(), "test.db"), PoisonViews: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() }) // after the servers
+
+	start := func(srv testServer) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- srv.Serve(ln) }()
+		t.Cleanup(func() {
+			srv.Close()
+			if err := <-done; !errors.Is(err, ErrServerClosed) {
+				t.Errorf("Serve() = %v", err)
+			}
+		})
+		return ln.Addr().String()
+	}
+
+	addr := start(&Server{DB: db, TLS: cfg})
+	c, err := client.DialTLS(addr, ca.clientConfig(t, "godb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := tls.Dial("tcp", addr, ca.clientConfig(t, "godb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto := raw.ConnectionState().NegotiatedProtocol; proto != "godb" {
+		t.Fatalf("ALPN = %q; want godb", proto)
+	}
+	raw.Close()
+
+	// without a client certificate, or a plain connection
+	bad, err := client.DialTLS(addr, &tls.Config{RootCAs: ca.pool})
+	if err == nil {
+		_, _, err = bad.Get([]byte("k"))
+		bad.Close()
+	}
+	if err == nil {
+		t.Fatal("a client without a certificate was served")
+	}
+	plain, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.SetDeadline(time.Now().Add(5 * time.Second))
+	w := bufio.NewWriter(plain)
+	wire.WriteFrame(w, wire.AppendBytes([]byte{wire.OP_GET}, []byte("k")))
+	if resp, err := wire.ReadFrame(bufio.NewReader(plain)); err == nil {
+		t.Fatalf("a plain connection was served: %q", resp)
+	}
+	plain.Close()
+
+	// RESP
+	addr = start(&RESPServer{DB: db, TLS: cfg})
+	conn, err := tls.Dial("tcp", addr, ca.clientConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PING\r\n"))
+	buf := make([]byte, 7)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "+PONG\r\n" {
+		t.Fatalf("RESP PING = %q, %v", buf, err)
+	}
+
+	// gRPC negotiates h2 with the same config
+	addr = start(&GRPCServer{DB: db, TLS: cfg})
+	gconn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(credentials.NewTLS(ca.clientConfig(t))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gconn.Close()
+	got, err := godbpb.NewKVClient(gconn).Get(context.Background(), &godbpb.GetRequest{Key: []byte("k")})
+	if err != nil || string(got.Value) != "v" {
+		t.Fatalf("gRPC Get(k) = %v, %v", got, err)
+	}
+
+	if err := (&Server{DB: db, TLS: &tls.Config{}}).Serve(nil); !errors.Is(err, errNoCertificate) {
+		t.Fatalf("Serve() without a certificate = %v", err)
+	}
+}
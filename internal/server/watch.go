@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"godb/internal/storage/index/btree"
+	"godb/internal/wire"
+)
+
+// Watches stream the committed changes of a range of a namespace, see
+// btree.Watch. the permission to read the namespace is checked when the
+// watch starts. a connection of the wire protocol that starts a watch
+// only receives changes afterwards, the client ends it by closing the
+// connection.
+
+// watches [start, end) of the namespace, empty `end` is the last key
+func watch(db *btree.KV, ns string, start, end []byte) *btree.Watcher {
+	var bucket []byte
+	if ns != ROOT_NAMESPACE {
+		bucket = []byte(ns)
+	}
+	if len(end) == 0 {
+		end = nil
+	}
+	return db.Watch(bucket, start, end)
+}
+
+func (sess *session) startWatch(start, end []byte) error {
+	if sess.tx != nil {
+		return errors.New("can't watch in a transaction")
+	}
+	if err := sess.auth.check(sess.user, sess.ns, PermRead); err != nil {
+		return err
+	}
+	sess.watcher = watch(sess.db, sess.ns, start, end)
+	return nil
+}
+
+// sends the changes until the client goes away or the watcher ends
+func (sess *session) stream(conn net.Conn, w *bufio.Writer) {
+	watcher := sess.watcher
+	defer watcher.Close()
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		// the client sends nothing more, the read ends when it goes away
+		io.Copy(io.Discard, conn)
+		watcher.Close()
+	}()
+	for c := range watcher.C {
+		if err := wire.WriteFrame(w, changeReply(c)); err != nil {
+			return
+		}
+	}
+	if err := watcher.Err(); !errors.Is(err, btree.ErrWatchClosed) {
+		wire.WriteFrame(w, errorReply(err))
+	}
+}
+
+func changeReply(c btree.Change) []byte {
+	out := wire.AppendUint64([]byte{wire.STATUS_OK}, c.Seq)
+	flags := byte(0)
+	if c.Old != nil {
+		flags |= wire.CHANGE_OLD
+	}
+	if c.New != nil {
+		flags |= wire.CHANGE_NEW
+	}
+	out = append(out, flags)
+	out = wire.AppendBytes(out, c.Key)
+	out = wire.AppendBytes(out, c.Old)
+	return wire.AppendBytes(out, c.New)
+}
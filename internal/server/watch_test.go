@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"godb/api/godbpb"
+	"godb/client"
+	"godb/internal/storage/index/btree"
+)
+
+func nextClientChange(t *testing.T, w *client.Watcher) string {
+	t.Helper()
+	select {
+	case c, ok := <-w.C:
+		if !ok {
+			t.Fatalf("watch ended: %v", w.Err())
+		}
+		return fmt.Sprintf("%s %q %q", c.Key, c.Old, c.New)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change")
+	}
+	return ""
+}
+
+func TestWatch(t *testing.T) {
+	addr := startServer(t)
+	c, wc := dial(t, addr), dial(t, addr)
+	c.Set([]byte("a"), []byte("0"))
+	wc.Use("ns")
+	w, err := wc.Watch([]byte("a"), []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	c.Use("ns")
+	c.Set([]byte("a"), []byte("1"))
+	c.Begin(true)
+	c.Set([]byte("a1"), []byte("2"))
+	c.Set([]byte("b"), []byte("out of range"))
+	c.Del([]byte("a"))
+	c.Commit()
+	c.Use("/")
+	c.Set([]byte("a"), []byte("main keyspace"))
+	c.Use("ns")
+	c.Set([]byte("a"), nil)
+
+	for _, want := range []string{
+		`a "" "1"`,
+		`a1 "" "2"`,
+		`a "1" ""`,
+		`a "" ""`,
+	} {
+		if got := nextClientChange(t, w); got != want {
+			t.Fatalf("change = %s; want %s", got, want)
+		}
+	}
+
+	// a watching connection serves nothing else, closing it ends the watch
+	if _, err := wc.Watch(nil, nil); err != client.ErrWatching {
+		t.Fatalf("a second request on a watching connection = %v", err)
+	}
+	w.Close()
+	if _, ok := <-w.C; ok || w.Err() != nil {
+		t.Fatalf("after Close: %v", w.Err())
+	}
+
+	c.Begin(false)
+	if _, err := c.Watch(nil, nil); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("Watch() in a transaction = %v", err)
+	}
+}
+
+func TestGRPCWatch(t *testing.T) {
+	db := &btree.KV{Path: filepath.Join(t.TempDir(), "test.db"), PoisonViews: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &GRPCServer{DB: db}
+	go srv.Serve(ln)
+	defer srv.Close()
+	conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	kv := godbpb.NewKVClient(conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := kv.Watch(ctx, &godbpb.WatchRequest{Start: []byte("k")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		kv.Put(ctx, &godbpb.PutRequest{Key: []byte("k"), Value: []byte(fmt.Sprint(i))})
+		c, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(c.Key) != "k" || string(c.New) != fmt.Sprint(i) {
+			t.Fatalf("change = %v", c)
+		}
+		if i > 0 && (string(c.Old) != fmt.Sprint(i-1) || c.Seq != 1+uint64(i)) {
+			t.Fatalf("change = %v", c)
+		}
+		if i == 2 {
+			break
+		}
+	}
+	kv.Delete(ctx, &godbpb.DeleteRequest{Key: []byte("k")})
+	if c, err := stream.Recv(); err != nil || c.New != nil || string(c.Old) != "2" {
+		t.Fatalf("delete = %v, %v", c, err)
+	}
+}
@@ -0,0 +1,515 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"godb/internal/table"
+)
+
+// Aggregation is hashed: rows are grouped in memory by the encoded GROUP BY
+// values. every group holds the states of the aggregates, when the groups
+// take more than SortBuffer bytes they are handed to a sorter as partial
+// groups and the table starts over. at the end the sorted partial groups
+// of a key are merged.
+//
+// the output has a column for every GROUP BY expression and aggregate,
+// the SELECT and ORDER BY expressions are rewritten to use them:
+//
+//	SELECT a + 1, SUM(b) * 2 FROM t GROUP BY a   ->   #g0 + 1, #a0 * 2
+//
+// COUNT(*) without GROUP BY is counted from the keys of the range when
+// every condition of WHERE is a bound of the range.
+
+var (
+	ErrAggregate = errors.New("bad use of an aggregate")
+	ErrFunction  = errors.New("unknown function")
+)
+
+var aggregates = map[string]bool{"COUNT": true, "SUM": true, "AVG": true, "MIN": true, "MAX": true}
+
+func hasAggregate(e Expr) bool {
+	switch e := e.(type) {
+	case *ExprCall:
+		return true
+	case *ExprUnary:
+		return hasAggregate(e.X)
+	case *ExprIsNull:
+		return hasAggregate(e.X)
+	case *ExprBinary:
+		return hasAggregate(e.L) || hasAggregate(e.R)
+	}
+	return false
+}
+
+func isAggregate(stmt *Select) bool {
+	if len(stmt.GroupBy) > 0 {
+		return true
+	}
+	for _, item := range stmt.Exprs {
+		if hasAggregate(item.Expr) {
+			return true
+		}
+	}
+	for _, item := range stmt.OrderBy {
+		if hasAggregate(item.Expr) {
+			return true
+		}
+	}
+	return false
+}
+
+// a copy of `e` with subexpressions replaced by `fn`
+func rewrite(e Expr, fn func(e Expr) (Expr, bool)) Expr {
+	if out, ok := fn(e); ok {
+		return out
+	}
+	switch e := e.(type) {
+	case *ExprUnary:
+		return &ExprUnary{Op: e.Op, X: rewrite(e.X, fn)}
+	case *ExprIsNull:
+		return &ExprIsNull{X: rewrite(e.X, fn), Not: e.Not}
+	case *ExprBinary:
+		return &ExprBinary{Op: e.Op, L: rewrite(e.L, fn), R: rewrite(e.R, fn)}
+	case *ExprCall:
+		args := make([]Expr, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = rewrite(arg, fn)
+		}
+		return &ExprCall{Name: e.Name, Args: args, Star: e.Star}
+	}
+	return e
+}
+
+// the aggregation of a SELECT
+type aggPlan struct {
+	groups []Expr
+	aggs   []*ExprCall
+}
+
+func (p *aggPlan) columns() []string {
+	var cols []string
+	for i := range p.groups {
+		cols = append(cols, fmt.Sprintf("#g%d", i))
+	}
+	for i := range p.aggs {
+		cols = append(cols, fmt.Sprintf("#a%d", i))
+	}
+	return cols
+}
+
+func (p *aggPlan) checkCall(call *ExprCall, tdef *table.TableDef) error {
+	if !aggregates[call.Name] {
+		return fmt.Errorf("%w: %s", ErrFunction, call.Name)
+	}
+	if call.Star && call.Name != "COUNT" || !call.Star && len(call.Args) != 1 {
+		return fmt.Errorf("%w: %s takes one argument", ErrAggregate, call.Name)
+	}
+	for _, arg := range call.Args {
+		if hasAggregate(arg) {
+			return fmt.Errorf("%w: nested in %s", ErrAggregate, call.Name)
+		}
+		if err := checkColumns(arg, tdef.Cols); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// an expression over the output of the aggregation
+func (p *aggPlan) output(e Expr, tdef *table.TableDef) (Expr, error) {
+	var err error
+	out := rewrite(e, func(e Expr) (Expr, bool) {
+		for i, g := range p.groups {
+			if reflect.DeepEqual(e, g) {
+				return &ExprCol{Name: fmt.Sprintf("#g%d", i)}, true
+			}
+		}
+		switch e := e.(type) {
+		case *ExprCall:
+			if err == nil {
+				err = p.checkCall(e, tdef)
+			}
+			for i, call := range p.aggs {
+				if reflect.DeepEqual(e, call) {
+					return &ExprCol{Name: fmt.Sprintf("#a%d", i)}, true
+				}
+			}
+			p.aggs = append(p.aggs, e)
+			return &ExprCol{Name: fmt.Sprintf("#a%d", len(p.aggs)-1)}, true
+		case *ExprCol:
+			if err == nil {
+				err = fmt.Errorf("%w: %s is not in GROUP BY", ErrAggregate, e.Name)
+			}
+		}
+		return e, false
+	})
+	return out, err
+}
+
+// the input rows grouped, the rewritten SELECT expressions and ORDER BY
+func execAggregate(tx *table.Tx, tdef *table.TableDef, stmt *Select, order []OrderItem) (Rows, []Expr, []OrderItem, error) {
+	p := &aggPlan{groups: stmt.GroupBy}
+	for _, g := range p.groups {
+		if hasAggregate(g) {
+			return nil, nil, nil, fmt.Errorf("%w: in GROUP BY", ErrAggregate)
+		}
+		if err := checkColumns(g, tdef.Cols); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	var exprs []Expr
+	for _, item := range stmt.Exprs {
+		e, err := p.output(item.Expr, tdef)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		exprs = append(exprs, e)
+	}
+	var outOrder []OrderItem
+	for _, item := range order {
+		e, err := p.output(item.Expr, tdef)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		outOrder = append(outOrder, OrderItem{Expr: e, Desc: item.Desc})
+	}
+
+	if rows, ok, err := countKeys(tx, tdef, stmt.Where, p); ok || err != nil {
+		return rows, exprs, outOrder, err
+	}
+	in, _, err := scanWhere(tx, tdef, stmt.Where, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return &aggRows{in: in, plan: p, cols: p.columns()}, exprs, outOrder, nil
+}
+
+// COUNT(*) of an exact range, bitmap or full-text match without reading the rows
+func countKeys(tx *table.Tx, tdef *table.TableDef, where Expr, p *aggPlan) (Rows, bool, error) {
+	if len(p.groups) > 0 {
+		return nil, false, nil
+	}
+	for _, call := range p.aggs {
+		if !call.Star {
+			return nil, false, nil
+		}
+	}
+	if err := checkColumns(where, tdef.Cols); err != nil {
+		return nil, false, err
+	}
+	plan := planScan(tdef, where, nil)
+	if where != nil && !plan.exact {
+		return nil, false, nil
+	}
+	var n table.Value
+	switch {
+	case plan.bitmap != nil:
+		bm, err := evalBitmap(tx, tdef, plan.bitmap)
+		if err != nil {
+			return nil, false, err
+		}
+		n = table.Int64(int64(bm.Len()))
+	case plan.match != nil:
+		m, err := tx.Match(tdef.Name, plan.match.col, string(plan.match.val.Str))
+		if err != nil {
+			return nil, false, err
+		}
+		count := 0
+		for ; m.Valid(); m.Next() {
+			count++
+		}
+		n = table.Int64(int64(count))
+	default:
+		if err := tx.Scanner(tdef.Name, &plan.sc); err != nil {
+			return nil, false, err
+		}
+		n = table.Int64(int64(plan.sc.Count()))
+	}
+	row := make([]table.Value, len(p.aggs))
+	for i := range row {
+		row[i] = n
+	}
+	return &valuesRows{cols: p.columns(), rows: [][]table.Value{row}}, true, nil
+}
+
+// aggregate states of a group, some aggregates take two values
+func stateSize(call *ExprCall) int {
+	if call.Name == "AVG" {
+		return 2 // sum, count
+	}
+	return 1
+}
+
+func initState(call *ExprCall, st []table.Value) {
+	switch call.Name {
+	case "COUNT":
+		st[0] = table.Int64(0)
+	case "AVG":
+		st[0], st[1] = table.Float64(0), table.Int64(0)
+	default:
+		st[0] = table.Null()
+	}
+}
+
+func addState(call *ExprCall, st []table.Value, v table.Value) error {
+	if call.Star {
+		st[0].I64++
+		return nil
+	}
+	if v.IsNull() {
+		return nil
+	}
+	switch call.Name {
+	case "COUNT":
+		st[0].I64++
+	case "SUM", "AVG":
+		if !isNumber(v) {
+			return fmt.Errorf("%w: %s(%s)", ErrType, call.Name, TypeName(v.Type))
+		}
+		if call.Name == "AVG" {
+			st[0].F64 += toFloat(v)
+			st[1].I64++
+			break
+		}
+		if st[0].IsNull() {
+			st[0] = v
+			break
+		}
+		sum, err := evalBinary("+", st[0], v)
+		if err != nil {
+			return err
+		}
+		st[0] = sum
+	case "MIN":
+		if st[0].IsNull() || table.Compare(v, st[0]) < 0 {
+			st[0] = v
+		}
+	case "MAX":
+		if st[0].IsNull() || table.Compare(v, st[0]) > 0 {
+			st[0] = v
+		}
+	}
+	return nil
+}
+
+// combines partial states of a group
+func mergeState(call *ExprCall, st, other []table.Value) error {
+	switch call.Name {
+	case "COUNT":
+		st[0].I64 += other[0].I64
+	case "AVG":
+		st[0].F64 += other[0].F64
+		st[1].I64 += other[1].I64
+	default:
+		return addState(&ExprCall{Name: call.Name}, st, other[0])
+	}
+	return nil
+}
+
+func stateResult(call *ExprCall, st []table.Value) table.Value {
+	if call.Name == "AVG" {
+		if st[1].I64 == 0 {
+			return table.Null()
+		}
+		return table.Float64(st[0].F64 / float64(st[1].I64))
+	}
+	return st[0]
+}
+
+// groups the input, see execAggregate
+type aggRows struct {
+	in   Rows
+	plan *aggPlan
+	cols []string
+
+	groups map[string]int
+	list   [][]table.Value // GROUP BY values followed by the states
+	size   int
+	sorter *sorter // partial groups
+	next   []table.Value
+	row    []table.Value
+	err    error
+	done   bool // read the input
+}
+
+func (it *aggRows) Columns() []string  { return it.cols }
+func (it *aggRows) Row() []table.Value { return it.row }
+func (it *aggRows) Err() error         { return it.err }
+
+func (it *aggRows) Close() error {
+	err := it.in.Close()
+	if it.sorter != nil {
+		if serr := it.sorter.close(); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+func (it *aggRows) Next() bool {
+	if it.err == nil && !it.done {
+		it.done = true
+		it.err = it.group()
+	}
+	if it.err != nil {
+		return false
+	}
+	var entry []table.Value
+	if it.sorter == nil {
+		if len(it.list) == 0 {
+			return false
+		}
+		entry, it.list = it.list[0], it.list[1:]
+	} else if entry, it.err = it.merged(); entry == nil {
+		return false
+	}
+	it.row = it.result(entry)
+	return true
+}
+
+// the output row of a group
+func (it *aggRows) result(entry []table.Value) []table.Value {
+	ng := len(it.plan.groups)
+	row := append([]table.Value{}, entry[:ng]...)
+	off := ng
+	for _, call := range it.plan.aggs {
+		row = append(row, stateResult(call, entry[off:]))
+		off += stateSize(call)
+	}
+	return row
+}
+
+// reads the input into the groups
+func (it *aggRows) group() error {
+	it.groups = map[string]int{}
+	cols := it.in.Columns()
+	ng := len(it.plan.groups)
+	var key []byte
+	for it.in.Next() {
+		s := &scope{cols: cols, vals: it.in.Row()}
+		vals := make([]table.Value, ng)
+		for i, e := range it.plan.groups {
+			v, err := eval(e, s)
+			if err != nil {
+				return err
+			}
+			if v.Type == table.TYPE_FLOAT64 && v.F64 == 0 {
+				v.F64 = 0 // -0 and 0 are one group
+			}
+			vals[i] = v
+		}
+		key = table.EncodeRow(key[:0], vals)
+		i, ok := it.groups[string(key)]
+		if !ok {
+			i = len(it.list)
+			it.groups[string(key)] = i
+			it.list = append(it.list, it.newEntry(vals))
+			it.size += len(key) + entrySize(it.list[i])
+		}
+		if err := it.add(it.list[i], s); err != nil {
+			return err
+		}
+		if it.size > SortBuffer {
+			if err := it.spill(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := it.in.Err(); err != nil {
+		return err
+	}
+	if len(it.list) == 0 && ng == 0 && it.sorter == nil {
+		// no GROUP BY is one group even without rows
+		it.list = append(it.list, it.newEntry(nil))
+	}
+	if it.sorter == nil {
+		return nil
+	}
+	if err := it.spill(); err != nil {
+		return err
+	}
+	return it.sorter.finish()
+}
+
+func (it *aggRows) newEntry(vals []table.Value) []table.Value {
+	entry := vals
+	for _, call := range it.plan.aggs {
+		n := len(entry)
+		entry = append(entry, make([]table.Value, stateSize(call))...)
+		initState(call, entry[n:])
+	}
+	return entry
+}
+
+func (it *aggRows) add(entry []table.Value, s *scope) error {
+	off := len(it.plan.groups)
+	for _, call := range it.plan.aggs {
+		var v table.Value
+		if !call.Star {
+			var err error
+			if v, err = eval(call.Args[0], s); err != nil {
+				return err
+			}
+		}
+		if err := addState(call, entry[off:], v); err != nil {
+			return err
+		}
+		off += stateSize(call)
+	}
+	return nil
+}
+
+// hands the groups to the sorter as partial groups
+func (it *aggRows) spill() error {
+	if it.sorter == nil {
+		it.sorter = &sorter{cmp: it.compare}
+	}
+	for _, entry := range it.list {
+		if err := it.sorter.add(entry); err != nil {
+			return err
+		}
+	}
+	clear(it.groups)
+	it.list, it.size = nil, 0
+	return nil
+}
+
+// orders partial groups by the GROUP BY values
+func (it *aggRows) compare(a, b []table.Value) int {
+	for i := range it.plan.groups {
+		if c := table.Compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// the next group merged from the sorted partial groups
+func (it *aggRows) merged() ([]table.Value, error) {
+	entry := it.next
+	if entry == nil {
+		var err error
+		if entry, err = it.sorter.next(); entry == nil {
+			return nil, err
+		}
+	}
+	for {
+		other, err := it.sorter.next()
+		if err != nil {
+			return nil, err
+		}
+		it.next = other
+		if other == nil || it.compare(entry, other) != 0 {
+			return entry, nil
+		}
+		off := len(it.plan.groups)
+		for _, call := range it.plan.aggs {
+			if err := mergeState(call, entry[off:], other[off:]); err != nil {
+				return nil, err
+			}
+			off += stateSize(call)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	db := openDB(t)
+	mustExec(t, db, "CREATE TABLE t (a INT, b STRING, c FLOAT, PRIMARY KEY (a), INDEX (b))")
+	cases := []struct{ src, want string }{
+		{"SELECT COUNT(*), COUNT(c), SUM(a), AVG(c), MIN(b), MAX(c) FROM t", "0 0 NULL NULL NULL NULL"},
+		{"SELECT b, COUNT(*) FROM t GROUP BY b", ""},
+	}
+	for _, c := range cases {
+		if got := query(t, db, c.src); got != c.want {
+			t.Errorf("%s = %q; want %q", c.src, got, c.want)
+		}
+	}
+
+	mustExec(t, db, `INSERT INTO t VALUES
+		(1, 'x', 1.5), (2, 'y', NULL), (3, 'x', 2.5), (4, NULL, 4), (5, 'y', 1), (6, 'x', NULL)`)
+	cases = []struct{ src, want string }{
+		{"SELECT COUNT(*), COUNT(c), SUM(a), AVG(c), MIN(b), MAX(c) FROM t", "6 4 21 2.25 x 4"},
+		{"SELECT count(*) FROM t WHERE a > 2", "4"},
+		{"SELECT COUNT(*) FROM t WHERE b = 'x' AND c > 2", "1"},
+		{"SELECT SUM(c), MIN(a) FROM t WHERE a > 100", "NULL NULL"},
+		{"SELECT b, COUNT(*), SUM(c) FROM t GROUP BY b ORDER BY b", "NULL 1 4\nx 3 4\ny 2 1"},
+		{"SELECT b, COUNT(*) * 10 AS n FROM t GROUP BY b ORDER BY n DESC, b LIMIT 2", "x 30\ny 20"},
+		{"SELECT a % 2 AS odd, MAX(a) FROM t GROUP BY a % 2 ORDER BY 1", "0 6\n1 5"},
+		{"SELECT b FROM t WHERE c IS NOT NULL GROUP BY b ORDER BY COUNT(*), b", "NULL\ny\nx"},
+		{"SELECT b, c IS NULL, COUNT(*) FROM t GROUP BY b, c IS NULL ORDER BY b, 2", "NULL false 1\nx false 2\nx true 1\ny false 1\ny true 1"},
+		{"SELECT MAX(a) - MIN(a), AVG(a) FROM t", "5 3.5"},
+	}
+	for _, c := range cases {
+		if got := query(t, db, c.src); got != c.want {
+			t.Errorf("%s = %q; want %q", c.src, got, c.want)
+		}
+	}
+
+	mustExec(t, db, "CREATE TABLE big (a INT, PRIMARY KEY (a))")
+	mustExec(t, db, "INSERT INTO big VALUES (9223372036854775807), (1)")
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	bad := []struct {
+		src  string
+		want error
+	}{
+		{"SELECT a, COUNT(*) FROM t", ErrAggregate},
+		{"SELECT b FROM t GROUP BY a", ErrAggregate},
+		{"SELECT a FROM t WHERE COUNT(*) > 1", ErrAggregate},
+		{"SELECT SUM(COUNT(*)) FROM t", ErrAggregate},
+		{"SELECT COUNT(a, b) FROM t", ErrAggregate},
+		{"SELECT SUM(*) FROM t", ErrAggregate},
+		{"SELECT * FROM t GROUP BY a", ErrAggregate},
+		{"SELECT COUNT(*) FROM t GROUP BY COUNT(*)", ErrAggregate},
+		{"SELECT a FROM t ORDER BY SUM(a)", ErrAggregate},
+		{"SELECT LENGTH(b) FROM t", ErrFunction},
+		{"SELECT SUM(x) FROM t", ErrColumn},
+		{"SELECT SUM(b) FROM t", ErrType},
+		{"SELECT SUM(a) FROM big", ErrOverflow},
+	}
+	for _, c := range bad {
+		res, err := Exec(tx, c.src)
+		if err == nil {
+			for res.Rows.Next() {
+			}
+			err = res.Rows.Err()
+			res.Rows.Close()
+		}
+		if !errors.Is(err, c.want) {
+			t.Errorf("%s: %v; want %v", c.src, err, c.want)
+		}
+	}
+}
+
+// hash aggregation with a buffer small enough to spill partial groups
+func TestGroupBySpill(t *testing.T) {
+	tmp := t.TempDir()
+	defer func(size int, dir string) { SortBuffer, TempDir = size, dir }(SortBuffer, TempDir)
+	SortBuffer, TempDir = 2048, tmp
+
+	db := openDB(t)
+	mustExec(t, db, "CREATE TABLE t (a INT, g INT, v INT, PRIMARY KEY (a))")
+	r := rand.New(rand.NewSource(1))
+	type group struct{ count, sum, min, max int }
+	groups := map[int]*group{}
+	tx := db.Begin()
+	for i := 0; i < 2000; i++ {
+		g, v := r.Intn(300), r.Intn(1000)
+		if _, err := Exec(tx, fmt.Sprintf("INSERT INTO t VALUES (%d, %d, %d)", i, g, v)); err != nil {
+			t.Fatal(err)
+		}
+		x := groups[g]
+		if x == nil {
+			x = &group{min: v, max: v}
+			groups[g] = x
+		}
+		x.count++
+		x.sum += v
+		x.min, x.max = min(x.min, v), max(x.max, v)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for g := 0; g < 300; g++ {
+		if x := groups[g]; x != nil {
+			want = append(want, fmt.Sprintf("%d %d %d %d %d %v", g, x.count, x.sum, x.min, x.max, float64(x.sum)/float64(x.count)))
+		}
+	}
+	got := query(t, db, "SELECT g, COUNT(*), SUM(v), MIN(v), MAX(v), AVG(v) FROM t GROUP BY g")
+	if sortLines(got) != sortLines(strings.Join(want, "\n")) {
+		t.Fatalf("got\n%s\nwant\n%s", got, strings.Join(want, "\n"))
+	}
+	files, err := os.ReadDir(tmp)
+	if err != nil || len(files) != 0 {
+		t.Fatalf("temporary files left: %v %v", files, err)
+	}
+}
+
+// COUNT(*) of exact ranges is counted from the keys
+func TestCountKeys(t *testing.T) {
+	db := openDB(t)
+	mustExec(t, db, "CREATE TABLE t (a INT, b INT, c STRING, PRIMARY KEY (a, b), INDEX (c))")
+	r := rand.New(rand.NewSource(1))
+	tx := db.Begin()
+	for i := 0; i < 300; i++ {
+		c := fmt.Sprintf("'%c'", 'a'+r.Intn(5))
+		if r.Intn(5) == 0 {
+			c = "NULL"
+		}
+		if _, err := Exec(tx, fmt.Sprintf("INSERT INTO t VALUES (%d, %d, %s)", r.Intn(10), i, c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := []string{"=", "<", "<=", ">", ">="}
+	wheres := []string{"", "c < 'c'", "c IS NULL"}
+	for i := 0; i < 100; i++ {
+		where := fmt.Sprintf("a %s %d", ops[r.Intn(5)], r.Intn(12)-1)
+		if r.Intn(2) == 0 {
+			where = fmt.Sprintf("c %s '%c'", ops[r.Intn(5)], 'a'+r.Intn(6))
+		}
+		wheres = append(wheres, where)
+	}
+	rtx := db.BeginRead()
+	defer rtx.Rollback()
+	fast := 0
+	for _, where := range wheres {
+		src := "SELECT COUNT(*) FROM t"
+		slow := src + " WHERE NOT NOT (TRUE)"
+		if where != "" {
+			src += " WHERE " + where
+			slow = "SELECT COUNT(*) FROM t WHERE NOT NOT (" + where + ")"
+		}
+		if got, want := query(t, db, src), query(t, db, slow); got != want {
+			t.Fatalf("%s = %s; want %s", src, got, want)
+		}
+		stmt, err := Parse(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tdef, err := rtx.TableDef("t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, _, _, err := execAggregate(rtx, tdef, stmt.(*Select), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := rows.(*valuesRows); ok {
+			fast++
+		}
+		rows.Close()
+	}
+	if fast < len(wheres)/2 {
+		t.Fatalf("%d of %d counts from the keys", fast, len(wheres))
+	}
+}
@@ -0,0 +1,123 @@
+package sql
+
+import (
+	"godb/internal/table"
+)
+
+// expressions
+
+type Expr interface {
+	expr()
+}
+
+type ExprLit struct {
+	Val table.Value
+}
+
+type ExprCol struct {
+	Name string
+}
+
+// -x, NOT x
+type ExprUnary struct {
+	Op string
+	X  Expr
+}
+
+// arithmetic, comparisons, AND, OR, MATCH
+type ExprBinary struct {
+	Op   string
+	L, R Expr
+}
+
+// x IS [NOT] NULL
+type ExprIsNull struct {
+	X   Expr
+	Not bool
+}
+
+// COUNT(*), SUM(x), ...
+type ExprCall struct {
+	Name string // upper case
+	Args []Expr
+	Star bool // COUNT(*)
+}
+
+// ?, a parameter of a prepared statement numbered from 0, see Bind
+type ExprParam struct {
+	N int
+}
+
+func (*ExprLit) expr()    {}
+func (*ExprCol) expr()    {}
+func (*ExprUnary) expr()  {}
+func (*ExprBinary) expr() {}
+func (*ExprIsNull) expr() {}
+func (*ExprCall) expr()   {}
+func (*ExprParam) expr()  {}
+
+// statements
+
+type Stmt interface {
+	stmt()
+}
+
+// CREATE TABLE t (a INT64, b STRING, PRIMARY KEY (a), INDEX (b), BITMAP INDEX (b),
+// FULLTEXT INDEX (b))
+type CreateTable struct {
+	Def table.TableDef
+}
+
+// INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y')
+type Insert struct {
+	Table string
+	Cols  []string // all columns in the table order if empty
+	Rows  [][]Expr
+}
+
+// SELECT a, b + 1 AS c FROM t WHERE a > 1 ORDER BY c DESC LIMIT 10 OFFSET 20
+// SELECT a, COUNT(*) FROM t GROUP BY a
+type Select struct {
+	Table   string
+	Exprs   []SelectExpr // nil for *
+	Where   Expr
+	GroupBy []Expr
+	OrderBy []OrderItem
+	Limit   Expr // constants, nil if absent
+	Offset  Expr
+}
+
+type SelectExpr struct {
+	Expr Expr
+	Name string // AS name, or the text of a column reference
+}
+
+// an expression, a name of a SELECT expression or its position from 1
+type OrderItem struct {
+	Expr Expr
+	Desc bool
+}
+
+// UPDATE t SET a = a + 1 WHERE b = 'x'
+type Update struct {
+	Table string
+	Set   []Assign
+	Where Expr
+}
+
+type Assign struct {
+	Col  string
+	Expr Expr
+}
+
+// DELETE FROM t WHERE a = 1
+type Delete struct {
+	Table string
+	Where Expr
+}
+
+func (*CreateTable) stmt() {}
+func (*Insert) stmt()      {}
+func (*Select) stmt()      {}
+func (*Update) stmt()      {}
+func (*Delete) stmt()      {}
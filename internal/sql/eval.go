@@ -0,0 +1,315 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"godb/internal/table"
+)
+
+var (
+	ErrType      = errors.New("type mismatch")
+	ErrColumn    = errors.New("unknown column")
+	ErrDivByZero = errors.New("division by zero")
+	ErrOverflow  = errors.New("integer overflow")
+)
+
+// columns visible to expressions and their values for the current row
+type scope struct {
+	cols []string
+	vals []table.Value
+}
+
+func (s *scope) lookup(name string) (table.Value, error) {
+	if i := indexOf(s.cols, name); i >= 0 {
+		return s.vals[i], nil
+	}
+	return table.Value{}, fmt.Errorf("%w: %s", ErrColumn, name)
+}
+
+func eval(e Expr, s *scope) (table.Value, error) {
+	switch e := e.(type) {
+	case *ExprLit:
+		return e.Val, nil
+	case *ExprCol:
+		return s.lookup(e.Name)
+	case *ExprIsNull:
+		x, err := eval(e.X, s)
+		if err != nil {
+			return x, err
+		}
+		return table.Bool(x.IsNull() != e.Not), nil
+	case *ExprUnary:
+		x, err := eval(e.X, s)
+		if err != nil || x.IsNull() {
+			return x, err
+		}
+		return evalUnary(e.Op, x)
+	case *ExprBinary:
+		if e.Op == "AND" || e.Op == "OR" {
+			return evalLogic(e, s)
+		}
+		l, err := eval(e.L, s)
+		if err != nil {
+			return l, err
+		}
+		r, err := eval(e.R, s)
+		if err != nil {
+			return r, err
+		}
+		if l.IsNull() || r.IsNull() {
+			return table.Null(), nil
+		}
+		return evalBinary(e.Op, l, r)
+	case *ExprCall:
+		if aggregates[e.Name] {
+			return table.Value{}, fmt.Errorf("%w: %s is not allowed here", ErrAggregate, e.Name)
+		}
+		return table.Value{}, fmt.Errorf("%w: %s", ErrFunction, e.Name)
+	case *ExprParam:
+		return table.Value{}, fmt.Errorf("%w: parameter %d is not bound", ErrParam, e.N+1)
+	}
+	panic("bad expression")
+}
+
+func evalUnary(op string, x table.Value) (table.Value, error) {
+	switch {
+	case op == "NOT" && x.Type == table.TYPE_BOOL:
+		return table.Bool(!x.Bool()), nil
+	case op == "-" && x.Type == table.TYPE_INT64:
+		if x.I64 == math.MinInt64 {
+			return x, ErrOverflow
+		}
+		return table.Int64(-x.I64), nil
+	case op == "-" && x.Type == table.TYPE_FLOAT64:
+		return table.Float64(-x.F64), nil
+	}
+	return x, fmt.Errorf("%w: %s %s", ErrType, op, x)
+}
+
+// three-valued logic: NULL AND false is false, NULL OR true is true
+func evalLogic(e *ExprBinary, s *scope) (table.Value, error) {
+	l, err := eval(e.L, s)
+	if err != nil {
+		return l, err
+	}
+	short := e.Op == "OR" // the value that decides the result
+	if l.Type == table.TYPE_BOOL && l.Bool() == short {
+		return l, nil
+	}
+	r, err := eval(e.R, s)
+	if err != nil {
+		return r, err
+	}
+	for _, v := range []table.Value{l, r} {
+		if !v.IsNull() && v.Type != table.TYPE_BOOL {
+			return v, fmt.Errorf("%w: %s %s", ErrType, e.Op, v)
+		}
+	}
+	if r.Type == table.TYPE_BOOL && r.Bool() == short {
+		return r, nil
+	}
+	if l.IsNull() || r.IsNull() {
+		return table.Null(), nil
+	}
+	return table.Bool(!short), nil
+}
+
+func evalBinary(op string, l, r table.Value) (table.Value, error) {
+	switch op {
+	case "MATCH":
+		if !isText(l) || !isText(r) {
+			return l, fmt.Errorf("%w: %s MATCH %s", ErrType, l, r)
+		}
+		return table.Bool(matches(l.Str, r.Str)), nil
+	case "=", "!=", "<", "<=", ">", ">=":
+		c, err := compare(l, r)
+		if err != nil {
+			return l, err
+		}
+		switch op {
+		case "=":
+			return table.Bool(c == 0), nil
+		case "!=":
+			return table.Bool(c != 0), nil
+		case "<":
+			return table.Bool(c < 0), nil
+		case "<=":
+			return table.Bool(c <= 0), nil
+		case ">":
+			return table.Bool(c > 0), nil
+		default:
+			return table.Bool(c >= 0), nil
+		}
+	}
+	if !isNumber(l) || !isNumber(r) {
+		return l, fmt.Errorf("%w: %s %s %s", ErrType, l, op, r)
+	}
+	if l.Type == table.TYPE_INT64 && r.Type == table.TYPE_INT64 {
+		return intArith(op, l.I64, r.I64)
+	}
+	a, b := toFloat(l), toFloat(r)
+	switch op {
+	case "+":
+		return table.Float64(a + b), nil
+	case "-":
+		return table.Float64(a - b), nil
+	case "*":
+		return table.Float64(a * b), nil
+	case "/":
+		if b == 0 {
+			return l, ErrDivByZero
+		}
+		return table.Float64(a / b), nil
+	case "%":
+		if b == 0 {
+			return l, ErrDivByZero
+		}
+		return table.Float64(math.Mod(a, b)), nil
+	}
+	panic("bad operator")
+}
+
+func intArith(op string, a, b int64) (table.Value, error) {
+	var c int64
+	switch op {
+	case "+":
+		c = a + b
+		if (c > a) != (b > 0) {
+			return table.Value{}, ErrOverflow
+		}
+	case "-":
+		c = a - b
+		if (c < a) != (b > 0) {
+			return table.Value{}, ErrOverflow
+		}
+	case "*":
+		c = a * b
+		if a != 0 && (c/a != b || (a == -1 && b == math.MinInt64)) {
+			return table.Value{}, ErrOverflow
+		}
+	case "/", "%":
+		if b == 0 {
+			return table.Value{}, ErrDivByZero
+		}
+		if a == math.MinInt64 && b == -1 {
+			if op == "%" {
+				return table.Int64(0), nil
+			}
+			return table.Value{}, ErrOverflow
+		}
+		if op == "/" {
+			c = a / b
+		} else {
+			c = a % b
+		}
+	default:
+		panic("bad operator")
+	}
+	return table.Int64(c), nil
+}
+
+// whether the text has all terms of the query, see table.Tokenize
+func matches(text, query []byte) bool {
+	terms := table.Tokenize(query)
+	if len(terms) == 0 {
+		return false
+	}
+	has := map[string]bool{}
+	for _, term := range table.Tokenize(text) {
+		has[term] = true
+	}
+	for _, term := range terms {
+		if !has[term] {
+			return false
+		}
+	}
+	return true
+}
+
+func isNumber(v table.Value) bool {
+	return v.Type == table.TYPE_INT64 || v.Type == table.TYPE_FLOAT64
+}
+
+func toFloat(v table.Value) float64 {
+	if v.Type == table.TYPE_INT64 {
+		return float64(v.I64)
+	}
+	return v.F64
+}
+
+func isText(v table.Value) bool {
+	return v.Type == table.TYPE_STRING || v.Type == table.TYPE_BYTES
+}
+
+// compares values of compatible types, strings compare with times as RFC 3339
+func compare(l, r table.Value) (int, error) {
+	if l.Type == table.TYPE_TIME && r.Type == table.TYPE_STRING {
+		t, err := coerce(r, table.TYPE_TIME)
+		if err != nil {
+			return 0, err
+		}
+		r = t
+	} else if l.Type == table.TYPE_STRING && r.Type == table.TYPE_TIME {
+		c, err := compare(r, l)
+		return -c, err
+	}
+	ok := l.Type == r.Type || isNumber(l) && isNumber(r) || isText(l) && isText(r)
+	if !ok {
+		return 0, fmt.Errorf("%w: comparing %s and %s", ErrType, l, r)
+	}
+	return table.Compare(l, r), nil
+}
+
+// converts the value for a column of type `typ`
+func coerce(v table.Value, typ uint32) (table.Value, error) {
+	switch {
+	case v.IsNull() || v.Type == typ:
+		return v, nil
+	case typ == table.TYPE_FLOAT64 && v.Type == table.TYPE_INT64:
+		return table.Float64(float64(v.I64)), nil
+	case typ == table.TYPE_BYTES && v.Type == table.TYPE_STRING:
+		return table.Bytes(v.Str), nil
+	case typ == table.TYPE_STRING && v.Type == table.TYPE_BYTES:
+		return table.String(string(v.Str)), nil
+	case typ == table.TYPE_TIME && v.Type == table.TYPE_STRING:
+		t, err := time.Parse(time.RFC3339Nano, string(v.Str))
+		if err != nil {
+			return v, fmt.Errorf("%w: bad time %q", ErrType, v.Str)
+		}
+		return table.Time(t), nil
+	}
+	return v, fmt.Errorf("%w: %s for a column of type %s", ErrType, v, TypeName(typ))
+}
+
+// the SQL name of a column type
+func TypeName(typ uint32) string {
+	switch typ {
+	case table.TYPE_INT64:
+		return "INT64"
+	case table.TYPE_FLOAT64:
+		return "FLOAT64"
+	case table.TYPE_BOOL:
+		return "BOOL"
+	case table.TYPE_STRING:
+		return "STRING"
+	case table.TYPE_BYTES:
+		return "BYTES"
+	case table.TYPE_TIME:
+		return "TIME"
+	}
+	return "NULL"
+}
+
+// WHERE passes rows where the condition is true, not NULL
+func truthy(v table.Value) (bool, error) {
+	switch v.Type {
+	case table.TYPE_NULL:
+		return false, nil
+	case table.TYPE_BOOL:
+		return v.Bool(), nil
+	}
+	return false, fmt.Errorf("%w: condition is %s", ErrType, v)
+}
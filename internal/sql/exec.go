@@ -0,0 +1,648 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"godb/internal/table"
+)
+
+var ErrDuplicateKey = errors.New("duplicate primary key")
+
+// Rows is the result of SELECT. Rows are produced on demand by a pipeline
+// of operators, each one is a Rows reading from its input:
+//
+//	scan -> filter -> [aggregate] -> sort -> limit -> project
+//
+// the scan reads the range of the primary key or of an index chosen by planScan,
+// or the rows of bitmap or full-text indexes. the sort is skipped if the
+// scan is in the ORDER BY order.
+type Rows interface {
+	Columns() []string
+	// advances to the next row, false at the end or on error
+	Next() bool
+	// the current row, valid until Next
+	Row() []table.Value
+	Err() error
+	// releases temporary files of the sort
+	Close() error
+}
+
+type Result struct {
+	Affected int  // rows changed by INSERT, UPDATE and DELETE
+	Rows     Rows // SELECT
+}
+
+// parses and executes one statement
+func Exec(tx *table.Tx, src string) (*Result, error) {
+	stmt, err := Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return Execute(tx, stmt)
+}
+
+func Execute(tx *table.Tx, stmt Stmt) (*Result, error) {
+	if n := NumParams(stmt); n > 0 {
+		return nil, fmt.Errorf("%w: %d parameters are not bound", ErrParam, n)
+	}
+	switch stmt := stmt.(type) {
+	case *CreateTable:
+		def := stmt.Def
+		return &Result{}, tx.TableNew(&def)
+	case *Select:
+		rows, err := execSelect(tx, stmt)
+		return &Result{Rows: rows}, err
+	case *Insert:
+		n, err := execInsert(tx, stmt)
+		return &Result{Affected: n}, err
+	case *Update:
+		n, err := execUpdate(tx, stmt)
+		return &Result{Affected: n}, err
+	case *Delete:
+		n, err := execDelete(tx, stmt)
+		return &Result{Affected: n}, err
+	}
+	panic("bad statement")
+}
+
+// reads a range of the primary key or of an index, see planScan
+type scanRows struct {
+	sc    table.Scanner
+	cols  []string
+	row   []table.Value
+	err   error
+	first bool
+}
+
+func newScan(tx *table.Tx, tdef *table.TableDef, sc table.Scanner) (*scanRows, error) {
+	it := &scanRows{sc: sc, cols: tdef.Cols, first: true}
+	if err := tx.Scanner(tdef.Name, &it.sc); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+func (it *scanRows) Columns() []string  { return it.cols }
+func (it *scanRows) Row() []table.Value { return it.row }
+func (it *scanRows) Err() error         { return it.err }
+func (it *scanRows) Close() error       { return nil }
+
+func (it *scanRows) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.first {
+		it.sc.Next()
+	}
+	it.first = false
+	if !it.sc.Valid() {
+		return false
+	}
+	var rec table.Record
+	if it.err = it.sc.Deref(&rec); it.err != nil {
+		return false
+	}
+	it.row = rec.Vals
+	return true
+}
+
+// reads the rows of a bitmap by their row ids
+type bitmapRows struct {
+	tx   *table.Tx
+	tdef *table.TableDef
+	ids  []uint32
+	row  []table.Value
+	err  error
+}
+
+func newBitmapScan(tx *table.Tx, tdef *table.TableDef, cond *bitmapCond) (*bitmapRows, error) {
+	bm, err := evalBitmap(tx, tdef, cond)
+	if err != nil {
+		return nil, err
+	}
+	it := &bitmapRows{tx: tx, tdef: tdef, ids: make([]uint32, 0, bm.Len())}
+	bm.Each(func(id uint32) bool {
+		it.ids = append(it.ids, id)
+		return true
+	})
+	return it, nil
+}
+
+// the bitmap of the condition
+func evalBitmap(tx *table.Tx, tdef *table.TableDef, c *bitmapCond) (*table.Bitmap, error) {
+	if c.op == "=" {
+		return tx.Bitmap(tdef.Name, c.col, c.val)
+	}
+	l, err := evalBitmap(tx, tdef, c.l)
+	if err != nil {
+		return nil, err
+	}
+	r, err := evalBitmap(tx, tdef, c.r)
+	if err != nil {
+		return nil, err
+	}
+	if c.op == "AND" {
+		return l.And(r), nil
+	}
+	return l.Or(r), nil
+}
+
+func (it *bitmapRows) Columns() []string  { return it.tdef.Cols }
+func (it *bitmapRows) Row() []table.Value { return it.row }
+func (it *bitmapRows) Err() error         { return it.err }
+func (it *bitmapRows) Close() error       { return nil }
+
+func (it *bitmapRows) Next() bool {
+	if it.err != nil || len(it.ids) == 0 {
+		return false
+	}
+	var rec table.Record
+	id := it.ids[0]
+	it.ids = it.ids[1:]
+	ok, err := it.tx.GetByID(it.tdef.Name, id, &rec)
+	if err == nil && !ok {
+		err = fmt.Errorf("bitmap of %s: row %d is missing", it.tdef.Name, id)
+	}
+	if it.err = err; err != nil {
+		return false
+	}
+	it.row = rec.Vals
+	return true
+}
+
+// reads the rows of a full-text index containing the terms
+type matchRows struct {
+	m     *table.Matcher
+	cols  []string
+	row   []table.Value
+	err   error
+	first bool
+}
+
+func newMatchScan(tx *table.Tx, tdef *table.TableDef, p *pred) (*matchRows, error) {
+	m, err := tx.Match(tdef.Name, p.col, string(p.val.Str))
+	if err != nil {
+		return nil, err
+	}
+	return &matchRows{m: m, cols: tdef.Cols, first: true}, nil
+}
+
+func (it *matchRows) Columns() []string  { return it.cols }
+func (it *matchRows) Row() []table.Value { return it.row }
+func (it *matchRows) Err() error         { return it.err }
+func (it *matchRows) Close() error       { return nil }
+
+func (it *matchRows) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.first {
+		it.m.Next()
+	}
+	it.first = false
+	if !it.m.Valid() {
+		return false
+	}
+	var rec table.Record
+	if it.err = it.m.Deref(&rec); it.err != nil {
+		return false
+	}
+	it.row = rec.Vals
+	return true
+}
+
+// passes rows where the condition is true
+type filterRows struct {
+	in   Rows
+	cond Expr
+	err  error
+}
+
+func (it *filterRows) Columns() []string  { return it.in.Columns() }
+func (it *filterRows) Row() []table.Value { return it.in.Row() }
+func (it *filterRows) Close() error       { return it.in.Close() }
+
+func (it *filterRows) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.in.Err()
+}
+
+func (it *filterRows) Next() bool {
+	for it.err == nil && it.in.Next() {
+		v, err := eval(it.cond, &scope{cols: it.in.Columns(), vals: it.in.Row()})
+		if err == nil {
+			var ok bool
+			if ok, err = truthy(v); ok {
+				return true
+			}
+		}
+		it.err = err
+	}
+	return false
+}
+
+// evaluates the SELECT expressions
+type projectRows struct {
+	in    Rows
+	exprs []Expr
+	cols  []string
+	row   []table.Value
+	err   error
+}
+
+func (it *projectRows) Columns() []string  { return it.cols }
+func (it *projectRows) Row() []table.Value { return it.row }
+func (it *projectRows) Close() error       { return it.in.Close() }
+
+func (it *projectRows) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.in.Err()
+}
+
+func (it *projectRows) Next() bool {
+	if it.err != nil || !it.in.Next() {
+		return false
+	}
+	s := &scope{cols: it.in.Columns(), vals: it.in.Row()}
+	it.row = make([]table.Value, len(it.exprs))
+	for i, e := range it.exprs {
+		if it.row[i], it.err = eval(e, s); it.err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// skips `offset` rows and stops after `limit`, -1 for no limit
+type limitRows struct {
+	in     Rows
+	offset int64
+	limit  int64
+}
+
+func (it *limitRows) Columns() []string  { return it.in.Columns() }
+func (it *limitRows) Row() []table.Value { return it.in.Row() }
+func (it *limitRows) Err() error         { return it.in.Err() }
+func (it *limitRows) Close() error       { return it.in.Close() }
+
+func (it *limitRows) Next() bool {
+	for ; it.offset > 0; it.offset-- {
+		if !it.in.Next() {
+			return false
+		}
+	}
+	if it.limit == 0 {
+		return false
+	}
+	it.limit--
+	return it.in.Next()
+}
+
+// rows computed before the pipeline starts
+type valuesRows struct {
+	cols []string
+	rows [][]table.Value
+	row  []table.Value
+}
+
+func (it *valuesRows) Columns() []string  { return it.cols }
+func (it *valuesRows) Row() []table.Value { return it.row }
+func (it *valuesRows) Err() error         { return nil }
+func (it *valuesRows) Close() error       { return nil }
+
+func (it *valuesRows) Next() bool {
+	if len(it.rows) == 0 {
+		return false
+	}
+	it.row, it.rows = it.rows[0], it.rows[1:]
+	return true
+}
+
+// rows of the table where the condition holds, and whether they are
+// in the `order` order
+func scanWhere(tx *table.Tx, tdef *table.TableDef, where Expr, order []OrderItem) (Rows, bool, error) {
+	if err := checkColumns(where, tdef.Cols); err != nil {
+		return nil, false, err
+	}
+	if hasAggregate(where) {
+		return nil, false, fmt.Errorf("%w: in WHERE", ErrAggregate)
+	}
+	plan := planScan(tdef, where, order)
+	var rows Rows
+	var err error
+	switch {
+	case plan.bitmap != nil:
+		rows, err = newBitmapScan(tx, tdef, plan.bitmap)
+	case plan.match != nil:
+		rows, err = newMatchScan(tx, tdef, plan.match)
+	default:
+		rows, err = newScan(tx, tdef, plan.sc)
+	}
+	if err != nil || where == nil {
+		return rows, plan.ordered, err
+	}
+	return &filterRows{in: rows, cond: where}, plan.ordered, nil
+}
+
+// reports unknown columns before the first row is read
+func checkColumns(e Expr, cols []string) error {
+	switch e := e.(type) {
+	case nil:
+	case *ExprCol:
+		if indexOf(cols, e.Name) < 0 {
+			return fmt.Errorf("%w: %s", ErrColumn, e.Name)
+		}
+	case *ExprUnary:
+		return checkColumns(e.X, cols)
+	case *ExprIsNull:
+		return checkColumns(e.X, cols)
+	case *ExprBinary:
+		if err := checkColumns(e.L, cols); err != nil {
+			return err
+		}
+		return checkColumns(e.R, cols)
+	case *ExprCall:
+		for _, arg := range e.Args {
+			if err := checkColumns(arg, cols); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func execSelect(tx *table.Tx, stmt *Select) (Rows, error) {
+	tdef, err := tx.TableDef(stmt.Table)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range stmt.Exprs {
+		if err := checkColumns(item.Expr, tdef.Cols); err != nil {
+			return nil, err
+		}
+	}
+	order, err := orderBy(tdef, stmt)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := constInt(stmt.Offset, 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := constInt(stmt.Limit, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows Rows
+	sorted := false
+	exprs := make([]Expr, len(stmt.Exprs))
+	for i, item := range stmt.Exprs {
+		exprs[i] = item.Expr
+	}
+	if isAggregate(stmt) {
+		if stmt.Exprs == nil {
+			return nil, fmt.Errorf("%w: SELECT * with GROUP BY", ErrAggregate)
+		}
+		rows, exprs, order, err = execAggregate(tx, tdef, stmt, order)
+	} else {
+		rows, sorted, err = scanWhere(tx, tdef, stmt.Where, order)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(order) > 0 && !sorted {
+		sort := &sortRows{in: rows}
+		for _, item := range order {
+			sort.keys = append(sort.keys, item.Expr)
+			sort.desc = append(sort.desc, item.Desc)
+		}
+		if limit >= 0 && offset+limit >= offset {
+			sort.keep = int(offset + limit)
+		}
+		rows = sort
+	}
+	if offset > 0 || limit >= 0 {
+		rows = &limitRows{in: rows, offset: offset, limit: limit}
+	}
+	if stmt.Exprs == nil {
+		return rows, nil
+	}
+	proj := &projectRows{in: rows, exprs: exprs}
+	for i, item := range stmt.Exprs {
+		name := item.Name
+		if name == "" {
+			name = fmt.Sprintf("col%d", i+1)
+		}
+		proj.cols = append(proj.cols, name)
+	}
+	return proj, nil
+}
+
+// ORDER BY over the columns of the table: names of SELECT expressions
+// and positions are replaced by the expressions
+func orderBy(tdef *table.TableDef, stmt *Select) ([]OrderItem, error) {
+	var order []OrderItem
+	for _, item := range stmt.OrderBy {
+		switch e := item.Expr.(type) {
+		case *ExprLit:
+			if e.Val.Type != table.TYPE_INT64 {
+				break
+			}
+			n := int(e.Val.I64)
+			switch {
+			case stmt.Exprs != nil && n >= 1 && n <= len(stmt.Exprs):
+				item.Expr = stmt.Exprs[n-1].Expr
+			case stmt.Exprs == nil && n >= 1 && n <= len(tdef.Cols):
+				item.Expr = &ExprCol{Name: tdef.Cols[n-1]}
+			default:
+				return nil, fmt.Errorf("%w: ORDER BY position %d", ErrColumn, n)
+			}
+		case *ExprCol:
+			if indexOf(tdef.Cols, e.Name) >= 0 {
+				break
+			}
+			for _, sel := range stmt.Exprs {
+				if sel.Name == e.Name {
+					item.Expr = sel.Expr
+					break
+				}
+			}
+		}
+		if err := checkColumns(item.Expr, tdef.Cols); err != nil {
+			return nil, err
+		}
+		order = append(order, item)
+	}
+	return order, nil
+}
+
+// the value of LIMIT or OFFSET
+func constInt(e Expr, def int64) (int64, error) {
+	if e == nil {
+		return def, nil
+	}
+	v, err := eval(e, &scope{})
+	if err != nil {
+		return 0, err
+	}
+	if v.Type != table.TYPE_INT64 || v.I64 < 0 {
+		return 0, fmt.Errorf("%w: LIMIT and OFFSET take a non-negative integer", ErrType)
+	}
+	return v.I64, nil
+}
+
+func execInsert(tx *table.Tx, stmt *Insert) (int, error) {
+	tdef, err := tx.TableDef(stmt.Table)
+	if err != nil {
+		return 0, err
+	}
+	cols := stmt.Cols
+	if cols == nil {
+		cols = tdef.Cols
+	}
+	for i, col := range cols {
+		if indexOf(tdef.Cols, col) < 0 || indexOf(cols[:i], col) >= 0 {
+			return 0, fmt.Errorf("%w: %s", ErrColumn, col)
+		}
+	}
+	for n, exprs := range stmt.Rows {
+		if len(exprs) != len(cols) {
+			return n, fmt.Errorf("%w: %d values for %d columns", ErrType, len(exprs), len(cols))
+		}
+		vals := make([]table.Value, len(tdef.Cols))
+		for i := range vals {
+			vals[i] = table.Null()
+		}
+		for i, e := range exprs {
+			v, err := eval(e, &scope{})
+			if err != nil {
+				return n, err
+			}
+			vals[indexOf(tdef.Cols, cols[i])] = v
+		}
+		rec, err := makeRecord(tdef, vals)
+		if err != nil {
+			return n, err
+		}
+		ok, err := tx.Insert(tdef.Name, rec)
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			return n, ErrDuplicateKey
+		}
+	}
+	return len(stmt.Rows), nil
+}
+
+// converts the values for the columns of the table
+func makeRecord(tdef *table.TableDef, vals []table.Value) (table.Record, error) {
+	rec := table.Record{Cols: tdef.Cols, Vals: make([]table.Value, len(vals))}
+	for i, v := range vals {
+		var err error
+		if rec.Vals[i], err = coerce(v, tdef.Types[i]); err != nil {
+			return rec, fmt.Errorf("column %s: %w", tdef.Cols[i], err)
+		}
+	}
+	return rec, nil
+}
+
+// rows matching the condition, read before writing
+// because updates invalidate the scan
+func collect(tx *table.Tx, tdef *table.TableDef, where Expr) ([][]table.Value, error) {
+	rows, _, err := scanWhere(tx, tdef, where, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out [][]table.Value
+	for rows.Next() {
+		out = append(out, slices.Clone(rows.Row()))
+	}
+	return out, rows.Err()
+}
+
+func execUpdate(tx *table.Tx, stmt *Update) (int, error) {
+	tdef, err := tx.TableDef(stmt.Table)
+	if err != nil {
+		return 0, err
+	}
+	for _, set := range stmt.Set {
+		if indexOf(tdef.Cols, set.Col) < 0 {
+			return 0, fmt.Errorf("%w: %s", ErrColumn, set.Col)
+		}
+		if err := checkColumns(set.Expr, tdef.Cols); err != nil {
+			return 0, err
+		}
+	}
+	rows, err := collect(tx, tdef, stmt.Where)
+	if err != nil {
+		return 0, err
+	}
+	// rows with a changed primary key are deleted first and inserted
+	// after, so keys can be shifted like SET id = id + 1
+	var moved []table.Record
+	for _, old := range rows {
+		vals := slices.Clone(old)
+		s := &scope{cols: tdef.Cols, vals: old}
+		for _, set := range stmt.Set {
+			if vals[indexOf(tdef.Cols, set.Col)], err = eval(set.Expr, s); err != nil {
+				return 0, err
+			}
+		}
+		rec, err := makeRecord(tdef, vals)
+		if err != nil {
+			return 0, err
+		}
+		if slices.EqualFunc(old[:tdef.PKeys], rec.Vals[:tdef.PKeys], func(a, b table.Value) bool {
+			return table.Compare(a, b) == 0
+		}) {
+			if _, err := tx.Update(tdef.Name, rec); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if _, err := tx.Delete(tdef.Name, pkeyRecord(tdef, old)); err != nil {
+			return 0, err
+		}
+		moved = append(moved, rec)
+	}
+	for _, rec := range moved {
+		ok, err := tx.Insert(tdef.Name, rec)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, ErrDuplicateKey
+		}
+	}
+	return len(rows), nil
+}
+
+func pkeyRecord(tdef *table.TableDef, vals []table.Value) table.Record {
+	return table.Record{Cols: tdef.Cols[:tdef.PKeys], Vals: vals[:tdef.PKeys]}
+}
+
+func execDelete(tx *table.Tx, stmt *Delete) (int, error) {
+	tdef, err := tx.TableDef(stmt.Table)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := collect(tx, tdef, stmt.Where)
+	if err != nil {
+		return 0, err
+	}
+	for n, row := range rows {
+		if _, err := tx.Delete(tdef.Name, pkeyRecord(tdef, row)); err != nil {
+			return n, err
+		}
+	}
+	return len(rows), nil
+}
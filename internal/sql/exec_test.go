@@ -0,0 +1,229 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"godb/internal/table"
+)
+
+func openDB(t *testing.T) *table.DB {
+	t.Helper()
+	db := &table.DB{Path: filepath.Join(t.TempDir(), "test.db")}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// runs the statements in one write transaction
+func mustExec(t *testing.T, db *table.DB, src string) *Result {
+	t.Helper()
+	tx := db.Begin()
+	stmts, err := ParseAll(src)
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	var res *Result
+	for _, stmt := range stmts {
+		if res, err = Execute(tx, stmt); err != nil {
+			tx.Rollback()
+			t.Fatalf("%s: %v", src, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// the rows of the query, one row per line, values separated by spaces
+func query(t *testing.T, db *table.DB, src string) string {
+	t.Helper()
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	res, err := Exec(tx, src)
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	defer res.Rows.Close()
+	var lines []string
+	for res.Rows.Next() {
+		var vals []string
+		for _, v := range res.Rows.Row() {
+			vals = append(vals, v.String())
+		}
+		lines = append(lines, strings.Join(vals, " "))
+	}
+	if err := res.Rows.Err(); err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestExec(t *testing.T) {
+	db := openDB(t)
+	mustExec(t, db, `
+		CREATE TABLE users (id INT, name STRING, score FLOAT, active BOOL, PRIMARY KEY (id));
+		INSERT INTO users VALUES (1, 'ann', 2.5, TRUE), (2, 'bob', 1, FALSE);
+		INSERT INTO users (name, id) VALUES ('cat', 3);
+	`)
+
+	cases := []struct{ src, want string }{
+		{"SELECT * FROM users", "1 ann 2.5 true\n2 bob 1 false\n3 cat NULL NULL"},
+		{"SELECT name, id * 10 AS x FROM users WHERE id >= 2", "bob 20\ncat 30"},
+		{"SELECT name FROM users WHERE score > 1", "ann"},
+		{"SELECT name FROM users WHERE score IS NULL OR active", "ann\ncat"},
+		{"SELECT name FROM users WHERE NOT active", "bob"},
+		{"SELECT name FROM users WHERE active AND score < 10", "ann"},
+		{"SELECT id / 2, id % 2, -id, 7 / 2.0 FROM users WHERE id = 3", "1 1 -3 3.5"},
+		{"SELECT name FROM users WHERE name != 'bob' AND id <> 3", "ann"},
+	}
+	for _, c := range cases {
+		if got := query(t, db, c.src); got != c.want {
+			t.Errorf("%s = %q; want %q", c.src, got, c.want)
+		}
+	}
+
+	res := mustExec(t, db, "UPDATE users SET score = score * 2, active = TRUE WHERE score IS NOT NULL")
+	if res.Affected != 2 {
+		t.Fatalf("UPDATE affected %d rows; want 2", res.Affected)
+	}
+	if got := query(t, db, "SELECT id, score, active FROM users"); got != "1 5 true\n2 2 true\n3 NULL NULL" {
+		t.Fatalf("after UPDATE: %q", got)
+	}
+	// the primary key can be shifted
+	mustExec(t, db, "UPDATE users SET id = id + 1")
+	if got := query(t, db, "SELECT id, name FROM users"); got != "2 ann\n3 bob\n4 cat" {
+		t.Fatalf("after moving keys: %q", got)
+	}
+	if res := mustExec(t, db, "DELETE FROM users WHERE name = 'bob' OR id = 4"); res.Affected != 2 {
+		t.Fatalf("DELETE affected %d rows; want 2", res.Affected)
+	}
+	if got := query(t, db, "SELECT name FROM users"); got != "ann" {
+		t.Fatalf("after DELETE: %q", got)
+	}
+}
+
+func TestExecErrors(t *testing.T) {
+	db := openDB(t)
+	mustExec(t, db, "CREATE TABLE t (k INT, v STRING, at TIME, INDEX (v)); INSERT INTO t VALUES (1, 'a', '2024-01-02T03:04:05Z')")
+	if got := query(t, db, "SELECT k FROM t WHERE at < '2025-01-01T00:00:00Z'"); got != "1" {
+		t.Fatalf("time comparison = %q", got)
+	}
+
+	cases := []struct {
+		src  string
+		want error
+	}{
+		{"INSERT INTO t VALUES (1, 'b', NULL)", ErrDuplicateKey},
+		{"INSERT INTO t VALUES ('x', 'b', NULL)", ErrType},
+		{"INSERT INTO t (k) VALUES (1, 2)", ErrType},
+		{"INSERT INTO t (nope) VALUES (1)", ErrColumn},
+		{"INSERT INTO t VALUES (9223372036854775807 + 1, 'b', NULL)", ErrOverflow},
+		{"INSERT INTO t VALUES (1 / 0, 'b', NULL)", ErrDivByZero},
+		{"INSERT INTO t VALUES (NULL, 'b', NULL)", table.ErrBadRecord},
+		{"INSERT INTO t VALUES (2, 'b', 'yesterday')", ErrType},
+		{"SELECT nope FROM t", ErrColumn},
+		{"SELECT k FROM t WHERE k", ErrType},
+		{"SELECT k FROM t WHERE k = 'a'", ErrType},
+		{"SELECT k FROM nope", table.ErrTableNotFound},
+		{"UPDATE t SET nope = 1", ErrColumn},
+		{"DELETE FROM t WHERE nope = 1", ErrColumn},
+	}
+	for _, c := range cases {
+		tx := db.Begin()
+		res, err := Exec(tx, c.src)
+		if err == nil && res.Rows != nil {
+			for res.Rows.Next() {
+			}
+			err = res.Rows.Err()
+		}
+		tx.Rollback()
+		if !errors.Is(err, c.want) {
+			t.Errorf("%s = %v; want %v", c.src, err, c.want)
+		}
+	}
+	if got := query(t, db, "SELECT k FROM t WHERE FALSE"); got != "" {
+		t.Fatalf("query = %q", got)
+	}
+}
+
+func TestLogic(t *testing.T) {
+	vals := map[string]table.Value{"t": table.Bool(true), "f": table.Bool(false), "n": table.Null()}
+	cases := map[string]string{
+		"t AND n": "NULL", "f AND n": "false", "n AND f": "false", "n AND n": "NULL",
+		"t OR n": "true", "n OR t": "true", "f OR n": "NULL", "NOT n": "NULL",
+		"n = n": "NULL", "n IS NULL": "true", "t IS NOT NULL": "true",
+	}
+	s := &scope{}
+	for name, v := range vals {
+		s.cols = append(s.cols, name)
+		s.vals = append(s.vals, v)
+	}
+	for src, want := range cases {
+		stmt, err := Parse(fmt.Sprintf("SELECT %s FROM x", src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := eval(stmt.(*Select).Exprs[0].Expr, s)
+		if err != nil || v.String() != want {
+			t.Errorf("%s = %v, %v; want %s", src, v, err, want)
+		}
+	}
+}
+
+func sortLines(s string) string {
+	lines := strings.Split(s, "\n")
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestMatch(t *testing.T) {
+	db := openDB(t)
+	mustExec(t, db, `CREATE TABLE docs (id INT, tag STRING, body STRING, FULLTEXT INDEX (body));
+		INSERT INTO docs VALUES (1, 'db', 'B-trees store Pages on disk'), (2, 'db', 'the page cache of the tree'),
+			(3, 'go', 'goroutines and channels'), (4, 'go', NULL), (5, 'db', 'Disk pages, pages and trees')`)
+	cases := []struct{ src, want string }{
+		{"SELECT id FROM docs WHERE body MATCH 'pages'", "1\n5"},
+		{"SELECT id FROM docs WHERE body MATCH 'DISK and trees'", "5"},
+		{"SELECT id FROM docs WHERE body MATCH 'tree' AND tag = 'db'", "2"},
+		{"SELECT id FROM docs WHERE body MATCH 'channels' OR id = 1", "1\n3"},
+		{"SELECT id FROM docs WHERE NOT body MATCH 'page'", "1\n3\n5"},
+		{"SELECT id FROM docs WHERE body MATCH ''", ""},
+		{"SELECT id FROM docs WHERE body MATCH 'pages' ORDER BY id DESC", "5\n1"},
+		{"SELECT COUNT(*) FROM docs WHERE body MATCH 'pages'", "2"},
+		{"SELECT COUNT(*) FROM docs WHERE body MATCH 'pages' AND id > 1", "1"},
+		{"SELECT tag MATCH 'DB' FROM docs WHERE id = 1", "true"},
+	}
+	for _, c := range cases {
+		if got := query(t, db, c.src); got != c.want {
+			t.Errorf("%s = %q; want %q", c.src, got, c.want)
+		}
+	}
+	mustExec(t, db, "UPDATE docs SET body = 'no more pages' WHERE id = 1; DELETE FROM docs WHERE id = 5")
+	if got := query(t, db, "SELECT id FROM docs WHERE body MATCH 'disk pages'"); got != "" {
+		t.Fatalf("after the update: %q", got)
+	}
+	if got := query(t, db, "SELECT body FROM docs WHERE body MATCH 'MORE'"); got != "no more pages" {
+		t.Fatalf("after the update: %q", got)
+	}
+
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	res, err := Exec(tx, "SELECT id FROM docs WHERE id MATCH 'x'")
+	if err == nil {
+		for res.Rows.Next() {
+		}
+		err = res.Rows.Err()
+	}
+	if !errors.Is(err, ErrType) {
+		t.Fatalf("MATCH of a number = %v", err)
+	}
+}
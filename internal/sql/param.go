@@ -0,0 +1,98 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"godb/internal/table"
+)
+
+// Prepared statements are parsed once and executed many times with
+// different arguments. a ? in an expression is a parameter, Bind replaces
+// the parameters by the arguments in the order of the text:
+//
+//	stmt, _ := Parse("SELECT b FROM t WHERE a = ? LIMIT ?")
+//	bound, _ := Bind(stmt, []table.Value{table.Int64(1), table.Int64(10)})
+//	res, _ := Execute(tx, bound)
+
+var ErrParam = errors.New("bad parameter")
+
+// the number of parameters of the statement
+func NumParams(stmt Stmt) int {
+	n := 0
+	mapExprs(stmt, func(e Expr) (Expr, bool) {
+		if p, ok := e.(*ExprParam); ok {
+			n = max(n, p.N+1)
+		}
+		return e, false
+	})
+	return n
+}
+
+// a copy of the statement with the arguments in place of the parameters,
+// the statement itself is not changed and can be bound again
+func Bind(stmt Stmt, args []table.Value) (Stmt, error) {
+	if n := NumParams(stmt); len(args) != n {
+		return nil, fmt.Errorf("%w: %d arguments for %d parameters", ErrParam, len(args), n)
+	}
+	if len(args) == 0 {
+		return stmt, nil
+	}
+	return mapExprs(stmt, func(e Expr) (Expr, bool) {
+		if p, ok := e.(*ExprParam); ok {
+			return &ExprLit{Val: args[p.N]}, true
+		}
+		return e, false
+	}), nil
+}
+
+// a copy of the statement with the expressions rewritten by `fn`
+func mapExprs(stmt Stmt, fn func(e Expr) (Expr, bool)) Stmt {
+	exprs := func(list []Expr) []Expr {
+		var out []Expr
+		for _, e := range list {
+			out = append(out, rewrite(e, fn))
+		}
+		return out
+	}
+	switch stmt := stmt.(type) {
+	case *CreateTable:
+		return stmt
+	case *Select:
+		out := *stmt
+		out.Exprs = slices.Clone(stmt.Exprs)
+		for i := range out.Exprs {
+			out.Exprs[i].Expr = rewrite(out.Exprs[i].Expr, fn)
+		}
+		out.Where = rewrite(stmt.Where, fn)
+		out.GroupBy = exprs(stmt.GroupBy)
+		out.OrderBy = slices.Clone(stmt.OrderBy)
+		for i := range out.OrderBy {
+			out.OrderBy[i].Expr = rewrite(out.OrderBy[i].Expr, fn)
+		}
+		out.Limit = rewrite(stmt.Limit, fn)
+		out.Offset = rewrite(stmt.Offset, fn)
+		return &out
+	case *Insert:
+		out := *stmt
+		out.Rows = nil
+		for _, row := range stmt.Rows {
+			out.Rows = append(out.Rows, exprs(row))
+		}
+		return &out
+	case *Update:
+		out := *stmt
+		out.Set = slices.Clone(stmt.Set)
+		for i := range out.Set {
+			out.Set[i].Expr = rewrite(out.Set[i].Expr, fn)
+		}
+		out.Where = rewrite(stmt.Where, fn)
+		return &out
+	case *Delete:
+		out := *stmt
+		out.Where = rewrite(stmt.Where, fn)
+		return &out
+	}
+	panic("bad statement")
+}
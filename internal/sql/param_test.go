@@ -0,0 +1,80 @@
+package sql
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"godb/internal/table"
+)
+
+func TestBind(t *testing.T) {
+	db := openDB(t)
+	mustExec(t, db, `CREATE TABLE t (a INT, b STRING, INDEX (b));
+		INSERT INTO t VALUES (1, 'x'), (2, 'y'), (3, 'x'), (4, 'z')`)
+
+	stmt, err := Parse("SELECT a FROM t WHERE b = ? AND a > ? - 1 ORDER BY a DESC LIMIT ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := NumParams(stmt); n != 3 {
+		t.Fatalf("NumParams() = %d", n)
+	}
+	run := func(args ...table.Value) string {
+		t.Helper()
+		bound, err := Bind(stmt, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx := db.BeginRead()
+		defer tx.Rollback()
+		res, err := Execute(tx, bound)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Rows.Close()
+		var vals []string
+		for res.Rows.Next() {
+			vals = append(vals, res.Rows.Row()[0].String())
+		}
+		return strings.Join(vals, " ")
+	}
+	if got := run(table.String("x"), table.Int64(1), table.Int64(10)); got != "3 1" {
+		t.Fatalf("first execution = %q", got)
+	}
+	// the parsed statement is not changed by Bind
+	if got := run(table.String("x"), table.Int64(2), table.Int64(1)); got != "3" {
+		t.Fatalf("second execution = %q", got)
+	}
+	if _, err := Bind(stmt, nil); !errors.Is(err, ErrParam) {
+		t.Fatalf("Bind() without arguments = %v", err)
+	}
+	tx := db.BeginRead()
+	_, err = Exec(tx, "SELECT a FROM t WHERE a = ?")
+	tx.Rollback()
+	if !errors.Is(err, ErrParam) {
+		t.Fatalf("Exec() with an unbound parameter = %v", err)
+	}
+
+	ins, err := Parse("INSERT INTO t VALUES (?, ?); ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx = db.Begin()
+	for i, s := range []string{"p", "q"} {
+		bound, err := Bind(ins, []table.Value{table.Int64(int64(10 + i)), table.String(s)})
+		if err == nil {
+			_, err = Execute(tx, bound)
+		}
+		if err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := query(t, db, "SELECT * FROM t WHERE a >= 10"); got != "10 p\n11 q" {
+		t.Fatalf("inserted rows = %q", got)
+	}
+}
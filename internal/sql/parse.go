@@ -0,0 +1,721 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"godb/internal/table"
+)
+
+var ErrSyntax = errors.New("syntax error")
+
+const (
+	TOK_EOF    = 0
+	TOK_IDENT  = 1 // names and keywords, "quoted" names
+	TOK_NUMBER = 2
+	TOK_STRING = 3 // 'text', '' is a quote
+	TOK_SYMBOL = 4
+)
+
+type token struct {
+	kind   int
+	text   string
+	quoted bool // a quoted name is never a keyword
+	pos    int
+}
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '-' && strings.HasPrefix(src[i:], "--"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+		case isIdentStart(c):
+			for i < len(src) && isIdentChar(src[i]) {
+				i++
+			}
+			toks = append(toks, token{kind: TOK_IDENT, text: src[start:i], pos: start})
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.' || src[i] == 'e' || src[i] == 'E' ||
+				(src[i] == '-' || src[i] == '+') && (src[i-1] == 'e' || src[i-1] == 'E')) {
+				i++
+			}
+			toks = append(toks, token{kind: TOK_NUMBER, text: src[start:i], pos: start})
+		case c == '\'' || c == '"':
+			var sb strings.Builder
+			for i++; ; i++ {
+				if i >= len(src) {
+					return nil, fmt.Errorf("%w: unterminated quote at %d", ErrSyntax, start)
+				}
+				if src[i] == c {
+					if i+1 < len(src) && src[i+1] == c {
+						i++
+					} else {
+						break
+					}
+				}
+				sb.WriteByte(src[i])
+			}
+			i++
+			if c == '"' {
+				toks = append(toks, token{kind: TOK_IDENT, text: sb.String(), quoted: true, pos: start})
+			} else {
+				toks = append(toks, token{kind: TOK_STRING, text: sb.String(), pos: start})
+			}
+		default:
+			sym := src[i : i+1]
+			for _, op := range []string{"<=", ">=", "!=", "<>"} {
+				if strings.HasPrefix(src[i:], op) {
+					sym = op
+				}
+			}
+			if !strings.Contains("(),;*=<>+-/%!?", sym[:1]) || sym == "!" {
+				return nil, fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, sym, start)
+			}
+			i += len(sym)
+			toks = append(toks, token{kind: TOK_SYMBOL, text: sym, pos: start})
+		}
+	}
+	return append(toks, token{kind: TOK_EOF, pos: len(src)}), nil
+}
+
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '@'
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+type parser struct {
+	toks   []token
+	pos    int
+	params int // parameters of the statement so far
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	tok := p.peek()
+	what := strconv.Quote(tok.text)
+	if tok.kind == TOK_EOF {
+		what = "end of input"
+	}
+	return fmt.Errorf("%w: %s at %d near %s", ErrSyntax, fmt.Sprintf(format, args...), tok.pos, what)
+}
+
+// consumes the keyword if it is next
+func (p *parser) keyword(kws ...string) bool {
+	for i, kw := range kws {
+		tok := p.toks[min(p.pos+i, len(p.toks)-1)]
+		if tok.kind != TOK_IDENT || tok.quoted || !strings.EqualFold(tok.text, kw) {
+			return false
+		}
+	}
+	p.pos += len(kws)
+	return true
+}
+
+func (p *parser) expectKeyword(kws ...string) error {
+	if !p.keyword(kws...) {
+		return p.errorf("expect %s", strings.Join(kws, " "))
+	}
+	return nil
+}
+
+// consumes the symbol if it is next
+func (p *parser) symbol(sym string) bool {
+	if tok := p.peek(); tok.kind == TOK_SYMBOL && tok.text == sym {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectSymbol(sym string) error {
+	if !p.symbol(sym) {
+		return p.errorf("expect %q", sym)
+	}
+	return nil
+}
+
+var keywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "INSERT": true, "INTO": true,
+	"VALUES": true, "UPDATE": true, "SET": true, "DELETE": true, "CREATE": true,
+	"TABLE": true, "PRIMARY": true, "KEY": true, "INDEX": true, "AND": true,
+	"OR": true, "NOT": true, "IS": true, "NULL": true, "TRUE": true, "FALSE": true,
+	"AS": true, "ORDER": true, "BY": true, "ASC": true, "DESC": true, "LIMIT": true,
+	"OFFSET": true, "GROUP": true, "MATCH": true,
+}
+
+func (p *parser) name() (string, error) {
+	tok := p.peek()
+	if tok.kind != TOK_IDENT || (!tok.quoted && keywords[strings.ToUpper(tok.text)]) {
+		return "", p.errorf("expect a name")
+	}
+	p.pos++
+	return tok.text, nil
+}
+
+// a, b, c
+func (p *parser) names() ([]string, error) {
+	var names []string
+	for {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.symbol(",") {
+			return names, nil
+		}
+	}
+}
+
+// parses one statement, a trailing semicolon is allowed
+func Parse(src string) (Stmt, error) {
+	stmts, err := ParseAll(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(stmts) != 1 {
+		return nil, fmt.Errorf("%w: %d statements, expect 1", ErrSyntax, len(stmts))
+	}
+	return stmts[0], nil
+}
+
+// parses statements separated by semicolons
+func ParseAll(src string) ([]Stmt, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	var stmts []Stmt
+	for p.peek().kind != TOK_EOF {
+		if p.symbol(";") {
+			continue
+		}
+		p.params = 0
+		stmt, err := p.stmt()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+		if p.peek().kind != TOK_EOF && !p.symbol(";") {
+			return nil, p.errorf("expect the end of the statement")
+		}
+	}
+	return stmts, nil
+}
+
+// reports whether `src` ends with a semicolon outside of quotes and
+// comments, for reading statements that span lines
+func Complete(src string) bool {
+	end := false
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			continue
+		case c == '-' && strings.HasPrefix(src[i:], "--"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '\'' || c == '"':
+			// a doubled quote closes and reopens
+			for i++; i < len(src) && src[i] != c; i++ {
+			}
+			if i >= len(src) {
+				return false
+			}
+		}
+		end = c == ';'
+	}
+	return end
+}
+
+func (p *parser) stmt() (Stmt, error) {
+	switch {
+	case p.keyword("SELECT"):
+		return p.selectStmt()
+	case p.keyword("INSERT", "INTO"):
+		return p.insertStmt()
+	case p.keyword("UPDATE"):
+		return p.updateStmt()
+	case p.keyword("DELETE", "FROM"):
+		return p.deleteStmt()
+	case p.keyword("CREATE", "TABLE"):
+		return p.createTable()
+	}
+	return nil, p.errorf("expect a statement")
+}
+
+var typeNames = map[string]uint32{
+	"INT": table.TYPE_INT64, "INT64": table.TYPE_INT64, "INTEGER": table.TYPE_INT64,
+	"FLOAT": table.TYPE_FLOAT64, "FLOAT64": table.TYPE_FLOAT64, "DOUBLE": table.TYPE_FLOAT64,
+	"BOOL": table.TYPE_BOOL, "BOOLEAN": table.TYPE_BOOL,
+	"STRING": table.TYPE_STRING, "TEXT": table.TYPE_STRING,
+	"BYTES": table.TYPE_BYTES, "BLOB": table.TYPE_BYTES,
+	"TIME": table.TYPE_TIME, "TIMESTAMP": table.TYPE_TIME,
+}
+
+// the primary key is the first column unless declared
+func (p *parser) createTable() (*CreateTable, error) {
+	stmt := &CreateTable{}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Def.Name = name
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	var pkey []string
+	for {
+		switch {
+		case p.keyword("PRIMARY", "KEY"):
+			if pkey != nil {
+				return nil, p.errorf("duplicate primary key")
+			}
+			if pkey, err = p.parenNames(); err != nil {
+				return nil, err
+			}
+		case p.keyword("INDEX"):
+			index, err := p.parenNames()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Def.Indexes = append(stmt.Def.Indexes, index)
+		case p.keyword("BITMAP", "INDEX"):
+			cols, err := p.parenNames()
+			if err != nil {
+				return nil, err
+			}
+			if len(cols) != 1 {
+				return nil, p.errorf("a bitmap index has one column")
+			}
+			stmt.Def.Bitmaps = append(stmt.Def.Bitmaps, cols[0])
+		case p.keyword("FULLTEXT", "INDEX"):
+			cols, err := p.parenNames()
+			if err != nil {
+				return nil, err
+			}
+			if len(cols) != 1 {
+				return nil, p.errorf("a full-text index has one column")
+			}
+			stmt.Def.FullText = append(stmt.Def.FullText, cols[0])
+		default:
+			col, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			typ, ok := typeNames[strings.ToUpper(p.peek().text)]
+			if !ok || p.peek().kind != TOK_IDENT {
+				return nil, p.errorf("expect a column type")
+			}
+			p.pos++
+			stmt.Def.Cols = append(stmt.Def.Cols, col)
+			stmt.Def.Types = append(stmt.Def.Types, typ)
+		}
+		if !p.symbol(",") {
+			break
+		}
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	if err := reorderPKey(&stmt.Def, pkey); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// (a, b)
+func (p *parser) parenNames() ([]string, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	names, err := p.names()
+	if err != nil {
+		return nil, err
+	}
+	return names, p.expectSymbol(")")
+}
+
+// moves the primary key columns first, the table layer keeps them there
+func reorderPKey(tdef *table.TableDef, pkey []string) error {
+	if pkey == nil {
+		tdef.PKeys = 1
+		return nil
+	}
+	var cols []string
+	var types []uint32
+	for _, name := range pkey {
+		i := indexOf(tdef.Cols, name)
+		if i < 0 || indexOf(cols, name) >= 0 {
+			return fmt.Errorf("%w: bad primary key column %s", ErrSyntax, name)
+		}
+		cols = append(cols, name)
+		types = append(types, tdef.Types[i])
+	}
+	for i, name := range tdef.Cols {
+		if indexOf(pkey, name) < 0 {
+			cols = append(cols, name)
+			types = append(types, tdef.Types[i])
+		}
+	}
+	tdef.Cols, tdef.Types, tdef.PKeys = cols, types, len(pkey)
+	return nil
+}
+
+func indexOf(list []string, s string) int {
+	for i, item := range list {
+		if item == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *parser) selectStmt() (*Select, error) {
+	stmt := &Select{}
+	if !p.symbol("*") {
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			item := SelectExpr{Expr: e}
+			if p.keyword("AS") {
+				if item.Name, err = p.name(); err != nil {
+					return nil, err
+				}
+			} else if col, ok := e.(*ExprCol); ok {
+				item.Name = col.Name
+			}
+			stmt.Exprs = append(stmt.Exprs, item)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	var err error
+	if stmt.Table, err = p.name(); err != nil {
+		return nil, err
+	}
+	if stmt.Where, err = p.where(); err != nil {
+		return nil, err
+	}
+	if p.keyword("GROUP") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			stmt.GroupBy = append(stmt.GroupBy, e)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	if p.keyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			item := OrderItem{Expr: e}
+			if p.keyword("DESC") {
+				item.Desc = true
+			} else {
+				p.keyword("ASC")
+			}
+			stmt.OrderBy = append(stmt.OrderBy, item)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	if p.keyword("LIMIT") {
+		if stmt.Limit, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("OFFSET") {
+		if stmt.Offset, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// nil if there is no WHERE
+func (p *parser) where() (Expr, error) {
+	if !p.keyword("WHERE") {
+		return nil, nil
+	}
+	return p.expr()
+}
+
+func (p *parser) insertStmt() (*Insert, error) {
+	stmt := &Insert{}
+	var err error
+	if stmt.Table, err = p.name(); err != nil {
+		return nil, err
+	}
+	if p.peek().text == "(" {
+		if stmt.Cols, err = p.parenNames(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		var row []Expr
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, e)
+			if !p.symbol(",") {
+				break
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		stmt.Rows = append(stmt.Rows, row)
+		if !p.symbol(",") {
+			return stmt, nil
+		}
+	}
+}
+
+func (p *parser) updateStmt() (*Update, error) {
+	stmt := &Update{}
+	var err error
+	if stmt.Table, err = p.name(); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, err
+	}
+	for {
+		col, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol("="); err != nil {
+			return nil, err
+		}
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Set = append(stmt.Set, Assign{Col: col, Expr: e})
+		if !p.symbol(",") {
+			break
+		}
+	}
+	stmt.Where, err = p.where()
+	return stmt, err
+}
+
+func (p *parser) deleteStmt() (*Delete, error) {
+	stmt := &Delete{}
+	var err error
+	if stmt.Table, err = p.name(); err != nil {
+		return nil, err
+	}
+	stmt.Where, err = p.where()
+	return stmt, err
+}
+
+// precedence climbing, from the lowest:
+// OR, AND, NOT, comparisons, IS and MATCH, + -, * / %, unary -
+func (p *parser) expr() (Expr, error) {
+	return p.exprOr()
+}
+
+func (p *parser) exprOr() (Expr, error) {
+	l, err := p.exprAnd()
+	for err == nil && p.keyword("OR") {
+		var r Expr
+		r, err = p.exprAnd()
+		l = &ExprBinary{Op: "OR", L: l, R: r}
+	}
+	return l, err
+}
+
+func (p *parser) exprAnd() (Expr, error) {
+	l, err := p.exprNot()
+	for err == nil && p.keyword("AND") {
+		var r Expr
+		r, err = p.exprNot()
+		l = &ExprBinary{Op: "AND", L: l, R: r}
+	}
+	return l, err
+}
+
+func (p *parser) exprNot() (Expr, error) {
+	if p.keyword("NOT") {
+		x, err := p.exprNot()
+		return &ExprUnary{Op: "NOT", X: x}, err
+	}
+	return p.exprCmp()
+}
+
+func (p *parser) exprCmp() (Expr, error) {
+	l, err := p.exprAdd()
+	if err != nil {
+		return nil, err
+	}
+	if p.keyword("IS") {
+		not := p.keyword("NOT")
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		return &ExprIsNull{X: l, Not: not}, nil
+	}
+	if p.keyword("MATCH") {
+		r, err := p.exprAdd()
+		return &ExprBinary{Op: "MATCH", L: l, R: r}, err
+	}
+	for _, op := range []string{"=", "!=", "<>", "<=", ">=", "<", ">"} {
+		if p.symbol(op) {
+			if op == "<>" {
+				op = "!="
+			}
+			r, err := p.exprAdd()
+			return &ExprBinary{Op: op, L: l, R: r}, err
+		}
+	}
+	return l, nil
+}
+
+func (p *parser) exprAdd() (Expr, error) {
+	l, err := p.exprMul()
+	for err == nil {
+		op := p.peek().text
+		if p.peek().kind != TOK_SYMBOL || (op != "+" && op != "-") {
+			break
+		}
+		p.pos++
+		var r Expr
+		r, err = p.exprMul()
+		l = &ExprBinary{Op: op, L: l, R: r}
+	}
+	return l, err
+}
+
+func (p *parser) exprMul() (Expr, error) {
+	l, err := p.exprUnary()
+	for err == nil {
+		op := p.peek().text
+		if p.peek().kind != TOK_SYMBOL || (op != "*" && op != "/" && op != "%") {
+			break
+		}
+		p.pos++
+		var r Expr
+		r, err = p.exprUnary()
+		l = &ExprBinary{Op: op, L: l, R: r}
+	}
+	return l, err
+}
+
+func (p *parser) exprUnary() (Expr, error) {
+	if p.symbol("-") {
+		x, err := p.exprUnary()
+		return &ExprUnary{Op: "-", X: x}, err
+	}
+	return p.exprAtom()
+}
+
+func (p *parser) exprAtom() (Expr, error) {
+	tok := p.peek()
+	switch {
+	case p.symbol("("):
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expectSymbol(")")
+	case p.symbol("?"):
+		p.params++
+		return &ExprParam{N: p.params - 1}, nil
+	case tok.kind == TOK_NUMBER:
+		p.pos++
+		if i, err := strconv.ParseInt(tok.text, 10, 64); err == nil {
+			return &ExprLit{Val: table.Int64(i)}, nil
+		}
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			p.pos--
+			return nil, p.errorf("bad number")
+		}
+		return &ExprLit{Val: table.Float64(f)}, nil
+	case tok.kind == TOK_STRING:
+		p.pos++
+		return &ExprLit{Val: table.String(tok.text)}, nil
+	case p.keyword("NULL"):
+		return &ExprLit{Val: table.Null()}, nil
+	case p.keyword("TRUE"):
+		return &ExprLit{Val: table.Bool(true)}, nil
+	case p.keyword("FALSE"):
+		return &ExprLit{Val: table.Bool(false)}, nil
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, p.errorf("expect an expression")
+	}
+	if tok.quoted || !p.symbol("(") {
+		return &ExprCol{Name: name}, nil
+	}
+	call := &ExprCall{Name: strings.ToUpper(name)}
+	if p.symbol("*") {
+		call.Star = true
+		return call, p.expectSymbol(")")
+	}
+	if p.symbol(")") {
+		return call, nil
+	}
+	for {
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	return call, p.expectSymbol(")")
+}
@@ -0,0 +1,155 @@
+package sql
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"godb/internal/table"
+)
+
+func TestParse(t *testing.T) {
+	col := func(name string) Expr { return &ExprCol{Name: name} }
+	lit := func(v table.Value) Expr { return &ExprLit{Val: v} }
+	bin := func(op string, l, r Expr) Expr { return &ExprBinary{Op: op, L: l, R: r} }
+
+	cases := []struct {
+		src  string
+		want Stmt
+	}{
+		{
+			"select a, b + 1 as c from t where a > 1 and not b is null",
+			&Select{
+				Table: "t",
+				Exprs: []SelectExpr{{col("a"), "a"}, {bin("+", col("b"), lit(table.Int64(1))), "c"}},
+				Where: bin("AND", bin(">", col("a"), lit(table.Int64(1))), &ExprUnary{Op: "NOT", X: &ExprIsNull{X: col("b")}}),
+			},
+		},
+		{
+			"SELECT * FROM t WHERE a = 1 OR a <> -2.5 * (3 - b) % 2;",
+			&Select{
+				Table: "t",
+				Where: bin("OR",
+					bin("=", col("a"), lit(table.Int64(1))),
+					bin("!=", col("a"), bin("%", bin("*", &ExprUnary{Op: "-", X: lit(table.Float64(2.5))}, bin("-", lit(table.Int64(3)), col("b"))), lit(table.Int64(2))))),
+			},
+		},
+		{
+			"SELECT a FROM t ORDER BY a DESC, b + 1 ASC, c LIMIT 10 OFFSET 2 * 5",
+			&Select{
+				Table:   "t",
+				Exprs:   []SelectExpr{{col("a"), "a"}},
+				OrderBy: []OrderItem{{col("a"), true}, {bin("+", col("b"), lit(table.Int64(1))), false}, {col("c"), false}},
+				Limit:   lit(table.Int64(10)),
+				Offset:  bin("*", lit(table.Int64(2)), lit(table.Int64(5))),
+			},
+		},
+		{
+			"SELECT b, count(*), SUM(a + 1) FROM t GROUP BY b, c ORDER BY MAX(a)",
+			&Select{
+				Table: "t",
+				Exprs: []SelectExpr{
+					{col("b"), "b"},
+					{&ExprCall{Name: "COUNT", Star: true}, ""},
+					{&ExprCall{Name: "SUM", Args: []Expr{bin("+", col("a"), lit(table.Int64(1)))}}, ""},
+				},
+				GroupBy: []Expr{col("b"), col("c")},
+				OrderBy: []OrderItem{{&ExprCall{Name: "MAX", Args: []Expr{col("a")}}, false}},
+			},
+		},
+		{
+			`INSERT INTO t (a, "select") VALUES (1, 'it''s'), (NULL, TRUE)`,
+			&Insert{Table: "t", Cols: []string{"a", "select"}, Rows: [][]Expr{
+				{lit(table.Int64(1)), lit(table.String("it's"))},
+				{lit(table.Null()), lit(table.Bool(true))},
+			}},
+		},
+		{
+			"UPDATE t SET a = a + 1, b = 'x' WHERE b IS NOT NULL -- comment",
+			&Update{Table: "t", Set: []Assign{{"a", bin("+", col("a"), lit(table.Int64(1)))}, {"b", lit(table.String("x"))}}, Where: &ExprIsNull{X: col("b"), Not: true}},
+		},
+		{
+			"DELETE FROM t",
+			&Delete{Table: "t"},
+		},
+		{
+			"DELETE FROM t WHERE a = ? OR a > ?",
+			&Delete{Table: "t", Where: bin("OR", bin("=", col("a"), &ExprParam{N: 0}), bin(">", col("a"), &ExprParam{N: 1}))},
+		},
+		{
+			"CREATE TABLE t (a INT, b STRING, c FLOAT64, PRIMARY KEY (b, a), INDEX (c))",
+			&CreateTable{Def: table.TableDef{
+				Name:    "t",
+				Cols:    []string{"b", "a", "c"},
+				Types:   []uint32{table.TYPE_STRING, table.TYPE_INT64, table.TYPE_FLOAT64},
+				PKeys:   2,
+				Indexes: [][]string{{"c"}},
+			}},
+		},
+	}
+	for _, c := range cases {
+		got, err := Parse(c.src)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", c.src, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("Parse(%q) = %#v; want %#v", c.src, got, c.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	bad := []string{
+		"",
+		"SELECT FROM t",
+		"SELECT a FROM",
+		"SELECT a FROM t WHERE",
+		"SELECT a FROM t; DELETE FROM t",
+		"SELECT 'a FROM t",
+		"SELECT a FROM t x",
+		"INSERT INTO t VALUES (1,)",
+		"UPDATE t SET a",
+		"CREATE TABLE t (a WHAT)",
+		"CREATE TABLE t (a INT, PRIMARY KEY (b))",
+		"SELECT a ! b FROM t",
+		"SELECT select FROM t",
+		"SELECT a FROM t ORDER a",
+		"SELECT a FROM t LIMIT",
+		"SELECT a FROM t OFFSET 1 LIMIT 2",
+		"SELECT COUNT(* FROM t",
+		"SELECT SUM(a,) FROM t",
+		"SELECT a FROM t GROUP a",
+	}
+	for _, src := range bad {
+		if _, err := Parse(src); !errors.Is(err, ErrSyntax) {
+			t.Errorf("Parse(%q) = %v; want ErrSyntax", src, err)
+		}
+	}
+	stmts, err := ParseAll("DELETE FROM a; ; DELETE FROM b;")
+	if err != nil || len(stmts) != 2 {
+		t.Fatalf("ParseAll() = %v, %v", stmts, err)
+	}
+}
+
+func TestComplete(t *testing.T) {
+	cases := map[string]bool{
+		"":                              false,
+		"SELECT a FROM t":               false,
+		"SELECT a FROM t;":              true,
+		"SELECT a\nFROM t;  \n":         true,
+		"SELECT a FROM t; -- done":      true,
+		"SELECT a FROM t -- x;":         false,
+		"SELECT 'a;":                    false,
+		"SELECT 'a;';":                  true,
+		"SELECT 'it''s;":                false,
+		"SELECT 'it''s';":               true,
+		`SELECT "a;" FROM t`:            false,
+		"DELETE FROM a; DELETE FROM b":  false,
+		"DELETE FROM a; DELETE FROM b;": true,
+	}
+	for src, want := range cases {
+		if got := Complete(src); got != want {
+			t.Errorf("Complete(%q) = %v; want %v", src, got, want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package sql
+
+import (
+	"godb/internal/table"
+)
+
+// The planner turns the conditions of WHERE into a range of the primary key
+// or of an index. WHERE is split into AND-ed conditions; `col op constant`
+// conditions on the leading columns of a path bound the scan:
+//
+//	a = 1 AND b = 2 AND c > 3    on (a, b, c, ...)  ->  (1, 2, 3) < key <= (1, 2)
+//
+// the path with the most equalities wins, a range on the next column
+// breaks ties, then a path that returns the rows in the ORDER BY order,
+// then the primary key, which needs no lookups. the whole condition is
+// still evaluated on the rows, the range only skips rows.
+//
+// a path is in the ORDER BY order if the ORDER BY columns, without those
+// fixed by equalities, are the next columns of the path in one direction.
+// DESC scans the range backward.
+//
+// the range is exact if every condition is one of its bounds, the rows of
+// an exact range can be counted without reading them.
+//
+// bitmap indexes answer `col = constant` on their columns and AND and OR
+// of them, the bitmap of WHERE is computed before any row is read:
+//
+//	status = 'open' AND (region = 'eu' OR region = 'us')  ->  open & (eu | us)
+//
+// an AND with a side no bitmap answers keeps the other side, which has
+// more rows than the condition. the bitmaps are used instead of a range
+// if they combine more conditions than the equalities of the range.
+//
+// `col MATCH 'terms'` on a column with a full-text index reads the rows
+// containing the terms from the index when no range has equalities.
+
+// `col op val`, val is converted to the column type
+type pred struct {
+	col string
+	op  string
+	val table.Value
+}
+
+// AND-ed conditions
+func conjuncts(e Expr, out []Expr) []Expr {
+	if b, ok := e.(*ExprBinary); ok && b.Op == "AND" {
+		return conjuncts(b.R, conjuncts(b.L, out))
+	}
+	if e != nil {
+		out = append(out, e)
+	}
+	return out
+}
+
+var flipped = map[string]string{"=": "=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+// conditions usable as scan bounds
+func predicates(tdef *table.TableDef, where Expr) []pred {
+	var preds []pred
+	for _, e := range conjuncts(where, nil) {
+		if p, ok := predicate(tdef, e); ok {
+			preds = append(preds, p)
+		}
+	}
+	return preds
+}
+
+// `col op constant` or `constant op col`
+func predicate(tdef *table.TableDef, e Expr) (pred, bool) {
+	b, ok := e.(*ExprBinary)
+	if !ok || flipped[b.Op] == "" {
+		return pred{}, false
+	}
+	col, lcol := b.L.(*ExprCol)
+	lit, rlit := b.R.(*ExprLit)
+	op := b.Op
+	if !lcol || !rlit {
+		col, lcol = b.R.(*ExprCol)
+		lit, rlit = b.L.(*ExprLit)
+		op = flipped[op]
+	}
+	if !lcol || !rlit || lit.Val.IsNull() {
+		return pred{}, false
+	}
+	i := indexOf(tdef.Cols, col.Name)
+	if i < 0 {
+		return pred{}, false
+	}
+	val, err := coerce(lit.Val, tdef.Types[i])
+	if err != nil {
+		return pred{}, false // reported by the filter
+	}
+	return pred{col: col.Name, op: op, val: val}, true
+}
+
+func findPred(preds []pred, col string, ops ...string) *pred {
+	for i := range preds {
+		if preds[i].col == col && indexOf(ops, preds[i].op) >= 0 {
+			return &preds[i]
+		}
+	}
+	return nil
+}
+
+// whether the scan of `path` returns rows in the `order` order, and backward
+func ordered(path []string, eq int, preds []pred, order []OrderItem) (ok bool, desc bool) {
+	next := eq
+	for i, item := range order {
+		col, isCol := item.Expr.(*ExprCol)
+		switch {
+		case !isCol:
+			return false, false
+		case findPred(preds, col.Name, "=") != nil:
+			continue // the same in all rows
+		case next == len(path):
+			return true, desc // the path is unique
+		case col.Name != path[next] || next > eq && item.Desc != desc:
+			return false, false
+		}
+		desc = order[i].Desc
+		next++
+	}
+	return true, desc
+}
+
+type scanPlan struct {
+	sc      table.Scanner
+	bitmap  *bitmapCond // the rows of bitmaps instead of the range
+	match   *pred       // the rows of a full-text index instead of the range
+	ordered bool        // the rows are in the ORDER BY order
+	exact   bool        // the range has only the rows matching WHERE
+}
+
+// `col MATCH 'terms'` on a full-text index
+func planMatch(tdef *table.TableDef, where Expr) *pred {
+	for _, e := range conjuncts(where, nil) {
+		b, ok := e.(*ExprBinary)
+		if !ok || b.Op != "MATCH" {
+			continue
+		}
+		col, isCol := b.L.(*ExprCol)
+		lit, isLit := b.R.(*ExprLit)
+		if isCol && isLit && isText(lit.Val) && indexOf(tdef.FullText, col.Name) >= 0 {
+			return &pred{col: col.Name, op: "MATCH", val: lit.Val}
+		}
+	}
+	return nil
+}
+
+// `col = val` on a bitmap index, or AND and OR of two conditions
+type bitmapCond struct {
+	op   string
+	col  string
+	val  table.Value
+	l, r *bitmapCond
+}
+
+// number of equalities
+func (c *bitmapCond) leaves() int {
+	if c.op == "=" {
+		return 1
+	}
+	return c.l.leaves() + c.r.leaves()
+}
+
+// the bitmap condition of `e`, nil if none, and whether it has only
+// the rows matching `e`
+func planBitmap(tdef *table.TableDef, e Expr) (*bitmapCond, bool) {
+	b, ok := e.(*ExprBinary)
+	if !ok {
+		return nil, false
+	}
+	if b.Op != "AND" && b.Op != "OR" {
+		p, ok := predicate(tdef, e)
+		if !ok || p.op != "=" || indexOf(tdef.Bitmaps, p.col) < 0 {
+			return nil, false
+		}
+		return &bitmapCond{op: "=", col: p.col, val: p.val}, true
+	}
+	l, lexact := planBitmap(tdef, b.L)
+	r, rexact := planBitmap(tdef, b.R)
+	switch {
+	case l != nil && r != nil:
+		return &bitmapCond{op: b.Op, l: l, r: r}, lexact && rexact
+	case b.Op == "AND" && l != nil:
+		return l, false
+	case b.Op == "AND" && r != nil:
+		return r, false
+	}
+	return nil, false
+}
+
+// the scan of the best path, a full scan of the table if nothing applies
+func planScan(tdef *table.TableDef, where Expr, order []OrderItem) scanPlan {
+	preds := predicates(tdef, where)
+	paths := append([][]string{tdef.Cols[:tdef.PKeys]}, tdef.Indexes...)
+	// every condition is a bound of the range
+	bounds := len(conjuncts(where, nil))
+
+	best := scanPlan{}
+	bestScore, bestEq := -1, 0
+	for i, path := range paths {
+		var eq table.Record
+		for _, col := range path {
+			p := findPred(preds, col, "=")
+			if p == nil {
+				break
+			}
+			eq.Add(col, p.val)
+		}
+		score := 4 * len(eq.Cols)
+		var lo, hi *pred
+		if len(eq.Cols) < len(path) {
+			next := path[len(eq.Cols)]
+			lo = findPred(preds, next, ">", ">=")
+			hi = findPred(preds, next, "<", "<=")
+			if lo != nil || hi != nil {
+				score += 2
+			}
+		}
+		inOrder, desc := false, false
+		if len(order) > 0 {
+			if inOrder, desc = ordered(path, len(eq.Cols), preds, order); inOrder {
+				score++
+			}
+		}
+		if score <= bestScore {
+			continue
+		}
+		bestScore, bestEq = score, len(eq.Cols)
+		used := len(eq.Cols)
+		if lo != nil {
+			used++
+		}
+		if hi != nil {
+			used++
+			// NULL sorts first and is in the range without a lower bound
+			if lo == nil && indexOf(tdef.Cols[:tdef.PKeys], hi.col) < 0 {
+				used = -1
+			}
+		}
+
+		// the keys of an index can match another path
+		sc := table.Scanner{Cmp1: table.CMP_GE, Key1: eq, Path: i}
+		if lo != nil {
+			sc.Key1 = withValue(eq, lo)
+			sc.Cmp1 = map[string]int{">": table.CMP_GT, ">=": table.CMP_GE}[lo.op]
+		}
+		if hi != nil {
+			sc.Key2 = withValue(eq, hi)
+			sc.Cmp2 = map[string]int{"<": table.CMP_LT, "<=": table.CMP_LE}[hi.op]
+		} else if len(eq.Cols) > 0 {
+			sc.Key2, sc.Cmp2 = eq, table.CMP_LE
+		}
+		if desc {
+			sc = reversed(sc)
+		}
+		best = scanPlan{sc: sc, ordered: inOrder, exact: used == bounds && used == len(preds)}
+	}
+	if m := planMatch(tdef, where); m != nil && bestEq == 0 {
+		return scanPlan{match: m, exact: bounds == 1}
+	}
+	if bm, exact := planBitmap(tdef, where); bm != nil && bm.leaves() > bestEq {
+		return scanPlan{bitmap: bm, exact: exact}
+	}
+	return best
+}
+
+// the same range scanned from the end
+func reversed(sc table.Scanner) table.Scanner {
+	out := table.Scanner{Cmp1: sc.Cmp2, Key1: sc.Key2, Cmp2: sc.Cmp1, Key2: sc.Key1, Path: sc.Path}
+	if out.Cmp1 == 0 {
+		out.Cmp1 = table.CMP_LE
+	}
+	return out
+}
+
+func withValue(rec table.Record, p *pred) table.Record {
+	out := table.Record{Cols: append([]string{}, rec.Cols...), Vals: append([]table.Value{}, rec.Vals...)}
+	return *out.Add(p.col, p.val)
+}
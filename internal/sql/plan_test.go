@@ -0,0 +1,281 @@
+package sql
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"godb/internal/table"
+)
+
+func TestPlanScan(t *testing.T) {
+	tdef := &table.TableDef{
+		Name:    "t",
+		Cols:    []string{"a", "b", "c", "d"},
+		Types:   []uint32{table.TYPE_INT64, table.TYPE_INT64, table.TYPE_STRING, table.TYPE_FLOAT64},
+		PKeys:   2,
+		Indexes: [][]string{{"c", "a", "b"}, {"d", "a", "b"}},
+	}
+	// the scan as `Cmp1 Key1 .. Cmp2 Key2`
+	show := func(sc table.Scanner) string {
+		key := func(rec table.Record) string {
+			s := ""
+			for i, col := range rec.Cols {
+				s += fmt.Sprintf("%s=%s ", col, rec.Vals[i])
+			}
+			return s
+		}
+		return fmt.Sprintf("%d %s.. %d %s", sc.Cmp1, key(sc.Key1), sc.Cmp2, key(sc.Key2))
+	}
+	cases := []struct{ where, want string }{
+		{"c = 'x' OR a = 1", "1 .. 0 "},
+		{"a = 1", "1 a=1 .. 4 a=1 "},
+		{"1 = a AND b = 2", "1 a=1 b=2 .. 4 a=1 b=2 "},
+		{"a = 1 AND b > 2 AND b <= 5", "2 a=1 b=2 .. 4 a=1 b=5 "},
+		{"a >= 3", "1 a=3 .. 0 "},
+		{"5 > a", "1 .. 3 a=5 "},
+		{"b = 1", "1 .. 0 "},
+		{"c = 'x' AND a > 1", "2 c=x a=1 .. 4 c=x "},
+		{"c = 'x' AND a = 1", "1 c=x a=1 .. 4 c=x a=1 "},
+		{"a = 1 AND c > 'x'", "1 a=1 .. 4 a=1 "},
+		{"c = 'x' AND a = 1 AND b < 0", "1 c=x a=1 .. 3 c=x a=1 b=0 "},
+		{"d < 2", "1 .. 3 d=2 "}, // the int is converted for the float column
+		{"a = 1.5", "1 .. 0 "},
+		{"a = NULL", "1 .. 0 "},
+		{"a = b", "1 .. 0 "},
+	}
+	for _, c := range cases {
+		stmt, err := Parse("SELECT * FROM t WHERE " + c.where)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := show(planScan(tdef, stmt.(*Select).Where, nil).sc); got != c.want {
+			t.Errorf("planScan(%s) = %q; want %q", c.where, got, c.want)
+		}
+	}
+}
+
+func TestPlanOrder(t *testing.T) {
+	tdef := &table.TableDef{
+		Name:    "t",
+		Cols:    []string{"a", "b", "c", "d"},
+		Types:   []uint32{table.TYPE_INT64, table.TYPE_INT64, table.TYPE_STRING, table.TYPE_FLOAT64},
+		PKeys:   2,
+		Indexes: [][]string{{"c", "a", "b"}, {"d", "a", "b"}},
+	}
+	// the path, the bounds and whether the scan is in order
+	cases := []struct{ where, order, want string }{
+		{"", "a", "0 1 .. 0 true"},
+		{"", "a DESC, b DESC", "0 4 .. 1 true"},
+		{"", "a, b DESC", "0 1 .. 0 false"},
+		{"", "b", "0 1 .. 0 false"},
+		{"", "a + 1", "0 1 .. 0 false"},
+		{"", "c", "1 1 .. 0 true"},
+		{"", "d, a, b, c", "2 1 .. 0 true"},
+		{"c = 'x'", "a DESC", "1 4 c=x .. 1 c=x true"},
+		{"c = 'x'", "c, a", "1 1 c=x .. 4 c=x true"},
+		{"a = 1", "c", "0 1 a=1 .. 4 a=1 false"},
+		{"a = 1", "b DESC", "0 4 a=1 .. 1 a=1 true"},
+		{"a > 1", "a DESC", "0 4 .. 2 a=1 true"},
+		{"d > 1", "a", "2 2 d=1 .. 0 false"},
+	}
+	for _, c := range cases {
+		stmt, err := Parse("SELECT * FROM t ORDER BY " + c.order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var where Expr
+		if c.where != "" {
+			if where, err = parseExpr(c.where); err != nil {
+				t.Fatal(err)
+			}
+		}
+		plan := planScan(tdef, where, stmt.(*Select).OrderBy)
+		sc, ok := plan.sc, plan.ordered
+		key := func(rec table.Record) string {
+			s := ""
+			for i, col := range rec.Cols {
+				s += fmt.Sprintf("%s=%s ", col, rec.Vals[i])
+			}
+			return s
+		}
+		got := fmt.Sprintf("%d %d %s.. %d %s%v", sc.Path, sc.Cmp1, key(sc.Key1), sc.Cmp2, key(sc.Key2), ok)
+		if got != c.want {
+			t.Errorf("WHERE %s ORDER BY %s = %q; want %q", c.where, c.order, got, c.want)
+		}
+	}
+}
+
+func TestPlanExact(t *testing.T) {
+	tdef := &table.TableDef{
+		Name:    "t",
+		Cols:    []string{"a", "b", "c", "d"},
+		Types:   []uint32{table.TYPE_INT64, table.TYPE_INT64, table.TYPE_STRING, table.TYPE_FLOAT64},
+		PKeys:   2,
+		Indexes: [][]string{{"c", "a", "b"}},
+	}
+	cases := []struct {
+		where string
+		exact bool
+	}{
+		{"a = 1", true},
+		{"a = 1 AND b > 2 AND b <= 5", true},
+		{"a < 5", true},
+		{"c = 'x' AND a > 1", true},
+		{"c > 'x'", true},
+		{"c < 'x'", false}, // NULL is in the range
+		{"c > 'a' AND c < 'x'", true},
+		{"a = 1 AND c = 'x'", true},
+		{"a = 1 AND d = 2", false},
+		{"a > 1 AND a > 2", false},
+		{"b = 1", false},
+		{"a = 1 OR a = 2", false},
+		{"a = 1.5", false},
+	}
+	for _, c := range cases {
+		where, err := parseExpr(c.where)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := planScan(tdef, where, nil).exact; got != c.exact {
+			t.Errorf("planScan(%s).exact = %v; want %v", c.where, got, c.exact)
+		}
+	}
+}
+
+func parseExpr(src string) (Expr, error) {
+	stmt, err := Parse("SELECT * FROM t WHERE " + src)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.(*Select).Where, nil
+}
+
+// range scans return the same rows as filtering the whole table
+func TestPlanResults(t *testing.T) {
+	db := openDB(t)
+	mustExec(t, db, "CREATE TABLE t (a INT, b INT, c STRING, PRIMARY KEY (a, b), INDEX (c))")
+	r := rand.New(rand.NewSource(1))
+	tx := db.Begin()
+	for i := 0; i < 300; i++ {
+		src := fmt.Sprintf("INSERT INTO t VALUES (%d, %d, '%c')", r.Intn(10), i, 'a'+r.Intn(5))
+		if _, err := Exec(tx, src); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := []string{"=", "<", "<=", ">", ">="}
+	for i := 0; i < 200; i++ {
+		where := fmt.Sprintf("a %s %d AND c %s '%c'", ops[r.Intn(5)], r.Intn(12)-1, ops[r.Intn(5)], 'a'+r.Intn(6))
+		if r.Intn(2) == 0 {
+			where += fmt.Sprintf(" AND b %s %d", ops[r.Intn(5)], r.Intn(300))
+		}
+		got := query(t, db, "SELECT a, b FROM t WHERE "+where)
+		// NOT NOT hides the conditions from the planner
+		want := query(t, db, "SELECT a, b FROM t WHERE NOT NOT ("+where+")")
+		if sortLines(got) != sortLines(want) {
+			t.Fatalf("WHERE %s:\n%s\nwant\n%s", where, got, want)
+		}
+	}
+}
+
+func TestPlanBitmap(t *testing.T) {
+	tdef := &table.TableDef{
+		Name:    "t",
+		Cols:    []string{"a", "b", "c", "d"},
+		Types:   []uint32{table.TYPE_INT64, table.TYPE_INT64, table.TYPE_STRING, table.TYPE_FLOAT64},
+		PKeys:   1,
+		Indexes: [][]string{{"b", "a"}},
+		Bitmaps: []string{"b", "c"},
+	}
+	// the bitmap condition, "range" if a range is scanned
+	show := func(c *bitmapCond) string {
+		var s func(c *bitmapCond) string
+		s = func(c *bitmapCond) string {
+			if c.op == "=" {
+				return fmt.Sprintf("%s=%s", c.col, c.val)
+			}
+			return fmt.Sprintf("(%s %s %s)", s(c.l), c.op, s(c.r))
+		}
+		if c == nil {
+			return "range"
+		}
+		return s(c)
+	}
+	cases := []struct {
+		where, want string
+		exact       bool
+	}{
+		{"c = 'x'", "c=x", true},
+		{"b = 1", "range", true}, // the index has as many equalities
+		{"b = 1 AND c = 'x'", "(b=1 AND c=x)", true},
+		{"c = 'x' OR c = 'y'", "(c=x OR c=y)", true},
+		{"(c = 'x' OR c = 'y') AND d > 1", "(c=x OR c=y)", false},
+		{"c = 'x' AND (b = 1 OR d = 2)", "c=x", false},
+		{"c = 'x' OR d = 2", "range", false},
+		{"a = 1 AND c = 'x'", "range", false},
+		{"a = 1 AND b = 2 AND c = 'x'", "range", false}, // (b, a) has 2 equalities
+		{"c = 'x' AND b = 1.5", "c=x", false},
+		{"c > 'x'", "range", false},
+		{"NOT c = 'x'", "range", false},
+	}
+	for _, c := range cases {
+		where, err := parseExpr(c.where)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan := planScan(tdef, where, nil)
+		if got := show(plan.bitmap); got != c.want || plan.bitmap != nil && plan.exact != c.exact {
+			t.Errorf("planScan(%s) = %s, exact %v; want %s, %v", c.where, got, plan.exact, c.want, c.exact)
+		}
+	}
+}
+
+// bitmap scans return the same rows as filtering the whole table
+func TestBitmapResults(t *testing.T) {
+	db := openDB(t)
+	mustExec(t, db, "CREATE TABLE t (a INT, b INT, c STRING, BITMAP INDEX (b), BITMAP INDEX (c))")
+	r := rand.New(rand.NewSource(1))
+	tx := db.Begin()
+	for i := 0; i < 500; i++ {
+		src := fmt.Sprintf("INSERT INTO t VALUES (%d, %d, '%c')", i, r.Intn(4), 'a'+r.Intn(5))
+		if i%7 == 0 {
+			src = fmt.Sprintf("INSERT INTO t VALUES (%d, NULL, '%c')", i, 'a'+r.Intn(5))
+		}
+		if _, err := Exec(tx, src); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, db, "UPDATE t SET b = 9 WHERE c = 'a' AND b = 0; DELETE FROM t WHERE c = 'b' OR b = 3")
+
+	for i := 0; i < 100; i++ {
+		where := fmt.Sprintf("b = %d", r.Intn(5))
+		for n := r.Intn(3); n >= 0; n-- {
+			op := []string{"AND", "OR"}[r.Intn(2)]
+			next := fmt.Sprintf("c = '%c'", 'a'+r.Intn(6))
+			if r.Intn(3) == 0 {
+				next = fmt.Sprintf("a > %d", r.Intn(500))
+			}
+			where = fmt.Sprintf("(%s) %s %s", where, op, next)
+		}
+		got := query(t, db, "SELECT a FROM t WHERE "+where)
+		want := query(t, db, "SELECT a FROM t WHERE NOT NOT ("+where+")")
+		if sortLines(got) != sortLines(want) {
+			t.Fatalf("WHERE %s:\n%s\nwant\n%s", where, got, want)
+		}
+		count := query(t, db, "SELECT COUNT(*) FROM t WHERE "+where)
+		if want := fmt.Sprint(len(strings.Fields(want))); count != want {
+			t.Fatalf("COUNT(*) WHERE %s = %s, want %s", where, count, want)
+		}
+	}
+	if got := query(t, db, "SELECT COUNT(*) FROM t WHERE b = 9 AND c = 'a'"); got == "0" {
+		t.Fatal("no updated rows")
+	}
+}
@@ -0,0 +1,302 @@
+package sql
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"godb/internal/table"
+)
+
+// ORDER BY that the scan can't provide is an external merge sort: rows are
+// buffered until SortBuffer bytes, sorted and written to a temporary file
+// as a run, the runs are merged at the end. rows that fit in the buffer are
+// sorted in memory. a run is a sequence of
+//
+// | len     | sort keys and row |
+// | uvarint | row format        |
+//
+// with LIMIT only the first OFFSET+LIMIT rows are kept, the buffer is
+// truncated to them whenever it doubles.
+
+var (
+	SortBuffer = 16 << 20 // bytes of rows sorted or grouped in memory
+	TempDir    = ""       // for sort runs, os.TempDir if empty
+)
+
+// sorts the rows of the input by the ORDER BY keys
+type sortRows struct {
+	in   Rows
+	keys []Expr
+	desc []bool
+	keep int // rows needed, 0 for all
+
+	sorter *sorter
+	row    []table.Value
+	err    error
+}
+
+func (it *sortRows) Columns() []string  { return it.in.Columns() }
+func (it *sortRows) Row() []table.Value { return it.row }
+func (it *sortRows) Err() error         { return it.err }
+
+func (it *sortRows) Close() error {
+	err := it.in.Close()
+	if it.sorter != nil {
+		if serr := it.sorter.close(); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+func (it *sortRows) Next() bool {
+	if it.err == nil && it.sorter == nil {
+		it.err = it.sort()
+	}
+	if it.err != nil {
+		return false
+	}
+	var entry []table.Value
+	if entry, it.err = it.sorter.next(); entry == nil {
+		return false
+	}
+	it.row = entry[len(it.keys):]
+	return true
+}
+
+// orders entries by the sort keys
+func (it *sortRows) compare(a, b []table.Value) int {
+	for i, desc := range it.desc {
+		if c := table.Compare(a[i], b[i]); c != 0 {
+			if desc {
+				return -c
+			}
+			return c
+		}
+	}
+	return 0
+}
+
+// reads the input into the sorter
+func (it *sortRows) sort() error {
+	it.sorter = &sorter{cmp: it.compare, keep: it.keep}
+	cols := it.in.Columns()
+	for it.in.Next() {
+		row := it.in.Row()
+		entry := make([]table.Value, len(it.keys), len(it.keys)+len(row))
+		s := &scope{cols: cols, vals: row}
+		for i, e := range it.keys {
+			var err error
+			if entry[i], err = eval(e, s); err != nil {
+				return err
+			}
+		}
+		if err := it.sorter.add(append(entry, row...)); err != nil {
+			return err
+		}
+	}
+	if err := it.in.Err(); err != nil {
+		return err
+	}
+	return it.sorter.finish()
+}
+
+// sorts entries in memory or in runs of a temporary file
+type sorter struct {
+	cmp  func(a, b []table.Value) int
+	keep int // entries needed, 0 for all
+
+	buf  [][]table.Value
+	size int
+	file *os.File
+	runs []int64 // end offsets of the runs in the file
+	heap mergeHeap
+}
+
+func (s *sorter) add(entry []table.Value) error {
+	s.buf = append(s.buf, entry)
+	s.size += entrySize(entry)
+	if s.keep > 0 && len(s.buf)-s.keep >= s.keep {
+		s.truncate()
+	}
+	if s.size > SortBuffer {
+		return s.spill()
+	}
+	return nil
+}
+
+// sorts the buffer or starts merging the runs, after the last add
+func (s *sorter) finish() error {
+	if s.file == nil {
+		slices.SortStableFunc(s.buf, s.cmp)
+		return nil
+	}
+	if err := s.spill(); err != nil {
+		return err
+	}
+	return s.merge()
+}
+
+// the next entry in order, nil at the end
+func (s *sorter) next() ([]table.Value, error) {
+	if s.file == nil {
+		if len(s.buf) == 0 {
+			return nil, nil
+		}
+		entry := s.buf[0]
+		s.buf = s.buf[1:]
+		return entry, nil
+	}
+	if len(s.heap.runs) == 0 {
+		return nil, s.close()
+	}
+	run := s.heap.runs[0]
+	entry := run.entry
+	if err := run.next(); err != nil {
+		return nil, err
+	}
+	if run.entry == nil {
+		heap.Pop(&s.heap)
+	} else {
+		heap.Fix(&s.heap, 0)
+	}
+	return entry, nil
+}
+
+// removes the temporary file
+func (s *sorter) close() error {
+	s.buf, s.heap.runs = nil, nil
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	err := os.Remove(s.file.Name())
+	s.file = nil
+	return err
+}
+
+func (s *sorter) truncate() {
+	slices.SortStableFunc(s.buf, s.cmp)
+	clear(s.buf[s.keep:])
+	s.buf = s.buf[:s.keep]
+	s.size = 0
+	for _, entry := range s.buf {
+		s.size += entrySize(entry)
+	}
+}
+
+// writes the sorted buffer as a run
+func (s *sorter) spill() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	if s.file == nil {
+		f, err := os.CreateTemp(TempDir, "godb-sort-")
+		if err != nil {
+			return err
+		}
+		s.file = f
+	}
+	slices.SortStableFunc(s.buf, s.cmp)
+	w := bufio.NewWriter(s.file)
+	var rec []byte
+	for _, entry := range s.buf {
+		rec = table.EncodeRow(rec[:0], entry)
+		if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(rec)))); err != nil {
+			return err
+		}
+		if _, err := w.Write(rec); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	end, err := s.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, end)
+	clear(s.buf)
+	s.buf, s.size = s.buf[:0], 0
+	return nil
+}
+
+// starts reading all runs
+func (s *sorter) merge() error {
+	s.heap = mergeHeap{cmp: s.cmp}
+	start := int64(0)
+	for i, end := range s.runs {
+		run := &sortRun{id: i, r: bufio.NewReader(io.NewSectionReader(s.file, start, end-start))}
+		if err := run.next(); err != nil {
+			return err
+		}
+		if run.entry != nil {
+			s.heap.runs = append(s.heap.runs, run)
+		}
+		start = end
+	}
+	heap.Init(&s.heap)
+	return nil
+}
+
+// approximate memory of the entry
+func entrySize(entry []table.Value) int {
+	size := 24
+	for _, v := range entry {
+		size += 48 + len(v.Str)
+	}
+	return size
+}
+
+type sortRun struct {
+	id    int
+	r     *bufio.Reader
+	entry []table.Value // nil at the end
+}
+
+func (run *sortRun) next() error {
+	size, err := binary.ReadUvarint(run.r)
+	if err == io.EOF {
+		run.entry = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rec := make([]byte, size)
+	if _, err := io.ReadFull(run.r, rec); err != nil {
+		return fmt.Errorf("sort run: %w", err)
+	}
+	run.entry, err = table.DecodeRow(rec)
+	return err
+}
+
+// runs by their current entries, equal entries by the run order
+// so the sort is stable
+type mergeHeap struct {
+	runs []*sortRun
+	cmp  func(a, b []table.Value) int
+}
+
+func (h *mergeHeap) Len() int      { return len(h.runs) }
+func (h *mergeHeap) Swap(i, j int) { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+func (h *mergeHeap) Push(x any)    { h.runs = append(h.runs, x.(*sortRun)) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	if c := h.cmp(h.runs[i].entry, h.runs[j].entry); c != 0 {
+		return c < 0
+	}
+	return h.runs[i].id < h.runs[j].id
+}
+
+func (h *mergeHeap) Pop() any {
+	run := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return run
+}
@@ -0,0 +1,132 @@
+package sql
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// ORDER BY with LIMIT and OFFSET against sorting in the test, with a
+// buffer small enough to spill runs
+func TestOrderBy(t *testing.T) {
+	tmp := t.TempDir()
+	defer func(size int, dir string) { SortBuffer, TempDir = size, dir }(SortBuffer, TempDir)
+	SortBuffer, TempDir = 4096, tmp
+
+	db := openDB(t)
+	mustExec(t, db, "CREATE TABLE t (a INT, b INT, c STRING, d FLOAT, PRIMARY KEY (a, b), INDEX (c))")
+	type row struct {
+		a, b int
+		c    string
+		d    *float64
+	}
+	r := rand.New(rand.NewSource(1))
+	var rows []row
+	tx := db.Begin()
+	for i := 0; i < 500; i++ {
+		x := row{a: r.Intn(20), b: i, c: string(rune('a' + r.Intn(8)))}
+		d := "NULL"
+		if r.Intn(4) != 0 {
+			f := float64(r.Intn(50))
+			x.d, d = &f, fmt.Sprint(f)
+		}
+		rows = append(rows, x)
+		if _, err := Exec(tx, fmt.Sprintf("INSERT INTO t VALUES (%d, %d, '%s', %s)", x.a, x.b, x.c, d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	cmpD := func(x, y row) int {
+		switch {
+		case x.d == nil && y.d == nil:
+			return 0
+		case x.d == nil:
+			return -1
+		case y.d == nil:
+			return 1
+		}
+		return cmp.Compare(*x.d, *y.d)
+	}
+	cases := []struct {
+		order string
+		cmp   func(x, y row) int
+	}{
+		{"a, b", func(x, y row) int { return cmp.Compare(x.a, y.a) }},
+		{"a DESC, b DESC", func(x, y row) int { return cmp.Or(cmp.Compare(y.a, x.a), y.b-x.b) }},
+		{"c, a, b", func(x, y row) int { return cmp.Or(strings.Compare(x.c, y.c), cmp.Compare(x.a, y.a)) }},
+		{"c DESC, a DESC, b DESC", func(x, y row) int {
+			return cmp.Or(strings.Compare(y.c, x.c), cmp.Compare(y.a, x.a), y.b-x.b)
+		}},
+		{"d, a, b", func(x, y row) int { return cmp.Or(cmpD(x, y), cmp.Compare(x.a, y.a)) }},
+		{"d DESC, b", func(x, y row) int { return cmpD(y, x) }},
+		{"c, a DESC, b", func(x, y row) int { return cmp.Or(strings.Compare(x.c, y.c), cmp.Compare(y.a, x.a)) }},
+	}
+	for _, c := range cases {
+		for _, lim := range []string{"", " LIMIT 7", " LIMIT 10 OFFSET 495", " OFFSET 30", " LIMIT 0"} {
+			want := slices.Clone(rows)
+			slices.SortStableFunc(want, c.cmp)
+			// the last key of every order is b, the insertion order
+			var lines []string
+			for _, x := range want {
+				lines = append(lines, fmt.Sprint(x.b))
+			}
+			switch lim {
+			case " LIMIT 7":
+				lines = lines[:7]
+			case " LIMIT 10 OFFSET 495":
+				lines = lines[495:]
+			case " OFFSET 30":
+				lines = lines[30:]
+			case " LIMIT 0":
+				lines = nil
+			}
+			src := "SELECT b FROM t ORDER BY " + c.order + lim
+			if got := query(t, db, src); got != strings.Join(lines, "\n") {
+				t.Fatalf("%s:\n%s\nwant\n%s", src, got, strings.Join(lines, "\n"))
+			}
+		}
+	}
+
+	files, err := os.ReadDir(tmp)
+	if err != nil || len(files) != 0 {
+		t.Fatalf("temporary files left: %v %v", files, err)
+	}
+}
+
+func TestOrderByNames(t *testing.T) {
+	db := openDB(t)
+	mustExec(t, db, "CREATE TABLE t (a INT, b STRING, PRIMARY KEY (a))")
+	mustExec(t, db, "INSERT INTO t VALUES (1, 'z'), (2, 'y'), (3, 'x'), (4, NULL)")
+	cases := []struct{ src, want string }{
+		{"SELECT a, -a AS n FROM t ORDER BY n", "4 -4\n3 -3\n2 -2\n1 -1"},
+		{"SELECT b, a FROM t ORDER BY 1 DESC LIMIT 2", "z 1\ny 2"},
+		{"SELECT * FROM t ORDER BY 2", "4 NULL\n3 x\n2 y\n1 z"},
+		{"SELECT a FROM t WHERE a > 1 ORDER BY a DESC LIMIT 1 + 1", "4\n3"},
+	}
+	for _, c := range cases {
+		if got := query(t, db, c.src); got != c.want {
+			t.Errorf("%s = %q; want %q", c.src, got, c.want)
+		}
+	}
+
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	for _, src := range []string{
+		"SELECT a FROM t ORDER BY 3",
+		"SELECT a FROM t ORDER BY x",
+		"SELECT a FROM t LIMIT -1",
+		"SELECT a FROM t LIMIT 'x'",
+		"SELECT a FROM t OFFSET a",
+	} {
+		if _, err := Exec(tx, src); err == nil {
+			t.Errorf("%s: no error", src)
+		}
+	}
+}
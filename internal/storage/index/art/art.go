@@ -0,0 +1,528 @@
+// Package art is an adaptive radix tree, an in-memory ordered index for
+// keys with long shared prefixes like URLs and file paths. a lookup reads
+// one byte of the key per level and compares the shared prefixes once, so
+// it doesn't compare whole keys against the separators of a B-tree node,
+// and the keys of a prefix are a subtree.
+//
+// inner nodes grow and shrink between 4, 16, 48 and 256 children by the
+// number of distinct next bytes, so sparse levels stay small. the bytes
+// shared by all keys below a node are stored once in the node (path
+// compression). a key that is a prefix of other keys is the value of the
+// inner node where it ends, leaves hold the other keys.
+//
+// a Tree is not safe for concurrent use, like a map. WriteTo and ReadFrom
+// save and load the keys in order so the index can be rebuilt fast.
+package art
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"slices"
+)
+
+const (
+	NODE4   = 1
+	NODE16  = 2
+	NODE48  = 3
+	NODE256 = 4
+	LEAF    = 5
+)
+
+// children of the node kinds
+var nodeSize = [...]int{NODE4: 4, NODE16: 16, NODE48: 48, NODE256: 256}
+
+// a node shrinks to the smaller kind at that many children, less than
+// the size of the smaller kind so a node doesn't flip on every update
+var shrinkAt = [...]int{NODE16: 3, NODE48: 12, NODE256: 37}
+
+type node struct {
+	kind uint8
+	// inner nodes
+	prefix []byte // shared by the keys below
+	n      int    // children
+	// NODE4, NODE16: the sorted next bytes of the children.
+	// NODE48: the slot+1 of the child of every byte, 0 for none
+	keys []byte
+	kids []*node // NODE256: by the next byte
+	leaf *node   // the key ending at the node
+	// leaves
+	key []byte
+	val []byte
+}
+
+type Tree struct {
+	root  *node
+	count int
+}
+
+func newLeaf(key, val []byte) *node {
+	return &node{kind: LEAF, key: slices.Clone(key), val: slices.Clone(val)}
+}
+
+func newInner(kind uint8, prefix []byte) *node {
+	n := &node{kind: kind, prefix: prefix, kids: make([]*node, nodeSize[kind])}
+	switch kind {
+	case NODE4, NODE16:
+		n.keys = make([]byte, 0, nodeSize[kind])
+	case NODE48:
+		n.keys = make([]byte, 256)
+	}
+	return n
+}
+
+// the slot of the child of `b`, nil if none
+func (n *node) child(b byte) **node {
+	switch n.kind {
+	case NODE4, NODE16:
+		if i := bytes.IndexByte(n.keys, b); i >= 0 {
+			return &n.kids[i]
+		}
+	case NODE48:
+		if i := n.keys[b]; i > 0 {
+			return &n.kids[i-1]
+		}
+	case NODE256:
+		if n.kids[b] != nil {
+			return &n.kids[b]
+		}
+	}
+	return nil
+}
+
+// adds a child of a byte that has none, the node grows into `ref` if full
+func (n *node) addChild(ref **node, b byte, kid *node) {
+	if n.kind != NODE256 && n.n == nodeSize[n.kind] {
+		n = n.resize(n.kind + 1)
+		*ref = n
+	}
+	switch n.kind {
+	case NODE4, NODE16:
+		i, _ := slices.BinarySearch(n.keys, b)
+		n.keys = slices.Insert(n.keys, i, b)
+		copy(n.kids[i+1:], n.kids[i:n.n])
+		n.kids[i] = kid
+	case NODE48:
+		slot := slices.Index(n.kids, nil)
+		n.kids[slot] = kid
+		n.keys[b] = byte(slot + 1)
+	case NODE256:
+		n.kids[b] = kid
+	}
+	n.n++
+}
+
+func (n *node) delChild(b byte) {
+	switch n.kind {
+	case NODE4, NODE16:
+		i := bytes.IndexByte(n.keys, b)
+		n.keys = slices.Delete(n.keys, i, i+1)
+		copy(n.kids[i:], n.kids[i+1:n.n])
+		n.kids[n.n-1] = nil
+	case NODE48:
+		n.kids[n.keys[b]-1] = nil
+		n.keys[b] = 0
+	case NODE256:
+		n.kids[b] = nil
+	}
+	n.n--
+}
+
+// calls `fn` for the children in the order of their bytes until it returns false
+func (n *node) each(fn func(b byte, kid *node) bool) bool {
+	switch n.kind {
+	case NODE4, NODE16:
+		for i, b := range n.keys {
+			if !fn(b, n.kids[i]) {
+				return false
+			}
+		}
+	case NODE48:
+		for b, i := range n.keys {
+			if i > 0 && !fn(byte(b), n.kids[i-1]) {
+				return false
+			}
+		}
+	case NODE256:
+		for b, kid := range n.kids {
+			if kid != nil && !fn(byte(b), kid) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// a copy of the node of another kind
+func (n *node) resize(kind uint8) *node {
+	out := newInner(kind, n.prefix)
+	out.leaf = n.leaf
+	n.each(func(b byte, kid *node) bool {
+		out.addChild(nil, b, kid)
+		return true
+	})
+	return out
+}
+
+func commonPrefix(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func (t *Tree) Len() int { return t.count }
+
+func (t *Tree) Get(key []byte) ([]byte, bool) {
+	n, depth := t.root, 0
+	for n != nil {
+		if n.kind == LEAF {
+			if bytes.Equal(n.key, key) {
+				return n.val, true
+			}
+			return nil, false
+		}
+		if !bytes.HasPrefix(key[depth:], n.prefix) {
+			return nil, false
+		}
+		depth += len(n.prefix)
+		if depth == len(key) {
+			if n.leaf == nil {
+				return nil, false
+			}
+			return n.leaf.val, true
+		}
+		kid := n.child(key[depth])
+		if kid == nil {
+			return nil, false
+		}
+		n, depth = *kid, depth+1
+	}
+	return nil, false
+}
+
+// inserts or replaces the key, the key and the value are copied
+func (t *Tree) Set(key, val []byte) {
+	if t.insert(&t.root, key, val, 0) {
+		t.count++
+	}
+}
+
+// a leaf or an inner node holding the key that ends at `depth`
+func attach(n *node, ref **node, kid *node, key []byte, depth int) {
+	if depth == len(key) {
+		n.leaf = kid
+	} else {
+		n.addChild(ref, key[depth], kid)
+	}
+}
+
+// true if the key is new
+func (t *Tree) insert(ref **node, key, val []byte, depth int) bool {
+	n := *ref
+	if n == nil {
+		*ref = newLeaf(key, val)
+		return true
+	}
+	if n.kind == LEAF {
+		if bytes.Equal(n.key, key) {
+			n.val = slices.Clone(val)
+			return false
+		}
+		// a node for the bytes the keys share
+		p := commonPrefix(n.key[depth:], key[depth:])
+		inner := newInner(NODE4, slices.Clone(key[depth:depth+p]))
+		attach(inner, nil, n, n.key, depth+p)
+		attach(inner, nil, newLeaf(key, val), key, depth+p)
+		*ref = inner
+		return true
+	}
+	p := commonPrefix(n.prefix, key[depth:])
+	if p < len(n.prefix) {
+		// the key leaves the prefix, split it
+		inner := newInner(NODE4, n.prefix[:p:p])
+		inner.addChild(nil, n.prefix[p], n)
+		n.prefix = n.prefix[p+1:]
+		attach(inner, nil, newLeaf(key, val), key, depth+p)
+		*ref = inner
+		return true
+	}
+	depth += len(n.prefix)
+	if depth == len(key) {
+		if n.leaf != nil {
+			n.leaf.val = slices.Clone(val)
+			return false
+		}
+		n.leaf = newLeaf(key, val)
+		return true
+	}
+	if kid := n.child(key[depth]); kid != nil {
+		return t.insert(kid, key, val, depth+1)
+	}
+	n.addChild(ref, key[depth], newLeaf(key, val))
+	return true
+}
+
+// false if the key isn't there
+func (t *Tree) Del(key []byte) bool {
+	if t.remove(&t.root, key, 0) {
+		t.count--
+		return true
+	}
+	return false
+}
+
+func (t *Tree) remove(ref **node, key []byte, depth int) bool {
+	n := *ref
+	if n == nil {
+		return false
+	}
+	if n.kind == LEAF {
+		if !bytes.Equal(n.key, key) {
+			return false
+		}
+		*ref = nil
+		return true
+	}
+	if !bytes.HasPrefix(key[depth:], n.prefix) {
+		return false
+	}
+	depth += len(n.prefix)
+	if depth == len(key) {
+		if n.leaf == nil {
+			return false
+		}
+		n.leaf = nil
+	} else {
+		kid := n.child(key[depth])
+		if kid == nil || !t.remove(kid, key, depth+1) {
+			return false
+		}
+		if *kid == nil {
+			n.delChild(key[depth])
+		}
+	}
+	*ref = n.shrink()
+	return true
+}
+
+// the node that replaces `n` after a deletion
+func (n *node) shrink() *node {
+	switch {
+	case n.n == 0:
+		return n.leaf // may be nil
+	case n.n == 1 && n.leaf == nil:
+		// merge with the only child
+		var b byte
+		var kid *node
+		n.each(func(kb byte, k *node) bool {
+			b, kid = kb, k
+			return false
+		})
+		if kid.kind != LEAF {
+			prefix := make([]byte, 0, len(n.prefix)+1+len(kid.prefix))
+			prefix = append(append(append(prefix, n.prefix...), b), kid.prefix...)
+			kid.prefix = prefix
+		}
+		return kid
+	case n.kind != NODE4 && n.n <= shrinkAt[n.kind]:
+		return n.resize(n.kind - 1)
+	}
+	return n
+}
+
+// calls `fn` for keys in [start, end) in order until it returns false,
+// a nil `end` scans to the last key. the slices are owned by the tree.
+func (t *Tree) Scan(start, end []byte, fn func(key, val []byte) bool) {
+	if t.root == nil {
+		return
+	}
+	ascend(t.root, 0, start, len(start) > 0, func(key, val []byte) bool {
+		return (end == nil || bytes.Compare(key, end) < 0) && fn(key, val)
+	})
+}
+
+// calls `fn` for the keys starting with `prefix` in order
+func (t *Tree) ScanPrefix(prefix []byte, fn func(key, val []byte) bool) {
+	t.Scan(prefix, prefixEnd(prefix), fn)
+}
+
+// the smallest key greater than all keys with the prefix, nil if none
+func prefixEnd(prefix []byte) []byte {
+	end := slices.Clone(prefix)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) == 0 {
+		return nil
+	}
+	end[len(end)-1]++
+	return end
+}
+
+// visits the subtree in order. `bounded` is set while the path to the
+// node is a prefix of `start`, so the subtrees before it are skipped.
+func ascend(n *node, depth int, start []byte, bounded bool, fn func(key, val []byte) bool) bool {
+	if n.kind == LEAF {
+		if bounded && bytes.Compare(n.key, start) < 0 {
+			return true
+		}
+		return fn(n.key, n.val)
+	}
+	if bounded {
+		rest := start[depth:]
+		m := min(len(rest), len(n.prefix))
+		switch c := bytes.Compare(n.prefix[:m], rest[:m]); {
+		case c < 0:
+			return true // the subtree is before `start`
+		case c > 0 || len(rest) <= len(n.prefix):
+			bounded = false
+		}
+	}
+	depth += len(n.prefix)
+	// the key of the node is a prefix of `start` if still bounded
+	if n.leaf != nil && !bounded && !fn(n.leaf.key, n.leaf.val) {
+		return false
+	}
+	return n.each(func(b byte, kid *node) bool {
+		if bounded && b < start[depth] {
+			return true
+		}
+		return ascend(kid, depth+1, start, bounded && b == start[depth], fn)
+	})
+}
+
+// numbers of the nodes by kind
+func (t *Tree) nodes() map[uint8]int {
+	counts := map[uint8]int{}
+	var walk func(n *node)
+	walk = func(n *node) {
+		counts[n.kind]++
+		if n.leaf != nil {
+			counts[LEAF]++
+		}
+		n.each(func(_ byte, kid *node) bool {
+			walk(kid)
+			return true
+		})
+	}
+	if t.root != nil {
+		walk(t.root)
+	}
+	return counts
+}
+
+// snapshots are the number of keys and the pairs in order, with
+// uvarint lengths, followed by the CRC-32C of the bytes before it
+
+var ErrBadSnapshot = errors.New("art: bad snapshot")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// writes a snapshot of the keys
+func (t *Tree) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	crc := crc32.New(crcTable)
+	out := io.MultiWriter(bw, crc)
+	var written int64
+	var err error
+	put := func(data []byte) {
+		if err == nil {
+			var n int
+			n, err = out.Write(data)
+			written += int64(n)
+		}
+	}
+	put(binary.AppendUvarint(nil, uint64(t.count)))
+	t.Scan(nil, nil, func(key, val []byte) bool {
+		put(binary.AppendUvarint(nil, uint64(len(key))))
+		put(key)
+		put(binary.AppendUvarint(nil, uint64(len(val))))
+		put(val)
+		return err == nil
+	})
+	put(binary.LittleEndian.AppendUint32(nil, crc.Sum32()))
+	if err == nil {
+		err = bw.Flush()
+	}
+	return written, err
+}
+
+// replaces the keys with the ones of a snapshot, `r` can be read past
+// its end
+func (t *Tree) ReadFrom(r io.Reader) (int64, error) {
+	cr := &crcReader{r: bufio.NewReader(r), crc: crc32.New(crcTable)}
+	fail := func(err error) (int64, error) {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = ErrBadSnapshot
+		}
+		return cr.n, err
+	}
+	bytesOf := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return nil, err
+		}
+		if n > 1<<30 {
+			return nil, ErrBadSnapshot
+		}
+		data := make([]byte, n)
+		_, err = io.ReadFull(cr, data)
+		return data, err
+	}
+	count, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return fail(err)
+	}
+	next := Tree{}
+	for i := uint64(0); i < count; i++ {
+		key, err := bytesOf()
+		if err != nil {
+			return fail(err)
+		}
+		val, err := bytesOf()
+		if err != nil {
+			return fail(err)
+		}
+		next.Set(key, val)
+	}
+	sum := cr.crc.Sum32()
+	var tail [4]byte
+	if _, err := io.ReadFull(cr.r, tail[:]); err != nil {
+		return fail(err)
+	}
+	cr.n += 4
+	if binary.LittleEndian.Uint32(tail[:]) != sum || uint64(next.count) != count {
+		return cr.n, ErrBadSnapshot
+	}
+	*t = next
+	return cr.n, nil
+}
+
+// sums and counts the bytes read
+type crcReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+	n   int64
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc.Write(p[:n])
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *crcReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.crc.Write([]byte{b})
+		c.n++
+	}
+	return b, err
+}
@@ -0,0 +1,260 @@
+package art
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"godb/internal/storage/index/btree"
+)
+
+// keys with long shared prefixes, some are prefixes of others
+func urlKey(rng *rand.Rand) string {
+	hosts := []string{"https://example.com", "https://example.org", "http://go.dev"}
+	key := hosts[rng.Intn(len(hosts))]
+	for depth := rng.Intn(5); depth > 0; depth-- {
+		key += fmt.Sprintf("/p%d", rng.Intn(40))
+	}
+	return key
+}
+
+func assertTree(t *testing.T, tree *Tree, ref map[string]string) {
+	t.Helper()
+	if tree.Len() != len(ref) {
+		t.Fatalf("Len() = %d, want %d", tree.Len(), len(ref))
+	}
+	keys := make([]string, 0, len(ref))
+	for k, v := range ref {
+		keys = append(keys, k)
+		if got, ok := tree.Get([]byte(k)); !ok || string(got) != v {
+			t.Fatalf("Get(%q) = %q, %v; want %q", k, got, ok, v)
+		}
+	}
+	slices.Sort(keys)
+	var got []string
+	tree.Scan(nil, nil, func(key, val []byte) bool {
+		got = append(got, string(key))
+		return true
+	})
+	if !slices.Equal(got, keys) {
+		t.Fatalf("Scan() = %d keys, want %d", len(got), len(keys))
+	}
+}
+
+func TestTree(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tree := &Tree{}
+	ref := map[string]string{}
+	for i := 0; i < 20000; i++ {
+		key := urlKey(rng)
+		if rng.Intn(3) == 0 {
+			_, ok := ref[key]
+			if tree.Del([]byte(key)) != ok {
+				t.Fatalf("Del(%q) != %v", key, ok)
+			}
+			delete(ref, key)
+			continue
+		}
+		val := fmt.Sprint(i)
+		tree.Set([]byte(key), []byte(val))
+		ref[key] = val
+	}
+	assertTree(t, tree, ref)
+	if _, ok := tree.Get([]byte("https://example.com/p1/nope")); ok {
+		t.Fatal("Get() of a missing key")
+	}
+	if _, ok := tree.Get([]byte("https://exa")); ok {
+		t.Fatal("Get() of a prefix of the keys")
+	}
+
+	// the empty key
+	tree.Set(nil, []byte("empty"))
+	ref[""] = "empty"
+	assertTree(t, tree, ref)
+
+	keys := make([]string, 0, len(ref))
+	for k := range ref {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for i := 0; i < 300; i++ {
+		start, end := urlKey(rng), urlKey(rng)
+		if i%3 == 0 {
+			start = start[:rng.Intn(len(start))]
+		}
+		var got []string
+		tree.Scan([]byte(start), []byte(end), func(key, val []byte) bool {
+			got = append(got, string(key))
+			return len(got) < 50
+		})
+		var want []string
+		for _, k := range keys {
+			if k >= start && k < end && len(want) < 50 {
+				want = append(want, k)
+			}
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("Scan(%q, %q) = %v\nwant %v", start, end, got, want)
+		}
+
+		prefix := start[:rng.Intn(len(start)+1)]
+		got = got[:0]
+		tree.ScanPrefix([]byte(prefix), func(key, val []byte) bool {
+			got = append(got, string(key))
+			return true
+		})
+		want = want[:0]
+		for _, k := range keys {
+			if len(k) >= len(prefix) && k[:len(prefix)] == prefix {
+				want = append(want, k)
+			}
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("ScanPrefix(%q) = %d keys, want %d", prefix, len(got), len(want))
+		}
+	}
+
+	for k := range ref {
+		if !tree.Del([]byte(k)) {
+			t.Fatalf("Del(%q) = false", k)
+		}
+	}
+	if tree.Len() != 0 || tree.root != nil {
+		t.Fatalf("Len() = %d after deleting all keys", tree.Len())
+	}
+}
+
+func TestNodeKinds(t *testing.T) {
+	tree := &Tree{}
+	for b := 0; b < 256; b++ {
+		tree.Set([]byte{'k', byte(b)}, []byte{byte(b)})
+	}
+	if tree.root.kind != NODE256 || !bytes.Equal(tree.root.prefix, []byte("k")) {
+		t.Fatalf("root kind %d, prefix %q", tree.root.kind, tree.root.prefix)
+	}
+	kinds := []struct{ n, kind int }{{40, NODE256}, {36, NODE48}, {13, NODE48}, {12, NODE16}, {4, NODE16}, {3, NODE4}}
+	n := 256
+	for _, k := range kinds {
+		for ; n > k.n; n-- {
+			tree.Del([]byte{'k', byte(n - 1)})
+		}
+		if int(tree.root.kind) != k.kind {
+			t.Fatalf("%d children: kind %d, want %d", n, tree.root.kind, k.kind)
+		}
+		for b := 0; b < n; b++ {
+			if v, ok := tree.Get([]byte{'k', byte(b)}); !ok || v[0] != byte(b) {
+				t.Fatalf("Get(%d) with %d children", b, n)
+			}
+		}
+	}
+
+	// a node with one child is merged with it
+	tree = &Tree{}
+	tree.Set([]byte("/usr/local/bin"), nil)
+	tree.Set([]byte("/usr/local/lib"), nil)
+	tree.Set([]byte("/usr/share"), nil)
+	if got := tree.nodes(); got[NODE4] != 2 || got[LEAF] != 3 {
+		t.Fatalf("nodes() = %v", got)
+	}
+	tree.Del([]byte("/usr/share"))
+	if got := tree.nodes(); got[NODE4] != 1 || !bytes.Equal(tree.root.prefix, []byte("/usr/local/")) {
+		t.Fatalf("nodes() = %v, prefix %q", got, tree.root.prefix)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	tree := &Tree{}
+	ref := map[string]string{}
+	for i := 0; i < 5000; i++ {
+		k, v := urlKey(rng), fmt.Sprint(i)
+		tree.Set([]byte(k), []byte(v))
+		ref[k] = v
+	}
+	var buf bytes.Buffer
+	n, err := tree.WriteTo(&buf)
+	if err != nil || n != int64(buf.Len()) {
+		t.Fatalf("WriteTo() = %d, %v; wrote %d", n, err, buf.Len())
+	}
+	data := buf.Bytes()
+
+	loaded := &Tree{}
+	if n, err := loaded.ReadFrom(bytes.NewReader(data)); err != nil || n != int64(len(data)) {
+		t.Fatalf("ReadFrom() = %d, %v", n, err)
+	}
+	assertTree(t, loaded, ref)
+
+	for _, bad := range [][]byte{
+		data[:len(data)-1],
+		append(slices.Clone(data[:len(data)/2]), 0xff),
+		append(append([]byte{}, data[:len(data)-4]...), 1, 2, 3, 4),
+	} {
+		if _, err := loaded.ReadFrom(bytes.NewReader(bad)); !errors.Is(err, ErrBadSnapshot) {
+			t.Fatalf("ReadFrom() of a bad snapshot = %v", err)
+		}
+	}
+	// a failed load keeps the keys
+	assertTree(t, loaded, ref)
+}
+
+// the keys of the benchmarks share long prefixes like paths of files
+func benchKeys(n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("/srv/data/tenants/%03d/projects/%04d/files/%08d.json", i%100, i%1000, i))
+	}
+	return keys
+}
+
+func BenchmarkGet(b *testing.B) {
+	keys := benchKeys(100000)
+	b.Run("art", func(b *testing.B) {
+		tree := &Tree{}
+		for _, k := range keys {
+			tree.Set(k, []byte("value"))
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			tree.Get(keys[(i*7919)%len(keys)])
+		}
+	})
+	b.Run("btree", func(b *testing.B) {
+		db := &btree.KV{Path: filepath.Join(b.TempDir(), "test.db")}
+		if err := db.Open(); err != nil {
+			b.Fatal(err)
+		}
+		defer db.Close()
+		for i := 0; i < len(keys); i += 10000 {
+			tx := db.Begin()
+			for _, k := range keys[i:min(i+10000, len(keys))] {
+				tx.Set(k, []byte("value"))
+			}
+			if err := tx.Commit(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		rtx := db.BeginRead()
+		defer rtx.Rollback()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			rtx.Get(keys[(i*7919)%len(keys)])
+		}
+	})
+}
+
+func BenchmarkScanPrefix(b *testing.B) {
+	keys := benchKeys(100000)
+	tree := &Tree{}
+	for _, k := range keys {
+		tree.Set(k, []byte("value"))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		prefix := []byte(fmt.Sprintf("/srv/data/tenants/%03d/projects/%04d/", i%100, i%1000))
+		tree.ScanPrefix(prefix, func(key, val []byte) bool { return true })
+	}
+}
@@ -0,0 +1,63 @@
+package btree
+
+// The arena recycles the node buffers of the writer instead of leaving
+// them to the GC. a large write transaction updates the same nodes many
+// times, each update builds the node in a new buffer and the previous one
+// is garbage: thousands of 4 and 8 KB buffers per transaction.
+//
+// two kinds of buffers come back to the arena:
+//   - scratch buffers, nodes split or merged into others, were never pages
+//     and nothing refers to them.
+//   - pages the write transaction allocated and replaced, see pageAlloc.
+//     keys and values the transaction returned can point into them, but
+//     its views are valid only until its next update, see view.go.
+//
+// both are reused right away: keeping the replaced pages until the
+// transaction ends would hold a page per node copy, gigabytes for a
+// transaction of a few hundred thousand updates.
+//
+// pages that are durable or being written never come back: they are in
+// the updates of a staged batch, the buffer pool and the queues of the
+// replications.
+
+const ARENA_BUFFERS = 1024 // buffers of each size kept
+
+type nodeArena struct {
+	free [2][]BN // of 1 and 2 pages
+}
+
+// a zeroed node buffer of `pages` pages
+func (a *nodeArena) alloc(pages int) BN {
+	if a == nil {
+		return BN(make([]byte, pages*BT_PAGE_SIZE))
+	}
+	free := a.free[pages-1]
+	if len(free) == 0 {
+		return BN(make([]byte, pages*BT_PAGE_SIZE))
+	}
+	node := free[len(free)-1]
+	a.free[pages-1] = free[:len(free)-1]
+	clear(node)
+	return node
+}
+
+// takes back a scratch buffer or a replaced page, up to ARENA_BUFFERS of
+// each size
+func (a *nodeArena) put(node BN) {
+	if a == nil || node == nil {
+		return
+	}
+	node = node[:cap(node)]
+	pages := len(node) / BT_PAGE_SIZE
+	if len(node)%BT_PAGE_SIZE == 0 && 1 <= pages && pages <= 2 && len(a.free[pages-1]) < ARENA_BUFFERS {
+		a.free[pages-1] = append(a.free[pages-1], node)
+	}
+}
+
+// the number of buffers kept
+func (a *nodeArena) len() int {
+	if a == nil {
+		return 0
+	}
+	return len(a.free[0]) + len(a.free[1])
+}
@@ -0,0 +1,141 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestNodeArena(t *testing.T) {
+	var a nodeArena
+	node := a.alloc(2)
+	node[0] = 1
+	a.put(node[:BT_PAGE_SIZE]) // a page of a 2 page buffer
+	page := a.alloc(1)
+	a.put(page)
+	if a.len() != 2 || a.alloc(1) == nil || a.len() != 1 {
+		t.Fatalf("len() = %d", a.len())
+	}
+	if reused := a.alloc(2); &reused[0] != &node[0] || reused[0] != 0 || len(reused) != 2*BT_PAGE_SIZE {
+		t.Fatal("the scratch buffer is not reused zeroed")
+	}
+	for i := 0; i < ARENA_BUFFERS+10; i++ {
+		a.put(make([]byte, BT_PAGE_SIZE))
+	}
+	if a.len() != ARENA_BUFFERS {
+		t.Fatalf("len() = %d", a.len())
+	}
+
+	var none *nodeArena
+	none.put(none.alloc(1))
+}
+
+func TestArenaTx(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ref := map[string]string{}
+	write := func(round int) {
+		tx := db.Begin()
+		tx.Set([]byte("held"), []byte("value"))
+		for i := 0; i < 3000; i++ {
+			k, v := fmt.Sprintf("k%04d", i), fmt.Sprintf("%d-%d", round, i)
+			if i%4 == round%4 {
+				tx.Del([]byte(k))
+				delete(ref, k)
+				continue
+			}
+			tx.Set([]byte(k), []byte(v))
+			ref[k] = v
+		}
+		// a view is valid until the next update
+		if held, _ := tx.Get([]byte("held")); !bytes.Equal(held, []byte("value")) {
+			t.Fatalf("held = %q", held)
+		}
+		ref["held"] = "value"
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(0)
+	if s := db.Buffers(); s.Arena == 0 {
+		t.Fatalf("Buffers() = %+v", s)
+	}
+	for round := 1; round < 4; round++ {
+		write(round)
+	}
+
+	// a rolled back transaction
+	tx := db.Begin()
+	for i := 0; i < 3000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("rolled back"))
+	}
+	tx.Rollback()
+	write(4)
+	assertKV(t, db, ref)
+	db.Close()
+
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	assertKV(t, db, ref)
+	db.Close()
+}
+
+// the pages a transaction replaces are reused during it, its memory grows
+// with the tree and not with the number of updates
+func TestArenaLargeTx(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	heap := func() uint64 {
+		var m runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+	tx := db.Begin()
+	var peak uint64
+	for i := 0; i < 50000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%08d", i*7919%50000)), []byte("value"))
+		if i%10000 == 9999 {
+			peak = max(peak, heap())
+		}
+	}
+	// about 2 MB of pages, the pages replaced by 50000 updates are ~1 GB
+	if peak > 32<<20 {
+		tx.Rollback()
+		t.Fatalf("heap = %d MB", peak>>20)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if s := db.Buffers(); s.Arena > 2*ARENA_BUFFERS {
+		t.Fatalf("Buffers() = %+v", s)
+	}
+}
+
+func BenchmarkArenaTx(b *testing.B) {
+	db := &KV{Path: filepath.Join(b.TempDir(), "test.db")}
+	if err := db.Open(); err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		tx := db.Begin()
+		for i := 0; i < 1000; i++ {
+			tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("%d-%d", n, i)))
+		}
+		if err := tx.Commit(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
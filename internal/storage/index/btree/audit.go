@@ -0,0 +1,229 @@
+package btree
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The audit log records the committed write transactions in a file of
+// its own, for deployments that must keep who changed what. set
+// KV.Audit before Open. a record is a line of JSON appended once the
+// batch of the transaction is durable, so rolled back and failed
+// transactions are not in it:
+//
+//	{"time":"2026-10-15T14:59:28.123Z","seq":42,"client":"alice@10.0.0.7:53122",
+//	 "statements":["UPDATE t SET v = 1 WHERE k = 2"],
+//	 "changes":[{"op":"set","key":"..."},{"op":"del","bucket":"ns","key_hex":"00ff"}]}
+//
+// the client and the statements are set by the transaction, see
+// Tx.SetClient and Tx.AddStatement. like the changefeed, the changes are
+// the keys of the main keyspace and of top-level buckets, keys removed by
+// Sweep and DeleteBucket are not recorded. keys that are not UTF-8 are
+// written as key_hex. the file is synced after the records of a batch.
+//
+// the file is only appended to. when it would grow past MaxSize it is
+// renamed to Path.<UTC time of the rotation> and a new one is started.
+type AuditLog struct {
+	Path     string
+	MaxSize  int64 // bytes of a file before the rotation, no rotation if 0
+	MaxFiles int   // rotated files kept, the oldest are removed, all if 0
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// a record of the audit log
+type AuditRecord struct {
+	Time       time.Time     `json:"time"`
+	Seq        uint64        `json:"seq"`
+	Client     string        `json:"client,omitempty"`
+	Statements []string      `json:"statements,omitempty"`
+	Changes    []AuditChange `json:"changes"`
+}
+
+type AuditChange struct {
+	Op     string `json:"op"` // "set" or "del"
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key,omitempty"`
+	KeyHex string `json:"key_hex,omitempty"`
+}
+
+// the audit information of a write transaction
+type txAudit struct {
+	client     string
+	statements []string
+}
+
+// sets the client of the write transaction for the audit log, like
+// user@address
+func (tx *Tx) SetClient(client string) {
+	assert(tx.writable)
+	if tx.closed() {
+		return
+	}
+	tx.audit.client = client
+}
+
+// adds a statement the write transaction runs to its audit record
+func (tx *Tx) AddStatement(stmt string) {
+	assert(tx.writable)
+	if tx.closed() {
+		return
+	}
+	tx.audit.statements = append(tx.audit.statements, stmt)
+}
+
+// the record of a committed transaction, with db.mu
+func (tx *Tx) auditRecord(seq uint64) AuditRecord {
+	r := AuditRecord{
+		Time:       tx.db.clock().UTC(),
+		Seq:        seq,
+		Client:     tx.audit.client,
+		Statements: tx.audit.statements,
+		Changes:    []AuditChange{},
+	}
+	for i := range tx.changes {
+		c := &tx.changes[i]
+		ac := AuditChange{Op: "set"}
+		if c.New == nil {
+			ac.Op = "del"
+		}
+		if c.bucket != nil {
+			name, top := bucketName(nil, c.bucket)
+			if !top {
+				continue
+			}
+			ac.Bucket = string(name)
+		}
+		if utf8.Valid(c.Key) {
+			ac.Key = string(c.Key)
+		} else {
+			ac.KeyHex = hex.EncodeToString(c.Key)
+		}
+		r.Changes = append(r.Changes, ac)
+	}
+	return r
+}
+
+func (l *AuditLog) open() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("audit log: %w", err)
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+func (l *AuditLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// appends the records of a durable batch and syncs the file
+func (l *AuditLog) write(records []AuditRecord) error {
+	var data []byte
+	for i := range records {
+		line, err := json.Marshal(&records[i])
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return fmt.Errorf("audit log: closed")
+	}
+	if l.MaxSize > 0 && l.size > 0 && l.size+int64(len(data)) > l.MaxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("audit log: rotate: %w", err)
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("audit log: %w", err)
+	}
+	return nil
+}
+
+// the suffix of the rotated files, the UTC time of the rotation
+const AUDIT_ROTATED_TIME = "20060102T150405.000000000Z"
+
+// renames the file and starts a new one, with l.mu
+func (l *AuditLog) rotate() error {
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	rotated := l.Path + "." + time.Now().UTC().Format(AUDIT_ROTATED_TIME)
+	if err := os.Rename(l.Path, rotated); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	l.file, l.size = file, 0
+	if err := syncDir(filepath.Dir(l.Path)); err != nil {
+		return err
+	}
+	if l.MaxFiles <= 0 {
+		return nil
+	}
+	old, err := l.Rotated()
+	if err != nil {
+		return err
+	}
+	for len(old) > l.MaxFiles {
+		if err := os.Remove(old[0]); err != nil {
+			return err
+		}
+		old = old[1:]
+	}
+	return nil
+}
+
+// the rotated files, the oldest first
+func (l *AuditLog) Rotated() ([]string, error) {
+	files, err := filepath.Glob(l.Path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var rotated []string
+	for _, f := range files {
+		suffix := f[len(l.Path)+1:]
+		if _, err := time.Parse(AUDIT_ROTATED_TIME, suffix); err == nil {
+			rotated = append(rotated, f)
+		}
+	}
+	sort.Strings(rotated)
+	return rotated, nil
+}
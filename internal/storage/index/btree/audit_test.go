@@ -0,0 +1,103 @@
+package btree
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readAudit(t *testing.T, path string) []AuditRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []AuditRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r AuditRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatalf("bad record %q: %v", sc.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	audit := &AuditLog{Path: filepath.Join(dir, "audit.log")}
+	db := &KV{Path: filepath.Join(dir, "test.db"), Audit: audit, Now: func() time.Time { return now }}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	tx := db.Begin()
+	tx.SetClient("alice@127.0.0.1:5000")
+	tx.AddStatement("INSERT INTO t VALUES (1)")
+	tx.Set([]byte("a"), []byte("1"))
+	tx.Set([]byte{0, 0xff}, []byte("2"))
+	b, _ := tx.CreateBucket([]byte("ns"))
+	b.Set([]byte("k"), []byte("3"))
+	tx.Commit()
+	// not recorded: a rollback, a deletion of a missing key that commits
+	// nothing
+	tx = db.Begin()
+	tx.Set([]byte("b"), []byte("1"))
+	tx.Rollback()
+	tx = db.Begin()
+	tx.Del([]byte("missing"))
+	tx.Commit()
+	db.Del([]byte("a"))
+	db.Close()
+
+	records := readAudit(t, audit.Path)
+	if len(records) != 2 {
+		t.Fatalf("%d records: %+v", len(records), records)
+	}
+	r := records[0]
+	if !r.Time.Equal(now) || r.Seq != 1 || r.Client != "alice@127.0.0.1:5000" || len(r.Statements) != 1 || len(r.Changes) != 3 {
+		t.Fatalf("record = %+v", r)
+	}
+	want := []AuditChange{{Op: "set", Key: "a"}, {Op: "set", KeyHex: "00ff"}, {Op: "set", Bucket: "ns", Key: "k"}}
+	for i, c := range r.Changes {
+		if c != want[i] {
+			t.Fatalf("change %d = %+v, want %+v", i, c, want[i])
+		}
+	}
+	if r := records[1]; r.Seq != 2 || r.Client != "" || len(r.Changes) != 1 || r.Changes[0] != (AuditChange{Op: "del", Key: "a"}) {
+		t.Fatalf("record = %+v", r)
+	}
+
+	// appended after a reopen, rotated past MaxSize
+	audit.MaxSize = 200
+	audit.MaxFiles = 2
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		db.Set([]byte("key"), []byte("value"))
+	}
+	db.Close()
+	rotated, err := audit.Rotated()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Fatalf("rotated files %v", rotated)
+	}
+	n := len(readAudit(t, audit.Path))
+	for _, path := range rotated {
+		if info, _ := os.Stat(path); info.Size() > audit.MaxSize {
+			t.Fatalf("%s has %d bytes", path, info.Size())
+		}
+		n += len(readAudit(t, path))
+	}
+	if last := readAudit(t, audit.Path); n == 0 || last[len(last)-1].Seq != 12 {
+		t.Fatalf("the last record %+v", last)
+	}
+}
@@ -0,0 +1,341 @@
+package btree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Backups copy the pages of a durable version. every page written by a
+// batch has the commit sequence of the batch in its header, so a backup
+// from `since` has only the pages written after the version `since`: applied
+// on top of a backup of that version, or of any later one up to the
+// backup itself, they make the pages reachable from the new meta page. a
+// backup from 0 has every page, it is a full backup. a copy of the file
+// written by Backup is a base for the backups from its sequence too.
+//
+// pages freed after `since` keep the content of the older version in the
+// restored file, nothing reaches them. the pages free at the version are
+// reused by the writer while the backup is written: a full backup has
+// them as zero pages, an incremental one leaves them out. the tail node of
+// the free list is updated in place past the items of the version, its copy
+// gets the sequence of the version.
+//
+// backup file, every record ends with the CRC-32C of the pointer and the
+// page. the pages are in order, the meta page is last with pointer 0.
+// | sig | since | seq | flushed | ptr | page | crc | ... |  0  | meta page | crc |
+// | 16B |  8B   | 8B  |   8B    | 8B  |  4K  | 4B  |     | 8B  |    4K     | 4B  |
+
+const BACKUP_SIG = "mydbbackup000002"
+
+var ErrBackupBase = errors.New("the backup doesn't apply to the database")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// the commit sequence of the batch that wrote a B-tree or free list page
+func pageSeq(page []byte) uint64 {
+	return binary.LittleEndian.Uint64(page[4:12])
+}
+
+func setPageSeq(page []byte, seq uint64) {
+	binary.LittleEndian.PutUint64(page[4:12], seq)
+}
+
+// writes a copy of the database file as of the last durable version, it
+// opens as a database. writers aren't blocked, the pages of the version are
+// kept until the copy ends.
+func (db *KV) Backup(w io.Writer) error {
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	bw := bufio.NewWriter(w)
+	meta := make([]byte, BT_PAGE_SIZE)
+	copy(meta, tx.base)
+	bw.Write(meta)
+	flushed := binary.LittleEndian.Uint64(tx.base[24:32])
+	for ptr := uint64(1); ptr < flushed; ptr++ {
+		bw.Write(tx.pageRead(ptr))
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	return nil
+}
+
+// writes a copy of the database as of the last durable version to a new
+// file at `path`, a clone that shares nothing with the database. the file
+// appears once it is complete and durable.
+func (db *KV) Snapshot(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("KV.Snapshot: %s exists", path)
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("KV.Snapshot: %w", err)
+	}
+	err = db.Backup(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("KV.Snapshot: %w", err)
+	}
+	return nil
+}
+
+// writes a backup of the last durable version with the pages written after
+// the version `since`, 0 for a full backup. returns the commit sequence of
+// the backup, the `since` of the next one. writers aren't blocked, the
+// pages of the version are kept until the backup ends.
+func (db *KV) BackupSince(w io.Writer, since uint64) (uint64, error) {
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	seq := binary.LittleEndian.Uint64(tx.base[72:80])
+	if since > seq {
+		return 0, fmt.Errorf("backup since %d: the database is at %d", since, seq)
+	}
+
+	bw := bufio.NewWriter(w)
+	flushed := binary.LittleEndian.Uint64(tx.base[24:32])
+	head := append([]byte(BACKUP_SIG), make([]byte, 24)...)
+	binary.LittleEndian.PutUint64(head[16:], since)
+	binary.LittleEndian.PutUint64(head[24:], seq)
+	binary.LittleEndian.PutUint64(head[32:], flushed)
+	bw.Write(head)
+	record := func(ptr uint64, page []byte) {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], ptr)
+		crc := crc32.Update(crc32.Checksum(buf[:], crcTable), crcTable, page)
+		bw.Write(buf[:])
+		bw.Write(page)
+		bw.Write(binary.LittleEndian.AppendUint32(nil, crc))
+	}
+	c := &checker{page: func(ptr uint64) ([]byte, error) {
+		return tx.pageRead(ptr), nil
+	}}
+	list := freeList(c, tx.base)
+	if list == nil {
+		return 0, errors.New("backup: bad free list")
+	}
+	free := map[uint64]bool{}
+	for _, items := range list {
+		for _, item := range items {
+			free[item.ptr] = true
+		}
+	}
+	tailPage := binary.LittleEndian.Uint64(tx.base[48:56])
+	// the pages are copied before the checksum, the mmap can change
+	page := make([]byte, BT_PAGE_SIZE)
+	for ptr := uint64(1); ptr < flushed; ptr++ {
+		if free[ptr] {
+			if since == 0 {
+				clear(page)
+				record(ptr, page)
+			}
+			continue
+		}
+		copy(page, tx.pageRead(ptr))
+		if ptr == tailPage && pageSeq(page) > seq {
+			setPageSeq(page, seq)
+		}
+		if since > 0 && pageSeq(page) <= since {
+			continue
+		}
+		record(ptr, page)
+	}
+	meta := make([]byte, BT_PAGE_SIZE)
+	copy(meta, tx.base)
+	record(0, meta)
+	if err := bw.Flush(); err != nil {
+		return 0, fmt.Errorf("backup: %w", err)
+	}
+	return seq, nil
+}
+
+// the header of a backup
+type BackupInfo struct {
+	Since   uint64 // 0 for a full backup
+	Seq     uint64
+	Flushed uint64 // the number of pages of the database
+	Pages   uint64 // the number of pages in the backup, known once it's read
+}
+
+// reads the records of a backup and checks them
+type backupReader struct {
+	r    *bufio.Reader
+	info BackupInfo
+	last uint64 // the last pointer
+	meta []byte // the meta page once read
+}
+
+func newBackupReader(r io.Reader) (*backupReader, error) {
+	br := &backupReader{r: bufio.NewReader(r)}
+	head := make([]byte, 40)
+	if _, err := io.ReadFull(br.r, head); err != nil || !bytes.Equal(head[:16], []byte(BACKUP_SIG)) {
+		return nil, errors.New("not a backup")
+	}
+	br.info = BackupInfo{
+		Since:   binary.LittleEndian.Uint64(head[16:24]),
+		Seq:     binary.LittleEndian.Uint64(head[24:32]),
+		Flushed: binary.LittleEndian.Uint64(head[32:40]),
+	}
+	if br.info.Since > br.info.Seq || br.info.Flushed == 0 {
+		return nil, errors.New("bad backup header")
+	}
+	return br, nil
+}
+
+// reads the header of a backup
+func ReadBackupInfo(r io.Reader) (BackupInfo, error) {
+	br, err := newBackupReader(r)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	return br.info, nil
+}
+
+// the next page, nil after the meta page
+func (br *backupReader) next(page []byte) (uint64, []byte, error) {
+	if br.meta != nil {
+		return 0, nil, nil
+	}
+	var buf [12]byte
+	if _, err := io.ReadFull(br.r, buf[:8]); err != nil {
+		return 0, nil, fmt.Errorf("truncated backup: %w", err)
+	}
+	if _, err := io.ReadFull(br.r, page); err != nil {
+		return 0, nil, fmt.Errorf("truncated backup: %w", err)
+	}
+	if _, err := io.ReadFull(br.r, buf[8:]); err != nil {
+		return 0, nil, fmt.Errorf("truncated backup: %w", err)
+	}
+	ptr := binary.LittleEndian.Uint64(buf[:8])
+	crc := crc32.Update(crc32.Checksum(buf[:8], crcTable), crcTable, page)
+	if crc != binary.LittleEndian.Uint32(buf[8:]) {
+		return 0, nil, fmt.Errorf("bad checksum of page %d", ptr)
+	}
+	info := &br.info
+	if ptr == 0 {
+		return 0, nil, br.checkMeta(page)
+	}
+	if ptr <= br.last || ptr >= info.Flushed {
+		return 0, nil, fmt.Errorf("bad page number %d", ptr)
+	}
+	if seq := pageSeq(page); seq > info.Seq || info.Since > 0 && seq <= info.Since {
+		return 0, nil, fmt.Errorf("page %d is from commit %d", ptr, seq)
+	}
+	br.last = ptr
+	info.Pages++
+	return ptr, page, nil
+}
+
+func (br *backupReader) checkMeta(meta []byte) error {
+	info := &br.info
+	if checkMeta(meta, int64(info.Flushed)*BT_PAGE_SIZE) != nil ||
+		binary.LittleEndian.Uint64(meta[24:32]) != info.Flushed ||
+		binary.LittleEndian.Uint64(meta[72:80]) != info.Seq {
+		return errors.New("bad meta page in the backup")
+	}
+	if info.Since == 0 && info.Pages != info.Flushed-1 {
+		return fmt.Errorf("a full backup with %d of %d pages", info.Pages, info.Flushed-1)
+	}
+	br.meta = meta
+	return nil
+}
+
+// checks the checksums, the page numbers and the meta page of a backup
+// without applying it
+func VerifyBackup(r io.Reader) (BackupInfo, error) {
+	br, err := newBackupReader(r)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	page := make([]byte, BT_PAGE_SIZE)
+	for {
+		_, data, err := br.next(page)
+		if err != nil || data == nil {
+			return br.info, err
+		}
+	}
+}
+
+// applies a backup to the database file at `path`, which is not open. a
+// full backup creates the file, an incremental one applies on top of a
+// version between its `since` and itself, ErrBackupBase otherwise. the
+// records are checked like VerifyBackup, the meta page is written last,
+// but pages of the file can be overwritten before a bad record is found:
+// apply to a copy to keep the file.
+func ApplyBackup(path string, r io.Reader) (BackupInfo, error) {
+	br, err := newBackupReader(r)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	info := &br.info
+
+	flags := os.O_RDWR
+	if info.Since == 0 {
+		flags |= os.O_CREATE | os.O_TRUNC
+	}
+	fp, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return *info, err
+	}
+	defer fp.Close()
+	if info.Since > 0 {
+		base := make([]byte, META_SIZE)
+		if _, err := fp.ReadAt(base, 0); err != nil {
+			return *info, fmt.Errorf("read meta page: %w", err)
+		}
+		stat, err := fp.Stat()
+		if err != nil {
+			return *info, err
+		}
+		if err := checkMeta(base, stat.Size()); err != nil {
+			return *info, err
+		}
+		if at := binary.LittleEndian.Uint64(base[72:80]); at < info.Since || at > info.Seq {
+			return *info, fmt.Errorf("%w: the backup is from %d to %d, the database is at %d", ErrBackupBase, info.Since, info.Seq, at)
+		}
+	}
+
+	// the pages first, like a commit
+	page := make([]byte, BT_PAGE_SIZE)
+	for {
+		ptr, data, err := br.next(page)
+		if err != nil {
+			return *info, err
+		}
+		if data == nil {
+			break
+		}
+		if _, err := fp.WriteAt(data, int64(ptr*BT_PAGE_SIZE)); err != nil {
+			return *info, err
+		}
+	}
+	if err := fp.Truncate(int64(info.Flushed) * BT_PAGE_SIZE); err != nil {
+		return *info, err
+	}
+	if err := fp.Sync(); err != nil {
+		return *info, err
+	}
+	if _, err := fp.WriteAt(br.meta, 0); err != nil {
+		return *info, fmt.Errorf("write meta page: %w", err)
+	}
+	return *info, fp.Sync()
+}
@@ -0,0 +1,260 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackupSince(t *testing.T) {
+	dir := t.TempDir()
+	db := openKV(t, filepath.Join(dir, "test.db"))
+	defer db.Close()
+	ref := map[string]string{}
+	for i := 0; i < 20000; i += 1000 {
+		tx := db.Begin()
+		for j := i; j < i+1000; j++ {
+			k, v := fmt.Sprintf("k%05d", j), fmt.Sprint(j)
+			tx.Set([]byte(k), []byte(v))
+			ref[k] = v
+		}
+		tx.Commit()
+	}
+	var full bytes.Buffer
+	seq, err := db.BackupSince(&full, 0)
+	if err != nil || seq != 20 {
+		t.Fatalf("BackupSince(0) = %d, %v", seq, err)
+	}
+
+	// a few changes, freed pages are reused
+	for i := 0; i < 20000; i += 1000 {
+		k := fmt.Sprintf("k%05d", i)
+		db.Set([]byte(k), []byte("changed"))
+		ref[k] = "changed"
+		db.Del([]byte(fmt.Sprintf("k%05d", i+1)))
+		delete(ref, fmt.Sprintf("k%05d", i+1))
+	}
+	var incr bytes.Buffer
+	seq2, err := db.BackupSince(&incr, seq)
+	if err != nil || seq2 != seq+40 {
+		t.Fatalf("BackupSince(%d) = %d, %v", seq, seq2, err)
+	}
+	if incr.Len() >= full.Len()/4 {
+		t.Fatalf("incremental backup of %d bytes, the full one is %d", incr.Len(), full.Len())
+	}
+	db.Set([]byte("last"), nil)
+	var incr2 bytes.Buffer
+	db.BackupSince(&incr2, seq2)
+
+	path := filepath.Join(dir, "restored.db")
+	if got, err := ApplyBackup(path, bytes.NewReader(full.Bytes())); got.Seq != seq || err != nil {
+		t.Fatalf("ApplyBackup(full) = %+v, %v", got, err)
+	}
+	if _, err := ApplyBackup(path, bytes.NewReader(incr2.Bytes())); !errors.Is(err, ErrBackupBase) {
+		t.Fatalf("ApplyBackup() on an older version = %v", err)
+	}
+	if got, err := ApplyBackup(path, bytes.NewReader(incr.Bytes())); got.Seq != seq2 || err != nil {
+		t.Fatalf("ApplyBackup(incremental) = %+v, %v", got, err)
+	}
+	restored := openKV(t, path)
+	assertKV(t, restored, ref)
+	restored.Close()
+
+	// the next one applies on top
+	if _, err := ApplyBackup(path, bytes.NewReader(incr2.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	ref["last"] = ""
+	restored = openKV(t, path)
+	defer restored.Close()
+	assertKV(t, restored, ref)
+	if _, err := ApplyBackup(filepath.Join(dir, "none.db"), bytes.NewReader(incr.Bytes())); err == nil {
+		t.Fatal("ApplyBackup() of an incremental backup without a database")
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	db := openKV(t, filepath.Join(dir, "test.db"))
+	defer db.Close()
+	ref := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		k, v := fmt.Sprintf("k%04d", i), fmt.Sprint(i)
+		db.Set([]byte(k), []byte(v))
+		ref[k] = v
+	}
+
+	// writers go on while the copy is written
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := db.Backup(pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	head := make([]byte, BT_PAGE_SIZE)
+	if _, err := io.ReadFull(pr, head); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("after"))
+	}
+	rest, err := io.ReadAll(pr)
+	if err != nil || <-done != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "copy.db")
+	if err := os.WriteFile(path, append(head, rest...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	copied := openKV(t, path)
+	assertKV(t, copied, ref)
+	copied.Close()
+
+	// incremental backups apply on top of the copy
+	var incr bytes.Buffer
+	if _, err := db.BackupSince(&incr, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ApplyBackup(path, &incr); err != nil {
+		t.Fatal(err)
+	}
+	copied = openKV(t, path)
+	defer copied.Close()
+	if val, _ := copied.Get([]byte("k0999")); string(val) != "after" {
+		t.Fatalf("Get() after ApplyBackup = %q", val)
+	}
+}
+
+// pages free at the version of a backup are reused by the writer while
+// they are copied
+func TestBackupConcurrentWriter(t *testing.T) {
+	dir := t.TempDir()
+	db := openKV(t, filepath.Join(dir, "test.db"))
+	defer db.Close()
+	// every commit sets the keys to the same round
+	write := func(round int) {
+		tx := db.Begin()
+		for i := 0; i < 300; i++ {
+			tx.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("%d-%0100d", round, i)))
+		}
+		tx.Commit()
+	}
+	write(0)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for round := 1; ; round++ {
+			select {
+			case <-stop:
+				return
+			default:
+				write(round)
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	path := filepath.Join(dir, "restored.db")
+	since := uint64(0)
+	for i := 0; i < 20; i++ {
+		var buf bytes.Buffer
+		seq, err := db.BackupSince(&buf, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := VerifyBackup(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatalf("VerifyBackup() of the backup since %d: %v", since, err)
+		}
+		if _, err := ApplyBackup(path, &buf); err != nil {
+			t.Fatalf("ApplyBackup() of the backup since %d: %v", since, err)
+		}
+		since = seq
+	}
+	if report, err := Check(path); err != nil || !report.OK() {
+		t.Fatalf("Check() = %v, %v", report.Errors, err)
+	}
+	restored := openKV(t, path)
+	defer restored.Close()
+	first, _ := restored.Get([]byte("k000"))
+	round, _, _ := strings.Cut(string(first), "-")
+	for i := 0; i < 300; i++ {
+		k := fmt.Sprintf("k%03d", i)
+		if val, _ := restored.Get([]byte(k)); string(val) != fmt.Sprintf("%s-%0100d", round, i) {
+			t.Fatalf("Get(%s) = %q, k000 is from round %s", k, val, round)
+		}
+	}
+}
+
+func TestVerifyBackup(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprint(i)))
+	}
+	var buf bytes.Buffer
+	db.BackupSince(&buf, 0)
+	good := buf.Bytes()
+	info, err := VerifyBackup(bytes.NewReader(good))
+	if err != nil || info.Seq != 1000 || info.Since != 0 || info.Pages != info.Flushed-1 {
+		t.Fatalf("VerifyBackup() = %+v, %v", info, err)
+	}
+
+	bad := bytes.Clone(good)
+	bad[40+8+100]++ // in the first page
+	if _, err := VerifyBackup(bytes.NewReader(bad)); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("VerifyBackup() of a corrupted page = %v", err)
+	}
+	if _, err := VerifyBackup(bytes.NewReader(good[:len(good)-100])); err == nil {
+		t.Fatal("VerifyBackup() of a truncated backup succeeded")
+	}
+	// a record dropped from a full backup
+	record := 8 + BT_PAGE_SIZE + 4
+	bad = append(bytes.Clone(good[:40]), good[40+record:]...)
+	if _, err := VerifyBackup(bytes.NewReader(bad)); err == nil {
+		t.Fatal("VerifyBackup() of a full backup without a page succeeded")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	db := openKV(t, filepath.Join(dir, "test.db"))
+	defer db.Close()
+	tx := db.Begin()
+	b, _ := tx.CreateBucket([]byte("b"))
+	b.Set([]byte("k"), []byte("v"))
+	tx.Set([]byte("a"), []byte("1"))
+	tx.Commit()
+
+	path := filepath.Join(dir, "clone.db")
+	if err := db.Snapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Snapshot(path); err == nil {
+		t.Fatal("Snapshot() over an existing file succeeded")
+	}
+	db.Set([]byte("a"), []byte("2"))
+	clone := openKV(t, path)
+	defer clone.Close()
+	clone.Set([]byte("c"), []byte("clone"))
+	if val, _ := clone.Get([]byte("a")); string(val) != "1" {
+		t.Fatalf("Get(a) in the clone = %s", val)
+	}
+	if _, ok := db.Get([]byte("c")); ok {
+		t.Fatal("a write to the clone in the database")
+	}
+	rtx := clone.BeginRead()
+	defer rtx.Rollback()
+	if val, _ := rtx.Bucket([]byte("b")).Get([]byte("k")); string(val) != "v" {
+		t.Fatalf("Get(k) in a bucket of the clone = %s", val)
+	}
+}
@@ -0,0 +1,274 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Blobs are values larger than a pair, streamed by KV.PutReader and
+// KV.GetReader without holding them in memory. a blob is kept in the bucket
+// BLOB_BUCKET as a header and chunks of KV.MaxValueSize bytes: the pages of
+// the chunks are plain leaves, the free list, Check, Compact and the
+// replicas need nothing more. blobs have their own keyspace, Get doesn't see
+// them. like the changefeed, the bucket isn't watched, logged in the
+// changefeed nor audited.
+//
+// PutReader writes the chunks in write transactions of BLOB_BATCH chunks
+// under a new generation, then the header of the generation: readers see
+// the old blob or the new one, never a part of it. the chunks of the older
+// generations are deleted after, those of a put interrupted by a crash by
+// the next PutReader or DelBlob of the key.
+//
+// header key          chunk key
+// | key len | key |   | key len | key | gen | index |
+// |   2B    |     |   |   2B    |     | 8B  |  4B   |
+//
+// header value
+// | size | gen |
+// |  8B  | 8B  |
+
+const BLOB_BUCKET = "_blobs"
+
+// chunks written or deleted by a write transaction of a blob
+const BLOB_BATCH = 256
+
+var blobKey = bucketKey(nil, []byte(BLOB_BUCKET))
+
+// a blob chunk is missing or has the wrong size
+var ErrBlobDamaged = errors.New("damaged blob")
+
+func blobHeaderKey(key []byte) []byte {
+	out := binary.BigEndian.AppendUint16(nil, uint16(len(key)))
+	return append(out, key...)
+}
+
+func blobChunkKey(key []byte, gen uint64, idx uint32) []byte {
+	out := binary.BigEndian.AppendUint64(blobHeaderKey(key), gen)
+	return binary.BigEndian.AppendUint32(out, idx)
+}
+
+// ErrInvalidKey or ErrKeyTooLarge for a key of a blob: its chunk keys have
+// 14 bytes more
+func (db *KV) checkBlobKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrInvalidKey
+	}
+	if n := 2 + len(key) + 8 + 4; n > db.MaxKeySize {
+		return fmt.Errorf("%w: a blob chunk key of %d bytes", ErrKeyTooLarge, n)
+	}
+	return nil
+}
+
+// writes the `size` bytes of `r` as the blob of `key`, io.ErrUnexpectedEOF
+// if `r` has less. the blob replaces the old one of the key once they are
+// all written. in memory there are BLOB_BATCH chunks at most.
+func (db *KV) PutReader(key []byte, r io.Reader, size int64) error {
+	if err := db.checkBlobKey(key); err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("PutReader: negative size %d", size)
+	}
+	var gen uint64
+	chunk := int64(db.MaxValueSize)
+	nchunks := (size + chunk - 1) / chunk
+	buf := make([]byte, min(size, BLOB_BATCH*chunk))
+	for idx := int64(0); idx < nchunks; {
+		// read the batch before the writer is taken
+		n := min(nchunks-idx, BLOB_BATCH)
+		batch := buf[:min(size-idx*chunk, n*chunk)]
+		if _, err := io.ReadFull(r, batch); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			db.dropChunks(key, gen, gen)
+			return fmt.Errorf("PutReader: %w", err)
+		}
+		tx := db.Begin()
+		if gen == 0 {
+			gen = tx.Seq() + 1 // the commit sequence of the first batch
+		}
+		b, err := tx.blobBucket()
+		for i := int64(0); i < n && err == nil; i++ {
+			data := batch[i*chunk : min((i+1)*chunk, int64(len(batch)))]
+			err = b.Set(blobChunkKey(key, gen, uint32(idx+i)), data)
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+		if err != nil {
+			db.dropChunks(key, gen, gen)
+			return fmt.Errorf("PutReader: %w", err)
+		}
+		idx += n
+	}
+
+	tx := db.Begin()
+	if gen == 0 {
+		gen = tx.Seq() + 1
+	}
+	b, err := tx.blobBucket()
+	if err == nil {
+		header := binary.LittleEndian.AppendUint64(nil, uint64(size))
+		err = b.Set(blobHeaderKey(key), binary.LittleEndian.AppendUint64(header, gen))
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		db.dropChunks(key, gen, gen)
+		return fmt.Errorf("PutReader: %w", err)
+	}
+	return db.dropChunks(key, 0, gen-1)
+}
+
+// deletes the blob of `key`, false if there is none
+func (db *KV) DelBlob(key []byte) (bool, error) {
+	if err := db.checkBlobKey(key); err != nil {
+		return false, err
+	}
+	tx := db.Begin()
+	b := tx.openBucket(blobKey)
+	var gen uint64
+	if b != nil {
+		if header, ok := b.Get(blobHeaderKey(key)); ok && len(header) == 16 {
+			gen = binary.LittleEndian.Uint64(header[8:])
+		}
+	}
+	if gen == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+	if _, err := b.Del(blobHeaderKey(key)); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, db.dropChunks(key, 0, gen)
+}
+
+// the bucket of the blobs, created by the first one
+func (tx *Tx) blobBucket() (*Bucket, error) {
+	if b := tx.openBucket(blobKey); b != nil {
+		return b, nil
+	}
+	return tx.createBucket(blobKey, []byte(BLOB_BUCKET), CFOptions{})
+}
+
+// deletes the chunks of `key` of the generations in [from, to], in
+// transactions of BLOB_BATCH chunks
+func (db *KV) dropChunks(key []byte, from, to uint64) error {
+	if from > to || to == 0 {
+		return nil
+	}
+	start, end := blobChunkKey(key, from, 0), blobChunkKey(key, to+1, 0)
+	for {
+		tx := db.Begin()
+		b := tx.openBucket(blobKey)
+		if b == nil {
+			tx.Rollback()
+			return nil
+		}
+		var keys [][]byte
+		b.Scan(start, end, func(key, val []byte) bool {
+			keys = append(keys, bytes.Clone(key))
+			return len(keys) < BLOB_BATCH
+		})
+		if len(keys) == 0 {
+			tx.Rollback()
+			return nil
+		}
+		for _, key := range keys {
+			if _, err := b.Del(key); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+}
+
+// BlobReader streams a blob, see KV.GetReader. it reads a version of the
+// database, the pages of the blob are kept until Close.
+type BlobReader struct {
+	tx   *Tx
+	b    *Bucket
+	key  []byte
+	gen  uint64
+	size int64
+	off  int64
+	buf  []byte // the rest of the current chunk, a view of its page
+}
+
+// a reader of the blob of `key`, ErrKeyNotFound if there is none. the
+// reader must be closed.
+func (db *KV) GetReader(key []byte) (*BlobReader, error) {
+	if err := db.checkBlobKey(key); err != nil {
+		return nil, err
+	}
+	tx := db.BeginRead()
+	b := tx.openBucket(blobKey)
+	if b == nil {
+		tx.Rollback()
+		return nil, ErrKeyNotFound
+	}
+	header, ok := b.Get(blobHeaderKey(key))
+	if !ok {
+		tx.Rollback()
+		return nil, ErrKeyNotFound
+	}
+	if len(header) != 16 {
+		tx.Rollback()
+		return nil, fmt.Errorf("%w: header of %d bytes", ErrBlobDamaged, len(header))
+	}
+	return &BlobReader{
+		tx:   tx,
+		b:    b,
+		key:  bytes.Clone(key),
+		size: int64(binary.LittleEndian.Uint64(header)),
+		gen:  binary.LittleEndian.Uint64(header[8:]),
+	}, nil
+}
+
+// the size of the blob
+func (br *BlobReader) Size() int64 {
+	return br.size
+}
+
+func (br *BlobReader) Read(p []byte) (int, error) {
+	if br.tx.done {
+		return 0, ErrTxClosed
+	}
+	if br.off == br.size {
+		return 0, io.EOF
+	}
+	if len(br.buf) == 0 {
+		chunk := int64(br.tx.db.MaxValueSize)
+		idx := br.off / chunk
+		val, ok := br.b.Get(blobChunkKey(br.key, br.gen, uint32(idx)))
+		if want := min(chunk, br.size-idx*chunk); !ok || int64(len(val)) != want {
+			return 0, fmt.Errorf("%w: chunk %d of %d bytes", ErrBlobDamaged, idx, len(val))
+		}
+		br.buf = val[br.off-idx*chunk:]
+	}
+	n := copy(p, br.buf)
+	br.buf = br.buf[n:]
+	br.off += int64(n)
+	return n, nil
+}
+
+// ends the read transaction of the reader
+func (br *BlobReader) Close() error {
+	return br.tx.Rollback()
+}
@@ -0,0 +1,124 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func readBlob(t *testing.T, db *KV, key string) []byte {
+	t.Helper()
+	r, err := db.GetReader([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != r.Size() {
+		t.Fatalf("%d bytes read of %d", len(data), r.Size())
+	}
+	return data
+}
+
+func blobChunks(t *testing.T, db *KV) int {
+	t.Helper()
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	b := tx.Bucket([]byte(BLOB_BUCKET))
+	if b == nil {
+		return 0
+	}
+	n := 0
+	b.Scan(nil, nil, func(key, val []byte) bool {
+		if len(key) == len(blobChunkKey([]byte("big"), 0, 0)) {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+func TestBlob(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, Changefeed: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	big := make([]byte, 2*BLOB_BATCH*BT_MAX_VAL_SIZE+123)
+	rand.New(rand.NewSource(1)).Read(big)
+	if err := db.PutReader([]byte("big"), bytes.NewReader(big), int64(len(big))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, db, "big"), big) {
+		t.Fatal("the blob read isn't the one written")
+	}
+	if _, ok := db.Get([]byte("big")); ok {
+		t.Fatal("the blob is in the main keyspace")
+	}
+
+	// a reader keeps its version
+	r, err := db.GetReader([]byte("big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := []byte("small")
+	if err := db.PutReader([]byte("big"), bytes.NewReader(small), int64(len(small))); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(r); err != nil || !bytes.Equal(data, big) {
+		t.Fatalf("the old reader read %d bytes, %v", len(data), err)
+	}
+	r.Close()
+	if got := readBlob(t, db, "big"); !bytes.Equal(got, small) {
+		t.Fatalf("blob %q", got)
+	}
+	if n := blobChunks(t, db); n != 1 {
+		t.Fatalf("%d chunks after the overwrite", n)
+	}
+
+	// a short reader leaves the old blob
+	err = db.PutReader([]byte("big"), bytes.NewReader(big[:5000]), int64(len(big)))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("PutReader() of a short reader = %v", err)
+	}
+	if got := readBlob(t, db, "big"); !bytes.Equal(got, small) {
+		t.Fatalf("blob %q after a failed put", got)
+	}
+	if n := blobChunks(t, db); n != 1 {
+		t.Fatalf("%d chunks after a failed put", n)
+	}
+
+	// the chunks aren't in the changefeed
+	tx := db.BeginRead()
+	if err := tx.Changes(0, func(e Entry) bool {
+		t.Fatalf("entry %s", entryText(e))
+		return false
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	if deleted, err := db.DelBlob([]byte("big")); !deleted || err != nil {
+		t.Fatalf("DelBlob() = %v, %v", deleted, err)
+	}
+	if _, err := db.GetReader([]byte("big")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetReader() of a deleted blob = %v", err)
+	}
+	if n := blobChunks(t, db); n != 0 {
+		t.Fatalf("%d chunks after DelBlob", n)
+	}
+	if _, err := db.GetReader(make([]byte, BT_MAX_KEY_SIZE)); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("GetReader() of a long key = %v", err)
+	}
+	if report, err := Check(path); err != nil || !report.OK() {
+		t.Fatalf("Check() = %+v, %v", report, err)
+	}
+}
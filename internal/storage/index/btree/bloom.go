@@ -0,0 +1,150 @@
+package btree
+
+import (
+	"hash/maphash"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// Bloom filters of the leaves answer lookups of missing keys without
+// reading the leaf, set KV.BloomBits. they are kept in memory by page
+// number, not in the file: a filter is built the first time a lookup
+// reaches a leaf, from then on a lookup that misses the filter stops at
+// the parent of the leaf.
+//
+// a page is immutable until it's freed and allocated again, pageAlloc drops
+// the filter of the page then. readers of the versions that can see the
+// old content of a page have ended before it's reused (see the epochs), so
+// a filter is never stale for a lookup that can reach its page. pages
+// overwritten by Apply drop their filters, Restore starts new filters and
+// the readers of the old file keep the old ones.
+// read only databases can't use filters: the writer is another process.
+
+const BLOOM_SHARDS = 16
+
+type leafFilters struct {
+	bits   int // per key
+	hashes int
+	seed   maphash.Seed
+	shards [BLOOM_SHARDS]filterShard
+
+	skips atomic.Uint64 // leaves not read
+}
+
+type filterShard struct {
+	mu      sync.RWMutex
+	filters map[uint64]bloomFilter // page number -> filter of the leaf
+}
+
+type bloomFilter []uint64
+
+// filters of `bits` bits per key, about 1% of false positives with 10
+func newLeafFilters(bits int) *leafFilters {
+	f := &leafFilters{
+		bits:   bits,
+		hashes: min(max(1, int(math.Round(float64(bits)*math.Ln2))), 30),
+		seed:   maphash.MakeSeed(),
+	}
+	for i := range f.shards {
+		f.shards[i].filters = map[uint64]bloomFilter{}
+	}
+	return f
+}
+
+// whether the leaf at `ptr` doesn't have `key` for sure, false if the page
+// has no filter yet or isn't a leaf
+func (f *leafFilters) miss(ptr uint64, key []byte) bool {
+	if f == nil {
+		return false
+	}
+	s := &f.shards[ptr%BLOOM_SHARDS]
+	s.mu.RLock()
+	filter, ok := s.filters[ptr]
+	s.mu.RUnlock()
+	if !ok || filter.has(f.hashes, maphash.Bytes(f.seed, key)) {
+		return false
+	}
+	f.skips.Add(1)
+	return true
+}
+
+// builds the filter of the leaf `node` at `ptr` unless it has one
+func (f *leafFilters) add(ptr uint64, node BN) {
+	if f == nil || node.btype() != BN_LEAF {
+		return
+	}
+	s := &f.shards[ptr%BLOOM_SHARDS]
+	s.mu.RLock()
+	_, ok := s.filters[ptr]
+	s.mu.RUnlock()
+	if ok {
+		return
+	}
+	n := node.nkeys()
+	filter := make(bloomFilter, (max(1, int(n)*f.bits)+63)/64)
+	for i := uint16(0); i < n; i++ {
+		filter.set(f.hashes, maphash.Bytes(f.seed, node.getKey(i)))
+	}
+	s.mu.Lock()
+	s.filters[ptr] = filter
+	s.mu.Unlock()
+}
+
+// drops the filters of the pages
+func (f *leafFilters) drop(ptrs ...uint64) {
+	if f == nil {
+		return
+	}
+	for _, ptr := range ptrs {
+		s := &f.shards[ptr%BLOOM_SHARDS]
+		s.mu.Lock()
+		delete(s.filters, ptr)
+		s.mu.Unlock()
+	}
+}
+
+// the number of leaves with a filter
+func (f *leafFilters) len() int {
+	if f == nil {
+		return 0
+	}
+	n := 0
+	for i := range f.shards {
+		s := &f.shards[i]
+		s.mu.RLock()
+		n += len(s.filters)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// reports the leaves skipped since the last report
+func (f *leafFilters) report(db *KV) {
+	if f == nil || db.Metrics == nil {
+		return
+	}
+	db.count(METRIC_BLOOM_SKIPS, f.skips.Swap(0))
+}
+
+// the bits of a key are picked by double hashing of its 64 bit hash
+func (b bloomFilter) set(k int, h uint64) {
+	n := uint32(len(b) * 64)
+	h1, h2 := uint32(h), uint32(h>>32)
+	for i := 0; i < k; i++ {
+		bit := (h1 + uint32(i)*h2) % n
+		b[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b bloomFilter) has(k int, h uint64) bool {
+	n := uint32(len(b) * 64)
+	h1, h2 := uint32(h), uint32(h>>32)
+	for i := 0; i < k; i++ {
+		bit := (h1 + uint32(i)*h2) % n
+		if b[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
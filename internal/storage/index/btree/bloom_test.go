@@ -0,0 +1,119 @@
+package btree
+
+import (
+	"fmt"
+	"hash/maphash"
+	"path/filepath"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	f := newLeafFilters(10)
+	filter := make(bloomFilter, (1000*f.bits+63)/64)
+	for i := 0; i < 1000; i++ {
+		filter.set(f.hashes, maphash.String(f.seed, fmt.Sprintf("k%d", i)))
+	}
+	fp := 0
+	for i := 0; i < 10000; i++ {
+		if !filter.has(f.hashes, maphash.String(f.seed, fmt.Sprintf("k%d", i))) && i < 1000 {
+			t.Fatalf("k%d is missing", i)
+		}
+		if filter.has(f.hashes, maphash.String(f.seed, fmt.Sprintf("m%d", i))) {
+			fp++
+		}
+	}
+	if fp > 300 {
+		t.Fatalf("%d false positives of 10000", fp)
+	}
+}
+
+func TestLeafFilters(t *testing.T) {
+	m := &testMetrics{counters: map[string]uint64{}, gauges: map[string]float64{}, durations: map[string]int{}}
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, BloomBits: 10, Metrics: m}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ref := map[string]string{}
+	write := func(round int) {
+		tx := db.Begin()
+		for i := 0; i < 2000; i++ {
+			k, v := fmt.Sprintf("k%04d", i), fmt.Sprintf("%d-%d", round, i)
+			if i%3 == round%3 {
+				tx.Del([]byte(k))
+				delete(ref, k)
+				continue
+			}
+			tx.Set([]byte(k), []byte(v))
+			ref[k] = v
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lookup := func(tx *Tx, ref map[string]string) {
+		for i := 0; i < 2000; i++ {
+			for _, k := range []string{fmt.Sprintf("k%04d", i), fmt.Sprintf("k%04d.", i)} {
+				v, ok := tx.Get([]byte(k))
+				if want, found := ref[k]; ok != found || string(v) != want {
+					t.Fatalf("Get(%s) = %q, %v", k, v, ok)
+				}
+			}
+		}
+	}
+
+	// filters built for a version stay right for the next ones
+	for round := 0; round < 4; round++ {
+		write(round)
+		for j := 0; j < 2; j++ {
+			tx := db.BeginRead()
+			lookup(tx, ref)
+			tx.Rollback()
+		}
+	}
+	if s := db.Buffers(); s.Filters == 0 {
+		t.Fatalf("Buffers() = %+v", s)
+	}
+
+	// the writer sees its own leaves
+	tx := db.Begin()
+	tx.Set([]byte("k0000."), []byte("new"))
+	tx.Del([]byte("k0001"))
+	if v, ok := tx.Get([]byte("k0000.")); !ok || string(v) != "new" {
+		t.Fatalf("Get() = %q, %v", v, ok)
+	}
+	if _, ok := tx.Get([]byte("k0001")); ok {
+		t.Fatal("a deleted key")
+	}
+	tx.Rollback()
+
+	// a restored file gets new filters, readers of the old one keep theirs
+	snap := path + ".snap"
+	if err := db.Snapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+	restored := map[string]string{}
+	for k, v := range ref {
+		restored[k] = v
+	}
+	write(4)
+	old := db.BeginRead()
+	lookup(old, ref)
+	if err := db.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	lookup(old, ref)
+	old.Rollback()
+	ref = restored
+	tx = db.BeginRead()
+	lookup(tx, ref)
+	tx.Rollback()
+	db.Close()
+	if m.counters[METRIC_BLOOM_SKIPS] == 0 {
+		t.Fatalf("no %s: %v", METRIC_BLOOM_SKIPS, m.counters)
+	}
+
+	if err := (&KV{Path: path, BloomBits: 10, ReadOnly: true}).Open(); err == nil {
+		t.Fatal("Bloom filters with ReadOnly")
+	}
+}
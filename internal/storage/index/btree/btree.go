@@ -3,15 +3,24 @@ package btree
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
+	"strings"
 	"unsafe"
 )
 
 const (
-	HEADER          = 4
+	HEADER          = 12
 	BT_PAGE_SIZE    = 4096
-	BT_MAX_KEY_SIZE = 1000
-	BT_MAX_VAL_SIZE = 3000
+	BT_MAX_KEY_SIZE = 1000 // the default of KV.MaxKeySize
+	BT_MAX_VAL_SIZE = 3000 // the default of KV.MaxValueSize
+	// a pair of a key and a value fits a node alone, the bound of the sum
+	// of KV.MaxKeySize and KV.MaxValueSize
+	BT_MAX_PAIR_SIZE = BT_PAGE_SIZE - HEADER - 8 - 2 - 4
+	// two keys and their counts fit a branch node, the bound of
+	// KV.MaxKeySize
+	BT_MAX_KEY_LIMIT = (BT_PAGE_SIZE-HEADER)/2 - 8 - 2 - 4 - 8
+	// the left node of a split of appended keys is filled up to this
+	// percentage of the page, see nodeSplit2
+	BT_APPEND_FILL = 90
 
 	BN_NODE = 1
 	BN_LEAF = 2
@@ -26,16 +35,28 @@ func assert(condition bool) {
 }
 
 func init() {
-	node1max := HEADER + 8 + 2 + 4 + BT_MAX_KEY_SIZE + BT_MAX_VAL_SIZE
-	assert(node1max <= BT_PAGE_SIZE)
+	assert(BT_MAX_KEY_SIZE+BT_MAX_VAL_SIZE <= BT_MAX_PAIR_SIZE)
+	assert(BT_MAX_KEY_SIZE <= BT_MAX_KEY_LIMIT)
 }
 
+// the first key of every tree is the sentinel, the empty key with an empty
+// value inserted with the root: a lookup in a node always has a key before
+// or at the one it searches, see nodeLookupLE. it isn't a key of the tree:
+// Insert doesn't take the empty key, Get and Delete don't find it, the
+// iterators, Count and the stats skip it. the methods of Tx and Bucket
+// return ErrInvalidKey for it.
 type BT struct {
 	root uint64
 
+	// the pages of the tree: the map of the in-memory C, the file of KV
+	// and its transactions. the trees of readers have no new nor del.
 	get func(uint64) []byte
 	new func([]byte) uint64
 	del func(uint64)
+
+	counts  *writeCounts // splits and merges, nil for readers
+	filters *leafFilters // of the leaves for Get, nil without KV.BloomBits
+	arena   *nodeArena   // node buffers of the writer, nil for readers
 }
 
 func (node BN) btype() uint16 {
@@ -162,14 +183,15 @@ func nodeAppendRange(new BN, old BN, dstNew uint16, srcOld uint16, n uint16) {
 	if n == 0 {
 		return
 	}
-	for i := uint16(0); i < n; i++ {
-		new.setPtr(dstNew+i, old.getPtr(srcOld+i))
-	}
-	dstBegin := new.getOffset(dstNew)
-	srcBegin := old.getOffset(srcOld)
-	for i := uint16(1); i <= n; i++ {
-		offset := dstBegin + old.getOffset(srcOld+i) - srcBegin
-		new.setOffset(dstNew+i, offset)
+	// pointers are position independent, copy them as one block
+	copy(new[HEADER+8*dstNew:HEADER+8*(dstNew+n)], old[HEADER+8*srcOld:HEADER+8*(srcOld+n)])
+	// offsets 1..n are rebased from old's start to new's start; uint16
+	// wraparound makes the delta work in both directions
+	delta := new.getOffset(dstNew) - old.getOffset(srcOld)
+	dst := new[offsetPos(new, dstNew+1) : offsetPos(new, dstNew+n)+2]
+	src := old[offsetPos(old, srcOld+1) : offsetPos(old, srcOld+n)+2]
+	for i := 0; i+1 < len(src); i += 2 {
+		binary.LittleEndian.PutUint16(dst[i:], binary.LittleEndian.Uint16(src[i:])+delta)
 	}
 	start := old.kvPos(srcOld)
 	end := old.kvPos(srcOld + n)
@@ -178,20 +200,57 @@ func nodeAppendRange(new BN, old BN, dstNew uint16, srcOld uint16, n uint16) {
 
 func nodeReplaceKidN(tree *BT, new BN, old BN, idx uint16, kids ...BN) {
 	inc := uint16(len(kids))
+	counted := old.counted()
 	new.setHeader(BN_NODE, old.nkeys()+inc-1)
 	nodeAppendRange(new, old, 0, 0, idx)
 	for i, node := range kids {
-		nodeAppendKV(new, idx+uint16(i), tree.new(node), node.getKey(0), nil)
+		val := kidVal(node, counted)
+		nodeAppendKV(new, idx+uint16(i), tree.new(node), node.getKey(0), val)
 	}
 	nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-idx-1)
 }
 
+// the value of a kid in a branch node is the number of pairs of its
+// subtree, the sentinel included, see Rank. the branch nodes of files from
+// before have empty values: a node has the counts of all its kids or none,
+// the ones without are counted by walking their subtrees.
+
+// the pairs of the subtree of `node`, false if it's a branch node without
+// counts
+func nodeCount(node BN) (uint64, bool) {
+	if node.btype() == BN_LEAF {
+		return uint64(node.nkeys()), true
+	}
+	if !node.counted() {
+		return 0, false
+	}
+	n := uint64(0)
+	for i := uint16(0); i < node.nkeys(); i++ {
+		n += binary.LittleEndian.Uint64(node.getVal(i))
+	}
+	return n, true
+}
+
+// a branch node with the counts of its kids
+func (node BN) counted() bool {
+	return node.btype() == BN_NODE && node.nkeys() > 0 && len(node.getVal(0)) == 8
+}
+
+// the value of `kid` in its parent, its count if the parent has counts
+func kidVal(kid BN, counted bool) []byte {
+	if !counted {
+		return nil
+	}
+	n, ok := nodeCount(kid)
+	assert(ok)
+	return binary.LittleEndian.AppendUint64(nil, n)
+}
+
 // check how many bytes it will take to copy `count` KV's
-// from `from` to new node. Only for leaf nodes
-func leafSizeFor(old BN, from, count uint16) uint16 {
-	assert(old.btype() == BN_LEAF)
+// from `from` to new node, pointers and offsets included
+func nodeSizeFor(old BN, from, count uint16) uint16 {
 	size := uint16(HEADER)
-	size += (count + 1) * 2
+	size += count * (8 + 2)
 
 	if count == 0 {
 		return size
@@ -207,28 +266,53 @@ func leafSizeFor(old BN, from, count uint16) uint16 {
 	return size
 }
 
-func nodeSplit2(left BN, right BN, old BN) {
+// splits `old` in two nodes of about the same size, `left` has two pages in
+// case they don't fit in one each. with `appended`, the
+// key was appended to the end of the tree (sequential inserts) and the
+// left node is filled up to BT_APPEND_FILL instead: it won't get more keys,
+// a split in the middle would leave it half empty for good.
+func nodeSplit2(left BN, right BN, old BN, appended bool) {
 	n := old.nkeys()
 	btype := old.btype()
 
 	bestIdx := uint16(0)
 	bestMax := uint16(^uint16(0))
 
-	for i := uint16(1); i < n; i++ {
-		ls := leafSizeFor(old, 0, i)
-		rs := leafSizeFor(old, i, n-i)
-
-		if ls > BT_PAGE_SIZE || rs > BT_PAGE_SIZE {
-			continue
+	for i := n - 1; appended && i > 0; i-- {
+		ls := nodeSizeFor(old, 0, i)
+		rs := nodeSizeFor(old, i, n-i)
+		if ls <= BT_PAGE_SIZE*BT_APPEND_FILL/100 && rs <= BT_PAGE_SIZE {
+			bestIdx = i
+			break
 		}
+	}
+
+	if bestIdx == 0 {
+		for i := uint16(1); i < n; i++ {
+			ls := nodeSizeFor(old, 0, i)
+			rs := nodeSizeFor(old, i, n-i)
+
+			if ls > BT_PAGE_SIZE || rs > BT_PAGE_SIZE {
+				continue
+			}
 
-		max := ls
-		if rs > max {
-			max = rs
+			max := ls
+			if rs > max {
+				max = rs
+			}
+
+			if max < bestMax {
+				bestMax = max
+				bestIdx = i
+			}
 		}
+	}
 
-		if max < bestMax {
-			bestMax = max
+	// no split in two nodes of a page: a large pair next to large
+	// neighbours. the right node gets the most keys that fit in a page, the
+	// left one fits in two and is split again, see nodeSplit3.
+	for i := uint16(1); bestIdx == 0 && i < n; i++ {
+		if nodeSizeFor(old, i, n-i) <= BT_PAGE_SIZE {
 			bestIdx = i
 		}
 	}
@@ -242,94 +326,164 @@ func nodeSplit2(left BN, right BN, old BN) {
 	nodeAppendRange(right, old, 0, bestIdx, n-bestIdx)
 }
 
-func nodeSplit3(old BN) (uint16, [3]BN) {
+// splits `old` in up to 3 nodes that fit in a page. `old` is a scratch
+// buffer if it's split. it has up to two pages less a header, so when the
+// right node gets the most keys that fit in a page the left one splits in
+// two nodes of a page: a key that fits in neither would make more than two
+// pages with the keys before it and the ones after.
+func nodeSplit3(tree *BT, old BN, appended bool) (uint16, [3]BN) {
 	if old.nbytes() <= BT_PAGE_SIZE {
 		old = old[:BT_PAGE_SIZE]
 		return 1, [3]BN{old}
 	}
-	left := BN(make([]byte, 2*BT_PAGE_SIZE))
-	right := BN(make([]byte, BT_PAGE_SIZE))
-	nodeSplit2(left, right, old)
+	left := tree.arena.alloc(2)
+	right := tree.arena.alloc(1)
+	nodeSplit2(left, right, old, appended)
 	if left.nbytes() <= BT_PAGE_SIZE {
 		left = left[:BT_PAGE_SIZE]
 		return 2, [3]BN{left, right}
 	}
-	leftleft := BN(make([]byte, BT_PAGE_SIZE))
-	middle := BN(make([]byte, BT_PAGE_SIZE))
-	nodeSplit2(leftleft, middle, left)
+	leftleft := tree.arena.alloc(1)
+	middle := tree.arena.alloc(1)
+	nodeSplit2(leftleft, middle, left, false)
 	assert(leftleft.nbytes() <= BT_PAGE_SIZE)
+	tree.arena.put(left)
 	return 3, [3]BN{leftleft, middle, right}
 }
 
 // insert a KV into a node, the result might be split.
 // the caller is responsible for deallocating the input node
 // and splitting and allocating result nodes.
-func treeInsert(tree *BT, node BN, key []byte, val []byte) BN {
-	new := BN(make([]byte, 2*BT_PAGE_SIZE))
-	idx := nodeLookupLE(node, key)
+// `last` is whether the node is the last of its level, the result is
+// whether the key was appended: it's a new key after every key of the tree.
+// with `tail` the key is known to be after every key and goes to the last
+// kid without comparisons, see BT.Append.
+func treeInsert(tree *BT, node BN, key []byte, val []byte, last bool, tail bool) (BN, bool) {
+	new := tree.arena.alloc(2)
+	idx := node.nkeys() - 1
+	if !tail {
+		idx = nodeLookupLE(node, key)
+	}
+	appended := false
 	switch node.btype() {
 	case BN_LEAF:
-		if bytes.Equal(key, node.getKey(idx)) {
+		if !tail && bytes.Equal(key, node.getKey(idx)) {
 			leafUpdate(new, node, idx, key, val)
 		} else {
 			leafInsert(new, node, idx+1, key, val)
+			appended = last && idx+1 == node.nkeys()
 		}
 	case BN_NODE:
-		nodeInsert(tree, new, node, idx, key, val)
+		appended = nodeInsert(tree, new, node, idx, key, val, last, tail)
 	default:
 		panic("bad node")
 	}
-	return new
+	return new, appended
 }
 
-func nodeInsert(tree *BT, new BN, node BN, idx uint16, key []byte, val []byte) {
+func nodeInsert(tree *BT, new BN, node BN, idx uint16, key []byte, val []byte, last bool, tail bool) bool {
 	kptr := node.getPtr(idx)
-	knode := treeInsert(tree, tree.get(kptr), key, val)
-	nsplit, split := nodeSplit3(knode)
+	knode, appended := treeInsert(tree, tree.node(kptr), key, val, last && idx+1 == node.nkeys(), tail)
+	nsplit, split := nodeSplit3(tree, knode, appended)
+	if nsplit > 1 {
+		tree.arena.put(knode)
+	}
+	tree.split(nsplit)
 	tree.del(kptr)
 	nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
+	return appended
 }
 
 func (tree *BT) Insert(key []byte, val []byte) {
+	tree.insert(key, val, false)
+}
+
+// inserts `key` if it's after every key of the tree and returns true.
+// the insert descends the last kids: with sequential keys like timestamps
+// it skips the key comparisons of Insert at every level.
+func (tree *BT) Append(key []byte, val []byte) bool {
+	if tree.root != 0 {
+		node := tree.node(tree.root)
+		for node.btype() == BN_NODE {
+			node = tree.node(node.getPtr(node.nkeys() - 1))
+		}
+		// the first key of the tree is the sentinel
+		if n := node.nkeys(); n > 1 && bytes.Compare(key, node.getKey(n-1)) <= 0 {
+			return false
+		}
+	}
+	tree.insert(key, val, true)
+	return true
+}
+
+func (tree *BT) insert(key []byte, val []byte, tail bool) {
+	// the callers check the sizes, nodeAppendKV would truncate them
+	assert(len(key) > 0 && len(key) <= BT_MAX_KEY_LIMIT && len(key)+len(val) <= BT_MAX_PAIR_SIZE)
 	if tree.root == 0 {
-		root := BN(make([]byte, BT_PAGE_SIZE))
+		root := tree.arena.alloc(2)
 		root.setHeader(BN_LEAF, 2)
 
-		// dummy
+		// the sentinel
 		nodeAppendKV(root, 0, 0, nil, nil)
 
 		nodeAppendKV(root, 1, 0, key, val)
-		tree.root = tree.new(root)
+		// a pair of BT_MAX_PAIR_SIZE doesn't fit with the sentinel
+		tree.root = tree.newRoot(root, false)
 		return
 	}
-	node := treeInsert(tree, tree.get(tree.root), key, val)
-	nsplit, split := nodeSplit3(node)
+	node, appended := treeInsert(tree, tree.node(tree.root), key, val, true, tail)
 	tree.del(tree.root)
-	if nsplit > 1 {
+	tree.root = tree.newRoot(node, appended)
+}
+
+// allocates `node`, the updated root, and the levels above it if it's
+// split. a new root of 3 keys of BT_MAX_KEY_LIMIT doesn't fit in a page,
+// it's split again.
+func (tree *BT) newRoot(node BN, appended bool) uint64 {
+	for {
+		nsplit, split := nodeSplit3(tree, node, appended)
+		if nsplit == 1 {
+			return tree.new(split[0])
+		}
+		tree.arena.put(node)
+		tree.split(nsplit)
 		// add new level
-		root := BN(make([]byte, BT_PAGE_SIZE))
-		root.setHeader(BN_NODE, nsplit)
+		node = tree.arena.alloc(2)
+		node.setHeader(BN_NODE, nsplit)
+		// the kids are leaves or were split from a node with counts
+		_, counted := nodeCount(split[0])
 		for i, knode := range split[:nsplit] {
+			val := kidVal(knode, counted)
 			ptr, key := tree.new(knode), knode.getKey(0)
-			nodeAppendKV(root, uint16(i), ptr, key, nil)
+			nodeAppendKV(node, uint16(i), ptr, key, val)
 		}
-		tree.root = tree.new(root)
-	} else {
-		tree.root = tree.new(split[0])
+		appended = false
+	}
+}
+
+// counts a node split in `nsplit` nodes
+func (tree *BT) split(nsplit uint16) {
+	if tree.counts == nil || nsplit < 2 {
+		return
+	}
+	tree.counts.splits++
+	if e := tree.counts.events; e != nil && e.Split != nil {
+		e.Split(int(nsplit))
 	}
 }
 
 func (tree *BT) Delete(key []byte) bool {
-	if tree.root == 0 {
+	if tree.root == 0 || len(key) == 0 {
 		return false
 	}
-	updated := treeDelete(tree, tree.get(tree.root), key)
+	updated := treeDelete(tree, tree.node(tree.root), key)
 	if len(updated) == 0 {
 		return false
 	}
 	tree.del(tree.root)
 	if updated.nkeys() == 0 && updated.btype() == BN_NODE {
 		tree.root = updated.getPtr(0)
+		tree.arena.put(updated)
 	} else {
 		tree.root = tree.new(updated)
 	}
@@ -358,14 +512,14 @@ func shouldMerge(tree *BT, node BN, idx uint16, updated BN) (int, BN) {
 		return 0, BN{}
 	}
 	if idx > 0 {
-		sibling := BN(tree.get(node.getPtr(idx - 1)))
+		sibling := tree.node(node.getPtr(idx - 1))
 		merged := sibling.nbytes() + updated.nbytes() - HEADER
 		if merged <= BT_PAGE_SIZE {
 			return -1, sibling
 		}
 	}
 	if idx+1 < node.nkeys() {
-		sibling := BN(tree.get(node.getPtr(idx + 1)))
+		sibling := tree.node(node.getPtr(idx + 1))
 		merged := sibling.nbytes() + updated.nbytes() - HEADER
 		if merged <= BT_PAGE_SIZE {
 			return 1, sibling
@@ -374,11 +528,12 @@ func shouldMerge(tree *BT, node BN, idx uint16, updated BN) (int, BN) {
 	return 0, BN{}
 }
 
-func nodeReplace2Kid(new BN, old BN, idx uint16, ptr uint64, key []byte) {
+func nodeReplace2Kid(tree *BT, new BN, old BN, idx uint16, merged BN) {
 	// asserts of type and idx???
 	new.setHeader(BN_NODE, old.nkeys()-1)
 	nodeAppendRange(new, old, 0, 0, idx)
-	nodeAppendKV(new, idx, ptr, key, nil)
+	val := kidVal(merged, old.counted())
+	nodeAppendKV(new, idx, tree.new(merged), merged.getKey(0), val)
 
 	if idx+2 < old.nkeys() {
 		nodeAppendRange(new, old, idx+1, idx+2, old.nkeys()-idx-2)
@@ -391,7 +546,7 @@ func treeDelete(tree *BT, node BN, key []byte) BN {
 		if !bytes.Equal(node.getKey(idx), key) {
 			return nil
 		}
-		new := BN(make([]byte, BT_PAGE_SIZE))
+		new := tree.arena.alloc(1)
 		leafDelete(new, node, idx)
 		return new
 	}
@@ -401,54 +556,107 @@ func treeDelete(tree *BT, node BN, key []byte) BN {
 
 func nodeDelete(tree *BT, node BN, idx uint16, key []byte) BN {
 	kptr := node.getPtr(idx)
-	updated := treeDelete(tree, tree.get(kptr), key)
+	updated := treeDelete(tree, tree.node(kptr), key)
 	if len(updated) == 0 {
 		return BN{}
 	}
 	tree.del(kptr)
 
-	new := BN(make([]byte, BT_PAGE_SIZE))
+	new := tree.arena.alloc(1)
 	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
+	if tree.counts != nil && mergeDir != 0 {
+		tree.counts.merges++
+		if e := tree.counts.events; e != nil && e.Merge != nil {
+			e.Merge()
+		}
+	}
 	switch {
 	case mergeDir < 0:
-		merged := BN(make([]byte, BT_PAGE_SIZE))
+		merged := tree.arena.alloc(1)
 		nodeMerge(merged, sibling, updated)
+		tree.arena.put(updated)
 		tree.del(node.getPtr(idx - 1))
-		nodeReplace2Kid(new, node, idx-1, tree.new(merged), merged.getKey(0))
+		nodeReplace2Kid(tree, new, node, idx-1, merged)
 	case mergeDir > 0:
-		merged := BN(make([]byte, BT_PAGE_SIZE))
+		merged := tree.arena.alloc(1)
 		nodeMerge(merged, updated, sibling)
+		tree.arena.put(updated)
 		tree.del(node.getPtr(idx + 1))
-		nodeReplace2Kid(new, node, idx, tree.new(merged), merged.getKey(0))
+		nodeReplace2Kid(tree, new, node, idx, merged)
 	case mergeDir == 0 && updated.nkeys() == 0:
 		assert(node.nkeys() == 1 && idx == 0)
 		new.setHeader(BN_NODE, 0)
+		tree.arena.put(updated)
 	case mergeDir == 0 && updated.nkeys() > 0:
 		nodeReplaceKidN(tree, new, node, idx, updated)
-		if idx > 0 {
-			pos := new.kvPos(idx)
-			firstKey := updated.getKey(0)
-			binary.LittleEndian.PutUint16(new[pos+0:], uint16(len(firstKey)))
-			binary.LittleEndian.PutUint16(new[pos+2:], 0)
-			copy(new[pos+4:], firstKey)
-		}
 	}
 	return new
 }
 
-func treeGet(tree *BT, node BN, key []byte) ([]byte, bool) {
+// reads the node `ptr`, see checkNode
+func (tree *BT) node(ptr uint64) BN {
+	node := BN(tree.get(ptr))
+	checkNode(ptr, node)
+	return node
+}
+
+// deallocates every page of the tree in one traversal
+func (tree *BT) Drop() {
+	if tree.root != 0 {
+		treeDrop(tree, tree.root)
+	}
+	tree.root = 0
+}
+
+func treeDrop(tree *BT, ptr uint64) {
+	node := tree.node(ptr)
+	if node.btype() == BN_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			treeDrop(tree, node.getPtr(i))
+		}
+	}
+	tree.del(ptr)
+}
+
+// copies the pages of `src` to the empty tree with its page functions, in
+// one traversal instead of inserting the keys one by one. the trees share
+// no page, each one can be updated or dropped.
+func (tree *BT) Clone(src *BT) {
+	assert(tree.root == 0)
+	if src.root != 0 {
+		tree.root = treeClone(tree, src, src.root)
+	}
+}
+
+func treeClone(tree *BT, src *BT, ptr uint64) uint64 {
+	old := src.node(ptr)
+	node := tree.arena.alloc(1)
+	copy(node, old[:old.nbytes()])
+	if node.btype() == BN_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			node.setPtr(i, treeClone(tree, src, node.getPtr(i)))
+		}
+	}
+	return tree.new(node)
+}
+
+func treeGet(tree *BT, ptr uint64, key []byte) ([]byte, bool) {
+	if tree.filters.miss(ptr, key) {
+		return nil, false
+	}
+	node := tree.node(ptr)
 	idx := nodeLookupLE(node, key)
 
 	switch node.btype() {
 	case BN_LEAF:
+		tree.filters.add(ptr, node)
 		if bytes.Equal(node.getKey(idx), key) {
 			return node.getVal(idx), true
 		}
 		return nil, false
 
 	case BN_NODE:
-		ptr := node.getPtr(idx)
-		return treeGet(tree, tree.get(ptr), key)
+		return treeGet(tree, node.getPtr(idx), key)
 
 	default:
 		panic("bad node type")
@@ -456,13 +664,14 @@ func treeGet(tree *BT, node BN, key []byte) ([]byte, bool) {
 }
 
 func (tree *BT) Get(key []byte) ([]byte, bool) {
-	if tree.root == 0 {
+	if tree.root == 0 || len(key) == 0 {
 		return nil, false
 	}
-	return treeGet(tree, tree.get(tree.root), key)
+	return treeGet(tree, tree.root, key)
 }
 
-// In-memory Btree
+// In-memory Btree, the tree of the tests with a map of its pairs to
+// compare
 type C struct {
 	tree  BT
 	ref   map[string]string
@@ -472,143 +681,44 @@ type C struct {
 func NewC() *C {
 	pages := map[uint64]BN{}
 	return &C{
-		tree: BT{
-			get: func(ptr uint64) []byte {
-				node, ok := pages[ptr]
-				assert(ok)
-				return node
-			},
-			new: func(node []byte) uint64 {
-				assert(BN(node).nbytes() <= BT_PAGE_SIZE)
-				ptr := uint64(uintptr(unsafe.Pointer(&node[0])))
-				assert(pages[ptr] == nil)
-				pages[ptr] = node
-				return ptr
-			},
-			del: func(ptr uint64) {
-				assert(pages[ptr] != nil)
-				delete(pages, ptr)
-			},
-		},
+		tree:  memTree(pages),
 		ref:   map[string]string{},
 		pages: pages,
 	}
 }
 
+// a tree with its pages in `pages`, keyed by their addresses
+func memTree(pages map[uint64]BN) BT {
+	return BT{
+		get: func(ptr uint64) []byte {
+			node, ok := pages[ptr]
+			assert(ok)
+			return node
+		},
+		new: func(node []byte) uint64 {
+			assert(BN(node).nbytes() <= BT_PAGE_SIZE)
+			ptr := uint64(uintptr(unsafe.Pointer(&node[0])))
+			assert(pages[ptr] == nil)
+			pages[ptr] = node
+			return ptr
+		},
+		del: func(ptr uint64) {
+			assert(pages[ptr] != nil)
+			delete(pages, ptr)
+		},
+	}
+}
+
 func (c *C) add(key string, val string) {
 	c.tree.Insert([]byte(key), []byte(val))
 	c.ref[key] = val
 }
 
+// the keys of the node and its bytes, see InspectPage
 func (node BN) String() string {
-	var buf bytes.Buffer
-
-	btype := node.btype()
-	nkeys := node.nkeys()
-
-	var typeStr string
-	switch btype {
-	case BN_LEAF:
-		typeStr = "LEAF"
-	case BN_NODE:
-		typeStr = "NODE"
-	default:
-		typeStr = fmt.Sprintf("UNKNOWN(%d)", btype)
-	}
-
-	fmt.Fprintf(&buf, "=== %s Node (nkeys=%d, nbytes=%d, total_size=%d) ===\n",
-		typeStr, nkeys, node.nbytes(), len(node))
-
-	if nkeys > 0 {
-		fmt.Fprintf(&buf, "Pointers: [")
-		for i := uint16(0); i < nkeys; i++ {
-			ptr := node.getPtr(i)
-			if i > 0 {
-				buf.WriteString(", ")
-			}
-			fmt.Fprintf(&buf, "%d", ptr)
-		}
-		buf.WriteString("]\n")
-
-		fmt.Fprintf(&buf, "Offsets:  [0")
-		for i := uint16(1); i <= nkeys; i++ {
-			offset := node.getOffset(i)
-			fmt.Fprintf(&buf, ", %d", offset)
-		}
-		buf.WriteString("]\n")
-
-		fmt.Fprintf(&buf, "KV pairs:\n")
-		for i := uint16(0); i < nkeys; i++ {
-			key := node.getKey(i)
-			val := node.getVal(i)
-			kvPos := node.kvPos(i)
-
-			fmt.Fprintf(&buf, "  [%2d] @pos=%d: ", i, kvPos)
-
-			if len(key) == 0 {
-				buf.WriteString("KEY: <empty>")
-			} else if len(key) <= 50 {
-				fmt.Fprintf(&buf, "KEY: %q", string(key))
-			} else {
-				fmt.Fprintf(&buf, "KEY: %q... (%d bytes)",
-					string(key[:50]), len(key))
-			}
-
-			if btype == BN_LEAF {
-				if len(val) == 0 {
-					buf.WriteString(", VAL: <empty>")
-				} else if len(val) <= 30 {
-					fmt.Fprintf(&buf, ", VAL: %q", string(val))
-				} else {
-					fmt.Fprintf(&buf, ", VAL: %q... (%d bytes)",
-						string(val[:30]), len(val))
-				}
-			} else {
-				buf.WriteString(", VAL: <nil>")
-			}
-			buf.WriteByte('\n')
-		}
-	} else {
-		buf.WriteString("(empty node)\n")
-	}
-
-	if len(node) > 0 {
-		fmt.Fprintf(&buf, "\nRaw data (first 100 bytes):\n")
-		limit := 100
-		if len(node) < limit {
-			limit = len(node)
-		}
-		for i := 0; i < limit; i += 16 {
-			end := i + 16
-			if end > limit {
-				end = limit
-			}
-
-			for j := i; j < end; j++ {
-				fmt.Fprintf(&buf, "%02x ", node[j])
-				if j == i+7 {
-					buf.WriteByte(' ')
-				}
-			}
-
-			for j := end; j < i+16; j++ {
-				buf.WriteString("   ")
-				if j == i+7 {
-					buf.WriteByte(' ')
-				}
-			}
-			buf.WriteString(" | ")
-			for j := i; j < end; j++ {
-				b := node[j]
-				if b >= 32 && b <= 126 {
-					buf.WriteByte(b)
-				} else {
-					buf.WriteByte('.')
-				}
-			}
-			buf.WriteByte('\n')
-		}
-	}
-
-	return buf.String()
+	var sb strings.Builder
+	formatNode(&sb, node)
+	sb.WriteByte('\n')
+	hexDump(&sb, node)
+	return sb.String()
 }
@@ -2,9 +2,11 @@ package btree
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"math/rand"
 	"sort"
+	"strings"
 	"testing"
 )
 
@@ -65,6 +67,14 @@ func verifyTreeStructure(t *testing.T, c *C) {
 				if !bytes.Equal(nodeKey, childKey) {
 					t.Errorf("Child first key is not equal to his key in parent")
 				}
+
+				// the count of the child is the pairs of its subtree
+				if bn.counted() {
+					want := binary.LittleEndian.Uint64(bn.getVal(i))
+					if n := walkCount(c, childPtr); n != want {
+						t.Errorf("Child count %d, the subtree has %d pairs", want, n)
+					}
+				}
 			}
 		}
 
@@ -100,6 +110,19 @@ func assertNodeSize(t *testing.T, node BN) {
 	}
 }
 
+// the pairs of the subtree `ptr` by its leaves
+func walkCount(c *C, ptr uint64) uint64 {
+	node := BN(c.tree.get(ptr))
+	if node.btype() == BN_LEAF {
+		return uint64(node.nkeys())
+	}
+	n := uint64(0)
+	for i := uint16(0); i < node.nkeys(); i++ {
+		n += walkCount(c, node.getPtr(i))
+	}
+	return n
+}
+
 func TestNodeSortedKeys(t *testing.T) {
 	c := NewC()
 
@@ -252,6 +275,72 @@ func TestBTreeConsistency(t *testing.T) {
 	verifyTreeStructure(t, c)
 }
 
+// bytes of the leaves over their pages
+func leafFill(c *C) float64 {
+	used, leaves := 0, 0
+	for _, node := range c.pages {
+		if node.btype() == BN_LEAF {
+			used += int(node.nbytes())
+			leaves++
+		}
+	}
+	return float64(used) / float64(leaves*BT_PAGE_SIZE)
+}
+
+func TestSplitAppended(t *testing.T) {
+	seq := NewC()
+	for i := 0; i < 20000; i++ {
+		seq.add(fmt.Sprintf("key%08d", i), fmt.Sprintf("val%d", i))
+	}
+	verifyTreeStructure(t, seq)
+	if f := leafFill(seq); f < 0.85 {
+		t.Fatalf("leaves of sequential inserts are %.2f full", f)
+	}
+
+	// keys before the last one split in the middle
+	random := NewC()
+	for _, i := range rand.Perm(20000) {
+		random.add(fmt.Sprintf("key%08d", i), fmt.Sprintf("val%d", i))
+	}
+	verifyTreeStructure(t, random)
+	if f := leafFill(random); f < 0.5 || f > 0.85 {
+		t.Fatalf("leaves of random inserts are %.2f full", f)
+	}
+	for _, c := range []*C{seq, random} {
+		for k, v := range c.ref {
+			if got, ok := c.tree.Get([]byte(k)); !ok || string(got) != v {
+				t.Fatalf("Get(%s) = %q, %v", k, got, ok)
+			}
+		}
+	}
+}
+
+func TestAppend(t *testing.T) {
+	c := NewC()
+	for i := 0; i < 20000; i++ {
+		k, v := fmt.Sprintf("key%08d", 2*i), fmt.Sprintf("val%d", i)
+		if !c.tree.Append([]byte(k), []byte(v)) {
+			t.Fatalf("Append(%s) = false", k)
+		}
+		c.ref[k] = v
+	}
+	// keys before the last one aren't appended
+	for _, k := range []string{"", "key00000001", "key00039998", "a"} {
+		if c.tree.Append([]byte(k), nil) {
+			t.Fatalf("Append(%q) = true", k)
+		}
+	}
+	verifyTreeStructure(t, c)
+	if f := leafFill(c); f < 0.85 {
+		t.Fatalf("leaves of appends are %.2f full", f)
+	}
+	for k, v := range c.ref {
+		if got, ok := c.tree.Get([]byte(k)); !ok || string(got) != v {
+			t.Fatalf("Get(%s) = %q, %v", k, got, ok)
+		}
+	}
+}
+
 func TestLargeKeysAndValues(t *testing.T) {
 	c := NewC()
 
@@ -276,6 +365,54 @@ func TestLargeKeysAndValues(t *testing.T) {
 	}
 }
 
+// pairs at the size limits next to large neighbours: no split in two
+// nodes of a page exists, the node is split in three
+func TestMaxPairSplit(t *testing.T) {
+	c := NewC()
+	c.add("a", strings.Repeat("a", 2000))
+	c.add("c", strings.Repeat("c", 2000))
+	c.add("b"+strings.Repeat("b", BT_MAX_KEY_SIZE-1), strings.Repeat("b", BT_MAX_VAL_SIZE))
+	verifyTreeStructure(t, c)
+
+	// random pairs up to the limits, updates grow values in place
+	c = NewC()
+	rng := rand.New(rand.NewSource(1))
+	pair := func() (string, string) {
+		klen := 1 + rng.Intn(BT_MAX_KEY_LIMIT)
+		switch rng.Intn(3) {
+		case 0:
+			klen = BT_MAX_KEY_LIMIT
+		case 1:
+			klen = 1 + rng.Intn(8)
+		}
+		key := fmt.Sprintf("%0*d", klen, rng.Intn(1000))[:klen]
+		vlen := BT_MAX_PAIR_SIZE - klen
+		if rng.Intn(2) == 0 {
+			vlen = rng.Intn(vlen + 1)
+		}
+		return key, strings.Repeat("v", vlen)
+	}
+	for i := 0; i < 3000; i++ {
+		key, val := pair()
+		c.add(key, val)
+		if i%3 == 0 {
+			// the next key of a deleted first key is the separator
+			key, _ = pair()
+			c.tree.Delete([]byte(key))
+			delete(c.ref, key)
+		}
+		if i%100 == 0 {
+			verifyTreeStructure(t, c)
+		}
+	}
+	verifyTreeStructure(t, c)
+	for k, v := range c.ref {
+		if got, ok := c.tree.Get([]byte(k)); !ok || string(got) != v {
+			t.Fatalf("Get(%.10s...) = %d bytes, %v", k, len(got), ok)
+		}
+	}
+}
+
 func TestRandomOperations(t *testing.T) {
 	c := NewC()
 
@@ -437,3 +574,126 @@ func BenchmarkBTreeInsert(b *testing.B) {
 		c.add(key, val)
 	}
 }
+
+// a leaf of `n` keys with pointers, for nodeAppendRange
+func testLeaf(n uint16) BN {
+	node := BN(make([]byte, BT_PAGE_SIZE))
+	node.setHeader(BN_LEAF, n)
+	for i := uint16(0); i < n; i++ {
+		nodeAppendKV(node, i, uint64(i)*7, []byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+	return node
+}
+
+func TestNodeAppendRange(t *testing.T) {
+	old := testLeaf(100)
+	for _, tc := range []struct{ dst, src, n uint16 }{{0, 0, 100}, {0, 10, 50}, {3, 40, 60}, {5, 99, 1}, {2, 7, 0}} {
+		new := BN(make([]byte, BT_PAGE_SIZE))
+		new.setHeader(BN_LEAF, tc.dst+tc.n)
+		for i := uint16(0); i < tc.dst; i++ {
+			nodeAppendKV(new, i, 1000+uint64(i), []byte(fmt.Sprintf("a%d", i)), []byte("a longer value"))
+		}
+		nodeAppendRange(new, old, tc.dst, tc.src, tc.n)
+		for i := uint16(0); i < tc.n; i++ {
+			j := tc.dst + i
+			if new.getPtr(j) != old.getPtr(tc.src+i) || !bytes.Equal(new.getKey(j), old.getKey(tc.src+i)) ||
+				!bytes.Equal(new.getVal(j), old.getVal(tc.src+i)) {
+				t.Fatalf("%+v: key %d = %q %q %d", tc, j, new.getKey(j), new.getVal(j), new.getPtr(j))
+			}
+		}
+		if tc.dst > 0 && string(new.getKey(tc.dst-1)) != fmt.Sprintf("a%d", tc.dst-1) {
+			t.Fatalf("%+v: key %d = %q", tc, tc.dst-1, new.getKey(tc.dst-1))
+		}
+	}
+}
+
+func BenchmarkNodeAppendRange(b *testing.B) {
+	old := testLeaf(150)
+	new := BN(make([]byte, BT_PAGE_SIZE))
+	new.setHeader(BN_LEAF, 150)
+	for i := 0; i < b.N; i++ {
+		nodeAppendRange(new, old, 0, 0, 150)
+	}
+}
+
+// decoding any page must not panic: nodeLayout rejects the pages the
+// accessors can't read, the others decode and encode back to the same bytes
+func FuzzNode(f *testing.F) {
+	c := NewC()
+	for i := 0; i < 50; i++ {
+		c.add(fmt.Sprintf("key%03d", i), fmt.Sprint("val", i))
+	}
+	for _, node := range c.pages {
+		f.Add([]byte(node))
+	}
+	f.Add([]byte{})
+	f.Add([]byte{BN_LEAF, 0, 1, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		node := make(BN, BT_PAGE_SIZE)
+		copy(node, data)
+		_ = node.String()
+		if nodeLayout(node) != "" {
+			return
+		}
+		n := node.nkeys()
+		again := make(BN, BT_PAGE_SIZE)
+		again.setHeader(node.btype(), n)
+		for i := uint16(0); i < n; i++ {
+			nodeAppendKV(again, i, node.getPtr(i), node.getKey(i), node.getVal(i))
+		}
+		if node.nbytes() > BT_PAGE_SIZE || !bytes.Equal(again[:4], node[:4]) || !bytes.Equal(again[HEADER:again.nbytes()], node[HEADER:node.nbytes()]) {
+			t.Fatalf("the node doesn't encode back:\n%s", node)
+		}
+	})
+}
+
+// random sequences of Insert, Append, Delete and Get against a map
+func FuzzTree(f *testing.F) {
+	f.Add([]byte("\x00a1\x00b2\x02a\x01c3\x03b"))
+	f.Add(bytes.Repeat([]byte{0, 'k', 7, 1, 'z', 9}, 200))
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		c := NewC()
+		for len(ops) >= 2 {
+			op, key := ops[0]%4, bytes.Repeat(ops[1:2], 1+int(ops[0])/4%64)
+			key = append(key, byte(len(ops)%7))
+			ops = ops[2:]
+			switch op {
+			case 0, 1:
+				val := bytes.Repeat([]byte{byte(len(ops))}, len(ops)%200)
+				if op == 0 {
+					c.tree.Insert(key, val)
+				} else if !c.tree.Append(key, val) {
+					continue
+				}
+				c.ref[string(key)] = string(val)
+			case 2:
+				_, ok := c.ref[string(key)]
+				if c.tree.Delete(key) != ok {
+					t.Fatalf("Delete(%q) != %v", key, ok)
+				}
+				delete(c.ref, string(key))
+			case 3:
+				val, ok := c.tree.Get(key)
+				if want, has := c.ref[string(key)]; ok != has || string(val) != want {
+					t.Fatalf("Get(%q) = %q, %v; want %q", key, val, ok, want)
+				}
+			}
+		}
+		verifyTreeStructure(t, c)
+		var keys []string
+		c.tree.Scan(nil, nil, func(key, val []byte) bool {
+			if len(key) > 0 {
+				keys = append(keys, string(key))
+			}
+			return true
+		})
+		if len(keys) != len(c.ref) || !sort.StringsAreSorted(keys) {
+			t.Fatalf("Scan() = %d keys, want %d", len(keys), len(c.ref))
+		}
+		for _, node := range c.pages {
+			if msg := nodeLayout(node); msg != "" {
+				t.Fatalf("%s\n%s", msg, node)
+			}
+		}
+	})
+}
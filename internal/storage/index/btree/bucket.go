@@ -0,0 +1,619 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var (
+	ErrBucketExists   = errors.New("bucket already exists")
+	ErrBucketNotFound = errors.New("bucket not found")
+	ErrBucketName     = errors.New("bucket name required")
+)
+
+// Bucket is a named keyspace with its own tree. The catalog tree maps
+// bucket paths to bucket records, nested buckets are stored in the catalog
+// under the path of the parent. Buckets are valid until the end of the transaction.
+//
+// bucket record
+// | root | seq | flags | pageSizeHint | valueLogThreshold | expiry | history | maxVersions | retention |
+// |  8B  |  8B |   2B  |      2B      |         4B        |   8B   |    8B   |      4B     |     8B    |
+type Bucket struct {
+	tx      *Tx
+	key     []byte // catalog key, the encoded path
+	tree    BT
+	expiry  BT     // expiration index of TTL families
+	history BT     // old versions of versioned families
+	seq     uint64 // the last value of NextSequence
+	opts    CFOptions
+	dirty   bool // the record is written to the catalog on commit
+	deleted bool
+}
+
+// catalog key of the path, names are escaped and terminated so that
+// a parent sorts right before its nested buckets
+//
+//	0x00 -> 0x00 0xff, terminator 0x00 0x01
+func bucketKey(parent []byte, name []byte) []byte {
+	key := append([]byte{}, parent...)
+	for _, c := range name {
+		if c == 0 {
+			key = append(key, 0, 0xff)
+		} else {
+			key = append(key, c)
+		}
+	}
+	return append(key, 0, 1)
+}
+
+// decodes the name of a direct child of `parent`, false for deeper buckets
+func bucketName(parent []byte, key []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(key, parent) {
+		return nil, false
+	}
+	rest := key[len(parent):]
+	name := []byte{}
+	for i := 0; i+1 < len(rest); i++ {
+		if rest[i] != 0 {
+			name = append(name, rest[i])
+			continue
+		}
+		if rest[i+1] == 1 {
+			return name, i+2 == len(rest)
+		}
+		name = append(name, 0)
+		i++
+	}
+	return nil, false
+}
+
+func encodeBucket(b *Bucket) []byte {
+	var data [52]byte
+	binary.LittleEndian.PutUint64(data[0:], b.tree.root)
+	binary.LittleEndian.PutUint64(data[8:], b.seq)
+	binary.LittleEndian.PutUint16(data[16:], b.opts.flags())
+	binary.LittleEndian.PutUint16(data[18:], b.opts.PageSizeHint)
+	binary.LittleEndian.PutUint32(data[20:], b.opts.ValueLogThreshold)
+	binary.LittleEndian.PutUint64(data[24:], b.expiry.root)
+	binary.LittleEndian.PutUint64(data[32:], b.history.root)
+	binary.LittleEndian.PutUint32(data[40:], b.opts.MaxVersions)
+	binary.LittleEndian.PutUint64(data[44:], uint64(b.opts.Retention))
+	return data[:]
+}
+
+// B-tree of a bucket with the same page callbacks as the main tree
+func (db *KV) bucketTree(root uint64) BT {
+	return BT{root: root, get: db.pageRead, new: db.pageAlloc, del: db.pageFree, counts: &db.counts, filters: db.filters, arena: &db.arena}
+}
+
+func (tx *Tx) openBucket(key []byte) *Bucket {
+	defer tx.catch("Bucket", nil)
+	if b, ok := tx.buckets[string(key)]; ok {
+		return b
+	}
+	val, ok := tx.catalog.Get(key)
+	if !ok {
+		return nil
+	}
+	if len(val) < 16 {
+		fault(0, "a bucket record of %d bytes", len(val))
+	}
+	b := &Bucket{tx: tx, key: key}
+	root := binary.LittleEndian.Uint64(val[0:8])
+	b.seq = binary.LittleEndian.Uint64(val[8:16])
+	b.opts = decodeOptions(val)
+	expiry, history := uint64(0), uint64(0)
+	if len(val) >= 32 {
+		expiry = binary.LittleEndian.Uint64(val[24:32])
+	}
+	if len(val) >= 52 {
+		history = binary.LittleEndian.Uint64(val[32:40])
+	}
+	if tx.writable {
+		b.tree = tx.db.bucketTree(root)
+		b.expiry = tx.db.bucketTree(expiry)
+		b.history = tx.db.bucketTree(history)
+	} else {
+		filters := tx.tree.filters
+		b.tree = BT{root: root, get: tx.pageRead, filters: filters}
+		b.expiry = BT{root: expiry, get: tx.pageRead, filters: filters}
+		b.history = BT{root: history, get: tx.pageRead, filters: filters}
+	}
+	tx.buckets[string(key)] = b
+	return b
+}
+
+func (tx *Tx) createBucket(key []byte, name []byte, opts CFOptions) (*Bucket, error) {
+	if tx.done {
+		return nil, ErrTxClosed
+	}
+	if !tx.writable {
+		return nil, ErrTxReadOnly
+	}
+	if len(name) == 0 {
+		return nil, ErrBucketName
+	}
+	if len(key) > tx.db.MaxKeySize {
+		return nil, fmt.Errorf("%w: a bucket path of %d bytes", ErrKeyTooLarge, len(key))
+	}
+	if tx.openBucket(key) != nil {
+		return nil, ErrBucketExists
+	}
+	if err := tx.Err(); err != nil {
+		return nil, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	b := &Bucket{
+		tx:      tx,
+		key:     key,
+		tree:    tx.db.bucketTree(0),
+		expiry:  tx.db.bucketTree(0),
+		history: tx.db.bucketTree(0),
+		opts:    opts,
+		dirty:   true,
+	}
+	tx.buckets[string(key)] = b
+	return b, nil
+}
+
+// nil if there is no such bucket
+func (tx *Tx) Bucket(name []byte) *Bucket {
+	if tx.closed() {
+		return nil
+	}
+	return tx.openBucket(bucketKey(nil, name))
+}
+
+func (tx *Tx) CreateBucket(name []byte) (*Bucket, error) {
+	return tx.createBucket(bucketKey(nil, name), name, CFOptions{})
+}
+
+// calls `fn` for each top-level bucket ordered by name until it returns an error
+func (tx *Tx) ForEachBucket(fn func(name []byte, b *Bucket) error) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	return tx.forEachBucket(nil, fn)
+}
+
+// names of the top-level buckets
+func (tx *Tx) Buckets() [][]byte {
+	var names [][]byte
+	tx.ForEachBucket(func(name []byte, b *Bucket) error {
+		names = append(names, name)
+		return nil
+	})
+	return names
+}
+
+func (tx *Tx) forEachBucket(parent []byte, fn func(name []byte, b *Bucket) error) error {
+	// buckets created in this transaction are not in the catalog yet
+	keys := map[string]bool{}
+	tx.catalog.Scan(parent, nil, func(k, v []byte) bool {
+		if !bytes.HasPrefix(k, parent) {
+			return false
+		}
+		keys[string(k)] = true
+		return true
+	})
+	for k := range tx.buckets {
+		keys[k] = true
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	slices.Sort(sorted)
+	for _, k := range sorted {
+		name, ok := bucketName(parent, []byte(k))
+		if !ok {
+			continue
+		}
+		if err := fn(name, tx.openBucket([]byte(k))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletes the bucket with its nested buckets,
+// pages of their trees are freed without visiting keys one by one
+func (tx *Tx) DeleteBucket(name []byte) error {
+	return tx.deleteBucket(bucketKey(nil, name))
+}
+
+func (tx *Tx) deleteBucket(key []byte) (err error) {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if tx.openBucket(key) == nil {
+		if err := tx.Err(); err != nil {
+			return err
+		}
+		return ErrBucketNotFound
+	}
+	defer tx.catch("DeleteBucket", &err)
+
+	for _, k := range tx.nestedKeys(key) {
+		b := tx.openBucket(k)
+		b.tree.Drop()
+		b.expiry.Drop()
+		b.history.Drop()
+		b.deleted = true
+		b.dirty = false
+		tx.catalog.Delete(k)
+		delete(tx.buckets, string(k))
+	}
+	return nil
+}
+
+// the catalog keys of the bucket `key` and of its nested buckets in order
+func (tx *Tx) nestedKeys(key []byte) [][]byte {
+	// nested buckets follow the parent in the catalog,
+	// the ones created in this transaction are only in the cache
+	keys := [][]byte{}
+	tx.catalog.Scan(key, nil, func(k, v []byte) bool {
+		if !bytes.HasPrefix(k, key) {
+			return false
+		}
+		keys = append(keys, append([]byte{}, k...))
+		return true
+	})
+	for k, b := range tx.buckets {
+		if b.dirty && bytes.HasPrefix([]byte(k), key) {
+			keys = append(keys, []byte(k))
+		}
+	}
+	slices.SortFunc(keys, bytes.Compare)
+	return slices.CompactFunc(keys, bytes.Equal)
+}
+
+// copies the top-level bucket `src` to the new bucket `dst`, with its
+// nested buckets, their options and sequences. the pages of the trees are
+// copied in one traversal, the keys aren't inserted one by one: like a
+// deleted bucket, the keys of the copy aren't watched, logged in the
+// changefeed nor audited.
+func (tx *Tx) CloneBucket(src, dst []byte) (err error) {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	srcKey, dstKey := bucketKey(nil, src), bucketKey(nil, dst)
+	if tx.openBucket(srcKey) == nil {
+		if err := tx.Err(); err != nil {
+			return err
+		}
+		return ErrBucketNotFound
+	}
+	if len(dst) == 0 {
+		return ErrBucketName
+	}
+	if tx.openBucket(dstKey) != nil {
+		return ErrBucketExists
+	}
+	defer tx.catch("CloneBucket", &err)
+
+	// the paths are checked before a bucket is created
+	srcKeys := tx.nestedKeys(srcKey)
+	dstKeys := make([][]byte, len(srcKeys))
+	for i, k := range srcKeys {
+		dstKeys[i] = append(slices.Clone(dstKey), k[len(srcKey):]...)
+		if len(dstKeys[i]) > tx.db.MaxKeySize {
+			return fmt.Errorf("%w: a bucket path of %d bytes", ErrKeyTooLarge, len(dstKeys[i]))
+		}
+	}
+	for i, k := range srcKeys {
+		b := tx.openBucket(k)
+		clone, err := tx.createBucket(dstKeys[i], dst, b.opts)
+		if err != nil {
+			return err
+		}
+		clone.tree.Clone(&b.tree)
+		clone.expiry.Clone(&b.expiry)
+		clone.history.Clone(&b.history)
+		clone.seq = b.seq
+	}
+	return nil
+}
+
+func (tx *Tx) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
+	if b := tx.Bucket(name); b != nil {
+		return b, nil
+	}
+	return tx.CreateBucket(name)
+}
+
+// nested bucket, nil if there is no such bucket
+func (b *Bucket) Bucket(name []byte) *Bucket {
+	if b.tx.closed() {
+		return nil
+	}
+	return b.tx.openBucket(bucketKey(b.key, name))
+}
+
+func (b *Bucket) CreateBucket(name []byte) (*Bucket, error) {
+	return b.tx.createBucket(bucketKey(b.key, name), name, CFOptions{})
+}
+
+// calls `fn` for each nested bucket ordered by name until it returns an error
+func (b *Bucket) ForEachBucket(fn func(name []byte, b *Bucket) error) error {
+	if b.tx.done {
+		return ErrTxClosed
+	}
+	return b.tx.forEachBucket(b.key, fn)
+}
+
+// names of the nested buckets
+func (b *Bucket) Buckets() [][]byte {
+	var names [][]byte
+	b.ForEachBucket(func(name []byte, b *Bucket) error {
+		names = append(names, name)
+		return nil
+	})
+	return names
+}
+
+func (b *Bucket) DeleteBucket(name []byte) error {
+	return b.tx.deleteBucket(bucketKey(b.key, name))
+}
+
+func (b *Bucket) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
+	if nested := b.Bucket(name); nested != nil {
+		return nested, nil
+	}
+	return b.CreateBucket(name)
+}
+
+func (b *Bucket) Get(key []byte) ([]byte, bool) {
+	if b.tx.closed() || b.tx.canceled() {
+		return nil, false
+	}
+	defer b.catch("Get", nil)
+	stored, ok := b.tree.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return b.tx.view(b.decode(stored, b.tx.now()))
+}
+
+// like Tx.GetCopy
+func (b *Bucket) GetCopy(key []byte) ([]byte, bool) {
+	val, ok := b.Get(key)
+	return bytes.Clone(val), ok
+}
+
+// like Tx.Fetch
+func (b *Bucket) Fetch(key []byte) ([]byte, error) {
+	if b.tx.done {
+		return nil, ErrTxClosed
+	}
+	if len(key) == 0 {
+		return nil, ErrInvalidKey
+	}
+	if b.tx.canceled() {
+		return nil, b.tx.Err()
+	}
+	var err error
+	val, ok := b.tx.view(func() ([]byte, bool) {
+		defer b.catch("Fetch", &err)
+		stored, ok := b.tree.Get(key)
+		if !ok {
+			return nil, false
+		}
+		return b.decode(stored, b.tx.now())
+	}())
+	return found(val, ok, err)
+}
+
+// checkSize of the keys and the values the pair is stored with in the
+// trees of the bucket: the expiry key and the version have a prefix
+func (b *Bucket) checkSize(key, stored []byte) error {
+	klen, vlen := len(key), len(stored)
+	if b.opts.TTL {
+		klen += 8 // expiryKey
+	}
+	if b.opts.versioned() {
+		// the version has the type instead of the expiration
+		hlen := 1 + len(stored)
+		if b.opts.TTL {
+			hlen -= 8
+		}
+		klen, vlen = max(klen, len(historyKey(key, 0))), max(vlen, hlen)
+	}
+	return b.tx.db.checkSize(klen, vlen)
+}
+
+func (b *Bucket) Set(key []byte, val []byte) error {
+	return b.set(key, val, 0, false)
+}
+
+// Set of a key expected after every key of the bucket, like the timestamps
+// of a time series, see BT.Append. other keys are set as by Set.
+func (b *Bucket) Append(key []byte, val []byte) error {
+	return b.set(key, val, 0, true)
+}
+
+func (b *Bucket) set(key []byte, val []byte, expireAt int64, tail bool) (err error) {
+	if err := b.writable(); err != nil {
+		return err
+	}
+	if len(key) == 0 {
+		return ErrInvalidKey
+	}
+	stored := b.encode(val, expireAt)
+	if err := b.checkSize(key, stored); err != nil {
+		return err
+	}
+	if err := b.tx.checkEntry(b, key, val); err != nil {
+		return err
+	}
+	defer b.catch("Set", &err)
+	b.tx.record(b, key, val, true)
+	if b.opts.TTL {
+		b.unindex(key)
+		b.index(key, expireAt)
+	}
+	if !tail || !b.tree.Append(key, stored) {
+		b.tree.Insert(key, stored)
+	}
+	if b.opts.versioned() {
+		b.addVersion(key, val, false)
+	}
+	b.dirty = true
+	return nil
+}
+
+func (b *Bucket) Del(key []byte) (deleted bool, err error) {
+	if err := b.writable(); err != nil {
+		return false, err
+	}
+	if len(key) == 0 {
+		return false, ErrInvalidKey
+	}
+	defer b.catch("Del", &err)
+	b.tx.record(b, key, nil, false)
+	if b.opts.TTL {
+		b.unindex(key)
+	}
+	deleted = b.tree.Delete(key)
+	if deleted && b.opts.versioned() {
+		b.addVersion(key, nil, true)
+	}
+	b.dirty = b.dirty || deleted
+	return deleted, nil
+}
+
+// calls `fn` for keys in [start, end) in order until it returns false
+func (b *Bucket) Scan(start, end []byte, fn func(key, val []byte) bool) {
+	if b.tx.closed() || b.tx.canceled() {
+		return
+	}
+	defer b.catch("Scan", nil)
+	fn = b.tx.interruptible(callback(fn))
+	if !b.opts.Compression && !b.opts.TTL {
+		b.tree.Scan(start, end, fn)
+		return
+	}
+	now := b.tx.now()
+	b.tree.Scan(start, end, func(key, stored []byte) bool {
+		val, ok := b.decode(stored, now)
+		return !ok || fn(key, val)
+	})
+}
+
+// number of keys in [start, end), see BT.Count. like Rank, the expired
+// keys are counted until they are swept.
+func (b *Bucket) Count(start, end []byte) int {
+	if b.tx.closed() || b.tx.canceled() {
+		return 0
+	}
+	defer b.catch("Count", nil)
+	return b.tree.Count(start, end)
+}
+
+// number of keys less than `key`, see BT.Rank. the expired keys are
+// counted until they are swept.
+func (b *Bucket) Rank(key []byte) int {
+	if b.tx.closed() || b.tx.canceled() {
+		return 0
+	}
+	defer b.catch("Rank", nil)
+	return b.tree.Rank(key)
+}
+
+// the key of rank `i`, the first one is 0, false past the last key. like
+// Rank, the expired keys are counted until they are swept.
+func (b *Bucket) SelectNth(i int) ([]byte, bool) {
+	if b.tx.closed() || b.tx.canceled() {
+		return nil, false
+	}
+	defer b.catch("SelectNth", nil)
+	iter := b.tree.SelectNth(i)
+	if !iter.Valid() {
+		return nil, false
+	}
+	key, _ := iter.Deref()
+	return key, true
+}
+
+// calls `fn` for every key of the bucket, see Tx.ForEach
+func (b *Bucket) ForEach(fn func(key, val []byte) error) error {
+	if b.tx.done {
+		return ErrTxClosed
+	}
+	return forEach(b.tx, b.Scan, fn)
+}
+
+// scans [start, end) with `n` goroutines, see BT.ScanParallel
+func (b *Bucket) ScanParallel(start, end []byte, n int, fn func(shard int, key, val []byte) error) (err error) {
+	if b.tx.done {
+		return ErrTxClosed
+	}
+	if b.tx.canceled() {
+		return b.tx.Err()
+	}
+	defer b.catch("ScanParallel", &err)
+	fn = b.tx.interruptibleParallel(parallelCallback(fn))
+	if !b.opts.Compression && !b.opts.TTL {
+		return b.tree.ScanParallel(start, end, n, fn)
+	}
+	now := b.tx.now()
+	return b.tree.ScanParallel(start, end, n, func(shard int, key, stored []byte) error {
+		val, ok := b.decode(stored, now)
+		if !ok {
+			return nil
+		}
+		return fn(shard, key, val)
+	})
+}
+
+// returns the next value of the bucket sequence, starting from 1.
+// the sequence is stored in the bucket record and is committed with the transaction.
+func (b *Bucket) NextSequence() (uint64, error) {
+	if err := b.writable(); err != nil {
+		return 0, err
+	}
+	b.seq++
+	b.dirty = true
+	return b.seq, nil
+}
+
+// the last value returned by NextSequence
+func (b *Bucket) Sequence() uint64 {
+	return b.seq
+}
+
+// sets the sequence, NextSequence returns the value after it
+func (b *Bucket) SetSequence(seq uint64) error {
+	if err := b.writable(); err != nil {
+		return err
+	}
+	b.seq = seq
+	b.dirty = true
+	return nil
+}
+
+func (b *Bucket) writable() error {
+	if b.tx.done {
+		return ErrTxClosed
+	}
+	if !b.tx.writable {
+		return ErrTxReadOnly
+	}
+	if b.deleted {
+		return ErrBucketNotFound
+	}
+	b.tx.canceled()
+	return b.tx.Err()
+}
@@ -0,0 +1,554 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestBucketBasic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+
+	tx := db.Begin()
+	users, err := tx.CreateBucket([]byte("users"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	posts, err := tx.CreateBucket([]byte("posts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.CreateBucket([]byte("users")); err != ErrBucketExists {
+		t.Fatalf("CreateBucket(users) twice = %v; want ErrBucketExists", err)
+	}
+	if _, err := tx.CreateBucket(nil); err != ErrBucketName {
+		t.Fatalf("CreateBucket(nil) = %v; want ErrBucketName", err)
+	}
+
+	// the same key in different keyspaces
+	users.Set([]byte("1"), []byte("alice"))
+	posts.Set([]byte("1"), []byte("hello"))
+	tx.tree.Insert([]byte("1"), []byte("default"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = openKV(t, path)
+	defer db.Close()
+	if val, ok := db.Get([]byte("1")); !ok || string(val) != "default" {
+		t.Fatalf("Get(1) = %q, %v; want default, true", val, ok)
+	}
+
+	rtx := db.BeginRead()
+	defer rtx.Rollback()
+	if val, ok := rtx.Bucket([]byte("users")).Get([]byte("1")); !ok || string(val) != "alice" {
+		t.Fatalf("users.Get(1) = %q, %v; want alice, true", val, ok)
+	}
+	if val, ok := rtx.Bucket([]byte("posts")).Get([]byte("1")); !ok || string(val) != "hello" {
+		t.Fatalf("posts.Get(1) = %q, %v; want hello, true", val, ok)
+	}
+	if b := rtx.Bucket([]byte("missing")); b != nil {
+		t.Fatal("Bucket(missing) is not nil")
+	}
+	if _, err := rtx.CreateBucket([]byte("new")); err != ErrTxReadOnly {
+		t.Fatalf("CreateBucket in read tx = %v; want ErrTxReadOnly", err)
+	}
+	if err := rtx.Bucket([]byte("users")).Set([]byte("2"), nil); err != ErrTxReadOnly {
+		t.Fatalf("Set in read tx = %v; want ErrTxReadOnly", err)
+	}
+}
+
+func TestBucketManyKeys(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	tx := db.Begin()
+	b, _ := tx.CreateBucket([]byte("data"))
+	for i := 0; i < 5000; i++ {
+		b.Set([]byte(fmt.Sprintf("key_%05d", i)), []byte(fmt.Sprintf("val_%d", i)))
+	}
+	for i := 0; i < 5000; i += 2 {
+		b.Del([]byte(fmt.Sprintf("key_%05d", i)))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	rtx := db.BeginRead()
+	defer rtx.Rollback()
+	b = rtx.Bucket([]byte("data"))
+	n := 0
+	b.Scan(nil, nil, func(key, val []byte) bool {
+		want := fmt.Sprintf("key_%05d", 2*n+1)
+		if string(key) != want {
+			t.Fatalf("scan[%d] = %q; want %q", n, key, want)
+		}
+		n++
+		return true
+	})
+	if n != 2500 {
+		t.Fatalf("scanned %d keys; want 2500", n)
+	}
+}
+
+func TestBucketRollback(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	tx := db.Begin()
+	b, _ := tx.CreateBucket([]byte("a"))
+	b.Set([]byte("k"), []byte("v1"))
+	tx.Commit()
+
+	tx = db.Begin()
+	tx.Bucket([]byte("a")).Set([]byte("k"), []byte("v2"))
+	tx.CreateBucket([]byte("b"))
+	tx.Rollback()
+
+	rtx := db.BeginRead()
+	defer rtx.Rollback()
+	if val, _ := rtx.Bucket([]byte("a")).Get([]byte("k")); string(val) != "v1" {
+		t.Fatalf("Get(k) after rollback = %q; want v1", val)
+	}
+	if rtx.Bucket([]byte("b")) != nil {
+		t.Fatal("bucket created in rolled back tx exists")
+	}
+}
+
+func TestNestedBuckets(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	tx := db.Begin()
+	parent, _ := tx.CreateBucket([]byte("parent"))
+	child, err := parent.CreateBucket([]byte("child"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	child.Set([]byte("k"), []byte("nested"))
+	parent.Set([]byte("k"), []byte("top"))
+	// a top-level bucket with the same name is a different bucket
+	tx.CreateBucket([]byte("child"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	rtx := db.BeginRead()
+	defer rtx.Rollback()
+	child = rtx.Bucket([]byte("parent")).Bucket([]byte("child"))
+	if val, ok := child.Get([]byte("k")); !ok || string(val) != "nested" {
+		t.Fatalf("child.Get(k) = %q, %v; want nested, true", val, ok)
+	}
+	if _, ok := rtx.Bucket([]byte("child")).Get([]byte("k")); ok {
+		t.Fatal("top-level bucket shares keys with the nested one")
+	}
+}
+
+func TestBucketSnapshot(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	tx := db.Begin()
+	b, _ := tx.CreateBucket([]byte("b"))
+	b.Set([]byte("k"), []byte("old"))
+	tx.Commit()
+
+	rtx := db.BeginRead()
+	defer rtx.Rollback()
+
+	tx = db.Begin()
+	tx.Bucket([]byte("b")).Set([]byte("k"), []byte("new"))
+	tx.Commit()
+
+	if val, _ := rtx.Bucket([]byte("b")).Get([]byte("k")); string(val) != "old" {
+		t.Fatalf("reader sees %q; want old", val)
+	}
+}
+
+func TestBucketNextSequence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+
+	tx := db.Begin()
+	b, _ := tx.CreateBucket([]byte("ids"))
+	for want := uint64(1); want <= 3; want++ {
+		if seq, err := b.NextSequence(); err != nil || seq != want {
+			t.Fatalf("NextSequence() = %d, %v; want %d, nil", seq, err, want)
+		}
+	}
+	tx.Commit()
+
+	// rolled back values are reused
+	tx = db.Begin()
+	tx.Bucket([]byte("ids")).NextSequence()
+	tx.Rollback()
+	db.Close()
+
+	db = openKV(t, path)
+	defer db.Close()
+	tx = db.Begin()
+	b = tx.Bucket([]byte("ids"))
+	if seq := b.Sequence(); seq != 3 {
+		t.Fatalf("Sequence() after reopen = %d; want 3", seq)
+	}
+	if seq, _ := b.NextSequence(); seq != 4 {
+		t.Fatalf("NextSequence() after reopen = %d; want 4", seq)
+	}
+	tx.Commit()
+	tx = db.Begin()
+	tx.Bucket([]byte("ids")).SetSequence(100)
+	tx.Commit()
+	tx = db.Begin()
+	if seq, _ := tx.Bucket([]byte("ids")).NextSequence(); seq != 101 {
+		t.Fatalf("NextSequence() after SetSequence(100) = %d; want 101", seq)
+	}
+	tx.Rollback()
+
+	rtx := db.BeginRead()
+	defer rtx.Rollback()
+	if _, err := rtx.Bucket([]byte("ids")).NextSequence(); err != ErrTxReadOnly {
+		t.Fatalf("NextSequence() in read tx = %v; want ErrTxReadOnly", err)
+	}
+}
+
+func TestDeleteBucket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+
+	tx := db.Begin()
+	b, _ := tx.CreateBucket([]byte("big"))
+	for i := 0; i < 5000; i++ {
+		b.Set([]byte(fmt.Sprintf("key_%05d", i)), []byte("some value"))
+	}
+	nested, _ := b.CreateBucket([]byte("nested"))
+	nested.Set([]byte("k"), []byte("v"))
+	keep, _ := tx.CreateBucket([]byte("keep"))
+	keep.Set([]byte("k"), []byte("v"))
+	tx.Commit()
+	size := db.page.flushed
+
+	tx = db.Begin()
+	if err := tx.DeleteBucket([]byte("big")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.DeleteBucket([]byte("big")); err != ErrBucketNotFound {
+		t.Fatalf("DeleteBucket twice = %v; want ErrBucketNotFound", err)
+	}
+	if err := b.Set([]byte("k"), nil); err != ErrTxClosed {
+		t.Fatalf("Set on bucket of a finished tx = %v; want ErrTxClosed", err)
+	}
+	tx.Commit()
+
+	tx = db.Begin()
+	if tx.Bucket([]byte("big")) != nil {
+		t.Fatal("deleted bucket exists")
+	}
+	if tx.Bucket([]byte("keep")) == nil {
+		t.Fatal("other bucket was deleted")
+	}
+	// the bucket can be created again and is empty
+	b, err := tx.CreateBucket([]byte("big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Bucket([]byte("nested")) != nil {
+		t.Fatal("nested bucket survived the parent")
+	}
+	if _, ok := b.Get([]byte("key_00000")); ok {
+		t.Fatal("recreated bucket is not empty")
+	}
+	// freed pages are reused
+	for i := 0; i < 5000; i++ {
+		b.Set([]byte(fmt.Sprintf("key_%05d", i)), []byte("some value"))
+	}
+	tx.Commit()
+	if db.page.flushed > size+size/4 {
+		t.Fatalf("pages of the deleted bucket are not reused: %d before, %d after", size, db.page.flushed)
+	}
+	db.Close()
+}
+
+func TestCloneBucket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+	defer db.Close()
+
+	tx := db.Begin()
+	b, _ := tx.CreateBucket([]byte("src"))
+	for i := 0; i < 5000; i++ {
+		b.Set([]byte(fmt.Sprintf("key_%05d", i)), []byte("some value"))
+	}
+	b.SetSequence(42)
+	nested, _ := b.CreateBucket([]byte("nested"))
+	nested.Set([]byte("k"), []byte("v"))
+	tx.Commit()
+
+	tx = db.Begin()
+	if err := tx.CloneBucket([]byte("src"), []byte("dst")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.CloneBucket([]byte("src"), []byte("dst")); err != ErrBucketExists {
+		t.Fatalf("CloneBucket() to an existing bucket = %v", err)
+	}
+	if err := tx.CloneBucket([]byte("none"), []byte("x")); err != ErrBucketNotFound {
+		t.Fatalf("CloneBucket() of no bucket = %v", err)
+	}
+	// the copy is updated alone
+	dst := tx.Bucket([]byte("dst"))
+	dst.Set([]byte("key_00001"), []byte("changed"))
+	dst.Bucket([]byte("nested")).Del([]byte("k"))
+	// a bucket of the transaction is copied too
+	fresh, _ := tx.CreateBucket([]byte("fresh"))
+	fresh.Set([]byte("k"), []byte("v"))
+	if err := tx.CloneBucket([]byte("fresh"), []byte("fresh2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx = db.Begin()
+	src, dst := tx.Bucket([]byte("src")), tx.Bucket([]byte("dst"))
+	if src.Count(nil, nil) != 5000 || dst.Count(nil, nil) != 5000 || dst.Sequence() != 42 {
+		t.Fatalf("%d keys in src, %d in dst, sequence %d", src.Count(nil, nil), dst.Count(nil, nil), dst.Sequence())
+	}
+	if val, _ := src.Get([]byte("key_00001")); string(val) != "some value" {
+		t.Fatalf("src key_00001 = %q", val)
+	}
+	if val, _ := dst.Get([]byte("key_00001")); string(val) != "changed" {
+		t.Fatalf("dst key_00001 = %q", val)
+	}
+	if _, ok := src.Bucket([]byte("nested")).Get([]byte("k")); !ok {
+		t.Fatal("the delete of the copy is in the source")
+	}
+	if val, _ := tx.Bucket([]byte("fresh2")).Get([]byte("k")); string(val) != "v" {
+		t.Fatalf("fresh2 k = %q", val)
+	}
+	// the pages aren't shared
+	if err := tx.DeleteBucket([]byte("src")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := Check(path); err != nil || !report.OK() {
+		t.Fatalf("Check() = %+v, %v", report, err)
+	}
+}
+
+func TestDeleteBucketCreatedInTx(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	tx := db.Begin()
+	b, _ := tx.CreateBucket([]byte("tmp"))
+	b.Set([]byte("k"), []byte("v"))
+	b.CreateBucket([]byte("nested"))
+	if err := tx.DeleteBucket([]byte("tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set([]byte("k"), nil); err != ErrBucketNotFound {
+		t.Fatalf("Set on deleted bucket = %v; want ErrBucketNotFound", err)
+	}
+	tx.Commit()
+
+	rtx := db.BeginRead()
+	defer rtx.Rollback()
+	if rtx.Bucket([]byte("tmp")) != nil {
+		t.Fatal("deleted bucket exists")
+	}
+	n := 0
+	rtx.catalog.Scan(nil, nil, func(k, v []byte) bool { n++; return true })
+	if n != 0 {
+		t.Fatalf("catalog has %d records; want 0", n)
+	}
+}
+
+func TestBucketStats(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	tx := db.Begin()
+	defer tx.Rollback()
+	b, _ := tx.CreateBucket([]byte("b"))
+	if stats := b.Stats(); stats.Keys != 0 || stats.Depth != 0 || stats.Size != 0 {
+		t.Fatalf("empty bucket stats = %+v", stats)
+	}
+
+	for i := 0; i < 3000; i++ {
+		b.Set([]byte(fmt.Sprintf("key_%05d", i)), []byte("value"))
+	}
+	stats := b.Stats()
+	if stats.Keys != 3000 {
+		t.Fatalf("Keys = %d; want 3000", stats.Keys)
+	}
+	if stats.KeyBytes != 3000*9 || stats.ValBytes != 3000*5 {
+		t.Fatalf("KeyBytes, ValBytes = %d, %d; want %d, %d", stats.KeyBytes, stats.ValBytes, 3000*9, 3000*5)
+	}
+	if stats.Depth != 2 || stats.BranchPages != 1 || stats.LeafPages < 2 {
+		t.Fatalf("tree shape = %+v; want a root with leaves", stats)
+	}
+	if stats.Size != (stats.LeafPages+stats.BranchPages)*BT_PAGE_SIZE {
+		t.Fatalf("Size = %d for %d pages", stats.Size, stats.LeafPages+stats.BranchPages)
+	}
+	if stats.FillFactor <= 0.3 || stats.FillFactor > 1 {
+		t.Fatalf("FillFactor = %f", stats.FillFactor)
+	}
+
+	b.Del([]byte("key_00000"))
+	if stats := b.Stats(); stats.Keys != 2999 {
+		t.Fatalf("Keys after delete = %d; want 2999", stats.Keys)
+	}
+}
+
+func TestForEachBucket(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	tx := db.Begin()
+	for _, name := range []string{"b", "a", "c", "with\x00zero"} {
+		tx.CreateBucket([]byte(name))
+	}
+	a := tx.Bucket([]byte("a"))
+	a.CreateBucket([]byte("y"))
+	x, _ := a.CreateBucket([]byte("x"))
+	x.CreateBucket([]byte("deep"))
+	tx.Commit()
+
+	tx = db.Begin()
+	defer tx.Rollback()
+	// created in this transaction
+	tx.CreateBucket([]byte("d"))
+	tx.DeleteBucket([]byte("c"))
+
+	names := tx.Buckets()
+	want := []string{"a", "b", "d", "with\x00zero"}
+	if fmt.Sprintf("%q", names) != fmt.Sprintf("%q", want) {
+		t.Fatalf("Buckets() = %q; want %q", names, want)
+	}
+
+	nested := tx.Bucket([]byte("a")).Buckets()
+	if fmt.Sprintf("%q", nested) != `["x" "y"]` {
+		t.Fatalf("a.Buckets() = %q; want [x y]", nested)
+	}
+
+	var visited []string
+	err := tx.ForEachBucket(func(name []byte, b *Bucket) error {
+		if b == nil {
+			t.Fatalf("nil bucket %q", name)
+		}
+		visited = append(visited, string(name))
+		if len(visited) == 2 {
+			return ErrBucketExists
+		}
+		return nil
+	})
+	if err != ErrBucketExists || len(visited) != 2 {
+		t.Fatalf("ForEachBucket() = %v after %q; want the callback error after 2", err, visited)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	tx := db.Begin()
+	users, _ := tx.CreateBucket([]byte("users"))
+	for _, k := range []string{"b", "a", "c"} {
+		tx.Set([]byte(k), []byte("v"+k))
+		users.Set([]byte("u"+k), []byte("v"+k))
+	}
+	tx.Commit()
+
+	var got []string
+	err := db.ForEach(func(key, val []byte) error {
+		got = append(got, string(key)+"="+string(val))
+		return nil
+	})
+	if err != nil || fmt.Sprint(got) != "[a=va b=vb c=vc]" {
+		t.Fatalf("ForEach() = %q, %v", got, err)
+	}
+
+	// stops at the first error
+	got = nil
+	err = db.ForEachIn([]byte("users"), func(key, val []byte) error {
+		got = append(got, string(key))
+		if len(got) == 2 {
+			return ErrKeyNotFound
+		}
+		return nil
+	})
+	if err != ErrKeyNotFound || fmt.Sprint(got) != "[ua ub]" {
+		t.Fatalf("ForEachIn() = %q, %v", got, err)
+	}
+	if err := db.ForEachIn([]byte("nope"), nil); err != ErrBucketNotFound {
+		t.Fatalf("ForEachIn() of a missing bucket = %v", err)
+	}
+
+	tx = db.BeginRead()
+	tx.Rollback()
+	if err := tx.ForEach(nil); err != ErrTxClosed {
+		t.Fatalf("ForEach() after Rollback = %v", err)
+	}
+}
+
+func TestColumnFamilyCompression(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+
+	tx := db.Begin()
+	opts := CFOptions{Compression: true, PageSizeHint: 8192, ValueLogThreshold: 1024}
+	cf, err := tx.CreateColumnFamily([]byte("logs"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := tx.CreateBucket([]byte("plain"))
+
+	big := bytes.Repeat([]byte("compressible "), 200)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%03d", i))
+		cf.Set(key, big)
+		plain.Set(key, big)
+	}
+	cf.Set([]byte("small"), []byte("x"))
+	if val, _ := cf.Get([]byte("key_000")); !bytes.Equal(val, big) {
+		t.Fatalf("Get() before commit returned %d bytes; want %d", len(val), len(big))
+	}
+	if got, want := cf.Stats().ValBytes, plain.Stats().ValBytes; got*10 > want {
+		t.Fatalf("compressed values take %d bytes, plain %d", got, want)
+	}
+	if _, err := tx.CreateColumnFamily([]byte("bad"), CFOptions{PageSizeHint: 3000}); err != ErrBadOptions {
+		t.Fatalf("CreateColumnFamily with a bad hint = %v; want ErrBadOptions", err)
+	}
+	tx.Commit()
+	db.Close()
+
+	db = openKV(t, path)
+	defer db.Close()
+	rtx := db.BeginRead()
+	defer rtx.Rollback()
+	cf = rtx.ColumnFamily([]byte("logs"))
+	if cf.Options() != opts {
+		t.Fatalf("Options() after reopen = %+v; want %+v", cf.Options(), opts)
+	}
+	if plain := rtx.Bucket([]byte("plain")); plain.Options() != (CFOptions{}) {
+		t.Fatalf("bucket options = %+v; want defaults", plain.Options())
+	}
+	if val, ok := cf.Get([]byte("small")); !ok || string(val) != "x" {
+		t.Fatalf("Get(small) = %q, %v; want x, true", val, ok)
+	}
+	n := 0
+	cf.Scan([]byte("key_"), []byte("key_~"), func(key, val []byte) bool {
+		if !bytes.Equal(val, big) {
+			t.Fatalf("Scan value of %s has %d bytes; want %d", key, len(val), len(big))
+		}
+		n++
+		return true
+	})
+	if n != 100 {
+		t.Fatalf("scanned %d keys; want 100", n)
+	}
+}
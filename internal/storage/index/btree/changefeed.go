@@ -0,0 +1,285 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// The changefeed is a durable log of the changes of write transactions,
+// kept in the bucket CHANGEFEED_BUCKET when KV.Changefeed is set. entries
+// are written by the transaction that made the changes, so the log has
+// every committed change in commit order and nothing of rolled back
+// transactions. consumers read it from a commit sequence on with
+// Tx.Changes, or tail it with KV.Follow. like watches, the log has the
+// changes of the main keyspace and of top-level buckets, keys removed by
+// Sweep and DeleteBucket are not logged.
+//
+// the log grows until it is trimmed with Tx.TrimChanges.
+//
+// entry key
+// | seq | index |
+// | 8B  |  4B   |
+//
+// entry value
+// | op | bucket len | bucket | key len | key | value |
+// | 1B |     4B     |        |   4B    |     |       |
+//
+// the entry of key seq 0 holds the first sequence kept by TrimChanges.
+
+var ErrChangesTrimmed = errors.New("changes were trimmed")
+
+const CHANGEFEED_BUCKET = "_changefeed"
+
+const (
+	OP_SET = 1
+	OP_DEL = 2
+)
+
+// entries read by a feed at a time
+const FEED_BATCH = 1000
+
+var changefeedKey = bucketKey(nil, []byte(CHANGEFEED_BUCKET))
+
+// an entry of the changefeed, Value is nil for OP_DEL
+type Entry struct {
+	Seq    uint64 // the commit sequence of the transaction
+	Op     byte
+	Bucket []byte // nil for the main keyspace
+	Key    []byte
+	Value  []byte
+}
+
+func entryKey(seq uint64, idx uint32) []byte {
+	key := binary.BigEndian.AppendUint64(nil, seq)
+	return binary.BigEndian.AppendUint32(key, idx)
+}
+
+func encodeEntry(e *Entry) []byte {
+	out := []byte{e.Op}
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(e.Bucket)))
+	out = append(out, e.Bucket...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(e.Key)))
+	out = append(out, e.Key...)
+	return append(out, e.Value...)
+}
+
+// checkSize of the entry of setting `key` to `val` in the bucket `b`, nil
+// for the main keyspace. the entry has the value with the bucket and the
+// key, it must fit the value of a pair as well.
+func (tx *Tx) checkEntry(b *Bucket, key, val []byte) error {
+	db := tx.db
+	if !db.Changefeed || db.Replica || db.ReadOnly {
+		return nil
+	}
+	var name []byte
+	if b != nil {
+		var top bool
+		if name, top = bucketName(nil, b.key); !top || bytes.Equal(b.key, changefeedKey) || bytes.Equal(b.key, blobKey) {
+			return nil
+		}
+	}
+	if err := db.checkSize(0, 1+4+len(name)+4+len(key)+len(val)); err != nil {
+		return fmt.Errorf("changefeed entry: %w", err)
+	}
+	return nil
+}
+
+func decodeEntry(key, val []byte) (Entry, bool) {
+	if len(key) != 12 || len(val) < 5 {
+		return Entry{}, false
+	}
+	e := Entry{Seq: binary.BigEndian.Uint64(key), Op: val[0]}
+	n := int(binary.LittleEndian.Uint32(val[1:]))
+	rest := val[5:]
+	if len(rest) < n+4 {
+		return Entry{}, false
+	}
+	if n > 0 {
+		e.Bucket = bytes.Clone(rest[:n])
+	}
+	rest = rest[n:]
+	n = int(binary.LittleEndian.Uint32(rest))
+	rest = rest[4:]
+	if len(rest) < n {
+		return Entry{}, false
+	}
+	e.Key = bytes.Clone(rest[:n])
+	if e.Op == OP_SET {
+		e.Value = append([]byte{}, rest[n:]...)
+	}
+	return e, true
+}
+
+// writes the changes of the transaction to the changefeed, before commit
+func (tx *Tx) logChanges(seq uint64) {
+	b := tx.openBucket(changefeedKey)
+	if b == nil {
+		b, _ = tx.createBucket(changefeedKey, []byte(CHANGEFEED_BUCKET), CFOptions{})
+	}
+	idx := uint32(0)
+	for i := range tx.changes {
+		c := &tx.changes[i]
+		e := Entry{Op: OP_SET, Key: c.Key, Value: c.New}
+		if c.New == nil {
+			e.Op = OP_DEL
+		}
+		if c.bucket != nil {
+			name, top := bucketName(nil, c.bucket)
+			if !top {
+				continue
+			}
+			e.Bucket = name
+		}
+		b.Set(entryKey(seq, idx), encodeEntry(&e))
+		idx++
+	}
+}
+
+// calls `fn` for the entries of the changefeed from the commit sequence
+// `from` on until it returns false. ErrChangesTrimmed if entries from
+// `from` on were trimmed, 0 is the first entry kept.
+func (tx *Tx) Changes(from uint64, fn func(e Entry) bool) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	_, err := tx.changesFrom(entryKey(from, 0), fn)
+	return err
+}
+
+// the key of the next entry after the last one passed to `fn`
+func (tx *Tx) changesFrom(start []byte, fn func(e Entry) bool) ([]byte, error) {
+	b := tx.openBucket(changefeedKey)
+	if b == nil {
+		return start, nil
+	}
+	from := binary.BigEndian.Uint64(start)
+	if first, ok := b.Get(entryKey(0, 0)); ok && from > 0 && from < binary.BigEndian.Uint64(first) {
+		return start, ErrChangesTrimmed
+	}
+	if from == 0 {
+		start = entryKey(1, 0)
+	}
+	next := start
+	var err error
+	b.Scan(start, nil, func(key, val []byte) bool {
+		e, ok := decodeEntry(key, val)
+		if !ok {
+			err = errors.New("bad changefeed entry")
+			return false
+		}
+		next = entryKey(e.Seq, binary.BigEndian.Uint32(key[8:])+1)
+		return fn(e)
+	})
+	return next, err
+}
+
+// deletes the entries of commit sequences before `seq`, returns the number
+// of entries deleted
+func (tx *Tx) TrimChanges(seq uint64) (int, error) {
+	if tx.done {
+		return 0, ErrTxClosed
+	}
+	if !tx.writable {
+		return 0, ErrTxReadOnly
+	}
+	b := tx.openBucket(changefeedKey)
+	if b == nil || seq <= 1 {
+		return 0, nil
+	}
+	var keys [][]byte
+	b.Scan(entryKey(1, 0), entryKey(seq, 0), func(key, val []byte) bool {
+		keys = append(keys, bytes.Clone(key))
+		return true
+	})
+	for _, key := range keys {
+		b.Del(key)
+	}
+	if first, ok := b.Get(entryKey(0, 0)); !ok || binary.BigEndian.Uint64(first) < seq {
+		b.Set(entryKey(0, 0), binary.BigEndian.AppendUint64(nil, seq))
+	}
+	return len(keys), nil
+}
+
+// Feed tails the changefeed, see KV.Follow
+type Feed struct {
+	// the entries in order, closed when the feed ends, see Err
+	C <-chan Entry
+
+	db   *KV
+	next []byte // the key of the next entry
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+// sends the entries of the changefeed from the commit sequence `from` on,
+// then the entries of later commits as they become durable. a consumer
+// that resumes after the last sequence it handled passes it plus one.
+// feeds wait for their consumer, entries can't be missed.
+func (db *KV) Follow(from uint64) *Feed {
+	c := make(chan Entry)
+	f := &Feed{C: c, db: db, next: entryKey(from, 0), done: make(chan struct{})}
+	db.feeds.Add(1)
+	go f.run(c)
+	return f
+}
+
+func (f *Feed) run(c chan<- Entry) {
+	db := f.db
+	defer db.feeds.Done()
+	defer close(c)
+	for {
+		// the read transaction doesn't wait for the consumer, it would
+		// keep old pages from being reused
+		db.rmu.Lock()
+		tx := db.beginRead()
+		committed := db.committed
+		db.rmu.Unlock()
+		var batch []Entry
+		next, err := tx.changesFrom(f.next, func(e Entry) bool {
+			batch = append(batch, e)
+			return len(batch) < FEED_BATCH
+		})
+		tx.Rollback()
+		for _, e := range batch {
+			select {
+			case c <- e:
+			case <-f.done:
+				return
+			case <-db.stop:
+				f.err = errors.New("database closed")
+				return
+			}
+		}
+		if err != nil {
+			f.err = err
+			return
+		}
+		f.next = next
+		if len(batch) == FEED_BATCH {
+			continue
+		}
+		select {
+		case <-committed:
+		case <-f.done:
+			return
+		case <-db.stop:
+			f.err = errors.New("database closed")
+			return
+		}
+	}
+}
+
+// stops the feed and closes C
+func (f *Feed) Close() {
+	f.once.Do(func() { close(f.done) })
+}
+
+// the reason C was closed, valid once it is closed: ErrChangesTrimmed or
+// the closing of the database. nil after Close.
+func (f *Feed) Err() error {
+	return f.err
+}
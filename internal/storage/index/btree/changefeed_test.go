@@ -0,0 +1,187 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func entryText(e Entry) string {
+	op := "set"
+	if e.Op == OP_DEL {
+		op = "del"
+	}
+	return fmt.Sprintf("%d %s %s %s %s", e.Seq, op, e.Bucket, e.Key, e.Value)
+}
+
+func nextEntry(t *testing.T, f *Feed) string {
+	t.Helper()
+	select {
+	case e, ok := <-f.C:
+		if !ok {
+			t.Fatalf("feed closed: %v", f.Err())
+		}
+		return entryText(e)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no entry")
+	}
+	return ""
+}
+
+func TestChangefeed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, Changefeed: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("a"), []byte("1"))
+	tx := db.Begin()
+	tx.Set([]byte("b"), []byte("2"))
+	tx.Del([]byte("a"))
+	tx.Del([]byte("nope"))
+	b, _ := tx.CreateBucket([]byte("bucket"))
+	b.Set([]byte("k"), []byte("v"))
+	nested, _ := b.CreateBucket([]byte("nested"))
+	nested.Set([]byte("not"), []byte("logged"))
+	tx.Commit()
+	tx = db.Begin()
+	tx.Set([]byte("lost"), nil)
+	tx.Rollback()
+	db.Set([]byte("c"), []byte("3"))
+
+	var got []string
+	rtx := db.BeginRead()
+	err := rtx.Changes(0, func(e Entry) bool {
+		got = append(got, entryText(e))
+		return true
+	})
+	rtx.Rollback()
+	want := []string{"1 set  a 1", "2 set  b 2", "2 del  a ", "2 set bucket k v", "3 set  c 3"}
+	if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Changes(0) = %q, %v; want %q", got, err, want)
+	}
+
+	// the log is durable, a feed reads it and tails new commits
+	db.Close()
+	db = &KV{Path: path, Changefeed: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	f := db.Follow(2)
+	for _, want := range want[1:] {
+		if got := nextEntry(t, f); got != want {
+			t.Fatalf("entry = %q; want %q", got, want)
+		}
+	}
+	db.Del([]byte("b"))
+	if got := nextEntry(t, f); got != "4 del  b " {
+		t.Fatalf("tailed entry = %q", got)
+	}
+	f.Close()
+	for range f.C {
+	}
+	if f.Err() != nil {
+		t.Fatalf("Err() after Close = %v", f.Err())
+	}
+
+	// more entries than a batch of the feed
+	tx = db.Begin()
+	for i := 0; i < FEED_BATCH+10; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%04d", i)), nil)
+	}
+	tx.Commit()
+	f = db.Follow(5)
+	for i := 0; i < FEED_BATCH+10; i++ {
+		if got, want := nextEntry(t, f), fmt.Sprintf("5 set  k%04d ", i); got != want {
+			t.Fatalf("entry = %q; want %q", got, want)
+		}
+	}
+	f.Close()
+
+	tx = db.Begin()
+	if n, err := tx.TrimChanges(3); n != 4 || err != nil {
+		t.Fatalf("TrimChanges(3) = %d, %v", n, err)
+	}
+	tx.Commit()
+	rtx = db.BeginRead()
+	defer rtx.Rollback()
+	if err := rtx.Changes(2, func(Entry) bool { return true }); err != ErrChangesTrimmed {
+		t.Fatalf("Changes() of trimmed entries = %v", err)
+	}
+	got = nil
+	rtx.Changes(0, func(e Entry) bool {
+		got = append(got, entryText(e))
+		return false
+	})
+	if fmt.Sprint(got) != "[3 set  c 3]" {
+		t.Fatalf("first entry after trimming = %q", got)
+	}
+	f = db.Follow(1)
+	for range f.C {
+	}
+	if f.Err() != ErrChangesTrimmed {
+		t.Fatalf("Err() of a feed of trimmed entries = %v", f.Err())
+	}
+
+	// the entry of a pair has the key and the bucket besides the value
+	val := make([]byte, BT_MAX_VAL_SIZE-9)
+	if err := db.Set([]byte("big"), val); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Set() of an entry too large = %v", err)
+	}
+	if err := db.Set([]byte("big"), val[:len(val)-3]); err != nil {
+		t.Fatalf("Set() at the limit of the entry = %v", err)
+	}
+}
+
+// entries at the exact limit between large neighbours, in the keyspace and
+// in the changefeed
+func TestChangefeedAtLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, Changefeed: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx := db.Begin()
+	ref := map[string]string{}
+	for i := 0; i < 60; i += 2 {
+		key, val := fmt.Sprintf("%03d", i), strings.Repeat("n", 2000)
+		tx.Set([]byte(key), []byte(val))
+		ref[key] = val
+	}
+	for i := 0; i < 60; i += 2 {
+		key := fmt.Sprintf("%03d", i) + strings.Repeat("x", BT_MAX_KEY_SIZE-3)
+		// the entry has the op, the lengths and the key before the value
+		val := strings.Repeat("v", BT_MAX_VAL_SIZE-9-len(key))
+		if err := tx.Set([]byte(key), []byte(val+"v")); !errors.Is(err, ErrValueTooLarge) {
+			tx.Rollback()
+			t.Fatalf("Set() of an entry over the limit = %v", err)
+		}
+		if err := tx.Set([]byte(key), []byte(val)); err != nil {
+			tx.Rollback()
+			t.Fatalf("Set() at the limit of the entry = %v", err)
+		}
+		ref[key] = val
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	assertKV(t, db, ref)
+	rtx := db.BeginRead()
+	defer rtx.Rollback()
+	n := 0
+	err := rtx.Changes(0, func(e Entry) bool {
+		if ref[string(e.Key)] != string(e.Value) {
+			t.Fatalf("entry of %.10s with %d bytes", e.Key, len(e.Value))
+		}
+		n++
+		return true
+	})
+	if err != nil || n != len(ref) {
+		t.Fatalf("Changes() = %d entries, %v", n, err)
+	}
+}
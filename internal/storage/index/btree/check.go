@@ -0,0 +1,487 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Check reads a database file page by page, without opening it as a
+// database, and checks the meta page, the free list and every page of the
+// trees reachable from the meta page:
+//
+//   - a node has a known type, keys and a layout that fits in the page
+//   - the keys of a node are in order and within the separators of the
+//     parent, the first key of a child is its separator
+//   - the leaves of a tree are at the same depth
+//   - a page is from a commit no newer than its parent and the meta page
+//   - a page is in one tree, or in the free list, once
+//   - every page of the file is in a tree or in the free list
+//
+// pages have no checksums in this format, a page is checked by its header,
+// its layout and its commit sequence. the file must not be written while
+// it is checked, Scrub checks an open database.
+
+const CHECK_MAX_ERRORS = 1000
+
+// a problem of a page found by Check, page 0 is the meta page
+type CheckError struct {
+	Page uint64
+	Tree string // "keyspace", "catalog", "bucket a/b", "free list"... empty if none
+	Msg  string
+}
+
+func (e *CheckError) Error() string {
+	if e.Tree == "" {
+		return fmt.Sprintf("page %d: %s", e.Page, e.Msg)
+	}
+	return fmt.Sprintf("page %d (%s): %s", e.Page, e.Tree, e.Msg)
+}
+
+type CheckReport struct {
+	Seq       uint64 // the commit sequence of the meta page
+	Pages     int    // pages of the file, the meta page included
+	TreePages int    // pages of the trees of the keyspace, the catalog and the buckets
+	FreePages int    // items of the free list
+	ListPages int    // nodes of the free list
+	Buckets   int
+	Errors    []*CheckError // the first CHECK_MAX_ERRORS problems
+	More      bool          // there are more problems than Errors
+}
+
+func (r *CheckReport) OK() bool {
+	return len(r.Errors) == 0
+}
+
+type checker struct {
+	f       *os.File
+	report  *CheckReport
+	flushed uint64
+	owner   map[uint64]string // the tree or the free list of the pages seen
+
+	// reads the pages instead of `f`, see Scrub
+	page func(ptr uint64) ([]byte, error)
+	// only the trees of these pages are walked, see checkBatch
+	batch map[uint64][]byte
+}
+
+// checks the database file at `path`, the error is for a file that can't
+// be read, the problems of the file are in the report
+func Check(path string) (*CheckReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c := &checker{f: f, report: &CheckReport{}, owner: map[uint64]string{}}
+	if err := c.check(); err != nil {
+		return nil, fmt.Errorf("check %s: %w", path, err)
+	}
+	return c.report, nil
+}
+
+func (c *checker) fail(page uint64, tree string, format string, args ...any) {
+	if len(c.report.Errors) == CHECK_MAX_ERRORS {
+		c.report.More = true
+		return
+	}
+	e := &CheckError{Page: page, Tree: tree, Msg: fmt.Sprintf(format, args...)}
+	c.report.Errors = append(c.report.Errors, e)
+}
+
+func (c *checker) read(ptr uint64) ([]byte, error) {
+	if c.page != nil {
+		return c.page(ptr)
+	}
+	page := make([]byte, BT_PAGE_SIZE)
+	_, err := c.f.ReadAt(page, int64(ptr)*BT_PAGE_SIZE)
+	if err == io.EOF {
+		err = fmt.Errorf("page %d: %w", ptr, io.ErrUnexpectedEOF)
+	}
+	return page, err
+}
+
+func (c *checker) check() error {
+	fi, err := c.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < BT_PAGE_SIZE {
+		c.fail(0, "", "the file has %d bytes, not a meta page", fi.Size())
+		return nil
+	}
+	meta, err := c.read(0)
+	if err != nil {
+		return err
+	}
+	return c.checkFrom(meta, uint64(fi.Size()/BT_PAGE_SIZE))
+}
+
+// checks the version of the meta page `meta` of a file of `pages` pages
+func (c *checker) checkFrom(meta []byte, pages uint64) error {
+	if !c.checkMeta(meta, pages) {
+		return nil
+	}
+	field := func(pos int) uint64 {
+		return binary.LittleEndian.Uint64(meta[pos : pos+8])
+	}
+	c.flushed = field(24)
+	c.report.Seq = field(72)
+	c.report.Pages = int(c.flushed)
+
+	free, err := c.freeList(field(32), field(40), field(48), field(56))
+	if err != nil {
+		return err
+	}
+	if err := c.tree("keyspace", field(16), nil); err != nil {
+		return err
+	}
+	var records [][2][]byte
+	err = c.tree("catalog", field(64), func(key, val []byte) {
+		records = append(records, [2][]byte{key, val})
+	})
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if err := c.bucket(rec[0], rec[1]); err != nil {
+			return err
+		}
+	}
+
+	// the free pages are checked after the trees, a page that is both is
+	// reported once at the free list
+	for _, ptr := range free {
+		if owner, ok := c.owner[ptr]; ok {
+			c.fail(ptr, "free list", "free and in the %s", owner)
+		} else {
+			c.owner[ptr] = "free list"
+		}
+	}
+	for ptr := uint64(1); ptr < c.flushed && c.batch == nil; ptr++ {
+		if _, ok := c.owner[ptr]; !ok {
+			c.fail(ptr, "", "not in a tree nor in the free list")
+		}
+	}
+	return nil
+}
+
+// reports the fields of the meta page that are wrong, false if the rest
+// of the file can't be checked
+func (c *checker) checkMeta(meta []byte, pages uint64) bool {
+	if !bytes.Equal(meta[:16], []byte(DB_SIG)) {
+		c.fail(0, "", "bad signature %q", meta[:16])
+		return false
+	}
+	field := func(pos int) uint64 {
+		return binary.LittleEndian.Uint64(meta[pos : pos+8])
+	}
+	flushed := field(24)
+	if flushed == 0 || flushed > pages {
+		c.fail(0, "", "%d pages used, the file has %d", flushed, pages)
+		return false
+	}
+	ok := true
+	for _, f := range []struct {
+		name    string
+		pos     int
+		nonzero bool
+	}{
+		{"root", 16, false},
+		{"catalog root", 64, false},
+		{"free list head", 32, true},
+		{"free list tail", 48, true},
+	} {
+		ptr := field(f.pos)
+		if ptr >= flushed || f.nonzero && ptr == 0 {
+			c.fail(0, "", "%s %d out of the %d pages used", f.name, ptr, flushed)
+			ok = false
+		}
+	}
+	if field(40) > field(56) {
+		c.fail(0, "", "free list head at %d after the tail at %d", field(40), field(56))
+		ok = false
+	}
+	if err := checkSizes(metaSizes(meta)); err != nil {
+		c.fail(0, "", "%v", err)
+		ok = false
+	}
+	return ok
+}
+
+// claims the page `ptr` referenced by the page `from` for `tree`, false if
+// it can't be read or is claimed already
+func (c *checker) claim(tree string, from uint64, ptr uint64) bool {
+	if ptr == 0 || ptr >= c.flushed {
+		c.fail(from, tree, "pointer %d out of the %d pages used", ptr, c.flushed)
+		return false
+	}
+	if owner, ok := c.owner[ptr]; ok {
+		if owner == tree {
+			c.fail(ptr, tree, "referenced twice, the second time by page %d", from)
+		} else {
+			c.fail(ptr, tree, "referenced by page %d, in the %s too", from, owner)
+		}
+		return false
+	}
+	c.owner[ptr] = tree
+	return true
+}
+
+// walks the nodes of the free list from the head to the tail, returns the
+// free pages
+func (c *checker) freeList(headPage, headSeq, tailPage, tailSeq uint64) ([]uint64, error) {
+	const tree = "free list"
+	var free []uint64
+	seen := map[uint64]bool{}
+	ptr := headPage
+	if !c.claim(tree, 0, ptr) {
+		return nil, nil
+	}
+	c.report.ListPages++
+	node, err := c.read(ptr)
+	if err != nil {
+		return nil, err
+	}
+	// the tail node is updated in place, an interrupted batch leaves its
+	// sequence behind
+	if pageSeq(node) > c.report.Seq && ptr != tailPage {
+		c.fail(ptr, tree, "from commit %d, after the meta page at %d", pageSeq(node), c.report.Seq)
+	}
+	for seq := headSeq; seq < tailSeq; {
+		item := LNode(node).getPtr(seq2idx(seq))
+		switch {
+		case item == 0 || item >= c.flushed:
+			c.fail(ptr, tree, "item %d: pointer %d out of the %d pages used", seq, item, c.flushed)
+		case seen[item]:
+			c.fail(ptr, tree, "item %d: page %d is free twice", seq, item)
+		default:
+			seen[item] = true
+			free = append(free, item)
+		}
+		seq++
+		if seq2idx(seq) != 0 {
+			continue
+		}
+		next := LNode(node).getNext()
+		if !c.claim(tree, ptr, next) {
+			return free, nil
+		}
+		ptr = next
+		c.report.ListPages++
+		if node, err = c.read(ptr); err != nil {
+			return nil, err
+		}
+		if pageSeq(node) > c.report.Seq && ptr != tailPage {
+			c.fail(ptr, tree, "from commit %d, after the meta page at %d", pageSeq(node), c.report.Seq)
+		}
+	}
+	if ptr != tailPage {
+		c.fail(ptr, tree, "the list ends here, the meta page has the tail at %d", tailPage)
+	}
+	c.report.FreePages = len(free)
+	return free, nil
+}
+
+// the bounds of the keys of a node, `hi` is nil for no upper bound
+type checkBounds struct {
+	lo, hi []byte
+}
+
+// a page of the trees out of the batch, a subtree checked before
+func (c *checker) skip(ptr uint64) bool {
+	return c.batch != nil && c.batch[ptr] == nil
+}
+
+// walks a tree from its root, `leaf` gets the pairs of the leaves
+func (c *checker) tree(tree string, root uint64, leaf func(key, val []byte)) error {
+	if root == 0 || c.skip(root) {
+		return nil
+	}
+	if !c.claim(tree, 0, root) {
+		return nil
+	}
+	depth := 0 // of the leaves, 0 until the first one
+	_, err := c.node(tree, root, checkBounds{}, 1, c.report.Seq, &depth, leaf)
+	return err
+}
+
+// walks the subtree of the node `ptr`, returns its number of pairs
+func (c *checker) node(tree string, ptr uint64, bounds checkBounds, level int, maxSeq uint64, depth *int, leaf func(key, val []byte)) (uint64, error) {
+	c.report.TreePages++
+	page, err := c.read(ptr)
+	if err != nil {
+		return 0, err
+	}
+	node := BN(page)
+	if seq := pageSeq(node); seq > maxSeq {
+		c.fail(ptr, tree, "from commit %d, after its parent at %d", seq, maxSeq)
+	}
+	if msg := nodeLayout(node); msg != "" {
+		c.fail(ptr, tree, "%s", msg)
+		return 0, nil
+	}
+	btype, nkeys := node.btype(), node.nkeys()
+	for i := uint16(0); i < nkeys; i++ {
+		key := node.getKey(i)
+		if i > 0 && bytes.Compare(node.getKey(i-1), key) >= 0 {
+			c.fail(ptr, tree, "key %d %q is not after key %d %q", i, key, i-1, node.getKey(i-1))
+		}
+		if bytes.Compare(key, bounds.lo) < 0 || bounds.hi != nil && bytes.Compare(key, bounds.hi) >= 0 {
+			c.fail(ptr, tree, "key %d %q out of the separators of the parent", i, key)
+		}
+	}
+	if !bytes.Equal(node.getKey(0), bounds.lo) {
+		c.fail(ptr, tree, "the first key %q is not the separator %q of the parent", node.getKey(0), bounds.lo)
+	}
+
+	if btype == BN_LEAF {
+		if *depth == 0 {
+			*depth = level
+		} else if *depth != level {
+			c.fail(ptr, tree, "a leaf at depth %d, the others are at %d", level, *depth)
+		}
+		if leaf != nil {
+			for i := uint16(0); i < nkeys; i++ {
+				leaf(node.getKey(i), node.getVal(i))
+			}
+		}
+		return uint64(nkeys), nil
+	}
+	// the kids have counts or none, see nodeCount
+	vlen := len(node.getVal(0))
+	total := uint64(0)
+	for i := uint16(0); i < nkeys; i++ {
+		val := node.getVal(i)
+		if len(val) != vlen || vlen != 0 && vlen != 8 {
+			c.fail(ptr, tree, "key %d: a branch node with a value of %d bytes", i, len(val))
+			val = nil
+		}
+		kid := node.getPtr(i)
+		if c.skip(kid) {
+			if len(val) == 8 {
+				total += binary.LittleEndian.Uint64(val)
+			}
+			continue
+		}
+		if !c.claim(tree, ptr, kid) {
+			continue
+		}
+		child := checkBounds{lo: node.getKey(i), hi: bounds.hi}
+		if i+1 < nkeys {
+			child.hi = node.getKey(i + 1)
+		}
+		failed := len(c.report.Errors)
+		n, err := c.node(tree, kid, child, level+1, pageSeq(node), depth, leaf)
+		if err != nil {
+			return 0, err
+		}
+		// a damaged subtree has a count of its own
+		if len(val) == 8 && failed == len(c.report.Errors) {
+			if want := binary.LittleEndian.Uint64(val); want != n {
+				c.fail(ptr, tree, "key %d: a count of %d, the subtree has %d pairs", i, want, n)
+			}
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// the problem of the header and the offsets of a node, empty if none. the
+// keys can be read if there is none.
+func nodeLayout(node BN) string {
+	btype, nkeys := node.btype(), node.nkeys()
+	if btype != BN_NODE && btype != BN_LEAF {
+		return fmt.Sprintf("bad node type %d", btype)
+	}
+	if nkeys == 0 {
+		return "no keys"
+	}
+	if HEADER+10*int(nkeys) > BT_PAGE_SIZE {
+		return fmt.Sprintf("%d keys don't fit in a page", nkeys)
+	}
+	end := HEADER + 10*int(nkeys)
+	for i := uint16(0); i < nkeys; i++ {
+		pos := end + int(node.getOffset(i))
+		if pos+4 > BT_PAGE_SIZE {
+			return fmt.Sprintf("key %d: bad offset %d", i, node.getOffset(i))
+		}
+		klen := int(binary.LittleEndian.Uint16(node[pos:]))
+		vlen := int(binary.LittleEndian.Uint16(node[pos+2:]))
+		next := pos + 4 + klen + vlen
+		if next > BT_PAGE_SIZE {
+			return fmt.Sprintf("the node has %d bytes", next)
+		}
+		// the offset after the last key is the size of the node
+		if want := end + int(node.getOffset(i+1)); next != want {
+			return fmt.Sprintf("key %d: %d bytes, the offsets have %d", i, 4+klen+vlen, want-pos)
+		}
+		if klen > BT_MAX_KEY_LIMIT || klen+vlen > BT_MAX_PAIR_SIZE {
+			return fmt.Sprintf("key %d: key of %d bytes and value of %d", i, klen, vlen)
+		}
+	}
+	return ""
+}
+
+// walks the trees of a bucket record of the catalog, see encodeBucket
+func (c *checker) bucket(key, rec []byte) error {
+	if len(key) == 0 {
+		return nil // the empty key of the root
+	}
+	name := "bucket " + bucketPath(key)
+	if len(rec) < 16 {
+		c.fail(0, name, "a bucket record of %d bytes", len(rec))
+		return nil
+	}
+	c.report.Buckets++
+	trees := []struct {
+		name string
+		pos  int
+	}{{"", 0}, {" expiry", 24}, {" history", 32}}
+	for _, t := range trees {
+		if len(rec) < t.pos+8 || t.pos == 32 && len(rec) < 52 {
+			break // older records have no expiry or history roots
+		}
+		root := binary.LittleEndian.Uint64(rec[t.pos:])
+		if err := c.tree(name+t.name, root, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the names of a catalog key joined by "/", see bucketKey
+func bucketPath(key []byte) string {
+	var names []string
+	var name []byte
+	for i := 0; i < len(key); i++ {
+		switch {
+		case key[i] != 0 || i+1 == len(key):
+			name = append(name, key[i])
+		case key[i+1] == 1:
+			names = append(names, printable(name))
+			name = nil
+			i++
+		default:
+			name = append(name, 0)
+			i++
+		}
+	}
+	if len(name) > 0 {
+		names = append(names, printable(name))
+	}
+	return strings.Join(names, "/")
+}
+
+// the name as is if printable, quoted otherwise
+func printable(name []byte) string {
+	for _, c := range name {
+		if c < 0x20 || c >= 0x7f || c == '/' || c == '"' {
+			return fmt.Sprintf("%q", name)
+		}
+	}
+	return string(name)
+}
@@ -0,0 +1,115 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db := openKV(t, path)
+	tx := db.Begin()
+	users, _ := tx.CreateBucket([]byte("users"))
+	users.CreateBucket([]byte("a\x00b"))
+	tx.CreateColumnFamily([]byte("docs"), CFOptions{MaxVersions: 3})
+	tx.CreateColumnFamily([]byte("cache"), CFOptions{TTL: true})
+	tx.Commit()
+	for round := 0; round < 5; round++ {
+		tx := db.Begin()
+		for i := 0; i < 1000; i++ {
+			tx.Set([]byte(fmt.Sprintf("k%04d", i)), bytes.Repeat([]byte{'x'}, 100))
+			tx.Bucket([]byte("users")).Set([]byte(fmt.Sprintf("u%04d", i)), []byte(fmt.Sprint(round)))
+		}
+		tx.ColumnFamily([]byte("docs")).Set([]byte("d"), []byte(fmt.Sprint(round)))
+		tx.ColumnFamily([]byte("cache")).SetTTL([]byte("c"), []byte("1"), time.Hour)
+		tx.Commit()
+	}
+	tx = db.Begin()
+	for i := 0; i < 1000; i++ {
+		if i%10 != 0 {
+			tx.Del([]byte(fmt.Sprintf("k%04d", i)))
+		}
+	}
+	tx.Commit()
+	rtx := db.BeginRead()
+	stats := rtx.FileStats()
+	seq := rtx.Seq()
+	rtx.Rollback()
+	db.Close()
+
+	report, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("Check() of a healthy file: %v", report.Errors)
+	}
+	if report.Seq != seq || report.Pages != stats.Pages || report.TreePages != stats.TreePages ||
+		report.FreePages+report.ListPages != stats.FreePages || report.Buckets != 4 {
+		t.Fatalf("Check() = %+v, FileStats() = %+v", report, stats)
+	}
+
+	data, _ := os.ReadFile(path)
+	page := func(data []byte, ptr uint64) BN {
+		return BN(data[ptr*BT_PAGE_SIZE:][:BT_PAGE_SIZE])
+	}
+	root := binary.LittleEndian.Uint64(data[16:24])
+	if page(data, root).btype() != BN_NODE {
+		t.Fatal("the keyspace is a single leaf")
+	}
+	first := page(data, root).getPtr(0)
+	second := page(data, root).getPtr(1)
+
+	cases := []struct {
+		name    string
+		corrupt func(data []byte)
+		page    uint64
+		msg     string
+	}{
+		{"bad signature", func(data []byte) { data[0] = 'x' }, 0, "bad signature"},
+		{"bad node", func(data []byte) {
+			clear(page(data, first))
+		}, first, "bad node type 0"},
+		{"keys out of order", func(data []byte) {
+			leaf := page(data, first)
+			leaf.getKey(leaf.nkeys() - 1)[0] = 0
+		}, first, "is not after key"},
+		{"separator", func(data []byte) {
+			page(data, second).getKey(0)[1] = '9'
+		}, second, "out of the separators of the parent"},
+		{"referenced twice", func(data []byte) {
+			page(data, root).setPtr(1, first)
+		}, first, "referenced twice"},
+		{"free and reachable", func(data []byte) {
+			fl := LNode(page(data, binary.LittleEndian.Uint64(data[32:40])))
+			fl.setPtr(seq2idx(binary.LittleEndian.Uint64(data[40:48])), second)
+		}, second, "free and in the keyspace"},
+		{"newer than the parent", func(data []byte) {
+			setPageSeq(page(data, first), seq+1)
+		}, first, "after its parent"},
+	}
+	for _, c := range cases {
+		corrupted := filepath.Join(dir, "corrupted.db")
+		copied := append([]byte{}, data...)
+		c.corrupt(copied)
+		os.WriteFile(corrupted, copied, 0o644)
+		report, err := Check(corrupted)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		found := false
+		for _, e := range report.Errors {
+			found = found || e.Page == c.page && strings.Contains(e.Msg, c.msg)
+		}
+		if !found {
+			t.Fatalf("%s: want %q at page %d, got %v", c.name, c.msg, c.page, report.Errors)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// With KV.CheckCommits the pages of every batch are checked like Check
+// does before its meta page is written, and the committer panics on a
+// problem: a bug of the tree shows up at the commit that has it, not when
+// a later read trips over the page. the panic fails the database, see
+// recoverCommitter, so the batch is never committed.
+//
+// a batch writes new copies of the nodes it updates, up to the roots, so
+// the trees are walked from their roots down the pages of the batch only:
+// the other subtrees are the same as in a version checked before. the free
+// list is walked whole, none of its items may be a page of a tree of the
+// batch.
+
+// checks the version of the batch `f`, its pages are written
+func checkBatch(db *KV, f *flight) (*CheckReport, error) {
+	c := &checker{report: &CheckReport{}, owner: map[uint64]string{}, batch: f.pages}
+	c.page = func(ptr uint64) ([]byte, error) {
+		if page, ok := f.pages[ptr]; ok {
+			return page, nil
+		}
+		page := make([]byte, BT_PAGE_SIZE)
+		n, err := syscall.Pread(db.fd, page, int64(ptr)*BT_PAGE_SIZE)
+		if err == nil && n != BT_PAGE_SIZE {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %w", ptr, err)
+		}
+		return page, nil
+	}
+	err := c.checkFrom(f.meta, binary.LittleEndian.Uint64(f.meta[24:32]))
+	return c.report, err
+}
+
+// panics with the problems of the batch `f`, if any
+func (db *KV) checkCommit(f *flight) {
+	report, err := checkBatch(db, f)
+	if err != nil {
+		panic(fmt.Sprintf("CheckCommits: commit %d: %v", report.Seq, err))
+	}
+	if !report.OK() {
+		panic(commitDiff(report, f))
+	}
+}
+
+// the problems of a batch and the nodes of the batch that have them
+func commitDiff(report *CheckReport, f *flight) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CheckCommits: commit %d has %d problems\n", report.Seq, len(report.Errors))
+	var ptrs []uint64
+	for _, e := range report.Errors {
+		fmt.Fprintf(&b, "  %v\n", e)
+		if _, ok := f.pages[e.Page]; ok && e.Page != 0 && !slices.Contains(ptrs, e.Page) {
+			ptrs = append(ptrs, e.Page)
+		}
+	}
+	for _, ptr := range ptrs {
+		fmt.Fprintf(&b, "page %d: ", ptr)
+		formatNode(&b, BN(f.pages[ptr]))
+	}
+	return b.String()
+}
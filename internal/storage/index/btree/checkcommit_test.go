@@ -0,0 +1,74 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckCommits(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), CheckCommits: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the committer panics on a problem
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 50; round++ {
+		tx := db.Begin()
+		b, err := tx.CreateBucket([]byte(fmt.Sprint("b", round%5)))
+		if err != nil {
+			b = tx.Bucket([]byte(fmt.Sprint("b", round%5)))
+		}
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("k%04d", r.Intn(2000)))
+			if r.Intn(3) == 0 {
+				tx.Del(key)
+				b.Del(key)
+			} else {
+				tx.Set(key, bytes.Repeat([]byte{'v'}, r.Intn(300)))
+				b.Set(key, []byte("1"))
+			}
+		}
+		if round%10 == 9 {
+			tx.DeleteBucket([]byte(fmt.Sprint("b", round%5)))
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a batch with a broken branch: the first one of the rightmost path
+	// with a key to break after the sentinel and the one before it
+	db.mu.Lock()
+	meta := saveMeta(db)
+	db.mu.Unlock()
+	f := &flight{meta: meta, pages: map[uint64][]byte{}}
+	broken := binary.LittleEndian.Uint64(meta[16:24])
+	node := BN(bytes.Clone(db.pageRead(broken)))
+	for node.nkeys() < 3 {
+		f.pages[broken] = node
+		broken = node.getPtr(node.nkeys() - 1)
+		node = BN(bytes.Clone(db.pageRead(broken)))
+	}
+	last := node.nkeys() - 1
+	copy(node.getKey(last), "a") // before the first key
+	f.pages[broken] = node
+	report, err := checkBatch(db, f)
+	if err != nil || report.OK() {
+		t.Fatalf("checkBatch() = %+v, %v", report, err)
+	}
+	var msg string
+	func() {
+		defer func() { msg, _ = recover().(string) }()
+		db.checkCommit(f)
+	}()
+	if !strings.Contains(msg, fmt.Sprintf("page %d: branch", broken)) || !strings.Contains(msg, "out of order") {
+		t.Fatalf("checkCommit() panics with %q", msg)
+	}
+}
@@ -0,0 +1,407 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"slices"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Updates are applied to the tree in memory by writers holding db.mu,
+// each of them queues a waiter. The committer stages everything applied so
+// far as one batch and writes it with a single pair of fsyncs:
+//
+//	write pages -> fsync -> write meta -> fsync
+//
+// The last fsync of batch N runs in the background while the pages of
+// batch N+1 are written, the meta page of N+1 is written only after N is durable.
+// Pages of N+1 can't overwrite anything reachable from N-1 or N: free pages
+// are reused only after the batch that freed them is durable.
+
+var errPrevFailed = errors.New("previous commit failed")
+
+// a batch of updates written by the committer
+type flight struct {
+	base    []byte // meta page before the batch, for reverting
+	meta    []byte
+	failed  bool   // the previous batch failed, the base meta is rewritten first
+	start   uint64 // first appended page
+	nappend uint64
+	pages   map[uint64][]byte
+	waiters []chan error
+	changes []change
+	audit   []AuditRecord
+	synced  chan error // the final fsync
+	staged  time.Time  // with Metrics or SlowCommit
+}
+
+func enqueue(db *KV) chan error {
+	done := make(chan error, 1)
+	if err := db.Failed(); err != nil {
+		done <- err
+		return done
+	}
+	db.queue.waiters = append(db.queue.waiters, done)
+	select {
+	case db.kick <- struct{}{}:
+	default:
+	}
+	return done
+}
+
+func (db *KV) committer() {
+	defer close(db.stopped)
+	defer db.recoverCommitter()
+	var prev *flight
+	last := time.Now()
+	for {
+		db.queue.flying = db.queue.flying[:0]
+		if prev != nil {
+			db.queue.flying = append(db.queue.flying, prev)
+		}
+		var synced chan error
+		if prev != nil {
+			synced = prev.synced
+		}
+		select {
+		case err := <-synced:
+			finish(db, prev, err)
+			prev = nil
+			continue
+		case <-db.kick:
+			if db.Async {
+				// collect more updates into the batch
+				time.Sleep(time.Until(last.Add(db.FlushInterval)))
+			}
+		case <-db.stop:
+			// flush the rest synchronously
+			prev = flush(db, prev)
+			if prev != nil {
+				finish(db, prev, <-prev.synced)
+			}
+			return
+		}
+		last = time.Now()
+		prev = flush(db, prev)
+	}
+}
+
+// fails the database on a panic of the committer: the batches in flight
+// and the queued updates fail with the internal error and nothing more is
+// written, the outcome of a batch with its meta page written is unknown
+// until the database is reopened. then fails the updates queued until
+// Close.
+func (db *KV) recoverCommitter() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	db.fail(&InternalError{Op: "Commit", Value: r, Stack: debug.Stack()})
+	err := db.Failed()
+	fail := func(waiters []chan error) {
+		for _, done := range waiters {
+			select {
+			case done <- err:
+			default: // the batch was finished
+			}
+		}
+	}
+	for _, f := range db.queue.flying {
+		fail(f.waiters)
+	}
+	db.queue.flying = nil
+	for {
+		db.mu.Lock()
+		waiters := db.queue.waiters
+		db.queue.waiters = nil
+		db.mu.Unlock()
+		fail(waiters)
+		select {
+		case <-db.kick:
+		case <-db.stop:
+			return
+		}
+	}
+}
+
+// runs `fn` with db.mu, it's released on a panic too
+func (db *KV) locked(fn func()) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	fn()
+}
+
+// stages and writes queued updates while `prev` is being synced,
+// returns the new batch with its final fsync in flight.
+func flush(db *KV, prev *flight) *flight {
+	var cur *flight
+	db.locked(func() { cur = stage(db) })
+	if cur == nil {
+		return prev
+	}
+	db.queue.flying = append(db.queue.flying, cur)
+	err := fullError(writePages(db, cur))
+	if err == nil && db.CheckCommits {
+		db.checkCommit(cur)
+	}
+	if prev != nil && !finish(db, prev, <-prev.synced) {
+		// the batch is built on top of the failed one, it's already reverted
+		for _, done := range cur.waiters {
+			done <- errPrevFailed
+		}
+		return nil
+	}
+	if err != nil {
+		revert(db, cur, err)
+		return nil
+	}
+	if !commit(db, cur) {
+		return nil
+	}
+	return cur
+}
+
+// takes the queued updates for writing, nil if there is nothing to write
+func stage(db *KV) *flight {
+	if len(db.queue.waiters) == 0 {
+		return nil
+	}
+	f := &flight{
+		base:    db.queue.staged,
+		failed:  db.failed,
+		start:   db.page.flushed,
+		nappend: db.page.nappend,
+		pages:   db.page.updates,
+		waiters: db.queue.waiters,
+		changes: db.queue.changes,
+		audit:   db.queue.audit,
+	}
+	db.page.flushed += db.page.nappend
+	db.page.nappend = 0
+	db.page.flushing = db.page.updates
+	db.page.updates = map[uint64][]byte{}
+	db.queue.waiters = nil
+	db.queue.changes = nil
+	db.queue.audit = nil
+	f.meta = saveMeta(db)
+	db.queue.staged = f.meta
+	for _, page := range f.pages {
+		setPageSeq(page, db.seq)
+	}
+	db.failed = false
+	db.reportBatch()
+	if db.Metrics != nil || db.SlowCommit > 0 {
+		f.staged = time.Now()
+	}
+	return f
+}
+
+func writePages(db *KV, f *flight) error {
+	var err error
+	db.locked(func() { err = extendMmap(db, int(db.page.flushed)*BT_PAGE_SIZE) })
+	if err != nil {
+		return err
+	}
+	if f.failed {
+		if _, err := syscall.Pwrite(db.fd, f.base, 0); err != nil {
+			return fmt.Errorf("rewrite meta page: %w", err)
+		}
+		if err := db.fsync(db.fd); err != nil {
+			return fmt.Errorf("fsync meta page: %w", err)
+		}
+		db.count(METRIC_PAGE_WRITES, 1)
+	}
+	if db.dwfd >= 0 {
+		if err := writeDoubleWrite(db, f); err != nil {
+			return err
+		}
+	}
+	calls, err := writeRuns(db.fd, f.pages)
+	db.count(METRIC_WRITE_CALLS, uint64(calls))
+	if err != nil {
+		return err
+	}
+	db.count(METRIC_PAGE_WRITES, uint64(len(f.pages)))
+	if db.pool.cur != nil {
+		db.pool.cur.update(f.pages)
+	}
+	// the pages are readable from the mmap now
+	db.mu.Lock()
+	db.page.flushing = nil
+	db.mu.Unlock()
+	return nil
+}
+
+// wraps the errors of a file that can't grow with ErrDatabaseFull
+func fullError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) || errors.Is(err, syscall.EFBIG) {
+		return fmt.Errorf("%w: %w", ErrDatabaseFull, err)
+	}
+	return err
+}
+
+// writes the pages in the order of their numbers, a run of consecutive
+// pages with one pwritev of up to IOV_MAX pages: the appended pages are a
+// run at the end of the file, the pages reused from the free list and the
+// free list nodes overwritten in place are often next to each other.
+// returns the number of calls.
+func writeRuns(fd int, pages map[uint64][]byte) (int, error) {
+	ptrs := make([]uint64, 0, len(pages))
+	for ptr := range pages {
+		ptrs = append(ptrs, ptr)
+	}
+	slices.Sort(ptrs)
+	iov := make([][]byte, 0, min(len(ptrs), IOV_MAX))
+	calls := 0
+	for len(ptrs) > 0 {
+		start := ptrs[0]
+		iov = iov[:0]
+		for len(ptrs) > 0 && ptrs[0] == start+uint64(len(iov)) && len(iov) < IOV_MAX {
+			iov = append(iov, pages[ptrs[0]])
+			ptrs = ptrs[1:]
+		}
+		n, err := unix.Pwritev(fd, iov, int64(start*BT_PAGE_SIZE))
+		calls++
+		if err != nil {
+			return calls, err
+		}
+		if n != len(iov)*BT_PAGE_SIZE {
+			return calls, fmt.Errorf("write pages %d-%d: %w", start, start+uint64(len(iov))-1, io.ErrShortWrite)
+		}
+	}
+	return calls, nil
+}
+
+// orders the pages before the meta page and writes it, the final fsync
+// runs in the background. returns false if the batch was reverted.
+func commit(db *KV, f *flight) bool {
+	if err := db.fsync(db.fd); err != nil {
+		revert(db, f, fullError(err))
+		return false
+	}
+	if _, err := syscall.Pwrite(db.fd, f.meta, 0); err != nil {
+		revert(db, f, fmt.Errorf("write meta page: %w", err))
+		return false
+	}
+	db.count(METRIC_PAGE_WRITES, 1)
+	f.synced = make(chan error, 1)
+	go func() { f.synced <- db.fsync(db.fd) }()
+	return true
+}
+
+// fsync of `fd`, skipped with NoSync
+func (db *KV) fsync(fd int) error {
+	if db.NoSync {
+		return nil
+	}
+	db.count(METRIC_FSYNCS, 1)
+	return syscall.Fsync(fd)
+}
+
+// completes a batch after its final fsync
+func finish(db *KV, f *flight, err error) bool {
+	if err != nil {
+		revert(db, f, err)
+		return false
+	}
+	db.locked(func() { commitVersion(db, f.meta, f.pages) })
+	db.commitErr.Store(nil)
+	db.publish(f.changes)
+	if len(f.audit) > 0 {
+		if err := db.Audit.write(f.audit); err != nil {
+			db.log().Error("writing the audit log failed", "err", err, "seq", f.audit[0].Seq)
+		}
+	}
+	db.count(METRIC_BATCHES, 1)
+	db.observe(METRIC_BATCH, f.staged)
+	db.logSlow(f)
+	db.commitEvents(binary.LittleEndian.Uint64(f.base[72:80])+1, binary.LittleEndian.Uint64(f.meta[72:80]))
+	for _, done := range f.waiters {
+		done <- nil
+	}
+	return true
+}
+
+// drops the batch and everything applied after it, reads continue from
+// the previous version. the meta page is rewritten by the next batch.
+func revert(db *KV, f *flight, err error) {
+	db.log().Error("commit failed, reverted to the previous version", "err", err,
+		"seq", binary.LittleEndian.Uint64(f.base[72:80]), "commits", len(f.waiters))
+	db.mu.Lock()
+	loadMeta(db, f.base)
+	db.queue.staged = f.base
+	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
+	db.page.flushing = nil
+	db.failed = true
+	db.commitErr.Store(&err)
+	waiters := append(f.waiters, db.queue.waiters...)
+	db.queue.waiters = nil
+	db.queue.changes = nil
+	db.queue.audit = nil
+	db.mu.Unlock()
+	for _, done := range waiters {
+		done <- err
+	}
+}
+
+// writes the initial pages of a new file
+func initFile(db *KV) error {
+	f := &flight{
+		start:   db.page.flushed,
+		nappend: db.page.nappend,
+		pages:   db.page.updates,
+	}
+	db.page.flushed += db.page.nappend
+	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
+	f.meta = saveMeta(db)
+	if err := writePages(db, f); err != nil {
+		return err
+	}
+	if err := db.fsync(db.fd); err != nil {
+		return err
+	}
+	if _, err := syscall.Pwrite(db.fd, f.meta, 0); err != nil {
+		return fmt.Errorf("write meta page: %w", err)
+	}
+	db.count(METRIC_PAGE_WRITES, 1)
+	return db.fsync(db.fd)
+}
+
+// publishes the durable version to new readers and replicas, `pages` are
+// the pages written by the update. pages freed by the update are reused
+// only after readers of the previous versions are finished.
+func commitVersion(db *KV, meta []byte, pages map[uint64][]byte) {
+	db.rmu.Lock()
+	defer db.rmu.Unlock()
+	db.version++
+	db.durable = meta
+	tailSeq := binary.LittleEndian.Uint64(meta[56:64])
+	commit := binary.LittleEndian.Uint64(meta[72:80])
+	db.epochs = append(db.epochs, epoch{version: db.version, seq: tailSeq, commit: commit})
+	db.ship(meta, pages)
+	close(db.committed)
+	db.committed = make(chan struct{})
+	db.release()
+}
+
+// allows reusing the pages freed up to the oldest version visible to the
+// readers of this process and of other processes, with db.rmu
+func (db *KV) release() {
+	oldest := db.oldestReader()
+	pinned := db.pinned()
+	// pages freed up to the oldest visible version aren't reachable by readers
+	i := 0
+	for i+1 < len(db.epochs) && db.epochs[i+1].version <= oldest && db.epochs[i+1].commit <= pinned {
+		i++
+	}
+	db.free.maxSeq = db.epochs[i].seq
+	db.epochs = db.epochs[i:]
+}
@@ -0,0 +1,181 @@
+package btree
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Compaction copies the pages reachable from the meta page of a durable
+// version to a new file, in the order of a traversal and without the free
+// pages, so the file shrinks to the size of the trees. the pointers of
+// branch nodes and bucket records are rewritten for the new places.
+//
+// the copy is at the next commit sequence and every page is from it: a
+// backup of the database doesn't apply to the copy, a backup of the copy
+// since an older sequence has every page.
+//
+// compacted file
+// | meta | free list node | pages of the trees ... |
+
+// writes a compacted copy of the last durable version to a new file at
+// `path`. the file appears once it is complete and durable, writers aren't
+// blocked.
+func (db *KV) Compact(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("KV.Compact: %s exists", path)
+	}
+	tmp := path + ".tmp"
+	start := time.Now()
+	pages, err := db.compactTo(tmp, path)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		db.log().Error("compaction failed", "to", path, "err", err)
+		err = fmt.Errorf("KV.Compact: %w", err)
+		pages = 0
+	} else {
+		db.log().Info("compaction done", "to", path, "pages", pages, "duration", time.Since(start))
+	}
+	if db.Events != nil && db.Events.CompactionEnd != nil {
+		db.Events.CompactionEnd(path, pages, err)
+	}
+	return err
+}
+
+type compactor struct {
+	w    *bufio.Writer
+	get  func(uint64) []byte
+	seq  uint64 // the commit sequence of the copy
+	next uint64 // the pointer of the next page written
+
+	log *slog.Logger // the progress, nil if not logged
+	err error        // the first damaged node
+}
+
+// returns the number of pages of the copy
+func (db *KV) compactTo(tmp, path string) (_ uint64, err error) {
+	defer db.catch("Compact", &err)
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	if db.Events != nil && db.Events.CompactionStart != nil {
+		db.Events.CompactionStart(path, tx.Seq())
+	}
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	c := &compactor{
+		w:    bufio.NewWriter(f),
+		get:  tx.pageRead,
+		seq:  binary.LittleEndian.Uint64(tx.base[72:80]) + 1,
+		next: 2,
+		log:  db.log().With("to", path),
+	}
+	c.log.Info("compaction started", "seq", c.seq-1, "pages", binary.LittleEndian.Uint64(tx.base[24:32]))
+	// the meta page is written last, the free list is one empty node
+	c.w.Write(make([]byte, BT_PAGE_SIZE))
+	free := make([]byte, BT_PAGE_SIZE)
+	setPageSeq(free, c.seq)
+	c.w.Write(free)
+	root := c.copyTree(tx.tree.root, false)
+	catalog := c.copyTree(tx.catalog.root, true)
+	if c.err != nil {
+		return 0, c.err
+	}
+	if err := c.w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+
+	meta := make([]byte, BT_PAGE_SIZE)
+	copy(meta, tx.base[:META_SIZE])
+	binary.LittleEndian.PutUint64(meta[16:], root)
+	binary.LittleEndian.PutUint64(meta[24:], c.next)
+	binary.LittleEndian.PutUint64(meta[32:], 1)
+	binary.LittleEndian.PutUint64(meta[40:], 0)
+	binary.LittleEndian.PutUint64(meta[48:], 1)
+	binary.LittleEndian.PutUint64(meta[56:], 0)
+	binary.LittleEndian.PutUint64(meta[64:], catalog)
+	binary.LittleEndian.PutUint64(meta[72:], c.seq)
+	if _, err := f.WriteAt(meta, 0); err != nil {
+		return 0, fmt.Errorf("write meta page: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return c.next, f.Close()
+}
+
+// copies the tree at `ptr` after its children and returns its new pointer,
+// 0 for an empty tree. the leaves of the catalog have bucket records. a
+// damaged node stops the copy with c.err.
+func (c *compactor) copyTree(ptr uint64, catalog bool) uint64 {
+	if ptr == 0 || c.err != nil {
+		return 0
+	}
+	node := BN(make([]byte, BT_PAGE_SIZE))
+	copy(node, c.get(ptr))
+	switch node.btype() {
+	case BN_NODE:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			node.setPtr(i, c.copyTree(node.getPtr(i), catalog))
+		}
+	case BN_LEAF:
+		if catalog {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				c.copyBucket(node.getVal(i))
+			}
+		}
+	default:
+		c.err = fmt.Errorf("page %d: bad node type %d", ptr, node.btype())
+		if c.log != nil {
+			c.log.Error("damaged node", "page", ptr, "type", node.btype())
+		}
+		return 0
+	}
+	return c.write(node)
+}
+
+// writes a node at the next page, returns its pointer
+func (c *compactor) write(node BN) uint64 {
+	setPageSeq(node, c.seq)
+	c.w.Write(node)
+	c.next++
+	if c.log != nil && c.next%COMPACT_LOG_PAGES == 0 {
+		c.log.Debug("compaction progress", "pages", c.next)
+	}
+	return c.next - 1
+}
+
+// copies the trees of a bucket record and rewrites their roots in place,
+// see encodeBucket. older records have no expiry or history roots.
+func (c *compactor) copyBucket(rec []byte) {
+	if len(rec) < 8 {
+		return // the empty key of the root
+	}
+	roots := []int{0}
+	if len(rec) >= 32 {
+		roots = append(roots, 24)
+	}
+	if len(rec) >= 52 {
+		roots = append(roots, 32)
+	}
+	for _, pos := range roots {
+		root := binary.LittleEndian.Uint64(rec[pos:])
+		binary.LittleEndian.PutUint64(rec[pos:], c.copyTree(root, false))
+	}
+}
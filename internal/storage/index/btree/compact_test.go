@@ -0,0 +1,106 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	db := openKV(t, filepath.Join(dir, "test.db"))
+	defer db.Close()
+	now := time.Unix(1000, 0)
+	db.Now = func() time.Time { return now }
+
+	tx := db.Begin()
+	users, _ := tx.CreateBucket([]byte("users"))
+	users.CreateBucket([]byte("nested"))
+	tx.CreateColumnFamily([]byte("docs"), CFOptions{MaxVersions: 3})
+	tx.CreateColumnFamily([]byte("cache"), CFOptions{TTL: true})
+	tx.Commit()
+	for round := 0; round < 10; round++ {
+		tx := db.Begin()
+		for i := 0; i < 1000; i++ {
+			tx.Set([]byte(fmt.Sprintf("k%04d", i)), bytes.Repeat([]byte{'x'}, 100))
+			tx.Bucket([]byte("users")).Set([]byte(fmt.Sprintf("u%04d", i)), []byte(fmt.Sprint(round)))
+		}
+		tx.Commit()
+	}
+	now = now.Add(time.Second)
+	tx = db.Begin()
+	for i := 0; i < 1000; i++ {
+		if i%10 != 0 {
+			tx.Del([]byte(fmt.Sprintf("k%04d", i)))
+		}
+	}
+	tx.Bucket([]byte("users")).Bucket([]byte("nested")).Set([]byte("a"), []byte("1"))
+	tx.ColumnFamily([]byte("docs")).Set([]byte("d"), []byte("v1"))
+	tx.ColumnFamily([]byte("cache")).SetTTL([]byte("c"), []byte("1"), time.Hour)
+	tx.SetApplied(7)
+	tx.Commit()
+	now = now.Add(time.Second)
+	tx = db.Begin()
+	tx.ColumnFamily([]byte("docs")).Set([]byte("d"), []byte("v2"))
+	tx.Commit()
+
+	rtx := db.BeginRead()
+	before := rtx.FileStats()
+	seq := rtx.Seq()
+	rtx.Rollback()
+	if before.FreePages == 0 || before.Pages != 1+before.TreePages+before.FreePages {
+		t.Fatalf("FileStats() = %+v", before)
+	}
+	path := filepath.Join(dir, "compact.db")
+	if err := db.Compact(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(path); err == nil {
+		t.Fatal("Compact() over an existing file succeeded")
+	}
+
+	// the trees and the free list node
+	info, _ := os.Stat(path)
+	if want := int64(2+before.TreePages) * BT_PAGE_SIZE; info.Size() != want {
+		t.Fatalf("compacted to %d bytes, want %d", info.Size(), want)
+	}
+	c := openKV(t, path)
+	c.Now = db.Now
+	rtx = c.BeginRead()
+	if stats := rtx.FileStats(); stats.TreePages != before.TreePages || stats.FreePages != 1 {
+		t.Fatalf("FileStats() of the copy = %+v", stats)
+	}
+	if rtx.Seq() != seq+1 || rtx.Applied() != 7 {
+		t.Fatalf("Seq() = %d, Applied() = %d", rtx.Seq(), rtx.Applied())
+	}
+	if n := rtx.Count(nil, nil); n != 100 {
+		t.Fatalf("%d keys in the copy", n)
+	}
+	if val, _ := rtx.Bucket([]byte("users")).Get([]byte("u0999")); string(val) != "9" {
+		t.Fatalf("users.Get() = %s", val)
+	}
+	if val, _ := rtx.Bucket([]byte("users")).Bucket([]byte("nested")).Get([]byte("a")); string(val) != "1" {
+		t.Fatalf("nested.Get() = %s", val)
+	}
+	if h := rtx.ColumnFamily([]byte("docs")).History([]byte("d")); len(h) != 2 || string(h[0].Value) != "v1" {
+		t.Fatalf("History() = %v", h)
+	}
+	if at, ok := rtx.ColumnFamily([]byte("cache")).ExpiresAt([]byte("c")); !ok || !at.Equal(now.Add(-time.Second+time.Hour)) {
+		t.Fatalf("ExpiresAt() = %v, %v", at, ok)
+	}
+	rtx.Rollback()
+
+	// the copy is a database of its own
+	for i := 0; i < 1000; i++ {
+		c.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("new"))
+	}
+	c.Close()
+	c = openKV(t, path)
+	defer c.Close()
+	if val, _ := c.Get([]byte("k0999")); string(val) != "new" {
+		t.Fatalf("Get() after reopening the copy = %s", val)
+	}
+}
@@ -0,0 +1,96 @@
+package btree
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// A transaction of BeginCtx or BeginReadCtx ends with its context: the
+// methods check it at their start, the safe points, and the scans every
+// CTX_CHECK_KEYS keys. a done context fails the transaction like a fault
+// with the error of the context: the reads find nothing, the writes and
+// Commit return it and Commit discards the updates, Err has it. the
+// transaction is still ended by Commit or Rollback.
+//
+// a commit isn't interrupted once it's queued, it's durable or failed
+// regardless of the context.
+
+const CTX_CHECK_KEYS = 256
+
+// like Begin, the wait for the current writer ends with `ctx` too
+func (db *KV) BeginCtx(ctx context.Context) (*Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !db.mu.TryLock() {
+		locked := make(chan struct{})
+		go func() {
+			db.mu.Lock()
+			close(locked)
+		}()
+		select {
+		case <-locked:
+		case <-ctx.Done():
+			// the lock is released as soon as it's taken
+			go func() {
+				<-locked
+				db.mu.Unlock()
+			}()
+			return nil, ctx.Err()
+		}
+	}
+	tx := db.begin()
+	tx.ctx = ctx
+	return tx, nil
+}
+
+func (db *KV) BeginReadCtx(ctx context.Context) (*Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tx := db.BeginRead()
+	tx.ctx = ctx
+	return tx, nil
+}
+
+// true if the context of the transaction is done, its error is the one of
+// the transaction then
+func (tx *Tx) canceled() bool {
+	if tx.ctx == nil {
+		return false
+	}
+	err := tx.ctx.Err()
+	if err == nil {
+		return false
+	}
+	tx.err.CompareAndSwap(nil, &err)
+	return true
+}
+
+// the scan callback `fn` stopped by the context every CTX_CHECK_KEYS keys
+func (tx *Tx) interruptible(fn func(key, val []byte) bool) func(key, val []byte) bool {
+	if tx.ctx == nil {
+		return fn
+	}
+	n := 0
+	return func(key, val []byte) bool {
+		if n++; n%CTX_CHECK_KEYS == 0 && tx.canceled() {
+			return false
+		}
+		return fn(key, val)
+	}
+}
+
+// like interruptible, for ScanParallel: the error stops every shard
+func (tx *Tx) interruptibleParallel(fn func(shard int, key, val []byte) error) func(shard int, key, val []byte) error {
+	if tx.ctx == nil {
+		return fn
+	}
+	var n atomic.Uint64
+	return func(shard int, key, val []byte) error {
+		if n.Add(1)%CTX_CHECK_KEYS == 0 && tx.canceled() {
+			return tx.Err()
+		}
+		return fn(shard, key, val)
+	}
+}
@@ -0,0 +1,73 @@
+package btree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBeginCtx(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	tx := db.Begin()
+	for i := 0; i < 2000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("val"))
+	}
+	tx.Commit()
+
+	// a scan stops at the next check of the context
+	ctx, cancel := context.WithCancel(context.Background())
+	tx, err := db.BeginReadCtx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	tx.Scan(nil, nil, func(key, val []byte) bool {
+		if n++; n == 10 {
+			cancel()
+		}
+		return true
+	})
+	if n != CTX_CHECK_KEYS-1 || !errors.Is(tx.Err(), context.Canceled) {
+		t.Fatalf("Scan() = %d keys, %v", n, tx.Err())
+	}
+	if _, ok := tx.Get([]byte("k0001")); ok {
+		t.Fatal("Get() after the cancel")
+	}
+	tx.Rollback()
+	if _, err := db.BeginReadCtx(ctx); err != context.Canceled {
+		t.Fatalf("BeginReadCtx() = %v", err)
+	}
+
+	// a write transaction fails
+	ctx, cancel = context.WithCancel(context.Background())
+	tx, _ = db.BeginCtx(ctx)
+	tx.Set([]byte("k0001"), []byte("new"))
+	cancel()
+	if err := tx.Set([]byte("k0002"), []byte("new")); err != context.Canceled {
+		t.Fatalf("Set() after the cancel = %v", err)
+	}
+	if err := tx.Commit(); err != context.Canceled {
+		t.Fatalf("Commit() after the cancel = %v", err)
+	}
+	if val, _ := db.Get([]byte("k0001")); string(val) != "val" {
+		t.Fatalf("the update of a canceled transaction is applied: %q", val)
+	}
+
+	// the wait for the writer ends with the context
+	writer := db.Begin()
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := db.BeginCtx(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("BeginCtx() = %v", err)
+	}
+	writer.Rollback()
+	tx, err = db.BeginCtx(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+}
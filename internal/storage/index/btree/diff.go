@@ -0,0 +1,230 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Diff walks two versions of a tree in key order and reports the keys
+// added, removed and changed between them. updates copy the nodes they
+// change, so the versions share the pages of the subtrees no update went
+// through: a subtree at the same page in both is skipped without reading
+// it, the walk reads the pages of the updates. the pages of the old version
+// must be the ones it had, they are while its transaction or MapSnapshot is
+// open: a page freed since can't be reused, equal pages are equal subtrees.
+//
+// the values passed to `fn`, `oldVal` is nil for an added key and `newVal`
+// for a removed one, are valid until it returns.
+
+var ErrDiffMismatch = errors.New("the trees of a diff are of different stores")
+
+// calls `fn` for the keys that differ between `old` and the tree in order
+// until it returns false
+func (tree *BT) Diff(old *BT, fn func(key, oldVal, newVal []byte) bool) {
+	a, b := diffCursor(old), diffCursor(tree)
+	for a.Valid() || b.Valid() {
+		var ka, kb []byte
+		if a.Valid() {
+			ka, _ = a.Deref()
+		}
+		if b.Valid() {
+			kb, _ = b.Deref()
+		}
+		switch {
+		case !b.Valid() || a.Valid() && bytes.Compare(ka, kb) < 0:
+			// the empty key inserted with the root of one of them
+			_, val := a.Deref()
+			if len(ka) > 0 && !fn(ka, val, nil) {
+				return
+			}
+			a.Next()
+		case !a.Valid() || bytes.Compare(ka, kb) > 0:
+			_, val := b.Deref()
+			if len(kb) > 0 && !fn(kb, nil, val) {
+				return
+			}
+			b.Next()
+		case diffSkip(a, b):
+		default:
+			_, va := a.Deref()
+			_, vb := b.Deref()
+			if !bytes.Equal(va, vb) && !fn(ka, va, vb) {
+				return
+			}
+			a.Next()
+			b.Next()
+		}
+	}
+}
+
+// an iterator at the empty key of the tree, the first one
+func diffCursor(tree *BT) *BIter {
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node := tree.node(ptr)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, 0)
+		ptr = 0
+		if node.btype() == BN_NODE {
+			ptr = node.getPtr(0)
+		}
+	}
+	return iter
+}
+
+// moves both iterators at the same key past the largest subtree they
+// share that starts at it, false if there is none
+func diffSkip(a, b *BIter) bool {
+	for la := diffTop(a); la < len(a.path); la++ {
+		pa := diffPage(a, la)
+		for lb := diffTop(b); lb < len(b.path); lb++ {
+			if diffPage(b, lb) == pa {
+				diffRun(a, la, b, lb)
+				diffPast(a, la)
+				diffPast(b, lb)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// moves both iterators to the last of the shared subtrees at `la` and
+// `lb` that follow each other in their parents, without reading them
+func diffRun(a *BIter, la int, b *BIter, lb int) {
+	if la == 0 || lb == 0 {
+		return
+	}
+	pa, pb := a.path[la-1], b.path[lb-1]
+	ia, ib := a.pos[la-1]+1, b.pos[lb-1]+1
+	for ; ia < pa.nkeys() && ib < pb.nkeys() && pa.getPtr(ia) == pb.getPtr(ib); ia, ib = ia+1, ib+1 {
+		a.pos[la-1], b.pos[lb-1] = ia, ib
+	}
+}
+
+// the top level of the nodes whose first key is the current one
+func diffTop(iter *BIter) int {
+	level := len(iter.pos)
+	for level > 0 && iter.pos[level-1] == 0 {
+		level--
+	}
+	return level
+}
+
+// the page of the node at `level` of the path
+func diffPage(iter *BIter, level int) uint64 {
+	if level == 0 {
+		return iter.tree.root
+	}
+	return iter.path[level-1].getPtr(iter.pos[level-1])
+}
+
+// moves the iterator past the subtree of the node at `level`, its first
+// key is the current one
+func diffPast(iter *BIter, level int) {
+	if level == 0 || !iterMove(iter, level-1, 1) {
+		iter.end = true
+		return
+	}
+	// iterMove loads the node below, the ones under it are at their first key
+	for l := level + 1; l < len(iter.path); l++ {
+		iter.path[l] = iter.tree.node(iter.path[l-1].getPtr(0))
+	}
+}
+
+// the callback `fn` of the caller with its panics as a callerPanic
+func diffCallback(fn func(key, oldVal, newVal []byte) bool) func(key, oldVal, newVal []byte) bool {
+	return func(key, oldVal, newVal []byte) bool {
+		defer func() {
+			if r := recover(); r != nil {
+				panic(callerPanic{r})
+			}
+		}()
+		return fn(key, oldVal, newVal)
+	}
+}
+
+// calls `fn` for the keys of the main keyspace that differ between the
+// version of `old`, a transaction of the same KV begun before, and the
+// one of the transaction, until it returns false. for an incremental
+// backup or a changefeed backfill from the version of a reader kept open.
+func (tx *Tx) Diff(old *Tx, fn func(key, oldVal, newVal []byte) bool) (err error) {
+	if tx.done || old.done {
+		return ErrTxClosed
+	}
+	if old.db != tx.db {
+		return ErrDiffMismatch
+	}
+	if tx.canceled() {
+		return tx.Err()
+	}
+	defer tx.catch("Diff", &err)
+	tx.tree.Diff(old.tree, diffCallback(fn))
+	return tx.Err()
+}
+
+// like Tx.Diff for the bucket in two transactions, `old` is nil if the
+// bucket is new. the values are decoded, a key expired in a version isn't
+// in it.
+func (b *Bucket) Diff(old *Bucket, fn func(key, oldVal, newVal []byte) bool) (err error) {
+	oldTree := &BT{}
+	if old != nil {
+		if old.tx.done {
+			return ErrTxClosed
+		}
+		if old.tx.db != b.tx.db {
+			return ErrDiffMismatch
+		}
+		oldTree = &old.tree
+	}
+	if b.tx.done {
+		return ErrTxClosed
+	}
+	if b.tx.canceled() {
+		return b.tx.Err()
+	}
+	defer b.catch("Diff", &err)
+	fn = diffCallback(fn)
+	if !b.opts.Compression && !b.opts.TTL {
+		b.tree.Diff(oldTree, fn)
+		return b.tx.Err()
+	}
+	now := b.tx.now()
+	b.tree.Diff(oldTree, func(key, oldVal, newVal []byte) bool {
+		var ok bool
+		if oldVal != nil {
+			if oldVal, ok = old.decode(oldVal, now); !ok {
+				oldVal = nil
+			}
+		}
+		if newVal != nil {
+			if newVal, ok = b.decode(newVal, now); !ok {
+				newVal = nil
+			}
+		}
+		if oldVal == nil && newVal == nil || oldVal != nil && newVal != nil && bytes.Equal(oldVal, newVal) {
+			return true
+		}
+		return fn(key, oldVal, newVal)
+	})
+	return b.tx.Err()
+}
+
+// calls `fn` for the keys that differ between the snapshot `old` of the
+// map and the map until it returns false
+func (m *Map) Diff(old *MapSnapshot, fn func(key, oldVal, newVal []byte) bool) error {
+	if old.m != m {
+		return ErrDiffMismatch
+	}
+	m.tree.Diff(&old.tree, fn)
+	return nil
+}
+
+// like Map.Diff between two snapshots of a map
+func (s *MapSnapshot) Diff(old *MapSnapshot, fn func(key, oldVal, newVal []byte) bool) error {
+	if old.m != s.m {
+		return ErrDiffMismatch
+	}
+	s.tree.Diff(&old.tree, fn)
+	return nil
+}
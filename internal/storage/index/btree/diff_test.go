@@ -0,0 +1,177 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// the diff of two reference maps in the format of diffText
+func refDiff(old, cur map[string]string) []string {
+	var out []string
+	for key, val := range old {
+		if v, ok := cur[key]; !ok {
+			out = append(out, "-"+key)
+		} else if v != val {
+			out = append(out, "~"+key+"="+v)
+		}
+	}
+	for key, val := range cur {
+		if _, ok := old[key]; !ok {
+			out = append(out, "+"+key+"="+val)
+		}
+	}
+	// by the keys of 6 bytes after the sign
+	slices.SortFunc(out, func(a, b string) int { return strings.Compare(a[1:7], b[1:7]) })
+	return out
+}
+
+// collects the diff from a callback, in order
+func diffText(out *[]string) func(key, oldVal, newVal []byte) bool {
+	return func(key, oldVal, newVal []byte) bool {
+		switch {
+		case oldVal == nil:
+			*out = append(*out, "+"+string(key)+"="+string(newVal))
+		case newVal == nil:
+			*out = append(*out, "-"+string(key))
+		default:
+			*out = append(*out, "~"+string(key)+"="+string(newVal))
+		}
+		return true
+	}
+}
+
+func TestMapDiff(t *testing.T) {
+	m := NewMap()
+	ref := map[string]string{}
+	r := rand.New(rand.NewSource(1))
+	update := func(n int) {
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("k%05d", r.Intn(20000))
+			if r.Intn(3) == 0 {
+				m.Delete([]byte(key))
+				delete(ref, key)
+			} else {
+				val := fmt.Sprint(i)
+				m.Set([]byte(key), []byte(val))
+				ref[key] = val
+			}
+		}
+	}
+	update(20000)
+	s1, ref1 := m.Snapshot(), maps(ref)
+	defer s1.Release()
+	update(100)
+	s2, ref2 := m.Snapshot(), maps(ref)
+	defer s2.Release()
+	update(3000)
+
+	for _, c := range []struct {
+		name     string
+		diff     func(fn func(key, oldVal, newVal []byte) bool) error
+		old, cur map[string]string
+	}{
+		{"s1 to s2", func(fn func(key, oldVal, newVal []byte) bool) error { return s2.Diff(s1, fn) }, ref1, ref2},
+		{"s2 to s1", func(fn func(key, oldVal, newVal []byte) bool) error { return s1.Diff(s2, fn) }, ref2, ref1},
+		{"s1 to the map", func(fn func(key, oldVal, newVal []byte) bool) error { return m.Diff(s1, fn) }, ref1, ref},
+		{"s2 to itself", func(fn func(key, oldVal, newVal []byte) bool) error { return s2.Diff(s2, fn) }, ref2, ref2},
+	} {
+		var got []string
+		if err := c.diff(diffText(&got)); err != nil {
+			t.Fatal(err)
+		}
+		if want := refDiff(c.old, c.cur); !slices.Equal(got, want) {
+			t.Fatalf("%s: %d differences %.5v; want %d %.5v", c.name, len(got), got, len(want), want)
+		}
+	}
+
+	// until the callback stops
+	n := 0
+	m.Diff(s1, func(key, oldVal, newVal []byte) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Fatalf("%d calls after the callback stopped", n)
+	}
+	if err := NewMap().Diff(s1, diffText(new([]string))); err != ErrDiffMismatch {
+		t.Fatalf("Diff() of another map = %v", err)
+	}
+}
+
+func maps(ref map[string]string) map[string]string {
+	out := map[string]string{}
+	for k, v := range ref {
+		out[k] = v
+	}
+	return out
+}
+
+func TestTxDiff(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	tx := db.Begin()
+	b, _ := tx.CreateBucket([]byte("b"))
+	for i := 0; i < 20000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%05d", i)), []byte("old"))
+		b.Set([]byte(fmt.Sprintf("k%05d", i)), []byte("old"))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	old := db.BeginRead()
+	defer old.Rollback()
+
+	tx = db.Begin()
+	tx.Set([]byte("k00100"), []byte("new"))
+	tx.Del([]byte("k12345"))
+	tx.Set([]byte("k99999"), []byte("new"))
+	tx.Bucket([]byte("b")).Del([]byte("k00007"))
+	fresh, _ := tx.CreateBucket([]byte("fresh"))
+	fresh.Set([]byte("k"), []byte("v"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	cur := db.BeginRead()
+	defer cur.Rollback()
+	var got []string
+	if err := cur.Diff(old, diffText(&got)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"~k00100=new", "-k12345", "+k99999=new"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Diff() = %v; want %v", got, want)
+	}
+	// the pages of the updates are read, not the shared ones
+	if reads := old.reads.Load() + cur.reads.Load(); reads > 20 {
+		t.Fatalf("%d pages read", reads)
+	}
+
+	got = nil
+	if err := cur.Bucket([]byte("b")).Diff(old.Bucket([]byte("b")), diffText(&got)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"-k00007"}; !slices.Equal(got, want) {
+		t.Fatalf("bucket Diff() = %v; want %v", got, want)
+	}
+	got = nil
+	if err := cur.Bucket([]byte("fresh")).Diff(nil, diffText(&got)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"+k=v"}; !slices.Equal(got, want) {
+		t.Fatalf("Diff() of a new bucket = %v; want %v", got, want)
+	}
+
+	other := openKV(t, filepath.Join(t.TempDir(), "other.db"))
+	defer other.Close()
+	otx := other.BeginRead()
+	defer otx.Rollback()
+	if err := cur.Diff(otx, diffText(&got)); err != ErrDiffMismatch {
+		t.Fatalf("Diff() of another file = %v", err)
+	}
+}
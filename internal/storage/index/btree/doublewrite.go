@@ -0,0 +1,145 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"syscall"
+)
+
+// The double-write buffer protects the pages written in place from torn
+// writes. appended pages and reused free pages aren't reachable from the
+// durable version, but a free list node is updated in place and holds
+// items of the durable version: a crash in the middle of its write can
+// leave the only copy of them corrupted.
+//
+// with KV.DoubleWrite the pages a batch writes in place are written to the
+// file Path+".dw" and fsynced first:
+//
+//	| sig | count | base meta | (ptr, page) * count | crc32c |
+//
+// at Open, if the meta page of the database is still the base meta of the
+// batch, the batch may have been torn and its pages are written again. if
+// the meta page is newer the pages were fsynced before it, nothing to do.
+// the file only holds the last batch: a page written in place later is
+// always in a newer batch.
+
+const (
+	DW_SIG    = "godbdblw"
+	DW_SUFFIX = ".dw"
+)
+
+var errBadDoubleWrite = errors.New("bad double-write file")
+
+// the pages of the flight written in place, nil if there are none
+func dwPages(f *flight) []uint64 {
+	var ptrs []uint64
+	for ptr := range f.pages {
+		if ptr < f.start {
+			ptrs = append(ptrs, ptr)
+		}
+	}
+	slices.Sort(ptrs)
+	return ptrs
+}
+
+// writes and fsyncs the pages of `f` written in place to the double-write file
+func writeDoubleWrite(db *KV, f *flight) error {
+	ptrs := dwPages(f)
+	if len(ptrs) == 0 {
+		return nil
+	}
+	buf := make([]byte, 0, 16+META_SIZE+len(ptrs)*(8+BT_PAGE_SIZE)+4)
+	buf = append(buf, DW_SIG...)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(ptrs)))
+	buf = append(buf, f.base[:META_SIZE]...)
+	for _, ptr := range ptrs {
+		buf = binary.LittleEndian.AppendUint64(buf, ptr)
+		buf = append(buf, f.pages[ptr]...)
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+	n, err := syscall.Pwrite(db.dwfd, buf, 0)
+	if err == nil && n != len(buf) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		return fmt.Errorf("write double-write file: %w", err)
+	}
+	if err := db.fsync(db.dwfd); err != nil {
+		return fmt.Errorf("fsync double-write file: %w", err)
+	}
+	db.count(METRIC_PAGE_WRITES, uint64(len(ptrs)))
+	return nil
+}
+
+// decodes a double-write file, the pages are nil if it is incomplete
+func readDoubleWrite(data []byte) (base []byte, pages map[uint64][]byte, err error) {
+	if len(data) < 16+META_SIZE+4 || string(data[:8]) != DW_SIG {
+		return nil, nil, errBadDoubleWrite
+	}
+	count := binary.LittleEndian.Uint64(data[8:16])
+	if count > uint64(len(data))/(8+BT_PAGE_SIZE) {
+		return nil, nil, errBadDoubleWrite
+	}
+	end := 16 + META_SIZE + int(count)*(8+BT_PAGE_SIZE)
+	if len(data) < end+4 || crc32.Checksum(data[:end], crcTable) != binary.LittleEndian.Uint32(data[end:]) {
+		// the fsync of the file didn't complete, neither did the batch
+		return nil, nil, errBadDoubleWrite
+	}
+	base = data[16 : 16+META_SIZE]
+	pages = map[uint64][]byte{}
+	for rec := data[16+META_SIZE : end]; len(rec) > 0; rec = rec[8+BT_PAGE_SIZE:] {
+		pages[binary.LittleEndian.Uint64(rec)] = rec[8 : 8+BT_PAGE_SIZE]
+	}
+	return base, pages, nil
+}
+
+// writes again the pages of the last batch if it may have been torn,
+// before the file is read. returns the number of pages.
+func recoverDoubleWrite(db *KV) (int, error) {
+	data, err := os.ReadFile(db.Path + DW_SUFFIX)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read double-write file: %w", err)
+	}
+	base, pages, err := readDoubleWrite(data)
+	if err != nil {
+		return 0, nil
+	}
+	meta := make([]byte, META_SIZE)
+	if n, err := syscall.Pread(db.fd, meta, 0); err != nil || n != META_SIZE {
+		return 0, nil // a new file
+	}
+	if !bytes.Equal(meta, base) {
+		return 0, nil
+	}
+	if _, err := writeRuns(db.fd, pages); err != nil {
+		return 0, fmt.Errorf("restore double-written pages: %w", err)
+	}
+	if err := syscall.Fsync(db.fd); err != nil {
+		return 0, fmt.Errorf("fsync restored pages: %w", err)
+	}
+	return len(pages), nil
+}
+
+// restores the pages of the last batch and opens the file with DoubleWrite
+func (db *KV) openDoubleWrite() error {
+	n, err := recoverDoubleWrite(db)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		db.log().Warn("restored the pages of an interrupted commit", "pages", n)
+	}
+	if db.DoubleWrite {
+		db.dwfd, err = createFileSync(db.Path + DW_SUFFIX)
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package btree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDoubleWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db := &KV{Path: path, DoubleWrite: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ref := map[string]string{}
+	for round := 0; round < 5; round++ {
+		tx := db.Begin()
+		for i := 0; i < 500; i++ {
+			key, val := fmt.Sprintf("k%04d", i), fmt.Sprint(round)
+			tx.Set([]byte(key), []byte(val))
+			ref[key] = val
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the last batch, torn below
+	tx := db.Begin()
+	for i := 0; i < 500; i += 7 {
+		tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("torn"))
+	}
+	tx.Commit()
+	db.Close()
+
+	data, err := os.ReadFile(path + DW_SUFFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, pages, err := readDoubleWrite(data)
+	if err != nil || len(pages) == 0 {
+		t.Fatalf("readDoubleWrite() = %d pages, %v", len(pages), err)
+	}
+
+	// the crash: the pages written in place are torn, the meta page of the
+	// batch isn't written
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.WriteAt(base, 0)
+	for ptr := range pages {
+		fp.WriteAt(make([]byte, BT_PAGE_SIZE/2), int64(ptr*BT_PAGE_SIZE))
+	}
+	fp.Close()
+
+	// the free list is damaged without the double-write file
+	torn := filepath.Join(dir, "torn.db")
+	file, _ := os.ReadFile(path)
+	os.WriteFile(torn, file, 0o644)
+	if report, err := Check(torn); err == nil && report.OK() {
+		t.Fatal("Check() of the torn file passes")
+	}
+
+	db = openKV(t, path)
+	assertKV(t, db, ref)
+	db.Close()
+	if report, err := Check(path); err != nil || !report.OK() {
+		t.Fatalf("Check() after the restore = %+v, %v", report, err)
+	}
+
+	// an incomplete file is ignored
+	data[len(data)-1] ^= 1
+	if _, _, err := readDoubleWrite(data); err == nil {
+		t.Fatal("readDoubleWrite() of a corrupt file")
+	}
+}
@@ -0,0 +1,31 @@
+package btree
+
+// Events are optional callbacks of the structural events of the engine,
+// set KV.Events before Open. a nil callback is skipped. Split and Merge
+// run in the write transaction holding the writer lock, Commit in the
+// committer or in Apply of a replica: they must not use the database.
+type Events struct {
+	// a commit is durable, once per commit sequence in order
+	Commit func(seq uint64)
+	// a node of a write transaction is split in `nodes` nodes, 2 or 3
+	Split func(nodes int)
+	// a node of a write transaction is merged with a sibling
+	Merge func()
+	// Compact starts to copy the version `seq` to `path`
+	CompactionStart func(path string, seq uint64)
+	// Compact is done, `pages` of the copy or the error
+	CompactionEnd func(path string, pages uint64, err error)
+	// Open found the pages of an interrupted commit after the last durable
+	// one at `seq`, they are reused
+	Recovery func(seq uint64, pages uint64)
+}
+
+// calls Events.Commit for the commits from `from` to `to` included
+func (db *KV) commitEvents(from, to uint64) {
+	if db.Events == nil || db.Events.Commit == nil {
+		return
+	}
+	for seq := from; seq <= to; seq++ {
+		db.Events.Commit(seq)
+	}
+}
@@ -0,0 +1,85 @@
+package btree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	var (
+		mu          sync.Mutex
+		commits     []uint64
+		splits      = map[int]int{}
+		merges      int
+		compactions []string
+		recovered   []uint64
+	)
+	events := &Events{
+		Commit: func(seq uint64) {
+			mu.Lock()
+			defer mu.Unlock()
+			commits = append(commits, seq)
+		},
+		Split: func(nodes int) { splits[nodes]++ },
+		Merge: func() { merges++ },
+		CompactionStart: func(path string, seq uint64) {
+			compactions = append(compactions, fmt.Sprintf("start %s %d", filepath.Base(path), seq))
+		},
+		CompactionEnd: func(path string, pages uint64, err error) {
+			compactions = append(compactions, fmt.Sprintf("end %s %v %v", filepath.Base(path), pages > 0, err))
+		},
+		Recovery: func(seq uint64, pages uint64) { recovered = append(recovered, seq, pages) },
+	}
+	db := &KV{Path: path, Events: events, Async: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		db.Set([]byte(fmt.Sprintf("k%04d", i)), make([]byte, 100))
+	}
+	db.Begin().Rollback() // no commit
+	for i := 0; i < 300; i++ {
+		db.Del([]byte(fmt.Sprintf("k%04d", i)))
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	db.Compact(filepath.Join(dir, "copy.db"))
+	db.Compact(filepath.Join(dir, "copy.db"))
+	db.Close()
+
+	mu.Lock()
+	if len(commits) != 600 {
+		t.Fatalf("%d commits", len(commits))
+	}
+	for i, seq := range commits {
+		if seq != uint64(i+1) {
+			t.Fatalf("commit %d: seq %d", i, seq)
+		}
+	}
+	mu.Unlock()
+	if splits[2] == 0 || merges == 0 {
+		t.Fatalf("splits %v, %d merges", splits, merges)
+	}
+	// the second one fails before it starts
+	if len(compactions) != 2 || compactions[0] != "start copy.db 600" || compactions[1] != "end copy.db true <nil>" {
+		t.Fatalf("compactions %q", compactions)
+	}
+
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write(make([]byte, BT_PAGE_SIZE))
+	f.Close()
+	db = &KV{Path: path, Events: events}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if len(recovered) != 2 || recovered[0] != 600 || recovered[1] != 1 {
+		t.Fatalf("Recovery(%v)", recovered)
+	}
+}
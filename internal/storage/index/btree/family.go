@@ -0,0 +1,161 @@
+package btree
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrBadOptions = errors.New("bad column family options")
+
+const (
+	CF_COMPRESSION = 1 << 0
+	CF_TTL         = 1 << 1
+
+	// compressed value header
+	VAL_RAW   = 0
+	VAL_FLATE = 1
+)
+
+// Column families are buckets with their own options, they share the file
+// and the transactions with the rest of the database. Options are stored in
+// the bucket record and can't be changed after creation.
+type CFOptions struct {
+	// values are compressed with flate, values that don't shrink are stored as is
+	Compression bool
+	// values carry an expiration time, see Bucket.SetTTL
+	TTL bool
+	// preferred page size, a power of 2 in [1KB, 64KB) or 0.
+	// recorded for the page allocator, pages are BT_PAGE_SIZE for now
+	PageSizeHint uint16
+	// values larger than this are meant for the value log, 0 disables it.
+	// recorded for the value log, values are stored in the tree for now
+	ValueLogThreshold uint32
+	// old versions of keys are kept in the history, see Bucket.History.
+	// a version is kept while it is one of the last MaxVersions versions
+	// and it was replaced within Retention, zero means no limit.
+	// both zero disables the history.
+	MaxVersions uint32
+	Retention   time.Duration
+}
+
+func (opts CFOptions) versioned() bool {
+	return opts.MaxVersions > 0 || opts.Retention > 0
+}
+
+func (opts CFOptions) flags() uint16 {
+	var flags uint16
+	if opts.Compression {
+		flags |= CF_COMPRESSION
+	}
+	if opts.TTL {
+		flags |= CF_TTL
+	}
+	return flags
+}
+
+func (opts CFOptions) validate() error {
+	hint := opts.PageSizeHint
+	if hint != 0 && (hint < 1024 || hint&(hint-1) != 0) {
+		return ErrBadOptions
+	}
+	if opts.Retention < 0 {
+		return ErrBadOptions
+	}
+	return nil
+}
+
+// options of the bucket record, older records have defaults
+func decodeOptions(record []byte) CFOptions {
+	opts := CFOptions{}
+	if len(record) >= 24 {
+		flags := binary.LittleEndian.Uint16(record[16:18])
+		opts.Compression = flags&CF_COMPRESSION != 0
+		opts.TTL = flags&CF_TTL != 0
+		opts.PageSizeHint = binary.LittleEndian.Uint16(record[18:20])
+		opts.ValueLogThreshold = binary.LittleEndian.Uint32(record[20:24])
+	}
+	if len(record) >= 52 {
+		opts.MaxVersions = binary.LittleEndian.Uint32(record[40:44])
+		opts.Retention = time.Duration(binary.LittleEndian.Uint64(record[44:52]))
+	}
+	return opts
+}
+
+func (tx *Tx) CreateColumnFamily(name []byte, opts CFOptions) (*Bucket, error) {
+	return tx.createBucket(bucketKey(nil, name), name, opts)
+}
+
+// nil if there is no such column family, same as Bucket
+func (tx *Tx) ColumnFamily(name []byte) *Bucket {
+	return tx.Bucket(name)
+}
+
+func (b *Bucket) Options() CFOptions {
+	return b.opts
+}
+
+// stored value
+// | expireAt (TTL) | value (compressed) |
+// |       8B       |        ...         |
+func (b *Bucket) encode(val []byte, expireAt int64) []byte {
+	if b.opts.Compression {
+		val = encodeValue(val)
+	}
+	if !b.opts.TTL {
+		return val
+	}
+	stored := make([]byte, 8+len(val))
+	binary.LittleEndian.PutUint64(stored, uint64(expireAt))
+	copy(stored[8:], val)
+	return stored
+}
+
+// false if the value is expired at `now`
+func (b *Bucket) decode(stored []byte, now int64) ([]byte, bool) {
+	if b.opts.TTL {
+		if expired(stored, now) {
+			return nil, false
+		}
+		stored = stored[8:]
+	}
+	if b.opts.Compression {
+		stored = decodeValue(stored)
+	}
+	return stored, true
+}
+
+// | type | data |
+// |  1B  | ...  |
+func encodeValue(val []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(VAL_FLATE)
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	assert(err == nil)
+	w.Write(val)
+	w.Close()
+	if buf.Len() >= 1+len(val) {
+		return append([]byte{VAL_RAW}, val...)
+	}
+	return buf.Bytes()
+}
+
+func decodeValue(data []byte) []byte {
+	if len(data) == 0 {
+		fault(0, "an empty stored value")
+	}
+	if data[0] == VAL_RAW {
+		return data[1:]
+	}
+	if data[0] != VAL_FLATE {
+		fault(0, "bad value type %d", data[0])
+	}
+	val, err := io.ReadAll(flate.NewReader(bytes.NewReader(data[1:])))
+	if err != nil {
+		fault(0, "bad compressed value: %v", err)
+	}
+	return val
+}
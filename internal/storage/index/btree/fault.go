@@ -0,0 +1,332 @@
+package btree
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"slices"
+	"strings"
+)
+
+// There are two kinds of checks. assert is for the invariants of the code:
+// a failure is a bug and panics. fault is for the checks of what is read
+// from the file, a damaged page or a pointer out of the file: it panics
+// with a *pageFault that the methods of Tx, Bucket and KV recover into a
+// *PageError, so a damaged file fails the operation instead of the process.
+// the page is quarantined: it's recorded with the keys it covers, see
+// Corrupted, and the rest of the database stays readable.
+//
+// the reads of the tree have no error path, a fault unwinds them up to
+// the method that started the operation:
+//
+//   - the methods with an error return it
+//   - Get, Scan and the like return nothing found, the error is Tx.Err
+//   - the write transaction is failed: its updates may be half applied,
+//     Commit discards them and returns the error
+//
+// pages have no checksums, a page is checked by its header when it's read.
+// Check and Scrub check the rest.
+//
+// the same methods recover the other panics, a failed assert, into an
+// *InternalError and fail the database: the file is left as it is, the
+// writes and the commits fail and the reads go on until it's reopened. the
+// committer recovers its own. the panics of the callbacks of the caller
+// aren't internal and go on, see callback.
+
+// the problems of a page found by fault
+var ErrCorrupted = errors.New("corrupted page")
+
+type PageError struct {
+	Page uint64 // 0 if unknown, the meta page is never read by the trees
+	Op   string // the method, "Get", "Set", "Commit"...
+	// the tree of the page like in CheckError and the keys [Lo, Hi) it
+	// covers, from the separators of its parent. empty if not found, Hi is
+	// nil for the end of the tree.
+	Tree   string
+	Lo, Hi []byte
+	Err    error // wraps ErrCorrupted
+}
+
+func (e *PageError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(e.Op)
+	if e.Page != 0 {
+		fmt.Fprintf(&sb, ": page %d", e.Page)
+	}
+	if e.Tree != "" {
+		fmt.Fprintf(&sb, " (%s", e.Tree)
+		if e.Lo != nil {
+			hi := "end"
+			if e.Hi != nil {
+				hi = showBytes(e.Hi)
+			}
+			fmt.Fprintf(&sb, ", keys %s to %s", showBytes(e.Lo), hi)
+		}
+		sb.WriteByte(')')
+	}
+	fmt.Fprintf(&sb, ": %v", e.Err)
+	return sb.String()
+}
+
+func (e *PageError) Unwrap() error {
+	return e.Err
+}
+
+// the panic of fault
+type pageFault struct {
+	page uint64
+	msg  string
+}
+
+// fails a check of the data of the page `ptr`
+func fault(ptr uint64, format string, args ...any) {
+	panic(&pageFault{page: ptr, msg: fmt.Sprintf(format, args...)})
+}
+
+// the other panics recovered by the methods, see InternalError
+var ErrInternal = errors.New("internal error")
+
+// a panic other than a fault: a failed assert, a bug. the database is
+// failed, see KV.Failed: the writes and the commits return the error
+// without touching the file, the reads go on. reopen the database.
+type InternalError struct {
+	Op    string
+	Value any    // of the panic
+	Stack []byte // of the panic
+}
+
+func (e *InternalError) Error() string {
+	return fmt.Sprintf("%s: %v: %v", e.Op, ErrInternal, e.Value)
+}
+
+func (e *InternalError) Unwrap() error {
+	return ErrInternal
+}
+
+// a tree searched for the parent of a corrupted page
+type namedTree struct {
+	name string
+	tree *BT
+}
+
+// recovers a panic of `op` into `err` if not nil, deferred by the methods
+// of KV
+func (db *KV) catch(op string, err *error) {
+	if r := recover(); r != nil {
+		e := db.recovered(r, op, []namedTree{{"keyspace", &db.tree}, {"catalog", &db.catalog}})
+		if err != nil {
+			*err = e
+		}
+	}
+}
+
+// recovers a panic of `op` into the error of the transaction and `err`
+// if not nil, deferred by the methods of Tx
+func (tx *Tx) catch(op string, err *error) {
+	if r := recover(); r != nil {
+		tx.recovered(r, op, nil, err)
+	}
+}
+
+// like Tx.catch, for the methods of Bucket
+func (b *Bucket) catch(op string, err *error) {
+	if r := recover(); r != nil {
+		name := "bucket " + bucketPath(b.key)
+		b.tx.recovered(r, op, []namedTree{
+			{name, &b.tree}, {name + " expiry", &b.expiry}, {name + " history", &b.history},
+		}, err)
+	}
+}
+
+func (tx *Tx) recovered(r any, op string, trees []namedTree, err *error) {
+	trees = append(trees, namedTree{"keyspace", tx.tree}, namedTree{"catalog", tx.catalog})
+	e := tx.db.recovered(r, op, trees)
+	tx.err.CompareAndSwap(nil, &e)
+	if err != nil {
+		*err = e
+	}
+}
+
+// the error of the panic `r` of `op`: a fault is quarantined, its page is
+// looked up in `trees`. another panic fails the database.
+func (db *KV) recovered(r any, op string, trees []namedTree) error {
+	if p, ok := r.(callerPanic); ok {
+		panic(p.value)
+	}
+	f, ok := r.(*pageFault)
+	if !ok {
+		e := &InternalError{Op: op, Value: r, Stack: debug.Stack()}
+		db.fail(e)
+		return e
+	}
+	e := &PageError{Page: f.page, Op: op, Err: fmt.Errorf("%w: %s", ErrCorrupted, f.msg)}
+	db.quarantine(e, trees)
+	return e
+}
+
+// fails the database with its first internal error
+func (db *KV) fail(e *InternalError) {
+	if db.internal.CompareAndSwap(nil, e) {
+		db.log().Error("internal error, the database is failed", "op", e.Op, "panic", e.Value, "stack", string(e.Stack))
+	}
+}
+
+// the internal error that failed the database, nil if none
+func (db *KV) Failed() error {
+	if e := db.internal.Load(); e != nil {
+		return e
+	}
+	return nil
+}
+
+// the panic of a callback of the caller, catch panics again with the
+// value: it isn't internal, the trees are fine
+type callerPanic struct {
+	value any
+}
+
+// the callback `fn` of the caller with its panics as a callerPanic
+func callback(fn func(key, val []byte) bool) func(key, val []byte) bool {
+	return func(key, val []byte) bool {
+		defer func() {
+			if r := recover(); r != nil {
+				panic(callerPanic{r})
+			}
+		}()
+		return fn(key, val)
+	}
+}
+
+// like callback, for ScanParallel
+func parallelCallback(fn func(shard int, key, val []byte) error) func(shard int, key, val []byte) error {
+	return func(shard int, key, val []byte) error {
+		defer func() {
+			if r := recover(); r != nil {
+				panic(callerPanic{r})
+			}
+		}()
+		return fn(shard, key, val)
+	}
+}
+
+// records the page of `e` as corrupted, the first time it's logged. the
+// tree and the keys of the page are looked up in `trees`.
+func (db *KV) quarantine(e *PageError, trees []namedTree) {
+	if e.Page == 0 {
+		db.log().Error("corrupted value", "op", e.Op, "err", e.Err)
+		return
+	}
+	for _, t := range trees {
+		if lo, hi, ok := locate(t.tree, e.Page); ok {
+			e.Tree, e.Lo, e.Hi = t.name, lo, hi
+			break
+		}
+	}
+	db.corrupt.Lock()
+	defer db.corrupt.Unlock()
+	if db.corrupt.pages == nil {
+		db.corrupt.pages = map[uint64]*PageError{}
+	}
+	if _, ok := db.corrupt.pages[e.Page]; ok {
+		return
+	}
+	db.corrupt.pages[e.Page] = e
+	db.count(METRIC_CORRUPT_PAGES, 1)
+	db.log().Error("corrupted page", "page", e.Page, "tree", e.Tree, "lo", e.Lo, "hi", e.Hi, "op", e.Op, "err", e.Err)
+}
+
+// the pages found corrupted since Open by page number, the first error of
+// each. the other pages stay readable.
+func (db *KV) Corrupted() []*PageError {
+	db.corrupt.Lock()
+	defer db.corrupt.Unlock()
+	errs := make([]*PageError, 0, len(db.corrupt.pages))
+	for _, e := range db.corrupt.pages {
+		errs = append(errs, e)
+	}
+	slices.SortFunc(errs, func(a, b *PageError) int {
+		return cmp.Compare(a.Page, b.Page)
+	})
+	return errs
+}
+
+// the keys [lo, hi) of the page `ptr` of `tree` from the separators of its
+// parent, searched in the branch nodes. false if it isn't in the tree. the
+// root covers every key, lo is empty.
+func locate(tree *BT, ptr uint64) (lo, hi []byte, ok bool) {
+	if tree.root == 0 {
+		return nil, nil, false
+	}
+	if tree.root == ptr {
+		return []byte{}, nil, true
+	}
+	// the leaves aren't read, the height is the one of the first leaf
+	height := 0
+	for kid := tree.root; ; height++ {
+		node, valid := readNode(tree, kid)
+		if !valid || node.btype() != BN_NODE {
+			break
+		}
+		kid = node.getPtr(0)
+	}
+	var walk func(node uint64, bound []byte, level int) bool
+	walk = func(nptr uint64, bound []byte, level int) bool {
+		node, valid := readNode(tree, nptr)
+		if !valid || node.btype() != BN_NODE {
+			return false
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			kidHi := bound
+			if i+1 < node.nkeys() {
+				kidHi = node.getKey(i + 1)
+			}
+			if node.getPtr(i) == ptr {
+				lo, hi = bytes.Clone(node.getKey(i)), bytes.Clone(kidHi)
+				return true
+			}
+			if level < height && walk(node.getPtr(i), kidHi, level+1) {
+				return true
+			}
+		}
+		return false
+	}
+	ok = walk(tree.root, nil, 1)
+	return lo, hi, ok
+}
+
+// the node `ptr` if it can be read and has a valid layout
+func readNode(tree *BT, ptr uint64) (node BN, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	node = BN(tree.get(ptr))
+	return node, nodeLayout(node) == ""
+}
+
+// the first fault, internal error or error of the context of the
+// transaction, nil if none. a write transaction with one can't be
+// committed.
+func (tx *Tx) Err() error {
+	if e := tx.err.Load(); e != nil {
+		return *e
+	}
+	return nil
+}
+
+// checks the header of the node `ptr` read from the file, the rest of its
+// layout is checked by Check and Scrub
+func checkNode(ptr uint64, node BN) {
+	btype, nkeys := node.btype(), node.nkeys()
+	switch {
+	case btype != BN_NODE && btype != BN_LEAF:
+		fault(ptr, "bad node type %d", btype)
+	case nkeys == 0 || HEADER+10*int(nkeys) > BT_PAGE_SIZE:
+		fault(ptr, "bad number of keys %d", nkeys)
+	case int(node.nbytes()) > BT_PAGE_SIZE:
+		fault(ptr, "the node has %d bytes", node.nbytes())
+	}
+}
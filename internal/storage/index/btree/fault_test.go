@@ -0,0 +1,234 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+	tx := db.Begin()
+	for i := 0; i < 2000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("val"))
+	}
+	tx.Commit()
+	db.Close()
+
+	// a bad type in the first kid of the root, it has the first keys
+	file, _ := os.ReadFile(path)
+	root := binary.LittleEndian.Uint64(file[16:24])
+	kid := BN(file[root*BT_PAGE_SIZE:]).getPtr(0)
+	binary.LittleEndian.PutUint16(file[kid*BT_PAGE_SIZE:], 9)
+	os.WriteFile(path, file, 0o644)
+
+	db = openKV(t, path)
+	defer db.Close()
+	isFault := func(err error, op string) bool {
+		var pe *PageError
+		return errors.As(err, &pe) && errors.Is(err, ErrCorrupted) && pe.Page == kid && pe.Op == op
+	}
+
+	// the rest of the database is readable
+	tx = db.BeginRead()
+	if _, ok := tx.Get([]byte("k1999")); !ok || tx.Err() != nil {
+		t.Fatalf("Get() of a good page = %v, %v", ok, tx.Err())
+	}
+	if _, ok := tx.Get([]byte("k0000")); ok || !isFault(tx.Err(), "Get") {
+		t.Fatalf("Get() of a bad page = %v, %v", ok, tx.Err())
+	}
+	if _, err := tx.Fetch([]byte("k0001")); !isFault(err, "Fetch") {
+		t.Fatalf("Fetch() of a bad page = %v", err)
+	}
+	// the keys of the page are from the root
+	var pe *PageError
+	errors.As(tx.Err(), &pe)
+	hi := BN(file[root*BT_PAGE_SIZE:]).getKey(1)
+	if pe.Tree != "keyspace" || len(pe.Lo) != 0 || string(pe.Hi) != string(hi) {
+		t.Fatalf("the page covers %q to %q of %s, want to %q", pe.Lo, pe.Hi, pe.Tree, hi)
+	}
+	want := fmt.Sprintf("Get: page %d (keyspace, keys \"\" to %q): corrupted page: bad node type 9", kid, hi)
+	if pe.Error() != want {
+		t.Fatalf("Error() = %s, want %s", pe, want)
+	}
+	tx.Rollback()
+	if _, ok := db.Get([]byte("k0000")); ok {
+		t.Fatal("KV.Get() of a bad page")
+	}
+
+	// a write transaction with a fault is discarded
+	tx = db.Begin()
+	tx.Set([]byte("k1999"), []byte("new"))
+	if err := tx.Set([]byte("k0001"), []byte("new")); !isFault(err, "Set") {
+		t.Fatalf("Set() in a bad page = %v", err)
+	}
+	if err := tx.Set([]byte("k1998"), []byte("new")); !isFault(err, "Set") {
+		t.Fatalf("Set() after a fault = %v", err)
+	}
+	if err := tx.Commit(); !isFault(err, "Set") {
+		t.Fatalf("Commit() after a fault = %v", err)
+	}
+	if val, _ := db.Get([]byte("k1999")); string(val) != "val" {
+		t.Fatalf("the update of a failed transaction is applied: %q", val)
+	}
+	if _, err := db.Del([]byte("k0002")); !isFault(err, "Del") {
+		t.Fatalf("KV.Del() in a bad page = %v", err)
+	}
+	if err := db.Set([]byte("k1999"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := db.Get([]byte("k1999")); string(val) != "new" {
+		t.Fatalf("Get() = %q", val)
+	}
+
+	// quarantined once, with the first operation
+	if errs := db.Corrupted(); len(errs) != 1 || errs[0].Page != kid || errs[0].Op != "Get" {
+		t.Fatalf("Corrupted() = %v", errs)
+	}
+}
+
+func TestFaultBucket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+	tx := db.Begin()
+	users, _ := tx.CreateBucket([]byte("users"))
+	for i := 0; i < 2000; i++ {
+		users.Set([]byte(fmt.Sprintf("u%04d", i)), []byte("val"))
+	}
+	tx.Commit()
+
+	// the last kid of the root of the bucket
+	tx = db.BeginRead()
+	b := tx.Bucket([]byte("users"))
+	parent := BN(tx.pageRead(b.tree.root))
+	leaf := parent.getPtr(parent.nkeys() - 1)
+	lo := bytes.Clone(parent.getKey(parent.nkeys() - 1))
+	tx.Rollback()
+	db.Close()
+	file, _ := os.ReadFile(path)
+	binary.LittleEndian.PutUint16(file[leaf*BT_PAGE_SIZE+2:], 0)
+	os.WriteFile(path, file, 0o644)
+
+	db = openKV(t, path)
+	defer db.Close()
+	tx = db.BeginRead()
+	defer tx.Rollback()
+	b = tx.Bucket([]byte("users"))
+	n := 0
+	b.Scan(nil, nil, func(key, val []byte) bool {
+		n++
+		return true
+	})
+	var pe *PageError
+	if !errors.As(tx.Err(), &pe) || pe.Op != "Scan" || pe.Tree != "bucket users" || string(pe.Lo) != string(lo) || pe.Hi != nil {
+		t.Fatalf("Scan() = %d keys, %v", n, tx.Err())
+	}
+	if _, ok := b.Get([]byte("u0000")); !ok {
+		t.Fatal("Get() of a good page")
+	}
+}
+
+func TestInternal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	var split, commit atomic.Bool
+	events := &Events{
+		Split: func(int) {
+			if split.Load() {
+				panic("split")
+			}
+		},
+		Commit: func(uint64) {
+			if commit.Load() {
+				panic("commit")
+			}
+		},
+	}
+	db := &KV{Path: path, Events: events}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("k"), []byte("val"))
+
+	// a panic of the caller goes on
+	func() {
+		defer func() {
+			if r := recover(); r != "scan" {
+				t.Fatalf("recover() = %v", r)
+			}
+		}()
+		tx := db.BeginRead()
+		defer tx.Rollback()
+		tx.Scan(nil, nil, func(key, val []byte) bool { panic("scan") })
+	}()
+	if err := db.Failed(); err != nil {
+		t.Fatalf("Failed() after a panic of Scan = %v", err)
+	}
+
+	// a panic in the tree fails the transaction and the database
+	split.Store(true)
+	tx := db.Begin()
+	var err error
+	for i := 0; err == nil; i++ {
+		err = tx.Set([]byte(fmt.Sprintf("k%04d", i)), make([]byte, 100))
+	}
+	var ie *InternalError
+	if !errors.As(err, &ie) || !errors.Is(err, ErrInternal) || ie.Op != "Set" || ie.Value != "split" {
+		t.Fatalf("Set() = %v", err)
+	}
+	if !strings.Contains(string(ie.Stack), "TestInternal") {
+		t.Fatalf("the stack of the panic:\n%s", ie.Stack)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrInternal) {
+		t.Fatalf("Commit() = %v", err)
+	}
+	split.Store(false)
+	if err := db.Set([]byte("k"), []byte("new")); !errors.Is(err, ErrInternal) {
+		t.Fatalf("Set() of a failed database = %v", err)
+	}
+	if err := db.Sync(); !errors.Is(err, ErrInternal) {
+		t.Fatalf("Sync() of a failed database = %v", err)
+	}
+	if db.Failed() != error(ie) || db.Health() != error(ie) {
+		t.Fatalf("Failed() = %v, Health() = %v", db.Failed(), db.Health())
+	}
+	if val, ok := db.Get([]byte("k")); !ok || string(val) != "val" {
+		t.Fatalf("Get() of a failed database = %q, %v", val, ok)
+	}
+	if err := db.Close(); !errors.Is(err, ErrInternal) {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	// the file is the one before the panic
+	db = &KV{Path: path, Events: events}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if db.Failed() != nil {
+		t.Fatalf("Failed() after Open = %v", db.Failed())
+	}
+	if val, _ := db.Get([]byte("k")); string(val) != "val" {
+		t.Fatalf("Get() = %q", val)
+	}
+	if _, ok := db.Get([]byte("k0000")); ok {
+		t.Fatal("the updates of the failed transaction are written")
+	}
+
+	// a panic of the committer fails the batch
+	commit.Store(true)
+	if err := db.Set([]byte("k"), []byte("new")); !errors.As(err, &ie) || ie.Op != "Commit" || ie.Value != "commit" {
+		t.Fatalf("Set() with a panic of the committer = %v", err)
+	}
+	if err := db.Set([]byte("k"), []byte("new")); !errors.Is(err, ErrInternal) {
+		t.Fatalf("Set() after a panic of the committer = %v", err)
+	}
+	if err := db.Close(); !errors.Is(err, ErrInternal) {
+		t.Fatalf("Close() = %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotOpen is the health of a database before Open or after Close
+var ErrNotOpen = errors.New("the database is not open")
+
+// checks the database for a liveness probe: it is open and its last batch
+// of commits is durable. the error of a failed batch is reported until the
+// next batch is durable, an internal error until the database is
+// reopened. call it after Open.
+func (db *KV) Health() error {
+	if db.stop == nil {
+		return ErrNotOpen
+	}
+	select {
+	case <-db.stop:
+		return ErrNotOpen
+	default:
+	}
+	if err := db.Failed(); err != nil {
+		return err
+	}
+	if err := db.commitErr.Load(); err != nil {
+		return fmt.Errorf("last commit failed: %w", *err)
+	}
+	return nil
+}
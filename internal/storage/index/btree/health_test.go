@@ -0,0 +1,60 @@
+package btree
+
+import (
+	"errors"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path}
+	if err := db.Health(); !errors.Is(err, ErrNotOpen) {
+		t.Fatalf("Health() before Open = %v", err)
+	}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Health(); err != nil {
+		t.Fatalf("Health() = %v", err)
+	}
+
+	// the writes of a batch fail on a read only descriptor
+	fd, err := syscall.Open(path, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	set := func(key string) error {
+		tx := db.Begin()
+		tx.Set([]byte(key), []byte("v"))
+		return tx.Commit()
+	}
+	db.mu.Lock()
+	fd, db.fd = db.fd, fd
+	db.mu.Unlock()
+	if err := set("a"); err == nil {
+		t.Fatal("Commit() on a read only descriptor")
+	}
+	if err := db.Health(); err == nil {
+		t.Fatal("Health() after a failed commit = nil")
+	}
+	db.mu.Lock()
+	fd, db.fd = db.fd, fd
+	db.mu.Unlock()
+	if err := set("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Health(); err != nil {
+		t.Fatalf("Health() after a durable commit = %v", err)
+	}
+
+	db.Close()
+	if err := db.Health(); !errors.Is(err, ErrNotOpen) {
+		t.Fatalf("Health() after Close = %v", err)
+	}
+	if err := db.Close(); !errors.Is(err, ErrNotOpen) {
+		t.Fatalf("second Close() = %v", err)
+	}
+}
@@ -0,0 +1,349 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+// B-tree iterator, the path from the root to the current leaf
+type BIter struct {
+	tree *BT
+	path []BN     // nodes from the root to the leaf
+	pos  []uint16 // index of the key in each node
+	end  bool     // moved past the first or the last key
+}
+
+// find the last key less than or equal to `key`
+func (tree *BT) SeekLE(key []byte) *BIter {
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node := tree.node(ptr)
+		idx := nodeLookupLE(node, key)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		ptr = 0
+		if node.btype() == BN_NODE {
+			ptr = node.getPtr(idx)
+		}
+	}
+	if iter.isSentinel() {
+		iter.end = true
+	}
+	return iter
+}
+
+// find the last key
+func (tree *BT) SeekLast() *BIter {
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node := tree.node(ptr)
+		idx := node.nkeys() - 1
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		ptr = 0
+		if node.btype() == BN_NODE {
+			ptr = node.getPtr(idx)
+		}
+	}
+	if iter.isSentinel() {
+		iter.end = true
+	}
+	return iter
+}
+
+// find the first key greater than or equal to `key`
+func (tree *BT) Seek(key []byte) *BIter {
+	iter := tree.SeekLE(key)
+	if iter.end && len(iter.path) > 0 {
+		// before the first key
+		iter.end = false
+		iter.Next()
+		return iter
+	}
+	if iter.Valid() {
+		if cur, _ := iter.Deref(); bytes.Compare(cur, key) < 0 {
+			iter.Next()
+		}
+	}
+	return iter
+}
+
+func (iter *BIter) Valid() bool {
+	return !iter.end && len(iter.path) > 0
+}
+
+// current KV pair
+func (iter *BIter) Deref() ([]byte, []byte) {
+	assert(iter.Valid())
+	leaf := iter.path[len(iter.path)-1]
+	idx := iter.pos[len(iter.pos)-1]
+	return leaf.getKey(idx), leaf.getVal(idx)
+}
+
+func (iter *BIter) Next() {
+	if !iter.Valid() {
+		return
+	}
+	if !iterMove(iter, len(iter.path)-1, 1) {
+		iter.end = true
+	}
+}
+
+func (iter *BIter) Prev() {
+	if !iter.Valid() {
+		return
+	}
+	if !iterMove(iter, len(iter.path)-1, -1) || iter.isSentinel() {
+		iter.end = true
+	}
+}
+
+// move the position at `level` by `dir`, reloading the nodes below
+func iterMove(iter *BIter, level int, dir int) bool {
+	node := iter.path[level]
+	pos := int(iter.pos[level]) + dir
+	if pos < 0 || pos >= int(node.nkeys()) {
+		if level == 0 || !iterMove(iter, level-1, dir) {
+			return false
+		}
+		node = iter.path[level]
+		pos = 0
+		if dir < 0 {
+			pos = int(node.nkeys()) - 1
+		}
+	}
+	iter.pos[level] = uint16(pos)
+	if level+1 < len(iter.path) {
+		kid := iter.tree.node(node.getPtr(uint16(pos)))
+		iter.path[level+1] = kid
+	}
+	return true
+}
+
+// the empty key inserted with the root is not a user key
+func (iter *BIter) isSentinel() bool {
+	for _, pos := range iter.pos {
+		if pos != 0 {
+			return false
+		}
+	}
+	return len(iter.path) > 0
+}
+
+// calls `fn` for keys in [start, end) in order until it returns false,
+// nil `end` means up to the last key.
+func (tree *BT) Scan(start, end []byte, fn func(key, val []byte) bool) {
+	for iter := tree.Seek(start); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			return
+		}
+		if !fn(key, val) {
+			return
+		}
+	}
+}
+
+// number of keys in [start, end), nil `end` means up to the last key. the
+// difference of the ranks of the bounds, O(height) with the counts of the
+// branch nodes: a range isn't iterated to be counted.
+func (tree *BT) Count(start, end []byte) int {
+	n := tree.Rank(end)
+	if end == nil {
+		n = tree.size()
+	}
+	return max(n-tree.Rank(start), 0)
+}
+
+// the number of keys
+func (tree *BT) size() int {
+	if tree.root == 0 {
+		return 0
+	}
+	root := tree.node(tree.root)
+	n, ok := nodeCount(root)
+	if !ok {
+		for i := uint16(0); i < root.nkeys(); i++ {
+			n += kidCount(tree, root, i)
+		}
+	}
+	return int(n) - 1 // the empty key inserted with the root
+}
+
+// number of keys less than `key`, the position `key` has or would have in
+// the order. O(height) with the counts of the branch nodes, see nodeCount.
+func (tree *BT) Rank(key []byte) int {
+	if tree.root == 0 || len(key) == 0 {
+		return 0
+	}
+	n := uint64(0)
+	for ptr := tree.root; ; {
+		node := tree.node(ptr)
+		idx := nodeLookupLE(node, key)
+		if node.btype() == BN_LEAF {
+			n += uint64(idx)
+			if bytes.Compare(node.getKey(idx), key) < 0 {
+				n++
+			}
+			break
+		}
+		for i := uint16(0); i < idx; i++ {
+			n += kidCount(tree, node, i)
+		}
+		ptr = node.getPtr(idx)
+	}
+	return int(n) - 1 // the empty key inserted with the root
+}
+
+// iterator at the key of rank `i`, the first one is 0. not valid past
+// the last key.
+func (tree *BT) SelectNth(i int) *BIter {
+	iter := &BIter{tree: tree}
+	if i < 0 {
+		return iter
+	}
+	rest := uint64(i) + 1 // past the empty key
+	for ptr := tree.root; ptr != 0; {
+		node := tree.node(ptr)
+		nkeys := node.nkeys()
+		idx := uint16(0)
+		if node.btype() == BN_LEAF {
+			if rest >= uint64(nkeys) {
+				return &BIter{tree: tree}
+			}
+			idx, ptr = uint16(rest), 0
+		} else {
+			for ; idx < nkeys; idx++ {
+				n := kidCount(tree, node, idx)
+				if rest < n {
+					break
+				}
+				rest -= n
+			}
+			if idx == nkeys {
+				return &BIter{tree: tree}
+			}
+			ptr = node.getPtr(idx)
+		}
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+	}
+	return iter
+}
+
+// the pairs of the subtree of the kid `idx` of a branch node, walked if
+// the node has no counts
+func kidCount(tree *BT, node BN, idx uint16) uint64 {
+	if node.counted() {
+		return binary.LittleEndian.Uint64(node.getVal(idx))
+	}
+	kid := tree.node(node.getPtr(idx))
+	if n, ok := nodeCount(kid); ok {
+		return n
+	}
+	n := uint64(0)
+	for i := uint16(0); i < kid.nkeys(); i++ {
+		n += kidCount(tree, kid, i)
+	}
+	return n
+}
+
+// splits [start, end) into up to `n` sub-ranges by separator keys of the
+// internal nodes, and scans them concurrently. `fn` is called concurrently
+// for different shards, calls for a shard are ordered and shards are
+// ordered by `shard`. the first error stops the scan, the first panic of a
+// shard stops it too and goes on in the caller.
+func (tree *BT) ScanParallel(start, end []byte, n int, fn func(shard int, key, val []byte) error) error {
+	bounds := [][]byte{start}
+	bounds = append(bounds, splitKeys(tree, start, end, n)...)
+	bounds = append(bounds, end)
+
+	var (
+		wg      sync.WaitGroup
+		stopped atomic.Bool
+		once    sync.Once
+		failed  error
+		panics  sync.Once
+		value   any
+	)
+	for i := 0; i+1 < len(bounds); i++ {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					panics.Do(func() { value = r })
+					stopped.Store(true)
+				}
+			}()
+			tree.Scan(bounds[shard], bounds[shard+1], func(key, val []byte) bool {
+				if stopped.Load() {
+					return false
+				}
+				if err := fn(shard, key, val); err != nil {
+					once.Do(func() { failed = err })
+					stopped.Store(true)
+					return false
+				}
+				return true
+			})
+		}(i)
+	}
+	wg.Wait()
+	if value != nil {
+		panic(value)
+	}
+	return failed
+}
+
+// up to n-1 increasing keys inside of (start, end), taken from the highest
+// level of the tree that has enough of them in the range.
+func splitKeys(tree *BT, start, end []byte, n int) [][]byte {
+	if tree.root == 0 || n <= 1 {
+		return nil
+	}
+	inside := func(key []byte) bool {
+		return bytes.Compare(key, start) > 0 && (end == nil || bytes.Compare(key, end) < 0)
+	}
+
+	level := []BN{tree.node(tree.root)}
+	var keys [][]byte
+	for len(level) > 0 {
+		keys = keys[:0]
+		var next []BN
+		for _, node := range level {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				key := node.getKey(i)
+				if inside(key) {
+					keys = append(keys, key)
+				}
+				if node.btype() != BN_NODE {
+					continue
+				}
+				// the kid covers [key, next key)
+				if end != nil && bytes.Compare(key, end) >= 0 {
+					continue
+				}
+				if i+1 < node.nkeys() && bytes.Compare(node.getKey(i+1), start) <= 0 {
+					continue
+				}
+				next = append(next, tree.node(node.getPtr(i)))
+			}
+		}
+		if len(keys) >= n-1 {
+			break
+		}
+		level = next
+	}
+
+	if len(keys) <= n-1 {
+		return keys
+	}
+	picked := make([][]byte, 0, n-1)
+	for i := 1; i < n; i++ {
+		picked = append(picked, keys[i*len(keys)/n])
+	}
+	return picked
+}
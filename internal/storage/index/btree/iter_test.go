@@ -0,0 +1,354 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func sortedKeys(ref map[string]string) []string {
+	keys := make([]string, 0, len(ref))
+	for k := range ref {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestIterForwardBackward(t *testing.T) {
+	c := NewC()
+	for i := 0; i < 2000; i++ {
+		c.add(fmt.Sprintf("key_%05d", i), fmt.Sprintf("val_%d", i))
+	}
+	keys := sortedKeys(c.ref)
+
+	i := 0
+	for iter := c.tree.Seek(nil); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if string(key) != keys[i] || string(val) != c.ref[keys[i]] {
+			t.Fatalf("iter[%d] = %q, %q; want %q", i, key, val, keys[i])
+		}
+		i++
+	}
+	if i != len(keys) {
+		t.Fatalf("iterated %d keys; want %d", i, len(keys))
+	}
+
+	i = len(keys) - 1
+	for iter := c.tree.SeekLE([]byte("zzz")); iter.Valid(); iter.Prev() {
+		key, _ := iter.Deref()
+		if string(key) != keys[i] {
+			t.Fatalf("reverse iter[%d] = %q; want %q", i, key, keys[i])
+		}
+		i--
+	}
+	if i != -1 {
+		t.Fatalf("reverse iteration stopped at %d", i)
+	}
+}
+
+func TestIterSeek(t *testing.T) {
+	c := NewC()
+	for i := 0; i < 500; i++ {
+		c.add(fmt.Sprintf("key_%05d", i*2), "val")
+	}
+
+	iter := c.tree.Seek([]byte("key_00011"))
+	if key, _ := iter.Deref(); string(key) != "key_00012" {
+		t.Fatalf("Seek(key_00011) = %q; want key_00012", key)
+	}
+	iter = c.tree.Seek([]byte("key_00012"))
+	if key, _ := iter.Deref(); string(key) != "key_00012" {
+		t.Fatalf("Seek(key_00012) = %q; want key_00012", key)
+	}
+	iter = c.tree.SeekLE([]byte("key_00011"))
+	if key, _ := iter.Deref(); string(key) != "key_00010" {
+		t.Fatalf("SeekLE(key_00011) = %q; want key_00010", key)
+	}
+	if iter := c.tree.Seek([]byte("zzz")); iter.Valid() {
+		t.Fatal("Seek past the last key is valid")
+	}
+	if iter := c.tree.SeekLE([]byte("a")); iter.Valid() {
+		t.Fatal("SeekLE before the first key is valid")
+	}
+	if iter := c.tree.Seek([]byte("a")); !iter.Valid() {
+		t.Fatal("Seek before the first key is not valid")
+	}
+}
+
+func TestScanRange(t *testing.T) {
+	c := NewC()
+	for i := 0; i < 1000; i++ {
+		c.add(fmt.Sprintf("key_%04d", i), "val")
+	}
+
+	var got []string
+	c.tree.Scan([]byte("key_0100"), []byte("key_0200"), func(key, val []byte) bool {
+		got = append(got, string(key))
+		return true
+	})
+	if len(got) != 100 || got[0] != "key_0100" || got[99] != "key_0199" {
+		t.Fatalf("Scan(key_0100, key_0200) = %d keys [%s..]", len(got), got[0])
+	}
+
+	n := 0
+	c.tree.Scan(nil, nil, func(key, val []byte) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("Scan stopped after %d keys; want 10", n)
+	}
+}
+
+func TestCount(t *testing.T) {
+	c := NewC()
+	if n := c.tree.Count(nil, nil); n != 0 {
+		t.Fatalf("Count() of an empty tree = %d", n)
+	}
+	for i := 0; i < 5000; i += 2 {
+		c.add(fmt.Sprintf("key_%04d", i), "val")
+	}
+	// counted like a scan
+	for _, r := range [][2]string{
+		{"", ""}, {"key_0100", "key_0200"}, {"key_0101", "key_0199"}, {"key_4000", ""},
+		{"a", "key_0010"}, {"key_0500", "key_0500"}, {"key_0600", "key_0500"}, {"z", ""},
+		{"key_1234", "key_3457"},
+	} {
+		var end []byte
+		if r[1] != "" {
+			end = []byte(r[1])
+		}
+		want := 0
+		c.tree.Scan([]byte(r[0]), end, func(key, val []byte) bool {
+			want++
+			return true
+		})
+		if got := c.tree.Count([]byte(r[0]), end); got != want {
+			t.Fatalf("Count(%q, %q) = %d; want %d", r[0], r[1], got, want)
+		}
+	}
+	if n := c.tree.Count(nil, nil); n != 2500 {
+		t.Fatalf("Count() = %d; want 2500", n)
+	}
+}
+
+// Rank and SelectNth agree with the sorted keys of the reference
+func checkRanks(t *testing.T, c *C) {
+	t.Helper()
+	keys := sortedKeys(c.ref)
+	for i, key := range keys {
+		if got := c.tree.Rank([]byte(key)); got != i {
+			t.Fatalf("Rank(%q) = %d; want %d", key, got, i)
+		}
+		// between two keys
+		if got := c.tree.Rank([]byte(key + "\x00")); got != i+1 {
+			t.Fatalf("Rank(%q) = %d; want %d", key+"\x00", got, i+1)
+		}
+		iter := c.tree.SelectNth(i)
+		if !iter.Valid() {
+			t.Fatalf("SelectNth(%d) isn't valid", i)
+		}
+		if got, _ := iter.Deref(); string(got) != key {
+			t.Fatalf("SelectNth(%d) = %q; want %q", i, got, key)
+		}
+	}
+	if iter := c.tree.SelectNth(len(keys)); iter.Valid() {
+		t.Fatalf("SelectNth(%d) past the last key is valid", len(keys))
+	}
+	if n := c.tree.Rank([]byte("\xff")); n != len(keys) {
+		t.Fatalf("Rank() past the last key = %d; want %d", n, len(keys))
+	}
+}
+
+func TestRankSelect(t *testing.T) {
+	c := NewC()
+	if n := c.tree.Rank([]byte("a")); n != 0 {
+		t.Fatalf("Rank() of an empty tree = %d", n)
+	}
+	if c.tree.SelectNth(0).Valid() {
+		t.Fatal("SelectNth() of an empty tree is valid")
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 6000; i++ {
+		key := fmt.Sprintf("key_%05d", r.Intn(8000))
+		if r.Intn(4) == 0 {
+			c.tree.Delete([]byte(key))
+			delete(c.ref, key)
+		} else {
+			c.add(key, strings.Repeat("v", r.Intn(100)))
+		}
+	}
+	verifyTreeStructure(t, c)
+	checkRanks(t, c)
+
+	// the branch nodes of a file from before the counts
+	for _, node := range c.pages {
+		if !node.counted() {
+			continue
+		}
+		old := BN(make([]byte, BT_PAGE_SIZE))
+		old.setHeader(BN_NODE, node.nkeys())
+		for i := uint16(0); i < node.nkeys(); i++ {
+			nodeAppendKV(old, i, node.getPtr(i), node.getKey(i), nil)
+		}
+		copy(node, old[:old.nbytes()]) // in place, the pages are keyed by address
+	}
+	checkRanks(t, c)
+	if n := c.tree.Count(nil, nil); n != len(c.ref) {
+		t.Fatalf("Count() without the counts = %d; want %d", n, len(c.ref))
+	}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key_%05d", r.Intn(8000))
+		if r.Intn(4) == 0 {
+			c.tree.Delete([]byte(key))
+			delete(c.ref, key)
+		} else {
+			c.add(key, "v")
+		}
+	}
+	verifyTreeStructure(t, c)
+	checkRanks(t, c)
+}
+
+func TestTxRankSelect(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	tx := db.Begin()
+	b, err := tx.CreateBucket([]byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10000; i++ {
+		tx.Set([]byte(fmt.Sprintf("key_%06d", i)), []byte("val"))
+		b.Set([]byte(fmt.Sprintf("key_%06d", i*2)), []byte("val"))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx = db.BeginRead()
+	defer tx.Rollback()
+	if n := tx.Rank([]byte("key_001234")); n != 1234 {
+		t.Fatalf("Rank() = %d; want 1234", n)
+	}
+	iter := tx.SelectNth(9000)
+	for i := 9000; i < 9003; i++ {
+		key, _ := iter.Deref()
+		if want := fmt.Sprintf("key_%06d", i); string(key) != want {
+			t.Fatalf("key %q; want %q", key, want)
+		}
+		iter.Next()
+	}
+	b = tx.Bucket([]byte("b"))
+	if n := b.Rank([]byte("key_001235")); n != 618 {
+		t.Fatalf("bucket Rank() = %d; want 618", n)
+	}
+	if key, ok := b.SelectNth(618); !ok || string(key) != "key_001236" {
+		t.Fatalf("bucket SelectNth() = %q, %v", key, ok)
+	}
+	if n := b.Count([]byte("key_000100"), []byte("key_000200")); n != 50 {
+		t.Fatalf("bucket Count() = %d; want 50", n)
+	}
+	if _, ok := b.SelectNth(10000); ok {
+		t.Fatal("bucket SelectNth() past the last key")
+	}
+	if report, err := Check(db.Path); err != nil || !report.OK() {
+		t.Fatalf("Check() = %+v, %v", report, err)
+	}
+}
+
+func TestScanParallel(t *testing.T) {
+	c := NewC()
+	for i := 0; i < 20000; i++ {
+		c.add(fmt.Sprintf("key_%06d", i), fmt.Sprintf("val_%d", i))
+	}
+
+	for _, shards := range []int{1, 2, 4, 16} {
+		start, end := []byte("key_001000"), []byte("key_019000")
+
+		var mu sync.Mutex
+		results := map[int][][]byte{}
+		err := c.tree.ScanParallel(start, end, shards, func(shard int, key, val []byte) error {
+			mu.Lock()
+			results[shard] = append(results[shard], key)
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) > shards {
+			t.Fatalf("%d shards; want at most %d", len(results), shards)
+		}
+		if shards > 1 && len(results) < 2 {
+			t.Fatalf("the range was not split into %d shards", shards)
+		}
+
+		// merged shards are the whole range in order
+		var merged [][]byte
+		for i := 0; i < shards; i++ {
+			merged = append(merged, results[i]...)
+		}
+		if len(merged) != 18000 {
+			t.Fatalf("%d shards: scanned %d keys; want 18000", shards, len(merged))
+		}
+		for i := 1; i < len(merged); i++ {
+			if bytes.Compare(merged[i-1], merged[i]) >= 0 {
+				t.Fatalf("%d shards: keys out of order: %q, %q", shards, merged[i-1], merged[i])
+			}
+		}
+	}
+}
+
+func TestScanParallelError(t *testing.T) {
+	c := NewC()
+	for i := 0; i < 5000; i++ {
+		c.add(fmt.Sprintf("key_%06d", i), "val")
+	}
+
+	stop := errors.New("stop")
+	err := c.tree.ScanParallel(nil, nil, 4, func(shard int, key, val []byte) error {
+		if string(key) == "key_002500" {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Fatalf("ScanParallel() = %v; want %v", err, stop)
+	}
+}
+
+func TestTxScanParallel(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	tx := db.Begin()
+	for i := 0; i < 10000; i++ {
+		tx.Set([]byte(fmt.Sprintf("key_%06d", i)), []byte("val"))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx = db.BeginRead()
+	defer tx.Rollback()
+	var mu sync.Mutex
+	count := 0
+	err := tx.ScanParallel(nil, nil, 8, func(shard int, key, val []byte) error {
+		mu.Lock()
+		count++
+		mu.Unlock()
+		return nil
+	})
+	if err != nil || count != 10000 {
+		t.Fatalf("ScanParallel() = %v, %d keys; want nil, 10000", err, count)
+	}
+}
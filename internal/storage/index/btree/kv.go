@@ -3,27 +3,50 @@ package btree
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
 	"syscall"
-
-	"golang.org/x/sys/unix"
+	"time"
 )
 
 const (
-	DB_SIG  = "mydb000000000000"
-	FREE_LIST_HEADER = 8
-	FREE_LIST_CAP = (BT_PAGE_SIZE - FREE_LIST_HEADER) / 8
+	DB_SIG           = "mydb000000000001"
+	META_SIZE        = 96
+	FREE_LIST_HEADER = 20
+	FREE_LIST_CAP    = (BT_PAGE_SIZE - FREE_LIST_HEADER) / 8
+
+	DEFAULT_FLUSH_INTERVAL = 10 * time.Millisecond
+	DEFAULT_SWEEP_BATCH    = 1000
+	IOV_MAX                = 1024
 )
 
-// freeList node
-// | next | pointers |
-// |  8B  |   n*8B   |
+// freeList node, `seq` is at the same place as in B-tree nodes, see pageSeq
+// | unused | seq | next | pointers |
+// |   4B   | 8B  |  8B  |   n*8B   |
 type LNode []byte
 
-func (node LNode) getNext() uint64
-func (node LNode) setNext(next uint64)
-func (node LNode) getPtr(idx int) uint64
-func (node LNode) setPtr(idx int, ptr uint64)
+func (node LNode) getNext() uint64 {
+	return binary.LittleEndian.Uint64(node[12:20])
+}
+
+func (node LNode) setNext(next uint64) {
+	binary.LittleEndian.PutUint64(node[12:20], next)
+}
+
+func (node LNode) getPtr(idx int) uint64 {
+	pos := FREE_LIST_HEADER + 8*idx
+	return binary.LittleEndian.Uint64(node[pos:])
+}
+
+func (node LNode) setPtr(idx int, ptr uint64) {
+	pos := FREE_LIST_HEADER + 8*idx
+	binary.LittleEndian.PutUint64(node[pos:], ptr)
+}
 
 type FreeList struct {
 	get func(uint64) []byte
@@ -31,10 +54,10 @@ type FreeList struct {
 	set func(uint64) []byte // copies a page and returns bytes that we can change. cant use get for this, because mmpa return read only
 
 	headPage uint64
-	headSeq uint64 // seq from what we can read
+	headSeq  uint64 // seq from what we can read
 	tailPage uint64
-	tailSeq uint64 // seq to what we can read
-	maxSeq uint64 // tailSeq snapshot to prevect consuming new items
+	tailSeq  uint64 // seq to what we can read
+	maxSeq   uint64 // tailSeq snapshot to prevect consuming new items
 }
 
 func seq2idx(seq uint64) int {
@@ -65,7 +88,7 @@ func (fl *FreeList) PushTail(ptr uint64) {
 		}
 		LNode(fl.set(fl.tailPage)).setNext(next)
 		fl.tailPage = next
-		
+
 		if head != 0 {
 			LNode(fl.set(fl.tailPage)).setPtr(0, head)
 			fl.tailSeq++
@@ -73,6 +96,7 @@ func (fl *FreeList) PushTail(ptr uint64) {
 	}
 }
 
+// removes an item from the head, `head` is the consumed list node if any
 func flPop(fl *FreeList) (ptr uint64, head uint64) {
 	if fl.headSeq == fl.maxSeq {
 		return 0, 0
@@ -82,171 +106,689 @@ func flPop(fl *FreeList) (ptr uint64, head uint64) {
 	fl.headSeq++
 	if seq2idx(fl.headSeq) == 0 {
 		head, fl.headPage = fl.headPage, node.getNext()
-		assert(fl.headPage != 0)
+		if fl.headPage == 0 {
+			fault(head, "the free list ends before item %d", fl.headSeq)
+		}
 	}
-	return ptr, fl.headPage
+	return ptr, head
 }
 
 type KV struct {
 	Path string
-	fd   int
-	tree BT
-	mmap struct {
-		total int           // mmap size, can be larger then file
-		chunks [][]byte     // mmaps can be non-continuous
+	// Set/Del return once the update is applied in memory,
+	// the committer flushes queued updates every FlushInterval
+	Async         bool
+	FlushInterval time.Duration
+	// expired keys of TTL families are swept every SweepInterval,
+	// up to SweepBatch keys per bucket, zero disables the sweeper
+	SweepInterval time.Duration
+	SweepBatch    int
+	// the clock of key expiration, time.Now if nil
+	Now func() time.Time
+	// the database follows a leader, see Apply. writes fail with ErrReplica.
+	Replica bool
+	// write transactions log their changes, see Changes
+	Changefeed bool
+	// committed write transactions are recorded in a file, see AuditLog
+	Audit *AuditLog
+	// the file is written by another process, see Refresh. writes fail
+	// with ErrReadOnly. new versions are read every RefreshInterval.
+	ReadOnly        bool
+	RefreshInterval time.Duration
+	// receives the counters of the engine, see Metrics
+	Metrics Metrics
+	// receives the events of the engine, see log.go. batches of commits
+	// slower than SlowCommit are logged, off if zero.
+	Logger     *slog.Logger
+	SlowCommit time.Duration
+	// callbacks of structural events, see Events
+	Events *Events
+	// pages are read into a buffer pool of about PoolPages pages instead of
+	// mapping the file, see bufferPool. not with ReadOnly.
+	PoolPages int
+	// leaves get Bloom filters of BloomBits bits per key in memory, lookups
+	// of missing keys mostly skip the leaf, see leafFilters. not with
+	// ReadOnly.
+	BloomBits int
+	// pages read per second by Scrub, no limit if zero
+	ScrubRate int
+	// pages written in place are written to Path+".dw" first, see
+	// doublewrite.go
+	DoubleWrite bool
+	// the pages of every batch are checked before its meta page is written,
+	// the committer panics on a problem. for debugging, see checkcommit.go
+	CheckCommits bool
+	// the values returned by transactions are poisoned when they end, for
+	// debugging, see view.go
+	PoisonViews bool
+	// commits skip their fsyncs: a crash can lose the last commits or
+	// break the file. for data that can be rebuilt, like a cache or a test
+	NoSync bool
+	// the size of the pages, 0 or BT_PAGE_SIZE: the only one for now
+	PageSize int
+	// the largest keys and values, set when the file is created and kept in
+	// its meta page. 0 for the ones of the file, BT_MAX_KEY_SIZE and
+	// BT_MAX_VAL_SIZE for a new one. a pair must fit a page, see
+	// BT_MAX_PAIR_SIZE. Open sets them.
+	MaxKeySize   int
+	MaxValueSize int
+	// the bytes of the file and so of its mmap, a batch that would grow it
+	// past fails with ErrDatabaseFull. no limit if zero
+	MmapLimit int64
+
+	fd      int
+	dwfd    int // the double-write file, -1 without DoubleWrite
+	corrupt struct {
+		sync.Mutex
+		pages map[uint64]*PageError // see Corrupted
+	}
+	tree    BT
+	catalog BT // bucket path -> bucket record
+	mmap    struct {
+		total   int      // mmap size, can be larger then file
+		chunks  [][]byte // mmaps can be non-continuous
+		retired [][]byte // mmaps of files replaced by Restore
+	}
+	pool struct {
+		cur     *bufferPool   // with PoolPages, instead of the mmap
+		retired []*bufferPool // of files replaced by Restore, their fd is open
 	}
 	page struct {
-		flushed uint64  // db size in number of pages
-		temp [][]byte   // newly allocated pages
+		flushed  uint64            // db size in number of pages, including pages being written
+		nappend  uint64            // number of pages to be appended
+		updates  map[uint64][]byte // pending updates, including appended pages
+		flushing map[uint64][]byte // updates being written by the committer
+		fresh    map[uint64]bool   // pages allocated by the write transaction, see pageFree
+		recycled []uint64          // fresh pages freed again, reused first
+	}
+	filters *leafFilters // with BloomBits
+	arena   nodeArena    // node buffers of the writer, with mu
+	failed  bool
+	free    FreeList
+	seq     uint64 // commit sequence of the last write transaction
+	applied uint64 // the last command applied, see ApplyCommand
+
+	mu    sync.Mutex // the single writer: serializes updates and staging
+	queue struct {
+		staged  []byte       // meta page of the last staged batch
+		flying  []*flight    // staged and not finished, of the committer
+		waiters []chan error // updates applied in memory and not staged yet
+		changes []change     // changes of the waiters for watchers
+		audit   []AuditRecord
+	}
+	kick    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+	sweep   struct {
+		stop    chan struct{}
+		stopped chan struct{}
+	}
+
+	// read transactions run against the mmap without db.mu
+	rmu       sync.Mutex
+	version   uint64         // number of durable updates since open
+	durable   []byte         // meta page of the last durable version
+	readers   map[uint64]int // version -> number of active readers
+	ended     *sync.Cond     // a version has no readers anymore
+	epochs    []epoch        // free list positions of versions still visible to readers
+	replicas  map[*Replication]struct{}
+	committed chan struct{} // closed by the next durable version, for feeds
+	feeds     sync.WaitGroup
+
+	shared struct {
+		fd      int    // the readers file
+		slot    int64  // the slot of a read only process
+		pinned  uint64 // the commit sequence in the slot
+		stopped chan struct{}
+	}
+
+	watch struct {
+		mu       sync.Mutex
+		watchers map[*Watcher]struct{}
+		n        atomic.Int32
 	}
-	failed bool
-	free FreeList
+
+	counts    writeCounts                   // of the writer for Metrics, with mu
+	logger    *slog.Logger                  // Logger with the path
+	commitErr atomic.Pointer[error]         // of the last batch, nil if durable, see Health
+	internal  atomic.Pointer[InternalError] // the first one, see Failed
+}
+
+// free list items pushed up to `seq` were freed by the update that produced
+// `version`, with the commit sequence `commit`
+type epoch struct {
+	version uint64
+	seq     uint64
+	commit  uint64
 }
 
 func (db *KV) Open() error {
+	if err := db.validate(); err != nil {
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	db.page.updates = map[uint64][]byte{}
+	db.page.fresh = map[uint64]bool{}
+	db.readers = map[uint64]int{}
+	db.ended = sync.NewCond(&db.rmu)
+	db.replicas = map[*Replication]struct{}{}
+	db.committed = make(chan struct{})
+	if db.Logger != nil {
+		db.logger = db.Logger.With("db", db.Path)
+	}
+	db.counts.events = db.Events
+	db.dwfd = -1
+
 	db.tree.get = db.pageRead
 	db.tree.new = db.pageAlloc
-	db.tree.del = db.free.PushTail
-	
+	db.tree.del = db.pageFree
+	db.tree.counts = &db.counts
+	db.tree.arena = &db.arena
+	db.catalog = db.bucketTree(0)
+
 	db.free.get = db.pageRead
 	db.free.new = db.pageAppend
 	db.free.set = db.pageWrite
+
+	var err error
+	if db.ReadOnly {
+		err = db.openShared()
+	} else {
+		db.fd, err = createFileSync(db.Path)
+		if err == nil {
+			err = db.openDoubleWrite()
+		}
+		if err == nil {
+			err = db.openReaders()
+		}
+	}
+	if err != nil {
+		db.close()
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	if db.PoolPages > 0 {
+		db.pool.cur = newBufferPool(db.fd, db.PoolPages)
+	}
+	if db.BloomBits > 0 {
+		db.filters = newLeafFilters(db.BloomBits)
+		db.tree.filters = db.filters
+		db.catalog.filters = db.filters
+	}
+
+	finfo := syscall.Stat_t{}
+	if err = syscall.Fstat(db.fd, &finfo); err != nil {
+		db.close()
+		return fmt.Errorf("KV.Open: stat: %w", err)
+	}
+	if err = extendMmap(db, int(finfo.Size)); err != nil {
+		db.close()
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	if err = readRoot(db, finfo.Size); err != nil {
+		db.close()
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	db.durable = saveMeta(db)
+	db.epochs = []epoch{{version: db.version, seq: db.free.tailSeq, commit: db.seq}}
+	db.queue.staged = db.durable
+	if db.Audit != nil && !db.ReadOnly {
+		if err = db.Audit.open(); err != nil {
+			db.close()
+			return fmt.Errorf("KV.Open: %w", err)
+		}
+	}
+
+	if db.FlushInterval <= 0 {
+		db.FlushInterval = DEFAULT_FLUSH_INTERVAL
+	}
+	db.kick = make(chan struct{}, 1)
+	db.stop = make(chan struct{})
+	db.stopped = make(chan struct{})
+	go db.committer()
+	if db.ReadOnly {
+		if db.RefreshInterval <= 0 {
+			db.RefreshInterval = DEFAULT_REFRESH_INTERVAL
+		}
+		if err := db.Refresh(); err != nil {
+			db.Close()
+			return fmt.Errorf("KV.Open: %w", err)
+		}
+		db.shared.stopped = make(chan struct{})
+		go db.refresher()
+	}
+	if db.SweepInterval > 0 && !db.Replica && !db.ReadOnly {
+		if db.SweepBatch <= 0 {
+			db.SweepBatch = DEFAULT_SWEEP_BATCH
+		}
+		db.sweep.stop = make(chan struct{})
+		db.sweep.stopped = make(chan struct{})
+		go db.sweeper()
+	}
+	return nil
 }
 
-func (db *KV) Get(key []byte, val []byte) ([]byte, bool) {
-	return db.tree.Get(key)
+// flushes queued updates and releases resources.
+// transactions must be finished before. a second Close returns ErrNotOpen.
+func (db *KV) Close() error {
+	if errors.Is(db.Health(), ErrNotOpen) {
+		return fmt.Errorf("KV.Close: %w", ErrNotOpen)
+	}
+	if db.sweep.stop != nil {
+		close(db.sweep.stop)
+		<-db.sweep.stopped
+	}
+	close(db.stop)
+	<-db.stopped
+	if db.shared.stopped != nil {
+		<-db.shared.stopped
+	}
+	db.feeds.Wait()
+	db.closeWatchers()
+	db.closeReplicas()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.close()
+	if db.Audit != nil {
+		if err := db.Audit.close(); err != nil {
+			return fmt.Errorf("KV.Close: %w", err)
+		}
+	}
+	if err := db.Failed(); err != nil {
+		return fmt.Errorf("KV.Close: %w", err)
+	}
+	if db.failed {
+		return errors.New("KV.Close: last commit failed")
+	}
+	return nil
 }
 
-func (db *KV) Set(key []byte, val []byte) (error) {
-	meta := saveMeta(db)
-	db.tree.Insert(key, val)
-	return updateOrRevert(db, meta)
+func (db *KV) close() {
+	for _, chunk := range append(db.mmap.chunks, db.mmap.retired...) {
+		err := syscall.Munmap(chunk)
+		assert(err == nil)
+	}
+	db.mmap.chunks = nil
+	db.mmap.retired = nil
+	db.mmap.total = 0
+	for _, pool := range db.pool.retired {
+		_ = syscall.Close(pool.fd)
+	}
+	db.pool.cur = nil
+	db.pool.retired = nil
+	_ = syscall.Close(db.fd)
+	if db.dwfd >= 0 {
+		_ = syscall.Close(db.dwfd)
+		db.dwfd = -1
+	}
+	db.closeReaders()
+}
+
+// open or create a file and fsync the directory
+func createFileSync(file string) (int, error) {
+	flags := os.O_RDONLY | syscall.O_DIRECTORY
+	dirfd, err := syscall.Open(path.Dir(file), flags, 0o644)
+	if err != nil {
+		return -1, fmt.Errorf("open directory: %w", err)
+	}
+	defer syscall.Close(dirfd)
+
+	flags = os.O_RDWR | os.O_CREATE
+	fd, err := syscall.Openat(dirfd, path.Base(file), flags, 0o644)
+	if err != nil {
+		return -1, fmt.Errorf("open file: %w", err)
+	}
+	if err = syscall.Fsync(dirfd); err != nil {
+		_ = syscall.Close(fd)
+		return -1, fmt.Errorf("fsync directory: %w", err)
+	}
+	return fd, nil
+}
+
+// a corrupted page is quarantined and the key is not found, see fault.
+// the value is a copy, the page can change once db.mu is released.
+func (db *KV) Get(key []byte) ([]byte, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer db.catch("Get", nil)
+	val, ok := db.tree.Get(key)
+	return bytes.Clone(val), ok
+}
+
+// calls `fn` for every key of a read transaction, see Tx.ForEach
+func (db *KV) ForEach(fn func(key, val []byte) error) error {
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	return tx.ForEach(fn)
+}
+
+// ForEach of the top-level bucket `name`, ErrBucketNotFound if there is none
+func (db *KV) ForEachIn(name []byte, fn func(key, val []byte) error) error {
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	b := tx.Bucket(name)
+	if b == nil {
+		return ErrBucketNotFound
+	}
+	return b.ForEach(fn)
+}
+
+func (db *KV) Set(key []byte, val []byte) error {
+	done := db.SetAsync(key, val)
+	if db.Async {
+		return failed(done)
+	}
+	return <-done
 }
 
 func (db *KV) Del(key []byte) (bool, error) {
-	deleted := db.tree.Delete(key)
-	return deleted, updateFile(db)
+	deleted, done := db.DelAsync(key)
+	if db.Async {
+		return deleted, failed(done)
+	}
+	return deleted, <-done
+}
+
+// the error of an update that failed before it was queued, nil if queued
+func failed(done <-chan error) error {
+	select {
+	case err := <-done:
+		return err
+	default:
+		return nil
+	}
+}
+
+// applies the update in memory and queues it for the committer,
+// the channel receives the result once the update is durable.
+func (db *KV) SetAsync(key []byte, val []byte) <-chan error {
+	tx := db.Begin()
+	if err := tx.Set(key, val); err != nil {
+		return tx.fail(err)
+	}
+	return tx.commit()
+}
+
+func (db *KV) DelAsync(key []byte) (bool, <-chan error) {
+	tx := db.Begin()
+	deleted, err := tx.Del(key)
+	if err != nil {
+		return false, tx.fail(err)
+	}
+	return deleted, tx.commit()
+}
+
+// waits until everything queued so far is durable
+func (db *KV) Sync() error {
+	if db.Replica || db.ReadOnly {
+		return nil // Apply is durable
+	}
+	db.mu.Lock()
+	done := enqueue(db)
+	db.mu.Unlock()
+	return <-done
 }
 
 // read a page, `ptr` is a number of the page of BTree
 func (db *KV) pageRead(ptr uint64) []byte {
+	if node, ok := db.page.updates[ptr]; ok {
+		return node
+	}
+	if node, ok := db.page.flushing[ptr]; ok {
+		return node
+	}
+	return db.pageReadFile(ptr)
+}
+
+func (db *KV) pageReadFile(ptr uint64) []byte {
+	db.counts.reads++
+	if db.pool.cur != nil {
+		return db.pool.cur.get(ptr)
+	}
+	return mmapRead(db.mmap.chunks, ptr)
+}
+
+func mmapRead(chunks [][]byte, ptr uint64) []byte {
 	start := uint64(0)
-	for _, chunk := range db.mmap.chunks {
-		end := start + uint64(len(chunk)) / BT_PAGE_SIZE
+	for _, chunk := range chunks {
+		end := start + uint64(len(chunk))/BT_PAGE_SIZE
 		if ptr < end {
 			offset := BT_PAGE_SIZE * (ptr - start)
 			return chunk[offset : offset+BT_PAGE_SIZE]
 		}
 		start = end
 	}
-	panic("bad ptr")
+	fault(ptr, "pointer out of the file of %d pages", start)
+	return nil
 }
 
-func (db *KV) pageAlloc([]byte) uint64
+// allocate a page, reusing the pages the write transaction freed, then
+// free pages. the page drops the filter of its previous content.
+func (db *KV) pageAlloc(node []byte) uint64 {
+	if n := len(db.page.recycled); n > 0 {
+		ptr := db.page.recycled[n-1]
+		db.page.recycled = db.page.recycled[:n-1]
+		db.arena.put(db.page.updates[ptr])
+		db.page.updates[ptr] = node
+		db.filters.drop(ptr)
+		return ptr
+	}
+	ptr := db.free.PopHead()
+	if ptr != 0 {
+		db.page.updates[ptr] = node
+	} else {
+		ptr = db.pageAppend(node)
+	}
+	db.filters.drop(ptr)
+	db.page.fresh[ptr] = true
+	return ptr
+}
 
-func (db *KV) pageWrite(uint64) []byte
+// frees a page of a tree. a page the write transaction allocated is
+// reachable from nothing else, not even the transactions committed before
+// it, so the next allocation reuses it: a node updated many times by a
+// transaction is written once by its batch instead of once per update.
+// other pages go to the free list.
+func (db *KV) pageFree(ptr uint64) {
+	if db.page.fresh[ptr] {
+		db.page.recycled = append(db.page.recycled, ptr)
+		return
+	}
+	db.free.PushTail(ptr)
+}
+
+// ends the pages of the write transaction, the recycled ones left are
+// freed if it commits
+func (db *KV) endFresh(commit bool) {
+	if commit {
+		for _, ptr := range db.page.recycled {
+			db.free.PushTail(ptr)
+		}
+	}
+	clear(db.page.fresh)
+	db.page.recycled = db.page.recycled[:0]
+}
+
+// returns a writable copy of the page, the copy replaces the page on flush
+func (db *KV) pageWrite(ptr uint64) []byte {
+	if node, ok := db.page.updates[ptr]; ok {
+		return node
+	}
+	node := make([]byte, BT_PAGE_SIZE)
+	copy(node, db.pageRead(ptr))
+	db.page.updates[ptr] = node
+	return node
+}
 
 func extendMmap(db *KV, size int) error {
-	if size <= db.mmap.total {
+	if db.MmapLimit > 0 && int64(size) > db.MmapLimit {
+		return fmt.Errorf("%w: %d bytes, MmapLimit is %d", ErrDatabaseFull, size, db.MmapLimit)
+	}
+	if size <= db.mmap.total || db.pool.cur != nil {
 		return nil
 	}
 	alloc := max(db.mmap.total, 64<<20)
-	for db.mmap.total + alloc < size {
+	for db.mmap.total+alloc < size {
 		alloc *= 2
 	}
 	chunk, err := syscall.Mmap(db.fd, int64(db.mmap.total), alloc, syscall.PROT_READ, syscall.MAP_SHARED)
 	if err != nil {
 		return fmt.Errorf("mmap: %w", err)
 	}
+	db.rmu.Lock()
 	db.mmap.total += alloc
 	db.mmap.chunks = append(db.mmap.chunks, chunk)
+	db.rmu.Unlock()
 	return nil
 }
 
 func (db *KV) pageAppend(node []byte) uint64 {
-	ptr := db.page.flushed + uint64(len(db.page.temp))
-	db.page.temp = append(db.page.temp, node)
+	ptr := db.page.flushed + db.page.nappend
+	db.page.nappend++
+	db.page.updates[ptr] = node
 	return ptr
 }
 
-func updateFile(db *KV) error {
-	if err := writePages(db); err != nil {
-		return err
-	}
-	if err := syscall.Fsync(db.fd); err != nil {
-		return err
-	}
-	if err := updateRoot(db); err != nil {
-		return err
-	}
-	return syscall.Fsync(db.fd)
-}
-
-func writePages(db *KV) error {
-	size := (int(db.page.flushed) + len(db.page.temp)) * BT_PAGE_SIZE
-	if err := extendMmap(db, size); err != nil {
-		return err
-	}
-	offset := int64(db.page.flushed * BT_PAGE_SIZE)
-	if _, err := unix.Pwritev(db.fd, db.page.temp, offset); err != nil {
-		return err
-	}
-	db.page.flushed += uint64(len(db.page.temp))
-	db.page.temp = db.page.temp[:0]
-	return nil
-}
-
+// meta page
+// | sig | root | flushed | headPage | headSeq | tailPage | tailSeq | catalog | seq | applied | maxKey | maxVal |
+// | 16B |  8B  |    8B   |    8B    |    8B   |    8B    |    8B   |    8B   |  8B |   8B    |   4B   |   4B   |
+//
+// the sizes are 0 in the files from before them, for the defaults
 func saveMeta(db *KV) []byte {
-	var data [32]byte
+	var data [META_SIZE]byte
 	copy(data[:16], []byte(DB_SIG))
 	binary.LittleEndian.PutUint64(data[16:], db.tree.root)
 	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+	binary.LittleEndian.PutUint64(data[32:], db.free.headPage)
+	binary.LittleEndian.PutUint64(data[40:], db.free.headSeq)
+	binary.LittleEndian.PutUint64(data[48:], db.free.tailPage)
+	binary.LittleEndian.PutUint64(data[56:], db.free.tailSeq)
+	binary.LittleEndian.PutUint64(data[64:], db.catalog.root)
+	binary.LittleEndian.PutUint64(data[72:], db.seq)
+	binary.LittleEndian.PutUint64(data[80:], db.applied)
+	binary.LittleEndian.PutUint32(data[88:], uint32(db.MaxKeySize))
+	binary.LittleEndian.PutUint32(data[92:], uint32(db.MaxValueSize))
 	return data[:]
 }
 
 func loadMeta(db *KV, data []byte) {
-	assert(len(data) >= 32)
-	assert(!bytes.Equal(data[:16], []byte(DB_SIG)))
+	assert(len(data) >= META_SIZE)
 	db.tree.root = binary.LittleEndian.Uint64(data[16:24])
 	db.page.flushed = binary.LittleEndian.Uint64(data[24:32])
+	db.free.headPage = binary.LittleEndian.Uint64(data[32:40])
+	db.free.headSeq = binary.LittleEndian.Uint64(data[40:48])
+	db.free.tailPage = binary.LittleEndian.Uint64(data[48:56])
+	db.free.tailSeq = binary.LittleEndian.Uint64(data[56:64])
+	db.catalog.root = binary.LittleEndian.Uint64(data[64:72])
+	db.seq = binary.LittleEndian.Uint64(data[72:80])
+	db.applied = binary.LittleEndian.Uint64(data[80:88])
+	db.MaxKeySize, db.MaxValueSize = metaSizes(data)
+}
+
+// the largest keys and values of the meta page
+func metaSizes(data []byte) (int, int) {
+	maxKey := int(binary.LittleEndian.Uint32(data[88:92]))
+	maxVal := int(binary.LittleEndian.Uint32(data[92:96]))
+	if maxKey == 0 && maxVal == 0 {
+		return BT_MAX_KEY_SIZE, BT_MAX_VAL_SIZE
+	}
+	return maxKey, maxVal
 }
 
 func readRoot(db *KV, fileSize int64) error {
+	if fileSize == 0 && db.ReadOnly {
+		return errors.New("empty file")
+	}
 	if fileSize == 0 {
+		// the meta page and the first free list node
+		db.MaxKeySize, db.MaxValueSize = db.newSizes()
 		db.page.flushed = 1
+		db.free.headPage = db.pageAppend(make([]byte, BT_PAGE_SIZE))
+		db.free.tailPage = db.free.headPage
+		if err := initFile(db); err != nil {
+			return err
+		}
+		db.log().Info("created database")
 		return nil
 	}
-	data := db.mmap.chunks[0]
+	var data []byte
+	if db.pool.cur != nil {
+		// page 0 is written in place by every batch, it isn't in the pool
+		data = make([]byte, META_SIZE)
+		if _, err := syscall.Pread(db.fd, data, 0); err != nil {
+			return fmt.Errorf("read meta page: %w", err)
+		}
+	} else {
+		data = db.mmap.chunks[0]
+	}
+	if err := checkMeta(data, fileSize); err != nil {
+		db.log().Error("damaged meta page", "size", fileSize)
+		return err
+	}
+	maxKey, maxVal := metaSizes(data)
+	if db.MaxKeySize != 0 && db.MaxKeySize != maxKey || db.MaxValueSize != 0 && db.MaxValueSize != maxVal {
+		return fmt.Errorf("%w: MaxKeySize %d and MaxValueSize %d, the file has %d and %d",
+			ErrConfig, db.MaxKeySize, db.MaxValueSize, maxKey, maxVal)
+	}
 	loadMeta(db, data)
-
+	db.free.setMaxSeq()
+	db.log().Info("opened database", "seq", db.seq, "pages", db.page.flushed,
+		"free", db.free.tailSeq-db.free.headSeq, "read_only", db.ReadOnly)
+	// a failed or interrupted batch appends pages without a meta page for
+	// them, they are overwritten by the next ones
+	if extra := uint64(fileSize/BT_PAGE_SIZE) - db.page.flushed; extra > 0 && !db.ReadOnly {
+		db.log().Warn("ignoring the pages of an interrupted commit", "pages", extra)
+		if db.Events != nil && db.Events.Recovery != nil {
+			db.Events.Recovery(db.seq, extra)
+		}
+	}
 	return nil
 }
 
-func updateRoot(db *KV) error {
-	if _, err := syscall.Pwrite(db.fd, saveMeta(db), 0); err != nil {
-		return fmt.Errorf("write meta page: %w", err)
+// the largest keys and values of a new file
+func (db *KV) newSizes() (int, int) {
+	maxKey, maxVal := db.MaxKeySize, db.MaxValueSize
+	if maxKey == 0 {
+		maxKey = BT_MAX_KEY_SIZE
+	}
+	if maxVal == 0 {
+		maxVal = BT_MAX_VAL_SIZE
+	}
+	return maxKey, maxVal
+}
+
+// the problem of the largest keys and values `maxKey` and `maxVal`, nil
+// if their pairs fit the pages
+func checkSizes(maxKey, maxVal int) error {
+	switch {
+	case maxKey <= 0 || maxVal <= 0:
+		return fmt.Errorf("MaxKeySize %d and MaxValueSize %d", maxKey, maxVal)
+	case maxKey > BT_MAX_KEY_LIMIT:
+		return fmt.Errorf("MaxKeySize %d over %d", maxKey, BT_MAX_KEY_LIMIT)
+	case maxKey+maxVal > BT_MAX_PAIR_SIZE:
+		return fmt.Errorf("MaxKeySize %d and MaxValueSize %d over %d bytes", maxKey, maxVal, BT_MAX_PAIR_SIZE)
 	}
 	return nil
 }
 
-func updateOrRevert(db *KV, meta []byte) error {
-	if db.failed {
-		if _, err := syscall.Pwrite(db.fd, meta, 0); err != nil {
-			return fmt.Errorf("rewrite meta page: %w", err)
-		}
-		if err := syscall.Fsync(db.fd); err != nil {
-			return fmt.Errorf("fsync meta page: %w", err)
-		}
-		db.failed = false
+func checkMeta(data []byte, fileSize int64) error {
+	if len(data) < META_SIZE {
+		return errors.New("bad meta page")
 	}
-	err := updateFile(db)
-	if err != nil {
-		db.failed = true
-		// reverting im-memory states to allow reads
-		loadMeta(db, meta)
-		db.page.temp = db.page.temp[:0]
+	flushed := binary.LittleEndian.Uint64(data[24:32])
+	maxpages := uint64(fileSize / BT_PAGE_SIZE)
+	below := func(pos int) bool {
+		return binary.LittleEndian.Uint64(data[pos:pos+8]) < flushed
+	}
+	nonzero := func(pos int) bool {
+		return binary.LittleEndian.Uint64(data[pos:pos+8]) != 0
 	}
-	return err
+	bad := !bytes.Equal(data[:16], []byte(DB_SIG))
+	bad = bad || !(0 < flushed && flushed <= maxpages)
+	bad = bad || !below(16) || !below(64)
+	bad = bad || !(nonzero(32) && below(32))
+	bad = bad || !(nonzero(48) && below(48))
+	bad = bad || checkSizes(metaSizes(data)) != nil
+	if bad {
+		return errors.New("bad meta page")
+	}
+	return nil
 }
-
-
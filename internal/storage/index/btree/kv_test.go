@@ -0,0 +1,298 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func openKV(t *testing.T, path string) *KV {
+	t.Helper()
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open(%s): %v", path, err)
+	}
+	return db
+}
+
+func assertKV(t *testing.T, db *KV, ref map[string]string) {
+	t.Helper()
+	for k, v := range ref {
+		val, ok := db.Get([]byte(k))
+		if !ok || string(val) != v {
+			t.Fatalf("Get(%s) = %q, %v; want %s, true", k, val, ok, v)
+		}
+	}
+}
+
+func TestKVBasic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+	defer db.Close()
+
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	assertKV(t, db, map[string]string{"a": "1", "b": "2"})
+
+	deleted, err := db.Del([]byte("a"))
+	if err != nil || !deleted {
+		t.Fatalf("Del(a) = %v, %v; want true, nil", deleted, err)
+	}
+	if val, ok := db.Get([]byte("a")); ok {
+		t.Fatalf("Get(a) after delete = %q, %v; want nil, false", val, ok)
+	}
+	deleted, err = db.Del([]byte("a"))
+	if err != nil || deleted {
+		t.Fatalf("Del(a) twice = %v, %v; want false, nil", deleted, err)
+	}
+}
+
+func TestKVReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+
+	ref := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		val := fmt.Sprintf("val_%d", i)
+		if err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		ref[key] = val
+	}
+	for i := 0; i < 2000; i += 3 {
+		key := fmt.Sprintf("key_%d", i)
+		if _, err := db.Del([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		delete(ref, key)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openKV(t, path)
+	defer db.Close()
+	assertKV(t, db, ref)
+	if _, ok := db.Get([]byte("key_0")); ok {
+		t.Fatal("deleted key is found after reopen")
+	}
+}
+
+func TestKVFreeListReuse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		if err := db.Set([]byte(key), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := db.page.flushed
+
+	// updates only recycle the pages of the previous versions
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key_%d", i%100)
+		if err := db.Set([]byte(key), []byte(fmt.Sprintf("val_%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.page.flushed > before+20 {
+		t.Fatalf("file keeps growing: %d pages before, %d after", before, db.page.flushed)
+	}
+}
+
+func TestKVBadMeta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+	db.Set([]byte("a"), []byte("1"))
+	db.Close()
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("garbage"), 0)
+	f.Close()
+
+	db = &KV{Path: path}
+	if err := db.Open(); err == nil {
+		db.Close()
+		t.Fatal("Open() with a corrupted meta page succeeded")
+	}
+}
+
+func TestKVAsync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, Async: true, FlushInterval: time.Millisecond}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	ref := map[string]string{}
+	var pending []<-chan error
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		val := fmt.Sprintf("val_%d", i)
+		pending = append(pending, db.SetAsync([]byte(key), []byte(val)))
+		ref[key] = val
+	}
+	// visible before being durable
+	assertKV(t, db, ref)
+
+	for _, done := range pending {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("update was not flushed")
+		}
+	}
+
+	deleted, done := db.DelAsync([]byte("key_0"))
+	if !deleted {
+		t.Fatal("DelAsync(key_0) did not find the key")
+	}
+	delete(ref, "key_0")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Set without waiting, Close flushes it
+	if err := db.Set([]byte("last"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	ref["last"] = "x"
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openKV(t, path)
+	defer db.Close()
+	assertKV(t, db, ref)
+}
+
+func TestKVConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+
+	const writers, nkeys = 8, 200
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < nkeys; i++ {
+				key := fmt.Sprintf("w%d_key_%d", w, i)
+				if err := db.Set([]byte(key), []byte(key)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openKV(t, path)
+	defer db.Close()
+	for w := 0; w < writers; w++ {
+		for i := 0; i < nkeys; i++ {
+			key := fmt.Sprintf("w%d_key_%d", w, i)
+			if val, ok := db.Get([]byte(key)); !ok || string(val) != key {
+				t.Fatalf("Get(%s) = %q, %v", key, val, ok)
+			}
+		}
+	}
+}
+
+func TestKVDirtyPagesOnce(t *testing.T) {
+	m := &testMetrics{counters: map[string]uint64{}, gauges: map[string]float64{}, durations: map[string]int{}}
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), Metrics: m, Async: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ref := map[string]string{}
+	tx := db.Begin()
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("k%04d", i)
+		tx.Set([]byte(k), []byte(k))
+		ref[k] = k
+	}
+	tx.Commit()
+
+	// the pages of a transaction committed before are not reused by the
+	// next one, its rollback leaves them intact
+	tx = db.Begin()
+	for i := 0; i < 1000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("rolled back"))
+	}
+	tx.Rollback()
+	before := m.counters[METRIC_PAGE_WRITES]
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	assertKV(t, db, ref)
+
+	// every node on the path was rewritten per key, each page is written once
+	r := db.BeginRead()
+	stats := r.FileStats()
+	r.Rollback()
+	if writes := m.counters[METRIC_PAGE_WRITES] - before; writes > uint64(stats.TreePages)+2 {
+		t.Fatalf("%d pages written for %d pages of the tree", writes, stats.TreePages)
+	}
+}
+
+func TestWriteRuns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pages")
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_CREAT, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	pages := map[uint64][]byte{}
+	for _, ptr := range []uint64{10, 1, 3, 2, 7, 8} {
+		pages[ptr] = bytes.Repeat([]byte{byte(ptr)}, BT_PAGE_SIZE)
+	}
+	// 1-3, 7-8 and 10
+	if calls, err := writeRuns(fd, pages); err != nil || calls != 3 {
+		t.Fatalf("writeRuns() = %d, %v", calls, err)
+	}
+	data, _ := os.ReadFile(path)
+	for ptr, page := range pages {
+		if !bytes.Equal(data[ptr*BT_PAGE_SIZE:][:BT_PAGE_SIZE], page) {
+			t.Fatalf("page %d", ptr)
+		}
+	}
+
+	// runs are split at IOV_MAX pages
+	pages = map[uint64][]byte{}
+	for ptr := uint64(0); ptr < IOV_MAX+1; ptr++ {
+		pages[ptr] = make([]byte, BT_PAGE_SIZE)
+	}
+	if calls, err := writeRuns(fd, pages); err != nil || calls != 2 {
+		t.Fatalf("writeRuns() of %d pages = %d, %v", len(pages), calls, err)
+	}
+}
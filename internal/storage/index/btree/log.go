@@ -0,0 +1,41 @@
+package btree
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"time"
+)
+
+// KV.Logger receives the events of the engine, a nil Logger is silent.
+// every record has the path of the database as "db".
+//
+//   - Info: a file opened or created, a compaction started or done
+//   - Warn: the pages of an interrupted commit found at open, commits
+//     slower than KV.SlowCommit, errors of the TTL sweeper
+//   - Error: failed commits, a damaged meta page or node
+//   - Debug: the progress of a compaction, failed refreshes of a read
+//     only database
+
+// the progress of a compaction is logged every COMPACT_LOG_PAGES pages
+const COMPACT_LOG_PAGES = 1 << 16
+
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// the logger of the database, set by Open
+func (db *KV) log() *slog.Logger {
+	if db.logger == nil {
+		return discardLogger
+	}
+	return db.logger
+}
+
+// logs a batch slower than KV.SlowCommit, from staging until durable
+func (db *KV) logSlow(f *flight) {
+	if db.SlowCommit <= 0 {
+		return
+	}
+	if d := time.Since(f.staged); d > db.SlowCommit {
+		db.log().Warn("slow commit", "duration", d, "commits", len(f.waiters), "pages", len(f.pages),
+			"seq", binary.LittleEndian.Uint64(f.meta[72:80]))
+	}
+}
@@ -0,0 +1,111 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a slog handler output safe for the committer and the test
+type testLog struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *testLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+// the records logged since the last call
+func (l *testLog) take() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.buf.String()
+	l.buf.Reset()
+	return s
+}
+
+func TestLogger(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	out := &testLog{}
+	logger := slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	open := func() (*KV, error) {
+		db := &KV{Path: path, Logger: logger, SlowCommit: time.Nanosecond}
+		return db, db.Open()
+	}
+	assertLogged := func(logged string, want ...string) {
+		t.Helper()
+		for _, w := range want {
+			if !strings.Contains(logged, w) {
+				t.Fatalf("no %q in the log:\n%s", w, logged)
+			}
+		}
+	}
+
+	db, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLogged(out.take(), "level=INFO msg=\"created database\" db="+path)
+	for i := 0; i < 100; i++ {
+		db.Set([]byte(fmt.Sprintf("k%03d", i)), make([]byte, 200))
+	}
+	assertLogged(out.take(), "level=WARN msg=\"slow commit\"", "commits=1")
+	if err := db.Compact(filepath.Join(dir, "copy.db")); err != nil {
+		t.Fatal(err)
+	}
+	assertLogged(out.take(), "msg=\"compaction started\"", "msg=\"compaction done\"", "to="+filepath.Join(dir, "copy.db"))
+	db.Close()
+	if db, err = open(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if logged := out.take(); strings.Contains(logged, "interrupted") {
+		t.Fatalf("a clean file:\n%s", logged)
+	}
+
+	// the pages of a batch without its meta page
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write(make([]byte, 2*BT_PAGE_SIZE))
+	f.Close()
+	if db, err = open(); err != nil {
+		t.Fatal(err)
+	}
+	assertLogged(out.take(), "msg=\"opened database\"", "seq=100", "level=WARN msg=\"ignoring the pages of an interrupted commit\"", "pages=2")
+
+	// a damaged node stops a compaction instead of a panic
+	root := db.tree.root
+	leaf := BN(db.pageRead(root)).getPtr(1)
+	db.Close()
+	data, _ := os.ReadFile(path)
+	binary.LittleEndian.PutUint16(data[leaf*BT_PAGE_SIZE:], 7)
+	os.WriteFile(path, data, 0o644)
+	if db, err = open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(filepath.Join(dir, "copy2.db")); err == nil {
+		t.Fatal("Compact() of a damaged file")
+	}
+	assertLogged(out.take(), "level=ERROR msg=\"damaged node\"", fmt.Sprintf("page=%d type=7", leaf), "msg=\"compaction failed\"")
+	if _, err := os.Stat(filepath.Join(dir, "copy2.db.tmp")); err == nil {
+		t.Fatal("the temporary file of a failed compaction")
+	}
+	db.Close()
+
+	clear(data[:BT_PAGE_SIZE])
+	os.WriteFile(path, data, 0o644)
+	if _, err = open(); err == nil {
+		t.Fatal("Open() without a meta page")
+	}
+	assertLogged(out.take(), "level=ERROR msg=\"damaged meta page\"")
+}
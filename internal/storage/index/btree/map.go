@@ -0,0 +1,197 @@
+package btree
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// Map is an ordered map of byte keys on the B-tree with its pages in
+// memory, no file. like the trees of KV, the pairs are at most
+// BT_MAX_KEY_SIZE and BT_MAX_VAL_SIZE bytes and the empty key isn't one.
+// updates copy the nodes they change: the keys and the values passed to
+// the callers stay as they are, they must not be modified. not safe for
+// concurrent use, its snapshots are.
+type Map struct {
+	mapView
+	mu        sync.RWMutex // the pages, for the readers of the snapshots
+	pages     map[uint64]BN
+	version   uint64         // one more for each snapshot
+	snapshots map[uint64]int // the snapshots not released by version
+	freed     []mapFreed     // pages of the tree kept for the snapshots
+}
+
+// a page deleted from the tree at `version`, the snapshots of the versions
+// before can read it
+type mapFreed struct {
+	ptr     uint64
+	version uint64
+}
+
+// the reads of a Map and of its snapshots
+type mapView struct {
+	tree BT
+	n    int
+}
+
+func NewMap() *Map {
+	m := &Map{pages: map[uint64]BN{}, snapshots: map[uint64]int{}}
+	m.tree = BT{
+		// the writer is the only one to update the pages
+		get: func(ptr uint64) []byte {
+			node, ok := m.pages[ptr]
+			assert(ok)
+			return node
+		},
+		new: func(node []byte) uint64 {
+			assert(BN(node).nbytes() <= BT_PAGE_SIZE)
+			ptr := uint64(uintptr(unsafe.Pointer(&node[0])))
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			assert(m.pages[ptr] == nil)
+			m.pages[ptr] = node
+			return ptr
+		},
+		del: func(ptr uint64) {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			assert(m.pages[ptr] != nil)
+			if len(m.snapshots) == 0 {
+				delete(m.pages, ptr)
+				return
+			}
+			m.freed = append(m.freed, mapFreed{ptr: ptr, version: m.version})
+		},
+	}
+	return m
+}
+
+// the number of keys
+func (m *mapView) Len() int {
+	return m.n
+}
+
+func (m *mapView) Get(key []byte) ([]byte, bool) {
+	return m.tree.Get(key)
+}
+
+// ErrInvalidKey for the empty key, ErrKeyTooLarge or ErrValueTooLarge
+func (m *Map) Set(key []byte, val []byte) error {
+	if len(key) == 0 {
+		return ErrInvalidKey
+	}
+	if len(key) > BT_MAX_KEY_SIZE {
+		return ErrKeyTooLarge
+	}
+	if len(val) > BT_MAX_VAL_SIZE {
+		return ErrValueTooLarge
+	}
+	if _, ok := m.tree.Get(key); !ok {
+		m.n++
+	}
+	m.tree.Insert(key, val)
+	return nil
+}
+
+// false if there is no `key`
+func (m *Map) Delete(key []byte) bool {
+	if len(key) == 0 || !m.tree.Delete(key) {
+		return false
+	}
+	m.n--
+	return true
+}
+
+// calls `fn` for the keys from `start` on in order until it returns false
+func (m *mapView) Ascend(start []byte, fn func(key, val []byte) bool) {
+	m.tree.Scan(start, nil, fn)
+}
+
+// calls `fn` for the keys from `start` down in reverse order until it
+// returns false, nil `start` is from the last key
+func (m *mapView) Descend(start []byte, fn func(key, val []byte) bool) {
+	iter := m.tree.SeekLast()
+	if start != nil {
+		iter = m.tree.SeekLE(start)
+	}
+	for ; iter.Valid(); iter.Prev() {
+		if !fn(iter.Deref()) {
+			return
+		}
+	}
+}
+
+// the number of keys in [start, end), nil `end` is up to the last key
+func (m *mapView) Count(start, end []byte) int {
+	return m.tree.Count(start, end)
+}
+
+// number of keys less than `key`
+func (m *mapView) Rank(key []byte) int {
+	return m.tree.Rank(key)
+}
+
+// the pair of rank `i`, the first one is 0, false past the last key
+func (m *mapView) SelectNth(i int) ([]byte, []byte, bool) {
+	iter := m.tree.SelectNth(i)
+	if !iter.Valid() {
+		return nil, nil, false
+	}
+	key, val := iter.Deref()
+	return key, val, true
+}
+
+// MapSnapshot is the Map as it was when Snapshot was called, it doesn't
+// change with the updates after. it shares the pages of the Map: the
+// updates copy the nodes they change, and the pages the Map deletes are
+// kept until the snapshots from before are released. its reads are safe
+// for concurrent use with each other and with the updates of the Map.
+type MapSnapshot struct {
+	mapView
+	m        *Map
+	version  uint64
+	released bool
+}
+
+// a snapshot of the map in O(1), it must be released
+func (m *Map) Snapshot() *MapSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &MapSnapshot{m: m, version: m.version}
+	s.n = m.n
+	s.tree = BT{root: m.tree.root, get: func(ptr uint64) []byte {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		assert(!s.released)
+		node, ok := m.pages[ptr]
+		assert(ok)
+		return node
+	}}
+	m.snapshots[m.version]++
+	m.version++
+	return s
+}
+
+// the pages kept for the snapshot are deleted once no snapshot from
+// before needs them. the snapshot can't be read after.
+func (s *MapSnapshot) Release() {
+	m := s.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	if m.snapshots[s.version]--; m.snapshots[s.version] == 0 {
+		delete(m.snapshots, s.version)
+	}
+	oldest := m.version
+	for version := range m.snapshots {
+		oldest = min(oldest, version)
+	}
+	// in the order of the versions
+	i := 0
+	for ; i < len(m.freed) && m.freed[i].version <= oldest; i++ {
+		delete(m.pages, m.freed[i].ptr)
+	}
+	m.freed = m.freed[i:]
+}
@@ -0,0 +1,169 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestMap(t *testing.T) {
+	m := NewMap()
+	ref := map[string]string{}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("k%05d", rng.Intn(2000))
+		if rng.Intn(3) == 0 {
+			_, want := ref[key]
+			if got := m.Delete([]byte(key)); got != want {
+				t.Fatalf("Delete(%s) = %v", key, got)
+			}
+			delete(ref, key)
+			continue
+		}
+		val := fmt.Sprint(i)
+		if err := m.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		ref[key] = val
+	}
+	if m.Len() != len(ref) {
+		t.Fatalf("Len() = %d, want %d", m.Len(), len(ref))
+	}
+	keys := make([]string, 0, len(ref))
+	for key := range ref {
+		keys = append(keys, key)
+		if val, ok := m.Get([]byte(key)); !ok || string(val) != ref[key] {
+			t.Fatalf("Get(%s) = %q, %v", key, val, ok)
+		}
+	}
+	slices.Sort(keys)
+
+	var got []string
+	m.Ascend(nil, func(key, val []byte) bool {
+		got = append(got, string(key))
+		return true
+	})
+	if !slices.Equal(got, keys) {
+		t.Fatalf("Ascend() has %d keys, want %d", len(got), len(keys))
+	}
+	got = got[:0]
+	m.Descend(nil, func(key, val []byte) bool {
+		got = append(got, string(key))
+		return true
+	})
+	slices.Reverse(got)
+	if !slices.Equal(got, keys) {
+		t.Fatalf("Descend() has %d keys, want %d", len(got), len(keys))
+	}
+
+	// from a key that isn't one, until the callback stops
+	mid := keys[len(keys)/2]
+	got = got[:0]
+	m.Descend([]byte(mid+"x"), func(key, val []byte) bool {
+		got = append(got, string(key))
+		return len(got) < 2
+	})
+	if len(got) != 2 || got[0] != mid || got[1] != keys[len(keys)/2-1] {
+		t.Fatalf("Descend(%s) = %v", mid+"x", got)
+	}
+
+	if err := m.Set(nil, nil); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("Set() of the empty key = %v", err)
+	}
+	for _, key := range keys {
+		m.Delete([]byte(key))
+	}
+	m.Descend(nil, func(key, val []byte) bool {
+		t.Fatalf("key %q in an empty map", key)
+		return false
+	})
+	if m.Len() != 0 {
+		t.Fatalf("Len() = %d", m.Len())
+	}
+}
+
+func TestMapSnapshot(t *testing.T) {
+	m := NewMap()
+	for i := 0; i < 3000; i++ {
+		m.Set([]byte(fmt.Sprintf("k%05d", i)), []byte("old"))
+	}
+	s := m.Snapshot()
+	pages := len(m.pages)
+
+	// the snapshot is read while the map is updated
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 5; round++ {
+				n := 0
+				s.Ascend(nil, func(key, val []byte) bool {
+					if string(val) != "old" {
+						t.Errorf("%s = %s in the snapshot", key, val)
+						return false
+					}
+					n++
+					return true
+				})
+				if n != 3000 || s.Len() != 3000 {
+					t.Errorf("%d keys, Len() = %d in the snapshot", n, s.Len())
+				}
+			}
+		}()
+	}
+	for i := 0; i < 3000; i += 2 {
+		m.Set([]byte(fmt.Sprintf("k%05d", i)), []byte("new"))
+		m.Delete([]byte(fmt.Sprintf("k%05d", i+1)))
+	}
+	wg.Wait()
+	if val, ok := s.Get([]byte("k00001")); !ok || string(val) != "old" {
+		t.Fatalf("Get() of a deleted key in the snapshot = %q, %v", val, ok)
+	}
+	if key, _, ok := s.SelectNth(2999); !ok || string(key) != "k02999" {
+		t.Fatalf("SelectNth() in the snapshot = %q, %v", key, ok)
+	}
+	if m.Len() != 1500 || m.Count(nil, nil) != 1500 {
+		t.Fatalf("Len() = %d after the updates", m.Len())
+	}
+	if len(m.pages) <= pages {
+		t.Fatalf("%d pages with the snapshot, %d before", len(m.pages), pages)
+	}
+
+	// the pages of the snapshot are deleted with it
+	s2 := m.Snapshot()
+	m.Set([]byte("k00001"), []byte("new"))
+	s.Release()
+	s.Release()
+	if val, ok := s2.Get([]byte("k00001")); ok {
+		t.Fatalf("Get() of a deleted key in the second snapshot = %q", val)
+	}
+	s2.Release()
+	c := &C{tree: m.tree, pages: m.pages}
+	if n := len(m.pages); n != len(reachable(c)) {
+		t.Fatalf("%d pages, %d in the tree", n, len(reachable(c)))
+	}
+	verifyTreeStructure(t, c)
+}
+
+// the pages of the tree
+func reachable(c *C) map[uint64]bool {
+	seen := map[uint64]bool{}
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		seen[ptr] = true
+		node := BN(c.tree.get(ptr))
+		if node.btype() == BN_NODE {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				walk(node.getPtr(i))
+			}
+		}
+	}
+	if c.tree.root != 0 {
+		walk(c.tree.root)
+	}
+	return seen
+}
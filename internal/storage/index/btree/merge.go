@@ -0,0 +1,271 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Merge applies a sorted batch of sets and deletes to a tree in one ordered
+// traversal of both: the batch is split between the kids of a branch node
+// by its separators, a node no pair falls in is kept as it is, and each
+// node a pair falls in is rebuilt once with all of its pairs, in as many
+// nodes as it takes. Insert copies the path of the key for every pair, a
+// merge copies it once for the pairs of a leaf: for a staged import or the
+// flush of a memtable of sorted pairs into the tree.
+
+var ErrMergeOrder = errors.New("merge pairs aren't in increasing key order")
+
+// a set or a delete of a merge
+type MergePair struct {
+	Key []byte
+	Val []byte
+	Del bool // the key is deleted, Val is ignored
+}
+
+// an entry of a node built by a merge
+type mergeEntry struct {
+	key []byte
+	val []byte
+	ptr uint64
+}
+
+// applies `pairs`, in increasing key order without the empty key
+func (tree *BT) Merge(pairs []MergePair) {
+	if len(pairs) == 0 {
+		return
+	}
+	var root BN
+	if tree.root != 0 {
+		root = tree.node(tree.root)
+	} else {
+		// a leaf of the empty key, like the first Insert
+		root = BN(make([]byte, BT_PAGE_SIZE))
+		root.setHeader(BN_LEAF, 1)
+		nodeAppendKV(root, 0, 0, nil, nil)
+	}
+	nodes := treeMerge(tree, root, pairs)
+	if tree.root != 0 {
+		tree.del(tree.root)
+	}
+	// new levels while the root doesn't fit a node
+	for len(nodes) > 1 {
+		_, counted := nodeCount(nodes[0])
+		entries := make([]mergeEntry, len(nodes))
+		for i, node := range nodes {
+			entries[i] = mergeEntry{key: node.getKey(0), val: kidVal(node, counted), ptr: tree.new(node)}
+		}
+		nodes = mergePack(tree, BN_NODE, entries)
+	}
+	// and fewer while it has a single kid
+	root = nodes[0]
+	if root.btype() == BN_NODE && root.nkeys() == 1 {
+		ptr := root.getPtr(0)
+		tree.arena.put(root)
+		for kid := tree.node(ptr); kid.btype() == BN_NODE && kid.nkeys() == 1; kid = tree.node(ptr) {
+			next := kid.getPtr(0)
+			tree.del(ptr)
+			ptr = next
+		}
+		tree.root = ptr
+		return
+	}
+	tree.root = tree.new(root)
+}
+
+// the nodes replacing `node` with `pairs` applied, none if it's left empty
+func treeMerge(tree *BT, node BN, pairs []MergePair) []BN {
+	var entries []mergeEntry
+	if node.btype() == BN_LEAF {
+		i, nkeys := uint16(0), node.nkeys()
+		for _, p := range pairs {
+			for ; i < nkeys && bytes.Compare(node.getKey(i), p.Key) < 0; i++ {
+				entries = append(entries, mergeEntry{key: node.getKey(i), val: node.getVal(i)})
+			}
+			if i < nkeys && bytes.Equal(node.getKey(i), p.Key) {
+				i++
+			}
+			if !p.Del {
+				entries = append(entries, mergeEntry{key: p.Key, val: p.Val})
+			}
+		}
+		for ; i < nkeys; i++ {
+			entries = append(entries, mergeEntry{key: node.getKey(i), val: node.getVal(i)})
+		}
+		return mergePack(tree, BN_LEAF, entries)
+	}
+
+	counted := node.counted()
+	for i := uint16(0); i < node.nkeys(); i++ {
+		// the pairs of the kid, before the next separator
+		n := len(pairs)
+		if i+1 < node.nkeys() {
+			next := node.getKey(i + 1)
+			n = 0
+			for n < len(pairs) && bytes.Compare(pairs[n].Key, next) < 0 {
+				n++
+			}
+		}
+		if n == 0 {
+			entries = append(entries, mergeEntry{key: node.getKey(i), val: node.getVal(i), ptr: node.getPtr(i)})
+			continue
+		}
+		ptr := node.getPtr(i)
+		kids := treeMerge(tree, tree.node(ptr), pairs[:n])
+		tree.del(ptr)
+		for _, kid := range kids {
+			entries = append(entries, mergeEntry{key: kid.getKey(0), val: kidVal(kid, counted), ptr: tree.new(kid)})
+		}
+		pairs = pairs[n:]
+	}
+	return mergePack(tree, BN_NODE, entries)
+}
+
+// the entries in nodes of about the same size, as few as fit
+func mergePack(tree *BT, btype uint16, entries []mergeEntry) []BN {
+	if len(entries) == 0 {
+		return nil
+	}
+	size := func(e mergeEntry) int {
+		return 8 + 2 + 4 + len(e.key) + len(e.val)
+	}
+	total := 0
+	for _, e := range entries {
+		total += size(e)
+	}
+	n := (total + BT_PAGE_SIZE - HEADER - 1) / (BT_PAGE_SIZE - HEADER)
+	target := (total + n - 1) / n
+
+	var nodes []BN
+	for start := 0; start < len(entries); {
+		end, used := start, 0
+		for end < len(entries) && (end == start || used < target && HEADER+used+size(entries[end]) <= BT_PAGE_SIZE) {
+			used += size(entries[end])
+			end++
+		}
+		node := tree.arena.alloc(1)
+		node.setHeader(btype, uint16(end-start))
+		for i, e := range entries[start:end] {
+			nodeAppendKV(node, uint16(i), e.ptr, e.key, e.val)
+		}
+		nodes = append(nodes, node)
+		start = end
+	}
+	return nodes
+}
+
+// ErrMergeOrder unless the keys of `pairs` are in increasing order,
+// ErrInvalidKey for the empty key
+func checkMergeOrder(pairs []MergePair) error {
+	for i, p := range pairs {
+		if len(p.Key) == 0 {
+			return ErrInvalidKey
+		}
+		if i > 0 && bytes.Compare(pairs[i-1].Key, p.Key) >= 0 {
+			return ErrMergeOrder
+		}
+	}
+	return nil
+}
+
+// applies the sets and the deletes of `pairs`, in increasing key order,
+// to the main keyspace in a merge, see BT.Merge. they are watched, logged
+// in the changefeed and audited like Set and Del.
+func (tx *Tx) Merge(pairs []MergePair) (err error) {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if err := checkMergeOrder(pairs); err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		if p.Del {
+			continue
+		}
+		if err := tx.db.checkSize(len(p.Key), len(p.Val)); err != nil {
+			return err
+		}
+		if err := tx.checkEntry(nil, p.Key, p.Val); err != nil {
+			return err
+		}
+	}
+	tx.canceled()
+	if err := tx.Err(); err != nil {
+		return err
+	}
+	defer tx.catch("Merge", &err)
+	for _, p := range pairs {
+		tx.record(nil, p.Key, p.Val, !p.Del)
+	}
+	tx.tree.Merge(pairs)
+	return nil
+}
+
+// like Tx.Merge for the bucket. the values are compressed for a family
+// with compression, the pairs of a family with TTL or versions are set
+// and deleted one by one.
+func (b *Bucket) Merge(pairs []MergePair) (err error) {
+	if err := b.writable(); err != nil {
+		return err
+	}
+	if err := checkMergeOrder(pairs); err != nil {
+		return err
+	}
+	if b.opts.TTL || b.opts.versioned() {
+		for _, p := range pairs {
+			if p.Del {
+				_, err = b.Del(p.Key)
+			} else {
+				err = b.Set(p.Key, p.Val)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	stored := make([]MergePair, len(pairs))
+	for i, p := range pairs {
+		stored[i] = p
+		if p.Del {
+			continue
+		}
+		stored[i].Val = b.encode(p.Val, 0)
+		if err := b.checkSize(p.Key, stored[i].Val); err != nil {
+			return err
+		}
+		if err := b.tx.checkEntry(b, p.Key, p.Val); err != nil {
+			return err
+		}
+	}
+	defer b.catch("Merge", &err)
+	for _, p := range pairs {
+		b.tx.record(b, p.Key, p.Val, !p.Del)
+	}
+	b.tree.Merge(stored)
+	b.dirty = true
+	return nil
+}
+
+// like Tx.Merge for the map
+func (m *Map) Merge(pairs []MergePair) error {
+	if err := checkMergeOrder(pairs); err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		if p.Del {
+			continue
+		}
+		if len(p.Key) > BT_MAX_KEY_SIZE {
+			return ErrKeyTooLarge
+		}
+		if len(p.Val) > BT_MAX_VAL_SIZE {
+			return ErrValueTooLarge
+		}
+	}
+	m.tree.Merge(pairs)
+	m.n = m.tree.size()
+	return nil
+}
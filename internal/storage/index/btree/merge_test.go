@@ -0,0 +1,118 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// a sorted batch of `n` random sets and deletes, applied to `ref`
+func mergeBatch(r *rand.Rand, n, keys int, ref map[string]string) []MergePair {
+	batch := map[string]MergePair{}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key_%06d", r.Intn(keys))
+		if r.Intn(3) == 0 {
+			batch[key] = MergePair{Key: []byte(key), Del: true}
+			delete(ref, key)
+		} else {
+			val := strings.Repeat("v", r.Intn(200))
+			batch[key] = MergePair{Key: []byte(key), Val: []byte(val)}
+			ref[key] = val
+		}
+	}
+	pairs := make([]MergePair, 0, len(batch))
+	for _, p := range batch {
+		pairs = append(pairs, p)
+	}
+	slices.SortFunc(pairs, func(a, b MergePair) int { return strings.Compare(string(a.Key), string(b.Key)) })
+	return pairs
+}
+
+func TestMerge(t *testing.T) {
+	c := NewC()
+	r := rand.New(rand.NewSource(1))
+	// into the empty tree, then batches of every size
+	for _, n := range []int{5000, 1, 10, 300, 3000, 20000, 100} {
+		c.tree.Merge(mergeBatch(r, n, 20000, c.ref))
+		verifyTreeStructure(t, c)
+		keys := sortedKeys(c.ref)
+		var got []string
+		c.tree.Scan(nil, nil, func(key, val []byte) bool {
+			if want := c.ref[string(key)]; string(val) != want {
+				t.Fatalf("%s = %q; want %q", key, val, want)
+			}
+			got = append(got, string(key))
+			return true
+		})
+		if !slices.Equal(got, keys) {
+			t.Fatalf("batch of %d: %d keys; want %d", n, len(got), len(keys))
+		}
+		if n := c.tree.Count(nil, nil); n != len(keys) {
+			t.Fatalf("Count() = %d; want %d", n, len(keys))
+		}
+	}
+	// every key deleted
+	var pairs []MergePair
+	for _, key := range sortedKeys(c.ref) {
+		pairs = append(pairs, MergePair{Key: []byte(key), Del: true})
+	}
+	c.tree.Merge(pairs)
+	c.ref = map[string]string{}
+	verifyTreeStructure(t, c)
+	if n := c.tree.Count(nil, nil); n != 0 || BN(c.tree.get(c.tree.root)).btype() != BN_LEAF {
+		t.Fatalf("Count() = %d after deleting every key", n)
+	}
+}
+
+func TestTxMerge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+	defer db.Close()
+	r := rand.New(rand.NewSource(1))
+	ref, bref := map[string]string{}, map[string]string{}
+
+	for round := 0; round < 5; round++ {
+		tx := db.Begin()
+		if err := tx.Merge(mergeBatch(r, 2000, 10000, ref)); err != nil {
+			t.Fatal(err)
+		}
+		cf, err := tx.CreateColumnFamily([]byte("cf"), CFOptions{Compression: true})
+		if err == ErrBucketExists {
+			cf = tx.Bucket([]byte("cf"))
+		}
+		if err := cf.Merge(mergeBatch(r, 500, 10000, bref)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertKV(t, db, ref)
+	tx := db.BeginRead()
+	cf := tx.Bucket([]byte("cf"))
+	for key, val := range bref {
+		if got, ok := cf.Get([]byte(key)); !ok || string(got) != val {
+			t.Fatalf("%s = %q, %v; want %q", key, got, ok, val)
+		}
+	}
+	if n := cf.Count(nil, nil); n != len(bref) {
+		t.Fatalf("%d keys in the family; want %d", n, len(bref))
+	}
+	tx.Rollback()
+
+	tx = db.Begin()
+	unordered := []MergePair{{Key: []byte("b")}, {Key: []byte("a")}}
+	if err := tx.Merge(unordered); err != ErrMergeOrder {
+		t.Fatalf("Merge() of unordered pairs = %v", err)
+	}
+	if err := tx.Merge([]MergePair{{Key: nil}}); err != ErrInvalidKey {
+		t.Fatalf("Merge() of the empty key = %v", err)
+	}
+	tx.Rollback()
+	if report, err := Check(path); err != nil || !report.OK() {
+		t.Fatalf("Check() = %+v, %v", report, err)
+	}
+}
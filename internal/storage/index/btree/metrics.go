@@ -0,0 +1,96 @@
+package btree
+
+import "time"
+
+// Metrics receives the counters of the engine, set KV.Metrics before Open.
+// it is called by the writer, the committer and the readers concurrently
+// and must not block. the page reads, splits and merges of the writer are
+// summed and reported once per batch by the committer, those of a reader
+// once at its Rollback.
+type Metrics interface {
+	// adds to the counter `name`
+	Add(name string, delta uint64)
+	// sets the gauge `name`
+	Set(name string, value float64)
+	// records a duration of `name`, like a histogram
+	Observe(name string, d time.Duration)
+}
+
+// counters
+const (
+	METRIC_COMMITS     = "commits"     // write transactions committed
+	METRIC_ROLLBACKS   = "rollbacks"   // write transactions rolled back
+	METRIC_BATCHES     = "batches"     // batches of commits made durable
+	METRIC_FSYNCS      = "fsyncs"      // of the database file
+	METRIC_PAGE_READS  = "page_reads"  // pages read from the file, not the pending ones
+	METRIC_PAGE_WRITES = "page_writes" // pages written, the meta page included
+	METRIC_WRITE_CALLS = "write_calls" // pwritev calls of the pages, a call per run of consecutive pages
+	METRIC_SPLITS      = "splits"      // nodes split in two or three
+	METRIC_MERGES      = "merges"      // nodes merged with a sibling
+	// reads of the buffer pool, see KV.PoolPages
+	METRIC_POOL_HITS      = "pool_hits"
+	METRIC_POOL_MISSES    = "pool_misses" // pages read from the file
+	METRIC_POOL_EVICTIONS = "pool_evictions"
+	// leaves not read by lookups of missing keys, see KV.BloomBits
+	METRIC_BLOOM_SKIPS = "bloom_skips"
+	// pages read by Scrub, the problems found
+	METRIC_SCRUB_PAGES  = "scrub_pages"
+	METRIC_SCRUB_ERRORS = "scrub_errors"
+	// pages found corrupted by reads, see Corrupted
+	METRIC_CORRUPT_PAGES = "corrupt_pages"
+)
+
+// gauges
+const (
+	METRIC_FREE_PAGES = "free_pages" // items of the free list
+	METRIC_FILE_PAGES = "file_pages" // pages of the file
+	// pages in the buffer pool, set by Tx.Resident
+	METRIC_RESIDENT_PAGES = "resident_pages"
+)
+
+// durations
+const (
+	METRIC_WRITE_TX = "write_tx" // from Begin to Commit or Rollback
+	METRIC_READ_TX  = "read_tx"  // from BeginRead to Rollback
+	METRIC_BATCH    = "batch"    // from staging a batch until it is durable
+)
+
+// counts of the writer since the last batch, with db.mu
+type writeCounts struct {
+	reads  uint64
+	splits uint64
+	merges uint64
+
+	events *Events // for Split and Merge
+}
+
+func (db *KV) count(name string, delta uint64) {
+	if db.Metrics != nil && delta > 0 {
+		db.Metrics.Add(name, delta)
+	}
+}
+
+func (db *KV) observe(name string, start time.Time) {
+	if db.Metrics != nil {
+		db.Metrics.Observe(name, time.Since(start))
+	}
+}
+
+// reports the counts of the writer and the gauges of a staged batch, with
+// db.mu
+func (db *KV) reportBatch() {
+	if db.Metrics == nil {
+		return
+	}
+	c := &db.counts
+	db.count(METRIC_PAGE_READS, c.reads)
+	db.count(METRIC_SPLITS, c.splits)
+	db.count(METRIC_MERGES, c.merges)
+	c.reads, c.splits, c.merges = 0, 0, 0
+	if db.pool.cur != nil {
+		db.pool.cur.report(db)
+	}
+	db.filters.report(db)
+	db.Metrics.Set(METRIC_FREE_PAGES, float64(db.free.tailSeq-db.free.headSeq))
+	db.Metrics.Set(METRIC_FILE_PAGES, float64(db.page.flushed))
+}
@@ -0,0 +1,78 @@
+package btree
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// records the metrics of a database
+type testMetrics struct {
+	mu        sync.Mutex
+	counters  map[string]uint64
+	gauges    map[string]float64
+	durations map[string]int
+}
+
+func (m *testMetrics) Add(name string, delta uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += delta
+}
+
+func (m *testMetrics) Set(name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[name] = value
+}
+
+func (m *testMetrics) Observe(name string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.durations[name]++
+}
+
+func TestMetrics(t *testing.T) {
+	m := &testMetrics{counters: map[string]uint64{}, gauges: map[string]float64{}, durations: map[string]int{}}
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), Metrics: m}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		db.Set([]byte(fmt.Sprintf("k%04d", i)), make([]byte, 100))
+	}
+	for i := 0; i < 200; i++ {
+		db.Del([]byte(fmt.Sprintf("k%04d", i)))
+	}
+	db.Begin().Rollback()
+	tx := db.BeginRead()
+	tx.Get([]byte("k0001"))
+	tx.Rollback()
+	db.Close()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.counters
+	switch {
+	case c[METRIC_COMMITS] != 400 || c[METRIC_ROLLBACKS] != 1:
+		t.Fatalf("%d commits, %d rollbacks", c[METRIC_COMMITS], c[METRIC_ROLLBACKS])
+	case c[METRIC_BATCHES] == 0 || c[METRIC_BATCHES] > 400:
+		t.Fatalf("%d batches", c[METRIC_BATCHES])
+	case c[METRIC_FSYNCS] != 2*c[METRIC_BATCHES]+2: // and the new file
+		t.Fatalf("%d fsyncs of %d batches", c[METRIC_FSYNCS], c[METRIC_BATCHES])
+	case c[METRIC_PAGE_WRITES] < 2*c[METRIC_BATCHES]:
+		t.Fatalf("%d pages written by %d batches", c[METRIC_PAGE_WRITES], c[METRIC_BATCHES])
+	case c[METRIC_PAGE_READS] == 0:
+		t.Fatal("no page reads")
+	case c[METRIC_SPLITS] == 0 || c[METRIC_MERGES] == 0:
+		t.Fatalf("%d splits, %d merges", c[METRIC_SPLITS], c[METRIC_MERGES])
+	}
+	if m.gauges[METRIC_FILE_PAGES] == 0 || m.gauges[METRIC_FREE_PAGES] == 0 {
+		t.Fatalf("gauges %v", m.gauges)
+	}
+	if d := m.durations; d[METRIC_WRITE_TX] != 401 || d[METRIC_READ_TX] != 1 || d[METRIC_BATCH] != int(c[METRIC_BATCHES]) {
+		t.Fatalf("durations %v", d)
+	}
+}
@@ -0,0 +1,174 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Open(path, options...) is the short way to configure a KV, an option
+// sets fields of it:
+//
+//	db, err := btree.Open("app.db", btree.WithAsync(5*time.Millisecond), btree.WithBloomBits(10))
+//
+// the fields are checked together by Open, the ones set by options and
+// the ones of a KV opened by KV.Open, and every problem is reported.
+
+// the problems of the fields of a KV
+var ErrConfig = errors.New("bad KV config")
+
+type Option func(db *KV)
+
+// opens the database at `path` with the options
+func Open(path string, opts ...Option) (*KV, error) {
+	db := &KV{Path: path}
+	for _, opt := range opts {
+		opt(db)
+	}
+	if err := db.Open(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Set and Del return once the update is applied in memory, the committer
+// flushes the queued updates every `interval`
+func WithAsync(interval time.Duration) Option {
+	return func(db *KV) { db.Async, db.FlushInterval = true, interval }
+}
+
+// the file is written by another process, it's read again every
+// `refresh`, see Refresh
+func WithReadOnly(refresh time.Duration) Option {
+	return func(db *KV) { db.ReadOnly, db.RefreshInterval = true, refresh }
+}
+
+// commits skip their fsyncs, see KV.NoSync
+func WithNoSync() Option {
+	return func(db *KV) { db.NoSync = true }
+}
+
+// pages of `size` bytes, BT_PAGE_SIZE is the only size for now
+func WithPageSize(size int) Option {
+	return func(db *KV) { db.PageSize = size }
+}
+
+// the largest keys and values of a new file, `key`+`val` up to
+// BT_MAX_PAIR_SIZE. a file keeps the ones it was created with, see
+// KV.MaxKeySize
+func WithMaxSizes(key, val int) Option {
+	return func(db *KV) { db.MaxKeySize, db.MaxValueSize = key, val }
+}
+
+// the file can't grow past `size` bytes, see KV.MmapLimit
+func WithMmapLimit(size int64) Option {
+	return func(db *KV) { db.MmapLimit = size }
+}
+
+// pages are read into a buffer pool of about `pages` pages instead of
+// mapping the file
+func WithPoolPages(pages int) Option {
+	return func(db *KV) { db.PoolPages = pages }
+}
+
+// Bloom filters of the leaves with `bits` per key
+func WithBloomBits(bits int) Option {
+	return func(db *KV) { db.BloomBits = bits }
+}
+
+// expired keys are swept every `interval`, up to `batch` keys per bucket
+func WithSweep(interval time.Duration, batch int) Option {
+	return func(db *KV) { db.SweepInterval, db.SweepBatch = interval, batch }
+}
+
+func WithClock(now func() time.Time) Option {
+	return func(db *KV) { db.Now = now }
+}
+
+func WithReplica() Option {
+	return func(db *KV) { db.Replica = true }
+}
+
+func WithChangefeed() Option {
+	return func(db *KV) { db.Changefeed = true }
+}
+
+func WithAudit(audit *AuditLog) Option {
+	return func(db *KV) { db.Audit = audit }
+}
+
+func WithMetrics(m Metrics) Option {
+	return func(db *KV) { db.Metrics = m }
+}
+
+// batches of commits slower than `slow` are logged, off if zero
+func WithLogger(logger *slog.Logger, slow time.Duration) Option {
+	return func(db *KV) { db.Logger, db.SlowCommit = logger, slow }
+}
+
+func WithEvents(events *Events) Option {
+	return func(db *KV) { db.Events = events }
+}
+
+func WithScrubRate(pages int) Option {
+	return func(db *KV) { db.ScrubRate = pages }
+}
+
+func WithDoubleWrite() Option {
+	return func(db *KV) { db.DoubleWrite = true }
+}
+
+func WithCheckCommits() Option {
+	return func(db *KV) { db.CheckCommits = true }
+}
+
+func WithPoisonViews() Option {
+	return func(db *KV) { db.PoisonViews = true }
+}
+
+// the problems of the fields, wrapped by ErrConfig. nil if none
+func (db *KV) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(db.Path != "", "no Path")
+	for _, f := range []struct {
+		name string
+		n    int64
+	}{
+		{"FlushInterval", int64(db.FlushInterval)},
+		{"SweepInterval", int64(db.SweepInterval)},
+		{"SweepBatch", int64(db.SweepBatch)},
+		{"RefreshInterval", int64(db.RefreshInterval)},
+		{"SlowCommit", int64(db.SlowCommit)},
+		{"PoolPages", int64(db.PoolPages)},
+		{"BloomBits", int64(db.BloomBits)},
+		{"ScrubRate", int64(db.ScrubRate)},
+		{"MmapLimit", db.MmapLimit},
+		{"MaxKeySize", int64(db.MaxKeySize)},
+		{"MaxValueSize", int64(db.MaxValueSize)},
+	} {
+		check(f.n >= 0, "negative %s %d", f.name, f.n)
+	}
+	check(db.PageSize == 0 || db.PageSize == BT_PAGE_SIZE, "PageSize %d, pages are %d bytes", db.PageSize, BT_PAGE_SIZE)
+	if db.MaxKeySize >= 0 && db.MaxValueSize >= 0 {
+		err := checkSizes(db.newSizes())
+		check(err == nil, "%v", err)
+	}
+	check(db.MmapLimit == 0 || db.MmapLimit >= 2*BT_PAGE_SIZE, "MmapLimit %d is less than 2 pages", db.MmapLimit)
+	if db.ReadOnly {
+		check(!db.Replica, "Replica with ReadOnly")
+		check(db.PoolPages == 0, "PoolPages with ReadOnly")
+		check(db.BloomBits == 0, "BloomBits with ReadOnly")
+		check(!db.DoubleWrite, "DoubleWrite with ReadOnly")
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrConfig, strings.Join(problems, ", "))
+}
@@ -0,0 +1,153 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	m := &testMetrics{counters: map[string]uint64{}, gauges: map[string]float64{}, durations: map[string]int{}}
+	db, err := Open(path, WithNoSync(), WithPageSize(BT_PAGE_SIZE), WithBloomBits(10), WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.NoSync || db.BloomBits != 10 || db.filters == nil {
+		t.Fatalf("the options aren't set: %+v", db)
+	}
+	for i := 0; i < 100; i++ {
+		db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("val"))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.counters[METRIC_FSYNCS]; n != 0 {
+		t.Fatalf("%d fsyncs with NoSync", n)
+	}
+
+	// every problem is reported
+	_, err = Open(path, WithReadOnly(0), WithPoolPages(10), WithPageSize(8192), WithSweep(-time.Second, 10))
+	if !errors.Is(err, ErrConfig) {
+		t.Fatalf("Open() = %v", err)
+	}
+	for _, problem := range []string{"PoolPages with ReadOnly", "PageSize 8192", "negative SweepInterval"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("Open() = %v, no %q", err, problem)
+		}
+	}
+}
+
+func TestMmapLimit(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithMmapLimit(64*BT_PAGE_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	i := 0
+	for ; i < 1000; i++ {
+		if err = db.Set([]byte(fmt.Sprintf("k%04d", i)), make([]byte, 1000)); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrDatabaseFull) {
+		t.Fatalf("Set() of key %d = %v", i, err)
+	}
+	// the commits before are kept
+	if _, ok := db.Get([]byte(fmt.Sprintf("k%04d", i-1))); !ok {
+		t.Fatal("the last commit before the limit is lost")
+	}
+	if _, ok := db.Get([]byte(fmt.Sprintf("k%04d", i))); ok {
+		t.Fatal("the commit past the limit is applied")
+	}
+}
+
+func TestMaxSizes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, WithMaxSizes(70, 4000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("k"), make([]byte, 4000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set(make([]byte, 71), nil); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("Set() of a key of 71 bytes = %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file keeps its sizes
+	db, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.MaxKeySize != 70 || db.MaxValueSize != 4000 {
+		t.Fatalf("sizes %d and %d", db.MaxKeySize, db.MaxValueSize)
+	}
+	if val, ok := db.Get([]byte("k")); !ok || len(val) != 4000 {
+		t.Fatalf("Get() = %d bytes, %v", len(val), ok)
+	}
+	db.Close()
+	if report, err := Check(path); err != nil || !report.OK() {
+		t.Fatalf("Check() = %+v, %v", report, err)
+	}
+
+	_, err = Open(path, WithMaxSizes(BT_MAX_KEY_SIZE, BT_MAX_VAL_SIZE))
+	if !errors.Is(err, ErrConfig) || !strings.Contains(err.Error(), "the file has 70 and 4000") {
+		t.Fatalf("Open() with other sizes = %v", err)
+	}
+	_, err = Open(path, WithMaxSizes(2000, 3000))
+	if !errors.Is(err, ErrConfig) || !strings.Contains(err.Error(), "MaxKeySize 2000 and MaxValueSize 3000") {
+		t.Fatalf("Open() with sizes over a page = %v", err)
+	}
+}
+
+// pairs at the limits next to large neighbours split a node in three
+func TestMaxSizesSplit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := strings.Repeat("b", BT_MAX_KEY_SIZE)
+	ref := map[string]string{
+		"a": strings.Repeat("a", 2000),
+		"c": strings.Repeat("c", 2000),
+		big: strings.Repeat("b", BT_MAX_VAL_SIZE),
+	}
+	for _, k := range []string{"a", "c", big} {
+		if err := db.Set([]byte(k), []byte(ref[k])); err != nil {
+			t.Fatalf("Set(%.10s) = %v", k, err)
+		}
+	}
+	assertKV(t, db, ref)
+	db.Close()
+
+	path = filepath.Join(t.TempDir(), "max.db")
+	db, err = Open(path, WithMaxSizes(BT_MAX_KEY_LIMIT, BT_MAX_PAIR_SIZE-BT_MAX_KEY_LIMIT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref = map[string]string{}
+	for i := 0; i < 200; i++ {
+		klen := []int{1, 100, BT_MAX_KEY_LIMIT}[i%3]
+		k := fmt.Sprintf("%0*d", klen, i*7%200)
+		v := strings.Repeat("v", BT_MAX_PAIR_SIZE-BT_MAX_KEY_LIMIT-i%2*1000)
+		if err := db.Set([]byte(k), []byte(v)); err != nil {
+			t.Fatalf("Set(%.10s) = %v", k, err)
+		}
+		ref[k] = v
+	}
+	assertKV(t, db, ref)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := Check(path); err != nil || !report.OK() {
+		t.Fatalf("Check() = %+v, %v", report, err)
+	}
+}
@@ -0,0 +1,215 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// InspectPage decodes a page of a database file for debugging: the fields
+// of the meta page, the items of a free list node or the keys of a tree
+// node, then the raw bytes. the kind of a page is from its number, the
+// free list of the meta page and its header, so damaged pages are shown
+// as far as they can be read.
+
+// keys and values longer than this are cut
+const PAGE_SHOW_BYTES = 64
+
+// the decoded page `ptr` of the file at `path` and its hexdump
+func InspectPage(path string, ptr uint64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	pages := uint64(fi.Size() / BT_PAGE_SIZE)
+	if ptr >= pages {
+		return "", fmt.Errorf("page %d: the file has %d pages", ptr, pages)
+	}
+	c := &checker{f: f, report: &CheckReport{}, owner: map[uint64]string{}}
+	page, err := c.read(ptr)
+	if err != nil {
+		return "", err
+	}
+	meta, err := c.read(0)
+	if err != nil {
+		return "", err
+	}
+	var list map[uint64][]freeItem
+	if c.checkMeta(meta, pages) {
+		list = freeList(c, meta)
+	}
+
+	var sb strings.Builder
+	items, isList := list[ptr]
+	switch {
+	case ptr == 0:
+		formatMeta(&sb, meta, pages)
+		for _, e := range c.report.Errors {
+			fmt.Fprintf(&sb, "  %s\n", e.Msg)
+		}
+	case isList:
+		formatFreeList(&sb, ptr, LNode(page), items)
+	default:
+		fmt.Fprintf(&sb, "page %d", ptr)
+		for _, items := range list {
+			for _, item := range items {
+				if item.ptr == ptr {
+					fmt.Fprintf(&sb, " (free, item %d of the free list)", item.seq)
+				}
+			}
+		}
+		sb.WriteString(": ")
+		formatNode(&sb, BN(page))
+	}
+	sb.WriteByte('\n')
+	hexDump(&sb, page)
+	return sb.String(), nil
+}
+
+func formatMeta(sb *strings.Builder, meta []byte, pages uint64) {
+	field := func(pos int) uint64 {
+		return binary.LittleEndian.Uint64(meta[pos : pos+8])
+	}
+	sb.WriteString("page 0: meta\n")
+	fmt.Fprintf(sb, "  signature       %q\n", meta[:16])
+	fmt.Fprintf(sb, "  root            %d\n", field(16))
+	fmt.Fprintf(sb, "  pages used      %d of %d\n", field(24), pages)
+	fmt.Fprintf(sb, "  free list head  page %d, item %d\n", field(32), field(40))
+	fmt.Fprintf(sb, "  free list tail  page %d, item %d\n", field(48), field(56))
+	fmt.Fprintf(sb, "  catalog root    %d\n", field(64))
+	fmt.Fprintf(sb, "  seq             %d\n", field(72))
+	fmt.Fprintf(sb, "  applied         %d\n", field(80))
+}
+
+// a free list item, its sequence and the free page
+type freeItem struct {
+	seq uint64
+	ptr uint64
+}
+
+// the live items of the nodes of the free list of the meta page, walked
+// from the head like FreeList. nil if a node can't be read.
+func freeList(c *checker, meta []byte) map[uint64][]freeItem {
+	field := func(pos int) uint64 {
+		return binary.LittleEndian.Uint64(meta[pos : pos+8])
+	}
+	flushed, tailPage, tailSeq := field(24), field(48), field(56)
+	node, seq := field(32), field(40)
+	list := map[uint64][]freeItem{}
+	for {
+		if _, ok := list[node]; ok || node == 0 || node >= flushed {
+			return nil
+		}
+		page, err := c.read(node)
+		if err != nil {
+			return nil
+		}
+		items := []freeItem{}
+		for seq < tailSeq {
+			items = append(items, freeItem{seq, LNode(page).getPtr(seq2idx(seq))})
+			seq++
+			if seq2idx(seq) == 0 {
+				break
+			}
+		}
+		list[node] = items
+		if node == tailPage || seq2idx(seq) != 0 {
+			return list
+		}
+		node = LNode(page).getNext()
+	}
+}
+
+func formatFreeList(sb *strings.Builder, ptr uint64, node LNode, items []freeItem) {
+	fmt.Fprintf(sb, "page %d: free list node, seq %d, next %d, %d items\n",
+		ptr, pageSeq(node), node.getNext(), len(items))
+	for _, item := range items {
+		fmt.Fprintf(sb, "  item %d (slot %d): page %d\n", item.seq, seq2idx(item.seq), item.ptr)
+	}
+}
+
+// the header and the keys of a node, without reading past a damaged layout
+func formatNode(sb *strings.Builder, node BN) {
+	switch node.btype() {
+	case BN_LEAF:
+		sb.WriteString("leaf")
+	case BN_NODE:
+		sb.WriteString("branch")
+	default:
+		fmt.Fprintf(sb, "type %d", node.btype())
+	}
+	fmt.Fprintf(sb, ", seq %d, %d keys", pageSeq(node), node.nkeys())
+	if msg := nodeLayout(node); msg != "" {
+		fmt.Fprintf(sb, "\n  not a valid node: %s\n", msg)
+		return
+	}
+	fmt.Fprintf(sb, ", %d bytes\n", node.nbytes())
+	for i := uint16(0); i < node.nkeys(); i++ {
+		fmt.Fprintf(sb, "  [%d] @%d %s", i, node.kvPos(i), showBytes(node.getKey(i)))
+		if node.btype() == BN_NODE {
+			fmt.Fprintf(sb, " -> page %d", node.getPtr(i))
+			if val := node.getVal(i); len(val) == 8 {
+				fmt.Fprintf(sb, ", %d pairs", binary.LittleEndian.Uint64(val))
+			}
+		} else {
+			fmt.Fprintf(sb, " = %s", showBytes(node.getVal(i)))
+		}
+		if i > 0 && bytes.Compare(node.getKey(i-1), node.getKey(i)) >= 0 {
+			sb.WriteString("  out of order")
+		}
+		sb.WriteByte('\n')
+	}
+}
+
+// quoted and cut after PAGE_SHOW_BYTES
+func showBytes(data []byte) string {
+	if len(data) <= PAGE_SHOW_BYTES {
+		return fmt.Sprintf("%q", data)
+	}
+	return fmt.Sprintf("%q... (%d bytes)", data[:PAGE_SHOW_BYTES], len(data))
+}
+
+// the bytes like `hexdump -C`, a run of the same lines is a "*"
+func hexDump(sb *strings.Builder, data []byte) {
+	var last []byte
+	repeated := false
+	for off := 0; off < len(data); off += 16 {
+		line := data[off:min(off+16, len(data))]
+		if last != nil && bytes.Equal(line, last) {
+			if !repeated {
+				sb.WriteString("*\n")
+				repeated = true
+			}
+			continue
+		}
+		last, repeated = line, false
+		fmt.Fprintf(sb, "%08x ", off)
+		for i := 0; i < 16; i++ {
+			if i == 8 {
+				sb.WriteByte(' ')
+			}
+			if i < len(line) {
+				fmt.Fprintf(sb, " %02x", line[i])
+			} else {
+				sb.WriteString("   ")
+			}
+		}
+		sb.WriteString("  |")
+		for _, b := range line {
+			if b >= 32 && b <= 126 {
+				sb.WriteByte(b)
+			} else {
+				sb.WriteByte('.')
+			}
+		}
+		sb.WriteString("|\n")
+	}
+	fmt.Fprintf(sb, "%08x\n", len(data))
+}
@@ -0,0 +1,69 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInspectPage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+	for round := 0; round < 3; round++ {
+		tx := db.Begin()
+		for i := 0; i < 500; i++ {
+			tx.Set([]byte(fmt.Sprintf("k%04d", i)), bytes.Repeat([]byte{'x'}, 100))
+		}
+		tx.Commit()
+	}
+	db.Close()
+
+	data, _ := os.ReadFile(path)
+	field := func(pos int) uint64 {
+		return binary.LittleEndian.Uint64(data[pos : pos+8])
+	}
+	root, head, tail := field(16), field(32), field(48)
+	leaf := BN(data[root*BT_PAGE_SIZE:][:BT_PAGE_SIZE]).getPtr(1)
+	free := LNode(data[head*BT_PAGE_SIZE:][:BT_PAGE_SIZE]).getPtr(seq2idx(field(40)))
+
+	for _, tc := range []struct {
+		ptr  uint64
+		want []string
+	}{
+		{0, []string{"page 0: meta", fmt.Sprintf("root            %d", root), "|mydb"}},
+		{root, []string{"branch", "[1] @", fmt.Sprintf("-> page %d", leaf)}},
+		{leaf, []string{"leaf", `"xxxxxxxx`, "(100 bytes)", "\n*\n", "00001000\n"}},
+		{head, []string{fmt.Sprintf("page %d: free list node", head), "(slot "}},
+		{tail, []string{"free list node"}},
+		{free, []string{fmt.Sprintf("page %d (free, item %d of the free list): ", free, field(40))}},
+	} {
+		got, err := InspectPage(path, tc.ptr)
+		if err != nil {
+			t.Fatalf("InspectPage(%d): %v", tc.ptr, err)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(got, want) {
+				t.Fatalf("InspectPage(%d) has no %q:\n%s", tc.ptr, want, got)
+			}
+		}
+	}
+
+	// damaged pages are shown as far as they can be read
+	node := BN(data[leaf*BT_PAGE_SIZE:][:BT_PAGE_SIZE])
+	binary.LittleEndian.PutUint16(node[offsetPos(node, 1):], 60000)
+	copy(data, "not a database!!")
+	os.WriteFile(path, data, 0o644)
+	if got, _ := InspectPage(path, leaf); !strings.Contains(got, "not a valid node: key 0: 109 bytes, the offsets have 60000") {
+		t.Fatalf("InspectPage() of a bad node:\n%s", got)
+	}
+	if got, _ := InspectPage(path, 0); !strings.Contains(got, "bad signature") {
+		t.Fatalf("InspectPage() of a bad meta page:\n%s", got)
+	}
+	if _, err := InspectPage(path, uint64(len(data)/BT_PAGE_SIZE)); err == nil {
+		t.Fatal("InspectPage() past the end of the file")
+	}
+}
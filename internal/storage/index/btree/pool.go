@@ -0,0 +1,165 @@
+package btree
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// The buffer pool reads the pages of the file with pread into a fixed
+// number of frames instead of mapping the file, set KV.PoolPages. the
+// memory of the database is then the pool, the updates of the writer and
+// the pages still held by transactions, whatever the size of the file.
+//
+// the frames are split in POOL_SHARDS by page number, each evicts with the
+// clock algorithm: a hit sets the reference bit of the frame, the hand
+// clears the bits it passes and evicts the first frame without one.
+//
+// an evicted frame is dropped rather than reused, so a page handed out
+// stays valid while a transaction holds it (a key, a value, a cursor) and
+// pages need no pinning. the memory is freed by the GC once no transaction
+// refers to it. the updates of the writer stay in memory until their batch
+// is written (db.page.updates), written pages replace their frames.
+//
+// pages reachable from a version are never overwritten while it has
+// readers, so a frame is never stale for the readers that can get it.
+// read only databases can't use the pool: the writer is another process
+// and its writes can't update the frames.
+
+const POOL_SHARDS = 16
+
+type bufferPool struct {
+	fd     int
+	shards [POOL_SHARDS]poolShard
+
+	// since the pool was created, see KV.Buffers
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+
+	// the counters at the last report to KV.Metrics
+	reportMu sync.Mutex
+	reported [3]uint64
+}
+
+type poolShard struct {
+	mu     sync.Mutex
+	cap    int
+	frames map[uint64]int // page number -> index in ring
+	ring   []poolFrame
+	hand   int
+}
+
+type poolFrame struct {
+	ptr  uint64
+	page []byte
+	ref  bool
+}
+
+// a pool of about `pages` frames of the file `fd`
+func newBufferPool(fd int, pages int) *bufferPool {
+	p := &bufferPool{fd: fd}
+	for i := range p.shards {
+		p.shards[i].cap = max(1, (pages+POOL_SHARDS-1)/POOL_SHARDS)
+		p.shards[i].frames = map[uint64]int{}
+	}
+	return p
+}
+
+func (p *bufferPool) get(ptr uint64) []byte {
+	s := &p.shards[ptr%POOL_SHARDS]
+	s.mu.Lock()
+	if i, ok := s.frames[ptr]; ok {
+		s.ring[i].ref = true
+		page := s.ring[i].page
+		s.mu.Unlock()
+		p.hits.Add(1)
+		return page
+	}
+	s.mu.Unlock()
+
+	p.misses.Add(1)
+	page := make([]byte, BT_PAGE_SIZE)
+	if n, err := syscall.Pread(p.fd, page, int64(ptr*BT_PAGE_SIZE)); err != nil || n != BT_PAGE_SIZE {
+		// like a fault of the mmap, there is no error path for reads
+		fault(ptr, "read %d bytes, %v", n, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i, ok := s.frames[ptr]; ok {
+		// loaded by another reader meanwhile
+		return s.ring[i].page
+	}
+	if s.insert(ptr, page) {
+		p.evictions.Add(1)
+	}
+	return page
+}
+
+// replaces the frames of pages written to the file, the others aren't
+// loaded
+func (p *bufferPool) update(pages map[uint64][]byte) {
+	for ptr, page := range pages {
+		s := &p.shards[ptr%POOL_SHARDS]
+		s.mu.Lock()
+		if i, ok := s.frames[ptr]; ok {
+			s.ring[i].page = page
+		}
+		s.mu.Unlock()
+	}
+}
+
+// the number of pages in the pool
+func (p *bufferPool) len() int {
+	n := 0
+	for i := range p.shards {
+		s := &p.shards[i]
+		s.mu.Lock()
+		n += len(s.ring)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// the hits, misses and evictions
+func (p *bufferPool) counters() [3]uint64 {
+	return [3]uint64{p.hits.Load(), p.misses.Load(), p.evictions.Load()}
+}
+
+// reports the hits, misses and evictions since the last report, from the
+// readers that end and the batches of the committer
+func (p *bufferPool) report(db *KV) {
+	if db.Metrics == nil {
+		return
+	}
+	p.reportMu.Lock()
+	defer p.reportMu.Unlock()
+	cur := p.counters()
+	for i, name := range []string{METRIC_POOL_HITS, METRIC_POOL_MISSES, METRIC_POOL_EVICTIONS} {
+		db.count(name, cur[i]-p.reported[i])
+	}
+	p.reported = cur
+}
+
+// adds a frame, evicts one if the shard is full, with s.mu. returns
+// whether a frame was evicted.
+func (s *poolShard) insert(ptr uint64, page []byte) bool {
+	if len(s.ring) < s.cap {
+		s.frames[ptr] = len(s.ring)
+		s.ring = append(s.ring, poolFrame{ptr: ptr, page: page})
+		return false
+	}
+	for {
+		f := &s.ring[s.hand]
+		if f.ref {
+			f.ref = false
+			s.hand = (s.hand + 1) % len(s.ring)
+			continue
+		}
+		delete(s.frames, f.ptr)
+		*f = poolFrame{ptr: ptr, page: page}
+		s.frames[ptr] = s.hand
+		s.hand = (s.hand + 1) % len(s.ring)
+		return true
+	}
+}
@@ -0,0 +1,129 @@
+package btree
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	m := &testMetrics{counters: map[string]uint64{}, gauges: map[string]float64{}, durations: map[string]int{}}
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, PoolPages: 32, Metrics: m}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ref := map[string]string{}
+	write := func(round int) {
+		tx := db.Begin()
+		for i := 0; i < 2000; i++ {
+			k, v := fmt.Sprintf("k%04d", i), fmt.Sprintf("%d-%d", round, i)
+			tx.Set([]byte(k), []byte(v))
+			ref[k] = v
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(0)
+
+	// a reader keeps its version while pages are reused and rewritten
+	old := db.BeginRead()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i += 7 {
+			k := fmt.Sprintf("k%04d", i)
+			if v, ok := old.Get([]byte(k)); !ok || string(v) != fmt.Sprintf("0-%d", i) {
+				t.Errorf("old Get(%s) = %q, %v", k, v, ok)
+				return
+			}
+		}
+	}()
+	for round := 1; round < 5; round++ {
+		write(round)
+	}
+	wg.Wait()
+	old.Rollback()
+	write(5) // reuses the pages the reader kept
+	assertKV(t, db, ref)
+
+	s := db.Buffers()
+	if s.Mapped != 0 || s.Pool == 0 || s.Pool > 32+POOL_SHARDS || s.PoolHits == 0 || s.PoolMisses == 0 || s.PoolEvictions == 0 {
+		t.Fatalf("Buffers() = %+v", s)
+	}
+	tx := db.BeginRead()
+	if n := tx.Resident(); n == 0 || n > 32+POOL_SHARDS {
+		t.Fatalf("Resident() = %d", n)
+	}
+	tx.Rollback()
+
+	// a restored file gets a pool of its own, readers of the old one keep it
+	snap := path + ".snap"
+	if err := db.Snapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+	restored := map[string]string{}
+	for k, v := range ref {
+		restored[k] = v
+	}
+	write(6)
+	old = db.BeginRead()
+	if err := db.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := old.Get([]byte("k0001")); string(v) != "6-1" {
+		t.Fatalf("Get() of the old file = %q", v)
+	}
+	old.Rollback()
+	ref = restored
+	assertKV(t, db, ref)
+	db.Close()
+	for _, name := range []string{METRIC_POOL_HITS, METRIC_POOL_MISSES, METRIC_POOL_EVICTIONS} {
+		if m.counters[name] == 0 {
+			t.Fatalf("no %s: %v", name, m.counters)
+		}
+	}
+
+	db = &KV{Path: path, PoolPages: 32}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	assertKV(t, db, ref)
+	db.Close()
+
+	if err := (&KV{Path: path, PoolPages: 32, ReadOnly: true}).Open(); err == nil {
+		t.Fatal("a buffer pool with ReadOnly")
+	}
+}
+
+// the reads of the writer are counted without readers
+func TestBufferPoolWriter(t *testing.T) {
+	m := &testMetrics{counters: map[string]uint64{}, gauges: map[string]float64{}, durations: map[string]int{}}
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), PoolPages: 16, Metrics: m}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for round := 0; round < 3; round++ {
+		tx := db.Begin()
+		for i := 0; i < 2000; i++ {
+			tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprint(round)))
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := db.Buffers()
+	if s.PoolMisses == 0 || s.PoolEvictions == 0 {
+		t.Fatalf("Buffers() = %+v", s)
+	}
+	// the batch reports the reads of its transaction
+	db.Set([]byte("k"), nil)
+	s = db.Buffers()
+	if m.counters[METRIC_POOL_MISSES] != s.PoolMisses || m.counters[METRIC_POOL_EVICTIONS] != s.PoolEvictions {
+		t.Fatalf("counters %v, Buffers() = %+v", m.counters, s)
+	}
+}
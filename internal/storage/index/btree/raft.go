@@ -0,0 +1,167 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// The pieces a consensus layer like hashicorp/raft or etcd/raft needs to
+// use the database as its state machine. the leader proposes commands made
+// with EncodeCommand, every node applies the committed ones in log order
+// with ApplyCommand. a command is applied in one write transaction that
+// also stores its log index in the meta page, so after a restart the node
+// knows the last applied index from the file (Tx.Applied) and replays only
+// the commands after it.
+//
+// a command carries the clock of the proposer, versions and expiry of the
+// command use it, so every node writes the same keys. the sweeper uses the
+// local clock, it must be off (SweepInterval 0) on the nodes.
+//
+// snapshots of the state machine are copies made by Backup, they have the
+// applied index in their meta page. InstallSnapshot replaces the database
+// with one.
+//
+// command
+// | time | n  | entry len | entry | ... |
+// |  8B  | 4B |    4B     |       |     |
+//
+// the entries are encoded like the entries of the changefeed.
+
+var ErrBadCommand = errors.New("bad command")
+
+// encodes the changes of a command, Seq of the entries is ignored. Bucket
+// is a top-level bucket, created if it doesn't exist.
+func EncodeCommand(now time.Time, ops []Entry) []byte {
+	out := binary.LittleEndian.AppendUint64(nil, uint64(now.UnixNano()))
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(ops)))
+	for i := range ops {
+		e := encodeEntry(&ops[i])
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(e)))
+		out = append(out, e...)
+	}
+	return out
+}
+
+// decodes a command made by EncodeCommand
+func DecodeCommand(data []byte) (time.Time, []Entry, error) {
+	if len(data) < 12 {
+		return time.Time{}, nil, ErrBadCommand
+	}
+	now := time.Unix(0, int64(binary.LittleEndian.Uint64(data)))
+	n := binary.LittleEndian.Uint32(data[8:])
+	data = data[12:]
+	var ops []Entry
+	for i := uint32(0); i < n; i++ {
+		if len(data) < 4 {
+			return now, nil, ErrBadCommand
+		}
+		size := int(binary.LittleEndian.Uint32(data))
+		if len(data) < 4+size {
+			return now, nil, ErrBadCommand
+		}
+		// the key part of a changefeed entry, the sequence is unused
+		e, ok := decodeEntry(make([]byte, 12), data[4:4+size])
+		if !ok || e.Op != OP_SET && e.Op != OP_DEL {
+			return now, nil, ErrBadCommand
+		}
+		ops = append(ops, e)
+		data = data[4+size:]
+	}
+	if len(data) != 0 {
+		return now, nil, ErrBadCommand
+	}
+	return now, ops, nil
+}
+
+// applies the command at the log index `index` and stores the index. a
+// command at or before the applied index was applied already, it is
+// skipped. the result is the same on every node.
+func (db *KV) ApplyCommand(index uint64, cmd []byte) error {
+	now, ops, err := DecodeCommand(cmd)
+	if err != nil {
+		return fmt.Errorf("command %d: %w", index, err)
+	}
+	tx := db.Begin()
+	if index <= db.applied {
+		tx.Rollback()
+		return nil
+	}
+	tx.time = now.UnixNano()
+	for _, op := range ops {
+		if err := tx.applyOp(&op); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("command %d: %w", index, err)
+		}
+	}
+	tx.SetApplied(index)
+	return tx.Commit()
+}
+
+func (tx *Tx) applyOp(op *Entry) error {
+	if op.Bucket == nil {
+		if op.Op == OP_DEL {
+			_, err := tx.Del(op.Key)
+			return err
+		}
+		return tx.Set(op.Key, op.Value)
+	}
+	b, err := tx.CreateBucketIfNotExists(op.Bucket)
+	if err != nil {
+		return err
+	}
+	if op.Op == OP_DEL {
+		_, err := b.Del(op.Key)
+		return err
+	}
+	return b.Set(op.Key, op.Value)
+}
+
+// the log index of the last command applied in the version of the transaction
+func (tx *Tx) Applied() uint64 {
+	if tx.writable {
+		return tx.db.applied
+	}
+	return binary.LittleEndian.Uint64(tx.base[80:88])
+}
+
+// stores the log index of the last command applied with the transaction,
+// for consensus layers that apply commands themselves
+func (tx *Tx) SetApplied(index uint64) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	tx.db.applied = index
+	return nil
+}
+
+// replaces the database with a snapshot read from `r`, a copy made by
+// Backup, see Restore
+func (db *KV) InstallSnapshot(r io.Reader) error {
+	tmp := db.Path + ".snapshot"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("KV.InstallSnapshot: %w", err)
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = db.Restore(tmp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("KV.InstallSnapshot: %w", err)
+	}
+	return nil
+}
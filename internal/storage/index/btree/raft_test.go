@@ -0,0 +1,83 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestApplyCommand(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Unix(1700000000, 0)
+	var log [][]byte
+	for i := 0; i < 100; i++ {
+		ops := []Entry{
+			{Op: OP_SET, Key: []byte(fmt.Sprintf("k%03d", i)), Value: []byte(fmt.Sprint(i))},
+			{Op: OP_SET, Bucket: []byte("b"), Key: []byte("last"), Value: []byte(fmt.Sprint(i))},
+		}
+		if i > 0 {
+			ops = append(ops, Entry{Op: OP_DEL, Key: []byte(fmt.Sprintf("k%03d", i-1))})
+		}
+		log = append(log, EncodeCommand(now.Add(time.Duration(i)*time.Second), ops))
+	}
+	if _, ops, err := DecodeCommand(log[1]); err != nil || len(ops) != 3 || string(ops[2].Key) != "k000" {
+		t.Fatalf("DecodeCommand() = %v, %v", ops, err)
+	}
+
+	// log indexes start at 1
+	path := filepath.Join(dir, "a.db")
+	a := openKV(t, path)
+	for i, cmd := range log[:50] {
+		if err := a.ApplyCommand(uint64(i+1), cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+	a = openKV(t, path)
+	defer a.Close()
+	tx := a.BeginRead()
+	if tx.Applied() != 50 {
+		t.Fatalf("Applied() after reopening = %d", tx.Applied())
+	}
+	tx.Rollback()
+	// replayed commands are skipped
+	for i, cmd := range log {
+		if err := a.ApplyCommand(uint64(i+1), cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.ApplyCommand(101, []byte("junk")); !errors.Is(err, ErrBadCommand) {
+		t.Fatalf("ApplyCommand() of a bad command = %v", err)
+	}
+
+	// a snapshot installs over a node that fell behind
+	var snap bytes.Buffer
+	if err := a.Backup(&snap); err != nil {
+		t.Fatal(err)
+	}
+	b := openKV(t, filepath.Join(dir, "b.db"))
+	defer b.Close()
+	b.ApplyCommand(1, log[0])
+	if err := b.InstallSnapshot(&snap); err != nil {
+		t.Fatal(err)
+	}
+	more := EncodeCommand(now, []Entry{{Op: OP_SET, Key: []byte("more"), Value: []byte("x")}})
+	a.ApplyCommand(101, more)
+	b.ApplyCommand(101, more)
+	for _, db := range []*KV{a, b} {
+		tx := db.BeginRead()
+		var keys []string
+		tx.Scan(nil, nil, func(key, val []byte) bool {
+			keys = append(keys, string(key)+"="+string(val))
+			return true
+		})
+		last, _ := tx.Bucket([]byte("b")).Get([]byte("last"))
+		if tx.Applied() != 101 || fmt.Sprint(keys) != "[k099=99 more=x]" || string(last) != "99" {
+			t.Fatalf("Applied() = %d, keys %v, last %s", tx.Applied(), keys, last)
+		}
+		tx.Rollback()
+	}
+}
@@ -0,0 +1,476 @@
+package btree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Repair is the last resort for a file whose meta page or branch nodes are
+// damaged. it scans every page of the file for leaves that look valid,
+// takes their key/value pairs and writes a new database with them, the
+// trees built bottom up like a compacted file.
+//
+// a leaf belongs to the tree of the root above it, following the newest
+// branch node that points to it. the roots are in the meta page and in the
+// bucket records of the catalog. if the meta page is damaged, the catalog
+// is the newest tree of bucket records and the main keyspace is unknown.
+// the pairs of leaves under no known root are in the bucket LOST_FOUND.
+// a key found in several leaves of a tree has the value of the newest.
+//
+// the free pages are skipped if the meta page and the free list are
+// intact. otherwise old versions of leaves are taken too: their keys are
+// in LOST_FOUND, deleted keys included.
+
+const LOST_FOUND = "lost+found"
+
+type RepairReport struct {
+	Pages     int // pages scanned, the meta page included
+	Leaves    int // leaves taken
+	Skipped   int // pages that aren't a valid node: free list nodes, damaged and empty pages
+	Free      int // pages of the free list skipped
+	Keys      int // pairs written
+	Buckets   int
+	LostFound int // pairs in LOST_FOUND
+	MetaOK    bool
+}
+
+// a tree of the repaired file: the keyspace and the catalog are at the
+// offsets of their roots in the meta page, 16 and 64. the trees of a bucket
+// at the offsets of the roots in its record.
+type repairTree struct {
+	bucket string // the catalog key
+	pos    int
+}
+
+var (
+	repairKeyspace  = repairTree{"", 16}
+	repairCatalog   = repairTree{"", 64}
+	repairLostFound = repairTree{string(bucketKey(nil, []byte(LOST_FOUND))), 0}
+)
+
+// a pair and the commit sequence of its leaf
+type repairPair struct {
+	val []byte
+	seq uint64
+}
+
+type repairer struct {
+	f      *os.File
+	report *RepairReport
+	seq    uint64            // the newest page
+	nodes  map[uint64]uint64 // the valid nodes and their commit sequences
+	kids   map[uint64][]uint64
+	leaves []uint64
+	parent map[uint64]uint64
+	roots  map[uint64]repairTree
+	pairs  map[repairTree]map[string]repairPair
+	maxKey int // the sizes of the meta page, 0 for the defaults if damaged
+	maxVal int
+}
+
+// writes the pairs of the valid leaves of the file at `path` to a new
+// database at `out`
+func Repair(path string, out string) (*RepairReport, error) {
+	if _, err := os.Stat(out); err == nil {
+		return nil, fmt.Errorf("repair: %s exists", out)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := &repairer{
+		f:      f,
+		report: &RepairReport{},
+		nodes:  map[uint64]uint64{},
+		kids:   map[uint64][]uint64{},
+		parent: map[uint64]uint64{},
+		roots:  map[uint64]repairTree{},
+		pairs:  map[repairTree]map[string]repairPair{},
+	}
+	applied, err := r.scan()
+	if err == nil {
+		r.collect()
+		tmp := out + ".tmp"
+		err = r.write(tmp, applied)
+		if err == nil {
+			err = os.Rename(tmp, out)
+		}
+		if err == nil {
+			err = syncDir(filepath.Dir(out))
+		}
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("repair %s: %w", path, err)
+	}
+	return r.report, nil
+}
+
+// reads the meta page and the free list if they are intact and the valid
+// nodes of the other pages, returns the applied index of the meta page
+func (r *repairer) scan() (uint64, error) {
+	fi, err := r.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	pages := uint64(fi.Size() / BT_PAGE_SIZE)
+	c := &checker{f: r.f, report: &CheckReport{}, owner: map[uint64]string{}}
+	free := map[uint64]bool{}
+	var applied uint64
+	if pages > 0 {
+		meta, err := c.read(0)
+		if err != nil {
+			return 0, err
+		}
+		if c.checkMeta(meta, pages) {
+			field := func(pos int) uint64 {
+				return binary.LittleEndian.Uint64(meta[pos : pos+8])
+			}
+			r.report.MetaOK = true
+			pages = field(24) // the pages after were never committed
+			r.seq = field(72)
+			applied = field(80)
+			r.maxKey, r.maxVal = metaSizes(meta)
+			c.flushed = pages
+			c.report.Seq = r.seq
+			items, err := c.freeList(field(32), field(40), field(48), field(56))
+			if err != nil {
+				return 0, err
+			}
+			if c.report.OK() {
+				for _, ptr := range items {
+					free[ptr] = true
+				}
+				r.report.Free = len(items)
+			}
+			if root := field(16); root != 0 {
+				r.roots[root] = repairKeyspace
+			}
+			if root := field(64); root != 0 {
+				r.roots[root] = repairCatalog
+			}
+		}
+	}
+	r.report.Pages = int(max(pages, 1))
+
+	maxSeq := r.seq
+	for ptr := uint64(1); ptr < pages; ptr++ {
+		if free[ptr] {
+			continue
+		}
+		page, err := c.read(ptr)
+		if err != nil {
+			return 0, err
+		}
+		node := BN(page)
+		if !validNode(node) || r.report.MetaOK && pageSeq(node) > maxSeq {
+			r.report.Skipped++
+			continue
+		}
+		r.nodes[ptr] = pageSeq(node)
+		r.seq = max(r.seq, pageSeq(node))
+		if node.btype() == BN_LEAF {
+			r.leaves = append(r.leaves, ptr)
+			continue
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			r.kids[ptr] = append(r.kids[ptr], node.getPtr(i))
+		}
+	}
+	// the parent of a node is the newest branch node pointing to it
+	for ptr, kids := range r.kids {
+		for _, kid := range kids {
+			if _, ok := r.nodes[kid]; !ok || kid == ptr {
+				continue
+			}
+			old, ok := r.parent[kid]
+			if !ok || r.nodes[ptr] > r.nodes[old] || r.nodes[ptr] == r.nodes[old] && ptr > old {
+				r.parent[kid] = ptr
+			}
+		}
+	}
+	return applied, nil
+}
+
+// a node with a valid layout and keys in order
+func validNode(node BN) bool {
+	if nodeLayout(node) != "" {
+		return false
+	}
+	for i := uint16(1); i < node.nkeys(); i++ {
+		if bytes.Compare(node.getKey(i-1), node.getKey(i)) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// the tree of the root above the node, false if there is no known root
+func (r *repairer) treeOf(ptr uint64) (repairTree, bool) {
+	// a cycle of damaged pointers ends at the height of any tree
+	for range 64 {
+		if tree, ok := r.roots[ptr]; ok {
+			return tree, true
+		}
+		parent, ok := r.parent[ptr]
+		if !ok {
+			return repairTree{}, false
+		}
+		ptr = parent
+	}
+	return repairTree{}, false
+}
+
+// the top of the branch nodes above the node
+func (r *repairer) topOf(ptr uint64) uint64 {
+	for range 64 {
+		parent, ok := r.parent[ptr]
+		if !ok {
+			break
+		}
+		ptr = parent
+	}
+	return ptr
+}
+
+func (r *repairer) leaf(ptr uint64) BN {
+	page := make([]byte, BT_PAGE_SIZE)
+	r.f.ReadAt(page, int64(ptr)*BT_PAGE_SIZE)
+	return BN(page)
+}
+
+// a catalog key and a bucket record, see bucketKey and encodeBucket
+func catalogPair(key, val []byte) bool {
+	if len(key) == 0 {
+		return len(val) == 0
+	}
+	return bytes.HasSuffix(key, []byte{0, 1}) && len(val) >= 16 && len(val) <= 52
+}
+
+// takes the pairs of the leaves: the catalog first for the roots of the
+// buckets, then the others
+func (r *repairer) collect() {
+	if !r.report.MetaOK {
+		r.guessCatalog()
+	}
+	var rest []uint64
+	for _, ptr := range r.leaves {
+		if tree, ok := r.treeOf(ptr); ok && tree == repairCatalog {
+			r.take(repairCatalog, ptr)
+		} else {
+			rest = append(rest, ptr)
+		}
+	}
+	for key, pair := range r.pairs[repairCatalog] {
+		for _, pos := range []int{0, 24, 32} {
+			if len(pair.val) < pos+8 || pos == 32 && len(pair.val) < 52 {
+				break
+			}
+			root := binary.LittleEndian.Uint64(pair.val[pos:])
+			if _, ok := r.roots[root]; !ok && root != 0 {
+				r.roots[root] = repairTree{key, pos}
+			}
+		}
+	}
+	for _, ptr := range rest {
+		tree, ok := r.treeOf(ptr)
+		if !ok {
+			tree = repairLostFound
+		}
+		r.take(tree, ptr)
+	}
+}
+
+// the catalog of a damaged meta page is the newest top of leaves with
+// bucket records only
+func (r *repairer) guessCatalog() {
+	bad := map[uint64]bool{}
+	records := map[uint64]bool{}
+	for _, ptr := range r.leaves {
+		top := r.topOf(ptr)
+		if bad[top] {
+			continue
+		}
+		node := r.leaf(ptr)
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if !catalogPair(node.getKey(i), node.getVal(i)) {
+				bad[top] = true
+				break
+			}
+			records[top] = records[top] || len(node.getKey(i)) > 0
+		}
+	}
+	best, found := uint64(0), false
+	for top, ok := range records {
+		if !ok || bad[top] {
+			continue
+		}
+		if !found || r.nodes[top] > r.nodes[best] || r.nodes[top] == r.nodes[best] && top > best {
+			best, found = top, true
+		}
+	}
+	if found {
+		r.roots[best] = repairCatalog
+	}
+}
+
+// adds the pairs of the leaf to the tree, the newest value of a key stays
+func (r *repairer) take(tree repairTree, ptr uint64) {
+	r.report.Leaves++
+	pairs := r.pairs[tree]
+	if pairs == nil {
+		pairs = map[string]repairPair{}
+		r.pairs[tree] = pairs
+	}
+	node := r.leaf(ptr)
+	seq := pageSeq(node)
+	for i := uint16(0); i < node.nkeys(); i++ {
+		key := string(node.getKey(i))
+		if old, ok := pairs[key]; ok && old.seq > seq {
+			continue
+		}
+		pairs[key] = repairPair{val: slices.Clone(node.getVal(i)), seq: seq}
+	}
+}
+
+// writes the new database like Compact, the trees of the buckets first
+func (r *repairer) write(tmp string, applied uint64) error {
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c := &compactor{w: bufio.NewWriter(f), seq: r.seq + 1, next: 2}
+	c.w.Write(make([]byte, BT_PAGE_SIZE))
+	free := make([]byte, BT_PAGE_SIZE)
+	setPageSeq(free, c.seq)
+	c.w.Write(free)
+
+	records := r.pairs[repairCatalog]
+	if records == nil {
+		records = map[string]repairPair{}
+	}
+	if lost := r.pairs[repairLostFound]; len(lost) > 0 {
+		if _, ok := records[repairLostFound.bucket]; !ok {
+			records[repairLostFound.bucket] = repairPair{val: encodeBucket(&Bucket{})}
+		}
+		r.report.LostFound = len(lost)
+		if _, ok := lost[""]; ok {
+			r.report.LostFound-- // the empty key of the root
+		}
+	}
+	catalog := map[string][]byte{}
+	for key, rec := range records {
+		if !catalogPair([]byte(key), rec.val) {
+			continue // a pair of a leaf that was taken for the catalog
+		}
+		val := slices.Clone(rec.val)
+		if key != "" {
+			r.report.Buckets++
+			for _, pos := range []int{0, 24, 32} {
+				if len(val) < pos+8 || pos == 32 && len(val) < 52 {
+					break
+				}
+				root := r.build(c, r.pairs[repairTree{key, pos}], pos == 0)
+				binary.LittleEndian.PutUint64(val[pos:], root)
+			}
+		}
+		catalog[key] = val
+	}
+	root := r.build(c, r.pairs[repairKeyspace], true)
+	catalogPairs := map[string]repairPair{}
+	for key, val := range catalog {
+		catalogPairs[key] = repairPair{val: val}
+	}
+	catalogRoot := r.build(c, catalogPairs, false)
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	meta := make([]byte, BT_PAGE_SIZE)
+	copy(meta, DB_SIG)
+	binary.LittleEndian.PutUint64(meta[16:], root)
+	binary.LittleEndian.PutUint64(meta[24:], c.next)
+	binary.LittleEndian.PutUint64(meta[32:], 1)
+	binary.LittleEndian.PutUint64(meta[48:], 1)
+	binary.LittleEndian.PutUint64(meta[64:], catalogRoot)
+	binary.LittleEndian.PutUint64(meta[72:], c.seq)
+	binary.LittleEndian.PutUint64(meta[80:], applied)
+	binary.LittleEndian.PutUint32(meta[88:], uint32(r.maxKey))
+	binary.LittleEndian.PutUint32(meta[92:], uint32(r.maxVal))
+	if _, err := f.WriteAt(meta, 0); err != nil {
+		return fmt.Errorf("write meta page: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writes a tree of the pairs bottom up and returns its root, 0 if there
+// are none. the first key is the empty one like in BT.Insert.
+func (r *repairer) build(c *compactor, pairs map[string]repairPair, count bool) uint64 {
+	if len(pairs) == 0 {
+		return 0
+	}
+	keys := make([]string, 0, len(pairs)+1)
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	if _, ok := pairs[""]; !ok {
+		keys = append(keys, "")
+	}
+	slices.Sort(keys)
+	if count {
+		r.report.Keys += len(keys) - 1
+	}
+
+	type entry struct {
+		key []byte
+		val []byte
+		ptr uint64
+	}
+	level := make([]entry, len(keys))
+	for i, key := range keys {
+		level[i] = entry{key: []byte(key), val: pairs[key].val}
+	}
+	btype := uint16(BN_LEAF)
+	for {
+		var next []entry
+		for start := 0; start < len(level); {
+			// as many entries as fit in a page
+			end, size := start, HEADER
+			for end < len(level) {
+				kv := 10 + 4 + len(level[end].key) + len(level[end].val)
+				if end > start && size+kv > BT_PAGE_SIZE {
+					break
+				}
+				size += kv
+				end++
+			}
+			node := BN(make([]byte, BT_PAGE_SIZE))
+			node.setHeader(btype, uint16(end-start))
+			for i, e := range level[start:end] {
+				nodeAppendKV(node, uint16(i), e.ptr, e.key, e.val)
+			}
+			// the value of a kid is the count of its subtree
+			next = append(next, entry{key: level[start].key, val: kidVal(node, true), ptr: c.write(node)})
+			start = end
+		}
+		if len(next) == 1 {
+			return next[0].ptr
+		}
+		level, btype = next, BN_NODE
+	}
+}
@@ -0,0 +1,140 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db := openKV(t, path)
+	tx := db.Begin()
+	users, _ := tx.CreateBucket([]byte("users"))
+	users.CreateBucket([]byte("nested"))
+	tx.Commit()
+	ref := map[string]string{}
+	refUsers := map[string]string{}
+	for round := 0; round < 5; round++ {
+		tx := db.Begin()
+		for i := 0; i < 1000; i++ {
+			key, val := fmt.Sprintf("k%04d", i), fmt.Sprintf("%d%s", round, bytes.Repeat([]byte{'x'}, 100))
+			tx.Set([]byte(key), []byte(val))
+			ref[key] = val
+			key, val = fmt.Sprintf("u%04d", i), fmt.Sprint(round)
+			tx.Bucket([]byte("users")).Set([]byte(key), []byte(val))
+			refUsers[key] = val
+		}
+		tx.Commit()
+	}
+	tx = db.Begin()
+	for i := 0; i < 1000; i += 3 {
+		key := fmt.Sprintf("k%04d", i)
+		tx.Del([]byte(key))
+		delete(ref, key)
+	}
+	tx.Bucket([]byte("users")).Bucket([]byte("nested")).Set([]byte("a"), []byte("1"))
+	tx.SetApplied(7)
+	tx.Commit()
+	db.Close()
+	data, _ := os.ReadFile(path)
+
+	// the pairs of the main keyspace, of users, of users/nested and of
+	// lost+found in the repaired file
+	repair := func(name string, data []byte) (*RepairReport, [4]map[string]string) {
+		t.Helper()
+		damaged := filepath.Join(dir, name+".db")
+		out := filepath.Join(dir, name+".repaired")
+		os.WriteFile(damaged, data, 0o644)
+		report, err := Repair(damaged, out)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := Repair(damaged, out); err == nil {
+			t.Fatalf("%s: Repair() over an existing file succeeded", name)
+		}
+		check, err := Check(out)
+		if err != nil || !check.OK() {
+			t.Fatalf("%s: Check() of the repaired file: %v %v", name, err, check.Errors)
+		}
+		db := openKV(t, out)
+		defer db.Close()
+		tx := db.BeginRead()
+		defer tx.Rollback()
+		var pairs [4]map[string]string
+		scan := func(i int, b *Bucket) {
+			pairs[i] = map[string]string{}
+			fn := func(key, val []byte) bool {
+				pairs[i][string(key)] = string(val)
+				return true
+			}
+			if b == nil {
+				tx.Scan(nil, nil, fn)
+			} else {
+				b.Scan(nil, nil, fn)
+			}
+		}
+		scan(0, nil)
+		if b := tx.Bucket([]byte("users")); b != nil {
+			scan(1, b)
+			if nested := b.Bucket([]byte("nested")); nested != nil {
+				scan(2, nested)
+			}
+		}
+		if b := tx.Bucket([]byte(LOST_FOUND)); b != nil {
+			scan(3, b)
+		}
+		return report, pairs
+	}
+	equal := func(name string, got, want map[string]string) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("%s: %d keys, want %d", name, len(got), len(want))
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Fatalf("%s: %s = %q, want %q", name, k, got[k], v)
+			}
+		}
+	}
+
+	report, pairs := repair("healthy", data)
+	if !report.MetaOK || report.Free == 0 || report.LostFound != 0 || report.Buckets != 2 {
+		t.Fatalf("Repair() = %+v", report)
+	}
+	equal("healthy", pairs[0], ref)
+	equal("healthy users", pairs[1], refUsers)
+	equal("healthy nested", pairs[2], map[string]string{"a": "1"})
+
+	// the root of the main keyspace is lost, its leaves are in lost+found
+	damaged := append([]byte{}, data...)
+	root := binary.LittleEndian.Uint64(damaged[16:24])
+	clear(damaged[root*BT_PAGE_SIZE:][:BT_PAGE_SIZE])
+	report, pairs = repair("root", damaged)
+	if !report.MetaOK || report.Keys != len(ref)+len(refUsers)+1 || report.LostFound != len(ref) {
+		t.Fatalf("Repair() = %+v", report)
+	}
+	equal("root", pairs[0], map[string]string{})
+	equal("root lost+found", pairs[3], ref)
+	equal("root users", pairs[1], refUsers)
+
+	// the meta page is lost, the catalog is the newest tree of bucket
+	// records and old versions of the keyspace are taken too
+	damaged = append([]byte{}, data...)
+	clear(damaged[:BT_PAGE_SIZE])
+	report, pairs = repair("meta", damaged)
+	if report.MetaOK || report.Free != 0 {
+		t.Fatalf("Repair() = %+v", report)
+	}
+	equal("meta users", pairs[1], refUsers)
+	equal("meta nested", pairs[2], map[string]string{"a": "1"})
+	for k, v := range ref {
+		if pairs[3][k] != v {
+			t.Fatalf("meta lost+found: %s = %q, want %q", k, pairs[3][k], v)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+// Replication ships the durable batches of a leader to followers. A
+// follower starts from a snapshot of a durable version of the leader, see
+// Replication.Snapshot and Restore, then applies every batch made durable
+// after it: the written pages and the meta page, with the same fsyncs as
+// the commits of the leader, see Apply. the pages reachable from the meta
+// page are the same in both files.
+//
+// batches overwrite free pages in place and the follower doesn't know
+// which version freed them, so Apply waits for the readers of older
+// versions to end first: a long read transaction of the follower delays
+// replication. a restored snapshot replaces the file,
+// readers of the old file keep reading it until they end. the follower
+// rejects writes with ErrReplica, watchers of a follower see no changes.
+
+var (
+	ErrReplica        = errors.New("the database is a replica")
+	ErrReplicaLagged  = errors.New("replica fell behind")
+	ErrReplicaClosed  = errors.New("replication closed")
+	errReplicaRestore = errors.New("the replica was restored from a snapshot")
+)
+
+// batches buffered per replication, a follower further behind is dropped
+const REPLICA_BUFFER = 4096
+
+// a durable batch: the meta page and the pages written, by page number
+type Delta struct {
+	Meta  []byte
+	Pages map[uint64][]byte
+}
+
+type Replication struct {
+	// the batches after the snapshot, closed when the replication ends, see Err
+	C <-chan Delta
+
+	c    chan Delta
+	db   *KV
+	snap *Tx // the version of the snapshot until it is sent
+	seq  uint64
+	err  error
+}
+
+// starts a replication from the last durable version. the pages of the
+// snapshot are kept until Snapshot or Close.
+func (db *KV) Replicate() *Replication {
+	c := make(chan Delta, REPLICA_BUFFER)
+	r := &Replication{C: c, c: c, db: db}
+	db.rmu.Lock()
+	defer db.rmu.Unlock()
+	r.snap = db.beginRead()
+	r.seq = r.snap.Seq()
+	db.replicas[r] = struct{}{}
+	return r
+}
+
+// the commit sequence of the snapshot, the batches on C follow it
+func (r *Replication) Seq() uint64 {
+	return r.seq
+}
+
+// calls `fn` for the pages of the snapshot in order and for the meta page,
+// page 0, last. a file of these pages opens as the database of the snapshot.
+func (r *Replication) Snapshot(fn func(ptr uint64, page []byte) error) error {
+	r.db.rmu.Lock()
+	tx := r.snap
+	r.snap = nil
+	r.db.rmu.Unlock()
+	if tx == nil {
+		return errors.New("no snapshot")
+	}
+	defer tx.Rollback()
+	flushed := binary.LittleEndian.Uint64(tx.base[24:32])
+	for ptr := uint64(1); ptr < flushed; ptr++ {
+		if err := fn(ptr, tx.pageRead(ptr)); err != nil {
+			return err
+		}
+	}
+	meta := make([]byte, BT_PAGE_SIZE)
+	copy(meta, tx.base)
+	return fn(0, meta)
+}
+
+// stops the replication and closes C
+func (r *Replication) Close() {
+	r.db.rmu.Lock()
+	tx := r.snap
+	r.snap = nil
+	r.stop(ErrReplicaClosed)
+	r.db.rmu.Unlock()
+	if tx != nil {
+		tx.Rollback()
+	}
+}
+
+// the reason C was closed: ErrReplicaClosed, ErrReplicaLagged or the
+// closing of the database. nil while C is open.
+func (r *Replication) Err() error {
+	r.db.rmu.Lock()
+	defer r.db.rmu.Unlock()
+	return r.err
+}
+
+// with db.rmu
+func (r *Replication) stop(err error) {
+	if r.err != nil {
+		return
+	}
+	r.err = err
+	close(r.c)
+	delete(r.db.replicas, r)
+}
+
+// sends a durable batch to the replications, with db.rmu. nil pages end
+// them, the version doesn't follow the previous one.
+func (db *KV) ship(meta []byte, pages map[uint64][]byte) {
+	for r := range db.replicas {
+		if pages == nil {
+			r.stop(errReplicaRestore)
+			continue
+		}
+		select {
+		case r.c <- Delta{Meta: meta, Pages: pages}:
+		default:
+			r.stop(ErrReplicaLagged)
+		}
+	}
+}
+
+func (db *KV) closeReplicas() {
+	db.rmu.Lock()
+	defer db.rmu.Unlock()
+	for r := range db.replicas {
+		r.stop(errors.New("database closed"))
+	}
+}
+
+// applies a batch of the leader, the next one after the version of the
+// replica. pages of older versions are overwritten in place, so Apply
+// waits for their readers to end.
+func (db *KV) Apply(d Delta) error {
+	if !db.Replica {
+		return errors.New("KV.Apply: not a replica")
+	}
+	if len(d.Meta) < META_SIZE {
+		return errors.New("KV.Apply: bad meta page")
+	}
+	meta := bytes.Clone(d.Meta[:META_SIZE])
+	flushed := binary.LittleEndian.Uint64(meta[24:32])
+	for ptr, page := range d.Pages {
+		if ptr == 0 || ptr >= flushed || len(page) != BT_PAGE_SIZE {
+			return fmt.Errorf("KV.Apply: bad page %d", ptr)
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := checkMeta(meta, int64(flushed)*BT_PAGE_SIZE); err != nil {
+		return fmt.Errorf("KV.Apply: %w", err)
+	}
+	db.rmu.Lock()
+	for db.oldestReader() < db.version {
+		db.ended.Wait()
+	}
+	db.rmu.Unlock()
+
+	if err := extendMmap(db, int(flushed)*BT_PAGE_SIZE); err != nil {
+		return fmt.Errorf("KV.Apply: %w", err)
+	}
+	for ptr, page := range d.Pages {
+		if _, err := syscall.Pwrite(db.fd, page, int64(ptr*BT_PAGE_SIZE)); err != nil {
+			return fmt.Errorf("KV.Apply: %w", err)
+		}
+	}
+	if err := syscall.Fsync(db.fd); err != nil {
+		return fmt.Errorf("KV.Apply: %w", err)
+	}
+	if db.pool.cur != nil {
+		db.pool.cur.update(d.Pages)
+	}
+	for ptr := range d.Pages {
+		db.filters.drop(ptr)
+	}
+	if _, err := syscall.Pwrite(db.fd, meta, 0); err != nil {
+		return fmt.Errorf("KV.Apply: write meta page: %w", err)
+	}
+	if err := syscall.Fsync(db.fd); err != nil {
+		return fmt.Errorf("KV.Apply: %w", err)
+	}
+	db.count(METRIC_PAGE_WRITES, uint64(len(d.Pages))+1)
+	db.count(METRIC_FSYNCS, 2)
+	prev := db.seq
+	loadMeta(db, meta)
+	db.free.setMaxSeq()
+	db.queue.staged = meta
+	commitVersion(db, meta, d.Pages)
+	db.commitEvents(prev+1, db.seq)
+	return nil
+}
+
+// replaces the database with the file at `file`, a snapshot of the leader
+// or a copy made by Backup. queued updates are made durable first. the
+// file is renamed to Path, readers of the old file keep it until they end.
+func (db *KV) Restore(file string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.drain(); err != nil {
+		return fmt.Errorf("KV.Restore: %w", err)
+	}
+	fd, err := syscall.Open(file, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("KV.Restore: %w", err)
+	}
+	finfo := syscall.Stat_t{}
+	meta := make([]byte, META_SIZE)
+	if err = syscall.Fstat(fd, &finfo); err == nil {
+		_, err = syscall.Pread(fd, meta, 0)
+	}
+	if err == nil {
+		err = checkMeta(meta, finfo.Size)
+	}
+	if err == nil {
+		err = syscall.Fsync(fd)
+	}
+	var chunk []byte
+	if err == nil && db.pool.cur == nil {
+		alloc := 64 << 20
+		for alloc < int(finfo.Size) {
+			alloc *= 2
+		}
+		chunk, err = syscall.Mmap(fd, 0, alloc, syscall.PROT_READ, syscall.MAP_SHARED)
+	}
+	if err == nil {
+		if err = os.Rename(file, db.Path); err != nil {
+			syscall.Munmap(chunk)
+		}
+	}
+	if err == nil {
+		err = syncDir(path.Dir(db.Path))
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("KV.Restore: %w", err)
+	}
+
+	db.rmu.Lock()
+	if db.pool.cur != nil {
+		// readers of the old file read it until they end
+		db.pool.retired = append(db.pool.retired, db.pool.cur)
+		db.pool.cur = newBufferPool(fd, db.PoolPages)
+	} else {
+		db.mmap.retired = append(db.mmap.retired, db.mmap.chunks...)
+		db.mmap.chunks = [][]byte{chunk}
+		db.mmap.total = len(chunk)
+	}
+	if db.filters != nil {
+		// readers of the old file keep its filters
+		db.filters = newLeafFilters(db.BloomBits)
+		db.tree.filters = db.filters
+		db.catalog.filters = db.filters
+	}
+	db.rmu.Unlock()
+	if chunk != nil {
+		syscall.Close(db.fd)
+	}
+	db.fd = fd
+	loadMeta(db, meta)
+	db.free.setMaxSeq()
+	db.queue.staged = meta
+	commitVersion(db, meta, nil)
+	return nil
+}
+
+// waits until the queued updates are durable, with db.mu. the lock is
+// released while the committer writes them.
+func (db *KV) drain() error {
+	for {
+		db.rmu.Lock()
+		idle := len(db.queue.waiters) == 0 && bytes.Equal(db.queue.staged, db.durable)
+		db.rmu.Unlock()
+		if idle {
+			return nil
+		}
+		done := enqueue(db)
+		db.mu.Unlock()
+		err := <-done
+		db.mu.Lock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// the oldest version being read, with db.rmu
+func (db *KV) oldestReader() uint64 {
+	oldest := db.version
+	for version := range db.readers {
+		oldest = min(oldest, version)
+	}
+	return oldest
+}
+
+func syncDir(dir string) error {
+	dirfd, err := syscall.Open(dir, os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return fmt.Errorf("open directory: %w", err)
+	}
+	defer syscall.Close(dirfd)
+	if err := syscall.Fsync(dirfd); err != nil {
+		return fmt.Errorf("fsync directory: %w", err)
+	}
+	return nil
+}
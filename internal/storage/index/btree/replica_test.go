@@ -0,0 +1,160 @@
+package btree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writes the snapshot of the replication to a file
+func writeSnapshot(t *testing.T, r *Replication, path string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = r.Snapshot(func(ptr uint64, page []byte) error {
+		_, err := f.WriteAt(page, int64(ptr*BT_PAGE_SIZE))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func nextDelta(t *testing.T, r *Replication) Delta {
+	t.Helper()
+	select {
+	case d, ok := <-r.C:
+		if !ok {
+			t.Fatalf("replication closed: %v", r.Err())
+		}
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delta")
+	}
+	return Delta{}
+}
+
+func TestReplica(t *testing.T) {
+	dir := t.TempDir()
+	leader := openKV(t, filepath.Join(dir, "leader.db"))
+	defer leader.Close()
+	ref := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		k, v := fmt.Sprintf("k%04d", i), fmt.Sprint(i)
+		leader.Set([]byte(k), []byte(v))
+		ref[k] = v
+	}
+
+	r := leader.Replicate()
+	defer r.Close()
+	if r.Seq() != 1000 {
+		t.Fatalf("Seq() of the snapshot = %d", r.Seq())
+	}
+	leader.Set([]byte("after"), []byte("snapshot"))
+	ref["after"] = "snapshot"
+	writeSnapshot(t, r, filepath.Join(dir, "sync.db"))
+
+	follower := &KV{Path: filepath.Join(dir, "follower.db"), Replica: true}
+	if err := follower.Open(); err != nil {
+		t.Fatal(err)
+	}
+	old := follower.BeginRead()
+	if err := follower.Restore(filepath.Join(dir, "sync.db")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := follower.Get([]byte("after")); ok {
+		t.Fatal("the snapshot has a later write")
+	}
+	if _, ok := old.Get([]byte("k0000")); ok {
+		t.Fatal("a reader of the old file sees the snapshot")
+	}
+	old.Rollback()
+	if err := follower.Apply(nextDelta(t, r)); err != nil {
+		t.Fatal(err)
+	}
+	assertKV(t, follower, ref)
+
+	for i := 0; i < 500; i++ {
+		k := fmt.Sprintf("k%04d", i)
+		leader.Del([]byte(k))
+		delete(ref, k)
+		if err := follower.Apply(nextDelta(t, r)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// batches overwrite pages freed before the version, a reader of an
+	// older version delays them
+	reader := follower.BeginRead()
+	leader.Set([]byte("k0499"), []byte("once"))
+	if err := follower.Apply(nextDelta(t, r)); err != nil {
+		t.Fatal(err)
+	}
+	leader.Set([]byte("k0000"), []byte("again"))
+	d := nextDelta(t, r)
+	applied := make(chan error)
+	go func() { applied <- follower.Apply(d) }()
+	select {
+	case <-applied:
+		t.Fatal("Apply() didn't wait for the reader")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if v, ok := reader.Get([]byte("k0500")); !ok || string(v) != "500" {
+		t.Fatalf("old reader Get() = %q, %v", v, ok)
+	}
+	if _, ok := reader.Get([]byte("k0499")); ok {
+		t.Fatal("old reader sees a later write")
+	}
+	reader.Rollback()
+	if err := <-applied; err != nil {
+		t.Fatal(err)
+	}
+	ref["k0499"] = "once"
+	ref["k0000"] = "again"
+	assertKV(t, follower, ref)
+	if _, ok := follower.Get([]byte("k0001")); ok {
+		t.Fatal("deleted key on the follower")
+	}
+	if err := follower.Set([]byte("x"), nil); err != ErrReplica {
+		t.Fatalf("Set() on a replica = %v", err)
+	}
+	assertKV(t, follower, ref)
+
+	// the follower is durable
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+	follower = &KV{Path: filepath.Join(dir, "follower.db"), Replica: true}
+	if err := follower.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	assertKV(t, follower, ref)
+	ftx, ltx := follower.BeginRead(), leader.BeginRead()
+	if ftx.Seq() != ltx.Seq() {
+		t.Fatalf("Seq() of the follower = %d; want %d", ftx.Seq(), ltx.Seq())
+	}
+	ftx.Rollback()
+	ltx.Rollback()
+
+	// a replication that isn't read is dropped
+	lagging := leader.Replicate()
+	writeSnapshot(t, lagging, filepath.Join(dir, "lagging.db"))
+	tx := leader.Begin()
+	for i := 0; i <= REPLICA_BUFFER; i++ {
+		tx.Set([]byte("lag"), []byte(fmt.Sprint(i)))
+		tx.Commit()
+		tx = leader.Begin()
+	}
+	tx.Rollback()
+	for range lagging.C {
+	}
+	if err := lagging.Err(); err != ErrReplicaLagged {
+		t.Fatalf("Err() of a lagging replication = %v", err)
+	}
+}
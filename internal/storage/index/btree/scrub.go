@@ -0,0 +1,51 @@
+package btree
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+)
+
+// Scrub runs the checks of Check on the database while it's in use: it
+// reads every page reachable from the meta page of a read transaction, so
+// writers go on and the pages it reads are not reused until it ends. the
+// free list of that version is checked against the trees and the pages of
+// the file, like Check. pages have no checksums in this format, a page is
+// checked by its header, its layout and its commit sequence.
+//
+// with ScrubRate the pages are read at about ScrubRate pages per second,
+// to run it in the background of a busy database. the error is ctx.Err()
+// if the context ends first, the problems are in the report.
+func (db *KV) Scrub(ctx context.Context) (*CheckReport, error) {
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	start, n := time.Now(), 0
+	c := &checker{report: &CheckReport{}, owner: map[uint64]string{}}
+	c.page = func(ptr uint64) ([]byte, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n++
+		if db.ScrubRate > 0 {
+			due := start.Add(time.Duration(n) * time.Second / time.Duration(db.ScrubRate))
+			if wait := time.Until(due); wait > 0 {
+				timer := time.NewTimer(wait)
+				defer timer.Stop()
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case <-timer.C:
+				}
+			}
+		}
+		return tx.pageRead(ptr), nil
+	}
+	// the pages used by the version, not the file that is growing
+	err := c.checkFrom(tx.base, binary.LittleEndian.Uint64(tx.base[24:32]))
+	db.count(METRIC_SCRUB_PAGES, uint64(n))
+	if err != nil {
+		return nil, err
+	}
+	db.count(METRIC_SCRUB_ERRORS, uint64(len(c.report.Errors)))
+	return c.report, nil
+}
@@ -0,0 +1,70 @@
+package btree
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScrub(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+	tx := db.Begin()
+	users, _ := tx.CreateBucket([]byte("users"))
+	for i := 0; i < 2000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%04d", i)), bytes.Repeat([]byte{'x'}, 100))
+		users.Set([]byte(fmt.Sprintf("u%04d", i)), []byte("1"))
+	}
+	tx.Commit()
+
+	// the writer goes on during the scrub
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for round := 0; round < 20; round++ {
+			tx := db.Begin()
+			for i := 0; i < 200; i++ {
+				tx.Set([]byte(fmt.Sprintf("k%04d", (round*200+i)%2000)), []byte(fmt.Sprint(round)))
+			}
+			tx.Commit()
+		}
+	}()
+	report, err := db.Scrub(context.Background())
+	<-done
+	if err != nil || !report.OK() || report.TreePages < 50 || report.Buckets != 1 {
+		t.Fatalf("Scrub() = %+v, %v", report, err)
+	}
+
+	// the rate limit and the context
+	db.ScrubRate = 1000
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := db.Scrub(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Scrub() past the deadline = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Scrub() returned after %v", elapsed)
+	}
+	db.Close()
+
+	// a leaf with keys out of order
+	data, _ := os.ReadFile(path)
+	root := binary.LittleEndian.Uint64(data[16:24])
+	leaf := BN(data[BN(data[root*BT_PAGE_SIZE:]).getPtr(0)*BT_PAGE_SIZE:][:BT_PAGE_SIZE])
+	leaf.getKey(leaf.nkeys() - 1)[0] = 0
+	os.WriteFile(path, data, 0o644)
+	db = openKV(t, path)
+	defer db.Close()
+	report, err = db.Scrub(context.Background())
+	if err != nil || report.OK() || !strings.Contains(report.Errors[0].Msg, "is not after key") {
+		t.Fatalf("Scrub() of a corrupted leaf = %+v, %v", report, err)
+	}
+}
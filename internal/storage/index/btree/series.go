@@ -0,0 +1,204 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Time series are buckets of points keyed by a timestamp, for metrics and
+// logs. the points are partitioned by time into nested buckets, one per
+// SeriesOptions.Partition, and old points are dropped a partition at a
+// time: the pages of its tree are freed without visiting the points.
+//
+//	series bucket          "options" -> | partition | retention |
+//	  partition bucket     named by the start of the partition
+//	    | time | key |  ->  val
+//
+// times are big endian nanoseconds with the sign bit flipped, so that
+// partitions and points sort in time order. points are written with
+// Bucket.Append: a point after the last one of its partition, the usual
+// case, descends the last kids of the tree without comparing keys.
+
+const seriesOptionsKey = "options"
+
+// ends ForEachBucket of Scan
+var errScanDone = errors.New("scan done")
+
+type SeriesOptions struct {
+	// the time range of a partition, required
+	Partition time.Duration
+	// partitions that ended this long ago are dropped when a partition is
+	// created or by Trim, zero keeps them
+	Retention time.Duration
+}
+
+type Series struct {
+	b    *Bucket
+	opts SeriesOptions
+	part *Bucket // the last partition written
+	from int64   // its start
+}
+
+func seriesTime(ns int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(ns)^1<<63)
+}
+
+func seriesKey(ts time.Time, key []byte) []byte {
+	return append(seriesTime(ts.UnixNano()), key...)
+}
+
+func (tx *Tx) CreateSeries(name []byte, opts SeriesOptions) (*Series, error) {
+	if opts.Partition <= 0 || opts.Retention < 0 {
+		return nil, ErrBadOptions
+	}
+	b, err := tx.CreateBucket(name)
+	if err != nil {
+		return nil, err
+	}
+	val := binary.LittleEndian.AppendUint64(nil, uint64(opts.Partition))
+	val = binary.LittleEndian.AppendUint64(val, uint64(opts.Retention))
+	if err := b.Set([]byte(seriesOptionsKey), val); err != nil {
+		return nil, err
+	}
+	return &Series{b: b, opts: opts}, nil
+}
+
+// nil if there is no such bucket or it isn't a time series
+func (tx *Tx) Series(name []byte) *Series {
+	b := tx.Bucket(name)
+	if b == nil {
+		return nil
+	}
+	val, ok := b.Get([]byte(seriesOptionsKey))
+	if !ok || len(val) != 16 {
+		return nil
+	}
+	return &Series{b: b, opts: SeriesOptions{
+		Partition: time.Duration(binary.LittleEndian.Uint64(val[0:])),
+		Retention: time.Duration(binary.LittleEndian.Uint64(val[8:])),
+	}}
+}
+
+func (s *Series) Options() SeriesOptions {
+	return s.opts
+}
+
+// the start of the partition of `ns`
+func (s *Series) partition(ns int64) int64 {
+	p := int64(s.opts.Partition)
+	start := ns / p * p
+	if start > ns {
+		start -= p // negative times round down
+	}
+	return start
+}
+
+// writes the point `key` at `ts`, points of the same time and key are
+// replaced. points of partitions past the retention are dropped.
+func (s *Series) Append(ts time.Time, key []byte, val []byte) error {
+	ns := ts.UnixNano()
+	if from := s.partition(ns); s.part == nil || s.part.deleted || from != s.from {
+		if s.expired(from) {
+			return nil
+		}
+		name := seriesTime(from)
+		part := s.b.Bucket(name)
+		if part == nil {
+			if _, err := s.Trim(); err != nil {
+				return err
+			}
+			var err error
+			if part, err = s.b.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		s.part, s.from = part, from
+	}
+	return s.part.Append(seriesKey(ts, key), val)
+}
+
+func (s *Series) Get(ts time.Time, key []byte) ([]byte, bool) {
+	part := s.b.Bucket(seriesTime(s.partition(ts.UnixNano())))
+	if part == nil {
+		return nil, false
+	}
+	return part.Get(seriesKey(ts, key))
+}
+
+// the starts of the partitions in time order
+func (s *Series) Partitions() []time.Time {
+	var starts []time.Time
+	for _, name := range s.b.Buckets() {
+		starts = append(starts, time.Unix(0, int64(binary.BigEndian.Uint64(name)^1<<63)))
+	}
+	return starts
+}
+
+// calls `fn` for the points in [from, to) in time order until it returns
+// false, points of the same time are ordered by key
+func (s *Series) Scan(from, to time.Time, fn func(ts time.Time, key, val []byte) bool) {
+	start, end := seriesTime(from.UnixNano()), seriesTime(to.UnixNano())
+	first := seriesTime(s.partition(from.UnixNano()))
+	more := true
+	s.b.ForEachBucket(func(name []byte, part *Bucket) error {
+		if bytes.Compare(name, first) < 0 {
+			return nil
+		}
+		if bytes.Compare(name, end) >= 0 {
+			return errScanDone
+		}
+		part.Scan(start, end, func(key, val []byte) bool {
+			ts := time.Unix(0, int64(binary.BigEndian.Uint64(key)^1<<63))
+			more = fn(ts, key[8:], val)
+			return more
+		})
+		if !more {
+			return errScanDone
+		}
+		return nil
+	})
+}
+
+// drops the partitions that end at or before `t`, returns their number
+func (s *Series) DropBefore(t time.Time) (int, error) {
+	if err := s.b.writable(); err != nil {
+		return 0, err
+	}
+	var names [][]byte
+	for _, start := range s.Partitions() {
+		if start.Add(s.opts.Partition).After(t) {
+			break
+		}
+		names = append(names, seriesTime(start.UnixNano()))
+	}
+	for _, name := range names {
+		if err := s.b.DeleteBucket(name); err != nil {
+			return 0, err
+		}
+	}
+	return len(names), nil
+}
+
+// the end of the partitions to drop, zero without a retention
+func (s *Series) cutoff() time.Time {
+	if s.opts.Retention == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, s.b.tx.now()).Add(-s.opts.Retention)
+}
+
+// whether the partition starting at `from` is past the retention
+func (s *Series) expired(from int64) bool {
+	cutoff := s.cutoff()
+	return !cutoff.IsZero() && !time.Unix(0, from).Add(s.opts.Partition).After(cutoff)
+}
+
+// drops the partitions past the retention, see DropBefore
+func (s *Series) Trim() (int, error) {
+	if s.opts.Retention == 0 {
+		return 0, nil
+	}
+	return s.DropBefore(s.cutoff())
+}
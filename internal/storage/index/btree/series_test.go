@@ -0,0 +1,121 @@
+package btree
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSeries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+	now := time.Unix(100000, 0)
+	db.Now = func() time.Time { return now }
+
+	tx := db.Begin()
+	if _, err := tx.CreateSeries([]byte("bad"), SeriesOptions{}); err != ErrBadOptions {
+		t.Fatalf("CreateSeries() without a partition = %v", err)
+	}
+	s, err := tx.CreateSeries([]byte("cpu"), SeriesOptions{Partition: time.Hour, Retention: 3 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := now.Add(-2 * time.Hour).Truncate(time.Hour)
+	for i := 0; i < 3*3600; i += 10 {
+		ts := start.Add(time.Duration(i) * time.Second)
+		for _, host := range []string{"b", "a"} {
+			if err := s.Append(ts, []byte(host), []byte(fmt.Sprint(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// a late point and a point past the retention
+	s.Append(start.Add(5*time.Second), []byte("a"), []byte("late"))
+	s.Append(start.Add(-5*time.Hour), []byte("a"), []byte("old"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = openKV(t, path)
+	defer db.Close()
+	db.Now = func() time.Time { return now }
+	tx = db.BeginRead()
+	s = tx.Series([]byte("cpu"))
+	if s == nil || s.Options().Partition != time.Hour {
+		t.Fatalf("Series() = %v", s)
+	}
+	if got := s.Partitions(); len(got) != 3 || !got[0].Equal(start) {
+		t.Fatalf("Partitions() = %v", got)
+	}
+	if val, ok := s.Get(start.Add(5*time.Second), []byte("a")); !ok || string(val) != "late" {
+		t.Fatalf("Get() of the late point = %q, %v", val, ok)
+	}
+	var got []string
+	s.Scan(start.Add(time.Hour-10*time.Second), start.Add(time.Hour+20*time.Second), func(ts time.Time, key, val []byte) bool {
+		got = append(got, fmt.Sprintf("%d %s", ts.Sub(start)/time.Second, key))
+		return true
+	})
+	if fmt.Sprint(got) != "[3590 a 3590 b 3600 a 3600 b 3610 a 3610 b]" {
+		t.Fatalf("Scan() = %v", got)
+	}
+	n := 0
+	s.Scan(start, start.Add(24*time.Hour), func(ts time.Time, key, val []byte) bool {
+		n++
+		return n < 1000
+	})
+	if n != 1000 {
+		t.Fatalf("Scan() stopped after %d points", n)
+	}
+	tx.Rollback()
+
+	// the oldest partition is dropped when a new one starts
+	now = now.Add(2 * time.Hour)
+	tx = db.Begin()
+	s = tx.Series([]byte("cpu"))
+	if err := s.Append(now, []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Partitions(); len(got) != 3 || !got[0].Equal(start.Add(time.Hour)) {
+		t.Fatalf("Partitions() after the retention = %v", got)
+	}
+	if _, ok := s.Get(start.Add(5*time.Second), []byte("a")); ok {
+		t.Fatal("Get() of a dropped point")
+	}
+	if n, err := s.DropBefore(now); n != 2 || err != nil {
+		t.Fatalf("DropBefore() = %d, %v", n, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx = db.BeginRead()
+	defer tx.Rollback()
+	if tx.Series([]byte("nope")) != nil || len(tx.Series([]byte("cpu")).Partitions()) != 1 {
+		t.Fatal("Series() after DropBefore()")
+	}
+}
+
+func BenchmarkSeriesAppend(b *testing.B) {
+	db := &KV{Path: filepath.Join(b.TempDir(), "test.db")}
+	if err := db.Open(); err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	start := time.Unix(0, 0)
+	for _, mode := range []string{"append", "set"} {
+		b.Run(mode, func(b *testing.B) {
+			tx := db.Begin()
+			defer tx.Rollback()
+			bucket, _ := tx.CreateBucket([]byte(mode))
+			for i := 0; i < b.N; i++ {
+				key := seriesKey(start.Add(time.Duration(i)*time.Millisecond), []byte("host"))
+				if mode == "append" {
+					bucket.Append(key, []byte("1.5"))
+				} else {
+					bucket.Set(key, []byte("1.5"))
+				}
+			}
+		})
+	}
+}
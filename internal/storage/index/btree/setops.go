@@ -0,0 +1,178 @@
+package btree
+
+import "bytes"
+
+// Set operations stream the keys in both, in either or in one and not the
+// other of two ranges of trees, in key order: the ranges of two buckets,
+// two indexes with the same keys or two parts of a keyspace. the ranges
+// are read by cursors, nothing is collected: Intersect and Difference seek
+// past the keys of a range the other one skips, a sparse intersection
+// reads the leaves of its keys instead of both ranges. for the AND and OR
+// of conditions on several indexes.
+
+// RangeIter is a cursor on the keys in [start, end) of a tree in order,
+// see Tx.Range. like BIter, it's valid until the tree is updated.
+type RangeIter struct {
+	tree   *BT
+	iter   *BIter
+	end    []byte
+	decode func(stored []byte) ([]byte, bool) // of a bucket, false to skip the key
+	val    []byte
+}
+
+// a cursor on [start, end), nil `end` means up to the last key
+func (tree *BT) Range(start, end []byte) *RangeIter {
+	r := &RangeIter{tree: tree, end: end}
+	r.Seek(start)
+	return r
+}
+
+// false past the end of the range
+func (r *RangeIter) Valid() bool {
+	if !r.iter.Valid() {
+		return false
+	}
+	key, _ := r.iter.Deref()
+	return r.end == nil || bytes.Compare(key, r.end) < 0
+}
+
+func (r *RangeIter) Key() []byte {
+	key, _ := r.iter.Deref()
+	return key
+}
+
+func (r *RangeIter) Value() []byte {
+	if r.decode != nil {
+		return r.val
+	}
+	_, val := r.iter.Deref()
+	return val
+}
+
+func (r *RangeIter) Next() {
+	r.iter.Next()
+	r.skip()
+}
+
+// moves to the first key greater than or equal to `key`, forward only
+func (r *RangeIter) Seek(key []byte) {
+	if r.iter != nil && r.Valid() && bytes.Compare(r.Key(), key) >= 0 {
+		return
+	}
+	r.iter = r.tree.Seek(key)
+	r.skip()
+}
+
+// moves past the keys the decoder of the bucket skips, the expired ones
+func (r *RangeIter) skip() {
+	for r.decode != nil && r.Valid() {
+		_, stored := r.iter.Deref()
+		val, ok := r.decode(stored)
+		if ok {
+			r.val = val
+			return
+		}
+		r.iter.Next()
+	}
+}
+
+// moves `r` to `key` or past it: a step of Next first, the neighbors of
+// an intersection are often in the same leaf, then a Seek
+func rangeCatchUp(r *RangeIter, key []byte) {
+	r.Next()
+	if r.Valid() && bytes.Compare(r.Key(), key) < 0 {
+		r.Seek(key)
+	}
+}
+
+// calls `fn` for the keys in both ranges in order until it returns false
+func Intersect(a, b *RangeIter, fn func(key, aVal, bVal []byte) bool) {
+	for a.Valid() && b.Valid() {
+		switch cmp := bytes.Compare(a.Key(), b.Key()); {
+		case cmp < 0:
+			rangeCatchUp(a, b.Key())
+		case cmp > 0:
+			rangeCatchUp(b, a.Key())
+		default:
+			if !fn(a.Key(), a.Value(), b.Value()) {
+				return
+			}
+			a.Next()
+			b.Next()
+		}
+	}
+}
+
+// calls `fn` for the keys in either range in order until it returns
+// false, `aVal` is nil for a key only in `b` and `bVal` for one only in `a`
+func Union(a, b *RangeIter, fn func(key, aVal, bVal []byte) bool) {
+	for a.Valid() || b.Valid() {
+		cmp := 0
+		switch {
+		case !b.Valid():
+			cmp = -1
+		case !a.Valid():
+			cmp = 1
+		default:
+			cmp = bytes.Compare(a.Key(), b.Key())
+		}
+		var ok bool
+		switch {
+		case cmp < 0:
+			ok = fn(a.Key(), a.Value(), nil)
+			a.Next()
+		case cmp > 0:
+			ok = fn(b.Key(), nil, b.Value())
+			b.Next()
+		default:
+			ok = fn(a.Key(), a.Value(), b.Value())
+			a.Next()
+			b.Next()
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// calls `fn` for the keys of `a` that aren't in `b` in order until it
+// returns false
+func Difference(a, b *RangeIter, fn func(key, val []byte) bool) {
+	for ; a.Valid(); a.Next() {
+		if b.Valid() && bytes.Compare(b.Key(), a.Key()) < 0 {
+			rangeCatchUp(b, a.Key())
+		}
+		if b.Valid() && bytes.Equal(b.Key(), a.Key()) {
+			continue
+		}
+		if !fn(a.Key(), a.Value()) {
+			return
+		}
+	}
+}
+
+// a cursor on [start, end) of the main keyspace, see RangeIter
+func (tx *Tx) Range(start, end []byte) *RangeIter {
+	if tx.closed() || tx.canceled() {
+		return &RangeIter{tree: tx.tree, iter: &BIter{tree: tx.tree}}
+	}
+	defer tx.catch("Range", nil)
+	return tx.tree.Range(start, end)
+}
+
+// like Tx.Range, the values are decoded and the expired keys skipped
+func (b *Bucket) Range(start, end []byte) *RangeIter {
+	if b.tx.closed() || b.tx.canceled() {
+		return &RangeIter{tree: &b.tree, iter: &BIter{tree: &b.tree}}
+	}
+	defer b.catch("Range", nil)
+	r := &RangeIter{tree: &b.tree, end: end}
+	if b.opts.Compression || b.opts.TTL {
+		now := b.tx.now()
+		r.decode = func(stored []byte) ([]byte, bool) {
+			return b.decode(stored, now)
+		}
+	}
+	r.Seek(start)
+	return r
+}
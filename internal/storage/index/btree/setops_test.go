@@ -0,0 +1,152 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// a tree of `n` random keys of [0, keys), see refSetOp
+func setOpTree(r *rand.Rand, n, keys int, val string) *C {
+	c := NewC()
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("k%05d", r.Intn(keys))
+		c.tree.Insert([]byte(key), []byte(val))
+		c.ref[key] = val
+	}
+	return c
+}
+
+// the keys of [start, end) of `a` and `b` that `keep` keeps, in order
+func refSetOp(a, b map[string]string, start, end string, keep func(inA, inB bool) bool) []string {
+	var out []string
+	both := maps(a)
+	for key, val := range b {
+		both[key] = val
+	}
+	for _, key := range sortedKeys(both) {
+		_, inA := a[key]
+		_, inB := b[key]
+		if key >= start && key < end && keep(inA, inB) {
+			out = append(out, key)
+		}
+	}
+	return out
+}
+
+func TestSetOps(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, sizes := range [][2]int{{3000, 3000}, {20000, 50}, {50, 20000}, {0, 1000}, {0, 0}} {
+		a, b := setOpTree(r, sizes[0], 10000, "a"), setOpTree(r, sizes[1], 10000, "b")
+		for _, bounds := range [][2]string{{"", "z"}, {"k02000", "k02500"}, {"k09990", "z"}, {"k05000", "k05000"}} {
+			start, end := []byte(bounds[0]), []byte(bounds[1])
+			var got []string
+			Intersect(a.tree.Range(start, end), b.tree.Range(start, end), func(key, aVal, bVal []byte) bool {
+				if string(aVal) != "a" || string(bVal) != "b" {
+					t.Fatalf("Intersect() at %s: %q, %q", key, aVal, bVal)
+				}
+				got = append(got, string(key))
+				return true
+			})
+			want := refSetOp(a.ref, b.ref, bounds[0], bounds[1], func(inA, inB bool) bool { return inA && inB })
+			if !slices.Equal(got, want) {
+				t.Fatalf("%v in %v: Intersect() = %d keys; want %d", sizes, bounds, len(got), len(want))
+			}
+
+			got = nil
+			Union(a.tree.Range(start, end), b.tree.Range(start, end), func(key, aVal, bVal []byte) bool {
+				_, inA := a.ref[string(key)]
+				_, inB := b.ref[string(key)]
+				if inA != (aVal != nil) || inB != (bVal != nil) {
+					t.Fatalf("Union() at %s: %q, %q", key, aVal, bVal)
+				}
+				got = append(got, string(key))
+				return true
+			})
+			want = refSetOp(a.ref, b.ref, bounds[0], bounds[1], func(inA, inB bool) bool { return inA || inB })
+			if !slices.Equal(got, want) {
+				t.Fatalf("%v in %v: Union() = %d keys; want %d", sizes, bounds, len(got), len(want))
+			}
+
+			got = nil
+			Difference(a.tree.Range(start, end), b.tree.Range(start, end), func(key, val []byte) bool {
+				got = append(got, string(key))
+				return true
+			})
+			want = refSetOp(a.ref, b.ref, bounds[0], bounds[1], func(inA, inB bool) bool { return inA && !inB })
+			if !slices.Equal(got, want) {
+				t.Fatalf("%v in %v: Difference() = %d keys; want %d", sizes, bounds, len(got), len(want))
+			}
+		}
+	}
+
+	// until the callback stops
+	a, b := setOpTree(r, 1000, 2000, "a"), setOpTree(r, 1000, 2000, "b")
+	n := 0
+	Union(a.tree.Range(nil, nil), b.tree.Range(nil, nil), func(key, aVal, bVal []byte) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Fatalf("%d calls after the callback stopped", n)
+	}
+}
+
+func TestTxSetOps(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	now := time.Unix(1000, 0)
+	db.Now = func() time.Time { return now }
+
+	tx := db.Begin()
+	idx, _ := tx.CreateBucket([]byte("idx"))
+	cf, _ := tx.CreateColumnFamily([]byte("cf"), CFOptions{TTL: true, Compression: true})
+	for i := 0; i < 20000; i++ {
+		key := []byte(fmt.Sprintf("k%05d", i))
+		tx.Set(key, []byte("main"))
+		if i%1000 == 0 {
+			idx.Set(key, []byte("idx"))
+		}
+		if i%3 == 0 {
+			cf.SetTTL(key, []byte("cf"), time.Duration(2-i%2)*time.Second)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(1500 * time.Millisecond)
+
+	tx = db.BeginRead()
+	defer tx.Rollback()
+	var got []string
+	Intersect(tx.Range(nil, nil), tx.Bucket([]byte("idx")).Range(nil, nil), func(key, aVal, bVal []byte) bool {
+		got = append(got, string(key)+"="+string(aVal)+","+string(bVal))
+		return true
+	})
+	if len(got) != 20 || got[3] != "k03000=main,idx" {
+		t.Fatalf("Intersect() = %d keys %.4v", len(got), got)
+	}
+	// the leaves of the keys of the index are read, not the whole keyspace
+	if reads := tx.reads.Load(); reads > 100 {
+		t.Fatalf("%d pages read", reads)
+	}
+
+	// the keys set to expire after a second are gone
+	got = nil
+	Difference(tx.Bucket([]byte("idx")).Range(nil, nil), tx.Bucket([]byte("cf")).Range(nil, nil), func(key, val []byte) bool {
+		got = append(got, string(key))
+		return true
+	})
+	want := []string{"k01000", "k02000", "k04000", "k05000", "k07000", "k08000", "k10000", "k11000", "k13000", "k14000", "k16000", "k17000", "k19000"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Difference() = %v; want %v", got, want)
+	}
+	for r := tx.Bucket([]byte("cf")).Range([]byte("k00000"), []byte("k00010")); r.Valid(); r.Next() {
+		if key := string(r.Key()); key != "k00000" && key != "k00006" || string(r.Value()) != "cf" {
+			t.Fatalf("Range() of the family at %s = %q", key, r.Value())
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// A process can read the database of another process from the same file:
+// with KV.ReadOnly set, Open maps the file without writing it and a
+// goroutine re-reads the meta page every RefreshInterval, new read
+// transactions see the last version committed by the writer.
+//
+// the writer reuses free pages in place, so the reading process pins the
+// commit sequence of the oldest version it reads in the readers file, and
+// the writer doesn't reuse pages freed after it. a slot of the file belongs
+// to a process while it holds a lock on the slot, the slots of processes
+// that went away are ignored.
+//
+// readers file, at Path + ".readers"
+// | used | seq | ...
+// |  8B  | 8B  |
+//
+// a file replaced by Restore isn't followed, the process reads the old one
+// until it reopens the database. followers don't wait for the readers of
+// other processes, their file can't be shared.
+
+var ErrReadOnly = errors.New("the database is read only")
+
+const (
+	READER_SLOT_SIZE = 16
+
+	DEFAULT_REFRESH_INTERVAL = 100 * time.Millisecond
+)
+
+func readersPath(path string) string {
+	return path + ".readers"
+}
+
+func lockSlot(fd int, slot int64, typ int16, cmd int) (unix.Flock_t, error) {
+	lk := unix.Flock_t{
+		Type:   typ,
+		Whence: io.SeekStart,
+		Start:  slot * READER_SLOT_SIZE,
+		Len:    READER_SLOT_SIZE,
+	}
+	err := unix.FcntlFlock(uintptr(fd), cmd, &lk)
+	return lk, err
+}
+
+// opens the file read only and pins the version of its meta page
+func (db *KV) openShared() error {
+	fd, err := syscall.Open(db.Path, os.O_RDONLY, 0)
+	if err != nil {
+		db.fd = -1
+		return fmt.Errorf("open file: %w", err)
+	}
+	db.fd = fd
+	if err := db.openReaders(); err != nil {
+		return err
+	}
+	// the writer reuses the pages of a version once a later one is
+	// durable, the pin counts if the version is still the last one after it
+	meta := make([]byte, META_SIZE)
+	for {
+		if _, err := syscall.Pread(fd, meta, 0); err != nil {
+			return fmt.Errorf("read meta page: %w", err)
+		}
+		seq := binary.LittleEndian.Uint64(meta[72:80])
+		if err := db.pin(seq); err != nil {
+			return fmt.Errorf("pin: %w", err)
+		}
+		if _, err := syscall.Pread(fd, meta, 0); err != nil {
+			return fmt.Errorf("read meta page: %w", err)
+		}
+		if binary.LittleEndian.Uint64(meta[72:80]) == seq {
+			db.shared.pinned = seq
+			return nil
+		}
+	}
+}
+
+// opens the readers file, a read only process takes a free slot
+func (db *KV) openReaders() error {
+	fd, err := syscall.Open(readersPath(db.Path), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("open readers file: %w", err)
+	}
+	db.shared.fd = fd
+	if !db.ReadOnly {
+		return nil
+	}
+	for slot := int64(0); ; slot++ {
+		_, err := lockSlot(fd, slot, unix.F_WRLCK, unix.F_OFD_SETLK)
+		if err == nil {
+			db.shared.slot = slot
+			return nil
+		}
+		if !errors.Is(err, syscall.EAGAIN) && !errors.Is(err, syscall.EACCES) {
+			return fmt.Errorf("lock readers file: %w", err)
+		}
+	}
+}
+
+// publishes the oldest commit sequence the process reads
+func (db *KV) pin(seq uint64) error {
+	var buf [READER_SLOT_SIZE]byte
+	binary.LittleEndian.PutUint64(buf[0:], 1)
+	binary.LittleEndian.PutUint64(buf[8:], seq)
+	_, err := syscall.Pwrite(db.shared.fd, buf[:], db.shared.slot*READER_SLOT_SIZE)
+	return err
+}
+
+// the oldest commit sequence pinned by reading processes, MaxUint64 if none
+func (db *KV) pinned() uint64 {
+	oldest := uint64(math.MaxUint64)
+	if db.shared.fd <= 0 {
+		return oldest
+	}
+	buf := make([]byte, 64*READER_SLOT_SIZE)
+	for off := int64(0); ; off += int64(len(buf)) {
+		n, _ := syscall.Pread(db.shared.fd, buf, off)
+		for i := 0; i+READER_SLOT_SIZE <= n; i += READER_SLOT_SIZE {
+			if binary.LittleEndian.Uint64(buf[i:]) == 0 {
+				continue
+			}
+			seq := binary.LittleEndian.Uint64(buf[i+8:])
+			if seq >= oldest {
+				continue
+			}
+			// the process went away if nobody holds the lock
+			slot := (off + int64(i)) / READER_SLOT_SIZE
+			lk, err := lockSlot(db.shared.fd, slot, unix.F_WRLCK, unix.F_OFD_GETLK)
+			if err != nil || lk.Type != unix.F_UNLCK {
+				oldest = seq
+			}
+		}
+		if n < len(buf) {
+			return oldest
+		}
+	}
+}
+
+func (db *KV) closeReaders() {
+	if db.shared.fd <= 0 {
+		return
+	}
+	if db.ReadOnly {
+		syscall.Pwrite(db.shared.fd, make([]byte, READER_SLOT_SIZE), db.shared.slot*READER_SLOT_SIZE)
+	}
+	// closing the file releases the lock
+	syscall.Close(db.shared.fd)
+	db.shared.fd = 0
+}
+
+func (db *KV) refresher() {
+	defer close(db.shared.stopped)
+	ticker := time.NewTicker(db.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// a meta page being written reads as bad, the next run reads it
+			if err := db.Refresh(); err != nil {
+				db.log().Debug("refresh failed", "err", err)
+			}
+		case <-db.stop:
+			return
+		}
+	}
+}
+
+// reads the last version committed by the writing process, new read
+// transactions see it. it runs every RefreshInterval, the readers of a
+// database that call it don't wait for the next run.
+func (db *KV) Refresh() error {
+	if !db.ReadOnly {
+		return errors.New("KV.Refresh: not read only")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	meta := make([]byte, META_SIZE)
+	if _, err := syscall.Pread(db.fd, meta, 0); err != nil {
+		return fmt.Errorf("KV.Refresh: read meta page: %w", err)
+	}
+	if binary.LittleEndian.Uint64(meta[72:80]) != db.seq {
+		finfo := syscall.Stat_t{}
+		if err := syscall.Fstat(db.fd, &finfo); err != nil {
+			return fmt.Errorf("KV.Refresh: stat: %w", err)
+		}
+		if err := checkMeta(meta, finfo.Size); err != nil {
+			return fmt.Errorf("KV.Refresh: %w", err)
+		}
+		flushed := binary.LittleEndian.Uint64(meta[24:32])
+		if err := extendMmap(db, int(flushed)*BT_PAGE_SIZE); err != nil {
+			return fmt.Errorf("KV.Refresh: %w", err)
+		}
+		// the pin of the oldest version read protects the pages of the new one
+		loadMeta(db, meta)
+		db.queue.staged = meta
+		commitVersion(db, meta, nil)
+	} else {
+		db.rmu.Lock()
+		db.release()
+		db.rmu.Unlock()
+	}
+	db.rmu.Lock()
+	oldest := db.epochs[0].commit
+	db.rmu.Unlock()
+	if oldest != db.shared.pinned {
+		if err := db.pin(oldest); err != nil {
+			return fmt.Errorf("KV.Refresh: %w", err)
+		}
+		db.shared.pinned = oldest
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	if err := (&KV{Path: path, ReadOnly: true}).Open(); err == nil {
+		t.Fatal("Open() of a missing file in read only mode succeeded")
+	}
+	writer := openKV(t, path)
+	defer writer.Close()
+	for i := 0; i < 1000; i++ {
+		writer.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("old"))
+	}
+
+	// the file is shared within a process too, the locks are per open file
+	reader := &KV{Path: path, ReadOnly: true, RefreshInterval: time.Hour}
+	if err := reader.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Set([]byte("k"), nil); err != ErrReadOnly {
+		t.Fatalf("Set() on a read only database = %v", err)
+	}
+	rtx := reader.BeginRead()
+	if writer.pinned() != 1000 {
+		t.Fatalf("pinned() = %d", writer.pinned())
+	}
+
+	// pages of the version read aren't reused while it's pinned
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 1000; i++ {
+			writer.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprint("new", round)))
+		}
+	}
+	n := 0
+	rtx.Scan(nil, nil, func(key, val []byte) bool {
+		if string(val) != "old" {
+			t.Fatalf("%s = %s in the pinned version", key, val)
+		}
+		n++
+		return true
+	})
+	if n != 1000 {
+		t.Fatalf("%d keys in the pinned version", n)
+	}
+	if err := reader.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := reader.Get([]byte("k0999")); string(val) != "new4" {
+		t.Fatalf("Get() after Refresh = %s", val)
+	}
+	if writer.pinned() != 1000 {
+		t.Fatalf("pinned() with a reader of the old version = %d", writer.pinned())
+	}
+	rtx.Rollback()
+	reader.Refresh()
+	if writer.pinned() != 6000 {
+		t.Fatalf("pinned() after the reader ended = %d", writer.pinned())
+	}
+
+	// new versions are read in the background
+	reader.Close()
+	reader = &KV{Path: path, ReadOnly: true, RefreshInterval: 5 * time.Millisecond}
+	if err := reader.Open(); err != nil {
+		t.Fatal(err)
+	}
+	writer.Set([]byte("later"), []byte("1"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := reader.Get([]byte("later")); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the reader didn't see a new version")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	reader.Close()
+	if writer.pinned() != math.MaxUint64 {
+		t.Fatalf("pinned() after Close = %d", writer.pinned())
+	}
+
+	// the slot of a process that went away is unlocked
+	f, err := os.OpenFile(readersPath(path), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot := binary.LittleEndian.AppendUint64(binary.LittleEndian.AppendUint64(nil, 1), 1)
+	f.WriteAt(slot, 3*READER_SLOT_SIZE)
+	f.Close()
+	if writer.pinned() != math.MaxUint64 {
+		t.Fatalf("pinned() with a stale slot = %d", writer.pinned())
+	}
+}
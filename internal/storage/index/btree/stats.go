@@ -0,0 +1,236 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// The stats types marshal to JSON with snake_case names, and String has
+// the same names as `name=value` pairs for logs and test failures.
+
+// usage of a tree, computed by a traversal
+type BucketStats struct {
+	Keys        int     `json:"keys"`  // number of keys
+	Depth       int     `json:"depth"` // number of levels, 0 for an empty tree
+	LeafPages   int     `json:"leaf_pages"`
+	BranchPages int     `json:"branch_pages"`
+	Size        int     `json:"size"`        // bytes of the pages
+	Used        int     `json:"used"`        // bytes used by the nodes
+	KeyBytes    int     `json:"key_bytes"`   // total size of keys
+	ValBytes    int     `json:"val_bytes"`   // total size of values
+	FillFactor  float64 `json:"fill_factor"` // Used / Size
+}
+
+func (s BucketStats) String() string {
+	return statsString(s)
+}
+
+// the fields of a stats struct as `name=value` with their JSON names
+func statsString(stats any) string {
+	v := reflect.ValueOf(stats)
+	var sb strings.Builder
+	for i := 0; i < v.NumField(); i++ {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if f := v.Field(i); f.Kind() == reflect.Float64 {
+			fmt.Fprintf(&sb, "%s=%.2f", name, f.Float())
+		} else {
+			fmt.Fprintf(&sb, "%s=%v", name, f.Interface())
+		}
+	}
+	return sb.String()
+}
+
+func (tree *BT) Stats() BucketStats {
+	var stats BucketStats
+	if tree.root != 0 {
+		treeStats(tree, tree.root, 1, &stats)
+		stats.Keys-- // the empty key inserted with the root
+	}
+	pages := stats.LeafPages + stats.BranchPages
+	stats.Size = pages * BT_PAGE_SIZE
+	if stats.Size > 0 {
+		stats.FillFactor = float64(stats.Used) / float64(stats.Size)
+	}
+	return stats
+}
+
+func treeStats(tree *BT, ptr uint64, depth int, stats *BucketStats) {
+	node := tree.node(ptr)
+	stats.Depth = max(stats.Depth, depth)
+	stats.Used += int(node.nbytes())
+	switch node.btype() {
+	case BN_LEAF:
+		stats.LeafPages++
+		stats.Keys += int(node.nkeys())
+		for i := uint16(0); i < node.nkeys(); i++ {
+			stats.KeyBytes += len(node.getKey(i))
+			stats.ValBytes += len(node.getVal(i))
+		}
+	case BN_NODE:
+		stats.BranchPages++
+		for i := uint16(0); i < node.nkeys(); i++ {
+			treeStats(tree, node.getPtr(i), depth+1, stats)
+		}
+	default:
+		panic("bad node type")
+	}
+}
+
+// computed by a traversal of the bucket tree, nested buckets are not included
+func (b *Bucket) Stats() BucketStats {
+	if b.tx.closed() {
+		return BucketStats{}
+	}
+	return b.tree.Stats()
+}
+
+// computed by a traversal of the main tree, buckets are not included
+func (tx *Tx) Stats() BucketStats {
+	if tx.closed() {
+		return BucketStats{}
+	}
+	return tx.tree.Stats()
+}
+
+// usage of the database file in pages
+type FileStats struct {
+	Pages     int `json:"pages"`      // pages of the file, the meta page included
+	TreePages int `json:"tree_pages"` // pages of the trees of the keyspace, the catalog and the buckets
+	FreePages int `json:"free_pages"` // pages nothing reaches and the nodes of the free list, Compact drops them
+	// pages in the buffer pool, see Tx.Resident
+	Resident int `json:"resident"`
+}
+
+func (s FileStats) String() string {
+	return statsString(s)
+}
+
+// the free list of the last version, see KV.FreeListStats
+type FreeListStats struct {
+	Items    int `json:"items"`    // free pages in the list
+	Reusable int `json:"reusable"` // items no reader can see, the next write transaction takes them first
+	Nodes    int `json:"nodes"`    // pages of the list itself
+}
+
+func (s FreeListStats) String() string {
+	return statsString(s)
+}
+
+// the free list with the updates of the write transaction, waits for it
+func (db *KV) FreeListStats() FreeListStats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	fl := &db.free
+	return FreeListStats{
+		Items:    int(fl.tailSeq - fl.headSeq),
+		Reusable: int(fl.maxSeq - fl.headSeq),
+		Nodes:    int(fl.tailSeq/FREE_LIST_CAP-fl.headSeq/FREE_LIST_CAP) + 1,
+	}
+}
+
+// computed by a traversal of every tree of the version read, for read
+// transactions
+func (tx *Tx) FileStats() FileStats {
+	assert(!tx.writable)
+	if tx.closed() {
+		return FileStats{}
+	}
+	stats := FileStats{Pages: int(binary.LittleEndian.Uint64(tx.base[24:32]))}
+	count := func(tree *BT) {
+		s := tree.Stats()
+		stats.TreePages += s.LeafPages + s.BranchPages
+	}
+	count(tx.tree)
+	count(tx.catalog)
+	tx.catalog.Scan(nil, nil, func(key, val []byte) bool {
+		if len(val) < 8 {
+			return true // the empty key of the root
+		}
+		b := tx.openBucket(key)
+		count(&b.tree)
+		count(&b.expiry)
+		count(&b.history)
+		return true
+	})
+	stats.FreePages = stats.Pages - 1 - stats.TreePages
+	stats.Resident = tx.Resident()
+	return stats
+}
+
+// the pages in the buffer pool, 0 without KV.PoolPages: reads go through
+// the mmap and the page cache of the OS isn't the database's. reported as
+// METRIC_RESIDENT_PAGES.
+func (tx *Tx) Resident() int {
+	if tx.closed() {
+		return 0
+	}
+	n := 0
+	if tx.pool != nil {
+		n = tx.pool.len()
+	}
+	if db := tx.db; db.Metrics != nil {
+		db.Metrics.Set(METRIC_RESIDENT_PAGES, float64(n))
+	}
+	return n
+}
+
+// the memory of the pages held by the database, see KV.Buffers
+type BufferStats struct {
+	Mapped    int `json:"mapped"`     // bytes of the mmaps of the file, mapped ahead of its size
+	MapChunks int `json:"map_chunks"` // number of mmaps
+	Retired   int `json:"retired"`    // bytes of the mmaps of files replaced by Restore, unmapped by Close
+	Pending   int `json:"pending"`    // pages updated in memory and not staged yet
+	Flushing  int `json:"flushing"`   // pages of the batch being written
+	Readers   int `json:"readers"`    // active read transactions
+	Versions  int `json:"versions"`   // durable versions the readers keep, their free pages aren't reused
+	Replicas  int `json:"replicas"`   // active replications
+	Queued    int `json:"queued"`     // durable batches queued for the replications
+	Pool      int `json:"pool"`       // pages in the buffer pool, see KV.PoolPages
+	Filters   int `json:"filters"`    // leaves with a Bloom filter, see KV.BloomBits
+	Arena     int `json:"arena"`      // node buffers kept for the next nodes of the writer
+	// reads of the buffer pool of the file since it was opened or restored
+	PoolHits      uint64 `json:"pool_hits"`
+	PoolMisses    uint64 `json:"pool_misses"` // pages read from the file
+	PoolEvictions uint64 `json:"pool_evictions"`
+}
+
+func (s BufferStats) String() string {
+	return statsString(s)
+}
+
+// counts the page buffers, waits for the write transaction
+func (db *KV) Buffers() BufferStats {
+	var stats BufferStats
+	db.mu.Lock()
+	stats.Pending = len(db.page.updates)
+	stats.Flushing = len(db.page.flushing)
+	stats.Arena = db.arena.len()
+	db.mu.Unlock()
+	db.rmu.Lock()
+	defer db.rmu.Unlock()
+	stats.Mapped = db.mmap.total
+	if p := db.pool.cur; p != nil {
+		stats.Pool = p.len()
+		c := p.counters()
+		stats.PoolHits, stats.PoolMisses, stats.PoolEvictions = c[0], c[1], c[2]
+	}
+	stats.Filters = db.filters.len()
+	stats.MapChunks = len(db.mmap.chunks)
+	for _, chunk := range db.mmap.retired {
+		stats.Retired += len(chunk)
+	}
+	for _, n := range db.readers {
+		stats.Readers += n
+	}
+	stats.Versions = len(db.readers)
+	stats.Replicas = len(db.replicas)
+	for r := range db.replicas {
+		stats.Queued += len(r.c)
+	}
+	return stats
+}
@@ -0,0 +1,108 @@
+package btree
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResident(t *testing.T) {
+	m := &testMetrics{counters: map[string]uint64{}, gauges: map[string]float64{}, durations: map[string]int{}}
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), PoolPages: 64, Metrics: m}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx := db.Begin()
+	for i := 0; i < 2000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%04d", i)), make([]byte, 500))
+	}
+	tx.Commit()
+
+	rtx := db.BeginRead()
+	defer rtx.Rollback()
+	n := 0
+	rtx.Scan(nil, nil, func(key, val []byte) bool {
+		n++
+		return true
+	})
+	stats := rtx.FileStats()
+	// the pages just read are in the pool
+	if stats.Resident == 0 || stats.Resident > 64+POOL_SHARDS {
+		t.Fatalf("%d resident pages of %d, %d in the trees", stats.Resident, stats.Pages, stats.TreePages)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.gauges[METRIC_RESIDENT_PAGES] != float64(stats.Resident) {
+		t.Fatalf("gauge %v, %d resident pages", m.gauges[METRIC_RESIDENT_PAGES], stats.Resident)
+	}
+}
+
+func TestBuffers(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	if s := db.Buffers(); s.Mapped == 0 || s.MapChunks != 1 || s.Pending != 0 || s.Readers != 0 {
+		t.Fatalf("Buffers() = %+v", s)
+	}
+	old := db.BeginRead()
+	db.Set([]byte("k"), []byte("v"))
+	r1, r2 := db.BeginRead(), db.BeginRead()
+	rep := db.Replicate()
+	db.Set([]byte("k"), []byte("v2"))
+	s := db.Buffers()
+	if s.Readers != 4 || s.Versions != 2 || s.Replicas != 1 || s.Queued != 1 {
+		t.Fatalf("Buffers() = %+v", s)
+	}
+	rep.Close()
+	old.Rollback()
+	r1.Rollback()
+	r2.Rollback()
+
+	// waits for the write transaction
+	tx := db.Begin()
+	tx.Set([]byte("a"), []byte("b"))
+	done := make(chan BufferStats)
+	go func() { done <- db.Buffers() }()
+	select {
+	case s := <-done:
+		t.Fatalf("Buffers() during a write transaction = %+v", s)
+	case <-time.After(10 * time.Millisecond):
+	}
+	tx.Commit()
+	if s := <-done; s.Readers != 0 || s.Replicas != 0 {
+		t.Fatalf("Buffers() = %+v", s)
+	}
+}
+
+func TestStatsJSON(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	db.Set([]byte("a"), []byte("b"))
+	tx := db.BeginRead()
+	s := tx.Stats()
+	tx.Rollback()
+	want := "keys=1 depth=1 leaf_pages=1 branch_pages=0 size=4096 used=42 key_bytes=1 val_bytes=1 fill_factor=0.01"
+	if s.String() != want {
+		t.Fatalf("String() = %s, want %s", s, want)
+	}
+	data, err := json.Marshal(s)
+	var back BucketStats
+	if err != nil || json.Unmarshal(data, &back) != nil || back != s || !strings.Contains(string(data), `"leaf_pages":1`) {
+		t.Fatalf("json.Marshal() = %s, %v", data, err)
+	}
+
+	// the pages freed by a batch are reusable once no reader sees them
+	for i := 0; i < 3; i++ {
+		db.Set([]byte("a"), []byte(fmt.Sprint(i)))
+	}
+	fl := db.FreeListStats()
+	if fl.Items == 0 || fl.Reusable == 0 || fl.Reusable > fl.Items || fl.Nodes != 1 {
+		t.Fatalf("FreeListStats() = %s", fl)
+	}
+	if got := db.Buffers().String(); !strings.HasPrefix(got, "mapped=") {
+		t.Fatalf("BufferStats.String() = %s", got)
+	}
+}
@@ -0,0 +1,180 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+var ErrNoTTL = errors.New("column family has no TTL")
+
+// Keys of TTL families may have an expiration time. Expired keys are absent
+// for reads and are deleted by Sweep. The expiration index of a family is
+// a separate tree ordered by time, so sweeping visits only expired keys.
+//
+// index key
+// | expireAt | key |
+// |    8B    | ... |
+// expireAt is unix nanoseconds, big-endian so that keys are ordered by time
+
+func expired(stored []byte, now int64) bool {
+	expireAt := int64(binary.LittleEndian.Uint64(stored[0:8]))
+	return expireAt != 0 && expireAt <= now
+}
+
+func expiryKey(expireAt int64, key []byte) []byte {
+	ikey := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(ikey, uint64(expireAt))
+	copy(ikey[8:], key)
+	return ikey
+}
+
+func (tx *Tx) now() int64 {
+	if tx.time != 0 {
+		return tx.time
+	}
+	return tx.db.clock().UnixNano()
+}
+
+func (db *KV) clock() time.Time {
+	if db.Now != nil {
+		return db.Now()
+	}
+	return time.Now()
+}
+
+func (b *Bucket) index(key []byte, expireAt int64) {
+	if expireAt != 0 {
+		b.expiry.Insert(expiryKey(expireAt, key), nil)
+	}
+}
+
+// removes the index entry of the current value
+func (b *Bucket) unindex(key []byte) {
+	stored, ok := b.tree.Get(key)
+	if !ok {
+		return
+	}
+	if expireAt := int64(binary.LittleEndian.Uint64(stored[0:8])); expireAt != 0 {
+		b.expiry.Delete(expiryKey(expireAt, key))
+	}
+}
+
+// sets the value that expires after `ttl`
+func (b *Bucket) SetTTL(key []byte, val []byte, ttl time.Duration) error {
+	if !b.opts.TTL {
+		return ErrNoTTL
+	}
+	return b.set(key, val, b.tx.now()+int64(ttl), false)
+}
+
+// changes the expiration of an existing key, ttl <= 0 removes the expiration.
+// false if there is no such key.
+func (b *Bucket) Expire(key []byte, ttl time.Duration) (bool, error) {
+	if !b.opts.TTL {
+		return false, ErrNoTTL
+	}
+	val, ok := b.Get(key)
+	if !ok {
+		return false, nil
+	}
+	expireAt := int64(0)
+	if ttl > 0 {
+		expireAt = b.tx.now() + int64(ttl)
+	}
+	return true, b.set(key, append([]byte{}, val...), expireAt, false)
+}
+
+// expiration time of the key, zero time if the key doesn't expire.
+// false if there is no such key.
+func (b *Bucket) ExpiresAt(key []byte) (time.Time, bool) {
+	if b.tx.closed() {
+		return time.Time{}, false
+	}
+	stored, ok := b.tree.Get(key)
+	if !ok || !b.opts.TTL {
+		return time.Time{}, ok
+	}
+	if expired(stored, b.tx.now()) {
+		return time.Time{}, false
+	}
+	expireAt := int64(binary.LittleEndian.Uint64(stored[0:8]))
+	if expireAt == 0 {
+		return time.Time{}, true
+	}
+	return time.Unix(0, expireAt), true
+}
+
+// deletes up to `limit` expired keys, returns the number of deleted keys
+func (b *Bucket) Sweep(limit int) (int, error) {
+	if err := b.writable(); err != nil {
+		return 0, err
+	}
+	if !b.opts.TTL {
+		return 0, nil
+	}
+	end := expiryKey(b.tx.now()+1, nil)
+	var keys [][]byte
+	b.expiry.Scan(nil, end, func(ikey, _ []byte) bool {
+		keys = append(keys, append([]byte{}, ikey...))
+		return len(keys) < limit
+	})
+	for _, ikey := range keys {
+		b.expiry.Delete(ikey)
+		b.tree.Delete(ikey[8:])
+	}
+	b.dirty = b.dirty || len(keys) > 0
+	return len(keys), nil
+}
+
+// sweeps every TTL family and bucket, up to `limit` keys per bucket
+func (tx *Tx) Sweep(limit int) (int, error) {
+	if tx.done {
+		return 0, ErrTxClosed
+	}
+	if !tx.writable {
+		return 0, ErrTxReadOnly
+	}
+	var keys [][]byte
+	tx.catalog.Scan(nil, nil, func(k, v []byte) bool {
+		if decodeOptions(v).TTL {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		return true
+	})
+	total := 0
+	for _, k := range keys {
+		n, err := tx.openBucket(k).Sweep(limit)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// background sweeper, runs a write transaction every SweepInterval
+func (db *KV) sweeper() {
+	defer close(db.sweep.stopped)
+	ticker := time.NewTicker(db.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			tx := db.Begin()
+			n, err := tx.Sweep(db.SweepBatch)
+			if err != nil {
+				db.log().Warn("sweeping expired keys", "err", err)
+			}
+			if n > 0 {
+				if err := tx.Commit(); err != nil {
+					db.log().Warn("sweeping expired keys", "err", err)
+				}
+			} else {
+				tx.Rollback()
+			}
+		case <-db.sweep.stop:
+			return
+		}
+	}
+}
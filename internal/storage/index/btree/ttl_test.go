@@ -0,0 +1,128 @@
+package btree
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+	now := time.Unix(1000, 0)
+	db.Now = func() time.Time { return now }
+
+	tx := db.Begin()
+	cf, err := tx.CreateColumnFamily([]byte("sessions"), CFOptions{TTL: true, Compression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := tx.CreateBucket([]byte("plain"))
+	if err := plain.SetTTL([]byte("k"), []byte("v"), time.Second); err != ErrNoTTL {
+		t.Fatalf("SetTTL on a plain bucket = %v; want ErrNoTTL", err)
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%03d", i))
+		if i%2 == 0 {
+			cf.SetTTL(key, key, time.Duration(i+1)*time.Second)
+		} else {
+			cf.Set(key, key)
+		}
+	}
+	// overwriting drops the old expiration
+	cf.SetTTL([]byte("key_000"), []byte("new"), time.Hour)
+	cf.Set([]byte("key_002"), []byte("forever"))
+	if at, ok := cf.ExpiresAt([]byte("key_004")); !ok || !at.Equal(now.Add(5*time.Second)) {
+		t.Fatalf("ExpiresAt(key_004) = %v, %v; want %v, true", at, ok, now.Add(5*time.Second))
+	}
+	if at, ok := cf.ExpiresAt([]byte("key_001")); !ok || !at.IsZero() {
+		t.Fatalf("ExpiresAt(key_001) = %v, %v; want zero, true", at, ok)
+	}
+	tx.Commit()
+	db.Close()
+
+	db = openKV(t, path)
+	defer db.Close()
+	db.Now = func() time.Time { return now }
+	now = now.Add(50 * time.Second)
+
+	// keys with i+1 <= 50 are expired but not swept yet
+	rtx := db.BeginRead()
+	cf = rtx.ColumnFamily([]byte("sessions"))
+	if _, ok := cf.Get([]byte("key_010")); ok {
+		t.Fatal("Get() returned an expired key")
+	}
+	if val, ok := cf.Get([]byte("key_000")); !ok || string(val) != "new" {
+		t.Fatalf("Get(key_000) = %q, %v; want new, true", val, ok)
+	}
+	n := 0
+	cf.Scan(nil, nil, func(key, val []byte) bool {
+		n++
+		return true
+	})
+	// 50 odd keys, key_000, key_002 and 25 even keys with i >= 50
+	if n != 77 {
+		t.Fatalf("scanned %d keys; want 77", n)
+	}
+	rtx.Rollback()
+
+	tx = db.Begin()
+	if swept, err := tx.Sweep(10); err != nil || swept != 10 {
+		t.Fatalf("Sweep(10) = %d, %v; want 10", swept, err)
+	}
+	if swept, err := tx.Sweep(100); err != nil || swept != 13 {
+		t.Fatalf("Sweep(100) = %d, %v; want 13", swept, err)
+	}
+	cf = tx.ColumnFamily([]byte("sessions"))
+	if ok, _ := cf.Expire([]byte("key_001"), time.Second); !ok {
+		t.Fatal("Expire(key_001) = false")
+	}
+	if ok, _ := cf.Expire([]byte("key_010"), time.Second); ok {
+		t.Fatal("Expire() of a swept key = true")
+	}
+	tx.Commit()
+
+	now = now.Add(time.Second)
+	tx = db.Begin()
+	// key_001 and key_050
+	if swept, _ := tx.Sweep(100); swept != 2 {
+		t.Fatalf("Sweep() = %d; want 2", swept)
+	}
+	if st := tx.ColumnFamily([]byte("sessions")).Stats(); st.Keys != 75 {
+		t.Fatalf("%d keys after sweeping; want 75", st.Keys)
+	}
+	tx.Commit()
+}
+
+func TestTTLSweeper(t *testing.T) {
+	db := &KV{
+		Path:          filepath.Join(t.TempDir(), "test.db"),
+		SweepInterval: time.Millisecond,
+	}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tx := db.Begin()
+	cf, _ := tx.CreateColumnFamily([]byte("cache"), CFOptions{TTL: true})
+	for i := 0; i < 10; i++ {
+		cf.SetTTL([]byte(fmt.Sprintf("key_%d", i)), []byte("v"), time.Millisecond)
+	}
+	tx.Commit()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rtx := db.BeginRead()
+		keys := rtx.ColumnFamily([]byte("cache")).Stats().Keys
+		rtx.Rollback()
+		if keys == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d keys left after sweeping", keys)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,466 @@
+package btree
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrTxClosed      = errors.New("tx closed")
+	ErrTxReadOnly    = errors.New("tx is read-only")
+	ErrInvalidKey    = errors.New("invalid key") // the empty key, see BT
+	ErrKeyNotFound   = errors.New("key not found")
+	ErrKeyTooLarge   = errors.New("key too large")   // over KV.MaxKeySize
+	ErrValueTooLarge = errors.New("value too large") // over KV.MaxValueSize
+	// the file can't grow, the disk is full or the file is at its limit
+	ErrDatabaseFull = errors.New("database full")
+)
+
+// Tx is either a read-only snapshot of the last durable version, or the
+// single write transaction.
+//
+// readers read the mmap directly and don't block or get blocked by the writer,
+// pages they can see are not reused until Rollback.
+//
+// the writer holds db.mu until Commit or Rollback and updates the tree
+// in place (copy-on-write), Commit hands the updates to the committer.
+type Tx struct {
+	db       *KV
+	writable bool
+	version  uint64
+	tree     *BT
+	catalog  *BT
+	buckets  map[string]*Bucket // opened buckets by catalog key
+	chunks   [][]byte
+	pool     *bufferPool // instead of chunks with KV.PoolPages
+	done     bool
+
+	base    []byte // meta page at begin, for rollback and Seq
+	nappend uint64
+
+	watched bool     // there were watchers at begin or the changefeed is on
+	changes []change // for the watchers, the changefeed and the audit log, see Watch
+	audit   txAudit
+
+	time int64 // the clock of the transaction in ns, db.Now if zero
+
+	start time.Time     // with Metrics
+	reads atomic.Uint64 // pages read by a reader, for Metrics
+
+	err atomic.Pointer[error] // the first fault, internal or context error, see Err
+	ctx context.Context       // of BeginCtx, see ctx.go
+
+	views [][]byte // the values returned with KV.PoisonViews, see view.go
+}
+
+func (db *KV) BeginRead() *Tx {
+	db.rmu.Lock()
+	defer db.rmu.Unlock()
+	return db.beginRead()
+}
+
+// with db.rmu
+func (db *KV) beginRead() *Tx {
+	tx := &Tx{
+		db:      db,
+		version: db.version,
+		base:    db.durable,
+		chunks:  db.mmap.chunks,
+		pool:    db.pool.cur,
+		buckets: map[string]*Bucket{},
+	}
+	tx.tree = &BT{root: binary.LittleEndian.Uint64(db.durable[16:24]), get: tx.pageRead, filters: db.filters}
+	tx.catalog = &BT{root: binary.LittleEndian.Uint64(db.durable[64:72]), get: tx.pageRead, filters: db.filters}
+	if db.Metrics != nil {
+		tx.start = time.Now()
+	}
+	db.readers[tx.version]++
+	return tx
+}
+
+// begins the write transaction, waits for the current one to finish.
+// the transaction sees updates of the previous writers that are not durable yet.
+func (db *KV) Begin() *Tx {
+	db.mu.Lock()
+	return db.begin()
+}
+
+// with db.mu
+func (db *KV) begin() *Tx {
+	tx := &Tx{
+		db:       db,
+		writable: true,
+		tree:     &db.tree,
+		catalog:  &db.catalog,
+		buckets:  map[string]*Bucket{},
+		base:     saveMeta(db),
+		nappend:  db.page.nappend,
+		watched:  db.Changefeed || db.Audit != nil || db.watch.n.Load() > 0,
+	}
+	if db.Metrics != nil {
+		tx.start = time.Now()
+	}
+	return tx
+}
+
+func (tx *Tx) Writable() bool {
+	return tx.writable
+}
+
+// the commit sequence of the version the transaction reads, the number of
+// committed write transactions that changed the database
+func (tx *Tx) Seq() uint64 {
+	if tx.writable {
+		return tx.db.seq
+	}
+	return binary.LittleEndian.Uint64(tx.base[72:80])
+}
+
+// waits until the updates are durable, unless the database is in async mode
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	done := tx.commit()
+	if tx.db.Async {
+		return failed(done)
+	}
+	return <-done
+}
+
+// applies the updates and queues them for the committer
+func (tx *Tx) commit() <-chan error {
+	db := tx.db
+	tx.canceled()
+	err := tx.Err()
+	if err == nil {
+		err = db.Failed()
+	}
+	if err == nil {
+		err = tx.apply()
+	}
+	if err != nil {
+		return tx.fail(err)
+	}
+	tx.done = true
+	tx.poison()
+	defer db.mu.Unlock()
+	db.observe(METRIC_WRITE_TX, tx.start)
+	db.endFresh(true)
+	if bytes.Equal(saveMeta(db), tx.base) {
+		db.count(METRIC_COMMITS, 1)
+		done := make(chan error, 1)
+		done <- nil
+		return done
+	}
+	if db.Replica || db.ReadOnly {
+		tx.discard()
+		done := make(chan error, 1)
+		if db.ReadOnly {
+			done <- ErrReadOnly
+		} else {
+			done <- ErrReplica
+		}
+		return done
+	}
+	db.count(METRIC_COMMITS, 1)
+	db.seq++
+	for i := range tx.changes {
+		tx.changes[i].Seq = db.seq
+	}
+	db.queue.changes = append(db.queue.changes, tx.changes...)
+	if db.Audit != nil && len(tx.changes) > 0 {
+		db.queue.audit = append(db.queue.audit, tx.auditRecord(db.seq))
+	}
+	return enqueue(db)
+}
+
+// writes the changes to the changefeed and the records of the buckets
+func (tx *Tx) apply() (err error) {
+	defer tx.catch("Commit", &err)
+	db := tx.db
+	if db.Changefeed && len(tx.changes) > 0 && !db.Replica && !db.ReadOnly {
+		tx.logChanges(db.seq + 1)
+	}
+	for key, b := range tx.buckets {
+		if b.dirty {
+			tx.catalog.Insert([]byte(key), encodeBucket(b))
+		}
+	}
+	return nil
+}
+
+// ends a write transaction with a fault, its updates may be half applied
+func (tx *Tx) fail(err error) <-chan error {
+	tx.done = true
+	tx.poison()
+	tx.discard()
+	tx.db.count(METRIC_ROLLBACKS, 1)
+	tx.db.mu.Unlock()
+	done := make(chan error, 1)
+	done <- err
+	return done
+}
+
+// ends the transaction, discards updates of the write transaction
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	tx.done = true
+	tx.poison()
+	db := tx.db
+	if tx.writable {
+		tx.discard()
+		db.count(METRIC_ROLLBACKS, 1)
+		db.observe(METRIC_WRITE_TX, tx.start)
+		db.mu.Unlock()
+		return nil
+	}
+	db.count(METRIC_PAGE_READS, tx.reads.Load())
+	if tx.pool != nil {
+		tx.pool.report(db)
+	}
+	db.observe(METRIC_READ_TX, tx.start)
+	db.rmu.Lock()
+	defer db.rmu.Unlock()
+	db.readers[tx.version]--
+	if db.readers[tx.version] == 0 {
+		delete(db.readers, tx.version)
+		db.ended.Broadcast()
+	}
+	return nil
+}
+
+// drops the updates of the write transaction, with db.mu
+func (tx *Tx) discard() {
+	db := tx.db
+	// pages reused from the free list become free again,
+	// writing them on the next flush is harmless
+	loadMeta(db, tx.base)
+	for i := tx.nappend; i < db.page.nappend; i++ {
+		db.arena.put(db.page.updates[db.page.flushed+i])
+		delete(db.page.updates, db.page.flushed+i)
+	}
+	db.page.nappend = tx.nappend
+	db.endFresh(false)
+}
+
+// true if the transaction has ended, ErrTxClosed is its error then. the
+// reads without an error return their zero values, see Err.
+func (tx *Tx) closed() bool {
+	if !tx.done {
+		return false
+	}
+	err := ErrTxClosed
+	tx.err.CompareAndSwap(nil, &err)
+	return true
+}
+
+func (tx *Tx) Get(key []byte) ([]byte, bool) {
+	if tx.closed() || tx.canceled() {
+		return nil, false
+	}
+	defer tx.catch("Get", nil)
+	return tx.view(tx.tree.Get(key))
+}
+
+// like Get, the value is a copy that can be kept after the transaction,
+// see view.go
+func (tx *Tx) GetCopy(key []byte) ([]byte, bool) {
+	val, ok := tx.Get(key)
+	return bytes.Clone(val), ok
+}
+
+// the value of `key`, ErrKeyNotFound if there is none. unlike Get a fault
+// is returned, not only in Err.
+func (tx *Tx) Fetch(key []byte) ([]byte, error) {
+	if tx.done {
+		return nil, ErrTxClosed
+	}
+	if len(key) == 0 {
+		return nil, ErrInvalidKey
+	}
+	if tx.canceled() {
+		return nil, tx.Err()
+	}
+	var err error
+	val, ok := tx.view(func() ([]byte, bool) {
+		defer tx.catch("Fetch", &err)
+		return tx.tree.Get(key)
+	}())
+	return found(val, ok, err)
+}
+
+// the result of Fetch
+func found(val []byte, ok bool, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return val, nil
+}
+
+// ErrKeyTooLarge or ErrValueTooLarge for a pair of these sizes as stored
+func (db *KV) checkSize(klen, vlen int) error {
+	if klen > db.MaxKeySize {
+		return fmt.Errorf("%w: %d bytes", ErrKeyTooLarge, klen)
+	}
+	if vlen > db.MaxValueSize {
+		return fmt.Errorf("%w: %d bytes", ErrValueTooLarge, vlen)
+	}
+	return nil
+}
+
+func (tx *Tx) Set(key []byte, val []byte) (err error) {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if len(key) == 0 {
+		return ErrInvalidKey
+	}
+	if err := tx.db.checkSize(len(key), len(val)); err != nil {
+		return err
+	}
+	if err := tx.checkEntry(nil, key, val); err != nil {
+		return err
+	}
+	tx.canceled()
+	if err := tx.Err(); err != nil {
+		return err
+	}
+	defer tx.catch("Set", &err)
+	tx.record(nil, key, val, true)
+	tx.tree.Insert(key, val)
+	return nil
+}
+
+func (tx *Tx) Del(key []byte) (deleted bool, err error) {
+	if tx.done {
+		return false, ErrTxClosed
+	}
+	if !tx.writable {
+		return false, ErrTxReadOnly
+	}
+	if len(key) == 0 {
+		return false, ErrInvalidKey
+	}
+	tx.canceled()
+	if err := tx.Err(); err != nil {
+		return false, err
+	}
+	defer tx.catch("Del", &err)
+	tx.record(nil, key, nil, false)
+	return tx.tree.Delete(key), nil
+}
+
+func (tx *Tx) pageRead(ptr uint64) []byte {
+	tx.reads.Add(1)
+	if tx.pool != nil {
+		return tx.pool.get(ptr)
+	}
+	return mmapRead(tx.chunks, ptr)
+}
+
+// calls `fn` for keys in [start, end) in order until it returns false
+func (tx *Tx) Scan(start, end []byte, fn func(key, val []byte) bool) {
+	if tx.closed() || tx.canceled() {
+		return
+	}
+	defer tx.catch("Scan", nil)
+	tx.tree.Scan(start, end, tx.interruptible(callback(fn)))
+}
+
+// calls `fn` for every key in order until it returns an error, which is
+// returned. a fault or a done context ends it too, see Err. the key and
+// the value are valid until `fn` returns.
+func (tx *Tx) ForEach(fn func(key, val []byte) error) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	return forEach(tx, tx.Scan, fn)
+}
+
+// ForEach with the Scan of a transaction or a bucket
+func forEach(tx *Tx, scan func(start, end []byte, fn func(key, val []byte) bool), fn func(key, val []byte) error) error {
+	var err error
+	scan(nil, nil, func(key, val []byte) bool {
+		err = fn(key, val)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Err()
+}
+
+// number of keys in [start, end), see BT.Count
+func (tx *Tx) Count(start, end []byte) int {
+	if tx.closed() || tx.canceled() {
+		return 0
+	}
+	defer tx.catch("Count", nil)
+	return tx.tree.Count(start, end)
+}
+
+// cursor at the first key >= `key`, valid until the tree is updated
+func (tx *Tx) Seek(key []byte) *BIter {
+	if tx.closed() || tx.canceled() {
+		return &BIter{tree: tx.tree}
+	}
+	defer tx.catch("Seek", nil)
+	return tx.tree.Seek(key)
+}
+
+// cursor at the last key <= `key`, valid until the tree is updated
+func (tx *Tx) SeekLE(key []byte) *BIter {
+	if tx.closed() || tx.canceled() {
+		return &BIter{tree: tx.tree}
+	}
+	defer tx.catch("SeekLE", nil)
+	return tx.tree.SeekLE(key)
+}
+
+// number of keys less than `key`, see BT.Rank
+func (tx *Tx) Rank(key []byte) int {
+	if tx.closed() || tx.canceled() {
+		return 0
+	}
+	defer tx.catch("Rank", nil)
+	return tx.tree.Rank(key)
+}
+
+// cursor at the key of rank `i`, the first one is 0, valid until the tree
+// is updated. to skip to the i-th row of a scan.
+func (tx *Tx) SelectNth(i int) *BIter {
+	if tx.closed() || tx.canceled() {
+		return &BIter{tree: tx.tree}
+	}
+	defer tx.catch("SelectNth", nil)
+	return tx.tree.SelectNth(i)
+}
+
+// scans [start, end) with `n` goroutines, see BT.ScanParallel
+func (tx *Tx) ScanParallel(start, end []byte, n int, fn func(shard int, key, val []byte) error) (err error) {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if tx.canceled() {
+		return tx.Err()
+	}
+	defer tx.catch("ScanParallel", &err)
+	return tx.tree.ScanParallel(start, end, n, tx.interruptibleParallel(parallelCallback(fn)))
+}
@@ -0,0 +1,348 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestReadTxSnapshot(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	for i := 0; i < 200; i++ {
+		db.Set([]byte(fmt.Sprintf("key_%d", i)), []byte("old"))
+	}
+	tx := db.BeginRead()
+
+	// overwrite everything many times, freed pages would be reused without the reader
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 200; i++ {
+			val := fmt.Sprintf("new_%d", round)
+			if err := db.Set([]byte(fmt.Sprintf("key_%d", i)), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	db.Set([]byte("added"), []byte("x"))
+
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		val, ok := tx.Get([]byte(key))
+		if !ok || string(val) != "old" {
+			t.Fatalf("tx.Get(%s) = %q, %v; want old, true", key, val, ok)
+		}
+	}
+	if _, ok := tx.Get([]byte("added")); ok {
+		t.Fatal("reader sees a key added after it started")
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != ErrTxClosed {
+		t.Fatalf("second Rollback() = %v; want ErrTxClosed", err)
+	}
+
+	tx = db.BeginRead()
+	defer tx.Rollback()
+	if val, ok := tx.Get([]byte("key_0")); !ok || string(val) != "new_19" {
+		t.Fatalf("tx.Get(key_0) = %q, %v; want new_19, true", val, ok)
+	}
+}
+
+func TestReadTxPagesReclaimed(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		db.Set([]byte(fmt.Sprintf("key_%d", i)), []byte("val"))
+	}
+
+	// the reader pins the freed pages, the file grows
+	tx := db.BeginRead()
+	before := db.page.flushed
+	for i := 0; i < 100; i++ {
+		db.Set([]byte(fmt.Sprintf("key_%d", i)), []byte("val2"))
+	}
+	pinned := db.page.flushed
+	if pinned <= before {
+		t.Fatalf("pages were reused while a reader can see them")
+	}
+	tx.Rollback()
+
+	// once the reader is done the pages are reused
+	for i := 0; i < 1000; i++ {
+		db.Set([]byte(fmt.Sprintf("key_%d", i%100)), []byte("val3"))
+	}
+	if db.page.flushed > pinned+20 {
+		t.Fatalf("pages are not reused: %d pages before, %d after", pinned, db.page.flushed)
+	}
+}
+
+func TestReadTxConcurrent(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	const nkeys = 100
+	for i := 0; i < nkeys; i++ {
+		db.Set([]byte(fmt.Sprintf("key_%d", i)), []byte("0"))
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	errs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// keys are updated in order, a snapshot never sees
+				// a later key with a newer value than an earlier one
+				tx := db.BeginRead()
+				prev := 1 << 30
+				for i := 0; i < nkeys; i++ {
+					val, ok := tx.Get([]byte(fmt.Sprintf("key_%d", i)))
+					round, err := strconv.Atoi(string(val))
+					if !ok || err != nil || round > prev {
+						errs <- fmt.Errorf("inconsistent snapshot: key_%d = %q, %v", i, val, ok)
+						tx.Rollback()
+						return
+					}
+					prev = round
+				}
+				tx.Rollback()
+			}
+		}()
+	}
+
+	for round := 1; round <= 50; round++ {
+		for i := 0; i < nkeys; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprint(round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteTxCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+
+	tx := db.Begin()
+	for i := 0; i < 100; i++ {
+		if err := tx.Set([]byte(fmt.Sprintf("key_%d", i)), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if val, ok := tx.Get([]byte("key_5")); !ok || string(val) != "val" {
+		t.Fatalf("tx.Get(key_5) = %q, %v; want val, true", val, ok)
+	}
+	if deleted, err := tx.Del([]byte("key_0")); !deleted || err != nil {
+		t.Fatalf("tx.Del(key_0) = %v, %v; want true, nil", deleted, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != ErrTxClosed {
+		t.Fatalf("second Commit() = %v; want ErrTxClosed", err)
+	}
+	db.Close()
+
+	db = openKV(t, path)
+	defer db.Close()
+	if _, ok := db.Get([]byte("key_0")); ok {
+		t.Fatal("key deleted in tx is found")
+	}
+	if val, ok := db.Get([]byte("key_99")); !ok || string(val) != "val" {
+		t.Fatalf("Get(key_99) = %q, %v; want val, true", val, ok)
+	}
+}
+
+func TestWriteTxRollback(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	ref := map[string]string{}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		db.Set([]byte(key), []byte("val"))
+		ref[key] = "val"
+	}
+	for i := 0; i < 300; i += 2 {
+		db.Del([]byte(fmt.Sprintf("key_%d", i)))
+		delete(ref, fmt.Sprintf("key_%d", i))
+	}
+
+	tx := db.Begin()
+	for i := 0; i < 1000; i++ {
+		tx.Set([]byte(fmt.Sprintf("key_%d", i)), []byte("tx"))
+	}
+	tx.Del([]byte("key_1"))
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertKV(t, db, ref)
+	if _, ok := db.Get([]byte("key_500")); ok {
+		t.Fatal("key set in rolled back tx is found")
+	}
+
+	// the database is still writable
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		if err := db.Set([]byte(key), []byte("after")); err != nil {
+			t.Fatal(err)
+		}
+		ref[key] = "after"
+	}
+	assertKV(t, db, ref)
+}
+
+func TestReadTxIsReadOnly(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	if err := tx.Set([]byte("a"), []byte("1")); err != ErrTxReadOnly {
+		t.Fatalf("Set() = %v; want ErrTxReadOnly", err)
+	}
+	if _, err := tx.Del([]byte("a")); err != ErrTxReadOnly {
+		t.Fatalf("Del() = %v; want ErrTxReadOnly", err)
+	}
+	if err := tx.Commit(); err != ErrTxReadOnly {
+		t.Fatalf("Commit() = %v; want ErrTxReadOnly", err)
+	}
+}
+
+func TestEmptyKey(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	if err := db.Set(nil, []byte("1")); err != ErrInvalidKey {
+		t.Fatalf("Set(empty) = %v; want ErrInvalidKey", err)
+	}
+	if _, err := db.Del([]byte{}); err != ErrInvalidKey {
+		t.Fatalf("Del(empty) = %v; want ErrInvalidKey", err)
+	}
+	tx := db.Begin()
+	for i := 0; i < 1000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("1"))
+	}
+	b, _ := tx.CreateBucket([]byte("b"))
+	if err := b.Set(nil, []byte("1")); err != ErrInvalidKey {
+		t.Fatalf("Bucket.Set(empty) = %v; want ErrInvalidKey", err)
+	}
+	if _, err := b.Del(nil); err != ErrInvalidKey {
+		t.Fatalf("Bucket.Del(empty) = %v; want ErrInvalidKey", err)
+	}
+	// the transaction goes on
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the sentinel isn't a key
+	tx = db.BeginRead()
+	defer tx.Rollback()
+	if _, ok := tx.Get(nil); ok {
+		t.Fatal("Get(empty) found the sentinel")
+	}
+	n := 0
+	tx.Scan(nil, nil, func(key, val []byte) bool {
+		if len(key) == 0 {
+			t.Fatal("Scan() returned the sentinel")
+		}
+		n++
+		return true
+	})
+	if n != 1000 || tx.Count(nil, nil) != 1000 {
+		t.Fatalf("Scan() = %d keys, Count() = %d", n, tx.Count(nil, nil))
+	}
+	if iter := tx.SeekLE([]byte("a")); iter.Valid() {
+		t.Fatal("SeekLE() before the first key is valid")
+	}
+	iter := tx.Seek(nil)
+	if key, _ := iter.Deref(); string(key) != "k0000" {
+		t.Fatalf("Seek(empty) = %q", key)
+	}
+	if iter.Prev(); iter.Valid() {
+		t.Fatal("Prev() of the first key is valid")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	tx := db.Begin()
+	if err := tx.Set(make([]byte, BT_MAX_KEY_SIZE+1), nil); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("Set(a large key) = %v", err)
+	}
+	if err := tx.Set([]byte("a"), make([]byte, BT_MAX_VAL_SIZE+1)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Set(a large value) = %v", err)
+	}
+	if err := tx.Set(bytes.Repeat([]byte("k"), BT_MAX_KEY_SIZE), make([]byte, BT_MAX_VAL_SIZE)); err != nil {
+		t.Fatalf("Set() at the limits = %v", err)
+	}
+	if _, err := tx.Fetch([]byte("a")); err != ErrKeyNotFound {
+		t.Fatalf("Fetch() of a missing key = %v", err)
+	}
+	if _, err := tx.CreateBucket(make([]byte, BT_MAX_KEY_SIZE)); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("CreateBucket(a large name) = %v", err)
+	}
+
+	// the expiry key and the version are larger than the pair
+	b, _ := tx.CreateColumnFamily([]byte("b"), CFOptions{TTL: true, MaxVersions: 2})
+	if err := b.Set(make([]byte, BT_MAX_KEY_SIZE-8), nil); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("Bucket.Set(a large key) = %v", err)
+	}
+	if err := b.Set([]byte("a"), make([]byte, BT_MAX_VAL_SIZE-7)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Bucket.Set(a large value) = %v", err)
+	}
+	if err := b.Set([]byte("a"), make([]byte, BT_MAX_VAL_SIZE-8)); err != nil {
+		t.Fatalf("Bucket.Set() at the limit = %v", err)
+	}
+	if val, err := b.Fetch([]byte("a")); err != nil || len(val) != BT_MAX_VAL_SIZE-8 {
+		t.Fatalf("Bucket.Fetch() = %d bytes, %v", len(val), err)
+	}
+	if _, err := b.Fetch([]byte("b")); err != ErrKeyNotFound {
+		t.Fatalf("Bucket.Fetch() of a missing key = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Fetch([]byte("a")); err != ErrTxClosed {
+		t.Fatalf("Fetch() after Commit = %v", err)
+	}
+	// the reads without an error don't panic, the transaction has it
+	if _, ok := tx.Get([]byte("a")); ok || tx.Count(nil, nil) != 0 || tx.Seek(nil).Valid() || tx.Range(nil, nil).Valid() {
+		t.Fatal("read after Commit")
+	}
+	if _, ok := b.Get([]byte("a")); ok || b.Rank([]byte("a")) != 0 || tx.Bucket([]byte("b")) != nil {
+		t.Fatal("Bucket read after Commit")
+	}
+	if err := tx.Err(); err != ErrTxClosed {
+		t.Fatalf("Err() after Commit = %v", err)
+	}
+
+	err := fullError(fmt.Errorf("write pages: %w", syscall.ENOSPC))
+	if !errors.Is(err, ErrDatabaseFull) || !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("fullError() = %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// Versioned families keep old values of keys in the history tree. Every
+// Set and Del of a key adds a version stamped with the time of the write;
+// versions are never updated in place, the tree is copy-on-write like the
+// rest of the file, so the history costs only the pages of new versions.
+//
+// history key
+// | key (escaped, terminated) | time |
+// |            ...            |  8B  |
+// time is unix nanoseconds, big-endian so that versions of a key are ordered by time
+//
+// history value
+// | kind | value (compressed) |
+// |  1B  |        ...         |
+
+const (
+	VER_VALUE   = 0
+	VER_DELETED = 1
+)
+
+// a version of a key, Value is nil for deletions
+type Version struct {
+	Time    time.Time
+	Value   []byte
+	Deleted bool
+}
+
+// escaped and terminated like bucket names, so no key is a prefix of another
+func historyPrefix(key []byte) []byte {
+	return bucketKey(nil, key)
+}
+
+func historyKey(key []byte, ts int64) []byte {
+	hkey := historyPrefix(key)
+	return binary.BigEndian.AppendUint64(hkey, uint64(ts))
+}
+
+func (b *Bucket) addVersion(key []byte, val []byte, deleted bool) {
+	now := b.tx.now()
+	hval := []byte{VER_VALUE}
+	if deleted {
+		hval[0] = VER_DELETED
+	} else if b.opts.Compression {
+		hval = append(hval, encodeValue(val)...)
+	} else {
+		hval = append(hval, val...)
+	}
+	b.history.Insert(historyKey(key, now), hval)
+	b.prune(key, now)
+}
+
+// drops versions of the key that fall out of MaxVersions or Retention
+func (b *Bucket) prune(key []byte, now int64) {
+	var stamps []int64
+	b.scanHistory(key, func(ts int64, _ []byte) bool {
+		stamps = append(stamps, ts)
+		return true
+	})
+	n := len(stamps)
+	for i, ts := range stamps {
+		keep := true
+		if max := int(b.opts.MaxVersions); max > 0 && i < n-max {
+			keep = false
+		}
+		// stamps[i+1] replaced this version
+		if b.opts.Retention > 0 && i+1 < n && stamps[i+1] <= now-int64(b.opts.Retention) {
+			keep = false
+		}
+		if !keep {
+			b.history.Delete(historyKey(key, ts))
+		}
+	}
+}
+
+// calls `fn` for versions of the key in time order until it returns false
+func (b *Bucket) scanHistory(key []byte, fn func(ts int64, hval []byte) bool) {
+	prefix := historyPrefix(key)
+	end := append([]byte{}, prefix...)
+	end[len(end)-1]++ // the terminator 0x00 0x01 -> 0x00 0x02
+	b.history.Scan(prefix, end, func(hkey, hval []byte) bool {
+		return fn(int64(binary.BigEndian.Uint64(hkey[len(prefix):])), hval)
+	})
+}
+
+func (b *Bucket) decodeVersion(ts int64, hval []byte) Version {
+	ver := Version{Time: time.Unix(0, ts), Deleted: hval[0] == VER_DELETED}
+	if !ver.Deleted {
+		ver.Value = hval[1:]
+		if b.opts.Compression {
+			ver.Value = decodeValue(ver.Value)
+		}
+	}
+	return ver
+}
+
+// the value of the key as of `ts`, false if the key didn't exist at that time
+// or the version is no longer retained
+func (b *Bucket) GetVersion(key []byte, ts time.Time) ([]byte, bool) {
+	if b.tx.closed() {
+		return nil, false
+	}
+	prefix := historyPrefix(key)
+	iter := b.history.SeekLE(historyKey(key, ts.UnixNano()))
+	if !iter.Valid() {
+		return nil, false
+	}
+	hkey, hval := iter.Deref()
+	if len(hkey) != len(prefix)+8 || !bytes.HasPrefix(hkey, prefix) {
+		return nil, false
+	}
+	ver := b.decodeVersion(int64(binary.BigEndian.Uint64(hkey[len(prefix):])), hval)
+	return ver.Value, !ver.Deleted
+}
+
+// retained versions of the key in time order, nil for unversioned families
+func (b *Bucket) History(key []byte) []Version {
+	if b.tx.closed() {
+		return nil
+	}
+	var versions []Version
+	b.scanHistory(key, func(ts int64, hval []byte) bool {
+		versions = append(versions, b.decodeVersion(ts, hval))
+		return true
+	})
+	return versions
+}
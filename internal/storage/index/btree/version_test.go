@@ -0,0 +1,105 @@
+package btree
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+	start := time.Unix(1000, 0)
+	now := start
+	db.Now = func() time.Time { return now }
+
+	tx := db.Begin()
+	opts := CFOptions{MaxVersions: 3, Compression: true}
+	cf, err := tx.CreateColumnFamily([]byte("docs"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+	for i := 1; i <= 5; i++ {
+		now = start.Add(time.Duration(i) * time.Second)
+		tx = db.Begin()
+		tx.ColumnFamily([]byte("docs")).Set([]byte("k"), []byte(fmt.Sprintf("v%d", i)))
+		tx.Commit()
+	}
+	now = start.Add(6 * time.Second)
+	tx = db.Begin()
+	tx.ColumnFamily([]byte("docs")).Del([]byte("k"))
+	tx.Commit()
+	db.Close()
+
+	db = openKV(t, path)
+	defer db.Close()
+	rtx := db.BeginRead()
+	defer rtx.Rollback()
+	cf = rtx.ColumnFamily([]byte("docs"))
+	if cf.Options() != opts {
+		t.Fatalf("Options() after reopen = %+v; want %+v", cf.Options(), opts)
+	}
+	if _, ok := cf.Get([]byte("k")); ok {
+		t.Fatal("Get() of a deleted key returned a value")
+	}
+	history := cf.History([]byte("k"))
+	if len(history) != 3 {
+		t.Fatalf("History() returned %d versions; want 3", len(history))
+	}
+	for i, ver := range history[:2] {
+		want := fmt.Sprintf("v%d", i+4)
+		if ver.Deleted || string(ver.Value) != want || !ver.Time.Equal(start.Add(time.Duration(i+4)*time.Second)) {
+			t.Fatalf("History()[%d] = %+v; want %s", i, ver, want)
+		}
+	}
+	if !history[2].Deleted {
+		t.Fatalf("History()[2] = %+v; want a deletion", history[2])
+	}
+
+	cases := []struct {
+		at   time.Duration
+		want string
+		ok   bool
+	}{
+		{at: 4 * time.Second, want: "v4", ok: true},
+		{at: 5500 * time.Millisecond, want: "v5", ok: true},
+		{at: 2 * time.Second}, // pruned
+		{at: 6 * time.Second}, // deleted
+		{at: time.Hour},
+	}
+	for _, c := range cases {
+		val, ok := cf.GetVersion([]byte("k"), start.Add(c.at))
+		if ok != c.ok || string(val) != c.want {
+			t.Fatalf("GetVersion(k, +%v) = %q, %v; want %q, %v", c.at, val, ok, c.want, c.ok)
+		}
+	}
+	if _, ok := cf.GetVersion([]byte("k\x00"), start.Add(time.Hour)); ok {
+		t.Fatal("GetVersion() returned a version of another key")
+	}
+}
+
+func TestVersionsRetention(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	start := time.Unix(1000, 0)
+	now := start
+	db.Now = func() time.Time { return now }
+
+	tx := db.Begin()
+	defer tx.Rollback()
+	cf, _ := tx.CreateColumnFamily([]byte("docs"), CFOptions{Retention: 10 * time.Second})
+	for _, sec := range []int{0, 5, 20} {
+		now = start.Add(time.Duration(sec) * time.Second)
+		cf.Set([]byte("k"), []byte(fmt.Sprint(sec)))
+	}
+	// the version written at 0 was replaced at 5, more than 10s ago
+	history := cf.History([]byte("k"))
+	if len(history) != 2 || string(history[0].Value) != "5" || string(history[1].Value) != "20" {
+		t.Fatalf("History() = %+v; want versions 5 and 20", history)
+	}
+	if plain, _ := tx.CreateBucket([]byte("plain")); plain.Set([]byte("k"), []byte("v")) != nil || plain.History([]byte("k")) != nil {
+		t.Fatal("unversioned bucket has a history")
+	}
+}
@@ -0,0 +1,39 @@
+package btree
+
+import "bytes"
+
+// The values returned by Get and Fetch of a transaction and its buckets
+// are views of the pages: the mmap or the buffer pool for a reader, the
+// nodes of the writer for a write transaction. they are valid until the
+// transaction ends, and in a write transaction until its next update. a
+// value kept longer is copied, by GetCopy or bytes.Clone. KV.Get has no
+// transaction, its values are copies.
+//
+// a view used too late reads the page as it is then: another value, or a
+// fault if the page is unmapped. with KV.PoisonViews the views are copies
+// the transaction overwrites with VIEW_POISON when it ends, so a view kept
+// by mistake reads bytes that stand out instead of a plausible value. for
+// debugging, each Get allocates.
+
+const VIEW_POISON = 0xdb
+
+// the value of a Get as returned to the caller, a copy to poison with
+// KV.PoisonViews
+func (tx *Tx) view(val []byte, ok bool) ([]byte, bool) {
+	if !tx.db.PoisonViews || !ok {
+		return val, ok
+	}
+	val = bytes.Clone(val)
+	tx.views = append(tx.views, val)
+	return val, ok
+}
+
+// overwrites the views returned by the transaction, at its end
+func (tx *Tx) poison() {
+	for _, val := range tx.views {
+		for i := range val {
+			val[i] = VIEW_POISON
+		}
+	}
+	tx.views = nil
+}
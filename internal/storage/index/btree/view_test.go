@@ -0,0 +1,55 @@
+package btree
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestPoisonViews(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithPoisonViews())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx := db.Begin()
+	tx.Set([]byte("a"), []byte("1"))
+	b, _ := tx.CreateBucket([]byte("b"))
+	b.Set([]byte("k"), []byte("val"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx = db.BeginRead()
+	view, _ := tx.Get([]byte("a"))
+	copied, _ := tx.GetCopy([]byte("a"))
+	bview, _ := tx.Bucket([]byte("b")).Get([]byte("k"))
+	bcopied, _ := tx.Bucket([]byte("b")).GetCopy([]byte("k"))
+	fetched, err := tx.Fetch([]byte("a"))
+	if err != nil || string(view) != "1" || string(bview) != "val" {
+		t.Fatalf("views %q %q, %v", view, bview, err)
+	}
+	tx.Rollback()
+	for _, v := range [][]byte{view, bview, fetched} {
+		if !bytes.Equal(v, bytes.Repeat([]byte{VIEW_POISON}, len(v))) {
+			t.Fatalf("view %q isn't poisoned", v)
+		}
+	}
+	if string(copied) != "1" || string(bcopied) != "val" {
+		t.Fatalf("copies %q %q", copied, bcopied)
+	}
+
+	// the views of a write transaction too
+	tx = db.Begin()
+	view, _ = tx.Get([]byte("a"))
+	tx.Set([]byte("c"), view)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if view[0] != VIEW_POISON {
+		t.Fatalf("view %q isn't poisoned", view)
+	}
+	if val, _ := db.Get([]byte("c")); string(val) != "1" {
+		t.Fatalf("Get() = %q", val)
+	}
+}
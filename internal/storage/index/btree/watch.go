@@ -0,0 +1,162 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Watchers receive the changes of keys in a range of the main keyspace or
+// of a top-level bucket. changes of a write transaction are recorded while
+// it runs if there were watchers at Begin, and are published in commit
+// order once the commit is durable, so a read transaction begun after a
+// change arrives sees it. a transaction begun before Watch is not seen.
+//
+// a watcher that doesn't keep up is closed with ErrWatchLagged rather than
+// stalling the commits. keys removed by Sweep and by DeleteBucket are not
+// reported, nor are changes of nested buckets.
+
+var (
+	ErrWatchLagged = errors.New("watcher fell behind")
+	ErrWatchClosed = errors.New("watcher closed")
+)
+
+// changes buffered per watcher
+const WATCH_BUFFER = 4096
+
+// a change of a key, Old is nil if the key did not exist, New is nil for
+// deletions
+type Change struct {
+	Seq    uint64 // the commit sequence of the transaction, see Tx.Seq
+	Bucket []byte // nil for the main keyspace
+	Key    []byte
+	Old    []byte
+	New    []byte
+}
+
+// a change and the catalog key of its bucket
+type change struct {
+	Change
+	bucket []byte
+}
+
+type Watcher struct {
+	// closed when the watcher ends, see Err
+	C <-chan Change
+
+	c          chan Change
+	db         *KV
+	bucket     []byte // catalog key, nil for the main keyspace
+	name       []byte
+	start, end []byte
+	err        error
+}
+
+// watches keys in [start, end) of the bucket, nil `bucket` is the main
+// keyspace and nil `end` means up to the last key
+func (db *KV) Watch(bucket, start, end []byte) *Watcher {
+	c := make(chan Change, WATCH_BUFFER)
+	w := &Watcher{C: c, c: c, db: db, start: bytes.Clone(start), end: bytes.Clone(end)}
+	if bucket != nil {
+		w.bucket = bucketKey(nil, bucket)
+		w.name = bytes.Clone(bucket)
+	}
+	db.watch.mu.Lock()
+	defer db.watch.mu.Unlock()
+	if db.watch.watchers == nil {
+		db.watch.watchers = map[*Watcher]struct{}{}
+	}
+	db.watch.watchers[w] = struct{}{}
+	db.watch.n.Add(1)
+	return w
+}
+
+// stops the watcher and closes C
+func (w *Watcher) Close() {
+	w.db.watch.mu.Lock()
+	defer w.db.watch.mu.Unlock()
+	w.stop(ErrWatchClosed)
+}
+
+// the reason C was closed: ErrWatchClosed, ErrWatchLagged or the closing
+// of the database. nil while C is open.
+func (w *Watcher) Err() error {
+	w.db.watch.mu.Lock()
+	defer w.db.watch.mu.Unlock()
+	return w.err
+}
+
+// with db.watch.mu
+func (w *Watcher) stop(err error) {
+	if w.err != nil {
+		return
+	}
+	w.err = err
+	close(w.c)
+	delete(w.db.watch.watchers, w)
+	w.db.watch.n.Add(-1)
+}
+
+func (w *Watcher) match(c *change) bool {
+	return bytes.Equal(c.bucket, w.bucket) &&
+		bytes.Compare(c.Key, w.start) >= 0 && (w.end == nil || bytes.Compare(c.Key, w.end) < 0)
+}
+
+// remembers the change of the key for the watchers, before it is applied
+func (tx *Tx) record(b *Bucket, key []byte, val []byte, set bool) {
+	if !tx.watched || b != nil && (bytes.Equal(b.key, changefeedKey) || bytes.Equal(b.key, blobKey)) {
+		return
+	}
+	c := change{Change: Change{Key: bytes.Clone(key)}}
+	var old []byte
+	var exists bool
+	if b == nil {
+		old, exists = tx.tree.Get(key)
+	} else {
+		old, exists = b.Get(key)
+		c.bucket = b.key
+	}
+	if !exists && !set {
+		return // deleting a missing key
+	}
+	if exists {
+		c.Old = append([]byte{}, old...)
+	}
+	if set {
+		c.New = append([]byte{}, val...)
+	}
+	tx.changes = append(tx.changes, c)
+}
+
+// delivers durable changes, called by the committer in commit order
+func (db *KV) publish(changes []change) {
+	if len(changes) == 0 {
+		return
+	}
+	db.watch.mu.Lock()
+	defer db.watch.mu.Unlock()
+	for w := range db.watch.watchers {
+		for i := range changes {
+			if !w.match(&changes[i]) {
+				continue
+			}
+			c := changes[i].Change
+			c.Bucket = w.name
+			select {
+			case w.c <- c:
+			default:
+				w.stop(ErrWatchLagged)
+			}
+			if w.err != nil {
+				break
+			}
+		}
+	}
+}
+
+func (db *KV) closeWatchers() {
+	db.watch.mu.Lock()
+	defer db.watch.mu.Unlock()
+	for w := range db.watch.watchers {
+		w.stop(errors.New("database closed"))
+	}
+}
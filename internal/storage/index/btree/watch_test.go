@@ -0,0 +1,94 @@
+package btree
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func nextChange(t *testing.T, w *Watcher) Change {
+	t.Helper()
+	select {
+	case c, ok := <-w.C:
+		if !ok {
+			t.Fatalf("watcher closed: %v", w.Err())
+		}
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change")
+	}
+	return Change{}
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openKV(t, path)
+	db.Set([]byte("b"), []byte("old"))
+	w := db.Watch(nil, []byte("a"), []byte("c"))
+	bw := db.Watch([]byte("bucket"), nil, nil)
+
+	tx := db.Begin()
+	tx.Set([]byte("a"), []byte("1"))
+	tx.Del([]byte("b"))
+	tx.Del([]byte("nope"))
+	tx.Set([]byte("c"), []byte("out of range"))
+	b, _ := tx.CreateBucket([]byte("bucket"))
+	b.Set([]byte("a"), []byte("in bucket"))
+	seq := tx.Seq()
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx = db.Begin()
+	tx.Set([]byte("a"), []byte("lost"))
+	tx.Rollback()
+	db.Set([]byte("a"), []byte("2"))
+
+	for _, want := range []string{
+		fmt.Sprintf("%d  a  1", seq+1),
+		fmt.Sprintf("%d  b old ", seq+1),
+		fmt.Sprintf("%d  a 1 2", seq+2),
+	} {
+		c := nextChange(t, w)
+		if got := fmt.Sprintf("%d %s %s %s %s", c.Seq, c.Bucket, c.Key, c.Old, c.New); got != want {
+			t.Fatalf("change = %q; want %q", got, want)
+		}
+	}
+	if c := nextChange(t, bw); string(c.Bucket) != "bucket" || string(c.Key) != "a" || c.Old != nil || string(c.New) != "in bucket" {
+		t.Fatalf("bucket change = %+v", c)
+	}
+
+	// a watcher that falls behind is closed, the others keep going
+	lagging := db.Watch(nil, nil, nil)
+	tx = db.Begin()
+	for i := 0; i <= WATCH_BUFFER; i++ {
+		tx.Set([]byte(fmt.Sprintf("z%05d", i)), nil)
+	}
+	tx.Commit()
+	db.Set([]byte("a"), []byte("3"))
+	if c := nextChange(t, w); string(c.New) != "3" {
+		t.Fatalf("change after the lagging one = %+v", c)
+	}
+	for range lagging.C {
+	}
+	if err := lagging.Err(); err != ErrWatchLagged {
+		t.Fatalf("Err() of a lagging watcher = %v", err)
+	}
+
+	w.Close()
+	if _, ok := <-w.C; ok || w.Err() != ErrWatchClosed {
+		t.Fatalf("after Close: %v", w.Err())
+	}
+
+	// the commit sequence is durable
+	last := db.BeginRead().Seq()
+	db.Close()
+	if _, ok := <-bw.C; ok {
+		t.Fatal("watcher open after the database was closed")
+	}
+	db = openKV(t, path)
+	defer db.Close()
+	if tx := db.BeginRead(); tx.Seq() != last || last != seq+4 {
+		t.Fatalf("Seq() after reopen = %d; want %d", tx.Seq(), last)
+	}
+}
@@ -0,0 +1,644 @@
+// Package hash is a persistent extendible hash index for keyspaces of
+// point lookups, like session tokens, where the order of the B-tree isn't
+// needed: a lookup reads one page whatever the number of keys.
+//
+// the file is made of pages. page 0 is the meta page, the directory is a
+// run of consecutive pages of 2^depth bucket page numbers, the other pages
+// are buckets. the low `depth` bits of the hash of a key pick the entry of
+// the directory. a full bucket of local depth d is split in two by bit d of
+// the hashes, the directory doubles when d reaches its depth. buckets are
+// never merged and the file doesn't shrink, a new directory is appended and
+// the pages of the old one are reused by buckets, like the pages Open finds
+// unused.
+//
+// pages are updated in place. a commit writes the images of its pages to
+// the journal at Path+".journal" and fsyncs it, then writes them to the
+// file and fsyncs it, then truncates the journal. Open replays a journal
+// that is complete, so a commit is atomic.
+package hash
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"syscall"
+)
+
+const (
+	PAGE_SIZE     = 4096
+	MAX_KEY_SIZE  = 1000
+	MAX_VAL_SIZE  = 3000
+	MAX_DEPTH     = 24 // of the directory, 128 MB of page numbers
+	BUCKET_HEADER = 6  // nkeys, local depth, bytes used
+	PAIR_HEADER   = 4  // key and value lengths
+
+	SIG         = "godbhash"
+	JOURNAL_SIG = "godbhjnl"
+)
+
+var (
+	ErrKeySize = errors.New("hash: bad key size")
+	ErrValSize = errors.New("hash: value too large")
+	// the keys of a bucket share MAX_DEPTH bits of their hashes
+	ErrFull = errors.New("hash: the directory is at its maximum depth")
+	// a previous commit failed to write the file, Open again
+	ErrFailed = errors.New("hash: a commit failed")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type Index struct {
+	Path string
+
+	mu       sync.RWMutex // Get and Len readers, a single writer
+	fd       int
+	journal  int
+	depth    uint32
+	dir      []uint64 // bucket page numbers
+	dirStart uint64
+	npages   uint64
+	count    uint64
+	salt     uint64
+	free     []uint64
+	failed   bool
+}
+
+func (h *Index) Open() error {
+	var err error
+	if h.fd, err = createFileSync(h.Path); err != nil {
+		return fmt.Errorf("Index.Open: %w", err)
+	}
+	if h.journal, err = createFileSync(h.Path + ".journal"); err != nil {
+		syscall.Close(h.fd)
+		return fmt.Errorf("Index.Open: %w", err)
+	}
+	if err = h.load(); err != nil {
+		h.close()
+		return fmt.Errorf("Index.Open: %w", err)
+	}
+	return nil
+}
+
+func (h *Index) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.close()
+	return nil
+}
+
+func (h *Index) close() {
+	syscall.Close(h.journal)
+	syscall.Close(h.fd)
+}
+
+// replays the journal, creates the file if empty, then reads the directory
+// and finds the free pages
+func (h *Index) load() error {
+	if err := h.replay(); err != nil {
+		return err
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(h.fd, &st); err != nil {
+		return err
+	}
+	if st.Size == 0 {
+		return h.create()
+	}
+	meta := make([]byte, PAGE_SIZE)
+	if _, err := syscall.Pread(h.fd, meta, 0); err != nil {
+		return err
+	}
+	if !bytes.Equal(meta[:8], []byte(SIG)) {
+		return errors.New("bad meta page")
+	}
+	h.depth = binary.LittleEndian.Uint32(meta[8:12])
+	h.dirStart = binary.LittleEndian.Uint64(meta[16:24])
+	h.npages = binary.LittleEndian.Uint64(meta[24:32])
+	h.count = binary.LittleEndian.Uint64(meta[32:40])
+	h.salt = binary.LittleEndian.Uint64(meta[40:48])
+	ndir := dirPages(h.depth)
+	if h.depth > MAX_DEPTH || h.npages*PAGE_SIZE > uint64(st.Size) ||
+		h.dirStart == 0 || h.dirStart+ndir > h.npages {
+		return errors.New("bad meta page")
+	}
+
+	buf := make([]byte, ndir*PAGE_SIZE)
+	if _, err := syscall.Pread(h.fd, buf, int64(h.dirStart*PAGE_SIZE)); err != nil {
+		return err
+	}
+	h.dir = make([]uint64, 1<<h.depth)
+	used := make([]bool, h.npages)
+	used[0] = true
+	for i := range ndir {
+		used[h.dirStart+i] = true
+	}
+	for i := range h.dir {
+		h.dir[i] = binary.LittleEndian.Uint64(buf[8*i:])
+		if ptr := h.dir[i]; ptr == 0 || ptr >= h.npages || ptr >= h.dirStart && ptr < h.dirStart+ndir {
+			return fmt.Errorf("bad directory entry %d", i)
+		}
+		used[h.dir[i]] = true
+	}
+	for ptr, ok := range used {
+		if !ok {
+			h.free = append(h.free, uint64(ptr))
+		}
+	}
+	return nil
+}
+
+// the meta page, a directory of depth 0 and its bucket
+func (h *Index) create() error {
+	var salt [8]byte
+	rand.Read(salt[:])
+	h.salt = binary.LittleEndian.Uint64(salt[:])
+	h.npages = 1
+	c := h.begin()
+	ptr := c.alloc()
+	setBucketHeader(c.pages[ptr], 0, 0, BUCKET_HEADER)
+	h.dir = []uint64{ptr}
+	c.dirty = true
+	return c.commit()
+}
+
+// Get returns a copy of the value of the key
+func (h *Index) Get(key []byte) ([]byte, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	page := h.read(h.dir[h.hash(key)&(1<<h.depth-1)])
+	if pos := lookup(page, key); pos > 0 {
+		_, val := pairAt(page, pos)
+		return val, true
+	}
+	return nil, false
+}
+
+// the number of keys
+func (h *Index) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return int(h.count)
+}
+
+func (h *Index) Set(key, val []byte) error {
+	var b Batch
+	b.Set(key, val)
+	return h.Apply(&b)
+}
+
+// deletes the key, false if there is no such key
+func (h *Index) Del(key []byte) (bool, error) {
+	var b Batch
+	b.Del(key)
+	if err := b.check(); err != nil {
+		return false, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if lookup(h.read(h.dir[h.hash(key)&(1<<h.depth-1)]), key) == 0 {
+		return false, nil
+	}
+	return true, h.apply(&b)
+}
+
+// Batch is a list of updates applied by one commit
+type Batch struct {
+	ops []op
+}
+
+type op struct {
+	key, val []byte
+	del      bool
+}
+
+func (b *Batch) Set(key, val []byte) {
+	b.ops = append(b.ops, op{key: key, val: val})
+}
+
+func (b *Batch) Del(key []byte) {
+	b.ops = append(b.ops, op{key: key, del: true})
+}
+
+func (b *Batch) check() error {
+	for _, op := range b.ops {
+		if len(op.key) == 0 || len(op.key) > MAX_KEY_SIZE {
+			return ErrKeySize
+		}
+		if len(op.val) > MAX_VAL_SIZE {
+			return ErrValSize
+		}
+	}
+	return nil
+}
+
+// applies the updates in order and makes them durable, nothing is applied
+// if one fails
+func (h *Index) Apply(b *Batch) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.apply(b)
+}
+
+// with h.mu
+func (h *Index) apply(b *Batch) error {
+	if h.failed {
+		return ErrFailed
+	}
+	c := h.begin()
+	for _, op := range b.ops {
+		var err error
+		if op.del {
+			c.del(op.key)
+		} else {
+			err = c.set(op.key, op.val)
+		}
+		if err != nil {
+			c.rollback()
+			return err
+		}
+	}
+	return c.commit()
+}
+
+// the updates of a commit, with h.mu
+type commit struct {
+	h     *Index
+	pages map[uint64][]byte // updated pages, written by the commit
+	dirty bool              // the directory changed
+	base  struct {          // to roll back
+		depth  uint32
+		dir    []uint64
+		npages uint64
+		count  uint64
+		free   []uint64
+	}
+}
+
+func (h *Index) begin() *commit {
+	c := &commit{h: h, pages: map[uint64][]byte{}}
+	c.base.depth, c.base.dir, c.base.npages, c.base.count = h.depth, h.dir, h.npages, h.count
+	c.base.free = slices.Clone(h.free)
+	return c
+}
+
+func (c *commit) rollback() {
+	h := c.h
+	h.depth, h.dir, h.npages, h.count, h.free = c.base.depth, c.base.dir, c.base.npages, c.base.count, c.base.free
+}
+
+// a writable copy of the page
+func (c *commit) page(ptr uint64) []byte {
+	if page, ok := c.pages[ptr]; ok {
+		return page
+	}
+	page := slices.Clone(c.h.read(ptr))
+	c.pages[ptr] = page
+	return page
+}
+
+// a new zeroed page, a free one or appended
+func (c *commit) alloc() uint64 {
+	h := c.h
+	var ptr uint64
+	if n := len(h.free); n > 0 {
+		ptr, h.free = h.free[n-1], h.free[:n-1]
+	} else {
+		ptr = h.npages
+		h.npages++
+	}
+	c.pages[ptr] = make([]byte, PAGE_SIZE)
+	return ptr
+}
+
+// a copy of the directory the commit can change
+func (c *commit) writeDir() {
+	if !c.dirty {
+		c.h.dir = slices.Clone(c.h.dir)
+		c.dirty = true
+	}
+}
+
+func (c *commit) set(key, val []byte) error {
+	h := c.h
+	hash := h.hash(key)
+	for {
+		ptr := h.dir[hash&(1<<h.depth-1)]
+		page := c.page(ptr)
+		if pos := lookup(page, key); pos > 0 {
+			removePair(page, pos)
+			h.count--
+		}
+		if appendPair(page, key, val) {
+			h.count++
+			return nil
+		}
+		if err := c.split(ptr, page); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *commit) del(key []byte) {
+	h := c.h
+	page := c.page(h.dir[h.hash(key)&(1<<h.depth-1)])
+	if pos := lookup(page, key); pos > 0 {
+		removePair(page, pos)
+		h.count--
+	}
+}
+
+// splits the bucket at `ptr` by the next bit of the hashes, doubles the
+// directory first if the bucket is as deep
+func (c *commit) split(ptr uint64, page []byte) error {
+	h := c.h
+	local := uint32(binary.LittleEndian.Uint16(page[2:4]))
+	if local == h.depth {
+		if h.depth == MAX_DEPTH {
+			return ErrFull
+		}
+		c.writeDir()
+		h.dir = append(h.dir, h.dir...)
+		h.depth++
+	}
+	c.writeDir()
+	old := slices.Clone(page)
+	right := c.alloc()
+	clear(page)
+	setBucketHeader(page, 0, local+1, BUCKET_HEADER)
+	setBucketHeader(c.pages[right], 0, local+1, BUCKET_HEADER)
+	for pos := BUCKET_HEADER; pos < bucketUsed(old); pos = nextPair(old, pos) {
+		key, val := pairAt(old, pos)
+		dst := page
+		if h.hash(key)>>local&1 == 1 {
+			dst = c.pages[right]
+		}
+		assert(appendPair(dst, key, val))
+	}
+	for i, p := range h.dir {
+		if p == ptr && uint32(i)>>local&1 == 1 {
+			h.dir[i] = right
+		}
+	}
+	return nil
+}
+
+// makes the updates durable
+func (c *commit) commit() error {
+	h := c.h
+	oldDir := c.commitPages()
+	if err := h.write(c.pages); err != nil {
+		h.failed = true
+		return err
+	}
+	h.free = append(h.free, oldDir...)
+	return nil
+}
+
+// adds the directory to new pages if it changed and the meta page to the
+// pages of the commit, returns the pages of the old directory
+func (c *commit) commitPages() []uint64 {
+	h := c.h
+	var oldDir []uint64
+	if c.dirty {
+		if h.dirStart != 0 {
+			for i := range dirPages(c.base.depth) {
+				oldDir = append(oldDir, h.dirStart+i)
+			}
+		}
+		// a run at the end of the file
+		n := dirPages(h.depth)
+		h.dirStart = h.npages
+		h.npages += n
+		buf := make([]byte, n*PAGE_SIZE)
+		for i, ptr := range h.dir {
+			binary.LittleEndian.PutUint64(buf[8*i:], ptr)
+		}
+		for i := range n {
+			c.pages[h.dirStart+i] = buf[i*PAGE_SIZE : (i+1)*PAGE_SIZE]
+		}
+	}
+	meta := make([]byte, PAGE_SIZE)
+	copy(meta, SIG)
+	binary.LittleEndian.PutUint32(meta[8:12], h.depth)
+	binary.LittleEndian.PutUint64(meta[16:24], h.dirStart)
+	binary.LittleEndian.PutUint64(meta[24:32], h.npages)
+	binary.LittleEndian.PutUint64(meta[32:40], h.count)
+	binary.LittleEndian.PutUint64(meta[40:48], h.salt)
+	c.pages[0] = meta
+	return oldDir
+}
+
+// writes the pages to the journal, then to the file
+func (h *Index) write(pages map[uint64][]byte) error {
+	jnl := journal(pages)
+	if err := pwriteAll(h.journal, jnl, 0); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+	if err := syscall.Fsync(h.journal); err != nil {
+		return fmt.Errorf("fsync journal: %w", err)
+	}
+	if err := writePages(h.fd, jnl); err != nil {
+		return err
+	}
+	if err := syscall.Ftruncate(h.journal, 0); err != nil {
+		return fmt.Errorf("truncate journal: %w", err)
+	}
+	return nil
+}
+
+// the signature, the number of pages, the checksum of the rest, then the
+// number and the image of every page
+func journal(pages map[uint64][]byte) []byte {
+	ptrs := make([]uint64, 0, len(pages))
+	for ptr := range pages {
+		ptrs = append(ptrs, ptr)
+	}
+	slices.Sort(ptrs)
+	jnl := make([]byte, 16, 16+len(ptrs)*(8+PAGE_SIZE))
+	copy(jnl, JOURNAL_SIG)
+	binary.LittleEndian.PutUint32(jnl[8:12], uint32(len(ptrs)))
+	for _, ptr := range ptrs {
+		jnl = binary.LittleEndian.AppendUint64(jnl, ptr)
+		jnl = append(jnl, pages[ptr]...)
+	}
+	binary.LittleEndian.PutUint32(jnl[12:16], crc32.Checksum(jnl[16:], crcTable))
+	return jnl
+}
+
+// writes the pages of a complete journal to the file again, the commit may
+// have been interrupted
+func (h *Index) replay() error {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(h.journal, &st); err != nil {
+		return err
+	}
+	if st.Size < 16 {
+		return nil
+	}
+	jnl := make([]byte, st.Size)
+	if _, err := syscall.Pread(h.journal, jnl, 0); err != nil {
+		return fmt.Errorf("read journal: %w", err)
+	}
+	n := int64(binary.LittleEndian.Uint32(jnl[8:12]))
+	if !bytes.Equal(jnl[:8], []byte(JOURNAL_SIG)) || st.Size != 16+n*(8+PAGE_SIZE) ||
+		binary.LittleEndian.Uint32(jnl[12:16]) != crc32.Checksum(jnl[16:], crcTable) {
+		// the commit failed before its journal was durable
+		return syscall.Ftruncate(h.journal, 0)
+	}
+	if err := writePages(h.fd, jnl); err != nil {
+		return err
+	}
+	return syscall.Ftruncate(h.journal, 0)
+}
+
+// writes the pages of a journal to the file and fsyncs it
+func writePages(fd int, jnl []byte) error {
+	for pos := 16; pos < len(jnl); pos += 8 + PAGE_SIZE {
+		ptr := binary.LittleEndian.Uint64(jnl[pos:])
+		if err := pwriteAll(fd, jnl[pos+8:pos+8+PAGE_SIZE], int64(ptr*PAGE_SIZE)); err != nil {
+			return fmt.Errorf("write page %d: %w", ptr, err)
+		}
+	}
+	if err := syscall.Fsync(fd); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
+func pwriteAll(fd int, data []byte, offset int64) error {
+	for len(data) > 0 {
+		n, err := syscall.Pwrite(fd, data, offset)
+		if err != nil {
+			return err
+		}
+		data, offset = data[n:], offset+int64(n)
+	}
+	return nil
+}
+
+// reads a page of the file, with h.mu
+func (h *Index) read(ptr uint64) []byte {
+	page := make([]byte, PAGE_SIZE)
+	if n, err := syscall.Pread(h.fd, page, int64(ptr*PAGE_SIZE)); err != nil || n != PAGE_SIZE {
+		// like a fault of an mmap, there is no error path for reads
+		panic(fmt.Sprintf("read page %d: %d bytes, %v", ptr, n, err))
+	}
+	return page
+}
+
+// FNV-1a of the salt and the key, with the finalizer of splitmix64 so the
+// low bits used by the directory depend on every byte
+func (h *Index) hash(key []byte) uint64 {
+	x := uint64(14695981039346656037)
+	for i := 0; i < 8; i++ {
+		x ^= h.salt >> (8 * i) & 0xff
+		x *= 1099511628211
+	}
+	for _, b := range key {
+		x ^= uint64(b)
+		x *= 1099511628211
+	}
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// pages of a directory of `depth`
+func dirPages(depth uint32) uint64 {
+	return (8<<depth + PAGE_SIZE - 1) / PAGE_SIZE
+}
+
+func setBucketHeader(page []byte, nkeys uint16, local uint32, used int) {
+	binary.LittleEndian.PutUint16(page[0:2], nkeys)
+	binary.LittleEndian.PutUint16(page[2:4], uint16(local))
+	binary.LittleEndian.PutUint16(page[4:6], uint16(used))
+}
+
+func bucketUsed(page []byte) int {
+	return int(binary.LittleEndian.Uint16(page[4:6]))
+}
+
+func nextPair(page []byte, pos int) int {
+	klen := int(binary.LittleEndian.Uint16(page[pos:]))
+	vlen := int(binary.LittleEndian.Uint16(page[pos+2:]))
+	return pos + PAIR_HEADER + klen + vlen
+}
+
+func pairAt(page []byte, pos int) ([]byte, []byte) {
+	klen := int(binary.LittleEndian.Uint16(page[pos:]))
+	vlen := int(binary.LittleEndian.Uint16(page[pos+2:]))
+	key := page[pos+PAIR_HEADER : pos+PAIR_HEADER+klen]
+	return key, page[pos+PAIR_HEADER+klen : pos+PAIR_HEADER+klen+vlen]
+}
+
+// the position of the pair of the key in the bucket, 0 if there is none
+func lookup(page []byte, key []byte) int {
+	for pos := BUCKET_HEADER; pos < bucketUsed(page); pos = nextPair(page, pos) {
+		if k, _ := pairAt(page, pos); bytes.Equal(k, key) {
+			return pos
+		}
+	}
+	return 0
+}
+
+// adds the pair at the end of the bucket, false if it doesn't fit
+func appendPair(page []byte, key, val []byte) bool {
+	used := bucketUsed(page)
+	end := used + PAIR_HEADER + len(key) + len(val)
+	if end > PAGE_SIZE {
+		return false
+	}
+	binary.LittleEndian.PutUint16(page[used:], uint16(len(key)))
+	binary.LittleEndian.PutUint16(page[used+2:], uint16(len(val)))
+	copy(page[used+PAIR_HEADER:], key)
+	copy(page[used+PAIR_HEADER+len(key):], val)
+	nkeys := binary.LittleEndian.Uint16(page[0:2])
+	setBucketHeader(page, nkeys+1, uint32(binary.LittleEndian.Uint16(page[2:4])), end)
+	return true
+}
+
+// removes the pair at `pos`, the pairs after it move back
+func removePair(page []byte, pos int) {
+	used, next := bucketUsed(page), nextPair(page, pos)
+	copy(page[pos:], page[next:used])
+	clear(page[used-(next-pos) : used])
+	nkeys := binary.LittleEndian.Uint16(page[0:2])
+	setBucketHeader(page, nkeys-1, uint32(binary.LittleEndian.Uint16(page[2:4])), used-(next-pos))
+}
+
+func assert(condition bool) {
+	if !condition {
+		panic("assertion failed")
+	}
+}
+
+// open or create a file and fsync the directory
+func createFileSync(file string) (int, error) {
+	fd, err := syscall.Open(file, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return -1, fmt.Errorf("open file: %w", err)
+	}
+	dirfd, err := syscall.Open(path.Dir(file), os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("open directory: %w", err)
+	}
+	defer syscall.Close(dirfd)
+	if err = syscall.Fsync(dirfd); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("fsync directory: %w", err)
+	}
+	return fd, nil
+}
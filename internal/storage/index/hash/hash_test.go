@@ -0,0 +1,170 @@
+package hash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func assertIndex(t *testing.T, h *Index, ref map[string]string) {
+	t.Helper()
+	if h.Len() != len(ref) {
+		t.Fatalf("Len() = %d, want %d", h.Len(), len(ref))
+	}
+	for k, v := range ref {
+		if got, ok := h.Get([]byte(k)); !ok || string(got) != v {
+			t.Fatalf("Get(%s) = %q, %v", k, got, ok)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.hash")
+	h := &Index{Path: path}
+	if err := h.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ref := map[string]string{}
+	for round := 0; round < 3; round++ {
+		var b Batch
+		for i := 0; i < 5000; i++ {
+			k := fmt.Sprintf("session-%06d", i)
+			if i%5 == round {
+				b.Del([]byte(k))
+				delete(ref, k)
+				continue
+			}
+			v := fmt.Sprintf("%d-%s", round, bytes.Repeat([]byte{'v'}, i%200))
+			b.Set([]byte(k), []byte(v))
+			ref[k] = v
+		}
+		if err := h.Apply(&b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertIndex(t, h, ref)
+	if h.depth < 4 {
+		t.Fatalf("depth %d", h.depth)
+	}
+
+	if ok, err := h.Del([]byte("session-000001")); !ok || err != nil {
+		t.Fatalf("Del() = %v, %v", ok, err)
+	}
+	delete(ref, "session-000001")
+	if ok, err := h.Del([]byte("session-000001")); ok || err != nil {
+		t.Fatalf("Del() of a missing key = %v, %v", ok, err)
+	}
+	if err := h.Set([]byte("big"), make([]byte, MAX_VAL_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	ref["big"] = string(make([]byte, MAX_VAL_SIZE))
+
+	// nothing of a failed batch is applied
+	var b Batch
+	b.Set([]byte("a"), []byte("1"))
+	b.Set(nil, []byte("2"))
+	if err := h.Apply(&b); !errors.Is(err, ErrKeySize) {
+		t.Fatalf("Apply() = %v", err)
+	}
+	if err := h.Set([]byte("a"), make([]byte, MAX_VAL_SIZE+1)); !errors.Is(err, ErrValSize) {
+		t.Fatalf("Set() = %v", err)
+	}
+	assertIndex(t, h, ref)
+	h.Close()
+
+	h = &Index{Path: path}
+	if err := h.Open(); err != nil {
+		t.Fatal(err)
+	}
+	assertIndex(t, h, ref)
+	// the pages of the old directories are reused
+	if len(h.free) == 0 {
+		t.Fatal("no free pages")
+	}
+	h.Close()
+}
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.hash")
+	h := &Index{Path: path}
+	if err := h.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ref := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		k, v := fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i)
+		ref[k] = v
+		if err := h.Set([]byte(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the journal of a commit is durable, its pages are not written
+	c := h.begin()
+	for i := 0; i < 2000; i++ {
+		k, v := fmt.Sprintf("k%d", i), fmt.Sprintf("new%d", i)
+		ref[k] = v
+		if err := c.set([]byte(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.commitPages()
+	if err := pwriteAll(h.journal, journal(c.pages), 0); err != nil {
+		t.Fatal(err)
+	}
+	h.close()
+
+	h = &Index{Path: path}
+	if err := h.Open(); err != nil {
+		t.Fatal(err)
+	}
+	assertIndex(t, h, ref)
+	h.Close()
+	if st, err := os.Stat(path + ".journal"); err != nil || st.Size() != 0 {
+		t.Fatalf("journal: %v, %v", st, err)
+	}
+
+	// a torn journal is ignored
+	h = &Index{Path: path}
+	if err := h.Open(); err != nil {
+		t.Fatal(err)
+	}
+	c = h.begin()
+	c.set([]byte("k1"), []byte("lost"))
+	c.commitPages()
+	jnl := journal(c.pages)
+	if err := pwriteAll(h.journal, jnl[:len(jnl)-100], 0); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Fsync(h.journal)
+	h.close()
+	h = &Index{Path: path}
+	if err := h.Open(); err != nil {
+		t.Fatal(err)
+	}
+	assertIndex(t, h, ref)
+	h.Close()
+}
+
+func BenchmarkIndexGet(b *testing.B) {
+	h := &Index{Path: filepath.Join(b.TempDir(), "test.hash")}
+	if err := h.Open(); err != nil {
+		b.Fatal(err)
+	}
+	defer h.Close()
+	var batch Batch
+	for i := 0; i < 100000; i++ {
+		batch.Set([]byte(fmt.Sprintf("session-%08d", i)), []byte("value"))
+	}
+	if err := h.Apply(&batch); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Get([]byte(fmt.Sprintf("session-%08d", i%100000)))
+	}
+}
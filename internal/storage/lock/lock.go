@@ -0,0 +1,207 @@
+package lock
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+type Mode int
+
+const (
+	LOCK_SHARED Mode = iota + 1
+	LOCK_EXCLUSIVE
+)
+
+var (
+	ErrBadMode  = errors.New("lock: bad mode")
+	ErrBadRange = errors.New("lock: bad range")
+	ErrDeadlock = errors.New("lock: deadlock")
+)
+
+// granted lock on the half-open key range [start, end), end == nil is +inf.
+// a single key `k` is the range [k, k+"\x00"), since there is nothing between them
+type lock struct {
+	txid  uint64
+	mode  Mode
+	start []byte
+	end   []byte
+}
+
+func (l *lock) overlaps(start, end []byte) bool {
+	return (end == nil || bytes.Compare(l.start, end) < 0) &&
+		(l.end == nil || bytes.Compare(start, l.end) < 0)
+}
+
+func (l *lock) covers(start, end []byte) bool {
+	if bytes.Compare(l.start, start) > 0 {
+		return false
+	}
+	if l.end == nil {
+		return true
+	}
+	return end != nil && bytes.Compare(end, l.end) <= 0
+}
+
+func compatible(a, b Mode) bool {
+	return a == LOCK_SHARED && b == LOCK_SHARED
+}
+
+// Manager grants shared/exclusive locks on keys and key ranges to transactions.
+// transactions are identified by ids, locks are held until Release.
+// conflicting requests block until the conflicting locks are released.
+//
+// ids are expected to grow with the transaction start time: when waiting
+// transactions form a cycle, the youngest one (the largest id) is the victim,
+// its pending request fails with ErrDeadlock and it should be aborted
+// by the caller, which releases its locks.
+type Manager struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	locks []*lock
+
+	waits   map[uint64][]uint64 // waits-for graph: waiting txid -> holders
+	victims map[uint64]bool     // chosen victims that are still waiting
+}
+
+func NewManager() *Manager {
+	m := &Manager{
+		waits:   map[uint64][]uint64{},
+		victims: map[uint64]bool{},
+	}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// lock a single key
+func (m *Manager) Lock(txid uint64, key []byte, mode Mode) error {
+	end := make([]byte, len(key)+1)
+	copy(end, key)
+	return m.LockRange(txid, key, end, mode)
+}
+
+// lock the range [start, end), nil end means up to the last key
+func (m *Manager) LockRange(txid uint64, start, end []byte, mode Mode) error {
+	if mode != LOCK_SHARED && mode != LOCK_EXCLUSIVE {
+		return ErrBadMode
+	}
+	if end != nil && bytes.Compare(start, end) >= 0 {
+		return ErrBadRange
+	}
+	start = append([]byte{}, start...)
+	if end != nil {
+		end = append([]byte{}, end...)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.holds(txid, start, end, mode) {
+		return nil
+	}
+	for {
+		holders := m.conflicts(txid, start, end, mode)
+		if len(holders) == 0 {
+			break
+		}
+		m.waits[txid] = holders
+		if victim, ok := m.deadlock(txid); ok {
+			if victim == txid {
+				delete(m.waits, txid)
+				return ErrDeadlock
+			}
+			// wake up the victim, it is waiting somewhere in the cycle
+			m.victims[victim] = true
+			m.cond.Broadcast()
+		}
+		m.cond.Wait()
+		if m.victims[txid] {
+			delete(m.victims, txid)
+			delete(m.waits, txid)
+			return ErrDeadlock
+		}
+	}
+	delete(m.waits, txid)
+	m.locks = append(m.locks, &lock{txid: txid, mode: mode, start: start, end: end})
+	return nil
+}
+
+// release all locks of the transaction
+func (m *Manager) Release(txid uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := m.locks[:0]
+	for _, l := range m.locks {
+		if l.txid != txid {
+			kept = append(kept, l)
+		}
+	}
+	for i := len(kept); i < len(m.locks); i++ {
+		m.locks[i] = nil
+	}
+	m.locks = kept
+	delete(m.victims, txid)
+	m.cond.Broadcast()
+}
+
+// search for a cycle in the waits-for graph through `txid`,
+// returns the youngest transaction of the cycle.
+func (m *Manager) deadlock(txid uint64) (uint64, bool) {
+	visited := map[uint64]bool{}
+	var path []uint64
+
+	var dfs func(id uint64) bool
+	dfs = func(id uint64) bool {
+		if id == txid && len(path) > 0 {
+			return true
+		}
+		if visited[id] {
+			return false
+		}
+		visited[id] = true
+		path = append(path, id)
+		for _, next := range m.waits[id] {
+			// victims are going to give up, they don't close any cycle
+			if m.victims[next] {
+				continue
+			}
+			if dfs(next) {
+				return true
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if !dfs(txid) {
+		return 0, false
+	}
+
+	victim := path[0]
+	for _, id := range path {
+		victim = max(victim, id)
+	}
+	return victim, true
+}
+
+// already holding a lock that is at least as strong
+func (m *Manager) holds(txid uint64, start, end []byte, mode Mode) bool {
+	for _, l := range m.locks {
+		if l.txid == txid && l.mode >= mode && l.covers(start, end) {
+			return true
+		}
+	}
+	return false
+}
+
+// ids of other transactions holding conflicting locks
+func (m *Manager) conflicts(txid uint64, start, end []byte, mode Mode) []uint64 {
+	var ids []uint64
+	for _, l := range m.locks {
+		if l.txid == txid || compatible(l.mode, mode) || !l.overlaps(start, end) {
+			continue
+		}
+		ids = append(ids, l.txid)
+	}
+	return ids
+}
@@ -0,0 +1,233 @@
+package lock
+
+import (
+	"testing"
+	"time"
+)
+
+// run lock request in background, result is sent to the channel
+func lockAsync(m *Manager, txid uint64, key []byte, mode Mode) chan error {
+	done := make(chan error, 1)
+	go func() { done <- m.Lock(txid, key, mode) }()
+	return done
+}
+
+func lockRangeAsync(m *Manager, txid uint64, start, end []byte, mode Mode) chan error {
+	done := make(chan error, 1)
+	go func() { done <- m.LockRange(txid, start, end, mode) }()
+	return done
+}
+
+func assertGranted(t *testing.T, done chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("lock failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lock was not granted")
+	}
+}
+
+func assertBlocked(t *testing.T, done chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		t.Fatalf("lock was granted while conflicting lock is held, err=%v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSharedLocksCompatible(t *testing.T) {
+	m := NewManager()
+
+	if err := m.Lock(1, []byte("a"), LOCK_SHARED); err != nil {
+		t.Fatal(err)
+	}
+	assertGranted(t, lockAsync(m, 2, []byte("a"), LOCK_SHARED))
+}
+
+func TestExclusiveLockBlocks(t *testing.T) {
+	m := NewManager()
+
+	if err := m.Lock(1, []byte("a"), LOCK_EXCLUSIVE); err != nil {
+		t.Fatal(err)
+	}
+	done := lockAsync(m, 2, []byte("a"), LOCK_SHARED)
+	assertBlocked(t, done)
+
+	// other keys are not affected
+	assertGranted(t, lockAsync(m, 3, []byte("b"), LOCK_EXCLUSIVE))
+
+	m.Release(1)
+	assertGranted(t, done)
+}
+
+func TestRangeLockConflicts(t *testing.T) {
+	m := NewManager()
+
+	if err := m.LockRange(1, []byte("b"), []byte("d"), LOCK_SHARED); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys outside of [b, d) are free
+	assertGranted(t, lockAsync(m, 2, []byte("a"), LOCK_EXCLUSIVE))
+	assertGranted(t, lockAsync(m, 2, []byte("d"), LOCK_EXCLUSIVE))
+	assertGranted(t, lockAsync(m, 2, []byte("ba"), LOCK_SHARED))
+
+	// key inside of the range
+	inside := lockAsync(m, 3, []byte("c"), LOCK_EXCLUSIVE)
+	assertBlocked(t, inside)
+
+	// overlapping open-ended range
+	open := lockRangeAsync(m, 4, []byte("cz"), nil, LOCK_EXCLUSIVE)
+	assertBlocked(t, open)
+
+	m.Release(1)
+	assertGranted(t, inside)
+	m.Release(3)
+	assertBlocked(t, open) // still conflicts with "d"
+	m.Release(2)
+	assertGranted(t, open)
+}
+
+func TestOpenRangeLock(t *testing.T) {
+	m := NewManager()
+
+	if err := m.LockRange(1, []byte("m"), nil, LOCK_EXCLUSIVE); err != nil {
+		t.Fatal(err)
+	}
+	assertGranted(t, lockAsync(m, 2, []byte("l"), LOCK_EXCLUSIVE))
+	assertBlocked(t, lockAsync(m, 3, []byte("zzz"), LOCK_SHARED))
+}
+
+func TestLockUpgrade(t *testing.T) {
+	m := NewManager()
+
+	if err := m.Lock(1, []byte("a"), LOCK_SHARED); err != nil {
+		t.Fatal(err)
+	}
+	// the only holder can upgrade
+	if err := m.Lock(1, []byte("a"), LOCK_EXCLUSIVE); err != nil {
+		t.Fatal(err)
+	}
+	assertBlocked(t, lockAsync(m, 2, []byte("a"), LOCK_SHARED))
+
+	// exclusive lock covers a shared request of the same transaction
+	if err := m.Lock(1, []byte("a"), LOCK_SHARED); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	m := NewManager()
+
+	if err := m.LockRange(1, []byte("b"), []byte("a"), LOCK_SHARED); err != ErrBadRange {
+		t.Fatalf("LockRange(b, a) = %v; want ErrBadRange", err)
+	}
+	if err := m.LockRange(1, []byte("a"), []byte("a"), LOCK_SHARED); err != ErrBadRange {
+		t.Fatalf("LockRange(a, a) = %v; want ErrBadRange", err)
+	}
+	if err := m.Lock(1, []byte("a"), Mode(0)); err != ErrBadMode {
+		t.Fatalf("Lock with mode 0 = %v; want ErrBadMode", err)
+	}
+}
+
+func TestDeadlockYoungestAborted(t *testing.T) {
+	m := NewManager()
+
+	if err := m.Lock(1, []byte("a"), LOCK_EXCLUSIVE); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Lock(2, []byte("b"), LOCK_EXCLUSIVE); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 waits for 1
+	young := lockAsync(m, 2, []byte("a"), LOCK_EXCLUSIVE)
+	assertBlocked(t, young)
+
+	// 1 waits for 2, the cycle is detected, 2 is the youngest
+	old := lockAsync(m, 1, []byte("b"), LOCK_EXCLUSIVE)
+
+	select {
+	case err := <-young:
+		if err != ErrDeadlock {
+			t.Fatalf("victim Lock() = %v; want ErrDeadlock", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("deadlock was not detected")
+	}
+	assertBlocked(t, old)
+
+	// aborting the victim unblocks the other transaction
+	m.Release(2)
+	assertGranted(t, old)
+}
+
+func TestDeadlockRequesterIsVictim(t *testing.T) {
+	m := NewManager()
+
+	if err := m.Lock(1, []byte("a"), LOCK_SHARED); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Lock(2, []byte("a"), LOCK_SHARED); err != nil {
+		t.Fatal(err)
+	}
+
+	// both try to upgrade
+	old := lockAsync(m, 1, []byte("a"), LOCK_EXCLUSIVE)
+	assertBlocked(t, old)
+
+	if err := m.Lock(2, []byte("a"), LOCK_EXCLUSIVE); err != ErrDeadlock {
+		t.Fatalf("Lock() = %v; want ErrDeadlock", err)
+	}
+	m.Release(2)
+	assertGranted(t, old)
+}
+
+func TestDeadlockCycleOfThree(t *testing.T) {
+	m := NewManager()
+
+	keys := []string{"a", "b", "c"}
+	for i, key := range keys {
+		if err := m.Lock(uint64(i+1), []byte(key), LOCK_EXCLUSIVE); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 1 -> 2 -> 3 -> 1
+	first := lockAsync(m, 1, []byte("b"), LOCK_EXCLUSIVE)
+	second := lockAsync(m, 2, []byte("c"), LOCK_EXCLUSIVE)
+	assertBlocked(t, first)
+	assertBlocked(t, second)
+
+	if err := m.Lock(3, []byte("a"), LOCK_EXCLUSIVE); err != ErrDeadlock {
+		t.Fatalf("Lock() = %v; want ErrDeadlock", err)
+	}
+	m.Release(3)
+	assertGranted(t, second)
+	m.Release(2)
+	assertGranted(t, first)
+}
+
+func TestNoFalseDeadlock(t *testing.T) {
+	m := NewManager()
+
+	if err := m.Lock(1, []byte("a"), LOCK_EXCLUSIVE); err != nil {
+		t.Fatal(err)
+	}
+
+	// several transactions waiting for the same one is not a cycle
+	var waiting []chan error
+	for id := uint64(2); id <= 4; id++ {
+		done := lockAsync(m, id, []byte("a"), LOCK_SHARED)
+		assertBlocked(t, done)
+		waiting = append(waiting, done)
+	}
+	m.Release(1)
+	for _, done := range waiting {
+		assertGranted(t, done)
+	}
+}
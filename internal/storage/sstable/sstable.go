@@ -0,0 +1,438 @@
+// Package sstable is an immutable file of sorted key-value pairs, the
+// tables of the LSM engine, also usable for bulk exports.
+//
+// the file is a run of data blocks, then the index block, the filter block
+// and the footer:
+//
+//	| data block | crc | ... | index block | crc | filter block | crc | footer |
+//
+// a data block has the pairs of a range of keys in order, each key shares
+// a prefix with the previous one of the block:
+//
+//	| shared uvarint | unshared uvarint | vlen uvarint | key[shared:] | val |
+//
+// the index block has an entry of the same encoding per data block, the key
+// is the last key of the block and the value the offset and length of the
+// block as uvarints. the filter block is a Bloom filter of the keys. the
+// crc of a block is its CRC-32C, little endian. the footer is fixed size:
+//
+//	| index off | index len | filter off | filter len | count | crc | magic |
+//
+// the five fields are little endian uint64 and the crc covers them.
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+)
+
+const (
+	BLOCK_SIZE  = 4096 // of data blocks before they're cut
+	BLOOM_BITS  = 10   // per key, about 1% of false positives
+	FOOTER_SIZE = 5*8 + 4 + 8
+	MAGIC       = "godbsst1"
+)
+
+var (
+	// keys must be added in increasing order
+	ErrOrder   = errors.New("sstable: keys out of order")
+	ErrBadFile = errors.New("sstable: bad file")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func appendEntry(out []byte, prev, key, val []byte) []byte {
+	shared := 0
+	for shared < min(len(prev), len(key)) && prev[shared] == key[shared] {
+		shared++
+	}
+	out = binary.AppendUvarint(out, uint64(shared))
+	out = binary.AppendUvarint(out, uint64(len(key)-shared))
+	out = binary.AppendUvarint(out, uint64(len(val)))
+	out = append(out, key[shared:]...)
+	return append(out, val...)
+}
+
+// the entry at the start of `data` after the key `prev`: the key, the value
+// and the rest of the data. the key is a new slice.
+func readEntry(data, prev []byte) ([]byte, []byte, []byte, error) {
+	var lens [3]uint64
+	for i := range lens {
+		n, size := binary.Uvarint(data)
+		if size <= 0 {
+			return nil, nil, nil, fmt.Errorf("%w: bad entry", ErrBadFile)
+		}
+		lens[i], data = n, data[size:]
+	}
+	shared, unshared, vlen := lens[0], lens[1], lens[2]
+	if shared > uint64(len(prev)) || unshared > uint64(len(data)) || vlen > uint64(len(data))-unshared {
+		return nil, nil, nil, fmt.Errorf("%w: bad entry", ErrBadFile)
+	}
+	key := append(slices.Clip(prev[:shared]), data[:unshared]...)
+	val := data[unshared : unshared+vlen]
+	return key, val, data[unshared+vlen:], nil
+}
+
+func keyHash(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+func bloomHashes(bits int) int {
+	return min(max(1, int(math.Round(float64(bits)*math.Ln2))), 30)
+}
+
+// the bits of a key are picked by double hashing of its 64 bit hash
+func bloomBits(nbits uint32, k int, h uint64, fn func(bit uint32) bool) bool {
+	h1, h2 := uint32(h), uint32(h>>32)
+	for i := 0; i < k; i++ {
+		if !fn((h1 + uint32(i)*h2) % nbits) {
+			return false
+		}
+	}
+	return true
+}
+
+// Writer writes a table to Path. the pairs are written to a temporary file
+// renamed to Path by Finish, an unfinished table never appears at Path.
+type Writer struct {
+	Path      string
+	BlockSize int // BLOCK_SIZE if 0
+	BloomBits int // per key, BLOOM_BITS if 0, no filter if < 0
+
+	f      *os.File
+	off    uint64
+	block  []byte
+	prev   []byte // the last key
+	index  []byte
+	hashes []uint64
+	count  uint64
+}
+
+func (w *Writer) Create() error {
+	if w.BlockSize == 0 {
+		w.BlockSize = BLOCK_SIZE
+	}
+	if w.BloomBits == 0 {
+		w.BloomBits = BLOOM_BITS
+	}
+	f, err := os.Create(w.Path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("Writer.Create: %w", err)
+	}
+	w.f = f
+	return nil
+}
+
+// adds a pair, keys must be increasing
+func (w *Writer) Add(key, val []byte) error {
+	if w.count > 0 && bytes.Compare(key, w.prev) <= 0 {
+		return ErrOrder
+	}
+	prev := w.prev
+	if len(w.block) == 0 {
+		prev = nil // a block is read from its start
+	}
+	w.block = appendEntry(w.block, prev, key, val)
+	w.prev = append(w.prev[:0], key...)
+	w.count++
+	if w.BloomBits > 0 {
+		w.hashes = append(w.hashes, keyHash(key))
+	}
+	if len(w.block) >= w.BlockSize {
+		return w.flush()
+	}
+	return nil
+}
+
+// writes a block and its crc, returns its offset
+func (w *Writer) write(block []byte) (uint64, error) {
+	off := w.off
+	block = binary.LittleEndian.AppendUint32(block, crc32.Checksum(block, crcTable))
+	if _, err := w.f.Write(block); err != nil {
+		return 0, err
+	}
+	w.off += uint64(len(block))
+	return off, nil
+}
+
+// ends the data block, its last key is the key of the index entry
+func (w *Writer) flush() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	size := uint64(len(w.block))
+	off, err := w.write(w.block)
+	if err != nil {
+		return err
+	}
+	// the index keys aren't prefix compressed, a lookup searches them
+	val := binary.AppendUvarint(nil, off)
+	val = binary.AppendUvarint(val, size)
+	w.index = appendEntry(w.index, nil, w.prev, val)
+	w.block = w.block[:0]
+	return nil
+}
+
+// writes the index, the filter and the footer, syncs the file and moves it
+// to Path
+func (w *Writer) Finish() error {
+	if err := w.finish(); err != nil {
+		w.Abort()
+		return fmt.Errorf("Writer.Finish: %w", err)
+	}
+	return nil
+}
+
+func (w *Writer) finish() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	var footer []byte
+	indexOff, err := w.write(w.index)
+	if err != nil {
+		return err
+	}
+	filter := w.filter()
+	filterOff, err := w.write(filter)
+	if err != nil {
+		return err
+	}
+	for _, n := range []uint64{indexOff, uint64(len(w.index)), filterOff, uint64(len(filter)), w.count} {
+		footer = binary.LittleEndian.AppendUint64(footer, n)
+	}
+	footer = binary.LittleEndian.AppendUint32(footer, crc32.Checksum(footer, crcTable))
+	footer = append(footer, MAGIC...)
+	if _, err := w.f.Write(footer); err != nil {
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.Path+".tmp", w.Path); err != nil {
+		return err
+	}
+	// the rename is durable once the directory is synced
+	dir, err := os.Open(filepath.Dir(w.Path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// the number of hashes followed by the bits, empty without a filter
+func (w *Writer) filter() []byte {
+	if w.BloomBits < 0 {
+		return nil
+	}
+	k := bloomHashes(w.BloomBits)
+	bits := make([]byte, (max(1, len(w.hashes)*w.BloomBits)+7)/8)
+	for _, h := range w.hashes {
+		bloomBits(uint32(len(bits)*8), k, h, func(bit uint32) bool {
+			bits[bit/8] |= 1 << (bit % 8)
+			return true
+		})
+	}
+	return append([]byte{byte(k)}, bits...)
+}
+
+// removes the temporary file of an unfinished table
+func (w *Writer) Abort() {
+	if w.f != nil {
+		w.f.Close()
+		os.Remove(w.Path + ".tmp")
+	}
+}
+
+// Reader reads a table. the index and the filter are read by Open, the data
+// blocks when a lookup or an iterator reaches them. it's safe for
+// concurrent use.
+type Reader struct {
+	f      *os.File
+	count  uint64
+	index  []indexEntry
+	filter []byte // without the number of hashes
+	hashes int
+}
+
+type indexEntry struct {
+	last []byte // the last key of the block
+	off  uint64
+	size uint64
+}
+
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("sstable.Open: %w", err)
+	}
+	r := &Reader{f: f}
+	if err := r.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("sstable.Open: %w", err)
+	}
+	return r, nil
+}
+
+func (r *Reader) Close() error { return r.f.Close() }
+
+// the number of pairs
+func (r *Reader) Len() int { return int(r.count) }
+
+func (r *Reader) load() error {
+	st, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+	if st.Size() < FOOTER_SIZE {
+		return fmt.Errorf("%w: no footer", ErrBadFile)
+	}
+	footer := make([]byte, FOOTER_SIZE)
+	if _, err := r.f.ReadAt(footer, st.Size()-FOOTER_SIZE); err != nil {
+		return err
+	}
+	if string(footer[44:]) != MAGIC {
+		return fmt.Errorf("%w: bad magic", ErrBadFile)
+	}
+	if crc32.Checksum(footer[:40], crcTable) != binary.LittleEndian.Uint32(footer[40:]) {
+		return fmt.Errorf("%w: bad footer checksum", ErrBadFile)
+	}
+	var fields [5]uint64
+	for i := range fields {
+		fields[i] = binary.LittleEndian.Uint64(footer[8*i:])
+	}
+	r.count = fields[4]
+	index, err := r.block(fields[0], fields[1])
+	if err != nil {
+		return err
+	}
+	for len(index) > 0 {
+		var key, val []byte
+		if key, val, index, err = readEntry(index, nil); err != nil {
+			return err
+		}
+		off, n := binary.Uvarint(val)
+		size, m := binary.Uvarint(val[max(n, 0):])
+		if n <= 0 || m <= 0 {
+			return fmt.Errorf("%w: bad index entry", ErrBadFile)
+		}
+		r.index = append(r.index, indexEntry{last: key, off: off, size: size})
+	}
+	filter, err := r.block(fields[2], fields[3])
+	if err != nil {
+		return err
+	}
+	if len(filter) > 1 {
+		r.hashes, r.filter = int(filter[0]), filter[1:]
+	}
+	return nil
+}
+
+// reads and checks the block at `off`
+func (r *Reader) block(off, size uint64) ([]byte, error) {
+	if size > math.MaxInt32 {
+		return nil, fmt.Errorf("%w: bad block size", ErrBadFile)
+	}
+	data := make([]byte, size+4)
+	if _, err := r.f.ReadAt(data, int64(off)); err != nil {
+		return nil, fmt.Errorf("%w: block at %d: %v", ErrBadFile, off, err)
+	}
+	if crc32.Checksum(data[:size], crcTable) != binary.LittleEndian.Uint32(data[size:]) {
+		return nil, fmt.Errorf("%w: bad checksum of the block at %d", ErrBadFile, off)
+	}
+	return data[:size], nil
+}
+
+// whether the filter rules out `key`
+func (r *Reader) miss(key []byte) bool {
+	if r.filter == nil {
+		return false
+	}
+	return !bloomBits(uint32(len(r.filter)*8), r.hashes, keyHash(key), func(bit uint32) bool {
+		return r.filter[bit/8]&(1<<(bit%8)) != 0
+	})
+}
+
+func (r *Reader) Get(key []byte) ([]byte, bool, error) {
+	if r.miss(key) {
+		return nil, false, nil
+	}
+	it := r.Seek(key)
+	if it.Valid() && bytes.Equal(it.key, key) {
+		return it.val, true, nil
+	}
+	return nil, false, it.Err()
+}
+
+// Iter iterates the pairs in order, it reads one data block at a time
+type Iter struct {
+	r     *Reader
+	i     int    // of the block in the index
+	data  []byte // the rest of the block
+	key   []byte
+	val   []byte
+	valid bool
+	err   error
+}
+
+// an iterator at the first key >= `key`, nil is the first key
+func (r *Reader) Seek(key []byte) *Iter {
+	it := &Iter{r: r}
+	it.i = sort.Search(len(r.index), func(i int) bool {
+		return bytes.Compare(r.index[i].last, key) >= 0
+	})
+	it.load()
+	for it.valid && bytes.Compare(it.key, key) < 0 {
+		it.Next()
+	}
+	return it
+}
+
+// reads block `i` from its first pair
+func (it *Iter) load() {
+	it.valid = false
+	if it.i >= len(it.r.index) {
+		return
+	}
+	e := it.r.index[it.i]
+	if it.data, it.err = it.r.block(e.off, e.size); it.err == nil {
+		it.key = nil
+		it.next()
+	}
+}
+
+func (it *Iter) next() {
+	it.key, it.val, it.data, it.err = readEntry(it.data, it.key)
+	it.valid = it.err == nil
+}
+
+func (it *Iter) Valid() bool { return it.valid }
+
+// an error reading a block, the iterator is invalid
+func (it *Iter) Err() error { return it.err }
+
+func (it *Iter) Next() {
+	if len(it.data) > 0 {
+		it.next()
+		return
+	}
+	it.i++
+	it.load()
+}
+
+// the current pair, valid until the iterator moves
+func (it *Iter) Deref() ([]byte, []byte) { return it.key, it.val }
@@ -0,0 +1,162 @@
+package sstable
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTable(t *testing.T, w *Writer, n int) {
+	t.Helper()
+	if err := w.Create(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := w.Add([]byte(fmt.Sprintf("key%06d", 2*i)), []byte(fmt.Sprint("val", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.sst")
+	writeTable(t, &Writer{Path: path, BlockSize: 256}, 5000)
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("the temporary file is left")
+	}
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.Len() != 5000 || len(r.index) < 100 {
+		t.Fatalf("Len() = %d, %d blocks", r.Len(), len(r.index))
+	}
+
+	misses := 0
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("key%06d", i))
+		val, ok, err := r.Get(key)
+		if err != nil || ok != (i%2 == 0) || ok && string(val) != fmt.Sprint("val", i/2) {
+			t.Fatalf("Get(%s) = %q, %v, %v", key, val, ok, err)
+		}
+		if i%2 == 1 && r.miss(key) {
+			misses++
+		}
+	}
+	if misses < 4900 {
+		t.Fatalf("the filter rules out %d of 5000 missing keys", misses)
+	}
+
+	// iterators cross the blocks
+	n := 0
+	for it := r.Seek([]byte("key000001")); it.Valid(); it.Next() {
+		key, _ := it.Deref()
+		if want := fmt.Sprintf("key%06d", 2*n+2); string(key) != want {
+			t.Fatalf("key %s, want %s", key, want)
+		}
+		n++
+	}
+	if n != 4999 {
+		t.Fatalf("Seek() = %d keys", n)
+	}
+	if r.Seek([]byte("key999999")).Valid() {
+		t.Fatal("Seek() past the last key")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	dir := t.TempDir()
+	w := &Writer{Path: filepath.Join(dir, "order.sst")}
+	if err := w.Create(); err != nil {
+		t.Fatal(err)
+	}
+	w.Add([]byte("b"), nil)
+	if err := w.Add([]byte("a"), nil); !errors.Is(err, ErrOrder) {
+		t.Fatalf("Add() out of order = %v", err)
+	}
+	if err := w.Add([]byte("b"), nil); !errors.Is(err, ErrOrder) {
+		t.Fatalf("Add() of a duplicate = %v", err)
+	}
+	w.Abort()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("Abort() left %d files", len(entries))
+	}
+
+	// empty and without a filter
+	path := filepath.Join(dir, "empty.sst")
+	writeTable(t, &Writer{Path: path, BloomBits: -1}, 0)
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, ok, err := r.Get([]byte("a")); ok || err != nil || r.Seek(nil).Valid() || r.filter != nil {
+		t.Fatalf("Get() of an empty table = %v, %v", ok, err)
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.sst")
+	writeTable(t, &Writer{Path: path, BlockSize: 128}, 500)
+	data, _ := os.ReadFile(path)
+
+	corrupt := func(off int) *Reader {
+		bad := append([]byte{}, data...)
+		bad[off] ^= 0x40
+		os.WriteFile(path, bad, 0o644)
+		r, err := Open(path)
+		if err != nil && !errors.Is(err, ErrBadFile) {
+			t.Fatalf("Open() = %v", err)
+		}
+		return r
+	}
+	for _, off := range []int{len(data) - 1, len(data) - 20, len(data) - FOOTER_SIZE - 3} {
+		if r := corrupt(off); r != nil {
+			t.Fatalf("Open() of a file corrupt at %d", off)
+		}
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "none")); err == nil {
+		t.Fatal("Open() of a missing file")
+	}
+
+	// data blocks are checked when they're read
+	r := corrupt(10)
+	defer r.Close()
+	if _, _, err := r.Get([]byte("key000000")); !errors.Is(err, ErrBadFile) {
+		t.Fatalf("Get() in a corrupt block = %v", err)
+	}
+	it := r.Seek(nil)
+	if it.Valid() || !errors.Is(it.Err(), ErrBadFile) {
+		t.Fatalf("Seek() in a corrupt block = %v", it.Err())
+	}
+	if _, ok, err := r.Get([]byte("key000998")); !ok || err != nil {
+		t.Fatalf("Get() in another block = %v, %v", ok, err)
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "t.sst")
+	w := &Writer{Path: path}
+	w.Create()
+	for i := 0; i < 100000; i++ {
+		w.Add([]byte(fmt.Sprintf("key%08d", i)), []byte("value"))
+	}
+	if err := w.Finish(); err != nil {
+		b.Fatal(err)
+	}
+	r, err := Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer r.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Get([]byte(fmt.Sprintf("key%08d", i*7919%200000)))
+	}
+}
@@ -0,0 +1,520 @@
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"slices"
+)
+
+// Bitmap indexes are for columns with few distinct values like a status.
+// a table with bitmap indexes gives every row a 32-bit row id, and a
+// bitmap of the row ids is kept for every value of the column. bitmaps
+// of several conditions are combined with And and Or before any row is
+// read, see Tx.Bitmap and Tx.GetByID.
+//
+// the row ids are stored in two prefixes after the ones of the bitmaps:
+//
+// | RowIDPrefix   | pkey  |  ->  | row id |
+// | RowIDPrefix+1 | row id |  ->  | pkey   |
+//
+// a bitmap is split into containers of 2^14 row ids like roaring bitmaps,
+// a container is the sorted low bits of its ids while it has fewer than
+// 1024 ids and a bitset of 2 KB otherwise:
+//
+// | prefix | value | high bits of the ids (4B) |  ->  | container |
+//
+// bitmaps are updated in the same transaction as the row, a row keeps
+// its id when it's updated. the ids of deleted rows are reused only if
+// they were the last ones.
+
+const (
+	BITMAP_CHUNK_BITS = 14
+	BITMAP_CHUNK_SIZE = 1 << BITMAP_CHUNK_BITS
+	// containers with at least that many ids are bitsets
+	BITMAP_ARRAY_MAX = 1024
+	bitmapWords      = BITMAP_CHUNK_SIZE / 64
+)
+
+// the ids of a chunk, either `array` or `bits` is set
+type container struct {
+	array []uint16 // sorted
+	bits  []uint64
+}
+
+func (c *container) len() int {
+	if c.bits == nil {
+		return len(c.array)
+	}
+	n := 0
+	for _, w := range c.bits {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+func (c *container) has(low uint16) bool {
+	if c.bits != nil {
+		return c.bits[low/64]&(1<<(low%64)) != 0
+	}
+	_, ok := slices.BinarySearch(c.array, low)
+	return ok
+}
+
+func (c *container) add(low uint16) {
+	if c.bits != nil {
+		c.bits[low/64] |= 1 << (low % 64)
+		return
+	}
+	i, ok := slices.BinarySearch(c.array, low)
+	if !ok {
+		c.array = slices.Insert(c.array, i, low)
+	}
+	c.compact()
+}
+
+func (c *container) del(low uint16) {
+	if c.bits != nil {
+		c.bits[low/64] &^= 1 << (low % 64)
+	} else if i, ok := slices.BinarySearch(c.array, low); ok {
+		c.array = slices.Delete(c.array, i, i+1)
+	}
+	c.compact()
+}
+
+// converts between an array and a bitset by the number of ids
+func (c *container) compact() {
+	n := c.len()
+	switch {
+	case c.bits == nil && n >= BITMAP_ARRAY_MAX:
+		c.bits = make([]uint64, bitmapWords)
+		for _, low := range c.array {
+			c.bits[low/64] |= 1 << (low % 64)
+		}
+		c.array = nil
+	case c.bits != nil && n < BITMAP_ARRAY_MAX:
+		c.array = make([]uint16, 0, n)
+		c.each(func(low uint16) bool {
+			c.array = append(c.array, low)
+			return true
+		})
+		c.bits = nil
+	}
+}
+
+// calls `fn` for the ids in order until it returns false
+func (c *container) each(fn func(low uint16) bool) bool {
+	if c.bits == nil {
+		for _, low := range c.array {
+			if !fn(low) {
+				return false
+			}
+		}
+		return true
+	}
+	for i, w := range c.bits {
+		for w != 0 {
+			if !fn(uint16(i*64 + bits.TrailingZeros64(w))) {
+				return false
+			}
+			w &= w - 1
+		}
+	}
+	return true
+}
+
+func (c *container) clone() container {
+	return container{array: slices.Clone(c.array), bits: slices.Clone(c.bits)}
+}
+
+func (c *container) and(o *container) container {
+	out := container{}
+	switch {
+	case c.bits != nil && o.bits != nil:
+		out.bits = make([]uint64, bitmapWords)
+		for i := range out.bits {
+			out.bits[i] = c.bits[i] & o.bits[i]
+		}
+	case c.bits != nil:
+		return o.and(c)
+	default:
+		for _, low := range c.array {
+			if o.has(low) {
+				out.array = append(out.array, low)
+			}
+		}
+	}
+	out.compact()
+	return out
+}
+
+func (c *container) or(o *container) container {
+	out := container{}
+	if c.bits == nil && o.bits == nil && len(c.array)+len(o.array) < BITMAP_ARRAY_MAX {
+		out.array = make([]uint16, 0, len(c.array)+len(o.array))
+		i, j := 0, 0
+		for i < len(c.array) || j < len(o.array) {
+			switch {
+			case j == len(o.array) || i < len(c.array) && c.array[i] < o.array[j]:
+				out.array = append(out.array, c.array[i])
+				i++
+			case i == len(c.array) || o.array[j] < c.array[i]:
+				out.array = append(out.array, o.array[j])
+				j++
+			default:
+				out.array = append(out.array, c.array[i])
+				i, j = i+1, j+1
+			}
+		}
+		return out
+	}
+	out.bits = make([]uint64, bitmapWords)
+	for _, in := range []*container{c, o} {
+		if in.bits != nil {
+			for i, w := range in.bits {
+				out.bits[i] |= w
+			}
+			continue
+		}
+		for _, low := range in.array {
+			out.bits[low/64] |= 1 << (low % 64)
+		}
+	}
+	out.compact()
+	return out
+}
+
+// little-endian ids of an array, or the words of a bitset, which is the
+// only container of 2 KB
+func (c *container) encode() []byte {
+	if c.bits != nil {
+		out := make([]byte, 0, bitmapWords*8)
+		for _, w := range c.bits {
+			out = binary.LittleEndian.AppendUint64(out, w)
+		}
+		return out
+	}
+	out := make([]byte, 0, 2*len(c.array))
+	for _, low := range c.array {
+		out = binary.LittleEndian.AppendUint16(out, low)
+	}
+	return out
+}
+
+func decodeContainer(val []byte) (container, error) {
+	c := container{}
+	switch {
+	case len(val) == bitmapWords*8:
+		c.bits = make([]uint64, bitmapWords)
+		for i := range c.bits {
+			c.bits[i] = binary.LittleEndian.Uint64(val[8*i:])
+		}
+	case len(val)%2 == 0 && len(val) < 2*BITMAP_ARRAY_MAX:
+		c.array = make([]uint16, len(val)/2)
+		for i := range c.array {
+			c.array[i] = binary.LittleEndian.Uint16(val[2*i:])
+		}
+	default:
+		return c, fmt.Errorf("%w: bitmap container of %d bytes", errBadEncoding, len(val))
+	}
+	return c, nil
+}
+
+// Bitmap is a set of row ids, the containers are ordered by their chunk
+type Bitmap struct {
+	keys []uint32 // high bits of the ids
+	cons []container
+}
+
+// number of ids
+func (bm *Bitmap) Len() int {
+	n := 0
+	for i := range bm.cons {
+		n += bm.cons[i].len()
+	}
+	return n
+}
+
+func (bm *Bitmap) Contains(id uint32) bool {
+	i, ok := slices.BinarySearch(bm.keys, id>>BITMAP_CHUNK_BITS)
+	return ok && bm.cons[i].has(uint16(id%BITMAP_CHUNK_SIZE))
+}
+
+func (bm *Bitmap) Add(id uint32) {
+	key := id >> BITMAP_CHUNK_BITS
+	i, ok := slices.BinarySearch(bm.keys, key)
+	if !ok {
+		bm.keys = slices.Insert(bm.keys, i, key)
+		bm.cons = slices.Insert(bm.cons, i, container{})
+	}
+	bm.cons[i].add(uint16(id % BITMAP_CHUNK_SIZE))
+}
+
+// calls `fn` for the ids in increasing order until it returns false
+func (bm *Bitmap) Each(fn func(id uint32) bool) {
+	for i := range bm.cons {
+		high := bm.keys[i] << BITMAP_CHUNK_BITS
+		if !bm.cons[i].each(func(low uint16) bool { return fn(high | uint32(low)) }) {
+			return
+		}
+	}
+}
+
+// the ids in both bitmaps
+func (bm *Bitmap) And(o *Bitmap) *Bitmap {
+	out := &Bitmap{}
+	for i, j := 0, 0; i < len(bm.keys) && j < len(o.keys); {
+		switch {
+		case bm.keys[i] < o.keys[j]:
+			i++
+		case bm.keys[i] > o.keys[j]:
+			j++
+		default:
+			if c := bm.cons[i].and(&o.cons[j]); c.len() > 0 {
+				out.keys = append(out.keys, bm.keys[i])
+				out.cons = append(out.cons, c)
+			}
+			i, j = i+1, j+1
+		}
+	}
+	return out
+}
+
+// the ids in either bitmap
+func (bm *Bitmap) Or(o *Bitmap) *Bitmap {
+	out := &Bitmap{}
+	for i, j := 0, 0; i < len(bm.keys) || j < len(o.keys); {
+		switch {
+		case j == len(o.keys) || i < len(bm.keys) && bm.keys[i] < o.keys[j]:
+			out.keys = append(out.keys, bm.keys[i])
+			out.cons = append(out.cons, bm.cons[i].clone())
+			i++
+		case i == len(bm.keys) || o.keys[j] < bm.keys[i]:
+			out.keys = append(out.keys, o.keys[j])
+			out.cons = append(out.cons, o.cons[j].clone())
+			j++
+		default:
+			out.keys = append(out.keys, bm.keys[i])
+			out.cons = append(out.cons, bm.cons[i].or(&o.cons[j]))
+			i, j = i+1, j+1
+		}
+	}
+	return out
+}
+
+func checkBitmaps(tdef *TableDef) error {
+	for i, col := range tdef.Bitmaps {
+		if colIndex(tdef, col) < 0 || slices.Index(tdef.Bitmaps[:i], col) >= 0 {
+			return ErrBadTable
+		}
+	}
+	return nil
+}
+
+func rowIDKey(tdef *TableDef, pkey []Value) []byte {
+	return encodeKey(nil, tdef.RowIDPrefix, pkey)
+}
+
+func rowKey(tdef *TableDef, id uint32) []byte {
+	key := binary.BigEndian.AppendUint32(nil, tdef.RowIDPrefix+1)
+	return binary.BigEndian.AppendUint32(key, id)
+}
+
+// the row id of the primary key, a new one is allocated if `add` is set
+func rowID(tx *Tx, tdef *TableDef, pkey []Value, add bool) (uint32, bool, error) {
+	key := rowIDKey(tdef, pkey)
+	if val, ok := tx.kv.Get(key); ok {
+		return binary.LittleEndian.Uint32(val), true, nil
+	}
+	if !add {
+		return 0, false, nil
+	}
+	// the one after the last row id
+	id := uint32(0)
+	first := rowKey(tdef, 0)
+	iter := tx.kv.SeekLE(prefixEnd(first[:4]))
+	if iter.Valid() {
+		if last, _ := iter.Deref(); len(last) == 8 && string(last[:4]) == string(first[:4]) {
+			id = binary.BigEndian.Uint32(last[4:]) + 1
+			if id == 0 {
+				return 0, false, fmt.Errorf("%w: out of row ids", ErrBadRecord)
+			}
+		}
+	}
+	if err := tx.kv.Set(key, binary.LittleEndian.AppendUint32(nil, id)); err != nil {
+		return 0, false, err
+	}
+	if err := tx.kv.Set(rowKey(tdef, id), encodeValues(nil, pkey)); err != nil {
+		return 0, false, err
+	}
+	return id, true, nil
+}
+
+// removes the row id of a deleted row
+func rowIDDel(tx *Tx, tdef *TableDef, pkey []Value) error {
+	id, ok, err := rowID(tx, tdef, pkey, false)
+	if err != nil || !ok {
+		return err
+	}
+	if _, err := tx.kv.Del(rowIDKey(tdef, pkey)); err != nil {
+		return err
+	}
+	_, err = tx.kv.Del(rowKey(tdef, id))
+	return err
+}
+
+func bitmapKey(tdef *TableDef, i int, val Value, high uint32) []byte {
+	key := encodeKey(nil, tdef.BitmapPrefixes[i], []Value{val})
+	return binary.BigEndian.AppendUint32(key, high)
+}
+
+// sets or clears the bits of the row, `vals` are all columns
+func bitmapOp(tx *Tx, tdef *TableDef, vals []Value, op int) error {
+	id, ok, err := rowID(tx, tdef, vals[:tdef.PKeys], op == INDEX_ADD)
+	if err != nil || !ok {
+		return err
+	}
+	for i, col := range tdef.Bitmaps {
+		key := bitmapKey(tdef, i, vals[colIndex(tdef, col)], id>>BITMAP_CHUNK_BITS)
+		c := container{}
+		if val, ok := tx.kv.Get(key); ok {
+			if c, err = decodeContainer(val); err != nil {
+				return err
+			}
+		}
+		switch op {
+		case INDEX_ADD:
+			c.add(uint16(id % BITMAP_CHUNK_SIZE))
+		case INDEX_DEL:
+			c.del(uint16(id % BITMAP_CHUNK_SIZE))
+		default:
+			panic("bad index op")
+		}
+		if c.len() == 0 {
+			_, err = tx.kv.Del(key)
+		} else {
+			err = tx.kv.Set(key, c.encode())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the row ids where the bitmap indexed column `col` equals `val`
+func (tx *Tx) Bitmap(table string, col string, val Value) (*Bitmap, error) {
+	tdef, err := tx.table(table)
+	if err != nil {
+		return nil, err
+	}
+	i := slices.Index(tdef.Bitmaps, col)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: no bitmap index by %s", ErrBadRecord, col)
+	}
+	if val.Type != tdef.Types[colIndex(tdef, col)] && val.Type != TYPE_NULL {
+		return nil, fmt.Errorf("%w: column %s type mismatch", ErrBadRecord, col)
+	}
+	bm := &Bitmap{}
+	prefix := encodeKey(nil, tdef.BitmapPrefixes[i], []Value{val})
+	for iter := tx.kv.Seek(prefix); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if !bytes.HasPrefix(key, prefix) || len(key) != len(prefix)+4 {
+			break
+		}
+		c, err := decodeContainer(val)
+		if err != nil {
+			return nil, err
+		}
+		bm.keys = append(bm.keys, binary.BigEndian.Uint32(key[len(key)-4:]))
+		bm.cons = append(bm.cons, c)
+	}
+	return bm, nil
+}
+
+// fetches the row by its row id, see Bitmap
+func (tx *Tx) GetByID(table string, id uint32, rec *Record) (bool, error) {
+	tdef, err := tx.table(table)
+	if err != nil {
+		return false, err
+	}
+	if len(tdef.Bitmaps) == 0 {
+		return false, fmt.Errorf("%w: %s has no row ids", ErrBadRecord, table)
+	}
+	pkey, ok := tx.kv.Get(rowKey(tdef, id))
+	if !ok {
+		return false, nil
+	}
+	vals := make([]Value, tdef.PKeys)
+	for i := range vals {
+		vals[i].Type = tdef.Types[i]
+	}
+	if err := decodeValues(pkey, vals); err != nil {
+		return false, err
+	}
+	*rec = Record{Cols: tdef.Cols[:tdef.PKeys], Vals: vals}
+	return dbGet(tx, tdef, rec)
+}
+
+// adds a bitmap index by `col` and indexes the existing rows
+func (tx *Tx) BitmapNew(table string, col string) error {
+	tdef, err := tx.table(table)
+	if err != nil {
+		return err
+	}
+	if table[0] == '@' {
+		return ErrBadTable
+	}
+	if colIndex(tdef, col) < 0 {
+		return ErrBadTable
+	}
+	if slices.Contains(tdef.Bitmaps, col) {
+		return fmt.Errorf("%w: duplicate bitmap index", ErrBadTable)
+	}
+	// the first bitmap index also allocates the row ids
+	n := 1
+	if len(tdef.Bitmaps) == 0 {
+		n = 3
+	}
+	prefix, err := allocPrefixes(tx, n)
+	if err != nil {
+		return err
+	}
+	next := *tdef
+	next.Bitmaps = append(slices.Clone(tdef.Bitmaps), col)
+	next.BitmapPrefixes = append(slices.Clone(tdef.BitmapPrefixes), prefix)
+	if n == 3 {
+		next.RowIDPrefix = prefix + 1
+	}
+	if err := saveTableDef(tx, &next, MODE_UPDATE_ONLY); err != nil {
+		return err
+	}
+
+	var rows [][]Value
+	err = dbScan(tx, &next, Record{}, func(rec Record) bool {
+		rows = append(rows, rec.Vals)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	only := next
+	only.Bitmaps = next.Bitmaps[len(next.Bitmaps)-1:]
+	only.BitmapPrefixes = next.BitmapPrefixes[len(next.BitmapPrefixes)-1:]
+	for _, vals := range rows {
+		if err := bitmapOp(tx, &only, vals, INDEX_ADD); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) BitmapNew(table string, col string) error {
+	tx := db.Begin()
+	if err := tx.BitmapNew(table, col); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,174 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func bitmapIDs(bm *Bitmap) []uint32 {
+	var ids []uint32
+	bm.Each(func(id uint32) bool {
+		ids = append(ids, id)
+		return true
+	})
+	return ids
+}
+
+func TestBitmapOps(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	// sparse and dense chunks
+	a, b := &Bitmap{}, &Bitmap{}
+	refA, refB := map[uint32]bool{}, map[uint32]bool{}
+	for i := 0; i < 20000; i++ {
+		id := uint32(rng.Intn(3 * BITMAP_CHUNK_SIZE))
+		if id < BITMAP_CHUNK_SIZE || i%20 == 0 {
+			a.Add(id)
+			refA[id] = true
+		}
+		id = uint32(rng.Intn(3 * BITMAP_CHUNK_SIZE))
+		if id >= BITMAP_CHUNK_SIZE || i%20 == 0 {
+			b.Add(id)
+			refB[id] = true
+		}
+	}
+	for _, c := range a.cons {
+		if c.bits == nil && c.len() >= BITMAP_ARRAY_MAX || c.bits != nil && c.len() < BITMAP_ARRAY_MAX {
+			t.Fatalf("a container of %d ids is not compact", c.len())
+		}
+	}
+	check := func(name string, bm *Bitmap, want func(id uint32) bool) {
+		t.Helper()
+		var ref []uint32
+		for id := uint32(0); id < 3*BITMAP_CHUNK_SIZE; id++ {
+			if want(id) {
+				ref = append(ref, id)
+			}
+		}
+		if got := bitmapIDs(bm); !slices.Equal(got, ref) || bm.Len() != len(ref) {
+			t.Fatalf("%s: %d ids, Len() = %d, want %d", name, len(got), bm.Len(), len(ref))
+		}
+	}
+	check("a", a, func(id uint32) bool { return refA[id] })
+	check("and", a.And(b), func(id uint32) bool { return refA[id] && refB[id] })
+	check("or", a.Or(b), func(id uint32) bool { return refA[id] || refB[id] })
+
+	// the result doesn't share containers with the inputs
+	or := a.Or(&Bitmap{})
+	or.Add(3*BITMAP_CHUNK_SIZE - 1)
+	for id := range refA {
+		if !or.Contains(id) {
+			t.Fatalf("Contains(%d) = false", id)
+		}
+	}
+	check("a after or", a, func(id uint32) bool { return refA[id] })
+
+	for _, c := range a.cons {
+		got, err := decodeContainer(c.encode())
+		if err != nil || got.len() != c.len() {
+			t.Fatalf("decodeContainer() = %d ids, %v", got.len(), err)
+		}
+	}
+	if _, err := decodeContainer(make([]byte, 3)); !errors.Is(err, errBadEncoding) {
+		t.Fatalf("decodeContainer() = %v", err)
+	}
+}
+
+func bitmapRows(t *testing.T, tx *Tx, bm *Bitmap) []string {
+	t.Helper()
+	var names []string
+	bm.Each(func(id uint32) bool {
+		var rec Record
+		ok, err := tx.GetByID("users", id, &rec)
+		if !ok || err != nil {
+			t.Fatalf("GetByID(%d) = %v, %v", id, ok, err)
+		}
+		names = append(names, string(rec.Get("name").Str))
+		return true
+	})
+	slices.Sort(names)
+	return names
+}
+
+func TestBitmapIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openDB(t, path)
+
+	users := &TableDef{
+		Name:    "users",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES, TYPE_INT64},
+		Cols:    []string{"id", "name", "status", "plan"},
+		Indexes: [][]string{{"name"}},
+		Bitmaps: []string{"status"},
+	}
+	if err := db.TableNew(users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users.BitmapPrefixes) != 1 || users.RowIDPrefix != users.BitmapPrefixes[0]+1 {
+		t.Fatalf("prefixes %v, row ids %d", users.BitmapPrefixes, users.RowIDPrefix)
+	}
+	statuses := []string{"active", "banned", "idle"}
+	tx := db.Begin()
+	for i := 0; i < 3000; i++ {
+		rec := (&Record{}).AddInt64("id", int64(i)).AddStr("name", []byte(fmt.Sprintf("u%04d", i))).
+			AddStr("status", []byte(statuses[i%3])).AddInt64("plan", int64(i%2))
+		if ok, err := tx.Insert("users", *rec); !ok || err != nil {
+			t.Fatalf("Insert(%d) = %v, %v", i, ok, err)
+		}
+	}
+	// the rows follow updates and deletes
+	tx.Update("users", *(&Record{}).AddInt64("id", 1).AddStr("name", []byte("u0001")).
+		AddStr("status", []byte("idle")).AddInt64("plan", 1))
+	for i := 3; i < 3000; i += 3 {
+		tx.Delete("users", *(&Record{}).AddInt64("id", int64(i)))
+	}
+	tx.Insert("users", *(&Record{}).AddInt64("id", 5000).AddStr("name", []byte("new")).
+		AddStr("status", []byte("active")).AddInt64("plan", 0))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.BitmapNew("users", "plan"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.BitmapNew("users", "plan"); !errors.Is(err, ErrBadTable) {
+		t.Fatalf("BitmapNew() of a duplicate index = %v", err)
+	}
+	db.Close()
+
+	db = openDB(t, path)
+	defer db.Close()
+	tx = db.BeginRead()
+	defer tx.Rollback()
+	active, err := tx.Bitmap("users", "status", Bytes([]byte("active")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bitmapRows(t, tx, active); fmt.Sprint(got) != "[new u0000]" {
+		t.Fatalf("active = %v", got)
+	}
+	idle, _ := tx.Bitmap("users", "status", Bytes([]byte("idle")))
+	free, _ := tx.Bitmap("users", "plan", Int64(0))
+	if got := bitmapRows(t, tx, idle.Or(active).And(free)); len(got) != 502 {
+		t.Fatalf("(idle OR active) AND free = %d rows", len(got))
+	}
+	banned, _ := tx.Bitmap("users", "status", Bytes([]byte("banned")))
+	if n := banned.Len(); n != 999 {
+		t.Fatalf("banned = %d rows", n)
+	}
+	if got := bitmapRows(t, tx, idle.And(banned)); len(got) != 0 {
+		t.Fatalf("idle AND banned = %v", got)
+	}
+	if _, err := tx.Bitmap("users", "name", Bytes([]byte("x"))); !errors.Is(err, ErrBadRecord) {
+		t.Fatalf("Bitmap() without an index = %v", err)
+	}
+	if _, err := tx.Bitmap("users", "plan", String("x")); !errors.Is(err, ErrBadRecord) {
+		t.Fatalf("Bitmap() of a bad type = %v", err)
+	}
+	var rec Record
+	if ok, err := tx.GetByID("users", 3, &rec); ok || err != nil {
+		t.Fatalf("GetByID() of a deleted row = %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,147 @@
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var errBadEncoding = errors.New("bad encoding")
+
+// order-preserving encoding of values, the encoded keys compare
+// like the values they encode (see Compare). every value starts with
+// a marker so that NULL sorts first:
+//
+// | 0x00 |        NULL
+// | 0x01 | data | other values
+//
+// int64, time: big-endian with the sign bit flipped
+// float64: big-endian bits, negative numbers with all bits flipped,
+// others with the sign bit flipped. -0 is stored as 0, NaN sorts first
+// bool: 1 byte
+// bytes, string: 0x00 -> 0x01 0x01, 0x01 -> 0x01 0x02, terminated by 0x00
+func encodeValues(out []byte, vals []Value) []byte {
+	for _, v := range vals {
+		if v.Type == TYPE_NULL {
+			out = append(out, 0)
+			continue
+		}
+		out = append(out, 1)
+		switch v.Type {
+		case TYPE_INT64, TYPE_TIME:
+			out = binary.BigEndian.AppendUint64(out, uint64(v.I64)+(1<<63))
+		case TYPE_FLOAT64:
+			out = binary.BigEndian.AppendUint64(out, encodeFloat(v.F64))
+		case TYPE_BOOL:
+			out = append(out, byte(v.I64))
+		case TYPE_BYTES, TYPE_STRING:
+			out = append(out, escapeString(v.Str)...)
+			out = append(out, 0)
+		default:
+			panic("bad value type")
+		}
+	}
+	return out
+}
+
+func encodeFloat(f float64) uint64 {
+	if math.IsNaN(f) {
+		return 0
+	}
+	if f == 0 {
+		f = 0 // -0
+	}
+	bits := math.Float64bits(f)
+	if bits>>63 != 0 {
+		return ^bits
+	}
+	return bits | 1<<63
+}
+
+func decodeFloat(bits uint64) float64 {
+	if bits>>63 == 0 {
+		return math.Float64frombits(^bits)
+	}
+	return math.Float64frombits(bits &^ (1 << 63))
+}
+
+// decodes values of the types of `out`
+func decodeValues(in []byte, out []Value) error {
+	for i := range out {
+		if len(in) == 0 {
+			return errBadEncoding
+		}
+		marker := in[0]
+		in = in[1:]
+		if marker == 0 {
+			out[i] = Value{Type: TYPE_NULL}
+			continue
+		}
+		switch out[i].Type {
+		case TYPE_INT64, TYPE_TIME, TYPE_FLOAT64:
+			if len(in) < 8 {
+				return errBadEncoding
+			}
+			u := binary.BigEndian.Uint64(in[:8])
+			if out[i].Type == TYPE_FLOAT64 {
+				out[i].F64 = decodeFloat(u)
+			} else {
+				out[i].I64 = int64(u - (1 << 63))
+			}
+			in = in[8:]
+		case TYPE_BOOL:
+			if len(in) < 1 {
+				return errBadEncoding
+			}
+			out[i].I64 = int64(in[0])
+			in = in[1:]
+		case TYPE_BYTES, TYPE_STRING:
+			idx := bytes.IndexByte(in, 0)
+			if idx < 0 {
+				return errBadEncoding
+			}
+			out[i].Str = unescapeString(in[:idx])
+			in = in[idx+1:]
+		default:
+			panic("bad value type")
+		}
+	}
+	if len(in) != 0 {
+		return errBadEncoding
+	}
+	return nil
+}
+
+func escapeString(in []byte) []byte {
+	zeros := bytes.Count(in, []byte{0})
+	ones := bytes.Count(in, []byte{1})
+	if zeros+ones == 0 {
+		return in
+	}
+	out := make([]byte, 0, len(in)+zeros+ones)
+	for _, c := range in {
+		if c <= 1 {
+			out = append(out, 0x01, c+1)
+		} else {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func unescapeString(in []byte) []byte {
+	if bytes.IndexByte(in, 1) < 0 {
+		return append([]byte{}, in...)
+	}
+	out := make([]byte, 0, len(in))
+	for i := 0; i < len(in); i++ {
+		if in[i] == 0x01 && i+1 < len(in) {
+			i++
+			out = append(out, in[i]-1)
+		} else {
+			out = append(out, in[i])
+		}
+	}
+	return out
+}
@@ -0,0 +1,236 @@
+package table
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"unicode"
+	"unicode/utf8"
+
+	"godb/internal/storage/index/btree"
+)
+
+// Full-text indexes map the terms of a text column to the rows containing
+// them. the text is split into terms by Tokenize, every term of a row is
+// a key of the index followed by the primary key, so the rows of a term
+// are a range of the index:
+//
+// | prefix | term | pkey |  ->  (empty)
+//
+// entries are updated in the same transaction as the row. a query matches
+// the rows containing all of its terms, see Tx.Match.
+
+// longer terms are cut
+const FULLTEXT_MAX_TERM = 64
+
+// the distinct terms of `text` in order of appearance: runs of letters and
+// digits, lower case
+func Tokenize(text []byte) []string {
+	var terms []string
+	seen := map[string]bool{}
+	for len(text) > 0 {
+		start := bytes.IndexFunc(text, isTermRune)
+		if start < 0 {
+			break
+		}
+		text = text[start:]
+		end := bytes.IndexFunc(text, func(r rune) bool { return !isTermRune(r) })
+		if end < 0 {
+			end = len(text)
+		}
+		term := bytes.ToLower(text[:end])
+		text = text[end:]
+		for len(term) > FULLTEXT_MAX_TERM {
+			_, size := utf8.DecodeLastRune(term)
+			term = term[:len(term)-size]
+		}
+		if !seen[string(term)] {
+			seen[string(term)] = true
+			terms = append(terms, string(term))
+		}
+	}
+	return terms
+}
+
+func isTermRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func checkFullText(tdef *TableDef) error {
+	for i, col := range tdef.FullText {
+		j := colIndex(tdef, col)
+		if j < 0 || !isString(tdef.Types[j]) || slices.Index(tdef.FullText[:i], col) >= 0 {
+			return ErrBadTable
+		}
+	}
+	return nil
+}
+
+func termKey(tdef *TableDef, i int, term string) []byte {
+	return encodeKey(nil, tdef.FullTextPrefixes[i], []Value{String(term)})
+}
+
+// adds or removes the terms of the row, `vals` are all columns
+func fullTextOp(tx *Tx, tdef *TableDef, vals []Value, op int) error {
+	pkey := encodeValues(nil, vals[:tdef.PKeys])
+	for i, col := range tdef.FullText {
+		for _, term := range Tokenize(vals[colIndex(tdef, col)].Str) {
+			key := append(termKey(tdef, i, term), pkey...)
+			var err error
+			switch op {
+			case INDEX_ADD:
+				err = tx.kv.Set(key, nil)
+			case INDEX_DEL:
+				_, err = tx.kv.Del(key)
+			default:
+				panic("bad index op")
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Matcher iterates the rows containing all terms of a query in the order
+// of the primary key. the postings of the rarest term are scanned and the
+// other terms are looked up for each row. like Scanner it's invalidated by
+// updates of the transaction.
+type Matcher struct {
+	tx     *Tx
+	tdef   *TableDef
+	prefix []byte   // of the scanned term
+	others [][]byte // prefixes of the other terms
+	iter   *btree.BIter
+}
+
+// the rows where the full-text indexed column `col` has all terms of `query`,
+// a query without terms matches nothing
+func (tx *Tx) Match(table string, col string, query string) (*Matcher, error) {
+	tdef, err := tx.table(table)
+	if err != nil {
+		return nil, err
+	}
+	i := slices.Index(tdef.FullText, col)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: no full-text index by %s", ErrBadRecord, col)
+	}
+	m := &Matcher{tx: tx, tdef: tdef}
+	for _, term := range Tokenize([]byte(query)) {
+		m.others = append(m.others, termKey(tdef, i, term))
+	}
+	if len(m.others) == 0 {
+		return m, nil
+	}
+	counts := make([]int, len(m.others))
+	for j, prefix := range m.others {
+		counts[j] = tx.kv.Count(prefix, prefixEnd(prefix))
+	}
+	rarest := slices.Index(counts, slices.Min(counts))
+	m.prefix = m.others[rarest]
+	m.others = slices.Delete(m.others, rarest, rarest+1)
+	m.iter = tx.kv.Seek(m.prefix)
+	m.skip()
+	return m, nil
+}
+
+// moves to the first posting with all the other terms
+func (m *Matcher) skip() {
+	for ; m.Valid(); m.iter.Next() {
+		key, _ := m.iter.Deref()
+		pkey := key[len(m.prefix):]
+		if !slices.ContainsFunc(m.others, func(prefix []byte) bool {
+			_, ok := m.tx.kv.Get(append(slices.Clip(prefix), pkey...))
+			return !ok
+		}) {
+			return
+		}
+	}
+}
+
+func (m *Matcher) Valid() bool {
+	if m.iter == nil || !m.iter.Valid() {
+		return false
+	}
+	key, _ := m.iter.Deref()
+	return bytes.HasPrefix(key, m.prefix)
+}
+
+func (m *Matcher) Next() {
+	m.iter.Next()
+	m.skip()
+}
+
+// the current row, fetched by the primary key
+func (m *Matcher) Deref(rec *Record) error {
+	key, _ := m.iter.Deref()
+	vals := make([]Value, m.tdef.PKeys)
+	for i := range vals {
+		vals[i].Type = m.tdef.Types[i]
+	}
+	if err := decodeValues(key[len(m.prefix):], vals); err != nil {
+		return err
+	}
+	*rec = Record{Cols: m.tdef.Cols[:m.tdef.PKeys], Vals: vals}
+	ok, err := dbGet(m.tx, m.tdef, rec)
+	if err == nil && !ok {
+		err = fmt.Errorf("%w: index entry without a row", errBadEncoding)
+	}
+	return err
+}
+
+// adds a full-text index by `col` and indexes the existing rows
+func (tx *Tx) FullTextNew(table string, col string) error {
+	tdef, err := tx.table(table)
+	if err != nil {
+		return err
+	}
+	if table[0] == '@' {
+		return ErrBadTable
+	}
+	if slices.Contains(tdef.FullText, col) {
+		return fmt.Errorf("%w: duplicate full-text index", ErrBadTable)
+	}
+	prefix, err := allocPrefixes(tx, 1)
+	if err != nil {
+		return err
+	}
+	next := *tdef
+	next.FullText = append(slices.Clone(tdef.FullText), col)
+	next.FullTextPrefixes = append(slices.Clone(tdef.FullTextPrefixes), prefix)
+	if err := checkFullText(&next); err != nil {
+		return err
+	}
+	if err := saveTableDef(tx, &next, MODE_UPDATE_ONLY); err != nil {
+		return err
+	}
+
+	var rows [][]Value
+	err = dbScan(tx, &next, Record{}, func(rec Record) bool {
+		rows = append(rows, rec.Vals)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	only := TableDef{
+		Cols: next.Cols, Types: next.Types, PKeys: next.PKeys,
+		FullText: []string{col}, FullTextPrefixes: []uint32{prefix},
+	}
+	for _, vals := range rows {
+		if err := fullTextOp(tx, &only, vals, INDEX_ADD); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) FullTextNew(table string, col string) error {
+	tx := db.Begin()
+	if err := tx.FullTextNew(table, col); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,123 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	cases := map[string]string{
+		"Hello, world! hello":      "[hello world]",
+		"  B-tree's pages (4096)":  "[b tree s pages 4096]",
+		"Ünïcode naïve café":       "[ünïcode naïve café]",
+		"":                         "[]",
+		"--- ...":                  "[]",
+		strings.Repeat("é", 40):    "[" + strings.Repeat("é", 32) + "]",
+		"go1.22 GO1 go1":           "[go1 22]",
+		"tabs\tand\nnew\r\nlines!": "[tabs and new lines]",
+	}
+	for text, want := range cases {
+		if got := fmt.Sprint(Tokenize([]byte(text))); got != want {
+			t.Errorf("Tokenize(%q) = %s; want %s", text, got, want)
+		}
+	}
+}
+
+func match(t *testing.T, tx *Tx, query string) []string {
+	t.Helper()
+	m, err := tx.Match("docs", "body", query)
+	if err != nil {
+		t.Fatalf("Match(%q): %v", query, err)
+	}
+	var ids []string
+	for ; m.Valid(); m.Next() {
+		var rec Record
+		if err := m.Deref(&rec); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, fmt.Sprint(rec.Get("id").I64))
+	}
+	return ids
+}
+
+func TestFullText(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openDB(t, path)
+	docs := &TableDef{
+		Name:     "docs",
+		Types:    []uint32{TYPE_INT64, TYPE_STRING, TYPE_STRING},
+		Cols:     []string{"id", "title", "body"},
+		FullText: []string{"body"},
+	}
+	if err := db.TableNew(docs); err != nil {
+		t.Fatal(err)
+	}
+	if len(docs.FullTextPrefixes) != 1 || docs.FullTextPrefixes[0] != docs.Prefix+1 {
+		t.Fatalf("FullTextPrefixes = %v", docs.FullTextPrefixes)
+	}
+	bad := &TableDef{Name: "bad", Types: []uint32{TYPE_INT64, TYPE_INT64}, Cols: []string{"id", "n"}, FullText: []string{"n"}}
+	if err := db.TableNew(bad); !errors.Is(err, ErrBadTable) {
+		t.Fatalf("TableNew() with a full-text index of a number = %v", err)
+	}
+
+	bodies := []string{
+		"the quick brown fox",
+		"The lazy dog sleeps",
+		"a quick dog, a quick fox",
+		"nothing to see",
+	}
+	tx := db.Begin()
+	for i, body := range bodies {
+		rec := (&Record{}).AddInt64("id", int64(i)).Add("title", String(fmt.Sprint("doc", i))).Add("body", String(body))
+		if _, err := tx.Insert("docs", *rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx.Insert("docs", *(&Record{}).AddInt64("id", 9).Add("title", String("empty")).Add("body", Null()))
+	if got := match(t, tx, "QUICK fox"); fmt.Sprint(got) != "[0 2]" {
+		t.Fatalf("quick fox = %v", got)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the terms follow updates and deletes
+	db.Update("docs", *(&Record{}).AddInt64("id", 0).Add("title", String("doc0")).Add("body", String("a slow brown fox")))
+	db.Delete("docs", *(&Record{}).AddInt64("id", 2))
+	if err := db.FullTextNew("docs", "title"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FullTextNew("docs", "title"); !errors.Is(err, ErrBadTable) {
+		t.Fatalf("FullTextNew() of a duplicate index = %v", err)
+	}
+	db.Close()
+
+	db = openDB(t, path)
+	defer db.Close()
+	tx = db.BeginRead()
+	defer tx.Rollback()
+	cases := map[string]string{
+		"quick":     "[]",
+		"fox":       "[0]",
+		"dog":       "[1]",
+		"brown fox": "[0]",
+		"dog fox":   "[]",
+		"...":       "[]",
+		"see":       "[3]",
+	}
+	for query, want := range cases {
+		if got := match(t, tx, query); fmt.Sprint(got) != want {
+			t.Errorf("Match(%q) = %v; want %s", query, got, want)
+		}
+	}
+	m, err := tx.Match("docs", "title", "doc3")
+	if err != nil || !m.Valid() {
+		t.Fatalf("Match() of the new index = %v", err)
+	}
+	if _, err := tx.Match("docs", "id", "x"); !errors.Is(err, ErrBadRecord) {
+		t.Fatalf("Match() without an index = %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package table
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Secondary indexes are stored in the KV tree like tables, every index has
+// its own prefix. An index contains the indexed columns followed by the
+// primary key columns that are not indexed, so every row has a unique
+// index key and the row can be found from it:
+//
+// | prefix | indexed columns | rest of pkey |  ->  (empty)
+// |   4B   |       ...       |     ...      |
+//
+// index entries are updated in the same transaction as the row.
+
+const (
+	INDEX_ADD = 1
+	INDEX_DEL = 2
+)
+
+func colIndex(tdef *TableDef, col string) int {
+	return slices.Index(tdef.Cols, col)
+}
+
+func checkIndex(tdef *TableDef, index []string) error {
+	if len(index) == 0 {
+		return ErrBadTable
+	}
+	for i, col := range index {
+		if colIndex(tdef, col) < 0 || slices.Index(index[:i], col) >= 0 {
+			return ErrBadTable
+		}
+	}
+	return nil
+}
+
+// appends the primary key columns missing from the index
+func indexColumns(tdef *TableDef, index []string) []string {
+	cols := append([]string{}, index...)
+	for _, col := range tdef.Cols[:tdef.PKeys] {
+		if !slices.Contains(cols, col) {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
+func indexKey(tdef *TableDef, i int, vals []Value) []byte {
+	ivals := make([]Value, len(tdef.Indexes[i]))
+	for j, col := range tdef.Indexes[i] {
+		ivals[j] = vals[colIndex(tdef, col)]
+	}
+	return encodeKey(nil, tdef.IndexPrefixes[i], ivals)
+}
+
+func hasIndexes(tdef *TableDef) bool {
+	return len(tdef.Indexes) > 0 || len(tdef.Bitmaps) > 0 || len(tdef.FullText) > 0
+}
+
+// adds or removes the index entries, the bits and the terms of the row,
+// `vals` are all columns
+func indexOp(tx *Tx, tdef *TableDef, vals []Value, op int) error {
+	for i := range tdef.Indexes {
+		key := indexKey(tdef, i, vals)
+		switch op {
+		case INDEX_ADD:
+			if err := tx.kv.Set(key, nil); err != nil {
+				return err
+			}
+		case INDEX_DEL:
+			if _, err := tx.kv.Del(key); err != nil {
+				return err
+			}
+		default:
+			panic("bad index op")
+		}
+	}
+	if len(tdef.Bitmaps) > 0 {
+		if err := bitmapOp(tx, tdef, vals, op); err != nil {
+			return err
+		}
+	}
+	return fullTextOp(tx, tdef, vals, op)
+}
+
+// adds an index by `cols` and indexes the existing rows
+func (tx *Tx) IndexNew(table string, cols []string) error {
+	tdef, err := tx.table(table)
+	if err != nil {
+		return err
+	}
+	if table[0] == '@' {
+		return ErrBadTable
+	}
+	if err := checkIndex(tdef, cols); err != nil {
+		return err
+	}
+	index := indexColumns(tdef, cols)
+	for _, other := range tdef.Indexes {
+		if slices.Equal(other, index) {
+			return fmt.Errorf("%w: duplicate index", ErrBadTable)
+		}
+	}
+	prefix, err := allocPrefixes(tx, 1)
+	if err != nil {
+		return err
+	}
+	next := *tdef
+	next.Indexes = append(slices.Clone(tdef.Indexes), index)
+	next.IndexPrefixes = append(slices.Clone(tdef.IndexPrefixes), prefix)
+	if err := saveTableDef(tx, &next, MODE_UPDATE_ONLY); err != nil {
+		return err
+	}
+
+	var keys [][]byte
+	err = dbScan(tx, &next, Record{}, func(rec Record) bool {
+		keys = append(keys, indexKey(&next, len(next.Indexes)-1, rec.Vals))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := tx.kv.Set(key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the first index whose leading columns are the columns of `key`
+func findIndex(tdef *TableDef, key Record) (int, error) {
+	for i, index := range tdef.Indexes {
+		if len(key.Cols) > len(index) {
+			continue
+		}
+		leading := index[:len(key.Cols)]
+		if !slices.ContainsFunc(key.Cols, func(col string) bool { return !slices.Contains(leading, col) }) {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("%w: no index by %v", ErrBadRecord, key.Cols)
+}
+
+// calls `fn` for rows whose indexed columns equal `key`, in the index order
+// until it returns false. `key` holds the leading columns of an index.
+func dbScanIndex(tx *Tx, tdef *TableDef, key Record, fn func(rec Record) bool) error {
+	i, err := findIndex(tdef, key)
+	if err != nil {
+		return err
+	}
+	sc := Scanner{Cmp1: CMP_GE, Key1: key, Cmp2: CMP_LE, Key2: key, Path: i + 1}
+	return scanAll(tx, tdef, &sc, fn)
+}
+
+// fetches the row of the index entry by the primary key
+func indexRow(tx *Tx, tdef *TableDef, i int, ikey []byte) (Record, error) {
+	index := tdef.Indexes[i]
+	vals := make([]Value, len(index))
+	for j, col := range index {
+		vals[j].Type = tdef.Types[colIndex(tdef, col)]
+	}
+	if err := decodeValues(ikey[4:], vals); err != nil {
+		return Record{}, err
+	}
+	rec := Record{}
+	for _, col := range tdef.Cols[:tdef.PKeys] {
+		rec.Cols = append(rec.Cols, col)
+		rec.Vals = append(rec.Vals, vals[slices.Index(index, col)])
+	}
+	ok, err := dbGet(tx, tdef, &rec)
+	if err != nil {
+		return Record{}, err
+	}
+	if !ok {
+		return Record{}, fmt.Errorf("%w: index entry without a row", errBadEncoding)
+	}
+	return rec, nil
+}
+
+// calls `fn` for rows whose indexed columns equal `key`, see dbScanIndex
+func (tx *Tx) ScanIndex(table string, key Record, fn func(rec Record) bool) error {
+	tdef, err := tx.table(table)
+	if err != nil {
+		return err
+	}
+	return dbScanIndex(tx, tdef, key, fn)
+}
+
+func (db *DB) IndexNew(table string, cols []string) error {
+	tx := db.Begin()
+	if err := tx.IndexNew(table, cols); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
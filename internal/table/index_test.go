@@ -0,0 +1,111 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func scanIndex(t *testing.T, db *DB, table string, key Record) []string {
+	t.Helper()
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	var names []string
+	err := tx.ScanIndex(table, key, func(rec Record) bool {
+		names = append(names, string(rec.Get("name").Str))
+		return true
+	})
+	if err != nil {
+		t.Fatalf("ScanIndex(%v): %v", key.Cols, err)
+	}
+	return names
+}
+
+func TestIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openDB(t, path)
+
+	users := &TableDef{
+		Name:    "users",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES, TYPE_INT64},
+		Cols:    []string{"id", "name", "city", "age"},
+		Indexes: [][]string{{"city", "age"}},
+	}
+	if err := db.TableNew(users); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(users.Indexes) != "[[city age id]]" || len(users.IndexPrefixes) != 1 {
+		t.Fatalf("Indexes = %v, prefixes %v", users.Indexes, users.IndexPrefixes)
+	}
+	cities := []string{"paris", "oslo", "rome"}
+	for i := 0; i < 30; i++ {
+		rec := (&Record{}).AddInt64("id", int64(i)).AddStr("name", []byte(fmt.Sprintf("u%02d", i))).
+			AddStr("city", []byte(cities[i%3])).AddInt64("age", int64(50-i))
+		if ok, err := db.Insert("users", *rec); !ok || err != nil {
+			t.Fatalf("Insert(%d) = %v, %v", i, ok, err)
+		}
+	}
+
+	// ordered by age
+	if got := scanIndex(t, db, "users", *(&Record{}).AddStr("city", []byte("oslo"))); fmt.Sprint(got) != "[u28 u25 u22 u19 u16 u13 u10 u07 u04 u01]" {
+		t.Fatalf("ScanIndex(oslo) = %v", got)
+	}
+	key := (&Record{}).AddInt64("age", 40).AddStr("city", []byte("oslo"))
+	if got := scanIndex(t, db, "users", *key); fmt.Sprint(got) != "[u10]" {
+		t.Fatalf("ScanIndex(oslo, 40) = %v", got)
+	}
+
+	// index entries follow updates and deletes
+	moved := (&Record{}).AddInt64("id", 10).AddStr("name", []byte("u10")).AddStr("city", []byte("rome")).AddInt64("age", 40)
+	if ok, _ := db.Update("users", *moved); !ok {
+		t.Fatal("Update() failed")
+	}
+	db.Delete("users", *(&Record{}).AddInt64("id", 1))
+	if got := scanIndex(t, db, "users", *key); len(got) != 0 {
+		t.Fatalf("ScanIndex(oslo, 40) after the update = %v", got)
+	}
+	if got := scanIndex(t, db, "users", *(&Record{}).AddStr("city", []byte("oslo"))); len(got) != 8 {
+		t.Fatalf("ScanIndex(oslo) after the update = %v", got)
+	}
+
+	// the new index covers existing rows
+	if err := db.IndexNew("users", []string{"name"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.IndexNew("users", []string{"name"}); !errors.Is(err, ErrBadTable) {
+		t.Fatalf("IndexNew() of a duplicate index = %v; want ErrBadTable", err)
+	}
+	if err := db.IndexNew("users", []string{"nope"}); !errors.Is(err, ErrBadTable) {
+		t.Fatalf("IndexNew() by a missing column = %v; want ErrBadTable", err)
+	}
+	db.Close()
+
+	db = openDB(t, path)
+	defer db.Close()
+	if got := scanIndex(t, db, "users", *(&Record{}).AddStr("name", []byte("u10"))); fmt.Sprint(got) != "[u10]" {
+		t.Fatalf("ScanIndex(name) = %v", got)
+	}
+	if got := scanIndex(t, db, "users", *(&Record{}).AddStr("name", []byte("u01"))); len(got) != 0 {
+		t.Fatalf("ScanIndex(name) of a deleted row = %v", got)
+	}
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	if err := tx.ScanIndex("users", *(&Record{}).AddInt64("age", 1), func(Record) bool { return true }); !errors.Is(err, ErrBadRecord) {
+		t.Fatalf("ScanIndex() by a non-leading column = %v; want ErrBadRecord", err)
+	}
+}
+
+func TestIndexRollback(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	tdef := &TableDef{Name: "t", Types: []uint32{TYPE_BYTES, TYPE_BYTES}, Cols: []string{"k", "name"}, Indexes: [][]string{{"name"}}}
+	db.TableNew(tdef)
+
+	tx := db.Begin()
+	tx.Insert("t", *(&Record{}).AddStr("k", []byte("1")).AddStr("name", []byte("a")))
+	tx.Rollback()
+	if got := scanIndex(t, db, "t", Record{}); len(got) != 0 {
+		t.Fatalf("index has entries of a rolled back insert: %v", got)
+	}
+}
@@ -0,0 +1,124 @@
+package table
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Rows are stored in a self-describing format, so rows written before
+// columns were added stay readable:
+//
+// | version | ncols | null bitmap  | values |
+// |    1B   | uvarint | (ncols+7)/8 | ...    |
+//
+// value
+// | type | data |
+// |  1B  | ...  |
+//
+// int64, time: varint. float64: 8B little-endian bits. bool: 1B.
+// bytes, string: uvarint length + data. NULL values are only in the bitmap.
+// columns added after the row was written decode as NULL.
+
+const ROW_FORMAT_V1 = 1
+
+func encodeRow(out []byte, vals []Value) []byte {
+	out = append(out, ROW_FORMAT_V1)
+	out = binary.AppendUvarint(out, uint64(len(vals)))
+	bitmap := len(out)
+	out = append(out, make([]byte, (len(vals)+7)/8)...)
+	for i, v := range vals {
+		if v.Type == TYPE_NULL {
+			out[bitmap+i/8] |= 1 << (i % 8)
+			continue
+		}
+		out = append(out, byte(v.Type))
+		switch v.Type {
+		case TYPE_INT64, TYPE_TIME:
+			out = binary.AppendVarint(out, v.I64)
+		case TYPE_FLOAT64:
+			out = binary.LittleEndian.AppendUint64(out, math.Float64bits(v.F64))
+		case TYPE_BOOL:
+			out = append(out, byte(v.I64))
+		case TYPE_BYTES, TYPE_STRING:
+			out = binary.AppendUvarint(out, uint64(len(v.Str)))
+			out = append(out, v.Str...)
+		default:
+			panic("bad value type")
+		}
+	}
+	return out
+}
+
+func decodeRow(in []byte) ([]Value, error) {
+	if len(in) == 0 || in[0] != ROW_FORMAT_V1 {
+		return nil, fmt.Errorf("%w: unknown row format", errBadEncoding)
+	}
+	in = in[1:]
+	ncols, n := binary.Uvarint(in)
+	if n <= 0 || ncols > uint64(len(in))*8 {
+		return nil, errBadEncoding
+	}
+	in = in[n:]
+	nbitmap := (int(ncols) + 7) / 8
+	if len(in) < nbitmap {
+		return nil, errBadEncoding
+	}
+	bitmap, in := in[:nbitmap], in[nbitmap:]
+
+	vals := make([]Value, ncols)
+	for i := range vals {
+		if bitmap[i/8]&(1<<(i%8)) != 0 {
+			vals[i].Type = TYPE_NULL
+			continue
+		}
+		if len(in) == 0 {
+			return nil, errBadEncoding
+		}
+		vals[i].Type = uint32(in[0])
+		in = in[1:]
+		switch vals[i].Type {
+		case TYPE_INT64, TYPE_TIME:
+			vals[i].I64, n = binary.Varint(in)
+			if n <= 0 {
+				return nil, errBadEncoding
+			}
+			in = in[n:]
+		case TYPE_FLOAT64:
+			if len(in) < 8 {
+				return nil, errBadEncoding
+			}
+			vals[i].F64 = math.Float64frombits(binary.LittleEndian.Uint64(in))
+			in = in[8:]
+		case TYPE_BOOL:
+			if len(in) < 1 || in[0] > 1 {
+				return nil, errBadEncoding
+			}
+			vals[i].I64 = int64(in[0])
+			in = in[1:]
+		case TYPE_BYTES, TYPE_STRING:
+			size, n := binary.Uvarint(in)
+			if n <= 0 || size > uint64(len(in)-n) {
+				return nil, errBadEncoding
+			}
+			vals[i].Str = append([]byte{}, in[n:n+int(size)]...)
+			in = in[n+int(size):]
+		default:
+			return nil, fmt.Errorf("%w: unknown value type %d", errBadEncoding, vals[i].Type)
+		}
+	}
+	if len(in) != 0 {
+		return nil, errBadEncoding
+	}
+	return vals, nil
+}
+
+// EncodeRow appends `vals` in the row format, for rows kept outside tables
+// like the runs of an external sort
+func EncodeRow(out []byte, vals []Value) []byte {
+	return encodeRow(out, vals)
+}
+
+func DecodeRow(in []byte) ([]Value, error) {
+	return decodeRow(in)
+}
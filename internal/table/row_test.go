@@ -0,0 +1,108 @@
+package table
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRowCodec(t *testing.T) {
+	rows := [][]Value{
+		{},
+		{{Type: TYPE_NULL}},
+		{{Type: TYPE_INT64, I64: math.MinInt64}, {Type: TYPE_INT64, I64: math.MaxInt64}, {Type: TYPE_INT64}},
+		{{Type: TYPE_BYTES, Str: []byte{}}, {Type: TYPE_NULL}, {Type: TYPE_BYTES, Str: []byte("a\x00\x01b")}},
+		{Float64(-0.5), Float64(math.Inf(1)), Bool(true), Bool(false), String("s"), Time(time.Unix(-5, 3))},
+	}
+	var nine []Value
+	for i := 0; i < 9; i++ {
+		if i%3 == 0 {
+			nine = append(nine, Value{Type: TYPE_NULL})
+		} else {
+			nine = append(nine, Value{Type: TYPE_INT64, I64: int64(-i)})
+		}
+	}
+	rows = append(rows, nine)
+
+	for _, row := range rows {
+		enc := encodeRow(nil, row)
+		got, err := decodeRow(enc)
+		if err != nil {
+			t.Fatalf("decodeRow(%x): %v", enc, err)
+		}
+		if len(row) == 0 && len(got) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, row) {
+			t.Fatalf("decodeRow(encodeRow(%+v)) = %+v", row, got)
+		}
+	}
+
+	for _, bad := range [][]byte{nil, {0}, {2, 0}, {ROW_FORMAT_V1, 1}, {ROW_FORMAT_V1, 1, 0, 9}, {ROW_FORMAT_V1, 1, 0, TYPE_BYTES, 5, 'a'}, {ROW_FORMAT_V1, 1, 0, TYPE_BOOL, 2}} {
+		if _, err := decodeRow(bad); err == nil {
+			t.Fatalf("decodeRow(%x) succeeded", bad)
+		}
+	}
+}
+
+func FuzzRowCodec(f *testing.F) {
+	f.Add(encodeRow(nil, []Value{{Type: TYPE_INT64, I64: -1}, {Type: TYPE_NULL}, {Type: TYPE_BYTES, Str: []byte("x")}}))
+	f.Add([]byte{ROW_FORMAT_V1, 0})
+	f.Add(encodeRow(nil, []Value{Float64(1.5), Bool(true), String("s"), Time(time.Unix(1, 2))}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		row, err := decodeRow(data)
+		if err != nil {
+			return
+		}
+		// the encoding is canonical except for varints with redundant bytes
+		enc := encodeRow(nil, row)
+		again, err := decodeRow(enc)
+		if err != nil {
+			t.Fatalf("decodeRow(encodeRow(%+v)): %v", row, err)
+		}
+		if !bytes.Equal(encodeRow(nil, again), enc) {
+			t.Fatalf("round trip of %+v changed the row", row)
+		}
+	})
+}
+
+func TestTableAddColumn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openDB(t, path)
+	tdef := &TableDef{Name: "t", Types: []uint32{TYPE_BYTES, TYPE_INT64}, Cols: []string{"k", "a"}}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatal(err)
+	}
+	db.Insert("t", *(&Record{}).AddStr("k", []byte("old")).AddInt64("a", 1))
+	if err := db.TableAddColumn("t", "b", TYPE_BYTES); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.TableAddColumn("t", "a", TYPE_BYTES); err != ErrBadTable {
+		t.Fatalf("TableAddColumn() of an existing column = %v; want ErrBadTable", err)
+	}
+	if err := db.TableAddColumn("@meta", "x", TYPE_BYTES); err != ErrBadTable {
+		t.Fatalf("TableAddColumn() of an internal table = %v; want ErrBadTable", err)
+	}
+	db.Close()
+
+	db = openDB(t, path)
+	defer db.Close()
+	rec := (&Record{}).AddStr("k", []byte("old"))
+	if ok, err := db.Get("t", rec); !ok || err != nil {
+		t.Fatalf("Get() = %v, %v", ok, err)
+	}
+	if rec.Get("a").I64 != 1 || rec.Get("b").Type != TYPE_NULL {
+		t.Fatalf("Get() = %+v; want a=1, b=NULL", rec)
+	}
+	if _, err := db.Insert("t", *(&Record{}).AddStr("k", []byte("old")).AddInt64("a", 1)); !errors.Is(err, ErrBadRecord) {
+		t.Fatalf("Insert() without the new column = %v; want ErrBadRecord", err)
+	}
+	rec = (&Record{}).AddStr("k", []byte("new")).AddInt64("a", 2).AddStr("b", []byte("x"))
+	if ok, _ := db.Insert("t", *rec); !ok {
+		t.Fatal("Insert() failed")
+	}
+}
@@ -0,0 +1,232 @@
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	"godb/internal/storage/index/btree"
+)
+
+const (
+	CMP_GE = 1 // >=
+	CMP_GT = 2 // >
+	CMP_LT = 3 // <
+	CMP_LE = 4 // <=
+)
+
+// Scanner iterates rows in a range of the primary key or of an index.
+// Key1 and Key2 hold the leading columns of the primary key or of an index,
+// the access path is chosen by the columns. Cmp1 is the bound of Key1 and
+// the direction: CMP_GE/CMP_GT scan forward, CMP_LE/CMP_LT backward.
+// Cmp2 bounds the other end, an empty Key2 scans to the end of the table.
+// the keys can have different numbers of columns, the shorter one is
+// compared as a prefix:
+//
+//	// rows with 10 <= id < 20
+//	sc := Scanner{Cmp1: CMP_GE, Key1: id(10), Cmp2: CMP_LT, Key2: id(20)}
+//	// rows with a = 1 and b > 5
+//	sc := Scanner{Cmp1: CMP_GT, Key1: ab(1, 5), Cmp2: CMP_LE, Key2: a(1)}
+//
+// the scanner is built on the tree cursor and is invalidated by updates
+// of the transaction.
+type Scanner struct {
+	Cmp1 int
+	Cmp2 int
+	Key1 Record
+	Key2 Record
+	Path int // 0 picks the path by the columns, i+1 scans index i
+
+	tx    *Tx
+	tdef  *TableDef
+	index int // -1 for the primary key
+	iter  *btree.BIter
+	back  bool
+	lo    []byte // [lo, hi) of encoded keys
+	hi    []byte
+}
+
+// columns of the access path
+func (sc *Scanner) columns() []string {
+	if sc.index < 0 {
+		return sc.tdef.Cols[:sc.tdef.PKeys]
+	}
+	return sc.tdef.Indexes[sc.index]
+}
+
+func (sc *Scanner) prefix() uint32 {
+	if sc.index < 0 {
+		return sc.tdef.Prefix
+	}
+	return sc.tdef.IndexPrefixes[sc.index]
+}
+
+// the primary key if the columns of `key` are its leading columns, an index otherwise
+func pickPath(tdef *TableDef, key Record) (int, error) {
+	pkey := tdef.Cols[:tdef.PKeys]
+	if len(key.Cols) <= len(pkey) && !slices.ContainsFunc(key.Cols, func(col string) bool {
+		return !slices.Contains(pkey[:len(key.Cols)], col)
+	}) {
+		return -1, nil
+	}
+	return findIndex(tdef, key)
+}
+
+// encodes the columns of `key` in the order of the access path
+func (sc *Scanner) encode(key Record) ([]byte, error) {
+	if len(key.Cols) != len(key.Vals) {
+		return nil, ErrBadRecord
+	}
+	cols := sc.columns()
+	if len(key.Cols) > len(cols) {
+		return nil, fmt.Errorf("%w: too many key columns", ErrBadRecord)
+	}
+	vals := make([]Value, len(key.Cols))
+	for i, col := range cols[:len(key.Cols)] {
+		v := key.Get(col)
+		if v == nil {
+			return nil, fmt.Errorf("%w: missing column %s", ErrBadRecord, col)
+		}
+		if v.Type != sc.tdef.Types[colIndex(sc.tdef, col)] && v.Type != TYPE_NULL {
+			return nil, fmt.Errorf("%w: column %s type mismatch", ErrBadRecord, col)
+		}
+		vals[i] = *v
+	}
+	return encodeKey(nil, sc.prefix(), vals), nil
+}
+
+// lower or upper bound of the range
+func (sc *Scanner) bound(cmp int, key Record) ([]byte, bool, error) {
+	enc, err := sc.encode(key)
+	if err != nil {
+		return nil, false, err
+	}
+	switch cmp {
+	case CMP_GE:
+		return enc, true, nil
+	case CMP_GT:
+		return prefixEnd(enc), true, nil
+	case CMP_LT:
+		return enc, false, nil
+	case CMP_LE:
+		return prefixEnd(enc), false, nil
+	}
+	return nil, false, fmt.Errorf("%w: bad comparison %d", ErrBadRecord, cmp)
+}
+
+func (sc *Scanner) init(tx *Tx, tdef *TableDef) error {
+	sc.tx, sc.tdef = tx, tdef
+	// the longer key picks the path, the other one must use
+	// the leading columns of the path
+	key := sc.Key1
+	if len(sc.Key2.Cols) > len(key.Cols) {
+		key = sc.Key2
+	}
+	sc.index = sc.Path - 1
+	if sc.Path == 0 {
+		index, err := pickPath(tdef, key)
+		if err != nil {
+			return err
+		}
+		sc.index = index
+	}
+
+	// the whole path by default
+	sc.lo = binary.BigEndian.AppendUint32(nil, sc.prefix())
+	sc.hi = prefixEnd(sc.lo)
+	sc.back = sc.Cmp1 == CMP_LT || sc.Cmp1 == CMP_LE
+	for _, b := range []struct {
+		cmp int
+		key Record
+	}{{sc.Cmp1, sc.Key1}, {sc.Cmp2, sc.Key2}} {
+		if b.cmp == 0 && len(b.key.Cols) == 0 {
+			continue
+		}
+		enc, lower, err := sc.bound(b.cmp, b.key)
+		if err != nil {
+			return err
+		}
+		if lower && bytes.Compare(enc, sc.lo) > 0 {
+			sc.lo = enc
+		} else if !lower && bytes.Compare(enc, sc.hi) < 0 {
+			sc.hi = enc
+		}
+	}
+
+	if sc.back {
+		sc.iter = tx.kv.SeekLE(sc.hi)
+		if sc.iter.Valid() {
+			if key, _ := sc.iter.Deref(); bytes.Equal(key, sc.hi) {
+				sc.iter.Prev()
+			}
+		}
+	} else {
+		sc.iter = tx.kv.Seek(sc.lo)
+	}
+	return nil
+}
+
+// within the range
+func (sc *Scanner) Valid() bool {
+	if !sc.iter.Valid() {
+		return false
+	}
+	key, _ := sc.iter.Deref()
+	return bytes.Compare(sc.lo, key) <= 0 && bytes.Compare(key, sc.hi) < 0
+}
+
+// moves in the direction of the scan
+func (sc *Scanner) Next() {
+	if sc.back {
+		sc.iter.Prev()
+	} else {
+		sc.iter.Next()
+	}
+}
+
+// number of rows in the range, counted by the keys without reading the rows
+func (sc *Scanner) Count() int {
+	if bytes.Compare(sc.lo, sc.hi) >= 0 {
+		return 0
+	}
+	return sc.tx.kv.Count(sc.lo, sc.hi)
+}
+
+// the current row, index scans fetch it by the primary key
+func (sc *Scanner) Deref(rec *Record) error {
+	key, val := sc.iter.Deref()
+	var err error
+	if sc.index < 0 {
+		*rec, err = decodeRecord(sc.tdef, key, val)
+	} else {
+		*rec, err = indexRow(sc.tx, sc.tdef, sc.index, key)
+	}
+	return err
+}
+
+// starts the scan of the table described by `req`
+func (tx *Tx) Scanner(table string, req *Scanner) error {
+	tdef, err := tx.table(table)
+	if err != nil {
+		return err
+	}
+	return req.init(tx, tdef)
+}
+
+// calls `fn` for rows of the scanner until it returns false
+func scanAll(tx *Tx, tdef *TableDef, sc *Scanner, fn func(rec Record) bool) error {
+	if err := sc.init(tx, tdef); err != nil {
+		return err
+	}
+	for ; sc.Valid(); sc.Next() {
+		var rec Record
+		if err := sc.Deref(&rec); err != nil {
+			return err
+		}
+		if !fn(rec) {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func scanIDs(t *testing.T, tx *Tx, table string, sc Scanner) string {
+	t.Helper()
+	if err := tx.Scanner(table, &sc); err != nil {
+		t.Fatalf("Scanner(%+v): %v", sc, err)
+	}
+	var ids []int64
+	for ; sc.Valid(); sc.Next() {
+		var rec Record
+		if err := sc.Deref(&rec); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, rec.Get("id").I64)
+	}
+	return fmt.Sprint(ids)
+}
+
+func TestScanner(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	tdef := &TableDef{
+		Name:    "t",
+		Types:   []uint32{TYPE_INT64, TYPE_INT64, TYPE_STRING},
+		Cols:    []string{"id", "score", "name"},
+		Indexes: [][]string{{"score"}},
+	}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatal(err)
+	}
+	// another table right after, scans must not cross into it
+	other := &TableDef{Name: "u", Types: []uint32{TYPE_INT64}, Cols: []string{"id"}}
+	db.TableNew(other)
+	db.Insert("u", *(&Record{}).AddInt64("id", 100))
+	for i := 0; i < 10; i++ {
+		rec := (&Record{}).AddInt64("id", int64(i)).AddInt64("score", int64(i%3)).Add("name", String(fmt.Sprint(i)))
+		db.Insert("t", *rec)
+	}
+
+	id := func(v int64) Record { return *(&Record{}).AddInt64("id", v) }
+	score := func(v int64) Record { return *(&Record{}).AddInt64("score", v) }
+	tx := db.BeginRead()
+	defer tx.Rollback()
+
+	cases := []struct {
+		sc   Scanner
+		want string
+	}{
+		{Scanner{Cmp1: CMP_GE}, "[0 1 2 3 4 5 6 7 8 9]"},
+		{Scanner{Cmp1: CMP_LE}, "[9 8 7 6 5 4 3 2 1 0]"},
+		{Scanner{Cmp1: CMP_GE, Key1: id(3), Cmp2: CMP_LT, Key2: id(6)}, "[3 4 5]"},
+		{Scanner{Cmp1: CMP_GT, Key1: id(3), Cmp2: CMP_LE, Key2: id(6)}, "[4 5 6]"},
+		{Scanner{Cmp1: CMP_LE, Key1: id(6), Cmp2: CMP_GT, Key2: id(3)}, "[6 5 4]"},
+		{Scanner{Cmp1: CMP_LT, Key1: id(6), Cmp2: CMP_GE, Key2: id(3)}, "[5 4 3]"},
+		{Scanner{Cmp1: CMP_GT, Key1: id(7)}, "[8 9]"},
+		{Scanner{Cmp1: CMP_LT, Key1: id(2)}, "[1 0]"},
+		{Scanner{Cmp1: CMP_GE, Key1: id(6), Cmp2: CMP_LT, Key2: id(3)}, "[]"},
+		// index scans, ordered by score then id
+		{Scanner{Cmp1: CMP_GE, Key1: score(1), Cmp2: CMP_LE, Key2: score(1)}, "[1 4 7]"},
+		{Scanner{Cmp1: CMP_GT, Key1: score(0)}, "[1 4 7 2 5 8]"},
+		{Scanner{Cmp1: CMP_LT, Key1: score(2)}, "[7 4 1 9 6 3 0]"},
+		// keys of different lengths
+		{Scanner{Cmp1: CMP_GT, Key1: *(&Record{}).AddInt64("score", 1).AddInt64("id", 1), Cmp2: CMP_LE, Key2: score(1)}, "[4 7]"},
+		{Scanner{Cmp1: CMP_GE, Key1: score(1), Cmp2: CMP_LT, Key2: *(&Record{}).AddInt64("score", 2).AddInt64("id", 5)}, "[1 4 7 2]"},
+	}
+	for _, c := range cases {
+		if got := scanIDs(t, tx, "t", c.sc); got != c.want {
+			t.Errorf("scan %d %v, %d %v = %s; want %s", c.sc.Cmp1, c.sc.Key1.Vals, c.sc.Cmp2, c.sc.Key2.Vals, got, c.want)
+		}
+		sc := c.sc
+		if err := tx.Scanner("t", &sc); err != nil {
+			t.Fatal(err)
+		}
+		if n, want := sc.Count(), len(strings.Fields(strings.Trim(c.want, "[]"))); n != want {
+			t.Errorf("count %d %v, %d %v = %d; want %d", c.sc.Cmp1, c.sc.Key1.Vals, c.sc.Cmp2, c.sc.Key2.Vals, n, want)
+		}
+	}
+
+	bad := []Scanner{
+		{Cmp1: CMP_GE, Key1: id(1), Cmp2: CMP_LE, Key2: score(1)},
+		{Cmp1: CMP_GE, Key1: *(&Record{}).Add("name", String("x"))},
+		{Cmp1: CMP_GE, Key1: *(&Record{}).Add("id", String("x"))},
+		{Cmp1: 42, Key1: id(1)},
+	}
+	for _, sc := range bad {
+		if err := tx.Scanner("t", &sc); !errors.Is(err, ErrBadRecord) {
+			t.Errorf("Scanner(%+v) = %v; want ErrBadRecord", sc, err)
+		}
+	}
+}
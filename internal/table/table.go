@@ -0,0 +1,599 @@
+package table
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"godb/internal/storage/index/btree"
+)
+
+var (
+	ErrTableExists   = errors.New("table already exists")
+	ErrTableNotFound = errors.New("table not found")
+	ErrBadTable      = errors.New("bad table definition")
+	ErrBadRecord     = errors.New("bad record")
+)
+
+// Tables are stored in the KV tree. Every table has a 4-byte prefix,
+// rows are stored under the prefix and the primary key:
+//
+// | prefix | pkey |  ->  | other columns |
+// |   4B   | ...  |
+//
+// the key is encoded with encodeValues, so rows are ordered by the primary key,
+// other columns are encoded with encodeRow.
+// table definitions are rows of the internal table @table, the next free
+// prefix is a row of @meta.
+
+// a table row, columns can be in any order
+type Record struct {
+	Cols []string
+	Vals []Value
+}
+
+func (rec *Record) Add(col string, val Value) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, val)
+	return rec
+}
+
+func (rec *Record) AddStr(col string, val []byte) *Record {
+	return rec.Add(col, Bytes(val))
+}
+
+func (rec *Record) AddInt64(col string, val int64) *Record {
+	return rec.Add(col, Int64(val))
+}
+
+// nil if there is no such column
+func (rec *Record) Get(col string) *Value {
+	for i, c := range rec.Cols {
+		if c == col {
+			return &rec.Vals[i]
+		}
+	}
+	return nil
+}
+
+// the first PKeys columns are the primary key, 0 means 1.
+// Indexes are secondary indexes by the listed columns, see index.go.
+// Bitmaps are bitmap indexes by one column each, see bitmap.go.
+// FullText are full-text indexes of text columns, see fulltext.go
+type TableDef struct {
+	Name             string
+	Types            []uint32
+	Cols             []string
+	PKeys            int
+	Prefix           uint32
+	Indexes          [][]string
+	IndexPrefixes    []uint32
+	Bitmaps          []string
+	BitmapPrefixes   []uint32
+	RowIDPrefix      uint32
+	FullText         []string
+	FullTextPrefixes []uint32
+}
+
+var TDEF_META = &TableDef{
+	Name:   "@meta",
+	Types:  []uint32{TYPE_BYTES, TYPE_BYTES},
+	Cols:   []string{"key", "val"},
+	PKeys:  1,
+	Prefix: 1,
+}
+
+var TDEF_TABLE = &TableDef{
+	Name:   "@table",
+	Types:  []uint32{TYPE_BYTES, TYPE_BYTES},
+	Cols:   []string{"name", "def"},
+	PKeys:  1,
+	Prefix: 2,
+}
+
+var INTERNAL_TABLES = map[string]*TableDef{
+	"@meta":  TDEF_META,
+	"@table": TDEF_TABLE,
+}
+
+// prefixes below are reserved for internal tables
+const TABLE_PREFIX_MIN = 100
+
+type DB struct {
+	Path string
+	kv   btree.KV
+}
+
+func (db *DB) Open() error {
+	db.kv.Path = db.Path
+	if err := db.kv.Open(); err != nil {
+		return fmt.Errorf("DB.Open: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) Close() error {
+	return db.kv.Close()
+}
+
+// Tx is a transaction of the underlying KV, see btree.Tx
+type Tx struct {
+	db     *DB
+	kv     *btree.Tx
+	tables map[string]*TableDef // definitions read by the transaction
+}
+
+func (db *DB) Begin() *Tx {
+	return &Tx{db: db, kv: db.kv.Begin(), tables: map[string]*TableDef{}}
+}
+
+func (db *DB) BeginRead() *Tx {
+	return &Tx{db: db, kv: db.kv.BeginRead(), tables: map[string]*TableDef{}}
+}
+
+// the tables of a transaction of a KV opened by someone else, like a
+// server sharing it with other protocols. Commit and Rollback end `kv`.
+func NewTx(kv *btree.Tx) *Tx {
+	return &Tx{kv: kv, tables: map[string]*TableDef{}}
+}
+
+func (tx *Tx) Commit() error {
+	return tx.kv.Commit()
+}
+
+func (tx *Tx) Rollback() error {
+	return tx.kv.Rollback()
+}
+
+// the table definition, nil if there is no such table
+func (tx *Tx) getTableDef(name string) *TableDef {
+	if tdef, ok := INTERNAL_TABLES[name]; ok {
+		return tdef
+	}
+	if tdef, ok := tx.tables[name]; ok {
+		return tdef
+	}
+	rec := (&Record{}).AddStr("name", []byte(name))
+	ok, err := dbGet(tx, TDEF_TABLE, rec)
+	if err != nil || !ok {
+		return nil
+	}
+	tdef := &TableDef{}
+	if err := json.Unmarshal(rec.Get("def").Str, tdef); err != nil {
+		return nil
+	}
+	if tdef.PKeys == 0 {
+		tdef.PKeys = 1
+	}
+	tx.tables[name] = tdef
+	return tdef
+}
+
+func checkTableDef(tdef *TableDef) error {
+	if tdef.Name == "" || tdef.Name[0] == '@' {
+		return ErrBadTable
+	}
+	if len(tdef.Cols) == 0 || len(tdef.Cols) != len(tdef.Types) {
+		return ErrBadTable
+	}
+	if tdef.PKeys < 1 || tdef.PKeys > len(tdef.Cols) {
+		return ErrBadTable
+	}
+	seen := map[string]bool{}
+	for i, col := range tdef.Cols {
+		if col == "" || seen[col] {
+			return ErrBadTable
+		}
+		seen[col] = true
+		if !isColumnType(tdef.Types[i]) {
+			return ErrBadTable
+		}
+	}
+	for _, index := range tdef.Indexes {
+		if err := checkIndex(tdef, index); err != nil {
+			return err
+		}
+	}
+	if err := checkBitmaps(tdef); err != nil {
+		return err
+	}
+	return checkFullText(tdef)
+}
+
+// allocates `n` consecutive key prefixes
+func allocPrefixes(tx *Tx, n int) (uint32, error) {
+	meta := (&Record{}).AddStr("key", []byte("next_prefix"))
+	ok, err := dbGet(tx, TDEF_META, meta)
+	if err != nil {
+		return 0, err
+	}
+	prefix := uint32(TABLE_PREFIX_MIN)
+	if ok {
+		prefix = binary.LittleEndian.Uint32(meta.Get("val").Str)
+	}
+	next := binary.LittleEndian.AppendUint32(nil, prefix+uint32(n))
+	meta = (&Record{}).AddStr("key", []byte("next_prefix")).AddStr("val", next)
+	if _, err := dbUpdate(tx, TDEF_META, *meta, MODE_UPSERT); err != nil {
+		return 0, err
+	}
+	return prefix, nil
+}
+
+func saveTableDef(tx *Tx, tdef *TableDef, mode int) error {
+	def, err := json.Marshal(tdef)
+	if err != nil {
+		return err
+	}
+	rec := (&Record{}).AddStr("name", []byte(tdef.Name)).AddStr("def", def)
+	if _, err := dbUpdate(tx, TDEF_TABLE, *rec, mode); err != nil {
+		return err
+	}
+	tx.tables[tdef.Name] = tdef
+	return nil
+}
+
+// creates the table, assigns tdef.Prefix, tdef.IndexPrefixes and the
+// prefixes of the bitmap and full-text indexes
+func (tx *Tx) TableNew(tdef *TableDef) error {
+	if tdef.PKeys == 0 {
+		tdef.PKeys = 1
+	}
+	if err := checkTableDef(tdef); err != nil {
+		return err
+	}
+	if tx.getTableDef(tdef.Name) != nil {
+		return ErrTableExists
+	}
+	for i, index := range tdef.Indexes {
+		tdef.Indexes[i] = indexColumns(tdef, index)
+	}
+
+	n := 1 + len(tdef.Indexes)
+	if len(tdef.Bitmaps) > 0 {
+		n += len(tdef.Bitmaps) + 2 // and the row ids
+	}
+	n += len(tdef.FullText)
+	prefix, err := allocPrefixes(tx, n)
+	if err != nil {
+		return err
+	}
+	tdef.Prefix = prefix
+	tdef.IndexPrefixes = nil
+	for i := range tdef.Indexes {
+		tdef.IndexPrefixes = append(tdef.IndexPrefixes, prefix+1+uint32(i))
+	}
+	tdef.BitmapPrefixes, tdef.RowIDPrefix = nil, 0
+	next := prefix + 1 + uint32(len(tdef.Indexes))
+	for i := range tdef.Bitmaps {
+		tdef.BitmapPrefixes = append(tdef.BitmapPrefixes, next+uint32(i))
+	}
+	if len(tdef.Bitmaps) > 0 {
+		tdef.RowIDPrefix = next + uint32(len(tdef.Bitmaps))
+		next = tdef.RowIDPrefix + 2
+	}
+	tdef.FullTextPrefixes = nil
+	for i := range tdef.FullText {
+		tdef.FullTextPrefixes = append(tdef.FullTextPrefixes, next+uint32(i))
+	}
+	return saveTableDef(tx, tdef, MODE_INSERT_ONLY)
+}
+
+// appends a column, existing rows get NULL
+func (tx *Tx) TableAddColumn(table string, col string, typ uint32) error {
+	tdef, err := tx.table(table)
+	if err != nil {
+		return err
+	}
+	if table[0] == '@' {
+		return ErrBadTable
+	}
+	next := *tdef
+	next.Cols = append(append([]string{}, tdef.Cols...), col)
+	next.Types = append(append([]uint32{}, tdef.Types...), typ)
+	if err := checkTableDef(&next); err != nil {
+		return err
+	}
+	return saveTableDef(tx, &next, MODE_UPDATE_ONLY)
+}
+
+// reorders the record into the table column order,
+// the first `n` columns must be present. primary key columns can't be NULL.
+func checkRecord(tdef *TableDef, rec Record, n int) ([]Value, error) {
+	if len(rec.Cols) != len(rec.Vals) || len(rec.Cols) != n {
+		return nil, fmt.Errorf("%w: %d columns, want %d", ErrBadRecord, len(rec.Cols), n)
+	}
+	vals := make([]Value, len(tdef.Cols))
+	for i, col := range tdef.Cols[:n] {
+		v := rec.Get(col)
+		if v == nil {
+			return nil, fmt.Errorf("%w: missing column %s", ErrBadRecord, col)
+		}
+		if v.Type == TYPE_NULL && i < tdef.PKeys {
+			return nil, fmt.Errorf("%w: NULL primary key column %s", ErrBadRecord, col)
+		}
+		if v.Type != tdef.Types[i] && v.Type != TYPE_NULL {
+			return nil, fmt.Errorf("%w: column %s type mismatch", ErrBadRecord, col)
+		}
+		vals[i] = *v
+	}
+	return vals, nil
+}
+
+func encodeKey(out []byte, prefix uint32, vals []Value) []byte {
+	out = binary.BigEndian.AppendUint32(out, prefix)
+	return encodeValues(out, vals)
+}
+
+// looks up the row by the primary key, fills the other columns of `rec`
+func dbGet(tx *Tx, tdef *TableDef, rec *Record) (bool, error) {
+	vals, err := checkRecord(tdef, *rec, tdef.PKeys)
+	if err != nil {
+		return false, err
+	}
+	key := encodeKey(nil, tdef.Prefix, vals[:tdef.PKeys])
+	val, ok := tx.kv.Get(key)
+	if !ok {
+		return false, nil
+	}
+	if err := decodeColumns(tdef, val, vals); err != nil {
+		return false, err
+	}
+	rec.Cols = append([]string{}, tdef.Cols...)
+	rec.Vals = vals
+	return true, nil
+}
+
+// decodes the row into the columns after the primary key
+func decodeColumns(tdef *TableDef, val []byte, vals []Value) error {
+	row, err := decodeRow(val)
+	if err != nil {
+		return err
+	}
+	if len(row) > len(tdef.Cols)-tdef.PKeys {
+		return fmt.Errorf("%w: row has more columns than the table", errBadEncoding)
+	}
+	for i := tdef.PKeys; i < len(tdef.Cols); i++ {
+		vals[i].Type = TYPE_NULL
+		if i-tdef.PKeys < len(row) {
+			vals[i] = row[i-tdef.PKeys]
+		}
+	}
+	return nil
+}
+
+// decodes a KV pair of the table
+func decodeRecord(tdef *TableDef, key []byte, val []byte) (Record, error) {
+	vals := make([]Value, len(tdef.Cols))
+	for i := 0; i < tdef.PKeys; i++ {
+		vals[i].Type = tdef.Types[i]
+	}
+	if err := decodeValues(key[4:], vals[:tdef.PKeys]); err != nil {
+		return Record{}, err
+	}
+	if err := decodeColumns(tdef, val, vals); err != nil {
+		return Record{}, err
+	}
+	return Record{Cols: append([]string{}, tdef.Cols...), Vals: vals}, nil
+}
+
+// calls `fn` for rows whose leading primary key columns equal `key` in order
+// of the primary key until it returns false. an empty `key` scans the table.
+func dbScan(tx *Tx, tdef *TableDef, key Record, fn func(rec Record) bool) error {
+	n := len(key.Cols)
+	if n > tdef.PKeys {
+		return fmt.Errorf("%w: %d key columns, the primary key has %d", ErrBadRecord, n, tdef.PKeys)
+	}
+	if _, err := checkRecord(tdef, key, n); err != nil {
+		return err
+	}
+	sc := Scanner{Cmp1: CMP_GE, Key1: key, Cmp2: CMP_LE, Key2: key}
+	return scanAll(tx, tdef, &sc, fn)
+}
+
+// the smallest key greater than all keys with the prefix
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) == 0 {
+		return nil
+	}
+	end[len(end)-1]++
+	return end
+}
+
+const (
+	MODE_UPSERT      = 0 // insert or replace
+	MODE_UPDATE_ONLY = 1 // update existing keys
+	MODE_INSERT_ONLY = 2 // only add new keys
+)
+
+// false if nothing was written because of the mode
+func dbUpdate(tx *Tx, tdef *TableDef, rec Record, mode int) (bool, error) {
+	vals, err := checkRecord(tdef, rec, len(tdef.Cols))
+	if err != nil {
+		return false, err
+	}
+	key := encodeKey(nil, tdef.Prefix, vals[:tdef.PKeys])
+	old, exists := tx.kv.Get(key)
+	if (mode == MODE_UPDATE_ONLY && !exists) || (mode == MODE_INSERT_ONLY && exists) {
+		return false, nil
+	}
+	if exists && hasIndexes(tdef) {
+		oldVals := append([]Value{}, vals[:tdef.PKeys]...)
+		oldVals = append(oldVals, make([]Value, len(tdef.Cols)-tdef.PKeys)...)
+		if err := decodeColumns(tdef, old, oldVals); err != nil {
+			return false, err
+		}
+		if err := indexOp(tx, tdef, oldVals, INDEX_DEL); err != nil {
+			return false, err
+		}
+	}
+	val := encodeRow(nil, vals[tdef.PKeys:])
+	if err := tx.kv.Set(key, val); err != nil {
+		return false, err
+	}
+	if err := indexOp(tx, tdef, vals, INDEX_ADD); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func dbDelete(tx *Tx, tdef *TableDef, rec Record) (bool, error) {
+	vals, err := checkRecord(tdef, rec, tdef.PKeys)
+	if err != nil {
+		return false, err
+	}
+	key := encodeKey(nil, tdef.Prefix, vals[:tdef.PKeys])
+	old, exists := tx.kv.Get(key)
+	if !exists {
+		return false, nil
+	}
+	if hasIndexes(tdef) {
+		if err := decodeColumns(tdef, old, vals); err != nil {
+			return false, err
+		}
+		if err := indexOp(tx, tdef, vals, INDEX_DEL); err != nil {
+			return false, err
+		}
+	}
+	if len(tdef.Bitmaps) > 0 {
+		if err := rowIDDel(tx, tdef, vals[:tdef.PKeys]); err != nil {
+			return false, err
+		}
+	}
+	return tx.kv.Del(key)
+}
+
+func (tx *Tx) table(name string) (*TableDef, error) {
+	tdef := tx.getTableDef(name)
+	if tdef == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, name)
+	}
+	return tdef, nil
+}
+
+// the definition of the table, shared by the transaction and read-only
+func (tx *Tx) TableDef(name string) (*TableDef, error) {
+	return tx.table(name)
+}
+
+// names of the tables in order, internal tables are not included
+func (tx *Tx) Tables() ([]string, error) {
+	var names []string
+	err := dbScan(tx, TDEF_TABLE, Record{}, func(rec Record) bool {
+		names = append(names, string(rec.Get("name").Str))
+		return true
+	})
+	return names, err
+}
+
+// looks up the row by the primary key of `rec` and fills the other columns
+func (tx *Tx) Get(table string, rec *Record) (bool, error) {
+	tdef, err := tx.table(table)
+	if err != nil {
+		return false, err
+	}
+	return dbGet(tx, tdef, rec)
+}
+
+// calls `fn` for rows whose leading primary key columns equal `key`,
+// in primary key order until it returns false
+func (tx *Tx) Scan(table string, key Record, fn func(rec Record) bool) error {
+	tdef, err := tx.table(table)
+	if err != nil {
+		return err
+	}
+	return dbScan(tx, tdef, key, fn)
+}
+
+// adds a new row, false if the primary key exists
+func (tx *Tx) Insert(table string, rec Record) (bool, error) {
+	return tx.update(table, rec, MODE_INSERT_ONLY)
+}
+
+// replaces an existing row, false if there is no such primary key
+func (tx *Tx) Update(table string, rec Record) (bool, error) {
+	return tx.update(table, rec, MODE_UPDATE_ONLY)
+}
+
+func (tx *Tx) Upsert(table string, rec Record) (bool, error) {
+	return tx.update(table, rec, MODE_UPSERT)
+}
+
+func (tx *Tx) update(table string, rec Record, mode int) (bool, error) {
+	tdef, err := tx.table(table)
+	if err != nil {
+		return false, err
+	}
+	return dbUpdate(tx, tdef, rec, mode)
+}
+
+// deletes the row by the primary key of `rec`
+func (tx *Tx) Delete(table string, rec Record) (bool, error) {
+	tdef, err := tx.table(table)
+	if err != nil {
+		return false, err
+	}
+	return dbDelete(tx, tdef, rec)
+}
+
+// single-operation transactions
+
+func (db *DB) TableNew(tdef *TableDef) error {
+	tx := db.Begin()
+	if err := tx.TableNew(tdef); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) TableAddColumn(table string, col string, typ uint32) error {
+	tx := db.Begin()
+	if err := tx.TableAddColumn(table, col, typ); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) Get(table string, rec *Record) (bool, error) {
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	return tx.Get(table, rec)
+}
+
+func (db *DB) Insert(table string, rec Record) (bool, error) {
+	return db.update(table, rec, MODE_INSERT_ONLY)
+}
+
+func (db *DB) Update(table string, rec Record) (bool, error) {
+	return db.update(table, rec, MODE_UPDATE_ONLY)
+}
+
+func (db *DB) Upsert(table string, rec Record) (bool, error) {
+	return db.update(table, rec, MODE_UPSERT)
+}
+
+func (db *DB) update(table string, rec Record, mode int) (bool, error) {
+	tx := db.Begin()
+	ok, err := tx.update(table, rec, mode)
+	if err != nil || !ok {
+		tx.Rollback()
+		return ok, err
+	}
+	return true, tx.Commit()
+}
+
+func (db *DB) Delete(table string, rec Record) (bool, error) {
+	tx := db.Begin()
+	ok, err := tx.Delete(table, rec)
+	if err != nil || !ok {
+		tx.Rollback()
+		return ok, err
+	}
+	return true, tx.Commit()
+}
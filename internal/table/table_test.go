@@ -0,0 +1,206 @@
+package table
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func openDB(t *testing.T, path string) *DB {
+	t.Helper()
+	db := &DB{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open(%s): %v", path, err)
+	}
+	return db
+}
+
+func TestTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openDB(t, path)
+
+	users := &TableDef{
+		Name:  "users",
+		Types: []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		Cols:  []string{"id", "name", "age"},
+	}
+	if err := db.TableNew(users); err != nil {
+		t.Fatal(err)
+	}
+	if users.Prefix != TABLE_PREFIX_MIN {
+		t.Fatalf("Prefix = %d; want %d", users.Prefix, TABLE_PREFIX_MIN)
+	}
+	if err := db.TableNew(users); err != ErrTableExists {
+		t.Fatalf("TableNew() of an existing table = %v; want ErrTableExists", err)
+	}
+	for i := 0; i < 10; i++ {
+		rec := (&Record{}).AddStr("name", []byte(fmt.Sprintf("user\x00%d", i))).AddInt64("id", int64(i)).AddInt64("age", int64(20+i))
+		if ok, err := db.Insert("users", *rec); !ok || err != nil {
+			t.Fatalf("Insert(%d) = %v, %v", i, ok, err)
+		}
+	}
+	dup := (&Record{}).AddInt64("id", 1).AddStr("name", []byte("dup")).AddInt64("age", 0)
+	if ok, _ := db.Insert("users", *dup); ok {
+		t.Fatal("Insert() of an existing key succeeded")
+	}
+	if ok, _ := db.Update("users", *dup); !ok {
+		t.Fatal("Update() of an existing key failed")
+	}
+	missing := (&Record{}).AddInt64("id", 100).AddStr("name", []byte("x")).AddInt64("age", 0)
+	if ok, _ := db.Update("users", *missing); ok {
+		t.Fatal("Update() of a missing key succeeded")
+	}
+	if ok, _ := db.Delete("users", *(&Record{}).AddInt64("id", 2)); !ok {
+		t.Fatal("Delete() failed")
+	}
+
+	bad := (&Record{}).AddStr("id", []byte("1")).AddStr("name", nil).AddInt64("age", 0)
+	if _, err := db.Insert("users", *bad); !errors.Is(err, ErrBadRecord) {
+		t.Fatalf("Insert() with a wrong type = %v; want ErrBadRecord", err)
+	}
+	if _, err := db.Insert("nope", *missing); !errors.Is(err, ErrTableNotFound) {
+		t.Fatalf("Insert() into a missing table = %v; want ErrTableNotFound", err)
+	}
+	db.Close()
+
+	db = openDB(t, path)
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		rec := (&Record{}).AddInt64("id", int64(i))
+		ok, err := db.Get("users", rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case i == 2:
+			if ok {
+				t.Fatal("Get() of a deleted row succeeded")
+			}
+		case i == 1:
+			if !ok || string(rec.Get("name").Str) != "dup" {
+				t.Fatalf("Get(1) = %+v; want the updated row", rec)
+			}
+		default:
+			if !ok || string(rec.Get("name").Str) != fmt.Sprintf("user\x00%d", i) || rec.Get("age").I64 != int64(20+i) {
+				t.Fatalf("Get(%d) = %+v", i, rec)
+			}
+		}
+	}
+
+	// a rolled back table doesn't exist
+	tx := db.Begin()
+	tmp := &TableDef{Name: "tmp", Types: []uint32{TYPE_BYTES}, Cols: []string{"k"}}
+	if err := tx.TableNew(tmp); err != nil || tmp.Prefix != TABLE_PREFIX_MIN+1 {
+		t.Fatalf("TableNew() = %v, prefix %d", err, tmp.Prefix)
+	}
+	if names, _ := tx.Tables(); fmt.Sprint(names) != "[tmp users]" {
+		t.Fatalf("Tables() = %v", names)
+	}
+	tx.Rollback()
+	if _, err := db.Get("tmp", (&Record{}).AddStr("k", nil)); !errors.Is(err, ErrTableNotFound) {
+		t.Fatalf("Get() from a rolled back table = %v; want ErrTableNotFound", err)
+	}
+	if err := db.TableNew(&TableDef{Name: "bad", Types: []uint32{TYPE_BYTES}, Cols: []string{"a", "b"}}); err != ErrBadTable {
+		t.Fatalf("TableNew() with a bad definition = %v; want ErrBadTable", err)
+	}
+}
+
+func TestEncodeValues(t *testing.T) {
+	ints := []int64{math.MinInt64, -100, -1, 0, 1, 100, math.MaxInt64}
+	strs := [][]byte{{}, {0}, {0, 0}, {0, 1}, {1}, {1, 0}, {2}, []byte("a"), []byte("a\x00b"), []byte("ab")}
+
+	var encoded [][]byte
+	for _, i := range ints {
+		for _, s := range strs {
+			vals := []Value{{Type: TYPE_INT64, I64: i}, {Type: TYPE_BYTES, Str: s}}
+			enc := encodeValues(nil, vals)
+			out := []Value{{Type: TYPE_INT64}, {Type: TYPE_BYTES}}
+			if err := decodeValues(enc, out); err != nil {
+				t.Fatal(err)
+			}
+			if out[0].I64 != i || !bytes.Equal(out[1].Str, s) {
+				t.Fatalf("decoded %+v; want %d, %q", out, i, s)
+			}
+			encoded = append(encoded, enc)
+		}
+	}
+	// values are listed in order, so are the encodings
+	if !sort.SliceIsSorted(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	}) {
+		t.Fatal("encoding doesn't preserve the order")
+	}
+}
+
+func TestCompositeKey(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	orders := &TableDef{
+		Name:  "orders",
+		Types: []uint32{TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+		Cols:  []string{"region", "id", "item"},
+		PKeys: 2,
+	}
+	if err := db.TableNew(orders); err != nil {
+		t.Fatal(err)
+	}
+	regions := []string{"a", "ab", "b", "a\x00"}
+	for _, region := range regions {
+		for id := -5; id < 5; id++ {
+			rec := (&Record{}).AddStr("region", []byte(region)).AddInt64("id", int64(id)).AddStr("item", []byte(region+fmt.Sprint(id)))
+			if ok, err := db.Insert("orders", *rec); !ok || err != nil {
+				t.Fatalf("Insert(%q, %d) = %v, %v", region, id, ok, err)
+			}
+		}
+	}
+	rec := (&Record{}).AddInt64("id", 3).AddStr("region", []byte("ab"))
+	if ok, _ := db.Get("orders", rec); !ok || string(rec.Get("item").Str) != "ab3" {
+		t.Fatalf("Get(ab, 3) = %+v", rec)
+	}
+	if _, err := db.Get("orders", (&Record{}).AddStr("region", []byte("a"))); !errors.Is(err, ErrBadRecord) {
+		t.Fatalf("Get() with a partial key = %v; want ErrBadRecord", err)
+	}
+
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	var ids []int64
+	err := tx.Scan("orders", *(&Record{}).AddStr("region", []byte("a")), func(rec Record) bool {
+		if string(rec.Get("region").Str) != "a" {
+			t.Fatalf("Scan(a) returned %+v", rec)
+		}
+		ids = append(ids, rec.Get("id").I64)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != "[-5 -4 -3 -2 -1 0 1 2 3 4]" {
+		t.Fatalf("Scan(a) ids = %v", ids)
+	}
+
+	n := 0
+	tx.Scan("orders", Record{}, func(rec Record) bool {
+		n++
+		return true
+	})
+	if n != 40 {
+		t.Fatalf("full scan returned %d rows; want 40", n)
+	}
+	full := (&Record{}).AddStr("region", []byte("b")).AddInt64("id", -5)
+	n = 0
+	tx.Scan("orders", *full, func(rec Record) bool {
+		n++
+		return true
+	})
+	if n != 1 {
+		t.Fatalf("Scan() with the full key returned %d rows; want 1", n)
+	}
+	if err := tx.Scan("orders", *(&Record{}).AddInt64("id", 1), func(Record) bool { return true }); !errors.Is(err, ErrBadRecord) {
+		t.Fatalf("Scan() by a non-leading column = %v; want ErrBadRecord", err)
+	}
+}
@@ -0,0 +1,145 @@
+package table
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	TYPE_ERROR   = 0
+	TYPE_BYTES   = 1
+	TYPE_INT64   = 2
+	TYPE_NULL    = 3 // a value, not a column type
+	TYPE_FLOAT64 = 4
+	TYPE_BOOL    = 5
+	TYPE_STRING  = 6
+	TYPE_TIME    = 7
+)
+
+// a table cell
+//
+//	TYPE_INT64:   I64
+//	TYPE_FLOAT64: F64
+//	TYPE_BOOL:    I64, 0 or 1
+//	TYPE_TIME:    I64, unix nanoseconds in UTC
+//	TYPE_BYTES, TYPE_STRING: Str
+type Value struct {
+	Type uint32
+	I64  int64
+	F64  float64
+	Str  []byte
+}
+
+func Null() Value             { return Value{Type: TYPE_NULL} }
+func Int64(v int64) Value     { return Value{Type: TYPE_INT64, I64: v} }
+func Float64(v float64) Value { return Value{Type: TYPE_FLOAT64, F64: v} }
+func Bytes(v []byte) Value    { return Value{Type: TYPE_BYTES, Str: v} }
+func String(v string) Value   { return Value{Type: TYPE_STRING, Str: []byte(v)} }
+func Time(v time.Time) Value  { return Value{Type: TYPE_TIME, I64: v.UnixNano()} }
+func Bool(v bool) Value {
+	if v {
+		return Value{Type: TYPE_BOOL, I64: 1}
+	}
+	return Value{Type: TYPE_BOOL}
+}
+
+func (v Value) IsNull() bool { return v.Type == TYPE_NULL }
+func (v Value) Bool() bool   { return v.I64 != 0 }
+func (v Value) Time() time.Time {
+	return time.Unix(0, v.I64).UTC()
+}
+
+func isColumnType(typ uint32) bool {
+	switch typ {
+	case TYPE_BYTES, TYPE_INT64, TYPE_FLOAT64, TYPE_BOOL, TYPE_STRING, TYPE_TIME:
+		return true
+	}
+	return false
+}
+
+func (v Value) String() string {
+	switch v.Type {
+	case TYPE_NULL:
+		return "NULL"
+	case TYPE_INT64:
+		return fmt.Sprint(v.I64)
+	case TYPE_FLOAT64:
+		return fmt.Sprint(v.F64)
+	case TYPE_BOOL:
+		return fmt.Sprint(v.Bool())
+	case TYPE_TIME:
+		return v.Time().Format(time.RFC3339Nano)
+	case TYPE_STRING:
+		return string(v.Str)
+	case TYPE_BYTES:
+		return fmt.Sprintf("%q", v.Str)
+	}
+	return "ERROR"
+}
+
+// orders values:
+//   - NULL is equal to NULL and less than other values
+//   - int64 and float64 compare as numbers, NaN is less than other numbers
+//   - bytes and strings compare bytewise, false < true, times by time
+//   - other values of different types are ordered by type
+func Compare(a, b Value) int {
+	switch {
+	case a.Type == TYPE_NULL && b.Type == TYPE_NULL:
+		return 0
+	case a.Type == TYPE_NULL:
+		return -1
+	case b.Type == TYPE_NULL:
+		return 1
+	}
+	if isNumber(a.Type) && isNumber(b.Type) {
+		if a.Type == TYPE_INT64 && b.Type == TYPE_INT64 {
+			return cmp.Compare(a.I64, b.I64)
+		}
+		return compareFloat(a, b)
+	}
+	if isString(a.Type) && isString(b.Type) {
+		return bytes.Compare(a.Str, b.Str)
+	}
+	if a.Type != b.Type {
+		return cmp.Compare(a.Type, b.Type)
+	}
+	switch a.Type {
+	case TYPE_BOOL, TYPE_TIME:
+		return cmp.Compare(a.I64, b.I64)
+	}
+	return 0
+}
+
+func isNumber(typ uint32) bool { return typ == TYPE_INT64 || typ == TYPE_FLOAT64 }
+func isString(typ uint32) bool { return typ == TYPE_BYTES || typ == TYPE_STRING }
+
+// int64 with float64 without losing precision of large ints
+func compareFloat(a, b Value) int {
+	if a.Type == TYPE_INT64 {
+		return -compareIntFloat(b.F64, a.I64)
+	}
+	if b.Type == TYPE_INT64 {
+		return compareIntFloat(a.F64, b.I64)
+	}
+	return cmp.Compare(a.F64, b.F64)
+}
+
+func compareIntFloat(f float64, i int64) int {
+	switch {
+	case math.IsNaN(f) || f < -(1<<63):
+		return -1
+	case f >= 1<<63:
+		return 1
+	}
+	t := math.Floor(f) // an int64 now
+	if c := cmp.Compare(int64(t), i); c != 0 {
+		return c
+	}
+	if f > t {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package table
+
+import (
+	"bytes"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompare(t *testing.T) {
+	cases := []struct {
+		a, b Value
+		want int
+	}{
+		{Null(), Null(), 0},
+		{Null(), Int64(math.MinInt64), -1},
+		{Bool(false), Null(), 1},
+		{Int64(1), Float64(1), 0},
+		{Int64(1), Float64(1.5), -1},
+		{Float64(-1.5), Int64(-1), -1},
+		{Int64(math.MaxInt64), Float64(math.MaxInt64), -1}, // the float is 2^63
+		{Int64(math.MinInt64), Float64(math.MinInt64), 0},
+		{Float64(math.NaN()), Int64(math.MinInt64), -1},
+		{Float64(math.Inf(-1)), Float64(-1e308), -1},
+		{String("a"), Bytes([]byte("a")), 0},
+		{String("a"), String("ab"), -1},
+		{Bool(false), Bool(true), -1},
+		{Time(time.Unix(1, 0)), Time(time.Unix(0, 1)), 1},
+		{Int64(5), String("5"), -1}, // by type
+	}
+	for _, c := range cases {
+		if got := Compare(c.a, c.b); got != c.want {
+			t.Errorf("Compare(%v, %v) = %d; want %d", c.a, c.b, got, c.want)
+		}
+		if got := Compare(c.b, c.a); got != -c.want {
+			t.Errorf("Compare(%v, %v) = %d; want %d", c.b, c.a, got, -c.want)
+		}
+	}
+}
+
+// the key encoding orders values like Compare
+func TestKeyOrder(t *testing.T) {
+	columns := [][]Value{
+		{Null(), Int64(math.MinInt64), Int64(-1), Int64(0), Int64(1), Int64(math.MaxInt64)},
+		{Null(), Float64(math.NaN()), Float64(math.Inf(-1)), Float64(-1.5), Float64(-math.SmallestNonzeroFloat64), Float64(0), Float64(math.SmallestNonzeroFloat64), Float64(2), Float64(math.Inf(1))},
+		{Null(), Bool(false), Bool(true)},
+		{Null(), String(""), String("\x00"), String("\x01"), String("a"), String("a\x00"), String("b")},
+		{Null(), Time(time.Unix(-1, 0)), Time(time.Unix(0, 0)), Time(time.Unix(0, 1))},
+	}
+	for _, vals := range columns {
+		for i := range vals {
+			for j := range vals {
+				a := encodeValues(nil, []Value{vals[i]})
+				b := encodeValues(nil, []Value{vals[j]})
+				if got, want := bytes.Compare(a, b), Compare(vals[i], vals[j]); got != want {
+					t.Fatalf("encodings of %v, %v compare %d; want %d", vals[i], vals[j], got, want)
+				}
+				out := []Value{{Type: vals[i].Type}}
+				if err := decodeValues(a, out); err != nil || Compare(out[0], vals[i]) != 0 {
+					t.Fatalf("decodeValues(%v) = %v, %v", vals[i], out[0], err)
+				}
+			}
+		}
+	}
+	if a, b := encodeValues(nil, []Value{Float64(0)}), encodeValues(nil, []Value{Float64(math.Copysign(0, -1))}); !bytes.Equal(a, b) {
+		t.Fatal("-0 and 0 are encoded differently")
+	}
+}
+
+func TestTypedColumns(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	events := &TableDef{
+		Name:    "events",
+		Types:   []uint32{TYPE_TIME, TYPE_STRING, TYPE_FLOAT64, TYPE_BOOL},
+		Cols:    []string{"at", "name", "score", "done"},
+		Indexes: [][]string{{"score"}},
+	}
+	if err := db.TableNew(events); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	rows := []Record{
+		*(&Record{}).Add("at", Time(at)).Add("name", String("a")).Add("score", Float64(2.5)).Add("done", Bool(true)),
+		*(&Record{}).Add("at", Time(at.Add(time.Second))).Add("name", Null()).Add("score", Null()).Add("done", Bool(false)),
+		*(&Record{}).Add("at", Time(at.Add(2*time.Second))).Add("name", String("c")).Add("score", Float64(-1)).Add("done", Null()),
+	}
+	for _, rec := range rows {
+		if ok, err := db.Insert("events", rec); !ok || err != nil {
+			t.Fatalf("Insert(%v) = %v, %v", rec.Vals, ok, err)
+		}
+	}
+	nullKey := (&Record{}).Add("at", Null()).Add("name", Null()).Add("score", Null()).Add("done", Null())
+	if _, err := db.Insert("events", *nullKey); err == nil {
+		t.Fatal("Insert() with a NULL primary key succeeded")
+	}
+
+	rec := (&Record{}).Add("at", Time(at))
+	if ok, _ := db.Get("events", rec); !ok || !rec.Get("at").Time().Equal(at) || rec.Get("name").String() != "a" || !rec.Get("done").Bool() || rec.Get("score").F64 != 2.5 {
+		t.Fatalf("Get() = %v", rec.Vals)
+	}
+
+	// NULL sorts first in the index
+	tx := db.BeginRead()
+	defer tx.Rollback()
+	var scores []string
+	tx.ScanIndex("events", Record{}, func(rec Record) bool {
+		scores = append(scores, rec.Get("score").String())
+		return true
+	})
+	if len(scores) != 3 || scores[0] != "NULL" || scores[1] != "-1" || scores[2] != "2.5" {
+		t.Fatalf("index order = %v", scores)
+	}
+	n := 0
+	tx.ScanIndex("events", *(&Record{}).Add("score", Null()), func(rec Record) bool {
+		n++
+		return true
+	})
+	if n != 1 {
+		t.Fatalf("ScanIndex(NULL) returned %d rows; want 1", n)
+	}
+}
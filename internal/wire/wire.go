@@ -0,0 +1,262 @@
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Requests and responses are frames:
+//
+// | len | payload |
+// | 4B  |   ...   |
+//
+// request payload
+// | op | args ... |
+// | 1B |
+//
+// response payload
+// | status | data ... |
+// |   1B   |
+//
+// args and data are byte strings with a 4-byte length, numbers are 4 bytes
+// unless noted, flags are 1 byte, everything is big-endian.
+//
+//	GET key                  -> OK val | NOT_FOUND
+//	SET key val              -> OK
+//	DEL key                  -> OK deleted
+//	SCAN start end limit     -> OK more n (key val)*n, empty end is the last key
+//	BEGIN writable           -> OK
+//	COMMIT, ROLLBACK         -> OK
+//	AUTH user password       -> OK
+//	USE namespace            -> OK, "/" is the main keyspace, others are buckets
+//	DROP namespace           -> OK dropped
+//	USER_SET name password n rule*n -> OK, rules are pattern=perm
+//	USER_DEL name            -> OK deleted
+//	QUERY sql args           -> OK result
+//	PREPARE sql              -> OK id nparams
+//	EXECUTE id args          -> OK result
+//	CLOSE_STMT id            -> OK closed
+//	SET_OPTION name value    -> OK, see below
+//	WATCH start end          -> OK, then OK change frames until the connection
+//	                            closes or ERR, empty end is the last key
+//	REPLICATE                -> OK, then OK replication frames until the
+//	                            connection closes or ERR, needs *=admin
+//	CHANGES from(8B)         -> OK, then OK entry frames until the connection
+//	                            closes or ERR, 0 is the oldest entry kept
+//
+// SQL runs in the main keyspace, args are the values of the ? parameters
+// as one byte string in the format of table.EncodeRow.
+//
+// result
+// | affected | ncols | col*ncols | nrows | row*nrows |
+// |    4B    |  4B   |           |  4B   |           |
+//
+// rows are byte strings in the format of table.EncodeRow.
+//
+// change
+// | seq | flags | key | old | new |
+// | 8B  |  1B   |     |     |     |
+//
+// flags: CHANGE_OLD if the key existed, CHANGE_NEW unless it was deleted.
+//
+// entry of the changefeed
+// | seq | op | namespace | key | value |
+// | 8B  | 1B |           |     |       |
+//
+// op: ENTRY_SET or ENTRY_DEL with an empty value.
+//
+// replication
+// | kind | data |
+// |  1B  |      |
+//
+//	REPL_PAGES     (ptr 8B, page)*, pages of the database file
+//	REPL_SNAPSHOT  seq(8B), the pages so far are a snapshot, the file of a
+//	               database at the commit sequence seq
+//	REPL_COMMIT    meta, the pages since the last commit and the meta page
+//	               are a durable batch of the leader
+//
+// options of the session:
+//
+//	isolation snapshot        reads of a read transaction see the data at BEGIN
+//	isolation read_committed  every request of a read transaction sees the
+//	                          latest commit
+//
+// any request can fail with ERR message. the server may close an idle
+// connection after sending ERR with the reason.
+
+const (
+	OP_GET        = 1
+	OP_SET        = 2
+	OP_DEL        = 3
+	OP_SCAN       = 4
+	OP_BEGIN      = 5
+	OP_COMMIT     = 6
+	OP_ROLLBACK   = 7
+	OP_AUTH       = 8
+	OP_USE        = 9
+	OP_DROP       = 10
+	OP_USER_SET   = 11
+	OP_USER_DEL   = 12
+	OP_QUERY      = 13
+	OP_PREPARE    = 14
+	OP_EXECUTE    = 15
+	OP_CLOSE_STMT = 16
+	OP_SET_OPTION = 17
+	OP_WATCH      = 18
+	OP_REPLICATE  = 19
+	OP_CHANGES    = 20
+)
+
+const (
+	CHANGE_OLD = 1
+	CHANGE_NEW = 2
+)
+
+const (
+	ENTRY_SET = 1
+	ENTRY_DEL = 2
+)
+
+const (
+	REPL_PAGES    = 1
+	REPL_SNAPSHOT = 2
+	REPL_COMMIT   = 3
+)
+
+const (
+	STATUS_OK        = 0
+	STATUS_NOT_FOUND = 1
+	STATUS_ERR       = 2
+)
+
+const MAX_FRAME = 16 << 20
+
+var ErrProtocol = errors.New("protocol error")
+
+func ReadFrame(r *bufio.Reader) ([]byte, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(head[:])
+	if size == 0 || size > MAX_FRAME {
+		return nil, fmt.Errorf("%w: frame of %d bytes", ErrProtocol, size)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func WriteFrame(w *bufio.Writer, payload []byte) error {
+	if len(payload) == 0 || len(payload) > MAX_FRAME {
+		return fmt.Errorf("%w: frame of %d bytes", ErrProtocol, len(payload))
+	}
+	if _, err := w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(payload)))); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func AppendBytes(out []byte, b []byte) []byte {
+	out = binary.BigEndian.AppendUint32(out, uint32(len(b)))
+	return append(out, b...)
+}
+
+func AppendUint32(out []byte, n uint32) []byte {
+	return binary.BigEndian.AppendUint32(out, n)
+}
+
+func AppendUint64(out []byte, n uint64) []byte {
+	return binary.BigEndian.AppendUint64(out, n)
+}
+
+// reads the fields of a payload, the first error is kept
+type Reader struct {
+	buf []byte
+	err error
+}
+
+func NewReader(payload []byte) *Reader {
+	return &Reader{buf: payload}
+}
+
+func (r *Reader) Byte() byte {
+	if r.err != nil || len(r.buf) < 1 {
+		r.fail()
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *Reader) Uint32() uint32 {
+	if r.err != nil || len(r.buf) < 4 {
+		r.fail()
+		return 0
+	}
+	n := binary.BigEndian.Uint32(r.buf)
+	r.buf = r.buf[4:]
+	return n
+}
+
+func (r *Reader) Uint64() uint64 {
+	if r.err != nil || len(r.buf) < 8 {
+		r.fail()
+		return 0
+	}
+	n := binary.BigEndian.Uint64(r.buf)
+	r.buf = r.buf[8:]
+	return n
+}
+
+// the returned slice points into the payload
+func (r *Reader) Bytes() []byte {
+	size := r.Uint32()
+	if r.err != nil || uint64(size) > uint64(len(r.buf)) {
+		r.fail()
+		return nil
+	}
+	b := r.buf[:size:size]
+	r.buf = r.buf[size:]
+	return b
+}
+
+// the rest of the payload
+func (r *Reader) Rest() []byte {
+	b := r.buf
+	r.buf = nil
+	return b
+}
+
+// the number of bytes left
+func (r *Reader) Len() int {
+	return len(r.buf)
+}
+
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// the first error, or an error if the payload has extra bytes
+func (r *Reader) Done() error {
+	if r.err == nil && len(r.buf) > 0 {
+		r.fail()
+	}
+	return r.err
+}
+
+func (r *Reader) fail() {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: bad payload", ErrProtocol)
+	}
+	r.buf = nil
+}